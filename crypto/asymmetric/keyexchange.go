@@ -16,7 +16,15 @@
 
 package asymmetric
 
-import ec "github.com/btcsuite/btcd/btcec"
+import (
+	"errors"
+
+	ec "github.com/btcsuite/btcd/btcec"
+	"github.com/thunderdb/ThunderDB/crypto/hash"
+)
+
+// SharedSecretLen is the length of the symmetric key returned by PrivateKey.SharedSecret.
+const SharedSecretLen = hash.HashBSize
 
 // GenECDHSharedSecret is just a wrapper of ec.GenerateSharedSecret which
 // generates a shared secret based on a private key and a
@@ -27,3 +35,18 @@ import ec "github.com/btcsuite/btcd/btcec"
 func GenECDHSharedSecret(privateKey *PrivateKey, publicKey *PublicKey) []byte {
 	return ec.GenerateSharedSecret((*ec.PrivateKey)(privateKey), (*ec.PublicKey)(publicKey))
 }
+
+// SharedSecret derives a SharedSecretLen bytes symmetric key from the ECDH shared point of
+// private and remote, the raw x coordinate is hashed by hash.DoubleHashB as etls does for its
+// key derivation.
+// Key Feature:
+// 		APriv.SharedSecret(BPub) == BPriv.SharedSecret(APub)
+func (private *PrivateKey) SharedSecret(remote *PublicKey) ([]byte, error) {
+	if private == nil || remote == nil {
+		return nil, errors.New("nil key for shared secret")
+	}
+	if remote.X == nil || remote.Y == nil || !ec.S256().IsOnCurve(remote.X, remote.Y) {
+		return nil, errors.New("remote public key is not on secp256k1 curve")
+	}
+	return hash.DoubleHashB(GenECDHSharedSecret(private, remote)), nil
+}
@@ -69,6 +69,35 @@ func TestGenECDHSharedSecret(t *testing.T) {
 	//t.Log(shared1)
 }
 
+func TestPrivateKey_SharedSecret(t *testing.T) {
+	Convey("shared secret", t, func() {
+		privateKey1, publicKey1, _ := GenSecp256k1KeyPair()
+		privateKey2, publicKey2, _ := GenSecp256k1KeyPair()
+		privateKey3, publicKey3, _ := GenSecp256k1KeyPair()
+
+		shared12, err := privateKey1.SharedSecret(publicKey2)
+		So(err, ShouldBeNil)
+		So(len(shared12), ShouldEqual, SharedSecretLen)
+		shared21, err := privateKey2.SharedSecret(publicKey1)
+		So(err, ShouldBeNil)
+		So(shared12, ShouldResemble, shared21)
+
+		shared13, err := privateKey1.SharedSecret(publicKey3)
+		So(err, ShouldBeNil)
+		shared32, err := privateKey3.SharedSecret(publicKey2)
+		So(err, ShouldBeNil)
+		So(shared13, ShouldNotResemble, shared12)
+		So(shared32, ShouldNotResemble, shared12)
+	})
+	Convey("shared secret error", t, func() {
+		privateKey, _, _ := GenSecp256k1KeyPair()
+		_, err := privateKey.SharedSecret(nil)
+		So(err, ShouldNotBeNil)
+		_, err = privateKey.SharedSecret(&PublicKey{})
+		So(err, ShouldNotBeNil)
+	})
+}
+
 func TestGetPubKeyNonce(t *testing.T) {
 	Convey("translate key error", t, func() {
 		privateKey, publicKey, err := GenSecp256k1KeyPair()
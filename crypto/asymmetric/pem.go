@@ -0,0 +1,92 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package asymmetric
+
+import (
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+const (
+	// PrivateKeyPEMType is the PEM block type of a secp256k1 private key.
+	PrivateKeyPEMType = "THUNDERDB SECP256K1 PRIVATE KEY"
+	// PublicKeyPEMType is the PEM block type of a secp256k1 public key.
+	PublicKeyPEMType = "THUNDERDB SECP256K1 PUBLIC KEY"
+)
+
+// ErrNoPEMBlock indicates no PEM block is found in the input.
+var ErrNoPEMBlock = errors.New("no PEM block found")
+
+// MarshalPEM encodes the private key into a PEM block of PrivateKeyPEMType, the block body is
+// the 32 bytes returned by Serialize.
+func (private *PrivateKey) MarshalPEM() ([]byte, error) {
+	if private == nil {
+		return nil, errors.New("nil private key")
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  PrivateKeyPEMType,
+		Bytes: private.Serialize(),
+	}), nil
+}
+
+// ParsePrivateKeyPEM decodes the first PEM block of data into a private key.
+func ParsePrivateKeyPEM(data []byte) (*PrivateKey, error) {
+	body, err := decodePEM(data, PrivateKeyPEMType)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) != PrivateKeyBytesLen {
+		return nil, fmt.Errorf("private key length should be %d, got %d",
+			PrivateKeyBytesLen, len(body))
+	}
+	private, _ := PrivKeyFromBytes(body)
+	return private, nil
+}
+
+// MarshalPEM encodes the public key into a PEM block of PublicKeyPEMType, the block body is the
+// compressed form returned by Serialize.
+func (k *PublicKey) MarshalPEM() ([]byte, error) {
+	keyBytes, err := k.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  PublicKeyPEMType,
+		Bytes: keyBytes,
+	}), nil
+}
+
+// ParsePublicKeyPEM decodes the first PEM block of data into a public key.
+func ParsePublicKeyPEM(data []byte) (*PublicKey, error) {
+	body, err := decodePEM(data, PublicKeyPEMType)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePubKey(body)
+}
+
+func decodePEM(data []byte, blockType string) ([]byte, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, ErrNoPEMBlock
+	}
+	if block.Type != blockType {
+		return nil, fmt.Errorf("unexpected PEM block type %q, want %q", block.Type, blockType)
+	}
+	return block.Bytes, nil
+}
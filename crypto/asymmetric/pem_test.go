@@ -0,0 +1,72 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package asymmetric
+
+import (
+	"bytes"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPEM(t *testing.T) {
+	Convey("private key round trip", t, func() {
+		privateKey, _, err := GenSecp256k1KeyPair()
+		So(err, ShouldBeNil)
+		data, err := privateKey.MarshalPEM()
+		So(err, ShouldBeNil)
+		So(bytes.HasPrefix(data, []byte("-----BEGIN "+PrivateKeyPEMType+"-----")), ShouldBeTrue)
+
+		parsed, err := ParsePrivateKeyPEM(data)
+		So(err, ShouldBeNil)
+		So(parsed.Serialize(), ShouldResemble, privateKey.Serialize())
+		So(parsed.PubKey().IsEqual(privateKey.PubKey()), ShouldBeTrue)
+	})
+	Convey("public key round trip", t, func() {
+		_, publicKey, err := GenSecp256k1KeyPair()
+		So(err, ShouldBeNil)
+		data, err := publicKey.MarshalPEM()
+		So(err, ShouldBeNil)
+		So(bytes.HasPrefix(data, []byte("-----BEGIN "+PublicKeyPEMType+"-----")), ShouldBeTrue)
+
+		parsed, err := ParsePublicKeyPEM(data)
+		So(err, ShouldBeNil)
+		So(parsed.IsEqual(publicKey), ShouldBeTrue)
+		So(parsed.Serialize(), ShouldResemble, publicKey.Serialize())
+	})
+	Convey("wrong block type", t, func() {
+		privateKey, publicKey, err := GenSecp256k1KeyPair()
+		So(err, ShouldBeNil)
+		privData, _ := privateKey.MarshalPEM()
+		pubData, _ := publicKey.MarshalPEM()
+
+		_, err = ParsePublicKeyPEM(privData)
+		So(err, ShouldNotBeNil)
+		_, err = ParsePrivateKeyPEM(pubData)
+		So(err, ShouldNotBeNil)
+	})
+	Convey("invalid input", t, func() {
+		_, err := ParsePrivateKeyPEM([]byte("not a pem"))
+		So(err, ShouldEqual, ErrNoPEMBlock)
+		_, err = ParsePublicKeyPEM(nil)
+		So(err, ShouldEqual, ErrNoPEMBlock)
+
+		var nilKey *PrivateKey
+		_, err = nilKey.MarshalPEM()
+		So(err, ShouldNotBeNil)
+	})
+}
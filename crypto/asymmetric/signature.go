@@ -19,7 +19,10 @@ package asymmetric
 import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
+	"fmt"
 	"math/big"
+	"runtime"
+	"sync"
 
 	ec "github.com/btcsuite/btcd/btcec"
 )
@@ -63,8 +66,77 @@ func (private *PrivateKey) Sign(hash []byte) (*Signature, error) {
 	return (*Signature)(s), e
 }
 
+// SignCompact generates a recoverable compact ECDSA signature for the provided hash. The 65-byte
+// result is the recovery code followed by R and S, so the signer public key can be restored by
+// RecoverPubKey and need not be transmitted along with the signature.
+func (private *PrivateKey) SignCompact(hash []byte) ([]byte, error) {
+	return ec.SignCompact(ec.S256(), (*ec.PrivateKey)(private), hash, true)
+}
+
+// RecoverPubKey recovers the signer public key from a compact signature produced by SignCompact.
+// A nil error only means the signature is well formed, the caller must still check the returned
+// key against the expected signer, e.g. by its node ID.
+func RecoverPubKey(hash []byte, sig []byte) (*PublicKey, error) {
+	key, _, err := ec.RecoverCompact(ec.S256(), sig, hash)
+	return (*PublicKey)(key), err
+}
+
 // Verify calls ecdsa.Verify to verify the signature of hash using the public key. It returns true
 // if the signature is valid, false otherwise.
 func (s *Signature) Verify(hash []byte, signee *PublicKey) bool {
 	return ecdsa.Verify(signee.toECDSA(), hash, s.R, s.S)
 }
+
+// BatchVerifyItem is a hash, signature and signee tuple to be verified by BatchVerify.
+type BatchVerifyItem struct {
+	Hash []byte
+	Sig  *Signature
+	Pub  *PublicKey
+}
+
+// BatchVerify verifies all items in parallel, secp256k1 ECDSA has no batch verification
+// algorithm, so the items are spread over runtime.NumCPU() goroutines. It returns true if all
+// the signatures are valid, otherwise the ascending indices of the invalid ones. An error is
+// returned without verifying anything if any item misses its signature or public key.
+func BatchVerify(items []BatchVerifyItem) (ok bool, invalid []int, err error) {
+	for i := range items {
+		if items[i].Sig == nil || items[i].Pub == nil {
+			return false, nil, fmt.Errorf("batch verify item %d: nil signature or public key", i)
+		}
+	}
+
+	var (
+		wg      sync.WaitGroup
+		next    = make(chan int)
+		results = make([]bool, len(items))
+		workers = runtime.NumCPU()
+	)
+
+	if workers > len(items) {
+		workers = len(items)
+	}
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				results[i] = items[i].Sig.Verify(items[i].Hash, items[i].Pub)
+			}
+		}()
+	}
+
+	for i := range items {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	for i, valid := range results {
+		if !valid {
+			invalid = append(invalid, i)
+		}
+	}
+
+	return len(invalid) == 0, invalid, nil
+}
@@ -18,6 +18,7 @@ package asymmetric
 
 import (
 	"bytes"
+	"math/big"
 	"math/rand"
 	"reflect"
 	"testing"
@@ -92,6 +93,83 @@ func TestSign(t *testing.T) {
 	}
 }
 
+func TestRecoverPubKey(t *testing.T) {
+	hash := make([]byte, 32)
+	rand.Read(hash)
+
+	sig, err := priv.SignCompact(hash)
+	if err != nil {
+		t.Fatalf("could not sign: %v", err)
+	}
+
+	recovered, err := RecoverPubKey(hash, sig)
+	if err != nil {
+		t.Fatalf("could not recover public key: %v", err)
+	}
+	if !recovered.IsEqual(pub) {
+		t.Errorf("unexpected public key - got: %x, want: %x",
+			recovered.Serialize(), pub.Serialize())
+	}
+
+	// recovered key should also verify the R, S part as a normal signature
+	normalSig := &Signature{
+		R: new(big.Int).SetBytes(sig[1:33]),
+		S: new(big.Int).SetBytes(sig[33:]),
+	}
+	if !normalSig.Verify(hash, recovered) {
+		t.Error("could not verify with recovered public key")
+	}
+
+	// corrupted signature should never recover the signer
+	corrupted := make([]byte, len(sig))
+	copy(corrupted, sig)
+	corrupted[10] ^= 0xff
+	if key, err := RecoverPubKey(hash, corrupted); err == nil && key.IsEqual(pub) {
+		t.Error("corrupted signature recovered the signer public key")
+	}
+
+	if _, err := RecoverPubKey(hash, sig[:64]); err == nil {
+		t.Error("truncated signature should fail")
+	}
+}
+
+func TestBatchVerify(t *testing.T) {
+	items := make([]BatchVerifyItem, 16)
+	for i := range items {
+		hash := make([]byte, 32)
+		rand.Read(hash)
+		sig, err := priv.Sign(hash)
+		if err != nil {
+			t.Fatalf("could not sign: %v", err)
+		}
+		items[i] = BatchVerifyItem{Hash: hash, Sig: sig, Pub: pub}
+	}
+
+	ok, invalid, err := BatchVerify(items)
+	if !ok || len(invalid) != 0 || err != nil {
+		t.Errorf("BatchVerify of valid items got %v, %v, %v", ok, invalid, err)
+	}
+
+	// tamper some of them
+	_, otherPub, _ := GenSecp256k1KeyPair()
+	items[3].Pub = otherPub
+	items[7].Hash = []byte("tampered")
+	items[15].Sig = items[0].Sig
+	ok, invalid, err = BatchVerify(items)
+	if ok || err != nil || !reflect.DeepEqual(invalid, []int{3, 7, 15}) {
+		t.Errorf("BatchVerify of tampered items got %v, %v, %v", ok, invalid, err)
+	}
+
+	items[5].Sig = nil
+	if ok, _, err = BatchVerify(items); ok || err == nil {
+		t.Errorf("BatchVerify with nil signature should fail")
+	}
+
+	if ok, invalid, err = BatchVerify(nil); !ok || len(invalid) != 0 || err != nil {
+		t.Errorf("BatchVerify of no item got %v, %v, %v", ok, invalid, err)
+	}
+}
+
 func BenchmarkGenKey(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		if _, _, err := GenSecp256k1KeyPair(); err != nil {
@@ -20,6 +20,7 @@
 package etls
 
 import (
+	"context"
 	"io"
 	"net"
 	"time"
@@ -33,6 +34,7 @@ type CryptoConn struct {
 	net.Conn
 	*Cipher
 	NodeID *proto.RawNodeID
+	record *recordState
 }
 
 // NewConn returns a new CryptoConn
@@ -44,10 +46,37 @@ func NewConn(c net.Conn, cipher *Cipher, nodeID *proto.RawNodeID) *CryptoConn {
 	}
 }
 
+// DefaultDialTimeout bounds the connection establishment of Dial and DialWithOptions.
+const DefaultDialTimeout = 10 * time.Second
+
 // Dial connects to a address with a Cipher
 // address should be in the form of host:port
+// The connection establishment is bounded by DefaultDialTimeout, see DialTimeout.
 func Dial(network, address string, cipher *Cipher) (c *CryptoConn, err error) {
-	conn, err := net.Dial(network, address)
+	return DialTimeout(network, address, cipher, DefaultDialTimeout)
+}
+
+// DialTimeout connects to a address with a Cipher like Dial, but fails with a timeout error if
+// the connection is not established within timeout. No timeout is applied if it's not positive.
+func DialTimeout(network, address string, cipher *Cipher, timeout time.Duration) (
+	c *CryptoConn, err error) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return DialContext(ctx, network, address, cipher)
+}
+
+// DialContext connects to a address with a Cipher like Dial, and returns promptly with the
+// context error if ctx is done before the connection is established. The cipher state is set up
+// on the first read and write, so there is no handshake round trip to wait for after the TCP
+// connection is established.
+func DialContext(ctx context.Context, network, address string, cipher *Cipher) (
+	c *CryptoConn, err error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, address)
 	if err != nil {
 		log.Errorf("connect to %s failed: %s", address, err)
 		return
@@ -57,6 +86,19 @@ func Dial(network, address string, cipher *Cipher) (c *CryptoConn, err error) {
 	return
 }
 
+// DialWithOptions connects to a address with a Cipher like Dial, and switches the connection to
+// record mode with options, see ConnOptions.
+func DialWithOptions(network, address string, cipher *Cipher, options *ConnOptions) (
+	c *CryptoConn, err error) {
+	if c, err = Dial(network, address, cipher); err != nil {
+		return
+	}
+	if options != nil {
+		c.startRecordMode(options)
+	}
+	return
+}
+
 // RawRead is the raw net.Conn.Read
 func (c *CryptoConn) RawRead(b []byte) (n int, err error) {
 	return c.Conn.Read(b)
@@ -64,6 +106,14 @@ func (c *CryptoConn) RawRead(b []byte) (n int, err error) {
 
 // Read iv and Encrypted data
 func (c *CryptoConn) Read(b []byte) (n int, err error) {
+	if c.record != nil {
+		return c.record.pr.Read(b)
+	}
+	return c.readStream(b)
+}
+
+// readStream reads and decrypts data from the underlying connection
+func (c *CryptoConn) readStream(b []byte) (n int, err error) {
 	if c.decStream == nil {
 		iv := make([]byte, c.info.ivLen)
 		if _, err = io.ReadFull(c.Conn, iv); err != nil {
@@ -98,6 +148,14 @@ func (c *CryptoConn) RawWrite(b []byte) (n int, err error) {
 
 // Write iv and Encrypted data
 func (c *CryptoConn) Write(b []byte) (n int, err error) {
+	if c.record != nil {
+		return c.writeData(b)
+	}
+	return c.writeStream(b)
+}
+
+// writeStream encrypts and writes data to the underlying connection
+func (c *CryptoConn) writeStream(b []byte) (n int, err error) {
 	var iv []byte
 	if c.encStream == nil {
 		iv, err = c.initEncrypt()
@@ -123,6 +181,9 @@ func (c *CryptoConn) Write(b []byte) (n int, err error) {
 // Close closes the connection.
 // Any blocked Read or Write operations will be unblocked and return errors.
 func (c *CryptoConn) Close() error {
+	if c.record != nil {
+		return c.closeRecord(nil)
+	}
 	return c.Conn.Close()
 }
 
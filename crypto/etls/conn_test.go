@@ -17,9 +17,12 @@
 package etls
 
 import (
+	"context"
+	"fmt"
 	"net"
 	"net/rpc"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 
@@ -155,3 +158,74 @@ func TestCryptoConn_RawRead(t *testing.T) {
 		}()
 	})
 }
+
+// blackHole returns the address of a listener which never accepts, and its accept queue is
+// filled, so that the SYN packets to it are dropped and the connecting hangs.
+func blackHole() (addr string, close func()) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	So(err, ShouldBeNil)
+	So(syscall.Bind(fd, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}), ShouldBeNil)
+	So(syscall.Listen(fd, 0), ShouldBeNil)
+	sa, err := syscall.Getsockname(fd)
+	So(err, ShouldBeNil)
+	addr = fmt.Sprintf("127.0.0.1:%d", sa.(*syscall.SockaddrInet4).Port)
+
+	var conns []net.Conn
+	for {
+		conn, err := net.DialTimeout("tcp", addr, 100*time.Millisecond)
+		if err != nil {
+			break
+		}
+		conns = append(conns, conn)
+	}
+
+	return addr, func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+		syscall.Close(fd)
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	cipher := NewCipher([]byte(pass))
+
+	Convey("dial black-holed address", t, func() {
+		addr, close := blackHole()
+		defer close()
+
+		start := time.Now()
+		conn, err := DialTimeout("tcp", addr, cipher, 200*time.Millisecond)
+		So(err, ShouldNotBeNil)
+		So(conn, ShouldBeNil)
+		So(time.Since(start), ShouldBeGreaterThanOrEqualTo, 200*time.Millisecond)
+		So(time.Since(start), ShouldBeLessThan, time.Second)
+	})
+	Convey("dial with done context", t, func() {
+		addr, close := blackHole()
+		defer close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(100*time.Millisecond, cancel)
+		start := time.Now()
+		conn, err := DialContext(ctx, "tcp", addr, cipher)
+		So(err, ShouldNotBeNil)
+		So(conn, ShouldBeNil)
+		So(time.Since(start), ShouldBeLessThan, time.Second)
+	})
+	Convey("dial reachable address", t, func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer l.Close()
+
+		conn, err := DialTimeout("tcp", l.Addr().String(), cipher, time.Second)
+		So(err, ShouldBeNil)
+		So(conn.RemoteAddr().String(), ShouldEqual, l.Addr().String())
+		So(conn.Close(), ShouldBeNil)
+
+		// no timeout
+		conn, err = DialTimeout("tcp", l.Addr().String(), cipher, 0)
+		So(err, ShouldBeNil)
+		So(conn.Close(), ShouldBeNil)
+	})
+}
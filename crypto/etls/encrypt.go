@@ -94,20 +94,30 @@ type Cipher struct {
 
 // NewCipher creates a cipher that can be used in Dial(), Listen() etc.
 func NewCipher(rawKey []byte) (c *Cipher) {
+	// KDFDoubleSHA256 never fails
+	c, _ = NewCipherWithOptions(rawKey, nil)
+	return
+}
+
+// NewCipherWithOptions creates a cipher like NewCipher, but derives the key from rawKey with
+// options, see CipherOptions. Nil options are compatible with NewCipher.
+func NewCipherWithOptions(rawKey []byte, options *CipherOptions) (c *Cipher, err error) {
 	mi := &cipherInfo{
 		32,
 		16,
 		newAESCFBDecStream,
 		newAESCFBEncStream,
 	}
-	hSuite := &hash.HashSuite{
-		HashLen:  hash.HashBSize,
-		HashFunc: hash.DoubleHashB,
+	if options == nil {
+		options = &CipherOptions{}
+	}
+	key, err := options.deriveKey(rawKey, mi.keyLen)
+	if err != nil {
+		return
 	}
-	key := KeyDerivation(rawKey, mi.keyLen, hSuite)
 	c = &Cipher{key: key, info: mi}
 
-	return c
+	return
 }
 
 // initEncrypt Initializes the block cipher with CFB mode, returns IV.
@@ -21,6 +21,10 @@ import (
 
 	"bytes"
 
+	"crypto/sha256"
+
+	"encoding/hex"
+
 	. "github.com/smartystreets/goconvey/convey"
 	"github.com/thunderdb/ThunderDB/crypto/hash"
 )
@@ -37,3 +41,53 @@ func TestKeyDerivation(t *testing.T) {
 		So(dKey, ShouldHaveLength, 100)
 	})
 }
+
+func TestCipherOptions(t *testing.T) {
+	Convey("derive key with options", t, func() {
+		pass := []byte("passphrase")
+		salt1 := []byte("salt1")
+		salt2 := []byte("salt2")
+
+		for _, kdf := range []KDF{KDFHKDF, KDFPBKDF2} {
+			c1, err := NewCipherWithOptions(pass, &CipherOptions{KDF: kdf, Salt: salt1})
+			So(err, ShouldBeNil)
+			c2, err := NewCipherWithOptions(pass, &CipherOptions{KDF: kdf, Salt: salt1})
+			So(err, ShouldBeNil)
+			c3, err := NewCipherWithOptions(pass, &CipherOptions{KDF: kdf, Salt: salt2})
+			So(err, ShouldBeNil)
+
+			So(c1.key, ShouldHaveLength, 32)
+			So(c1.key, ShouldResemble, c2.key)
+			So(c1.key, ShouldNotResemble, c3.key)
+			So(c1.key, ShouldNotResemble, NewCipher(pass).key)
+		}
+
+		c, err := NewCipherWithOptions(pass, nil)
+		So(err, ShouldBeNil)
+		So(c.key, ShouldResemble, NewCipher(pass).key)
+
+		c, err = NewCipherWithOptions(pass, &CipherOptions{KDF: KDFDoubleSHA256, Salt: salt1})
+		So(err, ShouldBeNil)
+		So(c.key, ShouldResemble, NewCipher(pass).key)
+
+		c, err = NewCipherWithOptions(pass, &CipherOptions{KDF: KDF(100)})
+		So(err, ShouldEqual, ErrUnknownKDF)
+		So(c, ShouldBeNil)
+	})
+
+	Convey("kdf test vectors", t, func() {
+		// RFC 5869 test case 1
+		okm := hkdf(sha256.New, bytes.Repeat([]byte{0x0b}, 22),
+			[]byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c},
+			[]byte{0xf0, 0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8, 0xf9}, 42)
+		So(hex.EncodeToString(okm), ShouldEqual, "3cb25f25faacd57a90434f64d0362f2a"+
+			"2d2d0a90cf1a5a4c5db02d56ecc4c5bf34007208d5b887185865")
+
+		dk := pbkdf2(sha256.New, []byte("password"), []byte("salt"), 1, 32)
+		So(hex.EncodeToString(dk), ShouldEqual,
+			"120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b")
+		dk = pbkdf2(sha256.New, []byte("password"), []byte("salt"), 4096, 32)
+		So(hex.EncodeToString(dk), ShouldEqual,
+			"c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a")
+	})
+}
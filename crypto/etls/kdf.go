@@ -0,0 +1,160 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package etls
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	stdhash "hash"
+
+	"github.com/thunderdb/ThunderDB/crypto/hash"
+)
+
+// KDF defines how a Cipher derives its key from the raw key.
+type KDF int
+
+const (
+	// KDFDoubleSHA256 derives the key with the unsalted KeyDerivation, it's compatible with
+	// peers not using CipherOptions.
+	KDFDoubleSHA256 KDF = iota
+
+	// KDFHKDF derives the key with HKDF (RFC 5869), it's suitable for high-entropy raw keys such
+	// as ECDH shared secrets.
+	KDFHKDF
+
+	// KDFPBKDF2 derives the key with PBKDF2 (RFC 8018), whose iteration count makes brute force
+	// on low-entropy passphrases expensive.
+	KDFPBKDF2
+)
+
+const (
+	// DefaultPBKDF2Iterations is the default iteration count of KDFPBKDF2.
+	DefaultPBKDF2Iterations = 4096
+)
+
+var (
+	// ErrUnknownKDF indicates the KDF of CipherOptions is not supported.
+	ErrUnknownKDF = errors.New("etls: unknown kdf")
+)
+
+// CipherOptions defines how a Cipher derives its key, both ends of a connection must use the
+// same options.
+type CipherOptions struct {
+	// KDF is the key derivation function, KDFDoubleSHA256 by default.
+	KDF KDF
+
+	// Hash is the hash function of KDFHKDF and KDFPBKDF2, sha256.New by default.
+	Hash func() stdhash.Hash
+
+	// Salt is the salt of KDFHKDF and KDFPBKDF2, it should be random and could be sent to peer in
+	// plain text.
+	Salt []byte
+
+	// Info is the application specific context of KDFHKDF, ignored by the others.
+	Info []byte
+
+	// Iterations is the cost of KDFPBKDF2, DefaultPBKDF2Iterations by default.
+	Iterations int
+}
+
+// deriveKey derives a key of keyLen bytes from rawKey with the options.
+func (o *CipherOptions) deriveKey(rawKey []byte, keyLen int) (key []byte, err error) {
+	h := o.Hash
+	if h == nil {
+		h = sha256.New
+	}
+
+	switch o.KDF {
+	case KDFDoubleSHA256:
+		key = KeyDerivation(rawKey, keyLen, &hash.HashSuite{
+			HashLen:  hash.HashBSize,
+			HashFunc: hash.DoubleHashB,
+		})
+	case KDFHKDF:
+		key = hkdf(h, rawKey, o.Salt, o.Info, keyLen)
+	case KDFPBKDF2:
+		iterations := o.Iterations
+		if iterations <= 0 {
+			iterations = DefaultPBKDF2Iterations
+		}
+		key = pbkdf2(h, rawKey, o.Salt, iterations, keyLen)
+	default:
+		err = ErrUnknownKDF
+	}
+
+	return
+}
+
+// hkdf implements HKDF extract-and-expand of RFC 5869.
+func hkdf(h func() stdhash.Hash, secret, salt, info []byte, keyLen int) []byte {
+	if len(salt) == 0 {
+		salt = make([]byte, h().Size())
+	}
+
+	extractor := hmac.New(h, salt)
+	extractor.Write(secret)
+	prk := extractor.Sum(nil)
+
+	expander := hmac.New(h, prk)
+	key := make([]byte, 0, keyLen+expander.Size())
+	var t []byte
+
+	for counter := byte(1); len(key) < keyLen; counter++ {
+		expander.Reset()
+		expander.Write(t)
+		expander.Write(info)
+		expander.Write([]byte{counter})
+		t = expander.Sum(t[:0])
+		key = append(key, t...)
+	}
+
+	return key[:keyLen]
+}
+
+// pbkdf2 implements PBKDF2 of RFC 8018 with HMAC as the pseudorandom function.
+func pbkdf2(h func() stdhash.Hash, password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(h, password)
+	hashLen := prf.Size()
+	key := make([]byte, 0, keyLen+hashLen)
+	block := make([]byte, 4)
+	u := make([]byte, hashLen)
+
+	for i := uint32(1); len(key) < keyLen; i++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(block, i)
+		prf.Write(block)
+		u = prf.Sum(u[:0])
+		t := append([]byte(nil), u...)
+
+		for n := 1; n < iterations; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+
+		key = append(key, t...)
+	}
+
+	return key[:keyLen]
+}
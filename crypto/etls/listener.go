@@ -29,6 +29,8 @@ type CipherHandler func(conn net.Conn) (cryptoConn *CryptoConn, err error)
 type CryptoListener struct {
 	net.Listener
 	CHandler CipherHandler
+	// Options switches accepted connections to record mode if not nil
+	Options *ConnOptions
 }
 
 // NewCryptoListener returns a new CryptoListener
@@ -37,7 +39,19 @@ func NewCryptoListener(network, addr string, handler CipherHandler) (*CryptoList
 	if err != nil {
 		return nil, err
 	}
-	return &CryptoListener{l, handler}, nil
+	return &CryptoListener{Listener: l, CHandler: handler}, nil
+}
+
+// NewCryptoListenerWithOptions returns a new CryptoListener whose accepted connections are in
+// record mode with options, see ConnOptions.
+func NewCryptoListenerWithOptions(network, addr string, handler CipherHandler, options *ConnOptions) (
+	*CryptoListener, error) {
+	l, err := NewCryptoListener(network, addr, handler)
+	if err != nil {
+		return nil, err
+	}
+	l.Options = options
+	return l, nil
 }
 
 // Accept waits for and returns the next connection to the listener.
@@ -48,7 +62,11 @@ func (l *CryptoListener) Accept() (net.Conn, error) {
 		return nil, err
 	}
 
-	return l.CHandler(c)
+	cc, err := l.CHandler(c)
+	if err == nil && cc != nil && l.Options != nil {
+		cc.startRecordMode(l.Options)
+	}
+	return cc, err
 }
 
 // Close closes the listener.
@@ -0,0 +1,332 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package etls
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Record types in record mode.
+const (
+	recordData uint8 = iota
+	recordPing
+	recordPong
+	recordCompressed
+)
+
+const (
+	// recordHeaderLen is the length of record header: 1 byte type + 4 bytes payload length.
+	recordHeaderLen = 5
+
+	// DefaultMaxFrameSize is the default max payload length of a record.
+	DefaultMaxFrameSize = 64 * 1024
+)
+
+var (
+	// ErrKeepAliveTimeout indicates no record is received from peer in
+	// ConnOptions.KeepAliveTimeout, the connection is closed.
+	ErrKeepAliveTimeout = errors.New("etls: keepalive timeout")
+
+	// ErrInvalidRecord indicates an unknown record type is received.
+	ErrInvalidRecord = errors.New("etls: invalid record")
+
+	// ErrFrameTooLarge indicates a record larger than ConnOptions.MaxFrameSize is received.
+	ErrFrameTooLarge = errors.New("etls: frame too large")
+)
+
+// ConnOptions defines the record mode options of a CryptoConn, both ends of a connection must
+// use the same mode.
+//
+// In record mode, the encrypted stream is split into records with the following format, the
+// header is encrypted too:
+//
+// 0      1       5                              5+len
+// +------+-------+------------------------------+
+// | type |  len  |           payload            |
+// +------+-------+------------------------------+
+//
+// A Write is split into records of at most MaxFrameSize bytes payload, and the payloads are
+// reassembled transparently by Read. If CompressThreshold is set, payloads not smaller than it
+// are gzip compressed before encryption and sent as compressed records, a payload is sent as is
+// if it does not shrink. Records are read by a background goroutine, so read
+// deadlines apply to the underlying connection instead of the Read call.
+type ConnOptions struct {
+	// MaxFrameSize is the max payload length of a record, DefaultMaxFrameSize by default. The
+	// connection is closed with ErrFrameTooLarge if peer sends a larger record, so it should be
+	// the same on both ends.
+	MaxFrameSize int
+
+	// CompressThreshold is the min payload length of a record to be compressed, 0 disables
+	// compression. Compressed records are always accepted on read, so it can differ between the
+	// two ends.
+	CompressThreshold int
+
+	// KeepAliveInterval is the interval to send ping records, 0 disables keepalive.
+	KeepAliveInterval time.Duration
+
+	// KeepAliveTimeout is the max duration without any record received from peer, the
+	// connection is closed with ErrKeepAliveTimeout after that. It defaults to 3 times of
+	// KeepAliveInterval.
+	KeepAliveTimeout time.Duration
+}
+
+// recordState keeps the record mode state of a CryptoConn.
+type recordState struct {
+	options ConnOptions
+
+	dmu sync.Mutex // keeps data records of a Write contiguous
+	wmu sync.Mutex // serializes record writes
+
+	pr *io.PipeReader
+	pw *io.PipeWriter
+
+	lastSeen   int64 // unix nano, accessed atomically
+	delivering int32 // accessed atomically
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// streamReader reads decrypted stream of a CryptoConn.
+type streamReader struct {
+	c *CryptoConn
+}
+
+func (r streamReader) Read(b []byte) (n int, err error) {
+	return r.c.readStream(b)
+}
+
+// startRecordMode switches the connection to record mode, it must be called before any read
+// or write.
+func (c *CryptoConn) startRecordMode(options *ConnOptions) {
+	rs := &recordState{
+		options: *options,
+		done:    make(chan struct{}),
+	}
+	if rs.options.MaxFrameSize <= 0 {
+		rs.options.MaxFrameSize = DefaultMaxFrameSize
+	}
+	if rs.options.KeepAliveInterval > 0 && rs.options.KeepAliveTimeout <= 0 {
+		rs.options.KeepAliveTimeout = 3 * rs.options.KeepAliveInterval
+	}
+	rs.pr, rs.pw = io.Pipe()
+	atomic.StoreInt64(&rs.lastSeen, time.Now().UnixNano())
+	c.record = rs
+
+	go c.readLoop()
+	if rs.options.KeepAliveInterval > 0 {
+		go c.pingLoop()
+		go c.watchdog()
+	}
+}
+
+// writeRecord encrypts and writes a single record.
+func (c *CryptoConn) writeRecord(recordType uint8, payload []byte) (err error) {
+	buf := make([]byte, recordHeaderLen+len(payload))
+	buf[0] = recordType
+	binary.BigEndian.PutUint32(buf[1:recordHeaderLen], uint32(len(payload)))
+	copy(buf[recordHeaderLen:], payload)
+
+	c.record.wmu.Lock()
+	defer c.record.wmu.Unlock()
+
+	_, err = c.writeStream(buf)
+	return
+}
+
+// writeData splits b into data records of at most MaxFrameSize bytes payload and writes them.
+func (c *CryptoConn) writeData(b []byte) (n int, err error) {
+	c.record.dmu.Lock()
+	defer c.record.dmu.Unlock()
+
+	maxFrameSize := c.record.options.MaxFrameSize
+	for n < len(b) {
+		end := n + maxFrameSize
+		if end > len(b) {
+			end = len(b)
+		}
+		recordType, payload := recordData, b[n:end]
+		if threshold := c.record.options.CompressThreshold; threshold > 0 && len(payload) >= threshold {
+			if compressed, ok := compressPayload(payload); ok {
+				recordType, payload = recordCompressed, compressed
+			}
+		}
+		if err = c.writeRecord(recordType, payload); err != nil {
+			return
+		}
+		n = end
+	}
+	return
+}
+
+// readLoop reads records and dispatches them until error.
+func (c *CryptoConn) readLoop() {
+	var (
+		rs     = c.record
+		r      = streamReader{c}
+		header = make([]byte, recordHeaderLen)
+		err    error
+	)
+
+	for {
+		if _, err = io.ReadFull(r, header); err != nil {
+			break
+		}
+		atomic.StoreInt64(&rs.lastSeen, time.Now().UnixNano())
+
+		length := binary.BigEndian.Uint32(header[1:])
+		if uint64(length) > uint64(rs.options.MaxFrameSize) {
+			err = ErrFrameTooLarge
+			break
+		}
+		payload := make([]byte, length)
+		if _, err = io.ReadFull(r, payload); err != nil {
+			break
+		}
+
+		switch header[0] {
+		case recordData:
+			err = c.deliver(payload)
+		case recordCompressed:
+			if payload, err = decompressPayload(payload, rs.options.MaxFrameSize); err == nil {
+				err = c.deliver(payload)
+			}
+		case recordPing:
+			err = c.writeRecord(recordPong, nil)
+		case recordPong:
+		default:
+			err = ErrInvalidRecord
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	c.closeRecord(err)
+}
+
+// deliver passes the payload of a data record to Read.
+func (c *CryptoConn) deliver(payload []byte) (err error) {
+	rs := c.record
+	atomic.StoreInt32(&rs.delivering, 1)
+	_, err = rs.pw.Write(payload)
+	atomic.StoreInt32(&rs.delivering, 0)
+	atomic.StoreInt64(&rs.lastSeen, time.Now().UnixNano())
+	return
+}
+
+// compressPayload gzips payload, ok is false if the compressed payload is not smaller.
+func compressPayload(payload []byte) (compressed []byte, ok bool) {
+	var buf bytes.Buffer
+	w, _ := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+	if _, err := w.Write(payload); err != nil {
+		return
+	}
+	if err := w.Close(); err != nil {
+		return
+	}
+	if buf.Len() >= len(payload) {
+		return
+	}
+	return buf.Bytes(), true
+}
+
+// decompressPayload gunzips payload, the decompressed payload must not be larger than
+// maxFrameSize.
+func decompressPayload(payload []byte, maxFrameSize int) (decompressed []byte, err error) {
+	r, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, ErrInvalidRecord
+	}
+	defer r.Close()
+
+	var buf bytes.Buffer
+	if _, err = io.Copy(&buf, io.LimitReader(r, int64(maxFrameSize)+1)); err != nil {
+		return nil, ErrInvalidRecord
+	}
+	if buf.Len() > maxFrameSize {
+		return nil, ErrFrameTooLarge
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *CryptoConn) pingLoop() {
+	ticker := time.NewTicker(c.record.options.KeepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.record.done:
+			return
+		case <-ticker.C:
+			if err := c.writeRecord(recordPing, nil); err != nil {
+				c.closeRecord(err)
+				return
+			}
+		}
+	}
+}
+
+func (c *CryptoConn) watchdog() {
+	rs := c.record
+	ticker := time.NewTicker(rs.options.KeepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-rs.done:
+			return
+		case <-ticker.C:
+			// peer is alive if we are blocked by local reader
+			if atomic.LoadInt32(&rs.delivering) == 1 {
+				continue
+			}
+			lastSeen := time.Unix(0, atomic.LoadInt64(&rs.lastSeen))
+			if time.Since(lastSeen) > rs.options.KeepAliveTimeout {
+				log.Warningf("etls: no record from %s since %s, close connection",
+					c.Conn.RemoteAddr(), lastSeen)
+				c.closeRecord(ErrKeepAliveTimeout)
+				return
+			}
+		}
+	}
+}
+
+// closeRecord stops record mode and closes the underlying connection, subsequent Read calls
+// return err, or io.EOF if err is nil. Only the first call closes the connection and returns its
+// close error.
+func (c *CryptoConn) closeRecord(err error) (closeErr error) {
+	c.record.closeOnce.Do(func() {
+		if err == nil {
+			err = io.EOF
+		}
+		close(c.record.done)
+		c.record.pw.CloseWithError(err)
+		closeErr = c.Conn.Close()
+	})
+	return
+}
@@ -0,0 +1,279 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package etls
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCryptoConn_KeepAlive(t *testing.T) {
+	options := &ConnOptions{
+		KeepAliveInterval: 50 * time.Millisecond,
+		KeepAliveTimeout:  200 * time.Millisecond,
+	}
+
+	Convey("dead peer is detected", t, func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer l.Close()
+
+		// peer accepts the connection and never reads or replies
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			c, _ := l.Accept()
+			accepted <- c
+		}()
+
+		conn, err := DialWithOptions("tcp", l.Addr().String(), NewCipher([]byte(pass)), options)
+		So(err, ShouldBeNil)
+		defer conn.Close()
+		peer := <-accepted
+		defer peer.Close()
+
+		errCh := make(chan error, 1)
+		go func() {
+			_, err := conn.Read(make([]byte, 1))
+			errCh <- err
+		}()
+
+		select {
+		case err = <-errCh:
+			So(err, ShouldEqual, ErrKeepAliveTimeout)
+		case <-time.After(2 * time.Second):
+			t.Fatal("dead connection not detected")
+		}
+	})
+
+	Convey("idle connection is kept alive", t, func() {
+		l, err := NewCryptoListenerWithOptions("tcp", "127.0.0.1:0", simpleCipherHandler, options)
+		So(err, ShouldBeNil)
+		defer l.Close()
+
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			c, _ := l.Accept()
+			accepted <- c
+		}()
+
+		conn, err := DialWithOptions("tcp", l.Addr().String(), NewCipher([]byte(pass)), options)
+		So(err, ShouldBeNil)
+		defer conn.Close()
+		server := <-accepted
+		So(server, ShouldNotBeNil)
+		defer server.Close()
+
+		// echo server
+		go io.Copy(server, server)
+
+		time.Sleep(3 * options.KeepAliveTimeout)
+
+		msg := []byte("hello after idle")
+		_, err = conn.Write(msg)
+		So(err, ShouldBeNil)
+		buf := make([]byte, len(msg))
+		_, err = io.ReadFull(conn, buf)
+		So(err, ShouldBeNil)
+		So(buf, ShouldResemble, msg)
+	})
+
+	Convey("closed connection returns EOF", t, func() {
+		l, err := NewCryptoListenerWithOptions("tcp", "127.0.0.1:0", simpleCipherHandler, options)
+		So(err, ShouldBeNil)
+		defer l.Close()
+
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			c, _ := l.Accept()
+			accepted <- c
+		}()
+
+		conn, err := DialWithOptions("tcp", l.Addr().String(), NewCipher([]byte(pass)), options)
+		So(err, ShouldBeNil)
+		server := <-accepted
+		So(server, ShouldNotBeNil)
+		defer server.Close()
+
+		So(conn.Close(), ShouldBeNil)
+		_, err = server.Read(make([]byte, 1))
+		So(err, ShouldEqual, io.EOF)
+	})
+}
+
+func TestCryptoConn_Frames(t *testing.T) {
+	options := &ConnOptions{
+		MaxFrameSize: 4096,
+	}
+
+	Convey("large payload is reassembled across frames", t, func() {
+		l, err := NewCryptoListenerWithOptions("tcp", "127.0.0.1:0", simpleCipherHandler, options)
+		So(err, ShouldBeNil)
+		defer l.Close()
+
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			c, _ := l.Accept()
+			accepted <- c
+		}()
+
+		conn, err := DialWithOptions("tcp", l.Addr().String(), NewCipher([]byte(pass)), options)
+		So(err, ShouldBeNil)
+		defer conn.Close()
+		server := <-accepted
+		So(server, ShouldNotBeNil)
+		defer server.Close()
+
+		payload := make([]byte, 4*1024*1024+123)
+		_, err = rand.Read(payload)
+		So(err, ShouldBeNil)
+
+		writeErr := make(chan error, 1)
+		go func() {
+			n, err := conn.Write(payload)
+			if err == nil && n != len(payload) {
+				err = io.ErrShortWrite
+			}
+			writeErr <- err
+		}()
+
+		received := make([]byte, len(payload))
+		_, err = io.ReadFull(server, received)
+		So(err, ShouldBeNil)
+		So(<-writeErr, ShouldBeNil)
+		So(bytes.Equal(received, payload), ShouldBeTrue)
+	})
+
+	Convey("oversized frame is rejected", t, func() {
+		l, err := NewCryptoListenerWithOptions("tcp", "127.0.0.1:0", simpleCipherHandler, options)
+		So(err, ShouldBeNil)
+		defer l.Close()
+
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			c, _ := l.Accept()
+			accepted <- c
+		}()
+
+		conn, err := DialWithOptions("tcp", l.Addr().String(), NewCipher([]byte(pass)),
+			&ConnOptions{MaxFrameSize: 2 * options.MaxFrameSize})
+		So(err, ShouldBeNil)
+		defer conn.Close()
+		server := <-accepted
+		So(server, ShouldNotBeNil)
+		defer server.Close()
+
+		go conn.Write(make([]byte, 2*options.MaxFrameSize))
+
+		_, err = server.Read(make([]byte, 1))
+		So(err, ShouldEqual, ErrFrameTooLarge)
+	})
+}
+
+// countingConn counts bytes read from the underlying connection.
+type countingConn struct {
+	net.Conn
+	read int64
+}
+
+func (c *countingConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	atomic.AddInt64(&c.read, int64(n))
+	return
+}
+
+func TestCryptoConn_Compression(t *testing.T) {
+	// transfer sends payload from a client with options and returns the received payload with
+	// the bytes read by server from wire
+	transfer := func(options *ConnOptions, payload []byte) (received []byte, wire int64) {
+		counter := make(chan *countingConn, 1)
+		handler := func(conn net.Conn) (*CryptoConn, error) {
+			cc := &countingConn{Conn: conn}
+			counter <- cc
+			return simpleCipherHandler(cc)
+		}
+		l, err := NewCryptoListenerWithOptions("tcp", "127.0.0.1:0", handler, &ConnOptions{})
+		So(err, ShouldBeNil)
+		defer l.Close()
+
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			c, _ := l.Accept()
+			accepted <- c
+		}()
+
+		conn, err := DialWithOptions("tcp", l.Addr().String(), NewCipher([]byte(pass)), options)
+		So(err, ShouldBeNil)
+		defer conn.Close()
+		server := <-accepted
+		So(server, ShouldNotBeNil)
+		defer server.Close()
+
+		go conn.Write(payload)
+
+		received = make([]byte, len(payload))
+		_, err = io.ReadFull(server, received)
+		So(err, ShouldBeNil)
+		return received, atomic.LoadInt64(&(<-counter).read)
+	}
+
+	Convey("compressible payload is compressed on wire", t, func() {
+		payload := bytes.Repeat([]byte("thunderdb block payload "), 64*1024)
+
+		received, plainWire := transfer(&ConnOptions{}, payload)
+		So(bytes.Equal(received, payload), ShouldBeTrue)
+		So(plainWire, ShouldBeGreaterThan, len(payload))
+
+		received, compressedWire := transfer(&ConnOptions{CompressThreshold: 1024}, payload)
+		So(bytes.Equal(received, payload), ShouldBeTrue)
+		So(compressedWire, ShouldBeLessThan, plainWire/10)
+	})
+
+	Convey("small and incompressible payloads are sent as is", t, func() {
+		small := []byte("small payload")
+		received, plainWire := transfer(&ConnOptions{}, small)
+		So(bytes.Equal(received, small), ShouldBeTrue)
+		received, wire := transfer(&ConnOptions{CompressThreshold: 1024}, small)
+		So(bytes.Equal(received, small), ShouldBeTrue)
+		So(wire, ShouldEqual, plainWire)
+
+		random := make([]byte, 256*1024)
+		_, err := rand.Read(random)
+		So(err, ShouldBeNil)
+		received, plainWire = transfer(&ConnOptions{}, random)
+		So(bytes.Equal(received, random), ShouldBeTrue)
+		received, wire = transfer(&ConnOptions{CompressThreshold: 1024}, random)
+		So(bytes.Equal(received, random), ShouldBeTrue)
+		So(wire, ShouldEqual, plainWire)
+	})
+
+	Convey("decompressed frame larger than max frame size is rejected", t, func() {
+		compressed, ok := compressPayload(make([]byte, 2*DefaultMaxFrameSize))
+		So(ok, ShouldBeTrue)
+		_, err := decompressPayload(compressed, DefaultMaxFrameSize)
+		So(err, ShouldEqual, ErrFrameTooLarge)
+
+		_, err = decompressPayload([]byte("not gzip"), DefaultMaxFrameSize)
+		So(err, ShouldEqual, ErrInvalidRecord)
+	})
+}
@@ -0,0 +1,51 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package hash
+
+import (
+	"crypto/sha256"
+	gohash "hash"
+)
+
+// Hasher computes HashH incrementally, the Sum of all data written equals
+// HashH of their concatenation. It implements io.Writer so serializers can
+// hash while writing without buffering the whole payload.
+type Hasher struct {
+	h gohash.Hash
+}
+
+// NewHasher returns a new Hasher.
+func NewHasher() Hasher {
+	return Hasher{h: sha256.New()}
+}
+
+// Write adds more data to the running hash, it never returns an error.
+func (h Hasher) Write(p []byte) (n int, err error) {
+	return h.h.Write(p)
+}
+
+// Sum returns the Hash of data written so far, it does not change the
+// underlying state.
+func (h Hasher) Sum() (hash Hash) {
+	copy(hash[:], h.h.Sum(nil))
+	return
+}
+
+// Reset resets the Hasher to its initial state.
+func (h Hasher) Reset() {
+	h.h.Reset()
+}
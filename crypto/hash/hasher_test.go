@@ -0,0 +1,56 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package hash
+
+import (
+	"io"
+	"math/rand"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestHasher(t *testing.T) {
+	Convey("empty input", t, func() {
+		So(NewHasher().Sum(), ShouldResemble, HashH(nil))
+	})
+	Convey("streaming sum equals HashH", t, func() {
+		data := make([]byte, 4096)
+		rand.Read(data)
+		for round := 0; round < 32; round++ {
+			h := NewHasher()
+			for rest := data; len(rest) > 0; {
+				n := rand.Intn(len(rest)) + 1
+				written, err := h.Write(rest[:n])
+				So(err, ShouldBeNil)
+				So(written, ShouldEqual, n)
+				rest = rest[n:]
+			}
+			So(h.Sum(), ShouldResemble, HashH(data))
+		}
+	})
+	Convey("sum does not change state", t, func() {
+		var w io.Writer = NewHasher()
+		h := w.(Hasher)
+		h.Write([]byte("abc"))
+		So(h.Sum(), ShouldResemble, HashH([]byte("abc")))
+		h.Write([]byte("def"))
+		So(h.Sum(), ShouldResemble, HashH([]byte("abcdef")))
+		h.Reset()
+		So(h.Sum(), ShouldResemble, HashH(nil))
+	})
+}
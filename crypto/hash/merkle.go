@@ -0,0 +1,115 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package hash
+
+import "errors"
+
+// ErrMerkleProofIndex indicates the requested leaf index is out of range.
+var ErrMerkleProofIndex = errors.New("merkle proof index out of range")
+
+// MerkleTree is a binary merkle tree built on THashH.
+// Leaves are hashed with THashH and each parent is THashH(left || right).
+// If a level has an odd number of nodes, the last one is paired with itself.
+type MerkleTree struct {
+	// levels[0] is the leaf hashes, levels[len(levels)-1] holds the root
+	levels [][]Hash
+}
+
+// NewMerkleTree builds a MerkleTree from the raw leaves.
+func NewMerkleTree(leaves [][]byte) *MerkleTree {
+	if len(leaves) == 0 {
+		return &MerkleTree{}
+	}
+
+	level := make([]Hash, len(leaves))
+	for i, leaf := range leaves {
+		level[i] = THashH(leaf)
+	}
+	levels := [][]Hash{level}
+
+	for len(level) > 1 {
+		next := make([]Hash, (len(level)+1)/2)
+		for i := range next {
+			left := level[2*i]
+			right := left
+			if 2*i+1 < len(level) {
+				right = level[2*i+1]
+			}
+			next[i] = mergeHash(&left, &right)
+		}
+		levels = append(levels, next)
+		level = next
+	}
+
+	return &MerkleTree{levels: levels}
+}
+
+// Root returns the merkle root, an empty tree has the zero Hash as root.
+func (t *MerkleTree) Root() Hash {
+	if len(t.levels) == 0 {
+		return Hash{}
+	}
+	return t.levels[len(t.levels)-1][0]
+}
+
+// Proof returns the sibling hashes from the leaf at index up to the root.
+func (t *MerkleTree) Proof(index int) ([]Hash, error) {
+	if len(t.levels) == 0 || index < 0 || index >= len(t.levels[0]) {
+		return nil, ErrMerkleProofIndex
+	}
+
+	proof := make([]Hash, 0, len(t.levels)-1)
+	for _, level := range t.levels[:len(t.levels)-1] {
+		sibling := index ^ 1
+		if sibling >= len(level) {
+			// odd node count, the last node is paired with itself
+			sibling = index
+		}
+		proof = append(proof, level[sibling])
+		index >>= 1
+	}
+
+	return proof, nil
+}
+
+// VerifyProof checks that leaf, the THashH of the raw leaf at index, is
+// included in the tree with root according to proof.
+func VerifyProof(root, leaf Hash, proof []Hash, index int) bool {
+	if index < 0 {
+		return false
+	}
+
+	current := leaf
+	for i := range proof {
+		if index&1 == 0 {
+			current = mergeHash(&current, &proof[i])
+		} else {
+			current = mergeHash(&proof[i], &current)
+		}
+		index >>= 1
+	}
+
+	// index must be consumed by the proof, or it points out of the tree
+	return index == 0 && current.IsEqual(&root)
+}
+
+func mergeHash(l, r *Hash) Hash {
+	buf := make([]byte, 0, HashSize*2)
+	buf = append(buf, l[:]...)
+	buf = append(buf, r[:]...)
+	return THashH(buf)
+}
@@ -0,0 +1,88 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package hash
+
+import (
+	"fmt"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func genLeaves(n int) [][]byte {
+	leaves := make([][]byte, n)
+	for i := range leaves {
+		leaves[i] = []byte(fmt.Sprintf("query %d", i))
+	}
+	return leaves
+}
+
+func TestMerkleTree(t *testing.T) {
+	Convey("empty tree", t, func() {
+		tree := NewMerkleTree(nil)
+		So(tree.Root(), ShouldResemble, Hash{})
+		_, err := tree.Proof(0)
+		So(err, ShouldEqual, ErrMerkleProofIndex)
+	})
+	Convey("single leaf", t, func() {
+		leaves := genLeaves(1)
+		tree := NewMerkleTree(leaves)
+		So(tree.Root(), ShouldResemble, THashH(leaves[0]))
+		proof, err := tree.Proof(0)
+		So(err, ShouldBeNil)
+		So(proof, ShouldBeEmpty)
+		So(VerifyProof(tree.Root(), THashH(leaves[0]), proof, 0), ShouldBeTrue)
+	})
+	Convey("odd leaf count duplicates the last", t, func() {
+		leaves := genLeaves(3)
+		l0, l1, l2 := THashH(leaves[0]), THashH(leaves[1]), THashH(leaves[2])
+		left := mergeHash(&l0, &l1)
+		right := mergeHash(&l2, &l2)
+		So(NewMerkleTree(leaves).Root(), ShouldResemble, mergeHash(&left, &right))
+	})
+	Convey("every leaf proof verifies", t, func() {
+		for n := 1; n <= 17; n++ {
+			leaves := genLeaves(n)
+			tree := NewMerkleTree(leaves)
+			root := tree.Root()
+			So(NewMerkleTree(leaves).Root(), ShouldResemble, root)
+			for i := range leaves {
+				proof, err := tree.Proof(i)
+				So(err, ShouldBeNil)
+				So(VerifyProof(root, THashH(leaves[i]), proof, i), ShouldBeTrue)
+			}
+			_, err := tree.Proof(n)
+			So(err, ShouldEqual, ErrMerkleProofIndex)
+			_, err = tree.Proof(-1)
+			So(err, ShouldEqual, ErrMerkleProofIndex)
+		}
+	})
+	Convey("tampered leaf is rejected", t, func() {
+		leaves := genLeaves(7)
+		tree := NewMerkleTree(leaves)
+		root := tree.Root()
+		proof, err := tree.Proof(4)
+		So(err, ShouldBeNil)
+		So(VerifyProof(root, THashH([]byte("tampered")), proof, 4), ShouldBeFalse)
+		So(VerifyProof(root, THashH(leaves[4]), proof, 5), ShouldBeFalse)
+		So(VerifyProof(root, THashH(leaves[4]), proof, 4+8), ShouldBeFalse)
+		So(VerifyProof(root, THashH(leaves[4]), proof, -1), ShouldBeFalse)
+
+		leaves[4] = []byte("tampered")
+		So(NewMerkleTree(leaves).Root(), ShouldNotResemble, root)
+	})
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kms
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/coreos/bbolt"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// kmsMetaBucketName is the boltdb bucket name of store metadata
+	kmsMetaBucketName = "kms_meta"
+	// schemaVersionKey is the key of schema version in meta bucket
+	schemaVersionKey = "version"
+)
+
+// migration upgrades the store from the previous schema version in tx
+type migration func(tx *bolt.Tx) error
+
+var (
+	// migrations holds the ordered migrations, migrations[i] upgrades the
+	// store from version i+1 to i+2. Version 1 is the store without meta bucket
+	migrations = []migration{
+		// version 2 adds the node expiry bucket
+		func(tx *bolt.Tx) (err error) {
+			_, err = tx.CreateBucketIfNotExists([]byte(kmsExpiryBucketName))
+			return
+		},
+	}
+
+	// ErrSchemaVersionTooNew indicates the store is created by newer code
+	ErrSchemaVersionTooNew = errors.New("schema version too new")
+	// ErrInvalidSchemaVersion indicates the schema version in store is malformed
+	ErrInvalidSchemaVersion = errors.New("invalid schema version")
+)
+
+// currentSchemaVersion returns the schema version of the code
+func currentSchemaVersion() uint32 {
+	return uint32(len(migrations)) + 1
+}
+
+// getSchemaVersion returns the schema version of store, an empty store
+// is treated as the current version
+func getSchemaVersion(tx *bolt.Tx) (version uint32, err error) {
+	meta := tx.Bucket([]byte(kmsMetaBucketName))
+	if meta == nil {
+		if tx.Bucket([]byte(kmsBucketName)) == nil {
+			return currentSchemaVersion(), nil
+		}
+		return 1, nil
+	}
+	byteVal := meta.Get([]byte(schemaVersionKey))
+	if len(byteVal) != 4 {
+		return 0, ErrInvalidSchemaVersion
+	}
+	return binary.BigEndian.Uint32(byteVal), nil
+}
+
+// migrate applies the migrations to bring the store up to the current
+// schema version and records the version
+func migrate(tx *bolt.Tx) (err error) {
+	version, err := getSchemaVersion(tx)
+	if err != nil {
+		return
+	}
+	current := currentSchemaVersion()
+	if version > current {
+		log.Errorf("schema version %d is newer than %d", version, current)
+		return ErrSchemaVersionTooNew
+	}
+	if version < 1 {
+		return ErrInvalidSchemaVersion
+	}
+
+	for ; version < current; version++ {
+		log.Infof("migrating kms store from schema version %d to %d", version, version+1)
+		if err = migrations[version-1](tx); err != nil {
+			log.Errorf("migrate kms store to schema version %d failed: %s", version+1, err)
+			return
+		}
+	}
+
+	meta, err := tx.CreateBucketIfNotExists([]byte(kmsMetaBucketName))
+	if err != nil {
+		return
+	}
+	byteVal := make([]byte, 4)
+	binary.BigEndian.PutUint32(byteVal, current)
+	return meta.Put([]byte(schemaVersionKey), byteVal)
+}
@@ -0,0 +1,140 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kms
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/coreos/bbolt"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/thunderdb/ThunderDB/proto"
+	"github.com/ugorji/go/codec"
+)
+
+const migrationDBFile = ".test_migration.db"
+
+func encodeNode(node *proto.Node) []byte {
+	buf := new(bytes.Buffer)
+	codec.NewEncoder(buf, &codec.MsgpackHandle{}).Encode(*node)
+	return buf.Bytes()
+}
+
+func schemaVersion() (version uint32, err error) {
+	err = pks.db.View(func(tx *bolt.Tx) (err error) {
+		version, err = getSchemaVersion(tx)
+		return
+	})
+	return
+}
+
+func TestMigration(t *testing.T) {
+	Convey("migrate kms store", t, func() {
+		pks = nil
+		os.Remove(migrationDBFile)
+		defer os.Remove(migrationDBFile)
+
+		// v1 store has no meta bucket
+		db, err := bolt.Open(migrationDBFile, 0600, nil)
+		So(err, ShouldBeNil)
+		err = db.Update(func(tx *bolt.Tx) error {
+			bucket, err := tx.CreateBucket([]byte(kmsBucketName))
+			if err != nil {
+				return err
+			}
+			for _, id := range []proto.NodeID{"node1", "node2"} {
+				node := &proto.Node{ID: id, Addr: "old"}
+				if err = bucket.Put([]byte(id), encodeNode(node)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		So(err, ShouldBeNil)
+		So(db.Close(), ShouldBeNil)
+
+		origin := migrations
+		defer func() { migrations = origin }()
+		migrations = append(migrations[:len(migrations):len(migrations)], func(tx *bolt.Tx) error {
+			bucket := tx.Bucket([]byte(kmsBucketName))
+			return bucket.ForEach(func(k, v []byte) error {
+				node := proto.NewNode()
+				if err := codec.NewDecoder(bytes.NewReader(v), &codec.MsgpackHandle{}).Decode(node); err != nil {
+					return err
+				}
+				node.Addr = "new"
+				return bucket.Put(k, encodeNode(node))
+			})
+		})
+
+		So(InitPublicKeyStore(migrationDBFile, nil), ShouldBeNil)
+		version, err := schemaVersion()
+		So(err, ShouldBeNil)
+		So(version, ShouldEqual, 3)
+		for _, id := range []proto.NodeID{"node1", "node2"} {
+			node, err := GetNodeInfo(id)
+			So(err, ShouldBeNil)
+			So(node.Addr, ShouldEqual, "new")
+		}
+		err = pks.db.View(func(tx *bolt.Tx) error {
+			So(tx.Bucket([]byte(kmsExpiryBucketName)), ShouldNotBeNil)
+			return nil
+		})
+		So(err, ShouldBeNil)
+		So(pks.db.Close(), ShouldBeNil)
+
+		Convey("current store is not migrated again", func() {
+			So(InitPublicKeyStore(migrationDBFile, nil), ShouldBeNil)
+			defer pks.db.Close()
+			node, err := GetNodeInfo("node1")
+			So(err, ShouldBeNil)
+			So(node.Addr, ShouldEqual, "new")
+			version, err := schemaVersion()
+			So(err, ShouldBeNil)
+			So(version, ShouldEqual, 3)
+		})
+
+		Convey("newer store is refused", func() {
+			migrations = origin
+			So(InitPublicKeyStore(migrationDBFile, nil), ShouldEqual, ErrSchemaVersionTooNew)
+		})
+
+		Convey("malformed schema version is refused", func() {
+			db, err := bolt.Open(migrationDBFile, 0600, nil)
+			So(err, ShouldBeNil)
+			err = db.Update(func(tx *bolt.Tx) error {
+				return tx.Bucket([]byte(kmsMetaBucketName)).Put([]byte(schemaVersionKey), []byte{1})
+			})
+			So(err, ShouldBeNil)
+			So(db.Close(), ShouldBeNil)
+			So(InitPublicKeyStore(migrationDBFile, nil), ShouldEqual, ErrInvalidSchemaVersion)
+		})
+	})
+
+	Convey("new store is created with current version", t, func() {
+		pks = nil
+		os.Remove(migrationDBFile)
+		defer os.Remove(migrationDBFile)
+
+		So(InitPublicKeyStore(migrationDBFile, nil), ShouldBeNil)
+		defer pks.db.Close()
+		version, err := schemaVersion()
+		So(err, ShouldBeNil)
+		So(version, ShouldEqual, currentSchemaVersion())
+	})
+}
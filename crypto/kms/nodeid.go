@@ -0,0 +1,76 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kms
+
+import (
+	"context"
+	"errors"
+
+	"github.com/thunderdb/ThunderDB/crypto/asymmetric"
+	"github.com/thunderdb/ThunderDB/crypto/hash"
+	mine "github.com/thunderdb/ThunderDB/pow/cpuminer"
+	"github.com/thunderdb/ThunderDB/proto"
+)
+
+var (
+	// MinNodeIDDifficulty is the min difficulty of node id accepted by SetNode
+	MinNodeIDDifficulty = 0
+	// ErrNodeIDDifficulty indicates node id difficulty is lower than required
+	ErrNodeIDDifficulty = errors.New("node id difficulty too low")
+)
+
+// GenerateNodeID mines a nonce to make Hash(publicKey||nonce) reach difficulty with all CPUs,
+// and returns the hash as NodeID along with the nonce
+func GenerateNodeID(publicKey *asymmetric.PublicKey, difficulty int) (
+	id proto.NodeID, nonce mine.Uint256, err error) {
+	if publicKey == nil {
+		return "", nonce, ErrNilNode
+	}
+
+	data := publicKey.Serialize()
+	if nonce, err = mine.MineParallel(context.Background(), data, difficulty, 0); err != nil {
+		return
+	}
+
+	keyHash := mine.HashBlock(data, nonce)
+	id = proto.NodeID(keyHash.String())
+	return
+}
+
+// VerifyNodeID verifies id is the Hash(publicKey||nonce) and reaches difficulty
+func VerifyNodeID(id proto.NodeID, publicKey *asymmetric.PublicKey, nonce mine.Uint256,
+	difficulty int) (err error) {
+	if publicKey == nil {
+		return ErrNilNode
+	}
+
+	idHash, err := hash.NewHashFromStr(string(id))
+	if err != nil {
+		return ErrNotValidNodeID
+	}
+
+	keyHash := mine.HashBlock(publicKey.Serialize(), nonce)
+	if !keyHash.IsEqual(idHash) {
+		return ErrNodeIDKeyNonceNotMatch
+	}
+
+	if idHash.Difficulty() < difficulty {
+		return ErrNodeIDDifficulty
+	}
+
+	return
+}
@@ -0,0 +1,66 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kms
+
+import (
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/thunderdb/ThunderDB/crypto/asymmetric"
+	"github.com/thunderdb/ThunderDB/pow/cpuminer"
+)
+
+func TestGenerateNodeID(t *testing.T) {
+	Convey("generate and verify node id", t, func() {
+		_, pubKey, err := asymmetric.GenSecp256k1KeyPair()
+		So(err, ShouldBeNil)
+
+		id, nonce, err := GenerateNodeID(pubKey, 8)
+		So(err, ShouldBeNil)
+		So(id.Difficulty(), ShouldBeGreaterThanOrEqualTo, 8)
+		So(VerifyNodeID(id, pubKey, nonce, 8), ShouldBeNil)
+		So(VerifyNodeID(id, pubKey, nonce, 256), ShouldEqual, ErrNodeIDDifficulty)
+		So(VerifyNodeID(id, pubKey, cpuminer.Uint256{D: 1}, 0), ShouldEqual, ErrNodeIDKeyNonceNotMatch)
+		So(VerifyNodeID("not valid", pubKey, nonce, 0), ShouldEqual, ErrNotValidNodeID)
+		So(VerifyNodeID(id, nil, nonce, 0), ShouldEqual, ErrNilNode)
+
+		_, _, err = GenerateNodeID(nil, 8)
+		So(err, ShouldEqual, ErrNilNode)
+
+		Convey("generated node id is accepted by SetPublicKey", func() {
+			const nodeIDDBFile = ".test_nodeid.db"
+			pks = nil
+			os.Remove(nodeIDDBFile)
+			defer os.Remove(nodeIDDBFile)
+
+			So(InitPublicKeyStore(nodeIDDBFile, nil), ShouldBeNil)
+			defer pks.db.Close()
+
+			So(SetPublicKey(id, nonce, pubKey), ShouldBeNil)
+			pubk, err := GetPublicKey(id)
+			So(err, ShouldBeNil)
+			So(pubk.IsEqual(pubKey), ShouldBeTrue)
+
+			origin := MinNodeIDDifficulty
+			MinNodeIDDifficulty = 256
+			defer func() { MinNodeIDDifficulty = origin }()
+
+			So(SetPublicKey(id, nonce, pubKey), ShouldEqual, ErrNodeIDDifficulty)
+		})
+	})
+}
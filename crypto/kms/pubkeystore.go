@@ -23,6 +23,12 @@ import (
 
 	"bytes"
 
+	"sort"
+
+	"encoding/binary"
+
+	"time"
+
 	log "github.com/sirupsen/logrus"
 
 	"github.com/coreos/bbolt"
@@ -33,21 +39,27 @@ import (
 	"github.com/ugorji/go/codec"
 )
 
-// PublicKeyStore holds db and bucket name
+// PublicKeyStore holds db and bucket name of a namespace, several stores of
+// different namespaces can share a db, see WithNamespace
 type PublicKeyStore struct {
-	db     *bolt.DB
-	bucket []byte
+	db        *bolt.DB
+	namespace string
+	bucket    []byte
 }
 
 const (
 	// kmsBucketName is the boltdb bucket name
 	kmsBucketName = "kms"
+	// kmsExpiryBucketName is the boltdb bucket name of node expiry time
+	kmsExpiryBucketName = "kms_expiry"
+	// kmsNamespaceSep separates the bucket name and the namespace
+	kmsNamespaceSep = ":"
 )
 
 var (
-	// pks holds the singleton instance
+	// pks holds the singleton instance of default namespace
 	pks *PublicKeyStore
-	// PksOnce for easy test we make PksOnce exported
+	// PksOnce for easy test we make PksOnce exported, it's reset by CloseStore
 	PksOnce sync.Once
 	// Unittest is a test flag
 	Unittest bool
@@ -95,90 +107,265 @@ var (
 )
 
 // InitPublicKeyStore opens a db file, if not exist, creates it.
-// and creates a bucket if not exist
+// and creates a bucket if not exist. An existing db of older schema version
+// is migrated, and a db of newer version is refused with ErrSchemaVersionTooNew
 func InitPublicKeyStore(dbPath string, initNode *proto.Node) (err error) {
+	s, err := openPublicKeyStore(dbPath)
+	if err != nil {
+		log.Errorf("InitPublicKeyStore failed: %s", err)
+		return
+	}
+
+	// pks is the singleton instance
+	pks = s
+
+	if initNode != nil {
+		err = setNode(initNode)
+	}
+
+	return
+}
+
+// NewPublicKeyStore opens a db file like InitPublicKeyStore, and returns the
+// store of namespace in it, the empty namespace is the default one used by
+// the package level functions. The initNode is set if it's not nil
+func NewPublicKeyStore(dbPath string, namespace string, initNode *proto.Node) (
+	s *PublicKeyStore, err error) {
+	root, err := openPublicKeyStore(dbPath)
+	if err != nil {
+		log.Errorf("NewPublicKeyStore failed: %s", err)
+		return
+	}
+
+	if s, err = root.WithNamespace(namespace); err == nil && initNode != nil {
+		err = s.setNode(initNode)
+	}
+	if err != nil {
+		root.Close()
+		return nil, err
+	}
+
+	return
+}
+
+// openPublicKeyStore opens the db file and returns the store of default namespace
+func openPublicKeyStore(dbPath string) (s *PublicKeyStore, err error) {
 	var bdb *bolt.DB
 	bdb, err = bolt.Open(dbPath, 0600, nil)
 	if err != nil {
-		log.Errorf("InitPublicKeyStore failed: %s", err)
 		return
 	}
 
 	name := []byte(kmsBucketName)
 	err = (*bolt.DB)(bdb).Update(func(tx *bolt.Tx) error {
+		if err := migrate(tx); err != nil {
+			return err
+		}
 		if _, err := tx.CreateBucketIfNotExists(name); err != nil {
 			log.Errorf("could not create bucket: %s", err)
 			return err
 		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(kmsExpiryBucketName)); err != nil {
+			log.Errorf("could not create bucket: %s", err)
+			return err
+		}
 		return nil // return from Update func
 	})
 	if err != nil {
-		log.Errorf("InitPublicKeyStore failed: %s", err)
+		bdb.Close()
 		return
 	}
 
-	// pks is the singleton instance
-	pks = &PublicKeyStore{
+	return &PublicKeyStore{
 		db:     bdb,
 		bucket: name,
+	}, nil
+}
+
+// WithNamespace returns the store of namespace sharing the db with s, the
+// buckets of namespace are created if not exist
+func (s *PublicKeyStore) WithNamespace(namespace string) (ns *PublicKeyStore, err error) {
+	ns = &PublicKeyStore{
+		db:        s.db,
+		namespace: namespace,
+		bucket:    namespaceBucket(kmsBucketName, namespace),
 	}
+	err = (*bolt.DB)(s.db).Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(ns.bucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(ns.expiryBucket())
+		return err
+	})
+	if err != nil {
+		log.Errorf("create namespace %s failed: %s", namespace, err)
+		return nil, err
+	}
+	return
+}
 
-	if initNode != nil {
-		err = setNode(initNode)
+// Namespace returns the namespace of store
+func (s *PublicKeyStore) Namespace() string {
+	return s.namespace
+}
+
+// Close closes the db of store, which is shared by the stores returned by
+// WithNamespace
+func (s *PublicKeyStore) Close() error {
+	return s.db.Close()
+}
+
+// namespaceBucket returns the bucket name of namespace, the empty namespace
+// uses the bucket name itself
+func namespaceBucket(name string, namespace string) []byte {
+	if namespace == "" {
+		return []byte(name)
 	}
+	return []byte(name + kmsNamespaceSep + namespace)
+}
 
+// expiryBucket returns the name of node expiry bucket of store
+func (s *PublicKeyStore) expiryBucket() []byte {
+	return namespaceBucket(kmsExpiryBucketName, s.namespace)
+}
+
+// CloseStore closes the db of public key store and resets the singleton, so that
+// InitPublicKeyStore can be called again, e.g. with another db file.
+// It's safe to call CloseStore if the store is not initialized
+func CloseStore() (err error) {
+	if pks != nil {
+		err = pks.db.Close()
+		pks = nil
+	}
+	PksOnce = sync.Once{}
 	return
 }
 
-// GetPublicKey gets a PublicKey of given id
+// GetPublicKey gets a PublicKey of given id in default store
 // Returns an error if the id was not found
 func GetPublicKey(id proto.NodeID) (publicKey *asymmetric.PublicKey, err error) {
-	node, err := GetNodeInfo(id)
+	return pks.GetPublicKey(id)
+}
+
+// GetPublicKey gets a PublicKey of given id
+// Returns an error if the id was not found
+func (s *PublicKeyStore) GetPublicKey(id proto.NodeID) (publicKey *asymmetric.PublicKey, err error) {
+	node, err := s.GetNodeInfo(id)
 	if err == nil {
 		publicKey = node.PublicKey
 	}
 	return
 }
 
-// GetNodeInfo gets node info of given id
-// Returns an error if the id was not found
+// GetPublicKeys gets the PublicKeys of given ids in default store, see
+// PublicKeyStore.GetPublicKeys
+func GetPublicKeys(ids []proto.NodeID) (
+	publicKeys map[proto.NodeID]*asymmetric.PublicKey, missing []proto.NodeID, err error) {
+	return pks.GetPublicKeys(ids)
+}
+
+// GetPublicKeys gets the PublicKeys of given ids in a single read transaction
+// Returns the found keys, and the ids not found or expired in request order
+func (s *PublicKeyStore) GetPublicKeys(ids []proto.NodeID) (
+	publicKeys map[proto.NodeID]*asymmetric.PublicKey, missing []proto.NodeID, err error) {
+	var expired []proto.NodeID
+	err = (*bolt.DB)(s.db).View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(s.bucket)
+		if bucket == nil {
+			return ErrBucketNotInitialized
+		}
+		publicKeys = make(map[proto.NodeID]*asymmetric.PublicKey, len(ids))
+		checked := make(map[proto.NodeID]bool, len(ids))
+		for _, id := range ids {
+			if checked[id] {
+				continue
+			}
+			checked[id] = true
+			if s.isExpired(tx, []byte(id)) {
+				expired = append(expired, id)
+				missing = append(missing, id)
+				continue
+			}
+			byteVal := bucket.Get([]byte(id))
+			if byteVal == nil {
+				missing = append(missing, id)
+				continue
+			}
+			nodeInfo, err := decodeNode(byteVal)
+			if err != nil {
+				return err
+			}
+			publicKeys[id] = nodeInfo.PublicKey
+		}
+		return nil // return from View func
+	})
+	for _, id := range expired {
+		s.sweepNode(id)
+	}
+	if err != nil {
+		log.Errorf("get public keys failed: %s", err)
+		return nil, nil, err
+	}
+	return
+}
+
+// VerifyEnvelope verifies the signed envelope with the public key of its signer in default store
+// Returns ErrKeyNotFound if the signer is unknown
+func VerifyEnvelope(e *proto.SignedEnvelope) error {
+	return pks.VerifyEnvelope(e)
+}
+
+// VerifyEnvelope verifies the signed envelope with the public key of its signer in store
+// Returns ErrKeyNotFound if the signer is unknown
+func (s *PublicKeyStore) VerifyEnvelope(e *proto.SignedEnvelope) error {
+	return e.Verify(s.GetPublicKey)
+}
+
+// GetNodeInfo gets node info of given id in default store
+// Returns an error if the id was not found or expired
 func GetNodeInfo(id proto.NodeID) (nodeInfo *proto.Node, err error) {
-	err = (*bolt.DB)(pks.db).View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(pks.bucket)
+	return pks.GetNodeInfo(id)
+}
+
+// GetNodeInfo gets node info of given id
+// Returns an error if the id was not found or expired
+func (s *PublicKeyStore) GetNodeInfo(id proto.NodeID) (nodeInfo *proto.Node, err error) {
+	var expired bool
+	err = (*bolt.DB)(s.db).View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(s.bucket)
 		if bucket == nil {
 			return ErrBucketNotInitialized
 		}
+		if expired = s.isExpired(tx, []byte(id)); expired {
+			return ErrKeyNotFound
+		}
 		byteVal := bucket.Get([]byte(id))
 		if byteVal == nil {
 			return ErrKeyNotFound
 		}
 		log.Debugf("get node: %#v", byteVal)
-		reader := bytes.NewReader(byteVal)
-		mh := &codec.MsgpackHandle{}
-		dec := codec.NewDecoder(reader, mh)
-		nodeInfo = proto.NewNode()
-		err = dec.Decode(nodeInfo)
+		nodeInfo, err = decodeNode(byteVal)
 		return err // return from View func
 	})
+	if expired {
+		s.sweepNode(id)
+	}
 	if err != nil {
 		log.Errorf("get node info failed: %s", err)
 	}
 	return
 }
 
-// GetAllNodeID get all node ids exist in store
+// GetAllNodeID get all node ids exist in default store
 func GetAllNodeID() (nodeIDs []proto.NodeID, err error) {
-	err = (*bolt.DB)(pks.db).View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(pks.bucket)
-		if bucket == nil {
-			return ErrBucketNotInitialized
-		}
-		err := bucket.ForEach(func(k, v []byte) error {
-			nodeIDs = append(nodeIDs, proto.NodeID(k))
-			return nil
-		})
+	return pks.GetAllNodeID()
+}
 
-		return err // return from View func
+// GetAllNodeID get all node ids exist in store
+func (s *PublicKeyStore) GetAllNodeID() (nodeIDs []proto.NodeID, err error) {
+	err = s.forEachNodeID(func(id proto.NodeID) error {
+		nodeIDs = append(nodeIDs, id)
+		return nil
 	})
 	if err != nil {
 		log.Errorf("get all node id failed: %s", err)
@@ -187,58 +374,185 @@ func GetAllNodeID() (nodeIDs []proto.NodeID, err error) {
 
 }
 
-// SetPublicKey verifies nonce and set Public Key
+// GetAllNodeIDsSorted gets all node ids exist in default store in lexicographic order
+func GetAllNodeIDsSorted() (nodeIDs []proto.NodeID, err error) {
+	return pks.GetAllNodeIDsSorted()
+}
+
+// GetAllNodeIDsSorted gets all node ids exist in store in lexicographic order,
+// which is stable for hashing or comparing the node set
+func (s *PublicKeyStore) GetAllNodeIDsSorted() (nodeIDs []proto.NodeID, err error) {
+	if nodeIDs, err = s.GetAllNodeID(); err != nil {
+		return
+	}
+	sort.Slice(nodeIDs, func(i, j int) bool {
+		return nodeIDs[i] < nodeIDs[j]
+	})
+	return
+}
+
+// ForEachNode calls fn with every unexpired node in default store, see
+// PublicKeyStore.ForEachNode
+func ForEachNode(fn func(nodeInfo *proto.Node) error) error {
+	return pks.ForEachNode(fn)
+}
+
+// ForEachNode calls fn with every unexpired node in store within a single read
+// transaction, so the nodes are a consistent snapshot of store and concurrent
+// writes are not blocked. Iteration stops on the first error returned by fn,
+// which is returned by ForEachNode
+func (s *PublicKeyStore) ForEachNode(fn func(nodeInfo *proto.Node) error) error {
+	return s.forEachNodeRecord(func(k, v []byte) error {
+		nodeInfo, err := decodeNode(v)
+		if err != nil {
+			log.Errorf("decode node %s failed: %s", k, err)
+			return err
+		}
+		return fn(nodeInfo)
+	})
+}
+
+// forEachNodeID calls fn with every unexpired node id in store, iteration stops
+// on the first error returned by fn
+func (s *PublicKeyStore) forEachNodeID(fn func(id proto.NodeID) error) error {
+	return s.forEachNodeRecord(func(k, v []byte) error {
+		return fn(proto.NodeID(k))
+	})
+}
+
+// forEachNodeRecord calls fn with every unexpired node id and its encoded node
+// in a read transaction, iteration stops on the first error returned by fn
+func (s *PublicKeyStore) forEachNodeRecord(fn func(k, v []byte) error) error {
+	return (*bolt.DB)(s.db).View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(s.bucket)
+		if bucket == nil {
+			return ErrBucketNotInitialized
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			if s.isExpired(tx, k) {
+				return nil
+			}
+			return fn(k, v)
+		})
+	})
+}
+
+// decodeNode decodes the node encoded by setNodeWithExpiry
+func decodeNode(byteVal []byte) (nodeInfo *proto.Node, err error) {
+	reader := bytes.NewReader(byteVal)
+	mh := &codec.MsgpackHandle{}
+	dec := codec.NewDecoder(reader, mh)
+	nodeInfo = proto.NewNode()
+	err = dec.Decode(nodeInfo)
+	return
+}
+
+// isExpired checks if the node of given id has an expiry time before now
+func (s *PublicKeyStore) isExpired(tx *bolt.Tx, id []byte) bool {
+	bucket := tx.Bucket(s.expiryBucket())
+	if bucket == nil {
+		return false
+	}
+	byteVal := bucket.Get(id)
+	if len(byteVal) != 8 {
+		return false
+	}
+	return time.Now().UnixNano() >= int64(binary.BigEndian.Uint64(byteVal))
+}
+
+// SetPublicKey verifies nonce and set Public Key in default store
 func SetPublicKey(id proto.NodeID, nonce mine.Uint256, publicKey *asymmetric.PublicKey) (err error) {
+	return pks.SetPublicKey(id, nonce, publicKey)
+}
+
+// SetPublicKey verifies nonce and set Public Key
+func (s *PublicKeyStore) SetPublicKey(id proto.NodeID, nonce mine.Uint256, publicKey *asymmetric.PublicKey) (err error) {
 	nodeInfo := &proto.Node{
 		ID:        id,
 		Addr:      "",
 		PublicKey: publicKey,
 		Nonce:     nonce,
 	}
-	return SetNode(nodeInfo)
+	return s.SetNode(nodeInfo)
 }
 
-// SetNode verifies nonce and sets {proto.Node.ID: proto.Node}
+// SetNode verifies nonce and sets {proto.Node.ID: proto.Node} in default store
 func SetNode(nodeInfo *proto.Node) (err error) {
+	return pks.SetNode(nodeInfo)
+}
+
+// SetNode verifies nonce and sets {proto.Node.ID: proto.Node}
+func (s *PublicKeyStore) SetNode(nodeInfo *proto.Node) (err error) {
+	return s.SetNodeWithTTL(nodeInfo, 0)
+}
+
+// SetNodeWithTTL verifies nonce and sets the node which expires after ttl in
+// default store, see PublicKeyStore.SetNodeWithTTL
+func SetNodeWithTTL(nodeInfo *proto.Node, ttl time.Duration) (err error) {
+	return pks.SetNodeWithTTL(nodeInfo, ttl)
+}
+
+// SetNodeWithTTL verifies nonce and sets {proto.Node.ID: proto.Node} which
+// expires after ttl, expired node is treated as not found and removed on read.
+// A non-positive ttl makes the node permanent like SetNode
+func (s *PublicKeyStore) SetNodeWithTTL(nodeInfo *proto.Node, ttl time.Duration) (err error) {
 	if nodeInfo == nil {
 		return ErrNilNode
 	}
 	if !Unittest {
-		if nodeInfo.PublicKey == nil {
-			return ErrNilNode
-		}
-		keyHash := mine.HashBlock(nodeInfo.PublicKey.Serialize(), nodeInfo.Nonce)
-		id := nodeInfo.ID
-		idHash, err := hash.NewHashFromStr(string(id))
+		err = VerifyNodeID(nodeInfo.ID, nodeInfo.PublicKey, nodeInfo.Nonce, MinNodeIDDifficulty)
 		if err != nil {
-			return ErrNotValidNodeID
-		}
-		if !keyHash.IsEqual(idHash) {
-			return ErrNodeIDKeyNonceNotMatch
+			return
 		}
 	}
 
-	return setNode(nodeInfo)
+	if ttl <= 0 {
+		return s.setNode(nodeInfo)
+	}
+	return s.setNodeWithExpiry(nodeInfo, time.Now().Add(ttl))
 }
 
-// setNode sets id and its publicKey
+// setNode sets id and its publicKey in default store
 func setNode(nodeInfo *proto.Node) (err error) {
+	return pks.setNode(nodeInfo)
+}
+
+// setNode sets id and its publicKey
+func (s *PublicKeyStore) setNode(nodeInfo *proto.Node) (err error) {
+	return s.setNodeWithExpiry(nodeInfo, time.Time{})
+}
+
+// setNodeWithExpiry sets id and its publicKey, zero expiry means permanent. The
+// address is stored in the form of proto.NormalizeAddr, an empty address is
+// kept as unknown
+func (s *PublicKeyStore) setNodeWithExpiry(nodeInfo *proto.Node, expiry time.Time) (err error) {
+	node := *nodeInfo
+	if node.Addr != "" {
+		if node.Addr, err = proto.NormalizeAddr(node.Addr); err != nil {
+			log.Errorf("invalid node address %s: %s", nodeInfo.Addr, err)
+			return
+		}
+	}
+
 	nodeBuf := new(bytes.Buffer)
 	mh := &codec.MsgpackHandle{}
 	enc := codec.NewEncoder(nodeBuf, mh)
-	err = enc.Encode(*nodeInfo)
+	err = enc.Encode(node)
 	if err != nil {
 		log.Errorf("marshal node info failed: %s", err)
 		return
 	}
 	log.Debugf("set node: %#v", nodeBuf.Bytes())
 
-	err = (*bolt.DB)(pks.db).Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(pks.bucket)
+	err = (*bolt.DB)(s.db).Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(s.bucket)
 		if bucket == nil {
 			return ErrBucketNotInitialized
 		}
-		return bucket.Put([]byte(nodeInfo.ID), nodeBuf.Bytes())
+		if err := bucket.Put([]byte(node.ID), nodeBuf.Bytes()); err != nil {
+			return err
+		}
+		return s.setExpiry(tx, []byte(node.ID), expiry)
 	})
 	if err != nil {
 		log.Errorf("get node info failed: %s", err)
@@ -247,14 +561,60 @@ func setNode(nodeInfo *proto.Node) (err error) {
 	return
 }
 
-// DelNode removes PublicKey to the id
+// sweepNode removes the node of given id if it is still expired
+func (s *PublicKeyStore) sweepNode(id proto.NodeID) (err error) {
+	err = (*bolt.DB)(s.db).Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(s.bucket)
+		if bucket == nil || !s.isExpired(tx, []byte(id)) {
+			return nil
+		}
+		if err := bucket.Delete([]byte(id)); err != nil {
+			return err
+		}
+		return s.setExpiry(tx, []byte(id), time.Time{})
+	})
+	if err != nil {
+		log.Errorf("sweep node failed: %s", err)
+	}
+	return
+}
+
+// setExpiry sets the expiry time of given id, zero expiry removes it
+func (s *PublicKeyStore) setExpiry(tx *bolt.Tx, id []byte, expiry time.Time) error {
+	bucket := tx.Bucket(s.expiryBucket())
+	if bucket == nil {
+		if expiry.IsZero() {
+			return nil
+		}
+		var err error
+		if bucket, err = tx.CreateBucket(s.expiryBucket()); err != nil {
+			return err
+		}
+	}
+	if expiry.IsZero() {
+		return bucket.Delete(id)
+	}
+	byteVal := make([]byte, 8)
+	binary.BigEndian.PutUint64(byteVal, uint64(expiry.UnixNano()))
+	return bucket.Put(id, byteVal)
+}
+
+// DelNode removes PublicKey to the id in default store
 func DelNode(id proto.NodeID) (err error) {
-	err = (*bolt.DB)(pks.db).Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(pks.bucket)
+	return pks.DelNode(id)
+}
+
+// DelNode removes PublicKey to the id
+func (s *PublicKeyStore) DelNode(id proto.NodeID) (err error) {
+	err = (*bolt.DB)(s.db).Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(s.bucket)
 		if bucket == nil {
 			return ErrBucketNotInitialized
 		}
-		return bucket.Delete([]byte(id))
+		if err := bucket.Delete([]byte(id)); err != nil {
+			return err
+		}
+		return s.setExpiry(tx, []byte(id), time.Time{})
 	})
 	if err != nil {
 		log.Errorf("del node failed: %s", err)
@@ -262,31 +622,46 @@ func DelNode(id proto.NodeID) (err error) {
 	return
 }
 
-// removeBucket this bucket
+// removeBucket removes the bucket of default store
 func removeBucket() (err error) {
-	err = (*bolt.DB)(pks.db).Update(func(tx *bolt.Tx) error {
-		return tx.DeleteBucket([]byte(kmsBucketName))
+	return pks.removeBucket()
+}
+
+// removeBucket this bucket
+func (s *PublicKeyStore) removeBucket() (err error) {
+	err = (*bolt.DB)(s.db).Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(s.expiryBucket()) != nil {
+			if err := tx.DeleteBucket(s.expiryBucket()); err != nil {
+				return err
+			}
+		}
+		return tx.DeleteBucket(namespaceBucket(kmsBucketName, s.namespace))
 	})
 	if err != nil {
 		log.Errorf("remove bucket failed: %s", err)
 		return
 	}
 	// ks.bucket == nil means bucket not exist
-	pks.bucket = nil
+	s.bucket = nil
 	return
 }
 
-// ResetBucket this bucket
+// ResetBucket resets the bucket of default store
 func ResetBucket() error {
+	return pks.ResetBucket()
+}
+
+// ResetBucket this bucket
+func (s *PublicKeyStore) ResetBucket() error {
 	// cause we are going to reset the bucket, the return of removeBucket
 	// is not useful
-	removeBucket()
-	bucketName := []byte(kmsBucketName)
-	err := (*bolt.DB)(pks.db).Update(func(tx *bolt.Tx) error {
+	s.removeBucket()
+	bucketName := namespaceBucket(kmsBucketName, s.namespace)
+	err := (*bolt.DB)(s.db).Update(func(tx *bolt.Tx) error {
 		_, err := tx.CreateBucketIfNotExists(bucketName)
 		return err
 	})
-	pks.bucket = bucketName
+	s.bucket = bucketName
 	if err != nil {
 		log.Errorf("reset bucket failed: %s", err)
 	}
@@ -29,6 +29,15 @@ import (
 
 	"reflect"
 
+	"fmt"
+
+	"math/rand"
+
+	"time"
+
+	"errors"
+
+	"github.com/coreos/bbolt"
 	log "github.com/sirupsen/logrus"
 	. "github.com/smartystreets/goconvey/convey"
 	"github.com/thunderdb/ThunderDB/crypto/asymmetric"
@@ -110,6 +119,15 @@ func TestDB(t *testing.T) {
 		So(err, ShouldBeNil)
 		So(privKey2.PubKey().IsEqual(pubKey2), ShouldBeTrue)
 
+		envelope, err := proto.NewSignedEnvelope([]byte("payload"), proto.NodeID("node1"), privKey1)
+		So(err, ShouldBeNil)
+		So(VerifyEnvelope(envelope), ShouldBeNil)
+		envelope.Signer = proto.NodeID("node2")
+		So(VerifyEnvelope(envelope), ShouldEqual, proto.ErrSignatureNotMatch)
+		envelope, err = proto.NewSignedEnvelope([]byte("payload"), proto.NodeID("not exist"), privKey1)
+		So(err, ShouldBeNil)
+		So(VerifyEnvelope(envelope), ShouldEqual, ErrKeyNotFound)
+
 		IDs, err := GetAllNodeID()
 		So(err, ShouldBeNil)
 		So(IDs, ShouldHaveLength, 3)
@@ -157,16 +175,401 @@ func TestDB(t *testing.T) {
 	})
 }
 
+func TestGetAllNodeIDsSorted(t *testing.T) {
+	Convey("get all node ids in sorted order", t, func() {
+		ids := make([]proto.NodeID, 16)
+		for i := range ids {
+			ids[i] = proto.NodeID(fmt.Sprintf("node%02d", i))
+		}
+
+		var results [][]proto.NodeID
+		for i := 0; i < 3; i++ {
+			pks = nil
+			os.Remove(dbFile)
+			So(InitPublicKeyStore(dbFile, nil), ShouldBeNil)
+
+			for _, j := range rand.Perm(len(ids)) {
+				So(setNode(&proto.Node{ID: ids[j]}), ShouldBeNil)
+			}
+
+			IDs, err := GetAllNodeIDsSorted()
+			So(err, ShouldBeNil)
+			results = append(results, IDs)
+
+			pks.db.Close()
+			os.Remove(dbFile)
+		}
+
+		So(results[0], ShouldResemble, ids)
+		So(results[1], ShouldResemble, results[0])
+		So(results[2], ShouldResemble, results[0])
+	})
+}
+
+func TestSetNodeWithTTL(t *testing.T) {
+	Convey("set node with ttl", t, func() {
+		pks = nil
+		os.Remove(dbFile)
+		defer os.Remove(dbFile)
+		So(InitPublicKeyStore(dbFile, nil), ShouldBeNil)
+		defer pks.db.Close()
+
+		Unittest = true
+		defer func() { Unittest = false }()
+
+		_, pubKey, _ := asymmetric.GenSecp256k1KeyPair()
+		node := &proto.Node{
+			ID:        proto.NodeID("transient"),
+			PublicKey: pubKey,
+		}
+		permanent := &proto.Node{
+			ID:        proto.NodeID("permanent"),
+			PublicKey: pubKey,
+		}
+		So(SetNodeWithTTL(nil, time.Second), ShouldEqual, ErrNilNode)
+		So(SetNodeWithTTL(node, 200*time.Millisecond), ShouldBeNil)
+		So(SetNode(permanent), ShouldBeNil)
+
+		pubk, err := GetPublicKey(node.ID)
+		So(err, ShouldBeNil)
+		So(pubk.IsEqual(pubKey), ShouldBeTrue)
+		IDs, err := GetAllNodeID()
+		So(err, ShouldBeNil)
+		So(IDs, ShouldHaveLength, 2)
+
+		time.Sleep(300 * time.Millisecond)
+
+		IDs, err = GetAllNodeID()
+		So(err, ShouldBeNil)
+		So(IDs, ShouldResemble, []proto.NodeID{permanent.ID})
+		_, err = GetNodeInfo(node.ID)
+		So(err, ShouldEqual, ErrKeyNotFound)
+		pubk, err = GetPublicKey(node.ID)
+		So(pubk, ShouldBeNil)
+		So(err, ShouldEqual, ErrKeyNotFound)
+		_, err = GetPublicKey(permanent.ID)
+		So(err, ShouldBeNil)
+
+		// the expired node is swept on read
+		err = pks.db.View(func(tx *bolt.Tx) error {
+			So(tx.Bucket([]byte(kmsBucketName)).Get([]byte(node.ID)), ShouldBeNil)
+			So(tx.Bucket([]byte(kmsExpiryBucketName)).Get([]byte(node.ID)), ShouldBeNil)
+			return nil
+		})
+		So(err, ShouldBeNil)
+
+		// setting again without ttl makes the node permanent
+		So(SetNodeWithTTL(node, 100*time.Millisecond), ShouldBeNil)
+		So(SetNode(node), ShouldBeNil)
+		time.Sleep(200 * time.Millisecond)
+		_, err = GetPublicKey(node.ID)
+		So(err, ShouldBeNil)
+	})
+}
+
+func TestSetNodeAddr(t *testing.T) {
+	Convey("node address is normalized on set", t, func() {
+		pks = nil
+		os.Remove(dbFile)
+		defer os.Remove(dbFile)
+		So(InitPublicKeyStore(dbFile, nil), ShouldBeNil)
+		defer pks.db.Close()
+
+		Unittest = true
+		defer func() { Unittest = false }()
+
+		_, pubKey, _ := asymmetric.GenSecp256k1KeyPair()
+		node := &proto.Node{
+			ID:        proto.NodeID("node"),
+			Addr:      "[::ffff:127.0.0.1]:0080",
+			PublicKey: pubKey,
+		}
+		So(SetNode(node), ShouldBeNil)
+		So(node.Addr, ShouldEqual, "[::ffff:127.0.0.1]:0080")
+		stored, err := GetNodeInfo(node.ID)
+		So(err, ShouldBeNil)
+		So(stored.Addr, ShouldEqual, "127.0.0.1:80")
+
+		node.Addr = "Node.Example.COM.:2120"
+		So(SetNodeWithTTL(node, time.Hour), ShouldBeNil)
+		stored, err = GetNodeInfo(node.ID)
+		So(err, ShouldBeNil)
+		So(stored.Addr, ShouldEqual, "node.example.com:2120")
+
+		// empty address is kept as unknown
+		node.Addr = ""
+		So(SetNode(node), ShouldBeNil)
+		stored, err = GetNodeInfo(node.ID)
+		So(err, ShouldBeNil)
+		So(stored.Addr, ShouldEqual, "")
+
+		// malformed address is rejected, and the stored node is kept
+		for _, addr := range []string{"garbage", "127.0.0.1:http", "bad host:80", "127.0.0.1:65536"} {
+			node.Addr = addr
+			So(SetNode(node), ShouldEqual, proto.ErrInvalidAddr)
+			So(setNode(node), ShouldEqual, proto.ErrInvalidAddr)
+		}
+		stored, err = GetNodeInfo(node.ID)
+		So(err, ShouldBeNil)
+		So(stored.Addr, ShouldEqual, "")
+	})
+}
+
+func TestGetPublicKeys(t *testing.T) {
+	Convey("get public keys of present and absent nodes", t, func() {
+		pks = nil
+		os.Remove(dbFile)
+		defer os.Remove(dbFile)
+		So(InitPublicKeyStore(dbFile, nil), ShouldBeNil)
+		defer pks.db.Close()
+
+		Unittest = true
+		defer func() { Unittest = false }()
+
+		keys := make(map[proto.NodeID]*asymmetric.PublicKey)
+		for i := 0; i < 3; i++ {
+			_, pubKey, _ := asymmetric.GenSecp256k1KeyPair()
+			id := proto.NodeID(fmt.Sprintf("node%d", i))
+			keys[id] = pubKey
+			So(SetPublicKey(id, cpuminer.Uint256{}, pubKey), ShouldBeNil)
+		}
+		_, pubKey, _ := asymmetric.GenSecp256k1KeyPair()
+		So(SetNodeWithTTL(&proto.Node{ID: "expired", PublicKey: pubKey}, 50*time.Millisecond),
+			ShouldBeNil)
+		time.Sleep(100 * time.Millisecond)
+
+		found, missing, err := GetPublicKeys([]proto.NodeID{
+			"absent1", "node2", "expired", "node0", "absent0", "node2",
+		})
+		So(err, ShouldBeNil)
+		So(missing, ShouldResemble, []proto.NodeID{"absent1", "expired", "absent0"})
+		So(found, ShouldHaveLength, 2)
+		for _, id := range []proto.NodeID{"node0", "node2"} {
+			So(found[id].IsEqual(keys[id]), ShouldBeTrue)
+		}
+
+		// the expired node is swept on read
+		_, err = GetNodeInfo("expired")
+		So(err, ShouldEqual, ErrKeyNotFound)
+		IDs, err := GetAllNodeIDsSorted()
+		So(err, ShouldBeNil)
+		So(IDs, ShouldResemble, []proto.NodeID{"node0", "node1", "node2"})
+
+		found, missing, err = GetPublicKeys(nil)
+		So(err, ShouldBeNil)
+		So(found, ShouldBeEmpty)
+		So(missing, ShouldBeEmpty)
+	})
+}
+
+func TestForEachNode(t *testing.T) {
+	Convey("iterate nodes in a consistent snapshot", t, func() {
+		pks = nil
+		os.Remove(dbFile)
+		defer os.Remove(dbFile)
+		So(InitPublicKeyStore(dbFile, nil), ShouldBeNil)
+		defer pks.db.Close()
+
+		_, pubKey, _ := asymmetric.GenSecp256k1KeyPair()
+		const nodeCount = 32
+		// setNodes sets all the nodes with generation gen in a single transaction
+		setNodes := func(gen int) error {
+			return pks.db.Update(func(tx *bolt.Tx) error {
+				bucket := tx.Bucket(pks.bucket)
+				for i := 0; i < nodeCount; i++ {
+					node := &proto.Node{
+						ID:        proto.NodeID(fmt.Sprintf("node%02d", i)),
+						Addr:      fmt.Sprintf("gen%d", gen),
+						PublicKey: pubKey,
+					}
+					if err := bucket.Put([]byte(node.ID), encodeNode(node)); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		}
+		So(setNodes(0), ShouldBeNil)
+
+		stop := make(chan struct{})
+		wg := &sync.WaitGroup{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for gen := 1; ; gen++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				setNodes(gen)
+				setNode(&proto.Node{ID: "churn", Addr: "churn:2120", PublicKey: pubKey})
+				DelNode("churn")
+			}
+		}()
+
+		for i := 0; i < 100; i++ {
+			var addrs []string
+			err := ForEachNode(func(node *proto.Node) error {
+				if node.ID == "churn" {
+					if node.Addr != "churn:2120" {
+						t.Errorf("torn node: %+v", node)
+					}
+					return nil
+				}
+				if node.PublicKey == nil || !node.PublicKey.IsEqual(pubKey) {
+					t.Errorf("torn node: %+v", node)
+				}
+				addrs = append(addrs, node.Addr)
+				return nil
+			})
+			So(err, ShouldBeNil)
+			So(addrs, ShouldHaveLength, nodeCount)
+			for _, addr := range addrs {
+				So(addr, ShouldEqual, addrs[0])
+			}
+		}
+		close(stop)
+		wg.Wait()
+
+		// stop early
+		errStop := errors.New("stop")
+		count := 0
+		err := ForEachNode(func(node *proto.Node) error {
+			if count++; count == 3 {
+				return errStop
+			}
+			return nil
+		})
+		So(err, ShouldEqual, errStop)
+		So(count, ShouldEqual, 3)
+	})
+}
+
 func TestErrorPath(t *testing.T) {
 	Convey("can not init db", t, func() {
-		pks = nil
-		PksOnce = sync.Once{}
+		So(CloseStore(), ShouldBeNil)
 		err := InitPublicKeyStore("/path/not/exist", nil)
 		So(pks, ShouldBeNil)
 		So(err, ShouldNotBeNil)
 	})
 }
 
+func TestCloseStore(t *testing.T) {
+	Convey("close and re-init store with another db", t, func() {
+		const anotherDBFile = ".test.another.db"
+		So(CloseStore(), ShouldBeNil)
+		os.Remove(dbFile)
+		os.Remove(anotherDBFile)
+		defer os.Remove(dbFile)
+		defer os.Remove(anotherDBFile)
+
+		_, pubKey1, _ := asymmetric.GenSecp256k1KeyPair()
+		_, pubKey2, _ := asymmetric.GenSecp256k1KeyPair()
+		node1 := &proto.Node{ID: "node1", PublicKey: pubKey1}
+		node2 := &proto.Node{ID: "node2", PublicKey: pubKey2}
+
+		So(InitPublicKeyStore(dbFile, nil), ShouldBeNil)
+		So(setNode(node1), ShouldBeNil)
+		So(CloseStore(), ShouldBeNil)
+		So(pks, ShouldBeNil)
+
+		// Closing twice is harmless
+		So(CloseStore(), ShouldBeNil)
+
+		So(InitPublicKeyStore(anotherDBFile, nil), ShouldBeNil)
+		_, err := GetNodeInfo(node1.ID)
+		So(err, ShouldEqual, ErrKeyNotFound)
+		So(setNode(node2), ShouldBeNil)
+		So(CloseStore(), ShouldBeNil)
+
+		// The first db is not touched by the second store
+		So(InitPublicKeyStore(dbFile, nil), ShouldBeNil)
+		defer CloseStore()
+		node, err := GetNodeInfo(node1.ID)
+		So(err, ShouldBeNil)
+		So(node.PublicKey.IsEqual(pubKey1), ShouldBeTrue)
+		_, err = GetNodeInfo(node2.ID)
+		So(err, ShouldEqual, ErrKeyNotFound)
+	})
+}
+
+func TestPublicKeyStoreNamespaces(t *testing.T) {
+	Convey("stores of different namespaces do not interfere", t, func() {
+		const anotherDBFile = ".test.another.db"
+		os.Remove(dbFile)
+		os.Remove(anotherDBFile)
+		defer os.Remove(dbFile)
+		defer os.Remove(anotherDBFile)
+
+		Unittest = true
+		defer func() { Unittest = false }()
+
+		miners, err := NewPublicKeyStore(dbFile, "miner", nil)
+		So(err, ShouldBeNil)
+		defer miners.Close()
+		So(miners.Namespace(), ShouldEqual, "miner")
+
+		clients, err := miners.WithNamespace("client")
+		So(err, ShouldBeNil)
+		defaults, err := miners.WithNamespace("")
+		So(err, ShouldBeNil)
+
+		_, pubKey, _ := asymmetric.GenSecp256k1KeyPair()
+		others, err := NewPublicKeyStore(anotherDBFile, "miner", &proto.Node{
+			ID:        "node1",
+			PublicKey: pubKey,
+		})
+		So(err, ShouldBeNil)
+		defer others.Close()
+
+		stores := []*PublicKeyStore{miners, clients, defaults}
+		keys := make([]*asymmetric.PublicKey, len(stores))
+		for i, s := range stores {
+			_, keys[i], _ = asymmetric.GenSecp256k1KeyPair()
+			So(s.SetNode(&proto.Node{ID: "node1", PublicKey: keys[i]}), ShouldBeNil)
+			So(s.SetNodeWithTTL(&proto.Node{ID: "node2", PublicKey: keys[i]},
+				time.Duration(i+1)*100*time.Millisecond), ShouldBeNil)
+		}
+
+		for i, s := range append(stores, others) {
+			key, err := s.GetPublicKey("node1")
+			So(err, ShouldBeNil)
+			if i < len(keys) {
+				So(key.IsEqual(keys[i]), ShouldBeTrue)
+			} else {
+				So(key.IsEqual(pubKey), ShouldBeTrue)
+			}
+		}
+
+		// node expires in its own namespace only
+		time.Sleep(150 * time.Millisecond)
+		_, err = miners.GetNodeInfo("node2")
+		So(err, ShouldEqual, ErrKeyNotFound)
+		_, err = clients.GetNodeInfo("node2")
+		So(err, ShouldBeNil)
+		IDs, err := clients.GetAllNodeIDsSorted()
+		So(err, ShouldBeNil)
+		So(IDs, ShouldResemble, []proto.NodeID{"node1", "node2"})
+
+		So(clients.DelNode("node1"), ShouldBeNil)
+		_, err = clients.GetPublicKey("node1")
+		So(err, ShouldEqual, ErrKeyNotFound)
+		So(defaults.ResetBucket(), ShouldBeNil)
+		IDs, err = defaults.GetAllNodeID()
+		So(err, ShouldBeNil)
+		So(IDs, ShouldBeEmpty)
+
+		key, err := miners.GetPublicKey("node1")
+		So(err, ShouldBeNil)
+		So(key.IsEqual(keys[0]), ShouldBeTrue)
+		keys2, missing, err := others.GetPublicKeys([]proto.NodeID{"node1", "node2"})
+		So(err, ShouldBeNil)
+		So(keys2, ShouldHaveLength, 1)
+		So(missing, ShouldResemble, []proto.NodeID{"node2"})
+	})
+}
+
 func TestMarshalNode(t *testing.T) {
 	Convey("marshal unmarshal node", t, func() {
 		nodeInfo := &proto.Node{
@@ -0,0 +1,142 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kayak
+
+import (
+	"context"
+	"encoding/json"
+)
+
+func (tpc *TwoPCConfig) maxBatchLogs() int {
+	if tpc.MaxBatchLogs <= 1 {
+		return 1
+	}
+	return tpc.MaxBatchLogs
+}
+
+func (r *TwoPCRunner) encodeLogs(logs []*Log) ([]byte, error) {
+	return r.config.logCodec().Encode(logs)
+}
+
+func (r *TwoPCRunner) decodeLogs(data interface{}) (logs []*Log, err error) {
+	var b []byte
+
+	switch v := data.(type) {
+	case []byte:
+		b = v
+	default:
+		// payload converted by transport, e.g. bytes to base64 string by jsonrpc
+		var j []byte
+		if j, err = json.Marshal(data); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(j, &b); err != nil {
+			return nil, ErrInvalidLog
+		}
+	}
+
+	if err = r.config.logCodec().Decode(b, &logs); err != nil || len(logs) == 0 {
+		return nil, ErrInvalidLog
+	}
+
+	for _, l := range logs {
+		if l == nil {
+			return nil, ErrInvalidLog
+		}
+	}
+
+	return logs, nil
+}
+
+// loadBatch loads at most MaxBatchLogs committed logs from index.
+func (r *TwoPCRunner) loadBatch(index uint64) (logs []*Log, err error) {
+	for ; index <= r.lastLogIndex && len(logs) < r.config.maxBatchLogs(); index++ {
+		l := &Log{}
+		if err = r.logStore.GetLog(index, l); err != nil {
+			return
+		}
+		logs = append(logs, l)
+	}
+
+	return
+}
+
+// processLearnBatch commits the logs sent by LearnBatch in order, it responds the last committed
+// log index, so leader resends from it if any log fails.
+func (r *TwoPCRunner) processLearnBatch(req Request) {
+	err := r.nestedTimeoutCtx(context.Background(), r.config.CommitTimeout, func(ctx context.Context) (err error) {
+		if r.role == Leader || r.getState() != Idle {
+			return ErrInvalidRequest
+		}
+
+		var logs []*Log
+		if logs, err = r.decodeLogs(req.GetRequest()); err != nil {
+			return
+		}
+
+		for _, l := range logs {
+			if err = r.learnLog(ctx, l); err != nil {
+				return
+			}
+		}
+
+		return
+	})
+
+	req.SendResponse(r.lastLogIndex, err)
+}
+
+// batch returns the queued logs to ship in one round trip, it must be called with lock held.
+func (lr *learnerReplicator) batch() []*Log {
+	n := len(lr.inflight)
+	if max := lr.runner.config.maxBatchLogs(); n > max {
+		n = max
+	}
+	return append([]*Log(nil), lr.inflight[:n]...)
+}
+
+// pending returns the count of committed logs not acked by learner.
+func (lr *learnerReplicator) pending() int {
+	lr.lock.Lock()
+	defer lr.lock.Unlock()
+	return int(lr.lastIndex - lr.matchIndex)
+}
+
+// linger waits up to MaxBatchLatency for more logs to fill a batch before shipping, so that the
+// logs committed by concurrent writes are shipped in one round trip. Logs committed while a batch
+// is in flight are batched anyway.
+func (lr *learnerReplicator) linger() {
+	config := lr.runner.config
+	if config.MaxBatchLatency <= 0 || config.maxBatchLogs() <= 1 {
+		return
+	}
+
+	timer := config.clock().NewTimer(config.MaxBatchLatency)
+	defer timer.Stop()
+
+	for lr.pending() < config.maxBatchLogs() {
+		select {
+		case <-lr.stopCh:
+			return
+		case <-lr.runner.shutdownCh:
+			return
+		case <-timer.C():
+			return
+		case <-lr.notifyCh:
+		}
+	}
+}
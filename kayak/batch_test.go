@@ -0,0 +1,229 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kayak
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/thunderdb/ThunderDB/proto"
+)
+
+// batchRecordTransport records the count of logs sent by each Learn or LearnBatch request.
+type batchRecordTransport struct {
+	*MockTransport
+	lock    sync.Mutex
+	batches []int
+}
+
+func (t *batchRecordTransport) Request(ctx context.Context, nodeID proto.NodeID,
+	method string, args interface{}) (interface{}, error) {
+	switch method {
+	case "Learn":
+		t.record(1)
+	case "LearnBatch":
+		var logs []*Log
+		(&MockLogCodec{}).Decode(args.([]byte), &logs)
+		t.record(len(logs))
+	}
+
+	return t.MockTransport.Request(ctx, nodeID, method, args)
+}
+
+func (t *batchRecordTransport) record(n int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.batches = append(t.batches, n)
+}
+
+func (t *batchRecordTransport) getBatches() []int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return append([]int(nil), t.batches...)
+}
+
+func TestTwoPCRunner_BatchReplication(t *testing.T) {
+	mockLogCodec := &MockLogCodec{}
+	mockRouter := &MockTransportRouter{
+		transports: make(map[proto.NodeID]*MockTransport),
+	}
+
+	type createMockRes struct {
+		runner *TwoPCRunner
+		config *TwoPCConfig
+		fsm    *recordFSM
+		store  *MockInmemStore
+	}
+
+	createMock := func(nodeID proto.NodeID) (res *createMockRes) {
+		logger := log.New()
+		logger.SetLevel(log.FatalLevel)
+		res = &createMockRes{
+			runner: NewTwoPCRunner(),
+			fsm:    &recordFSM{},
+			store:  NewMockInmemStore(),
+		}
+		res.config = &TwoPCConfig{
+			RuntimeConfig: RuntimeConfig{
+				RootDir:        "test_dir",
+				LocalID:        nodeID,
+				Runner:         res.runner,
+				Transport:      mockRouter.getTransport(nodeID),
+				ProcessTimeout: time.Millisecond * 800,
+				Logger:         logger,
+			},
+			LogCodec:        mockLogCodec,
+			FSM:             res.fsm,
+			PrepareTimeout:  time.Millisecond * 200,
+			CommitTimeout:   time.Millisecond * 200,
+			RollbackTimeout: time.Millisecond * 200,
+			MaxBatchLogs:    4,
+			MaxBatchLatency: time.Millisecond * 200,
+		}
+		return
+	}
+	peers := testPeersFixture(1, []*Server{
+		{
+			Role: Leader,
+			ID:   "leader",
+		},
+		{
+			Role: Follower,
+			ID:   "follower",
+		},
+		{
+			Role: Learner,
+			ID:   "learner",
+		},
+	})
+
+	Convey("batched log replication", t, func() {
+		mockRouter.ResetAll()
+
+		lMock := createMock("leader")
+		fMock := createMock("follower")
+		lnMock := createMock("learner")
+		mocks := []*createMockRes{lMock, fMock, lnMock}
+
+		transport := &batchRecordTransport{MockTransport: mockRouter.getTransport("leader")}
+		lMock.config.Transport = transport
+
+		for _, r := range mocks {
+			err := r.runner.Init(r.config, peers, r.store, r.store, r.config.Transport)
+			So(err, ShouldBeNil)
+		}
+
+		defer func() {
+			for _, r := range mocks {
+				r.runner.Shutdown(true)
+			}
+		}()
+
+		apply := func(from, to int) {
+			for i := from; i <= to; i++ {
+				testData, _ := mockLogCodec.Encode(fmt.Sprintf("test data %d", i))
+				So(lMock.runner.Apply(testData), ShouldBeNil)
+			}
+		}
+
+		Convey("logs are shipped to learner in batches", func() {
+			apply(1, 9)
+			So(waitLearned(lMock.runner, "learner", 9), ShouldBeTrue)
+			So(lnMock.fsm.getApplied(), ShouldResemble, []uint64{1, 2, 3, 4, 5, 6, 7, 8, 9})
+
+			batches := transport.getBatches()
+			So(len(batches), ShouldBeLessThan, 9)
+
+			total := 0
+			for _, n := range batches {
+				So(n, ShouldBeBetweenOrEqual, 1, 4)
+				total += n
+			}
+			So(total, ShouldEqual, 9)
+		})
+
+		Convey("batch with gap is rejected", func() {
+			apply(1, 3)
+			So(waitLearned(lMock.runner, "learner", 3), ShouldBeTrue)
+
+			var l2, l3 Log
+			So(lMock.store.GetLog(2, &l2), ShouldBeNil)
+			So(lMock.store.GetLog(3, &l3), ShouldBeNil)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			// already learned logs are skipped
+			data, _ := lMock.runner.encodeLogs([]*Log{&l2, &l3})
+			res, err := lMock.runner.transport.Request(ctx, "learner", "LearnBatch", data)
+			So(err, ShouldBeNil)
+			So(res, ShouldEqual, uint64(3))
+
+			gap := l3
+			gap.Index = 5
+			data, _ = lMock.runner.encodeLogs([]*Log{&gap})
+			_, err = lMock.runner.transport.Request(ctx, "learner", "LearnBatch", data)
+			So(err, ShouldEqual, ErrInvalidLog)
+
+			_, err = lMock.runner.transport.Request(ctx, "learner", "LearnBatch", []byte("[]"))
+			So(err, ShouldEqual, ErrInvalidLog)
+			So(lnMock.runner.lastLogIndex, ShouldEqual, uint64(3))
+		})
+
+		Convey("lagging follower is caught up in batches", func() {
+			apply(1, 6)
+
+			// new follower joins without any log
+			newPeers := testPeersFixture(2, []*Server{
+				{
+					Role: Leader,
+					ID:   "leader",
+				},
+				{
+					Role: Follower,
+					ID:   "follower",
+				},
+				{
+					Role: Follower,
+					ID:   "follower2",
+				},
+			})
+			f2Mock := createMock("follower2")
+			So(f2Mock.runner.Init(f2Mock.config, newPeers, f2Mock.store, f2Mock.store,
+				f2Mock.config.Transport), ShouldBeNil)
+			mocks = append(mocks, f2Mock)
+			So(lMock.runner.UpdatePeers(newPeers), ShouldBeNil)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			// writes are blocked during catch up
+			lMock.runner.processLock.Lock()
+			before := len(transport.getBatches())
+			err := lMock.runner.catchUpPeer(ctx, "follower2", 0)
+			lMock.runner.processLock.Unlock()
+			So(err, ShouldBeNil)
+			So(transport.getBatches()[before:], ShouldResemble, []int{4, 2})
+			So(f2Mock.fsm.getApplied(), ShouldResemble, []uint64{1, 2, 3, 4, 5, 6})
+		})
+	})
+}
@@ -46,6 +46,9 @@ type BoltStore struct {
 
 	// The path to the Bolt database file
 	path string
+
+	// codec of the stored log entries
+	codec LogCodec
 }
 
 // Options contains all the configuraiton used to open the BoltDB
@@ -61,6 +64,10 @@ type Options struct {
 	// write to the log. This is unsafe, so it should be used
 	// with caution.
 	NoSync bool
+
+	// Codec encodes the log entries on disk, it should be the LogCodec of the
+	// runner config, MsgPackLogCodec is used if it's not set.
+	Codec LogCodec
 }
 
 // readOnly returns true if the contained bolt options say to open
@@ -86,8 +93,12 @@ func New(options Options) (*BoltStore, error) {
 
 	// Create the new store
 	store := &BoltStore{
-		conn: handle,
-		path: options.Path,
+		conn:  handle,
+		path:  options.Path,
+		codec: options.Codec,
+	}
+	if store.codec == nil {
+		store.codec = &MsgPackLogCodec{}
 	}
 
 	// If the store was opened read-only, don't try and create buckets
@@ -170,7 +181,7 @@ func (b *BoltStore) GetLog(idx uint64, log *Log) error {
 	if val == nil {
 		return ErrKeyNotFound
 	}
-	return decodeMsgPack(val, log)
+	return b.codec.Decode(val, log)
 }
 
 // StoreLog is used to store a single raft log
@@ -188,12 +199,12 @@ func (b *BoltStore) StoreLogs(logs []*Log) error {
 
 	for _, log := range logs {
 		key := uint64ToBytes(log.Index)
-		val, err := encodeMsgPack(log)
+		val, err := b.codec.Encode(log)
 		if err != nil {
 			return err
 		}
 		bucket := tx.Bucket(dbLogs)
-		if err := bucket.Put(key, val.Bytes()); err != nil {
+		if err := bucket.Put(key, val); err != nil {
 			return err
 		}
 	}
@@ -274,6 +285,29 @@ func (b *BoltStore) GetUint64(key []byte) (uint64, error) {
 	return bytesToUint64(val), nil
 }
 
+// SetBatch is like Set and SetUint64, but sets all the values in a single transaction
+func (b *BoltStore) SetBatch(vals map[string][]byte, uint64Vals map[string]uint64) error {
+	tx, err := b.conn.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	bucket := tx.Bucket(dbConf)
+	for k, v := range vals {
+		if err := bucket.Put([]byte(k), v); err != nil {
+			return err
+		}
+	}
+	for k, v := range uint64Vals {
+		if err := bucket.Put([]byte(k), uint64ToBytes(v)); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
 // Sync performs an fsync on the database file handle. This is not necessary
 // under normal operation unless NoSync is enabled, in which this forces the
 // database file to sync against the disk.
@@ -373,3 +373,26 @@ func TestBoltStore_SetUint64_GetUint64(t *testing.T) {
 		So(val, ShouldEqual, v)
 	})
 }
+
+func TestBoltStore_SetBatch(t *testing.T) {
+	Convey("SetBatch", t, func() {
+		store := testBoltStore(t)
+		defer store.Close()
+		defer os.Remove(store.path)
+
+		err := store.SetBatch(map[string][]byte{
+			"hello": []byte("world"),
+		}, map[string]uint64{
+			"abc": 123,
+		})
+		So(err, ShouldBeNil)
+
+		// Read back the values
+		val, err := store.Get([]byte("hello"))
+		So(err, ShouldBeNil)
+		So(val, ShouldResemble, []byte("world"))
+		num, err := store.GetUint64([]byte("abc"))
+		So(err, ShouldBeNil)
+		So(num, ShouldEqual, uint64(123))
+	})
+}
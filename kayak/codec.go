@@ -0,0 +1,70 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the “License”);
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an “AS IS” BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kayak
+
+import (
+	"encoding/json"
+)
+
+// LogCodec is the encoder/decoder of log entries and log data.
+type LogCodec interface {
+	// Encode log to bytes
+	Encode(interface{}) ([]byte, error)
+
+	// Decode logs to bytes
+	Decode([]byte, interface{}) error
+}
+
+// TwoPCLogCodec is the log data encode/decoder.
+//
+// Deprecated: use LogCodec instead.
+type TwoPCLogCodec = LogCodec
+
+// MsgPackLogCodec is a LogCodec in msgpack format, it's the default codec.
+type MsgPackLogCodec struct{}
+
+// JSONLogCodec is a LogCodec in json format, which is readable for debugging.
+type JSONLogCodec struct{}
+
+// Encode implements LogCodec.Encode.
+func (c *MsgPackLogCodec) Encode(v interface{}) ([]byte, error) {
+	buf, err := encodeMsgPack(v)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode implements LogCodec.Decode.
+func (c *MsgPackLogCodec) Decode(data []byte, v interface{}) error {
+	return decodeMsgPack(data, v)
+}
+
+// Encode implements LogCodec.Encode.
+func (c *JSONLogCodec) Encode(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Decode implements LogCodec.Decode.
+func (c *JSONLogCodec) Decode(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+var (
+	_ LogCodec = &MsgPackLogCodec{}
+	_ LogCodec = &JSONLogCodec{}
+)
@@ -0,0 +1,127 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the “License”);
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an “AS IS” BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kayak
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/thunderdb/ThunderDB/crypto/hash"
+)
+
+var testLogCodecs = map[string]LogCodec{
+	"msgpack": &MsgPackLogCodec{},
+	"json":    &JSONLogCodec{},
+}
+
+func testCodecLog() *Log {
+	lastHash := hash.DoubleHashH([]byte("last log"))
+	l := &Log{
+		Index:    2,
+		Term:     1,
+		Data:     bytes.Repeat([]byte("test data"), 16),
+		LastHash: &lastHash,
+	}
+	l.ComputeHash()
+	return l
+}
+
+func TestLogCodec(t *testing.T) {
+	for name, codec := range testLogCodecs {
+		Convey("round trip log through "+name+" codec", t, func() {
+			l := testCodecLog()
+			b, err := codec.Encode(l)
+			So(err, ShouldBeNil)
+
+			var decoded *Log
+			err = codec.Decode(b, &decoded)
+			So(err, ShouldBeNil)
+			So(decoded, ShouldResemble, l)
+			So(decoded.VerifyHash(), ShouldBeTrue)
+
+			err = codec.Decode([]byte{0xc1}, &decoded)
+			So(err, ShouldNotBeNil)
+		})
+		Convey("decode log payload with "+name+" codec", t, func() {
+			r := NewTwoPCRunner()
+			r.config = &TwoPCConfig{LogCodec: codec}
+			l := testCodecLog()
+			b, err := r.encodeLog(l)
+			So(err, ShouldBeNil)
+
+			decoded, err := r.decodeLog(b)
+			So(err, ShouldBeNil)
+			So(decoded, ShouldResemble, l)
+
+			// bytes converted to base64 string by jsonrpc transport
+			var payload interface{} = base64.StdEncoding.EncodeToString(b)
+			decoded, err = r.decodeLog(payload)
+			So(err, ShouldBeNil)
+			So(decoded, ShouldResemble, l)
+
+			_, err = r.decodeLog(nil)
+			So(err, ShouldEqual, ErrInvalidLog)
+			_, err = r.decodeLog([]byte{0xc1})
+			So(err, ShouldEqual, ErrInvalidLog)
+		})
+		Convey("store log with "+name+" codec", t, func() {
+			fh, err := ioutil.TempFile("", "bolt")
+			So(err, ShouldBeNil)
+			os.Remove(fh.Name())
+			defer os.Remove(fh.Name())
+
+			store, err := New(Options{Path: fh.Name(), Codec: codec})
+			So(err, ShouldBeNil)
+			defer store.Close()
+
+			l := testCodecLog()
+			So(store.StoreLog(l), ShouldBeNil)
+			var stored Log
+			So(store.GetLog(l.Index, &stored), ShouldBeNil)
+			So(&stored, ShouldResemble, l)
+		})
+	}
+}
+
+func BenchmarkLogCodec(b *testing.B) {
+	l := testCodecLog()
+	for name, codec := range testLogCodecs {
+		encoded, err := codec.Encode(l)
+		if err != nil {
+			b.Fatalf("err: %s", err)
+		}
+		b.Run(name+"/Encode", func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(encoded)))
+			for i := 0; i < b.N; i++ {
+				codec.Encode(l)
+			}
+		})
+		b.Run(name+"/Decode", func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(encoded)))
+			for i := 0; i < b.N; i++ {
+				var decoded *Log
+				codec.Decode(encoded, &decoded)
+			}
+		})
+	}
+}
@@ -0,0 +1,572 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kayak
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// SyncPolicy defines when the writes of FileLogStore are synced to disk.
+type SyncPolicy int
+
+const (
+	// SyncAlways syncs the file on every write, a stored log survives crash once StoreLog returns
+	SyncAlways SyncPolicy = iota
+	// SyncInterval syncs the file in background every SyncInterval, logs written after the last
+	// sync may be lost on crash
+	SyncInterval
+	// SyncNever leaves the sync to operating system
+	SyncNever
+)
+
+const (
+	// DefaultSyncInterval defines the default interval of background sync with SyncInterval
+	DefaultSyncInterval = time.Second
+
+	// record header: payload length, crc32 of type and payload, record type
+	walHeaderSize = 9
+
+	walRecordLog    byte = 1
+	walRecordDelete byte = 2
+
+	// dead records are only compacted if there are as many as this
+	walCompactMinRecords = 1024
+)
+
+var (
+	// ErrCorruptedLog defines log record failing checksum error
+	ErrCorruptedLog = errors.New("corrupted log record")
+	// ErrStoreClosed defines operating on closed store error
+	ErrStoreClosed = errors.New("store is closed")
+
+	walCRCTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// FileLogOptions contains the configuration used to open FileLogStore.
+type FileLogOptions struct {
+	// Path is the path of the log file, it's created if it does not exist
+	Path string
+
+	// Codec encodes the log entries on disk, it should be the LogCodec of the
+	// runner config, MsgPackLogCodec is used if it's not set.
+	Codec LogCodec
+
+	// SyncPolicy defines when the writes are synced to disk, SyncAlways by default
+	SyncPolicy SyncPolicy
+
+	// SyncInterval is the interval of background sync with SyncInterval policy,
+	// DefaultSyncInterval is used if it's not set
+	SyncInterval time.Duration
+}
+
+// walPos is the position of a log record in file.
+type walPos struct {
+	offset int64
+	size   int64
+}
+
+// FileLogStore is a LogStore backed by an append-only file.
+//
+// Each stored log and each deleted range is appended as a record checksummed by crc32, the file
+// is replayed on open to rebuild the index of logs. A torn or corrupted last record found on
+// replay, which is usually written by a crash, is truncated, so the log is caught up from leader.
+// A corrupted record followed by other records fails the open with ErrCorruptedLog instead, since
+// truncating it would silently drop the committed logs after it. The file is rewritten with the
+// live records once the dead records outnumber them.
+type FileLogStore struct {
+	lock sync.RWMutex
+
+	file    *os.File
+	path    string
+	codec   LogCodec
+	policy  SyncPolicy
+	size    int64
+	index   map[uint64]walPos
+	first   uint64
+	last    uint64
+	records int
+	closed  bool
+
+	stopCh chan struct{}
+	doneCh chan struct{}
+}
+
+// NewFileLogStore opens the log file at path with the default options.
+func NewFileLogStore(path string) (*FileLogStore, error) {
+	return OpenFileLogStore(FileLogOptions{Path: path})
+}
+
+// OpenFileLogStore opens the log file with the options, and replays the records in it.
+func OpenFileLogStore(options FileLogOptions) (s *FileLogStore, err error) {
+	var file *os.File
+	if file, err = os.OpenFile(options.Path, os.O_RDWR|os.O_CREATE, dbFileMode); err != nil {
+		return
+	}
+
+	s = &FileLogStore{
+		file:   file,
+		path:   options.Path,
+		codec:  options.Codec,
+		policy: options.SyncPolicy,
+		index:  make(map[uint64]walPos),
+	}
+	if s.codec == nil {
+		s.codec = &MsgPackLogCodec{}
+	}
+
+	var info os.FileInfo
+	if info, err = file.Stat(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	s.size = info.Size()
+
+	if err = s.replay(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if s.policy == SyncInterval {
+		interval := options.SyncInterval
+		if interval <= 0 {
+			interval = DefaultSyncInterval
+		}
+		s.stopCh = make(chan struct{})
+		s.doneCh = make(chan struct{})
+		go s.syncLoop(interval)
+	}
+
+	return
+}
+
+// replay rebuilds the index from records, and truncates the torn or corrupted last record.
+func (s *FileLogStore) replay() (err error) {
+	var offset int64
+
+	for {
+		var (
+			typ     byte
+			payload []byte
+		)
+
+		typ, payload, err = s.readRecord(offset)
+		if err == io.EOF {
+			err = nil
+			break
+		} else if err == io.ErrUnexpectedEOF ||
+			(err == ErrCorruptedLog && offset+int64(walHeaderSize+len(payload)) == s.size) {
+			// torn write of crash, the log is resent by leader
+			if err = s.file.Truncate(offset); err != nil {
+				return
+			}
+			if err = s.file.Sync(); err != nil {
+				return
+			}
+			break
+		} else if err != nil {
+			return
+		}
+
+		size := int64(walHeaderSize + len(payload))
+
+		switch typ {
+		case walRecordLog:
+			var l Log
+			if err = s.codec.Decode(payload, &l); err != nil {
+				return
+			}
+			s.addIndex(l.Index, walPos{offset: offset, size: size})
+		case walRecordDelete:
+			if len(payload) != 16 {
+				return ErrCorruptedLog
+			}
+			s.deleteIndex(bytesToUint64(payload[:8]), bytesToUint64(payload[8:]))
+		default:
+			return ErrCorruptedLog
+		}
+
+		s.records++
+		offset += size
+	}
+
+	s.size = offset
+
+	return
+}
+
+// readRecord reads and verifies the record at offset, the payload is returned along with
+// ErrCorruptedLog, so the size of the corrupted record is known.
+func (s *FileLogStore) readRecord(offset int64) (typ byte, payload []byte, err error) {
+	header := make([]byte, walHeaderSize)
+
+	var n int
+	if n, err = s.file.ReadAt(header, offset); err == io.EOF && n > 0 {
+		return 0, nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return
+	}
+
+	length := binary.BigEndian.Uint32(header[:4])
+	checksum := binary.BigEndian.Uint32(header[4:8])
+	typ = header[8]
+
+	if offset+walHeaderSize+int64(length) > s.size {
+		// length of torn record
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+
+	payload = make([]byte, length)
+	if _, err = s.file.ReadAt(payload, offset+walHeaderSize); err == io.EOF {
+		return 0, nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return
+	}
+
+	crc := crc32.Update(crc32.Checksum(header[8:], walCRCTable), walCRCTable, payload)
+	if crc != checksum {
+		return 0, payload, ErrCorruptedLog
+	}
+
+	return
+}
+
+// appendRecords writes the records to the end of file and syncs it by policy, it must be called
+// with lock held.
+func (s *FileLogStore) appendRecords(typ byte, payloads ...[]byte) (positions []walPos, err error) {
+	var buf []byte
+
+	for _, payload := range payloads {
+		header := make([]byte, walHeaderSize)
+		binary.BigEndian.PutUint32(header[:4], uint32(len(payload)))
+		header[8] = typ
+		crc := crc32.Update(crc32.Checksum(header[8:], walCRCTable), walCRCTable, payload)
+		binary.BigEndian.PutUint32(header[4:8], crc)
+
+		positions = append(positions, walPos{
+			offset: s.size + int64(len(buf)),
+			size:   int64(walHeaderSize + len(payload)),
+		})
+		buf = append(buf, header...)
+		buf = append(buf, payload...)
+	}
+
+	if _, err = s.file.WriteAt(buf, s.size); err != nil {
+		// partial record is overwritten by next write, or truncated on replay
+		return nil, err
+	}
+
+	if s.policy == SyncAlways {
+		if err = s.file.Sync(); err != nil {
+			return nil, err
+		}
+	}
+
+	s.size += int64(len(buf))
+	s.records += len(payloads)
+
+	return
+}
+
+func (s *FileLogStore) addIndex(index uint64, pos walPos) {
+	s.index[index] = pos
+
+	if s.first == 0 || index < s.first {
+		s.first = index
+	}
+	if index > s.last {
+		s.last = index
+	}
+}
+
+func (s *FileLogStore) deleteIndex(min, max uint64) {
+	if len(s.index) == 0 {
+		return
+	}
+
+	if min < s.first {
+		min = s.first
+	}
+	if max > s.last {
+		max = s.last
+	}
+	for i := min; i <= max; i++ {
+		delete(s.index, i)
+	}
+
+	if len(s.index) == 0 {
+		s.first, s.last = 0, 0
+		return
+	}
+	for _, ok := s.index[s.first]; !ok; _, ok = s.index[s.first] {
+		s.first++
+	}
+	for _, ok := s.index[s.last]; !ok; _, ok = s.index[s.last] {
+		s.last--
+	}
+}
+
+// FirstIndex implements LogStore.FirstIndex.
+func (s *FileLogStore) FirstIndex() (uint64, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.closed {
+		return 0, ErrStoreClosed
+	}
+
+	return s.first, nil
+}
+
+// LastIndex implements LogStore.LastIndex.
+func (s *FileLogStore) LastIndex() (uint64, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.closed {
+		return 0, ErrStoreClosed
+	}
+
+	return s.last, nil
+}
+
+// GetLog implements LogStore.GetLog, the record is verified by checksum on read.
+func (s *FileLogStore) GetLog(index uint64, l *Log) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.closed {
+		return ErrStoreClosed
+	}
+
+	pos, ok := s.index[index]
+	if !ok {
+		return ErrKeyNotFound
+	}
+
+	typ, payload, err := s.readRecord(pos.offset)
+	if err == io.ErrUnexpectedEOF || (err == nil && typ != walRecordLog) {
+		return ErrCorruptedLog
+	} else if err != nil {
+		return err
+	}
+
+	return s.codec.Decode(payload, l)
+}
+
+// StoreLog implements LogStore.StoreLog.
+func (s *FileLogStore) StoreLog(l *Log) error {
+	return s.StoreLogs([]*Log{l})
+}
+
+// StoreLogs implements LogStore.StoreLogs, the logs are written in one append.
+func (s *FileLogStore) StoreLogs(logs []*Log) error {
+	payloads := make([][]byte, 0, len(logs))
+	for _, l := range logs {
+		payload, err := s.codec.Encode(l)
+		if err != nil {
+			return err
+		}
+		payloads = append(payloads, payload)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return ErrStoreClosed
+	}
+
+	positions, err := s.appendRecords(walRecordLog, payloads...)
+	if err != nil {
+		return err
+	}
+
+	for i, l := range logs {
+		s.addIndex(l.Index, positions[i])
+	}
+
+	return nil
+}
+
+// DeleteRange implements LogStore.DeleteRange, the range is inclusive.
+func (s *FileLogStore) DeleteRange(min, max uint64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return ErrStoreClosed
+	}
+
+	payload := append(uint64ToBytes(min), uint64ToBytes(max)...)
+	if _, err := s.appendRecords(walRecordDelete, payload); err != nil {
+		return err
+	}
+
+	s.deleteIndex(min, max)
+
+	if dead := s.records - len(s.index); dead >= walCompactMinRecords && dead > len(s.index) {
+		return s.compact()
+	}
+
+	return nil
+}
+
+// Compact rewrites the file with the live logs only.
+func (s *FileLogStore) Compact() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return ErrStoreClosed
+	}
+
+	return s.compact()
+}
+
+// compact copies the live records to a new file and replaces the log file with it, it must be
+// called with lock held.
+func (s *FileLogStore) compact() (err error) {
+	tmpPath := s.path + ".compact"
+
+	var tmp *os.File
+	if tmp, err = os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, dbFileMode); err != nil {
+		return
+	}
+	defer func() {
+		// the new file is kept once it replaces the log file
+		if err != nil && s.file != tmp {
+			tmp.Close()
+			os.Remove(tmpPath)
+		}
+	}()
+
+	var (
+		offset int64
+		index  = make(map[uint64]walPos, len(s.index))
+	)
+
+	for i := s.first; i <= s.last && len(s.index) > 0; i++ {
+		pos, ok := s.index[i]
+		if !ok {
+			continue
+		}
+
+		buf := make([]byte, pos.size)
+		if _, err = s.file.ReadAt(buf, pos.offset); err != nil {
+			return
+		}
+		if _, err = tmp.WriteAt(buf, offset); err != nil {
+			return
+		}
+
+		index[i] = walPos{offset: offset, size: pos.size}
+		offset += pos.size
+	}
+
+	if err = tmp.Sync(); err != nil {
+		return
+	}
+	if err = os.Rename(tmpPath, s.path); err != nil {
+		return
+	}
+
+	s.file.Close()
+	s.file = tmp
+	s.index = index
+	s.size = offset
+	s.records = len(index)
+
+	// the rename is only durable once the directory is synced
+	return syncDir(filepath.Dir(s.path))
+}
+
+// syncDir syncs the directory at path, so the entries renamed in it survive crash.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	if err = dir.Sync(); err != nil {
+		dir.Close()
+		return err
+	}
+
+	return dir.Close()
+}
+
+// Sync syncs the log file to disk, it's only necessary with SyncNever policy.
+func (s *FileLogStore) Sync() error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.closed {
+		return ErrStoreClosed
+	}
+
+	return s.file.Sync()
+}
+
+func (s *FileLogStore) syncLoop(interval time.Duration) {
+	defer close(s.doneCh)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		case <-ticker.C:
+			s.Sync()
+		}
+	}
+}
+
+// Close syncs and closes the log file.
+func (s *FileLogStore) Close() (err error) {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.lock.Unlock()
+
+	if s.stopCh != nil {
+		close(s.stopCh)
+		<-s.doneCh
+	}
+
+	if err = s.file.Sync(); err != nil {
+		s.file.Close()
+		return
+	}
+
+	return s.file.Close()
+}
+
+var (
+	_ LogStore = &FileLogStore{}
+)
@@ -0,0 +1,308 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kayak
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/thunderdb/ThunderDB/proto"
+)
+
+func testFileLogStore(t testing.TB, options FileLogOptions) (*FileLogStore, string) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	options.Path = filepath.Join(dir, "wal")
+	store, err := OpenFileLogStore(options)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	return store, dir
+}
+
+func TestFileLogStore(t *testing.T) {
+	Convey("file log store", t, func() {
+		store, dir := testFileLogStore(t, FileLogOptions{})
+		defer os.RemoveAll(dir)
+		defer store.Close()
+
+		reopen := func() {
+			So(store.Close(), ShouldBeNil)
+			var err error
+			store, err = NewFileLogStore(store.path)
+			So(err, ShouldBeNil)
+		}
+
+		So(store.StoreLog(testLog(1, "log1")), ShouldBeNil)
+		So(store.StoreLogs([]*Log{
+			testLog(2, "log2"),
+			testLog(3, "log3"),
+			testLog(4, "log4"),
+		}), ShouldBeNil)
+
+		Convey("store and get logs", func() {
+			first, err := store.FirstIndex()
+			So(err, ShouldBeNil)
+			So(first, ShouldEqual, uint64(1))
+			last, err := store.LastIndex()
+			So(err, ShouldBeNil)
+			So(last, ShouldEqual, uint64(4))
+
+			var l Log
+			So(store.GetLog(3, &l), ShouldBeNil)
+			So(&l, ShouldResemble, testLog(3, "log3"))
+			So(store.GetLog(5, &l), ShouldEqual, ErrKeyNotFound)
+
+			// rewritten log wins
+			So(store.StoreLog(testLog(4, "log4 rewritten")), ShouldBeNil)
+			So(store.GetLog(4, &l), ShouldBeNil)
+			So(string(l.Data), ShouldEqual, "log4 rewritten")
+		})
+
+		Convey("logs are replayed on reopen", func() {
+			So(store.DeleteRange(1, 1), ShouldBeNil)
+			So(store.DeleteRange(4, 10), ShouldBeNil)
+			reopen()
+
+			first, _ := store.FirstIndex()
+			last, _ := store.LastIndex()
+			So(first, ShouldEqual, uint64(2))
+			So(last, ShouldEqual, uint64(3))
+
+			var l Log
+			So(store.GetLog(1, &l), ShouldEqual, ErrKeyNotFound)
+			So(store.GetLog(2, &l), ShouldBeNil)
+			So(&l, ShouldResemble, testLog(2, "log2"))
+
+			So(store.DeleteRange(0, 100), ShouldBeNil)
+			reopen()
+			first, _ = store.FirstIndex()
+			last, _ = store.LastIndex()
+			So(first, ShouldEqual, uint64(0))
+			So(last, ShouldEqual, uint64(0))
+		})
+
+		Convey("torn record is truncated on reopen", func() {
+			size := store.size
+			So(store.StoreLog(testLog(5, "log5")), ShouldBeNil)
+			So(store.file.Truncate(store.size-3), ShouldBeNil)
+			reopen()
+
+			last, _ := store.LastIndex()
+			So(last, ShouldEqual, uint64(4))
+			So(store.size, ShouldEqual, size)
+
+			// appended after the truncated record
+			So(store.StoreLog(testLog(5, "log5")), ShouldBeNil)
+			reopen()
+			var l Log
+			So(store.GetLog(5, &l), ShouldBeNil)
+			So(&l, ShouldResemble, testLog(5, "log5"))
+		})
+
+		Convey("corrupted record is detected", func() {
+			pos := store.index[3]
+			_, err := store.file.WriteAt([]byte{0xff}, pos.offset+pos.size-1)
+			So(err, ShouldBeNil)
+
+			var l Log
+			So(store.GetLog(3, &l), ShouldEqual, ErrCorruptedLog)
+
+			// committed logs after the corrupted one are not dropped
+			So(store.Close(), ShouldBeNil)
+			_, err = NewFileLogStore(store.path)
+			So(err, ShouldEqual, ErrCorruptedLog)
+
+			info, err := os.Stat(store.path)
+			So(err, ShouldBeNil)
+			So(info.Size(), ShouldEqual, store.size)
+		})
+
+		Convey("corrupted last record is truncated on reopen", func() {
+			pos := store.index[4]
+			_, err := store.file.WriteAt([]byte{0xff}, pos.offset+pos.size-1)
+			So(err, ShouldBeNil)
+
+			reopen()
+			last, _ := store.LastIndex()
+			So(last, ShouldEqual, uint64(3))
+			So(store.size, ShouldEqual, pos.offset)
+		})
+
+		Convey("dead records are compacted", func() {
+			size := store.size
+			for i := uint64(5); i <= walCompactMinRecords+5; i++ {
+				So(store.StoreLog(testLog(i, fmt.Sprintf("log%d", i))), ShouldBeNil)
+			}
+			So(store.DeleteRange(1, walCompactMinRecords+3), ShouldBeNil)
+			So(store.records, ShouldEqual, 2)
+			So(store.size, ShouldBeLessThan, size)
+
+			reopen()
+			first, _ := store.FirstIndex()
+			last, _ := store.LastIndex()
+			So(first, ShouldEqual, uint64(walCompactMinRecords+4))
+			So(last, ShouldEqual, uint64(walCompactMinRecords+5))
+
+			var l Log
+			So(store.GetLog(last, &l), ShouldBeNil)
+			So(string(l.Data), ShouldEqual, fmt.Sprintf("log%d", last))
+
+			So(store.Compact(), ShouldBeNil)
+			So(store.GetLog(first, &l), ShouldBeNil)
+		})
+
+		Convey("closed store", func() {
+			So(store.Close(), ShouldBeNil)
+			So(store.Close(), ShouldBeNil)
+
+			var l Log
+			So(store.GetLog(1, &l), ShouldEqual, ErrStoreClosed)
+			So(store.StoreLog(testLog(5, "log5")), ShouldEqual, ErrStoreClosed)
+			So(store.DeleteRange(1, 1), ShouldEqual, ErrStoreClosed)
+			_, err := store.FirstIndex()
+			So(err, ShouldEqual, ErrStoreClosed)
+		})
+	})
+
+	Convey("file log store sync policies", t, func() {
+		for _, options := range []FileLogOptions{
+			{SyncPolicy: SyncInterval, SyncInterval: time.Millisecond * 10},
+			{SyncPolicy: SyncNever, Codec: &JSONLogCodec{}},
+		} {
+			store, dir := testFileLogStore(t, options)
+			So(store.StoreLog(testLog(1, "log1")), ShouldBeNil)
+			time.Sleep(time.Millisecond * 20)
+			So(store.Sync(), ShouldBeNil)
+			So(store.Close(), ShouldBeNil)
+
+			options.Path = store.path
+			store, err := OpenFileLogStore(options)
+			So(err, ShouldBeNil)
+			var l Log
+			So(store.GetLog(1, &l), ShouldBeNil)
+			So(store.Close(), ShouldBeNil)
+			os.RemoveAll(dir)
+		}
+	})
+}
+
+func TestTwoPCRunner_FileLogStoreRecovery(t *testing.T) {
+	mockLogCodec := &MockLogCodec{}
+	mockRouter := &MockTransportRouter{
+		transports: make(map[proto.NodeID]*MockTransport),
+	}
+
+	type createMockRes struct {
+		runner   *TwoPCRunner
+		config   *TwoPCConfig
+		fsm      *recordFSM
+		logStore *FileLogStore
+		store    *MockInmemStore
+	}
+
+	createConfig := func(res *createMockRes, nodeID proto.NodeID) {
+		logger := log.New()
+		logger.SetLevel(log.FatalLevel)
+		res.runner = NewTwoPCRunner()
+		res.fsm = &recordFSM{}
+		res.config = &TwoPCConfig{
+			RuntimeConfig: RuntimeConfig{
+				RootDir:        "test_dir",
+				LocalID:        nodeID,
+				Runner:         res.runner,
+				Transport:      mockRouter.getTransport(nodeID),
+				ProcessTimeout: time.Millisecond * 800,
+				Logger:         logger,
+			},
+			LogCodec:        mockLogCodec,
+			FSM:             res.fsm,
+			PrepareTimeout:  time.Millisecond * 200,
+			CommitTimeout:   time.Millisecond * 200,
+			RollbackTimeout: time.Millisecond * 200,
+		}
+	}
+	peers := testPeersFixture(1, []*Server{
+		{
+			Role: Leader,
+			ID:   "leader",
+		},
+		{
+			Role: Follower,
+			ID:   "follower",
+		},
+	})
+
+	Convey("follower rejoins with the logs replayed from file", t, func() {
+		mockRouter.ResetAll()
+
+		var mocks []*createMockRes
+		for _, id := range []proto.NodeID{"leader", "follower"} {
+			res := &createMockRes{store: NewMockInmemStore()}
+			res.logStore, _ = testFileLogStore(t, FileLogOptions{Codec: mockLogCodec})
+			defer os.RemoveAll(filepath.Dir(res.logStore.path))
+			createConfig(res, id)
+			So(res.runner.Init(res.config, peers, res.logStore, res.store, res.config.Transport), ShouldBeNil)
+			mocks = append(mocks, res)
+		}
+		lMock, fMock := mocks[0], mocks[1]
+
+		defer func() {
+			for _, r := range mocks {
+				r.runner.Shutdown(true)
+				r.logStore.Close()
+			}
+		}()
+
+		apply := func(from, to int) {
+			for i := from; i <= to; i++ {
+				testData, _ := mockLogCodec.Encode(fmt.Sprintf("test data %d", i))
+				So(lMock.runner.Apply(testData), ShouldBeNil)
+			}
+		}
+
+		apply(1, 3)
+
+		// crash and restart with the same log file
+		So(fMock.runner.Shutdown(true), ShouldBeNil)
+		So(fMock.logStore.Close(), ShouldBeNil)
+
+		logStore, err := OpenFileLogStore(FileLogOptions{Path: fMock.logStore.path, Codec: mockLogCodec})
+		So(err, ShouldBeNil)
+		fMock.logStore = logStore
+		createConfig(fMock, "follower")
+		So(fMock.runner.Init(fMock.config, peers, fMock.logStore, fMock.store,
+			fMock.config.Transport), ShouldBeNil)
+		So(fMock.runner.lastLogIndex, ShouldEqual, uint64(3))
+		So(fMock.runner.lastLogHash.IsEqual(lMock.runner.lastLogHash), ShouldBeTrue)
+
+		apply(4, 4)
+		So(fMock.runner.lastLogIndex, ShouldEqual, uint64(4))
+		// logs applied before crash are not applied again
+		So(fMock.fsm.getApplied(), ShouldResemble, []uint64{4})
+	})
+}
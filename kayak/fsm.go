@@ -0,0 +1,122 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kayak
+
+import (
+	"context"
+
+	"github.com/thunderdb/ThunderDB/twopc"
+)
+
+// FSM is the application state machine which the committed logs are handed off to, e.g. the
+// sqlchain storage. It decouples the replication from the twopc.Worker shape of Storage, a runner
+// configured with FSM only, such as a pure KV or metadata state machine, commits the logs without
+// preparing them, see NewWorkerFSM to apply the logs to a twopc.Worker instead.
+//
+// The runner applies each committed log once, strictly in log order, and persists the index of
+// the last applied log in the stable store. On restart, the committed logs after the last
+// applied one are replayed before the runner starts. A log may be applied again if the node
+// stops after Apply returns but before the applied index is persisted.
+type FSM interface {
+	// Apply applies the committed log to the state machine.
+	Apply(l *Log) (interface{}, error)
+}
+
+// WorkerFSM is the FSM applying the committed logs to a twopc.Worker, the log data is decoded and
+// prepared then committed by the worker, and rolled back if prepare fails.
+type WorkerFSM struct {
+	worker twopc.Worker
+	codec  LogCodec
+}
+
+// NewWorkerFSM returns the FSM applying the logs to worker, the log data is decoded by codec, which
+// should be the LogCodec of the runner config, MsgPackLogCodec is used if it's nil.
+func NewWorkerFSM(worker twopc.Worker, codec LogCodec) *WorkerFSM {
+	if codec == nil {
+		codec = &MsgPackLogCodec{}
+	}
+
+	return &WorkerFSM{
+		worker: worker,
+		codec:  codec,
+	}
+}
+
+// Apply implements FSM.Apply.
+func (f *WorkerFSM) Apply(l *Log) (interface{}, error) {
+	var decoded interface{}
+	if err := f.codec.Decode(l.Data, &decoded); err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	if err := f.worker.Prepare(ctx, decoded); err != nil {
+		f.worker.Rollback(ctx, decoded)
+		return nil, err
+	}
+
+	if err := f.worker.Commit(ctx, decoded); err != nil {
+		return nil, err
+	}
+
+	return decoded, nil
+}
+
+// applyCommitted applies the committed logs after the last applied one to FSM in order, it must
+// be called in run routine. Applying stops at the first failed log, which is retried on the next
+// commit or on restart.
+func (r *TwoPCRunner) applyCommitted() (err error) {
+	if r.config.FSM == nil {
+		return
+	}
+
+	for r.lastApplied < r.lastLogIndex {
+		var l Log
+		if err = r.logStore.GetLog(r.lastApplied+1, &l); err != nil {
+			return
+		}
+
+		if _, err = r.config.FSM.Apply(&l); err != nil {
+			return
+		}
+
+		r.lastApplied = l.Index
+		r.appliedSinceSnapshot++
+		r.appliedBytesSinceSnapshot += uint64(len(l.Data))
+
+		if err = r.stableStore.SetUint64(keyLastApplied, l.Index); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// tryApplyCommitted applies the committed logs to FSM and takes a snapshot if needed, the log is
+// already committed, so failure is only logged.
+func (r *TwoPCRunner) tryApplyCommitted() {
+	if err := r.applyCommitted(); err != nil {
+		r.config.Logger.Warningf("apply committed log %d failed: %s", r.lastApplied+1, err.Error())
+	}
+
+	if r.config.FSM != nil {
+		r.config.observer().OnApply(r.lastApplied, r.applyLag())
+	}
+
+	r.publishApplied()
+	r.trySnapshot()
+}
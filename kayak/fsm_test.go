@@ -0,0 +1,226 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the “License”);
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an “AS IS” BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kayak
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/stretchr/testify/mock"
+	"github.com/thunderdb/ThunderDB/proto"
+)
+
+// recordFSM records the applied logs, and fails on the log at failAt if it's set.
+type recordFSM struct {
+	lock    sync.Mutex
+	applied []uint64
+	data    []string
+	failAt  uint64
+}
+
+func (f *recordFSM) Apply(l *Log) (interface{}, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if l.Index == f.failAt {
+		return nil, errors.New("fsm failure")
+	}
+
+	f.applied = append(f.applied, l.Index)
+	f.data = append(f.data, string(l.Data))
+	return nil, nil
+}
+
+func (f *recordFSM) getApplied() []uint64 {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]uint64(nil), f.applied...)
+}
+
+func (f *recordFSM) setFailAt(index uint64) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.failAt = index
+}
+
+func TestTwoPCRunner_FSM(t *testing.T) {
+	mockLogCodec := &MockLogCodec{}
+	mockRouter := &MockTransportRouter{
+		transports: make(map[proto.NodeID]*MockTransport),
+	}
+
+	type createMockRes struct {
+		runner *TwoPCRunner
+		config *TwoPCConfig
+		fsm    *recordFSM
+		store  *MockInmemStore
+	}
+
+	createConfig := func(res *createMockRes, nodeID proto.NodeID) {
+		logger := log.New()
+		logger.SetLevel(log.FatalLevel)
+		res.runner = NewTwoPCRunner()
+		res.config = &TwoPCConfig{
+			RuntimeConfig: RuntimeConfig{
+				RootDir:        "test_dir",
+				LocalID:        nodeID,
+				Runner:         res.runner,
+				Transport:      mockRouter.getTransport(nodeID),
+				ProcessTimeout: time.Millisecond * 800,
+				Logger:         logger,
+			},
+			LogCodec:        mockLogCodec,
+			FSM:             res.fsm,
+			PrepareTimeout:  time.Millisecond * 200,
+			CommitTimeout:   time.Millisecond * 200,
+			RollbackTimeout: time.Millisecond * 200,
+		}
+	}
+	createMock := func(nodeID proto.NodeID) (res *createMockRes) {
+		res = &createMockRes{
+			fsm:   &recordFSM{},
+			store: NewMockInmemStore(),
+		}
+		createConfig(res, nodeID)
+		return
+	}
+	peers := testPeersFixture(1, []*Server{
+		{
+			Role: Leader,
+			ID:   "leader",
+		},
+		{
+			Role: Follower,
+			ID:   "follower",
+		},
+	})
+
+	Convey("committed logs are applied to fsm in order", t, func() {
+		mockRouter.ResetAll()
+
+		lMock := createMock("leader")
+		fMock := createMock("follower")
+		mocks := []*createMockRes{lMock, fMock}
+
+		for _, r := range mocks {
+			err := r.runner.Init(r.config, peers, r.store, r.store, r.config.Transport)
+			So(err, ShouldBeNil)
+		}
+
+		defer func() {
+			for _, r := range mocks {
+				r.runner.Shutdown(true)
+			}
+		}()
+
+		apply := func(from, to int) {
+			for i := from; i <= to; i++ {
+				testData, _ := mockLogCodec.Encode(fmt.Sprintf("test data %d", i))
+				So(lMock.runner.Apply(testData), ShouldBeNil)
+			}
+		}
+
+		apply(1, 2)
+
+		for _, r := range mocks {
+			So(r.fsm.getApplied(), ShouldResemble, []uint64{1, 2})
+			So(r.store.kvInt[string(keyLastApplied)], ShouldEqual, uint64(2))
+		}
+		So(lMock.fsm.data, ShouldResemble, fMock.fsm.data)
+
+		Convey("failed log is retried on next commit", func() {
+			fMock.fsm.setFailAt(3)
+			apply(3, 3)
+			So(fMock.runner.lastLogIndex, ShouldEqual, uint64(3))
+			So(fMock.fsm.getApplied(), ShouldResemble, []uint64{1, 2})
+
+			fMock.fsm.setFailAt(0)
+			apply(4, 4)
+
+			for _, r := range mocks {
+				So(r.fsm.getApplied(), ShouldResemble, []uint64{1, 2, 3, 4})
+			}
+		})
+
+		Convey("unapplied logs are replayed on restart", func() {
+			fMock.fsm.setFailAt(3)
+			apply(3, 4)
+			So(fMock.runner.lastLogIndex, ShouldEqual, uint64(4))
+			So(fMock.fsm.getApplied(), ShouldResemble, []uint64{1, 2})
+			So(fMock.runner.Shutdown(true), ShouldBeNil)
+
+			// restart with the same stores and fsm
+			fMock.fsm.setFailAt(0)
+			createConfig(fMock, "follower")
+			So(fMock.runner.Init(fMock.config, peers, fMock.store, fMock.store,
+				fMock.config.Transport), ShouldBeNil)
+			So(fMock.fsm.getApplied(), ShouldResemble, []uint64{1, 2, 3, 4})
+
+			apply(5, 5)
+
+			for _, r := range mocks {
+				So(r.fsm.getApplied(), ShouldResemble, []uint64{1, 2, 3, 4, 5})
+				So(r.store.kvInt[string(keyLastApplied)], ShouldEqual, uint64(5))
+			}
+			So(lMock.fsm.data, ShouldResemble, fMock.fsm.data)
+		})
+	})
+}
+
+func TestWorkerFSM(t *testing.T) {
+	Convey("logs are applied to twopc worker", t, func() {
+		mockLogCodec := &MockLogCodec{}
+		worker := &MockWorker{}
+		fsm := NewWorkerFSM(worker, mockLogCodec)
+
+		testData, _ := mockLogCodec.Encode("test data")
+		worker.On("Prepare", mock.Anything, "test data").Return(nil)
+		worker.On("Commit", mock.Anything, "test data").Return(nil)
+
+		res, err := fsm.Apply(testLog(1, string(testData)))
+		So(err, ShouldBeNil)
+		So(res, ShouldEqual, "test data")
+		worker.AssertExpectations(t)
+		worker.AssertNotCalled(t, "Rollback", mock.Anything, mock.Anything)
+
+		Convey("failed prepare is rolled back", func() {
+			worker := &MockWorker{}
+			fsm := NewWorkerFSM(worker, mockLogCodec)
+			worker.On("Prepare", mock.Anything, "test data").Return(errors.New("prepare failed"))
+			worker.On("Rollback", mock.Anything, "test data").Return(nil)
+
+			_, err := fsm.Apply(testLog(1, string(testData)))
+			So(err, ShouldNotBeNil)
+			worker.AssertExpectations(t)
+			worker.AssertNotCalled(t, "Commit", mock.Anything, mock.Anything)
+		})
+
+		Convey("invalid log data is rejected", func() {
+			worker := &MockWorker{}
+			fsm := NewWorkerFSM(worker, mockLogCodec)
+
+			_, err := fsm.Apply(testLog(1, "{invalid"))
+			So(err, ShouldNotBeNil)
+			worker.AssertNotCalled(t, "Prepare", mock.Anything, mock.Anything)
+		})
+	})
+}
@@ -123,3 +123,16 @@ func (i *MockInmemStore) GetUint64(key []byte) (uint64, error) {
 	defer i.l.RUnlock()
 	return i.kvInt[string(key)], nil
 }
+
+// SetBatch implements the StableStore interface.
+func (i *MockInmemStore) SetBatch(vals map[string][]byte, uint64Vals map[string]uint64) error {
+	i.l.Lock()
+	defer i.l.Unlock()
+	for k, v := range vals {
+		i.kv[k] = v
+	}
+	for k, v := range uint64Vals {
+		i.kvInt[k] = v
+	}
+	return nil
+}
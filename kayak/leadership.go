@@ -0,0 +1,270 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the “License”);
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an “AS IS” BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kayak
+
+import (
+	"context"
+	"errors"
+
+	"github.com/thunderdb/ThunderDB/crypto/asymmetric"
+	"github.com/thunderdb/ThunderDB/crypto/kms"
+	"github.com/thunderdb/ThunderDB/proto"
+	"github.com/thunderdb/ThunderDB/utils"
+)
+
+var (
+	// ErrInvalidTransferTarget defines invalid leadership transfer target error
+	ErrInvalidTransferTarget = errors.New("invalid leadership transfer target")
+	// ErrTargetNotUpToDate defines leadership transfer target lagging behind error
+	ErrTargetNotUpToDate = errors.New("leadership transfer target not up to date")
+	// ErrStaleConfig defines received peers configuration not newer than the current one error
+	ErrStaleConfig = errors.New("stale configuration")
+	// ErrInvalidConfigSig defines received peers configuration with invalid signature error
+	ErrInvalidConfigSig = errors.New("invalid configuration signature")
+)
+
+// transferRequest is the payload of TimeoutNow request sent to leadership transfer target
+type transferRequest struct {
+	// LastLogIndex is the last committed log index of the current leader
+	LastLogIndex uint64
+	// Peers is the new peers configuration with the target as leader
+	Peers *Peers
+}
+
+// TransferableRunner is a Runner supporting graceful leadership transfer, see
+// Runtime.TransferLeadership.
+type TransferableRunner interface {
+	Runner
+
+	// TransferLeadershipContext transfers the leadership to target within ctx.
+	TransferLeadershipContext(ctx context.Context, target proto.NodeID) error
+}
+
+// TransferLeadership transfers the leadership to the follower target within ProcessTimeout, see
+// TransferLeadershipContext.
+func (r *TwoPCRunner) TransferLeadership(target proto.NodeID) error {
+	ctx, cancel := utils.WithClockTimeout(context.Background(), r.config.clock(), r.config.ProcessTimeout)
+	defer cancel()
+
+	return r.TransferLeadershipContext(ctx, target)
+}
+
+// TransferLeadershipContext transfers the leadership to the follower target without stopping the
+// leader, it should be called by Leader role only.
+//
+// Since leadership is defined by the signed peers configuration, the leader builds a new
+// configuration with the next term and target as leader, and signs it with the local private
+// key in kms. The leader stops accepting writes during the transfer, the writes are blocked
+// instead of rejected, and replicates the committed logs missing on target. Then it sends a
+// TimeoutNow request to target, which checks that it has committed all the logs of the leader
+// and takes over the leadership immediately. The leader steps down after target accepts the new
+// configuration and pushes it to other followers. If target fails to catch up or take over
+// before ctx is done, the leader keeps the leadership and resumes accepting writes.
+func (r *TwoPCRunner) TransferLeadershipContext(ctx context.Context, target proto.NodeID) (err error) {
+	// block writes
+	r.processLock.Lock()
+	defer r.processLock.Unlock()
+
+	if r.role != Leader {
+		return ErrNotLeader
+	}
+
+	if target == r.config.LocalID {
+		return ErrInvalidTransferTarget
+	}
+
+	// build new peers configuration
+	newPeers := &Peers{
+		Term: r.nextPeersTerm(),
+	}
+	targetFound := false
+
+	for _, s := range r.peers.Servers {
+		ns := *s
+
+		switch s.ID {
+		case target:
+			if s.Role == Learner {
+				// learner must be promoted before taking over the leadership
+				return ErrInvalidTransferTarget
+			}
+
+			ns.Role = Leader
+			newPeers.Leader = &ns
+			targetFound = true
+		case r.config.LocalID:
+			ns.Role = Follower
+		}
+
+		newPeers.Servers = append(newPeers.Servers, &ns)
+	}
+
+	if !targetFound {
+		return ErrInvalidTransferTarget
+	}
+
+	// wait for target to catch up
+	r.progressLock.Lock()
+	var matchIndex uint64
+	if p, ok := r.progress[target]; ok {
+		matchIndex = p.matchIndex
+	}
+	r.progressLock.Unlock()
+
+	if err = r.catchUpPeer(ctx, target, matchIndex); err != nil {
+		r.config.Logger.Warningf("catch up transfer target %s failed: %s", target, err.Error())
+		return ErrTargetNotUpToDate
+	}
+
+	if err = signPeers(newPeers); err != nil {
+		return
+	}
+
+	// prompt target to take over the leadership
+	if _, err = r.transport.Request(ctx, target, "TimeoutNow", &transferRequest{
+		LastLogIndex: r.lastLogIndex,
+		Peers:        newPeers,
+	}); err != nil {
+		r.config.Logger.Warningf("transfer leadership to %s failed, resume leadership: %s",
+			target, err.Error())
+		return
+	}
+
+	// step down
+	if err = r.UpdatePeers(newPeers); err != nil {
+		return
+	}
+
+	// push new configuration to other followers
+	r.pushPeers(ctx, newPeers, target)
+
+	return nil
+}
+
+// signPeers signs the peers configuration with the local private key in kms.
+func signPeers(peers *Peers) (err error) {
+	if peers.PubKey, err = kms.GetLocalPublicKey(); err != nil {
+		return
+	}
+
+	privateKey, err := kms.GetLocalPrivateKey()
+	if err != nil {
+		return
+	}
+
+	return peers.Sign(privateKey)
+}
+
+// pushPeers pushes the new peers configuration to all servers except local node and exclude.
+func (r *TwoPCRunner) pushPeers(ctx context.Context, peers *Peers, exclude proto.NodeID) {
+	for _, s := range peers.Servers {
+		if s.ID == exclude || s.ID == r.config.LocalID {
+			continue
+		}
+
+		if _, err := r.transport.Request(ctx, s.ID, "UpdatePeers", peers); err != nil {
+			// TODO(xq262144), retry or let new leader sync the configuration
+			r.config.Logger.Warningf("update peers on %s failed: %s", s.ID, err.Error())
+		}
+	}
+}
+
+func (r *TwoPCRunner) decodePeers(data interface{}) (*Peers, error) {
+	// TODO(xq262144), support peers decoding from serialized transport payload
+	peers, ok := data.(*Peers)
+
+	if !ok || peers == nil {
+		return nil, ErrInvalidRequest
+	}
+
+	return peers, nil
+}
+
+// installPeers applies the new peers configuration pushed by leader, it must be called in run
+// routine. Only a configuration with strictly higher term signed by a trusted signer is accepted,
+// so that an old signed configuration can not be replayed, and a configuration self-signed with
+// any other key can not be forged, see trustedSigner. The configuration already installed is accepted
+// again without change, so leader can tell a redelivered configuration from a different one of
+// the same term.
+func (r *TwoPCRunner) installPeers(peers *Peers) error {
+	if r.getState() != Idle {
+		// has running transaction
+		return ErrInvalidRequest
+	}
+
+	if peers.Term == r.peers.Term && peers.Digest() == r.peers.Digest() {
+		// already installed
+		return nil
+	}
+
+	if peers.Term <= r.peers.Term {
+		return ErrStaleConfig
+	}
+
+	if !r.trustedSigner(peers.PubKey) || !peers.Verify() {
+		return ErrInvalidConfigSig
+	}
+
+	return r.applyPeers(peers)
+}
+
+// trustedSigner returns whether the new configuration signed with pubKey is trusted, it's either
+// signed by the signer of the current configuration, or by the current leader, e.g. the target
+// of a leadership transfer signing its first configuration.
+func (r *TwoPCRunner) trustedSigner(pubKey *asymmetric.PublicKey) bool {
+	if pubKey == nil {
+		return false
+	}
+
+	if r.peers.PubKey != nil && r.peers.PubKey.IsEqual(pubKey) {
+		return true
+	}
+
+	leader := r.peers.Leader
+	return leader != nil && leader.PubKey != nil && leader.PubKey.IsEqual(pubKey)
+}
+
+func (r *TwoPCRunner) processTimeoutNow(req Request) {
+	req.SendResponse(nil, func() error {
+		tr, ok := req.GetRequest().(*transferRequest)
+
+		if !ok || tr == nil || tr.Peers == nil {
+			return ErrInvalidRequest
+		}
+
+		if tr.Peers.Leader == nil || tr.Peers.Leader.ID != r.config.LocalID {
+			return ErrInvalidTransferTarget
+		}
+
+		if r.lastLogIndex != tr.LastLogIndex {
+			// leader catches up the target before the request
+			return ErrTargetNotUpToDate
+		}
+
+		return r.installPeers(tr.Peers)
+	}())
+}
+
+func (r *TwoPCRunner) processUpdatePeers(req Request) {
+	peers, err := r.decodePeers(req.GetRequest())
+
+	if err == nil {
+		err = r.installPeers(peers)
+	}
+
+	req.SendResponse(nil, err)
+}
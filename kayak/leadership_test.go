@@ -0,0 +1,355 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the “License”);
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an “AS IS” BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kayak
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/stretchr/testify/mock"
+	"github.com/thunderdb/ThunderDB/crypto/asymmetric"
+	"github.com/thunderdb/ThunderDB/crypto/kms"
+	"github.com/thunderdb/ThunderDB/proto"
+)
+
+func TestTwoPCRunner_TransferLeadership(t *testing.T) {
+	mockLogCodec := &MockLogCodec{}
+	mockRouter := &MockTransportRouter{
+		transports: make(map[proto.NodeID]*MockTransport),
+	}
+
+	type createMockRes struct {
+		runner      *TwoPCRunner
+		transport   *MockTransport
+		config      *TwoPCConfig
+		logStore    *MockLogStore
+		stableStore *MockStableStore
+	}
+
+	createMock := func(nodeID proto.NodeID) (res *createMockRes) {
+		res = &createMockRes{}
+		logger := log.New()
+		logger.SetLevel(log.FatalLevel)
+		res.runner = NewTwoPCRunner()
+		res.transport = mockRouter.getTransport(nodeID)
+		res.config = &TwoPCConfig{
+			RuntimeConfig: RuntimeConfig{
+				RootDir:        "test_dir",
+				LocalID:        nodeID,
+				Runner:         res.runner,
+				Transport:      res.transport,
+				ProcessTimeout: time.Millisecond * 800,
+				Logger:         logger,
+			},
+			LogCodec:        mockLogCodec,
+			Storage:         &MockWorker{},
+			PrepareTimeout:  time.Millisecond * 200,
+			CommitTimeout:   time.Millisecond * 200,
+			RollbackTimeout: time.Millisecond * 200,
+		}
+		res.logStore = &MockLogStore{}
+		res.stableStore = &MockStableStore{}
+
+		// init with no log and no term info
+		res.stableStore.On("GetUint64", keyCurrentTerm).Return(uint64(0), nil)
+		res.stableStore.On("GetUint64", keyCommittedIndex).Return(uint64(0), nil)
+		res.stableStore.On("SetUint64", keyCurrentTerm, mock.Anything).Return(nil)
+		res.logStore.On("LastIndex").Return(uint64(0), nil)
+		return
+	}
+	peers := testPeersFixture(1, []*Server{
+		{
+			Role: Leader,
+			ID:   "leader",
+		},
+		{
+			Role: Follower,
+			ID:   "follower1",
+		},
+		{
+			Role: Follower,
+			ID:   "follower2",
+		},
+	})
+
+	// configurations are signed by leader with the key of fixtures
+	privateKey, publicKey := testPeersKey()
+	kms.InitLocalKeyStore()
+	kms.SetLocalKeyPair(privateKey, publicKey)
+
+	Convey("transfer leadership", t, func() {
+		mockRouter.ResetAll()
+
+		lMock := createMock("leader")
+		f1Mock := createMock("follower1")
+		f2Mock := createMock("follower2")
+		mocks := []*createMockRes{lMock, f1Mock, f2Mock}
+
+		for _, r := range mocks {
+			err := r.runner.Init(r.config, peers, r.logStore, r.stableStore, r.transport)
+			So(err, ShouldBeNil)
+		}
+
+		defer func() {
+			for _, r := range mocks {
+				r.runner.Shutdown(true)
+			}
+		}()
+
+		Convey("invalid transfer", func() {
+			So(f1Mock.runner.TransferLeadership("follower2"), ShouldEqual, ErrNotLeader)
+			So(lMock.runner.TransferLeadership("leader"), ShouldEqual, ErrInvalidTransferTarget)
+			So(lMock.runner.TransferLeadership("unknown"), ShouldEqual, ErrInvalidTransferTarget)
+			So(lMock.runner.role, ShouldEqual, Leader)
+		})
+
+		Convey("target not up to date", func() {
+			f2Mock.runner.lastLogIndex = 1
+			err := lMock.runner.TransferLeadership("follower2")
+			So(err, ShouldEqual, ErrTargetNotUpToDate)
+
+			// leader resumes
+			for _, r := range mocks {
+				So(r.runner.currentTerm, ShouldEqual, uint64(1))
+				So(r.runner.leader.ID, ShouldEqual, proto.NodeID("leader"))
+			}
+			So(lMock.runner.role, ShouldEqual, Leader)
+			So(f2Mock.runner.role, ShouldEqual, Follower)
+		})
+
+		Convey("transfer to follower", func() {
+			start := time.Now()
+			err := lMock.runner.TransferLeadership("follower1")
+			So(err, ShouldBeNil)
+			So(time.Since(start), ShouldBeLessThan, lMock.config.ProcessTimeout)
+
+			for _, r := range mocks {
+				So(r.runner.currentTerm, ShouldEqual, uint64(2))
+				So(r.runner.leader.ID, ShouldEqual, proto.NodeID("follower1"))
+				So(r.runner.peers.Verify(), ShouldBeTrue)
+				r.stableStore.AssertCalled(t, "SetUint64", keyCurrentTerm, uint64(2))
+			}
+			So(lMock.runner.role, ShouldEqual, Follower)
+			So(f1Mock.runner.role, ShouldEqual, Leader)
+			So(f2Mock.runner.role, ShouldEqual, Follower)
+
+			// old leader stops accepting writes
+			testData, _ := mockLogCodec.Encode("test data")
+			So(lMock.runner.Apply(testData), ShouldEqual, ErrNotLeader)
+
+			// transfer back
+			err = f1Mock.runner.TransferLeadership("leader")
+			So(err, ShouldBeNil)
+			So(lMock.runner.role, ShouldEqual, Leader)
+			So(f1Mock.runner.role, ShouldEqual, Follower)
+			So(f2Mock.runner.leader.ID, ShouldEqual, proto.NodeID("leader"))
+		})
+
+		Convey("replayed peers configuration", func() {
+			servers := []*Server{
+				{
+					Role: Leader,
+					ID:   "leader",
+				},
+				{
+					Role: Follower,
+					ID:   "follower1",
+				},
+				{
+					Role: Follower,
+					ID:   "follower2",
+				},
+			}
+			updatePeers := func(peers *Peers) error {
+				ctx, cancel := context.WithTimeout(context.Background(), lMock.config.ProcessTimeout)
+				defer cancel()
+				_, err := lMock.transport.Request(ctx, "follower1", "UpdatePeers", peers)
+				return err
+			}
+
+			// replay of current configuration is accepted without change
+			So(updatePeers(peers), ShouldBeNil)
+			So(f1Mock.runner.currentTerm, ShouldEqual, uint64(1))
+
+			// different configuration of current term
+			So(updatePeers(testPeersFixture(1, servers[:2])), ShouldEqual, ErrStaleConfig)
+
+			// configuration validly self-signed with a foreign key
+			foreignKey, _, err := asymmetric.GenSecp256k1KeyPair()
+			So(err, ShouldBeNil)
+			forged := testPeersFixture(2, servers)
+			forged.PubKey = foreignKey.PubKey()
+			So(forged.Sign(foreignKey), ShouldBeNil)
+			So(forged.Verify(), ShouldBeTrue)
+			So(updatePeers(forged), ShouldEqual, ErrInvalidConfigSig)
+			So(f1Mock.runner.currentTerm, ShouldEqual, uint64(1))
+
+			// newer configuration is accepted
+			newPeers := testPeersFixture(2, servers)
+			So(updatePeers(newPeers), ShouldBeNil)
+			So(f1Mock.runner.currentTerm, ShouldEqual, uint64(2))
+			So(f1Mock.runner.peers, ShouldEqual, newPeers)
+			f1Mock.stableStore.AssertCalled(t, "SetUint64", keyCurrentTerm, uint64(2))
+
+			// installed configuration is accepted again, while older ones are rejected
+			So(updatePeers(newPeers), ShouldBeNil)
+			So(updatePeers(peers), ShouldEqual, ErrStaleConfig)
+			So(f1Mock.runner.currentTerm, ShouldEqual, uint64(2))
+			So(f1Mock.runner.peers, ShouldEqual, newPeers)
+		})
+	})
+}
+
+func TestRuntime_TransferLeadership(t *testing.T) {
+	mockLogCodec := &MockLogCodec{}
+	mockRouter := &MockTransportRouter{
+		transports: make(map[proto.NodeID]*MockTransport),
+	}
+
+	type createMockRes struct {
+		runner *TwoPCRunner
+		config *TwoPCConfig
+		fsm    *recordFSM
+		store  *MockInmemStore
+	}
+
+	createMock := func(nodeID proto.NodeID) (res *createMockRes) {
+		logger := log.New()
+		logger.SetLevel(log.FatalLevel)
+		res = &createMockRes{
+			runner: NewTwoPCRunner(),
+			fsm:    &recordFSM{},
+			store:  NewMockInmemStore(),
+		}
+		res.config = &TwoPCConfig{
+			RuntimeConfig: RuntimeConfig{
+				RootDir:        "test_dir",
+				LocalID:        nodeID,
+				Runner:         res.runner,
+				Transport:      mockRouter.getTransport(nodeID),
+				ProcessTimeout: time.Millisecond * 800,
+				Logger:         logger,
+			},
+			LogCodec:        mockLogCodec,
+			FSM:             res.fsm,
+			PrepareTimeout:  time.Millisecond * 200,
+			CommitTimeout:   time.Millisecond * 200,
+			RollbackTimeout: time.Millisecond * 200,
+		}
+		return
+	}
+	servers := []*Server{
+		{
+			Role: Leader,
+			ID:   "leader",
+		},
+		{
+			Role: Follower,
+			ID:   "follower1",
+		},
+	}
+
+	// configurations are signed by leader with the key of fixtures
+	privateKey, publicKey := testPeersKey()
+	kms.InitLocalKeyStore()
+	kms.SetLocalKeyPair(privateKey, publicKey)
+
+	Convey("transfer leadership to lagging follower", t, func() {
+		mockRouter.ResetAll()
+
+		peers := testPeersFixture(1, servers)
+		lMock := createMock("leader")
+		f1Mock := createMock("follower1")
+		mocks := []*createMockRes{lMock, f1Mock}
+
+		for _, r := range mocks {
+			err := r.runner.Init(r.config, peers, r.store, r.store, r.config.Transport)
+			So(err, ShouldBeNil)
+		}
+
+		defer func() {
+			for _, r := range mocks {
+				r.runner.Shutdown(true)
+			}
+		}()
+
+		rt, err := NewRuntime(lMock.config, peers)
+		So(err, ShouldBeNil)
+
+		for i := 1; i <= 2; i++ {
+			testData, _ := mockLogCodec.Encode(fmt.Sprintf("test data %d", i))
+			So(rt.Apply(testData), ShouldBeNil)
+		}
+
+		// new follower joins without any log
+		newPeers := testPeersFixture(2, append(servers, &Server{
+			Role: Follower,
+			ID:   "follower2",
+		}))
+		f2Mock := createMock("follower2")
+		So(f2Mock.runner.Init(f2Mock.config, newPeers, f2Mock.store, f2Mock.store,
+			f2Mock.config.Transport), ShouldBeNil)
+		mocks = append(mocks, f2Mock)
+		So(rt.UpdatePeers(newPeers), ShouldBeNil)
+		So(f2Mock.runner.lastLogIndex, ShouldEqual, uint64(0))
+
+		Convey("target is caught up before taking over", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			So(rt.TransferLeadership(ctx, "follower2"), ShouldBeNil)
+			So(f2Mock.runner.lastLogIndex, ShouldEqual, uint64(2))
+			So(f2Mock.fsm.getApplied(), ShouldResemble, []uint64{1, 2})
+			So(f2Mock.runner.role, ShouldEqual, Leader)
+			So(lMock.runner.role, ShouldEqual, Follower)
+			So(f1Mock.runner.leader.ID, ShouldEqual, proto.NodeID("follower2"))
+
+			// old leader runtime stops accepting writes
+			testData, _ := mockLogCodec.Encode("test data 3")
+			So(rt.Apply(testData), ShouldEqual, ErrNotLeader)
+			So(rt.TransferLeadership(ctx, "follower1"), ShouldEqual, ErrNotLeader)
+
+			// new leader commits on all followers
+			So(f2Mock.runner.Apply(testData), ShouldBeNil)
+
+			for _, r := range mocks {
+				So(r.fsm.getApplied(), ShouldResemble, []uint64{1, 2, 3})
+			}
+		})
+
+		Convey("leader resumes if target fails to catch up in time", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			So(rt.TransferLeadership(ctx, "follower2"), ShouldEqual, ErrTargetNotUpToDate)
+			So(lMock.runner.role, ShouldEqual, Leader)
+			So(lMock.runner.currentTerm, ShouldEqual, uint64(2))
+			So(f2Mock.runner.role, ShouldEqual, Follower)
+
+			// retry
+			ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			So(rt.TransferLeadership(ctx, "follower2"), ShouldBeNil)
+			So(f2Mock.runner.role, ShouldEqual, Leader)
+		})
+	})
+}
@@ -0,0 +1,499 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the “License”);
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an “AS IS” BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kayak
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/thunderdb/ThunderDB/proto"
+	"github.com/thunderdb/ThunderDB/utils"
+)
+
+var (
+	// ErrNotLearner defines operating on non-learner server error
+	ErrNotLearner = errors.New("not learner")
+)
+
+// PromoteLearner converts the learner to a voting follower once it has caught up with the
+// committed logs of leader, it should be called by Leader role only.
+//
+// The leader stops accepting writes during the promotion, replicates the missing logs to the
+// learner, then signs a new peers configuration with the next term and pushes it to all servers,
+// the promotion fails if any voter including the learner rejects it, see changePeers.
+func (r *TwoPCRunner) PromoteLearner(id proto.NodeID) (err error) {
+	// block writes
+	r.processLock.Lock()
+	defer r.processLock.Unlock()
+
+	if r.role != Leader {
+		return ErrNotLeader
+	}
+
+	// build new peers configuration
+	newPeers := &Peers{
+		Term: r.nextPeersTerm(),
+	}
+	learnerFound := false
+
+	for _, s := range r.peers.Servers {
+		ns := *s
+
+		if s.ID == id && s.Role == Learner {
+			ns.Role = Follower
+			learnerFound = true
+		}
+		if s.Role == Leader {
+			newPeers.Leader = &ns
+		}
+
+		newPeers.Servers = append(newPeers.Servers, &ns)
+	}
+
+	if !learnerFound {
+		return ErrNotLearner
+	}
+
+	// take over the learner from background replication
+	matchIndex := r.stopLearner(id)
+
+	ctx, cancel := utils.WithClockTimeout(context.Background(), r.config.clock(), r.config.ProcessTimeout)
+	defer cancel()
+
+	if err = r.catchUpPeer(ctx, id, matchIndex); err != nil {
+		r.config.Logger.Warningf("catch up learner %s failed: %s", id, err.Error())
+		return ErrTargetNotUpToDate
+	}
+
+	return r.changePeers(ctx, newPeers)
+}
+
+// replicateToLearners queues the committed log to background replicators of learners, it never
+// blocks on learners since they are not counted in commit quorum.
+func (r *TwoPCRunner) replicateToLearners(l *Log) {
+	learners := r.peers.Learners()
+
+	r.progressLock.Lock()
+	defer r.progressLock.Unlock()
+
+	// stop replicators of servers which are not learners any more
+	for id, lr := range r.learners {
+		found := false
+		for _, s := range learners {
+			if s.ID == id {
+				found = true
+				break
+			}
+		}
+		if !found {
+			delete(r.learners, id)
+			close(lr.stopCh)
+		}
+	}
+
+	for _, s := range learners {
+		lr, ok := r.learners[s.ID]
+		if !ok {
+			var matchIndex uint64
+			if p, ok := r.progress[s.ID]; ok {
+				matchIndex = p.matchIndex
+			}
+			lr = newLearnerReplicator(r, s.ID, matchIndex)
+			r.learners[s.ID] = lr
+			r.goFunc(lr.run)
+		}
+		lr.offer(l)
+	}
+}
+
+// stopLearner stops the background replicator of learner and returns the last index it acked.
+func (r *TwoPCRunner) stopLearner(id proto.NodeID) (matchIndex uint64) {
+	r.progressLock.Lock()
+	lr, ok := r.learners[id]
+	delete(r.learners, id)
+	if p, ok := r.progress[id]; ok {
+		matchIndex = p.matchIndex
+	}
+	r.progressLock.Unlock()
+
+	if ok {
+		close(lr.stopCh)
+		<-lr.doneCh
+		matchIndex = lr.getMatchIndex()
+	}
+
+	return
+}
+
+// catchUpPeer sends the logs after matchIndex to the learner or follower in batches of
+// MaxBatchLogs, the snapshot is sent first if the logs are truncated.
+func (r *TwoPCRunner) catchUpPeer(ctx context.Context, id proto.NodeID, matchIndex uint64) error {
+	for matchIndex < r.lastLogIndex {
+		prev := matchIndex
+
+		var (
+			learned uint64
+			acked   bool
+			err     error
+		)
+
+		if r.needsSnapshot(prev) {
+			learned, acked, err = r.sendSnapshot(ctx, id)
+		} else {
+			var logs []*Log
+			if logs, err = r.loadBatch(prev + 1); err != nil {
+				return err
+			}
+
+			learned, acked, err = r.sendLearn(ctx, id, logs)
+		}
+
+		if acked {
+			matchIndex = learned
+		}
+
+		if matchIndex == prev {
+			// no progress
+			if err == nil {
+				err = ErrInvalidLog
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sendLearn sends the logs to learner in one round trip, the last index committed on learner is
+// acked even on failure. A single log is sent by Learn, and more by LearnBatch.
+func (r *TwoPCRunner) sendLearn(ctx context.Context, id proto.NodeID, logs []*Log) (
+	learned uint64, acked bool, err error) {
+	var (
+		method = "Learn"
+		data   []byte
+	)
+
+	if len(logs) == 1 {
+		data, err = r.encodeLog(logs[0])
+	} else {
+		method = "LearnBatch"
+		data, err = r.encodeLogs(logs)
+	}
+	if err != nil {
+		return
+	}
+
+	res, err := r.requestPeer(ctx, id, method, data)
+	if index, derr := r.decodeLogIndex(res); derr == nil {
+		learned, acked = index, true
+		r.updateProgress(id, learned)
+	}
+
+	return
+}
+
+func (r *TwoPCRunner) processLearn(req Request) {
+	err := r.nestedTimeoutCtx(context.Background(), r.config.CommitTimeout, func(ctx context.Context) (err error) {
+		if r.role == Leader || r.getState() != Idle {
+			// followers learn the committed logs to catch up only if there is no running transaction
+			return ErrInvalidRequest
+		}
+
+		// get log
+		var l *Log
+		if l, err = r.decodeLog(req.GetRequest()); err != nil {
+			return
+		}
+
+		return r.learnLog(ctx, l)
+	})
+
+	req.SendResponse(r.lastLogIndex, err)
+}
+
+// learnLog commits the log already committed on leader, it must be called in run routine.
+func (r *TwoPCRunner) learnLog(ctx context.Context, l *Log) (err error) {
+	// validate log
+	if !l.VerifyHash() {
+		return ErrInvalidLog
+	}
+
+	if l.Index <= r.lastLogIndex {
+		// already learned
+		return nil
+	}
+
+	if l.Index != r.lastLogIndex+1 {
+		// gap found, leader should resend from last committed index
+		return ErrInvalidLog
+	}
+
+	// check hash with last log hash
+	if (r.lastLogHash == nil) != (l.LastHash == nil) ||
+		(r.lastLogHash != nil && !l.LastHash.IsEqual(r.lastLogHash)) {
+		return ErrInvalidLog
+	}
+
+	// decode log payload
+	var decodedLog interface{}
+	if decodedLog, err = r.decodeLogData(l.Data); err != nil {
+		return err
+	}
+
+	// log is already committed on leader, prepare and commit directly
+	if err = r.config.storage().Prepare(ctx, decodedLog); err != nil {
+		return err
+	}
+
+	if err = r.logStore.StoreLog(l); err != nil {
+		r.config.storage().Rollback(ctx, decodedLog)
+		return err
+	}
+
+	if err = r.config.storage().Commit(ctx, decodedLog); err != nil {
+		r.logStore.DeleteRange(l.Index, l.Index)
+		return err
+	}
+
+	r.stableStore.SetUint64(keyCommittedIndex, l.Index)
+	r.lastLogHash = &l.Hash
+	r.lastLogIndex = l.Index
+	r.lastLogTerm = l.Term
+
+	r.tryApplyCommitted()
+
+	return nil
+}
+
+// learnerReplicator ships committed logs to a learner in background with flow control: logs are
+// queued until acked by learner, once the queue is full, new logs are not queued and shipping to
+// the learner pauses, the skipped logs are loaded from log store and queued again on ack.
+type learnerReplicator struct {
+	runner *TwoPCRunner
+	id     proto.NodeID
+
+	lock          sync.Mutex
+	inflight      []*Log
+	inflightBytes int
+	matchIndex    uint64
+	lastIndex     uint64
+
+	notifyCh chan struct{}
+	stopCh   chan struct{}
+	doneCh   chan struct{}
+}
+
+func newLearnerReplicator(r *TwoPCRunner, id proto.NodeID, matchIndex uint64) *learnerReplicator {
+	return &learnerReplicator{
+		runner:     r,
+		id:         id,
+		matchIndex: matchIndex,
+		lastIndex:  matchIndex,
+		notifyCh:   make(chan struct{}, 1),
+		stopCh:     make(chan struct{}),
+		doneCh:     make(chan struct{}),
+	}
+}
+
+// offer queues the committed log if there is room, and wakes up the replicator.
+func (lr *learnerReplicator) offer(l *Log) {
+	lr.lock.Lock()
+	if l.Index > lr.lastIndex {
+		if l.Index == lr.tailIndex()+1 && lr.hasRoom(len(l.Data)) {
+			lr.push(l)
+		}
+		lr.lastIndex = l.Index
+	}
+	lr.lock.Unlock()
+
+	select {
+	case lr.notifyCh <- struct{}{}:
+	default:
+	}
+}
+
+// tailIndex returns the index of the last queued log, it must be called with lock held.
+func (lr *learnerReplicator) tailIndex() uint64 {
+	if len(lr.inflight) == 0 {
+		return lr.matchIndex
+	}
+	return lr.inflight[len(lr.inflight)-1].Index
+}
+
+// hasRoom checks if a log of size bytes can be queued, it must be called with lock held.
+func (lr *learnerReplicator) hasRoom(size int) bool {
+	if len(lr.inflight) == 0 {
+		// at least one log is shipped to make progress
+		return true
+	}
+	if len(lr.inflight) >= lr.runner.config.maxInflightLogs() {
+		return false
+	}
+	maxBytes := lr.runner.config.MaxInflightBytes
+	return maxBytes <= 0 || lr.inflightBytes+size <= maxBytes
+}
+
+func (lr *learnerReplicator) push(l *Log) {
+	lr.inflight = append(lr.inflight, l)
+	lr.inflightBytes += len(l.Data)
+}
+
+// fill loads the skipped logs from log store until the queue is full, it must be called with
+// lock held.
+func (lr *learnerReplicator) fill() error {
+	for next := lr.tailIndex() + 1; next <= lr.lastIndex; next++ {
+		l := &Log{}
+		if err := lr.runner.logStore.GetLog(next, l); err != nil {
+			return err
+		}
+		if !lr.hasRoom(len(l.Data)) {
+			break
+		}
+		lr.push(l)
+	}
+	return nil
+}
+
+// ack removes the logs committed on learner from queue.
+func (lr *learnerReplicator) ack(learned uint64) {
+	lr.lock.Lock()
+	defer lr.lock.Unlock()
+
+	lr.matchIndex = learned
+	i := 0
+	for ; i < len(lr.inflight) && lr.inflight[i].Index <= learned; i++ {
+		lr.inflightBytes -= len(lr.inflight[i].Data)
+	}
+	lr.inflight = lr.inflight[i:]
+
+	if len(lr.inflight) > 0 && lr.inflight[0].Index != learned+1 {
+		// learner is behind the queue, resend from log store
+		lr.inflight = nil
+		lr.inflightBytes = 0
+	}
+}
+
+func (lr *learnerReplicator) getMatchIndex() uint64 {
+	lr.lock.Lock()
+	defer lr.lock.Unlock()
+	return lr.matchIndex
+}
+
+func (lr *learnerReplicator) getInflight() (count int, bytes int) {
+	lr.lock.Lock()
+	defer lr.lock.Unlock()
+	return len(lr.inflight), lr.inflightBytes
+}
+
+func (lr *learnerReplicator) run() {
+	defer close(lr.doneCh)
+
+	for {
+		select {
+		case <-lr.stopCh:
+			return
+		case <-lr.runner.shutdownCh:
+			return
+		case <-lr.notifyCh:
+		}
+
+		lr.linger()
+
+		ship := lr.ship
+		if lr.runner.config.pipelineDepth() > 1 {
+			ship = lr.shipPipelined
+		}
+
+		if err := ship(); err != nil {
+			// retry on next commit
+			lr.runner.config.Logger.Warningf("replicate log to learner %s failed: %s", lr.id, err.Error())
+		}
+	}
+}
+
+// ship sends the queued logs to learner in batches until all committed logs are acked.
+func (lr *learnerReplicator) ship() error {
+	for {
+		select {
+		case <-lr.stopCh:
+			return nil
+		case <-lr.runner.shutdownCh:
+			return nil
+		default:
+		}
+
+		if prev := lr.getMatchIndex(); lr.runner.needsSnapshot(prev) {
+			if err := lr.installSnapshot(prev); err != nil {
+				return err
+			}
+			continue
+		}
+
+		lr.lock.Lock()
+		err := lr.fill()
+		logs := lr.batch()
+		prev := lr.matchIndex
+		lr.lock.Unlock()
+
+		if err != nil {
+			return err
+		}
+		if len(logs) == 0 {
+			return nil
+		}
+
+		ctx, cancel := utils.WithClockTimeout(context.Background(), lr.runner.config.clock(),
+			lr.runner.config.ProcessTimeout)
+		learned, acked, err := lr.runner.sendLearn(ctx, lr.id, logs)
+		cancel()
+
+		if acked {
+			lr.ack(learned)
+		}
+
+		if !acked || (learned == prev && learned < logs[len(logs)-1].Index) {
+			// no progress
+			if err == nil {
+				err = ErrInvalidLog
+			}
+			return err
+		}
+	}
+}
+
+// installSnapshot sends the snapshot to learner lagging behind the truncated logs.
+func (lr *learnerReplicator) installSnapshot(prev uint64) error {
+	ctx, cancel := utils.WithClockTimeout(context.Background(), lr.runner.config.clock(),
+		lr.runner.config.ProcessTimeout)
+	learned, acked, err := lr.runner.sendSnapshot(ctx, lr.id)
+	cancel()
+
+	if acked {
+		lr.ack(learned)
+	}
+
+	if !acked || learned == prev {
+		// no progress
+		if err == nil {
+			err = ErrInvalidSnapshot
+		}
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,338 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the “License”);
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an “AS IS” BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kayak
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/stretchr/testify/mock"
+	"github.com/thunderdb/ThunderDB/crypto/kms"
+	"github.com/thunderdb/ThunderDB/proto"
+)
+
+func TestPeers_Quorum(t *testing.T) {
+	Convey("learners are excluded from quorum", t, func() {
+		peers := testPeersFixture(1, []*Server{
+			{
+				Role: Leader,
+				ID:   "leader",
+			},
+			{
+				Role: Follower,
+				ID:   "follower",
+			},
+			{
+				Role: Learner,
+				ID:   "learner",
+			},
+		})
+
+		So(peers.Quorum(), ShouldEqual, 2)
+		So(peers.Voters(), ShouldHaveLength, 2)
+		So(peers.Learners(), ShouldHaveLength, 1)
+		So(peers.Learners()[0].ID, ShouldEqual, proto.NodeID("learner"))
+		So(Learner.String(), ShouldEqual, "Learner")
+	})
+}
+
+// waitLearned waits for the learner to ack index on leader.
+func waitLearned(leader *TwoPCRunner, id proto.NodeID, index uint64) bool {
+	for i := 0; i < 100; i++ {
+		if ps, ok := leader.Stats().Peers[id]; ok && ps.MatchIndex >= index {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestTwoPCRunner_Learner(t *testing.T) {
+	mockLogCodec := &MockLogCodec{}
+	mockRouter := &MockTransportRouter{
+		transports: make(map[proto.NodeID]*MockTransport),
+	}
+
+	type createMockRes struct {
+		runner *TwoPCRunner
+		config *TwoPCConfig
+		worker *MockWorker
+		store  *MockInmemStore
+	}
+
+	createMock := func(nodeID proto.NodeID) (res *createMockRes) {
+		res = &createMockRes{}
+		logger := log.New()
+		logger.SetLevel(log.FatalLevel)
+		res.runner = NewTwoPCRunner()
+		res.worker = &MockWorker{}
+		res.store = NewMockInmemStore()
+		res.config = &TwoPCConfig{
+			RuntimeConfig: RuntimeConfig{
+				RootDir:        "test_dir",
+				LocalID:        nodeID,
+				Runner:         res.runner,
+				Transport:      mockRouter.getTransport(nodeID),
+				ProcessTimeout: time.Millisecond * 800,
+				Logger:         logger,
+			},
+			LogCodec:        mockLogCodec,
+			Storage:         res.worker,
+			PrepareTimeout:  time.Millisecond * 200,
+			CommitTimeout:   time.Millisecond * 200,
+			RollbackTimeout: time.Millisecond * 200,
+		}
+		return
+	}
+	peers := testPeersFixture(1, []*Server{
+		{
+			Role: Leader,
+			ID:   "leader",
+		},
+		{
+			Role: Follower,
+			ID:   "follower",
+		},
+		{
+			Role: Learner,
+			ID:   "learner",
+		},
+	})
+
+	// configurations are signed by leader with the key of fixtures
+	privateKey, publicKey := testPeersKey()
+	kms.InitLocalKeyStore()
+	kms.SetLocalKeyPair(privateKey, publicKey)
+
+	Convey("learner replication", t, func() {
+		mockRouter.ResetAll()
+
+		lMock := createMock("leader")
+		fMock := createMock("follower")
+		lnMock := createMock("learner")
+		mocks := []*createMockRes{lMock, fMock, lnMock}
+
+		for _, r := range mocks {
+			err := r.runner.Init(r.config, peers, r.store, r.store, r.config.Transport)
+			So(err, ShouldBeNil)
+		}
+
+		defer func() {
+			for _, r := range mocks {
+				r.runner.Shutdown(true)
+			}
+		}()
+
+		So(lnMock.runner.role, ShouldEqual, Learner)
+
+		testData, _ := mockLogCodec.Encode("test data")
+
+		Convey("learner receives committed logs", func() {
+			for _, r := range mocks {
+				r.worker.On("Prepare", mock.Anything, "test data").Return(nil)
+				r.worker.On("Commit", mock.Anything, "test data").Return(nil)
+			}
+
+			So(lMock.runner.Apply(testData), ShouldBeNil)
+			So(waitLearned(lMock.runner, "learner", 1), ShouldBeTrue)
+
+			for _, r := range mocks {
+				So(r.runner.lastLogIndex, ShouldEqual, uint64(1))
+				So(r.store.kvInt[string(keyCommittedIndex)], ShouldEqual, uint64(1))
+			}
+			So(lnMock.runner.lastLogHash.IsEqual(lMock.runner.lastLogHash), ShouldBeTrue)
+		})
+
+		Convey("learner failure does not affect commit", func() {
+			for _, r := range mocks[:2] {
+				r.worker.On("Prepare", mock.Anything, "test data").Return(nil)
+				r.worker.On("Commit", mock.Anything, "test data").Return(nil)
+			}
+			lnMock.worker.On("Prepare", mock.Anything, "test data").
+				Return(errors.New("learner failure")).Once()
+
+			So(lMock.runner.Apply(testData), ShouldBeNil)
+			So(fMock.runner.lastLogIndex, ShouldEqual, uint64(1))
+			So(lnMock.runner.lastLogIndex, ShouldEqual, uint64(0))
+
+			// learner catches up on next commit
+			lnMock.worker.On("Prepare", mock.Anything, "test data").Return(nil)
+			lnMock.worker.On("Commit", mock.Anything, "test data").Return(nil)
+
+			So(lMock.runner.Apply(testData), ShouldBeNil)
+			So(waitLearned(lMock.runner, "learner", 2), ShouldBeTrue)
+			So(lnMock.runner.lastLogIndex, ShouldEqual, uint64(2))
+			lnMock.worker.AssertNumberOfCalls(t, "Commit", 2)
+		})
+
+		Convey("invalid promotion", func() {
+			So(fMock.runner.PromoteLearner("learner"), ShouldEqual, ErrNotLeader)
+			So(lMock.runner.PromoteLearner("follower"), ShouldEqual, ErrNotLearner)
+			So(lMock.runner.PromoteLearner("unknown"), ShouldEqual, ErrNotLearner)
+			So(lMock.runner.TransferLeadership("learner"), ShouldEqual, ErrInvalidTransferTarget)
+		})
+
+		Convey("promote learner", func() {
+			for _, r := range mocks {
+				r.worker.On("Prepare", mock.Anything, "test data").Return(nil)
+				r.worker.On("Commit", mock.Anything, "test data").Return(nil)
+			}
+
+			So(lMock.runner.Apply(testData), ShouldBeNil)
+			So(lMock.runner.PromoteLearner("learner"), ShouldBeNil)
+
+			for _, r := range mocks {
+				So(r.runner.currentTerm, ShouldEqual, uint64(2))
+				So(r.runner.peers.Verify(), ShouldBeTrue)
+				So(r.runner.peers.Quorum(), ShouldEqual, 3)
+				So(r.runner.leader.ID, ShouldEqual, proto.NodeID("leader"))
+			}
+			So(lnMock.runner.role, ShouldEqual, Follower)
+			So(lMock.runner.learners, ShouldBeEmpty)
+
+			// promoted learner takes part in two phase commit
+			So(lMock.runner.Apply(testData), ShouldBeNil)
+			So(lnMock.runner.lastLogIndex, ShouldEqual, uint64(2))
+		})
+	})
+}
+
+func TestTwoPCRunner_LearnerFlowControl(t *testing.T) {
+	mockLogCodec := &MockLogCodec{}
+	mockRouter := &MockTransportRouter{
+		transports: make(map[proto.NodeID]*MockTransport),
+	}
+
+	type createMockRes struct {
+		runner *TwoPCRunner
+		config *TwoPCConfig
+		worker *MockWorker
+		store  *MockInmemStore
+	}
+
+	createMock := func(nodeID proto.NodeID) (res *createMockRes) {
+		res = &createMockRes{}
+		logger := log.New()
+		logger.SetLevel(log.FatalLevel)
+		res.runner = NewTwoPCRunner()
+		res.worker = &MockWorker{}
+		res.store = NewMockInmemStore()
+		res.config = &TwoPCConfig{
+			RuntimeConfig: RuntimeConfig{
+				RootDir:        "test_dir",
+				LocalID:        nodeID,
+				Runner:         res.runner,
+				Transport:      mockRouter.getTransport(nodeID),
+				ProcessTimeout: time.Millisecond * 800,
+				Logger:         logger,
+			},
+			LogCodec:        mockLogCodec,
+			Storage:         res.worker,
+			PrepareTimeout:  time.Millisecond * 200,
+			CommitTimeout:   time.Millisecond * 200,
+			RollbackTimeout: time.Millisecond * 200,
+		}
+		return
+	}
+	peers := testPeersFixture(1, []*Server{
+		{
+			Role: Leader,
+			ID:   "leader",
+		},
+		{
+			Role: Follower,
+			ID:   "follower",
+		},
+		{
+			Role: Learner,
+			ID:   "learner",
+		},
+	})
+
+	// configurations are signed by leader with the key of fixtures
+	privateKey, publicKey := testPeersKey()
+	kms.InitLocalKeyStore()
+	kms.SetLocalKeyPair(privateKey, publicKey)
+
+	testData, _ := mockLogCodec.Encode("test data")
+	const logCount = 10
+
+	applySlowLearner := func(config func(*TwoPCConfig), maxInflight int) {
+		mockRouter.ResetAll()
+
+		lMock := createMock("leader")
+		fMock := createMock("follower")
+		lnMock := createMock("learner")
+		mocks := []*createMockRes{lMock, fMock, lnMock}
+		config(lMock.config)
+
+		for _, r := range mocks {
+			err := r.runner.Init(r.config, peers, r.store, r.store, r.config.Transport)
+			So(err, ShouldBeNil)
+		}
+
+		defer func() {
+			for _, r := range mocks {
+				r.runner.Shutdown(true)
+			}
+		}()
+
+		for _, r := range mocks[:2] {
+			r.worker.On("Prepare", mock.Anything, "test data").Return(nil)
+			r.worker.On("Commit", mock.Anything, "test data").Return(nil)
+		}
+		// artificially slow learner
+		lnMock.worker.On("Prepare", mock.Anything, "test data").
+			After(time.Millisecond * 30).Return(nil)
+		lnMock.worker.On("Commit", mock.Anything, "test data").Return(nil)
+
+		for i := uint64(1); i <= logCount; i++ {
+			So(lMock.runner.Apply(testData), ShouldBeNil)
+			So(fMock.runner.lastLogIndex, ShouldEqual, i)
+
+			stats := lMock.runner.Stats()
+			So(stats.CommitIndex, ShouldEqual, i)
+			So(stats.Peers["follower"].MatchIndex, ShouldEqual, i)
+			So(stats.Peers["learner"].Inflight, ShouldBeBetweenOrEqual, 1, maxInflight)
+			So(stats.Peers["learner"].InflightBytes, ShouldEqual,
+				stats.Peers["learner"].Inflight*len(testData))
+		}
+
+		// commit does not wait for the learner
+		So(lMock.runner.Stats().Peers["learner"].MatchIndex, ShouldBeLessThan, logCount)
+
+		// learner resumes on ack and catches up
+		So(waitLearned(lMock.runner, "learner", logCount), ShouldBeTrue)
+		So(lMock.runner.Stats().Peers["learner"].Inflight, ShouldEqual, 0)
+		lnMock.worker.AssertNumberOfCalls(t, "Commit", logCount)
+	}
+
+	Convey("max inflight logs to slow learner", t, func() {
+		applySlowLearner(func(c *TwoPCConfig) {
+			c.MaxInflightLogs = 2
+		}, 2)
+	})
+
+	Convey("max inflight bytes to slow learner", t, func() {
+		applySlowLearner(func(c *TwoPCConfig) {
+			c.MaxInflightBytes = len(testData) * 3
+		}, 3)
+	})
+}
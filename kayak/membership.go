@@ -0,0 +1,187 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kayak
+
+import (
+	"context"
+	"errors"
+
+	"github.com/thunderdb/ThunderDB/crypto/asymmetric"
+	"github.com/thunderdb/ThunderDB/proto"
+)
+
+var (
+	// ErrServerExists defines adding server already in peers error
+	ErrServerExists = errors.New("server already exists")
+	// ErrServerNotFound defines removing server not in peers error
+	ErrServerNotFound = errors.New("server not found")
+	// ErrConfigNotAccepted defines new peers configuration rejected by voters error
+	ErrConfigNotAccepted = errors.New("configuration not accepted by all voters")
+)
+
+// AddServer adds the server to peers as a learner, it should be called by Leader role only.
+//
+// The server joins as a non-voting learner, so it catches up the committed logs in background
+// without affecting commit, and then it's turned into a voter by PromoteLearner. The server should
+// be started with the current peers configuration, it waits as a learner for the configuration
+// pushed by leader.
+func (r *TwoPCRunner) AddServer(ctx context.Context, id proto.NodeID, pubKey *asymmetric.PublicKey) error {
+	// block writes
+	r.processLock.Lock()
+	defer r.processLock.Unlock()
+
+	if r.role != Leader {
+		return ErrNotLeader
+	}
+
+	newPeers := &Peers{
+		Term: r.nextPeersTerm(),
+	}
+
+	for _, s := range r.peers.Servers {
+		if s.ID == id {
+			return ErrServerExists
+		}
+
+		ns := *s
+		if s.Role == Leader {
+			newPeers.Leader = &ns
+		}
+
+		newPeers.Servers = append(newPeers.Servers, &ns)
+	}
+
+	newPeers.Servers = append(newPeers.Servers, &Server{
+		Role:   Learner,
+		ID:     id,
+		PubKey: pubKey,
+	})
+
+	return r.changePeers(ctx, newPeers)
+}
+
+// RemoveServer removes the follower or learner from peers, it should be called by Leader role
+// only. The removed server shuts down once it receives the new configuration.
+func (r *TwoPCRunner) RemoveServer(ctx context.Context, id proto.NodeID) error {
+	// block writes
+	r.processLock.Lock()
+	defer r.processLock.Unlock()
+
+	if r.role != Leader {
+		return ErrNotLeader
+	}
+
+	if id == r.config.LocalID {
+		// transfer the leadership first
+		return ErrInvalidRequest
+	}
+
+	newPeers := &Peers{
+		Term: r.nextPeersTerm(),
+	}
+	found := false
+
+	for _, s := range r.peers.Servers {
+		if s.ID == id {
+			found = true
+			continue
+		}
+
+		ns := *s
+		if s.Role == Leader {
+			newPeers.Leader = &ns
+		}
+
+		newPeers.Servers = append(newPeers.Servers, &ns)
+	}
+
+	if !found {
+		return ErrServerNotFound
+	}
+
+	return r.changePeers(ctx, newPeers)
+}
+
+// nextPeersTerm returns the term of a new peers configuration, it must be called with processLock
+// held. The term is past all the configurations signed before, including the abandoned ones which
+// may be held by some servers, so a different configuration never reuses the term of them.
+func (r *TwoPCRunner) nextPeersTerm() uint64 {
+	if r.signedTerm < r.peers.Term {
+		r.signedTerm = r.peers.Term
+	}
+	r.signedTerm++
+	return r.signedTerm
+}
+
+// changePeers signs the new configuration, and pushes it to the servers of both the current and
+// the new configuration, it must be called with processLock held.
+//
+// Since two phase commit requires all the voters to be prepared, the new configuration is only
+// installed on leader after all the voters of it have accepted, otherwise ErrConfigNotAccepted is
+// returned and leader keeps the current configuration. The removed servers and learners accept the
+// configuration in best effort, so that an unreachable server can still be removed. Redelivering
+// the configuration is safe, since a server which has installed the same configuration accepts it
+// again, while a server holding a different configuration of the same term rejects it as stale.
+func (r *TwoPCRunner) changePeers(ctx context.Context, newPeers *Peers) (err error) {
+	if err = signPeers(newPeers); err != nil {
+		return
+	}
+
+	voters := make(map[proto.NodeID]bool)
+	for _, s := range newPeers.Voters() {
+		voters[s.ID] = true
+	}
+
+	targets := append([]*Server(nil), newPeers.Servers...)
+	for _, s := range r.peers.Servers {
+		found := false
+		for _, ns := range newPeers.Servers {
+			if ns.ID == s.ID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			targets = append(targets, s)
+		}
+	}
+
+	accepted := true
+
+	for _, s := range targets {
+		if s.ID == r.config.LocalID {
+			continue
+		}
+
+		_, err := r.transport.Request(ctx, s.ID, "UpdatePeers", newPeers)
+		if err == nil {
+			continue
+		}
+
+		r.config.Logger.Warningf("update peers on %s failed: %s", s.ID, err.Error())
+
+		if voters[s.ID] {
+			accepted = false
+		}
+	}
+
+	if !accepted {
+		return ErrConfigNotAccepted
+	}
+
+	return r.UpdatePeers(newPeers)
+}
@@ -0,0 +1,217 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kayak
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/thunderdb/ThunderDB/crypto/kms"
+	"github.com/thunderdb/ThunderDB/proto"
+)
+
+func TestTwoPCRunner_Membership(t *testing.T) {
+	mockLogCodec := &MockLogCodec{}
+	mockRouter := &MockTransportRouter{
+		transports: make(map[proto.NodeID]*MockTransport),
+	}
+
+	type createMockRes struct {
+		runner *TwoPCRunner
+		config *TwoPCConfig
+		fsm    *recordFSM
+		store  *MockInmemStore
+	}
+
+	createMock := func(nodeID proto.NodeID) (res *createMockRes) {
+		logger := log.New()
+		logger.SetLevel(log.FatalLevel)
+		res = &createMockRes{
+			runner: NewTwoPCRunner(),
+			fsm:    &recordFSM{},
+			store:  NewMockInmemStore(),
+		}
+		res.config = &TwoPCConfig{
+			RuntimeConfig: RuntimeConfig{
+				RootDir:        "test_dir",
+				LocalID:        nodeID,
+				Runner:         res.runner,
+				Transport:      mockRouter.getTransport(nodeID),
+				ProcessTimeout: time.Millisecond * 800,
+				Logger:         logger,
+			},
+			LogCodec:        mockLogCodec,
+			FSM:             res.fsm,
+			PrepareTimeout:  time.Millisecond * 200,
+			CommitTimeout:   time.Millisecond * 200,
+			RollbackTimeout: time.Millisecond * 200,
+		}
+		return
+	}
+	peers := testPeersFixture(1, []*Server{
+		{
+			Role: Leader,
+			ID:   "leader",
+		},
+		{
+			Role: Follower,
+			ID:   "follower",
+		},
+	})
+
+	// configurations are signed by leader with the key of fixtures
+	privateKey, publicKey := testPeersKey()
+	kms.InitLocalKeyStore()
+	kms.SetLocalKeyPair(privateKey, publicKey)
+
+	Convey("single server membership change", t, func() {
+		mockRouter.ResetAll()
+
+		lMock := createMock("leader")
+		fMock := createMock("follower")
+		nMock := createMock("newnode")
+		mocks := []*createMockRes{lMock, fMock, nMock}
+
+		// new server is started with the current configuration
+		for _, r := range mocks {
+			err := r.runner.Init(r.config, peers, r.store, r.store, r.config.Transport)
+			So(err, ShouldBeNil)
+		}
+
+		defer func() {
+			for _, r := range mocks {
+				r.runner.Shutdown(true)
+			}
+		}()
+
+		So(nMock.runner.role, ShouldEqual, Learner)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		apply := func(i int) error {
+			testData, _ := mockLogCodec.Encode(fmt.Sprintf("test data %d", i))
+			return lMock.runner.Apply(testData)
+		}
+
+		So(apply(1), ShouldBeNil)
+
+		Convey("invalid change", func() {
+			So(fMock.runner.AddServer(ctx, "newnode", publicKey), ShouldEqual, ErrNotLeader)
+			So(lMock.runner.AddServer(ctx, "follower", publicKey), ShouldEqual, ErrServerExists)
+			So(lMock.runner.RemoveServer(ctx, "unknown"), ShouldEqual, ErrServerNotFound)
+			So(lMock.runner.RemoveServer(ctx, "leader"), ShouldEqual, ErrInvalidRequest)
+			So(lMock.runner.currentTerm, ShouldEqual, uint64(1))
+		})
+
+		Convey("add and promote then remove server", func() {
+			So(lMock.runner.AddServer(ctx, "newnode", publicKey), ShouldBeNil)
+
+			for _, r := range mocks {
+				So(r.runner.currentTerm, ShouldEqual, uint64(2))
+				So(r.runner.peers.Verify(), ShouldBeTrue)
+				So(r.runner.peers.Quorum(), ShouldEqual, 2)
+			}
+			So(nMock.runner.role, ShouldEqual, Learner)
+
+			// learner catches up in background
+			So(apply(2), ShouldBeNil)
+			So(waitLearned(lMock.runner, "newnode", 2), ShouldBeTrue)
+			So(nMock.fsm.getApplied(), ShouldResemble, []uint64{1, 2})
+
+			So(lMock.runner.PromoteLearner("newnode"), ShouldBeNil)
+			So(nMock.runner.role, ShouldEqual, Follower)
+			So(lMock.runner.peers.Quorum(), ShouldEqual, 3)
+
+			So(apply(3), ShouldBeNil)
+			So(nMock.runner.lastLogIndex, ShouldEqual, uint64(3))
+
+			// removed server shuts down
+			So(lMock.runner.RemoveServer(ctx, "follower"), ShouldBeNil)
+			So(fMock.runner.getState(), ShouldEqual, Shutdown)
+
+			for _, r := range []*createMockRes{lMock, nMock} {
+				So(r.runner.currentTerm, ShouldEqual, uint64(4))
+				So(r.runner.peers.Servers, ShouldHaveLength, 2)
+			}
+
+			So(apply(4), ShouldBeNil)
+			So(nMock.fsm.getApplied(), ShouldResemble, []uint64{1, 2, 3, 4})
+			So(fMock.runner.lastLogIndex, ShouldEqual, uint64(3))
+		})
+
+		Convey("change is not installed if voter rejects", func() {
+			So(fMock.runner.Shutdown(true), ShouldBeNil)
+
+			shortCtx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+			defer cancel()
+
+			So(lMock.runner.AddServer(shortCtx, "newnode", publicKey), ShouldEqual, ErrConfigNotAccepted)
+			So(lMock.runner.currentTerm, ShouldEqual, uint64(1))
+			So(lMock.runner.peers, ShouldEqual, peers)
+
+			// unreachable server can still be removed, the term of abandoned change is skipped
+			So(lMock.runner.RemoveServer(shortCtx, "follower"), ShouldBeNil)
+			So(lMock.runner.currentTerm, ShouldEqual, uint64(3))
+			So(lMock.runner.peers.Quorum(), ShouldEqual, 1)
+			So(apply(2), ShouldBeNil)
+		})
+
+		Convey("abandoned configuration is not taken as accepted", func() {
+			So(nMock.runner.Shutdown(true), ShouldBeNil)
+
+			shortCtx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+			defer cancel()
+
+			// follower accepts the change, while the new voter is unreachable
+			abandoned := &Peers{Term: 2}
+			for _, s := range peers.Servers {
+				ns := *s
+				if s.Role == Leader {
+					abandoned.Leader = &ns
+				}
+				abandoned.Servers = append(abandoned.Servers, &ns)
+			}
+			abandoned.Servers = append(abandoned.Servers, &Server{
+				Role:   Follower,
+				ID:     "newnode",
+				PubKey: publicKey,
+			})
+
+			lMock.runner.processLock.Lock()
+			err := lMock.runner.changePeers(shortCtx, abandoned)
+			lMock.runner.processLock.Unlock()
+			So(err, ShouldEqual, ErrConfigNotAccepted)
+			So(lMock.runner.currentTerm, ShouldEqual, uint64(1))
+			So(fMock.runner.currentTerm, ShouldEqual, uint64(2))
+
+			// a different change of the same term is rejected by follower
+			So(lMock.runner.AddServer(shortCtx, "other", publicKey), ShouldEqual, ErrConfigNotAccepted)
+			So(lMock.runner.currentTerm, ShouldEqual, uint64(1))
+
+			// the next change is past the abandoned ones
+			So(lMock.runner.AddServer(ctx, "other", publicKey), ShouldBeNil)
+			So(lMock.runner.currentTerm, ShouldEqual, uint64(3))
+			So(fMock.runner.currentTerm, ShouldEqual, uint64(3))
+			So(fMock.runner.peers.Digest(), ShouldResemble, lMock.runner.peers.Digest())
+		})
+	})
+}
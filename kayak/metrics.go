@@ -0,0 +1,137 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kayak
+
+import (
+	"context"
+	"time"
+
+	"github.com/thunderdb/ThunderDB/proto"
+)
+
+const (
+	// proposal rate is averaged over the last rateWindow seconds
+	rateWindow = 10
+)
+
+// Observer receives the events of runner for instrumentation, e.g. to export metrics to
+// Prometheus or expvar, see TwoPCConfig.Observer. The methods are called synchronously by runner,
+// so they should return quickly.
+type Observer interface {
+	// OnPropose is called on leader after a log proposed by Apply is processed, err is nil if it's
+	// committed.
+	OnPropose(index uint64, latency time.Duration, err error)
+
+	// OnApply is called after the committed logs are applied to FSM, lag is the count of the
+	// committed logs not applied yet.
+	OnApply(lastApplied uint64, lag uint64)
+
+	// OnReplicate is called on leader after each attempt of a request to peer is responded, e.g.
+	// replicating logs.
+	OnReplicate(id proto.NodeID, method string, latency time.Duration, err error)
+
+	// OnLeaderChange is called when a new peers configuration changes the leader.
+	OnLeaderChange(term uint64, leader proto.NodeID)
+}
+
+type nopObserver struct{}
+
+func (nopObserver) OnPropose(index uint64, latency time.Duration, err error)                     {}
+func (nopObserver) OnApply(lastApplied uint64, lag uint64)                                       {}
+func (nopObserver) OnReplicate(id proto.NodeID, method string, latency time.Duration, err error) {}
+func (nopObserver) OnLeaderChange(term uint64, leader proto.NodeID)                              {}
+
+func (tpc *TwoPCConfig) observer() Observer {
+	if tpc.Observer == nil {
+		return nopObserver{}
+	}
+	return tpc.Observer
+}
+
+// rateCounter counts events in per second buckets of the last rateWindow seconds.
+type rateCounter struct {
+	counts [rateWindow]uint64
+	secs   [rateWindow]int64
+}
+
+func (c *rateCounter) incr(now time.Time) {
+	sec := now.Unix()
+	i := sec % rateWindow
+	if c.secs[i] != sec {
+		c.secs[i] = sec
+		c.counts[i] = 0
+	}
+	c.counts[i]++
+}
+
+// rate returns the average count per second.
+func (c *rateCounter) rate(now time.Time) float64 {
+	sec := now.Unix()
+	var total uint64
+	for i := range c.counts {
+		if c.secs[i] <= sec && sec-c.secs[i] < rateWindow {
+			total += c.counts[i]
+		}
+	}
+	return float64(total) / rateWindow
+}
+
+// propose processes the log proposed by Apply and records the proposal metrics, it must be
+// called in run routine.
+func (r *TwoPCRunner) propose(data []byte) (err error) {
+	index := r.lastLogIndex + 1
+	start := r.config.clock().Now()
+	err = r.processNewLog(data)
+	now := r.config.clock().Now()
+
+	if err == nil {
+		r.proposals++
+		r.proposalRate.incr(now)
+	} else {
+		r.proposalFailures++
+	}
+
+	r.config.observer().OnPropose(index, now.Sub(start), err)
+
+	return
+}
+
+// requestPeer sends the replication request to peer, and records the latency.
+func (r *TwoPCRunner) requestPeer(ctx context.Context, id proto.NodeID, method string,
+	args interface{}) (res interface{}, err error) {
+	start := r.config.clock().Now()
+	res, err = r.transport.Request(ctx, id, method, args)
+	latency := r.config.clock().Now().Sub(start)
+
+	if err == nil {
+		r.progressLock.Lock()
+		r.getProgress(id).latency = latency
+		r.progressLock.Unlock()
+	}
+
+	r.config.observer().OnReplicate(id, method, latency, err)
+
+	return
+}
+
+// applyLag returns the count of committed logs not applied to FSM.
+func (r *TwoPCRunner) applyLag() uint64 {
+	if r.config.FSM == nil || r.lastApplied >= r.lastLogIndex {
+		return 0
+	}
+	return r.lastLogIndex - r.lastApplied
+}
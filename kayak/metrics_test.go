@@ -0,0 +1,214 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kayak
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/thunderdb/ThunderDB/proto"
+)
+
+// recordObserver records the events of runner.
+type recordObserver struct {
+	lock       sync.Mutex
+	proposed   []uint64
+	applied    uint64
+	replicated map[proto.NodeID][]string
+	leaders    []proto.NodeID
+}
+
+func (o *recordObserver) OnPropose(index uint64, latency time.Duration, err error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if err == nil {
+		o.proposed = append(o.proposed, index)
+	}
+}
+
+func (o *recordObserver) OnApply(lastApplied uint64, lag uint64) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.applied = lastApplied
+}
+
+func (o *recordObserver) OnReplicate(id proto.NodeID, method string, latency time.Duration, err error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.replicated == nil {
+		o.replicated = make(map[proto.NodeID][]string)
+	}
+	o.replicated[id] = append(o.replicated[id], method)
+}
+
+func (o *recordObserver) OnLeaderChange(term uint64, leader proto.NodeID) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.leaders = append(o.leaders, leader)
+}
+
+func TestRateCounter(t *testing.T) {
+	Convey("rate counter", t, func() {
+		var c rateCounter
+		now := time.Unix(1000, 0)
+		So(c.rate(now), ShouldEqual, 0)
+
+		for i := 0; i < 20; i++ {
+			c.incr(now.Add(time.Duration(i%2) * time.Second))
+		}
+		So(c.rate(now.Add(time.Second)), ShouldEqual, 2)
+
+		// expired buckets are not counted
+		So(c.rate(now.Add(rateWindow*time.Second)), ShouldEqual, 1)
+		So(c.rate(now.Add((rateWindow+1)*time.Second)), ShouldEqual, 0)
+
+		// expired bucket is reused
+		c.incr(now.Add(rateWindow * time.Second))
+		So(c.rate(now.Add(rateWindow*time.Second)), ShouldEqual, 1.1)
+	})
+}
+
+func TestTwoPCRunner_Metrics(t *testing.T) {
+	mockLogCodec := &MockLogCodec{}
+	mockRouter := &MockTransportRouter{
+		transports: make(map[proto.NodeID]*MockTransport),
+	}
+
+	type createMockRes struct {
+		runner   *TwoPCRunner
+		config   *TwoPCConfig
+		fsm      *recordFSM
+		observer *recordObserver
+		store    *MockInmemStore
+	}
+
+	createMock := func(nodeID proto.NodeID) (res *createMockRes) {
+		logger := log.New()
+		logger.SetLevel(log.FatalLevel)
+		res = &createMockRes{
+			runner:   NewTwoPCRunner(),
+			fsm:      &recordFSM{},
+			observer: &recordObserver{},
+			store:    NewMockInmemStore(),
+		}
+		res.config = &TwoPCConfig{
+			RuntimeConfig: RuntimeConfig{
+				RootDir:        "test_dir",
+				LocalID:        nodeID,
+				Runner:         res.runner,
+				Transport:      mockRouter.getTransport(nodeID),
+				ProcessTimeout: time.Millisecond * 800,
+				Logger:         logger,
+			},
+			LogCodec:        mockLogCodec,
+			FSM:             res.fsm,
+			Observer:        res.observer,
+			PrepareTimeout:  time.Millisecond * 200,
+			CommitTimeout:   time.Millisecond * 200,
+			RollbackTimeout: time.Millisecond * 200,
+		}
+		return
+	}
+	servers := []*Server{
+		{
+			Role: Leader,
+			ID:   "leader",
+		},
+		{
+			Role: Follower,
+			ID:   "follower",
+		},
+		{
+			Role: Learner,
+			ID:   "learner",
+		},
+	}
+
+	Convey("runner metrics", t, func() {
+		mockRouter.ResetAll()
+
+		lMock := createMock("leader")
+		fMock := createMock("follower")
+		lnMock := createMock("learner")
+		mocks := []*createMockRes{lMock, fMock, lnMock}
+
+		for _, r := range mocks {
+			err := r.runner.Init(r.config, testPeersFixture(1, servers), r.store, r.store,
+				r.config.Transport)
+			So(err, ShouldBeNil)
+		}
+
+		defer func() {
+			for _, r := range mocks {
+				r.runner.Shutdown(true)
+			}
+		}()
+
+		for i := 1; i <= 3; i++ {
+			testData, _ := mockLogCodec.Encode(fmt.Sprintf("test data %d", i))
+			So(lMock.runner.Apply(testData), ShouldBeNil)
+		}
+		So(waitLearned(lMock.runner, "learner", 3), ShouldBeTrue)
+
+		stats := lMock.runner.Stats()
+		So(stats.CommitIndex, ShouldEqual, uint64(3))
+		So(stats.LastApplied, ShouldEqual, uint64(3))
+		So(stats.ApplyLag, ShouldEqual, uint64(0))
+		So(stats.Proposals, ShouldEqual, uint64(3))
+		So(stats.ProposalFailures, ShouldEqual, uint64(0))
+		So(stats.ProposalRate, ShouldBeGreaterThan, 0)
+		So(stats.LeaderChanges, ShouldEqual, uint64(0))
+		So(stats.Peers[proto.NodeID("follower")].Latency, ShouldBeGreaterThan, 0)
+		So(stats.Peers[proto.NodeID("learner")].Latency, ShouldBeGreaterThan, 0)
+
+		lMock.observer.lock.Lock()
+		So(lMock.observer.proposed, ShouldResemble, []uint64{1, 2, 3})
+		So(lMock.observer.applied, ShouldEqual, uint64(3))
+		So(lMock.observer.replicated["follower"], ShouldContain, "Prepare")
+		So(lMock.observer.replicated["follower"], ShouldContain, "Commit")
+		So(lMock.observer.replicated["learner"], ShouldContain, "Learn")
+		lMock.observer.lock.Unlock()
+
+		// followers propose nothing
+		stats = fMock.runner.Stats()
+		So(stats.Proposals, ShouldEqual, uint64(0))
+		So(stats.LastApplied, ShouldEqual, uint64(3))
+
+		Convey("leader change is reported", func() {
+			newServers := []*Server{
+				{
+					Role: Follower,
+					ID:   "leader",
+				},
+				{
+					Role: Leader,
+					ID:   "follower",
+				},
+			}
+			So(lMock.runner.UpdatePeers(testPeersFixture(2, newServers)), ShouldBeNil)
+
+			So(lMock.runner.Stats().LeaderChanges, ShouldEqual, uint64(1))
+			lMock.observer.lock.Lock()
+			So(lMock.observer.leaders, ShouldResemble, []proto.NodeID{"follower"})
+			lMock.observer.lock.Unlock()
+		})
+	})
+}
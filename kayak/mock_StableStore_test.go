@@ -66,6 +66,20 @@ func (_m *MockStableStore) Set(key []byte, val []byte) error {
 	return r0
 }
 
+// SetBatch provides a mock function with given fields: vals, uint64Vals
+func (_m *MockStableStore) SetBatch(vals map[string][]byte, uint64Vals map[string]uint64) error {
+	ret := _m.Called(vals, uint64Vals)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(map[string][]byte, map[string]uint64) error); ok {
+		r0 = rf(vals, uint64Vals)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // SetUint64 provides a mock function with given fields: key, val
 func (_m *MockStableStore) SetUint64(key []byte, val uint64) error {
 	ret := _m.Called(key, val)
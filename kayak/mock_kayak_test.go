@@ -277,14 +277,20 @@ func (c *CallCollector) Reset() {
 	c.callOrder = c.callOrder[:0]
 }
 
-func testPeersFixture(term uint64, servers []*Server) *Peers {
+// testPeersKey returns the key pair signing the peers fixtures, tests set it as the local key pair
+// of leader in kms, so the configurations signed by leader are trusted.
+func testPeersKey() (*asymmetric.PrivateKey, *asymmetric.PublicKey) {
 	testPriv := []byte{
 		0xea, 0xf0, 0x2c, 0xa3, 0x48, 0xc5, 0x24, 0xe6,
 		0x39, 0x26, 0x55, 0xba, 0x4d, 0x29, 0x60, 0x3c,
 		0xd1, 0xa7, 0x34, 0x7d, 0x9d, 0x65, 0xcf, 0xe9,
 		0x3c, 0xe1, 0xeb, 0xff, 0xdc, 0xa2, 0x26, 0x94,
 	}
-	privKey, pubKey := asymmetric.PrivKeyFromBytes(testPriv)
+	return asymmetric.PrivKeyFromBytes(testPriv)
+}
+
+func testPeersFixture(term uint64, servers []*Server) *Peers {
+	privKey, pubKey := testPeersKey()
 
 	newServers := make([]*Server, 0, len(servers))
 	var leaderNode *Server
@@ -0,0 +1,147 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kayak
+
+import (
+	"context"
+
+	"github.com/thunderdb/ThunderDB/utils"
+)
+
+// pipelineResult is the result of a Learn request sent in pipeline.
+type pipelineResult struct {
+	learned uint64
+	acked   bool
+	err     error
+}
+
+func (tpc *TwoPCConfig) pipelineDepth() int {
+	if tpc.PipelineDepth <= 1 {
+		return 1
+	}
+	return tpc.PipelineDepth
+}
+
+// batchFrom returns the queued logs to ship from index in one request, it must be called with
+// lock held.
+func (lr *learnerReplicator) batchFrom(index uint64) []*Log {
+	for i, l := range lr.inflight {
+		if l.Index >= index {
+			n := len(lr.inflight) - i
+			if max := lr.runner.config.maxBatchLogs(); n > max {
+				n = max
+			}
+			return append([]*Log(nil), lr.inflight[i:i+n]...)
+		}
+	}
+	return nil
+}
+
+// advance acks the index learned by learner if it's ahead, the acks of pipelined requests may
+// arrive out of order.
+func (lr *learnerReplicator) advance(learned uint64) {
+	if learned > lr.getMatchIndex() {
+		lr.ack(learned)
+	}
+}
+
+// shipPipelined sends the queued logs to learner with at most PipelineDepth requests in flight,
+// so the replication to a distant learner is not bounded by round trip time. The learner commits
+// logs in order and rejects the logs arriving ahead of a gap, so on any failure, the requests in
+// flight are drained and the logs are resent from the acked index one request at a time, see ship.
+func (lr *learnerReplicator) shipPipelined() error {
+	depth := lr.runner.config.pipelineDepth()
+	results := make(chan pipelineResult, depth)
+
+	for {
+		if prev := lr.getMatchIndex(); lr.runner.needsSnapshot(prev) {
+			if err := lr.installSnapshot(prev); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var (
+			prev     = lr.getMatchIndex()
+			next     = prev + 1
+			inflight int
+			failed   bool
+		)
+
+		for {
+			for !failed && inflight < depth {
+				lr.lock.Lock()
+				err := lr.fill()
+				logs := lr.batchFrom(next)
+				lr.lock.Unlock()
+
+				if err != nil || len(logs) == 0 {
+					failed = failed || err != nil
+					break
+				}
+
+				inflight++
+				next = logs[len(logs)-1].Index + 1
+				lr.runner.goFunc(func() {
+					ctx, cancel := utils.WithClockTimeout(context.Background(), lr.runner.config.clock(),
+						lr.runner.config.ProcessTimeout)
+					defer cancel()
+
+					var res pipelineResult
+					res.learned, res.acked, res.err = lr.runner.sendLearn(ctx, lr.id, logs)
+					results <- res
+				})
+			}
+
+			if inflight == 0 {
+				break
+			}
+
+			var res pipelineResult
+			select {
+			case <-lr.stopCh:
+				return nil
+			case <-lr.runner.shutdownCh:
+				return nil
+			case res = <-results:
+			}
+
+			inflight--
+
+			if res.acked {
+				lr.advance(res.learned)
+			}
+			if !res.acked || res.err != nil {
+				// stop sending, and wait for the requests in flight
+				failed = true
+			}
+		}
+
+		lr.lock.Lock()
+		matchIndex, lastIndex := lr.matchIndex, lr.lastIndex
+		lr.lock.Unlock()
+
+		if failed || (matchIndex == prev && matchIndex < lastIndex) {
+			// resend from the acked index
+			return lr.ship()
+		}
+
+		if matchIndex >= lastIndex {
+			return nil
+		}
+	}
+}
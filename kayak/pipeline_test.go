@@ -0,0 +1,186 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kayak
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/thunderdb/ThunderDB/proto"
+)
+
+// latencyTransport delays the Learn requests to simulate round trip time, and records the max
+// count of them in flight.
+type latencyTransport struct {
+	*MockTransport
+	delay func(seq int) time.Duration
+
+	lock        sync.Mutex
+	seq         int
+	inflight    int
+	maxInflight int
+}
+
+func (t *latencyTransport) Request(ctx context.Context, nodeID proto.NodeID,
+	method string, args interface{}) (interface{}, error) {
+	if method != "Learn" {
+		return t.MockTransport.Request(ctx, nodeID, method, args)
+	}
+
+	t.lock.Lock()
+	t.seq++
+	seq := t.seq
+	t.inflight++
+	if t.inflight > t.maxInflight {
+		t.maxInflight = t.inflight
+	}
+	t.lock.Unlock()
+
+	defer func() {
+		t.lock.Lock()
+		t.inflight--
+		t.lock.Unlock()
+	}()
+
+	time.Sleep(t.delay(seq))
+	return t.MockTransport.Request(ctx, nodeID, method, args)
+}
+
+func (t *latencyTransport) getMaxInflight() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.maxInflight
+}
+
+func TestTwoPCRunner_Pipeline(t *testing.T) {
+	mockLogCodec := &MockLogCodec{}
+	mockRouter := &MockTransportRouter{
+		transports: make(map[proto.NodeID]*MockTransport),
+	}
+
+	type createMockRes struct {
+		runner *TwoPCRunner
+		config *TwoPCConfig
+		fsm    *recordFSM
+		store  *MockInmemStore
+	}
+
+	createMock := func(nodeID proto.NodeID) (res *createMockRes) {
+		logger := log.New()
+		logger.SetLevel(log.FatalLevel)
+		res = &createMockRes{
+			runner: NewTwoPCRunner(),
+			fsm:    &recordFSM{},
+			store:  NewMockInmemStore(),
+		}
+		res.config = &TwoPCConfig{
+			RuntimeConfig: RuntimeConfig{
+				RootDir:        "test_dir",
+				LocalID:        nodeID,
+				Runner:         res.runner,
+				Transport:      mockRouter.getTransport(nodeID),
+				ProcessTimeout: time.Millisecond * 800,
+				Logger:         logger,
+			},
+			LogCodec:        mockLogCodec,
+			FSM:             res.fsm,
+			PrepareTimeout:  time.Millisecond * 200,
+			CommitTimeout:   time.Millisecond * 200,
+			RollbackTimeout: time.Millisecond * 200,
+		}
+		return
+	}
+	peers := testPeersFixture(1, []*Server{
+		{
+			Role: Leader,
+			ID:   "leader",
+		},
+		{
+			Role: Follower,
+			ID:   "follower",
+		},
+		{
+			Role: Learner,
+			ID:   "learner",
+		},
+	})
+
+	replicate := func(depth int, delay func(seq int) time.Duration) (maxInflight int) {
+		mockRouter.ResetAll()
+
+		lMock := createMock("leader")
+		fMock := createMock("follower")
+		lnMock := createMock("learner")
+		mocks := []*createMockRes{lMock, fMock, lnMock}
+
+		transport := &latencyTransport{
+			MockTransport: mockRouter.getTransport("leader"),
+			delay:         delay,
+		}
+		lMock.config.Transport = transport
+		lMock.config.PipelineDepth = depth
+
+		for _, r := range mocks {
+			err := r.runner.Init(r.config, peers, r.store, r.store, r.config.Transport)
+			So(err, ShouldBeNil)
+		}
+
+		defer func() {
+			for _, r := range mocks {
+				r.runner.Shutdown(true)
+			}
+		}()
+
+		for i := 1; i <= 8; i++ {
+			testData, _ := mockLogCodec.Encode(fmt.Sprintf("test data %d", i))
+			So(lMock.runner.Apply(testData), ShouldBeNil)
+		}
+
+		So(waitLearned(lMock.runner, "learner", 8), ShouldBeTrue)
+		So(lnMock.fsm.getApplied(), ShouldResemble, []uint64{1, 2, 3, 4, 5, 6, 7, 8})
+		So(lnMock.runner.lastLogHash.IsEqual(lMock.runner.lastLogHash), ShouldBeTrue)
+
+		return transport.getMaxInflight()
+	}
+
+	rtt := func(seq int) time.Duration {
+		return time.Millisecond * 20
+	}
+
+	Convey("one request in flight without pipeline", t, func() {
+		So(replicate(0, rtt), ShouldEqual, 1)
+	})
+
+	Convey("requests are pipelined to learner", t, func() {
+		So(replicate(4, rtt), ShouldBeBetweenOrEqual, 2, 4)
+	})
+
+	Convey("reordered requests are resent", t, func() {
+		// the second request arrives after the later ones
+		So(replicate(4, func(seq int) time.Duration {
+			if seq == 2 {
+				return time.Millisecond * 60
+			}
+			return time.Millisecond * 5
+		}), ShouldBeBetweenOrEqual, 2, 4)
+	})
+}
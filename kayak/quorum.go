@@ -0,0 +1,157 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kayak
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/thunderdb/ThunderDB/proto"
+	"github.com/thunderdb/ThunderDB/twopc"
+)
+
+var (
+	// ErrReadOnly defines writes rejected by leader in read-only mode after losing quorum
+	ErrReadOnly = errors.New("read-only since quorum is lost")
+)
+
+const (
+	// DefaultQuorumProbeInterval defines the default interval of probing peers in read-only mode
+	DefaultQuorumProbeInterval = time.Second
+)
+
+func (tpc *TwoPCConfig) quorumProbeInterval() time.Duration {
+	if tpc.QuorumProbeInterval <= 0 {
+		return DefaultQuorumProbeInterval
+	}
+	return tpc.QuorumProbeInterval
+}
+
+// SetReadOnlyOnQuorumLoss sets whether leader degrades to read-only mode instead of blocking on
+// peers when quorum is lost.
+//
+// Two phase commit requires all the voters to be prepared, so the quorum is considered lost once
+// a voter fails to prepare a log. In read-only mode, Apply fails fast with ErrReadOnly, while the
+// committed state can still be read from the underlying storage, which is stale as of the index
+// returned by ReadIndex. Leader probes the voters every QuorumProbeInterval and resumes accepting
+// writes once all of them respond. Disabling it resumes writes immediately.
+func (r *TwoPCRunner) SetReadOnlyOnQuorumLoss(enabled bool) {
+	r.quorumLock.Lock()
+	defer r.quorumLock.Unlock()
+
+	r.readOnlyOnQuorumLoss = enabled
+	if !enabled {
+		r.quorumLost = false
+	}
+}
+
+// ReadIndex returns the last committed log index, stale is true if the runner is in read-only mode
+// or shutdown, so that reads of the committed state may lag behind the other peers.
+func (r *TwoPCRunner) ReadIndex() (index uint64, stale bool) {
+	stats := r.Stats()
+	if stats == nil {
+		return 0, true
+	}
+
+	return stats.CommitIndex, stats.ReadOnly
+}
+
+func (r *TwoPCRunner) isReadOnly() bool {
+	r.quorumLock.Lock()
+	defer r.quorumLock.Unlock()
+
+	return r.quorumLost
+}
+
+// checkQuorum switches to read-only mode if any voter fails to prepare the log, it must be called
+// in run routine.
+func (r *TwoPCRunner) checkQuorum(err error) {
+	var pe *twopc.PrepareError
+	if !errors.As(err, &pe) {
+		return
+	}
+
+	r.quorumLock.Lock()
+	defer r.quorumLock.Unlock()
+
+	if !r.readOnlyOnQuorumLoss || r.quorumLost {
+		return
+	}
+
+	r.quorumLost = true
+	voters := r.otherVoters()
+
+	r.config.Logger.Warningf("quorum lost on preparing log, leader degrades to read-only: %s", err.Error())
+	r.goFunc(func() { r.probeQuorum(voters) })
+}
+
+// probeQuorum pings voters periodically until all of them respond, then resumes writes.
+func (r *TwoPCRunner) probeQuorum(voters []proto.NodeID) {
+	for {
+		select {
+		case <-r.shutdownCh:
+			return
+		case <-r.config.clock().After(r.config.quorumProbeInterval()):
+		}
+
+		if !r.isReadOnly() {
+			// disabled meanwhile
+			return
+		}
+
+		if r.pingVoters(voters) == nil {
+			r.quorumLock.Lock()
+			r.quorumLost = false
+			r.quorumLock.Unlock()
+
+			r.config.Logger.Info("quorum regained, leader resumes accepting writes")
+			return
+		}
+	}
+}
+
+// otherVoters returns the voters except local server, it must be called in run routine.
+func (r *TwoPCRunner) otherVoters() (voters []proto.NodeID) {
+	for _, s := range r.peers.Voters() {
+		if s.ID != r.config.LocalID {
+			voters = append(voters, s.ID)
+		}
+	}
+	return
+}
+
+// pingVoters pings the voters, and returns the first failure. A voter only responds to its
+// leader, see verifyLeader.
+func (r *TwoPCRunner) pingVoters(voters []proto.NodeID) error {
+	for _, id := range voters {
+		err := r.nestedTimeoutCtx(context.Background(), r.config.PrepareTimeout, func(ctx context.Context) error {
+			_, err := r.callPeer(ctx, id, "Ping", nil)
+			return err
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *TwoPCRunner) processPing(req Request) {
+	req.SendResponse(nil, nil)
+}
@@ -0,0 +1,260 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kayak
+
+import (
+	"errors"
+	"runtime"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/stretchr/testify/mock"
+	"github.com/thunderdb/ThunderDB/proto"
+	"github.com/thunderdb/ThunderDB/utils"
+)
+
+func TestTwoPCRunner_ReadOnlyOnQuorumLoss(t *testing.T) {
+	mockLogCodec := &MockLogCodec{}
+	mockRouter := &MockTransportRouter{
+		transports: make(map[proto.NodeID]*MockTransport),
+	}
+
+	type createMockRes struct {
+		runner    *TwoPCRunner
+		transport *MockTransport
+		worker    *MockWorker
+		fsm       *recordFSM
+		config    *TwoPCConfig
+		store     *MockInmemStore
+	}
+
+	createMock := func(nodeID proto.NodeID) (res *createMockRes) {
+		res = &createMockRes{}
+		logger := log.New()
+		logger.SetLevel(log.FatalLevel)
+		res.runner = NewTwoPCRunner()
+		res.transport = mockRouter.getTransport(nodeID)
+		res.worker = &MockWorker{}
+		res.fsm = &recordFSM{}
+		res.store = NewMockInmemStore()
+		res.config = &TwoPCConfig{
+			RuntimeConfig: RuntimeConfig{
+				RootDir:        "test_dir",
+				LocalID:        nodeID,
+				Runner:         res.runner,
+				Transport:      res.transport,
+				ProcessTimeout: time.Millisecond * 800,
+				Logger:         logger,
+			},
+			LogCodec:            mockLogCodec,
+			Storage:             res.worker,
+			FSM:                 res.fsm,
+			PrepareTimeout:      time.Millisecond * 200,
+			CommitTimeout:       time.Millisecond * 200,
+			RollbackTimeout:     time.Millisecond * 200,
+			QuorumProbeInterval: time.Millisecond * 50,
+		}
+		res.worker.On("Prepare", mock.Anything, "test data").Return(nil)
+		res.worker.On("Commit", mock.Anything, "test data").Return(nil)
+		res.worker.On("Rollback", mock.Anything, "test data").Return(nil)
+		return
+	}
+	peers := testPeersFixture(1, []*Server{
+		{
+			Role: Leader,
+			ID:   "leader",
+		},
+		{
+			Role: Follower,
+			ID:   "follower1",
+		},
+		{
+			Role: Follower,
+			ID:   "follower2",
+		},
+		{
+			Role: Follower,
+			ID:   "follower3",
+		},
+		{
+			Role: Follower,
+			ID:   "follower4",
+		},
+	})
+
+	Convey("leader degrades to read-only on quorum loss", t, func() {
+		mockRouter.ResetAll()
+
+		lMock := createMock("leader")
+		mocks := []*createMockRes{lMock}
+		for _, id := range []proto.NodeID{"follower1", "follower2", "follower3", "follower4"} {
+			mocks = append(mocks, createMock(id))
+		}
+
+		for _, r := range mocks {
+			err := r.runner.Init(r.config, peers, r.store, r.store, r.transport)
+			So(err, ShouldBeNil)
+		}
+
+		defer func() {
+			for _, r := range mocks {
+				r.runner.Shutdown(true)
+			}
+		}()
+
+		lMock.runner.SetReadOnlyOnQuorumLoss(true)
+
+		testData, _ := mockLogCodec.Encode("test data")
+		So(lMock.runner.Apply(testData), ShouldBeNil)
+
+		index, stale := lMock.runner.ReadIndex()
+		So(index, ShouldEqual, uint64(1))
+		So(stale, ShouldBeFalse)
+
+		// partition away the majority, requests to them are dropped
+		partitioned := mocks[2:]
+		for _, r := range partitioned {
+			mockRouter.ResetTransport(r.config.LocalID)
+		}
+
+		So(lMock.runner.Apply(testData), ShouldNotBeNil)
+
+		// writes fail fast without contacting peers
+		start := time.Now()
+		So(lMock.runner.Apply(testData), ShouldEqual, ErrReadOnly)
+		So(time.Since(start), ShouldBeLessThan, lMock.config.PrepareTimeout)
+
+		// reads are served from the last committed state, marked stale
+		index, stale = lMock.runner.ReadIndex()
+		So(index, ShouldEqual, uint64(1))
+		So(stale, ShouldBeTrue)
+		So(lMock.runner.Stats().ReadOnly, ShouldBeTrue)
+		So(lMock.fsm.getApplied(), ShouldResemble, []uint64{1})
+
+		// still read-only after probing partitioned peers
+		time.Sleep(lMock.config.PrepareTimeout * 2)
+		So(lMock.runner.Apply(testData), ShouldEqual, ErrReadOnly)
+
+		// reconnect, leader resumes accepting writes
+		mockRouter.transportLock.Lock()
+		for _, r := range partitioned {
+			mockRouter.transports[r.config.LocalID] = r.transport
+		}
+		mockRouter.transportLock.Unlock()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if _, stale = lMock.runner.ReadIndex(); !stale || time.Now().After(deadline) {
+				break
+			}
+			time.Sleep(lMock.config.QuorumProbeInterval)
+		}
+		So(stale, ShouldBeFalse)
+
+		So(lMock.runner.Apply(testData), ShouldBeNil)
+		for _, r := range mocks {
+			So(r.runner.lastLogIndex, ShouldEqual, uint64(2))
+		}
+		So(lMock.fsm.getApplied(), ShouldResemble, []uint64{1, 2})
+	})
+
+	Convey("leader blocks on quorum loss by default", t, func() {
+		mockRouter.ResetAll()
+
+		lMock := createMock("leader")
+		mocks := []*createMockRes{lMock}
+		for _, id := range []proto.NodeID{"follower1", "follower2", "follower3", "follower4"} {
+			mocks = append(mocks, createMock(id))
+		}
+
+		for _, r := range mocks {
+			err := r.runner.Init(r.config, peers, r.store, r.store, r.transport)
+			So(err, ShouldBeNil)
+		}
+
+		defer func() {
+			for _, r := range mocks {
+				r.runner.Shutdown(true)
+			}
+		}()
+
+		mockRouter.ResetTransport("follower4")
+
+		testData, _ := mockLogCodec.Encode("test data")
+		So(lMock.runner.Apply(testData), ShouldNotBeNil)
+		So(lMock.runner.Apply(testData), ShouldNotEqual, ErrReadOnly)
+
+		_, stale := lMock.runner.ReadIndex()
+		So(stale, ShouldBeFalse)
+	})
+
+	Convey("quorum probe is driven by clock", t, func() {
+		mockRouter.ResetAll()
+
+		clock := utils.NewFakeClock(time.Now())
+		lMock := createMock("leader")
+		mocks := []*createMockRes{lMock}
+		for _, id := range []proto.NodeID{"follower1", "follower2", "follower3", "follower4"} {
+			mocks = append(mocks, createMock(id))
+		}
+
+		for _, r := range mocks {
+			r.config.Clock = clock
+			r.config.QuorumProbeInterval = time.Hour
+			err := r.runner.Init(r.config, peers, r.store, r.store, r.transport)
+			So(err, ShouldBeNil)
+		}
+
+		defer func() {
+			for _, r := range mocks {
+				r.runner.Shutdown(true)
+			}
+		}()
+
+		// follower1 fails to prepare once
+		f1Worker := mocks[1].worker
+		f1Worker.ExpectedCalls = nil
+		f1Worker.On("Prepare", mock.Anything, "test data").Return(errors.New("prepare failed")).Once()
+		f1Worker.On("Prepare", mock.Anything, "test data").Return(nil)
+		f1Worker.On("Commit", mock.Anything, "test data").Return(nil)
+		f1Worker.On("Rollback", mock.Anything, "test data").Return(nil)
+
+		lMock.runner.SetReadOnlyOnQuorumLoss(true)
+
+		testData, _ := mockLogCodec.Encode("test data")
+		So(lMock.runner.Apply(testData), ShouldNotBeNil)
+		So(lMock.runner.Apply(testData), ShouldEqual, ErrReadOnly)
+
+		// no probe until the clock advances
+		_, stale := lMock.runner.ReadIndex()
+		So(stale, ShouldBeTrue)
+
+		for i := 0; i < 1000 && stale; i++ {
+			clock.Advance(lMock.config.QuorumProbeInterval)
+			runtime.Gosched()
+			_, stale = lMock.runner.ReadIndex()
+		}
+		So(stale, ShouldBeFalse)
+
+		So(lMock.runner.Apply(testData), ShouldBeNil)
+		for _, r := range mocks {
+			So(r.runner.lastLogIndex, ShouldEqual, uint64(1))
+		}
+	})
+}
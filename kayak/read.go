@@ -0,0 +1,158 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kayak
+
+import (
+	"context"
+
+	"github.com/thunderdb/ThunderDB/proto"
+)
+
+// ReadBarrierRunner is a Runner supporting consistent reads on any server, see Runtime.Read.
+type ReadBarrierRunner interface {
+	Runner
+
+	// ReadBarrier waits for the logs committed by leader before the call to be applied locally.
+	ReadBarrier(ctx context.Context) (index uint64, err error)
+}
+
+// ReadBarrier waits until the logs committed by leader as of the call are applied to the local
+// state, so that the reads of the local storage or FSM after it observe all the writes completed
+// before the call. The read index is returned.
+//
+// The read index is the committed index of leader, since a log is only committed by leader after
+// all the voters are prepared. A deposed leader may not know it's replaced by a new peers
+// configuration yet, so leader confirms that all the voters still recognize it before using its
+// committed index, see confirmLeadership. Followers and learners request the read index from
+// leader, then wait for the local state to catch up, which is usually no more than the log being
+// committed.
+func (r *TwoPCRunner) ReadBarrier(ctx context.Context) (index uint64, err error) {
+	var stats *RunnerStats
+	if stats, err = r.statsContext(ctx); err != nil {
+		return
+	}
+
+	index = stats.CommitIndex
+
+	if stats.Leader == r.config.LocalID {
+		var voters []proto.NodeID
+		for id, ps := range stats.Peers {
+			if ps.Role != Learner {
+				voters = append(voters, id)
+			}
+		}
+
+		if err = r.confirmLeadership(voters); err != nil {
+			return
+		}
+	} else {
+		var res interface{}
+		if res, err = r.transport.Request(ctx, stats.Leader, "ReadIndex", nil); err != nil {
+			return
+		}
+
+		if index, err = r.decodeLogIndex(res); err != nil {
+			return
+		}
+	}
+
+	err = r.waitApplied(ctx, index)
+
+	return
+}
+
+// waitApplied waits until the log at index is applied locally.
+func (r *TwoPCRunner) waitApplied(ctx context.Context, index uint64) error {
+	for {
+		r.appliedLock.Lock()
+		applied, notify := r.applied, r.appliedNotify
+		r.appliedLock.Unlock()
+
+		if applied >= index {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-r.shutdownCh:
+			return ErrShutdown
+		case <-notify:
+		}
+	}
+}
+
+// publishApplied wakes up the readers waiting for the applied index, it must be called in run
+// routine after the committed logs are applied. Logs are applied to storage on commit, and then
+// to FSM if it's set.
+func (r *TwoPCRunner) publishApplied() {
+	applied := r.lastLogIndex
+	if r.config.FSM != nil {
+		applied = r.lastApplied
+	}
+
+	r.appliedLock.Lock()
+	defer r.appliedLock.Unlock()
+
+	if applied == r.applied && r.appliedNotify != nil {
+		return
+	}
+
+	r.applied = applied
+	if r.appliedNotify != nil {
+		close(r.appliedNotify)
+	}
+	r.appliedNotify = make(chan struct{})
+}
+
+// confirmLeadership confirms that local server is still the leader recognized by all the voters
+// with a round of Ping, ErrNotLeader is returned if any of them fails. A new leader is always a
+// voter of the previous configuration, so a deposed leader can not get all the responses.
+func (r *TwoPCRunner) confirmLeadership(voters []proto.NodeID) error {
+	if err := r.pingVoters(voters); err != nil {
+		r.config.Logger.Warningf("confirm leadership failed: %s", err.Error())
+		return ErrNotLeader
+	}
+
+	return nil
+}
+
+// processReadIndex responds the committed index of leader to the servers in peers, it's responded
+// after the leadership is confirmed in background, so the run routine is not blocked.
+func (r *TwoPCRunner) processReadIndex(req Request) {
+	if r.role != Leader {
+		req.SendResponse(nil, ErrNotLeader)
+		return
+	}
+
+	for _, s := range r.peers.Servers {
+		if s.ID == req.GetNodeID() {
+			index, voters := r.lastLogIndex, r.otherVoters()
+			r.goFunc(func() {
+				if err := r.confirmLeadership(voters); err != nil {
+					req.SendResponse(nil, err)
+					return
+				}
+
+				req.SendResponse(index, nil)
+			})
+			return
+		}
+	}
+
+	req.SendResponse(nil, ErrInvalidRequest)
+}
@@ -0,0 +1,236 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kayak
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/thunderdb/ThunderDB/proto"
+)
+
+// blockFSM is recordFSM which blocks applying logs until unblocked.
+type blockFSM struct {
+	recordFSM
+	block     chan struct{}
+	unblocked sync.Once
+}
+
+func (f *blockFSM) Apply(l *Log) (interface{}, error) {
+	<-f.block
+	return f.recordFSM.Apply(l)
+}
+
+func (f *blockFSM) unblock() {
+	f.unblocked.Do(func() {
+		close(f.block)
+	})
+}
+
+func TestTwoPCRunner_ReadBarrier(t *testing.T) {
+	mockLogCodec := &MockLogCodec{}
+	mockRouter := &MockTransportRouter{
+		transports: make(map[proto.NodeID]*MockTransport),
+	}
+
+	type createMockRes struct {
+		runner *TwoPCRunner
+		config *TwoPCConfig
+		fsm    *blockFSM
+		store  *MockInmemStore
+	}
+
+	createMock := func(nodeID proto.NodeID) (res *createMockRes) {
+		logger := log.New()
+		logger.SetLevel(log.FatalLevel)
+		res = &createMockRes{
+			runner: NewTwoPCRunner(),
+			fsm:    &blockFSM{block: make(chan struct{})},
+			store:  NewMockInmemStore(),
+		}
+		res.config = &TwoPCConfig{
+			RuntimeConfig: RuntimeConfig{
+				RootDir:        "test_dir",
+				LocalID:        nodeID,
+				Runner:         res.runner,
+				Transport:      mockRouter.getTransport(nodeID),
+				ProcessTimeout: time.Millisecond * 800,
+				Logger:         logger,
+			},
+			LogCodec:        mockLogCodec,
+			FSM:             res.fsm,
+			PrepareTimeout:  time.Millisecond * 200,
+			CommitTimeout:   time.Millisecond * 200,
+			RollbackTimeout: time.Millisecond * 200,
+		}
+		return
+	}
+	peers := testPeersFixture(1, []*Server{
+		{
+			Role: Leader,
+			ID:   "leader",
+		},
+		{
+			Role: Follower,
+			ID:   "follower",
+		},
+		{
+			Role: Learner,
+			ID:   "learner",
+		},
+	})
+
+	Convey("read barrier", t, func() {
+		mockRouter.ResetAll()
+
+		lMock := createMock("leader")
+		fMock := createMock("follower")
+		lnMock := createMock("learner")
+		mocks := []*createMockRes{lMock, fMock, lnMock}
+
+		// only learner applies logs in background
+		lMock.fsm.unblock()
+		fMock.fsm.unblock()
+
+		for _, r := range mocks {
+			err := r.runner.Init(r.config, peers, r.store, r.store, r.config.Transport)
+			So(err, ShouldBeNil)
+		}
+
+		defer func() {
+			for _, r := range mocks {
+				r.fsm.unblock()
+				r.runner.Shutdown(true)
+			}
+		}()
+
+		for i := 1; i <= 2; i++ {
+			testData, _ := mockLogCodec.Encode(fmt.Sprintf("test data %d", i))
+			So(lMock.runner.Apply(testData), ShouldBeNil)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		Convey("voters read committed index", func() {
+			for _, r := range []*createMockRes{lMock, fMock} {
+				index, err := r.runner.ReadBarrier(ctx)
+				So(err, ShouldBeNil)
+				So(index, ShouldEqual, uint64(2))
+				So(r.fsm.getApplied(), ShouldResemble, []uint64{1, 2})
+			}
+		})
+
+		Convey("learner waits for logs to be applied", func() {
+			shortCtx, shortCancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+			defer shortCancel()
+
+			_, err := lnMock.runner.ReadBarrier(shortCtx)
+			So(err == context.DeadlineExceeded, ShouldBeTrue)
+
+			lnMock.fsm.unblock()
+
+			index, err := lnMock.runner.ReadBarrier(ctx)
+			So(err, ShouldBeNil)
+			So(index, ShouldEqual, uint64(2))
+			So(lnMock.fsm.getApplied(), ShouldResemble, []uint64{1, 2})
+		})
+
+		Convey("read index is served by leader only", func() {
+			lnMock.fsm.unblock()
+
+			_, err := lnMock.runner.transport.Request(ctx, "follower", "ReadIndex", nil)
+			So(err, ShouldEqual, ErrNotLeader)
+
+			// server removed from peers
+			newPeers := testPeersFixture(2, []*Server{
+				{
+					Role: Leader,
+					ID:   "leader",
+				},
+				{
+					Role: Follower,
+					ID:   "follower",
+				},
+			})
+			So(lMock.runner.UpdatePeers(newPeers), ShouldBeNil)
+			_, err = lnMock.runner.transport.Request(ctx, "leader", "ReadIndex", nil)
+			So(err, ShouldEqual, ErrInvalidRequest)
+		})
+
+		Convey("deposed leader does not serve read index", func() {
+			lnMock.fsm.unblock()
+
+			// new configuration is not pushed to the old leader yet
+			newPeers := testPeersFixture(2, []*Server{
+				{
+					Role: Follower,
+					ID:   "leader",
+				},
+				{
+					Role: Leader,
+					ID:   "follower",
+				},
+				{
+					Role: Learner,
+					ID:   "learner",
+				},
+			})
+			So(fMock.runner.UpdatePeers(newPeers), ShouldBeNil)
+			So(lnMock.runner.UpdatePeers(newPeers), ShouldBeNil)
+			So(lMock.runner.role, ShouldEqual, Leader)
+
+			_, err := lnMock.runner.transport.Request(ctx, "leader", "ReadIndex", nil)
+			So(err, ShouldEqual, ErrNotLeader)
+			_, err = lMock.runner.ReadBarrier(ctx)
+			So(err, ShouldEqual, ErrNotLeader)
+
+			// new leader serves read index once all the voters install the new configuration
+			So(lMock.runner.UpdatePeers(newPeers), ShouldBeNil)
+			index, err := fMock.runner.ReadBarrier(ctx)
+			So(err, ShouldBeNil)
+			So(index, ShouldEqual, uint64(2))
+		})
+
+		Convey("runtime read", func() {
+			rt, err := NewRuntime(fMock.config, peers)
+			So(err, ShouldBeNil)
+
+			index, err := rt.Read(ctx)
+			So(err, ShouldBeNil)
+			So(index, ShouldEqual, uint64(2))
+
+			rt, err = NewRuntime(testConfig(".", "leader"), peers)
+			So(err, ShouldBeNil)
+			_, err = rt.Read(ctx)
+			So(err, ShouldEqual, ErrReadNotSupported)
+		})
+
+		Convey("read barrier fails on shutdown", func() {
+			lnMock.fsm.unblock()
+
+			So(fMock.runner.Shutdown(true), ShouldBeNil)
+			_, err := fMock.runner.ReadBarrier(ctx)
+			So(err, ShouldEqual, ErrShutdown)
+		})
+	})
+}
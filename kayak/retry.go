@@ -0,0 +1,142 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kayak
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/thunderdb/ThunderDB/proto"
+	"github.com/thunderdb/ThunderDB/utils"
+)
+
+// RPCPolicy is the timeout and retry policy of the requests of a method to peers. The zero value
+// sends a request once, bounded by the deadline of the round only.
+type RPCPolicy struct {
+	// Timeout bounds each attempt of the request, so a slow peer is retried instead of holding the
+	// whole round, the attempts are still bounded by the deadline of the round
+	Timeout time.Duration
+
+	// MaxRetries is the max count of retries after the first attempt failed
+	MaxRetries int
+
+	// MinBackoff is the backoff before the first retry, it's doubled on each retry
+	MinBackoff time.Duration
+
+	// MaxBackoff caps the backoff before a retry, the backoff is not capped if it's not set
+	MaxBackoff time.Duration
+
+	// Jitter is the fraction in [0, 1] of the backoff randomly reduced, so the retries to the
+	// peers failed at the same time are spread
+	Jitter float64
+}
+
+// RPCConfig is the timeout and retry policies of the requests to peers by method. The requests
+// are idempotent on peers, so a request is retried even if it may have been processed.
+type RPCConfig struct {
+	// Prepare is the policy of Prepare requests of 2PC
+	Prepare RPCPolicy
+
+	// Commit is the policy of Commit requests of 2PC
+	Commit RPCPolicy
+
+	// Rollback is the policy of Rollback requests of 2PC
+	Rollback RPCPolicy
+
+	// Heartbeat is the policy of Ping requests probing the quorum, see SetReadOnlyOnQuorumLoss
+	Heartbeat RPCPolicy
+}
+
+func (c *RPCConfig) policy(method string) RPCPolicy {
+	switch method {
+	case "Prepare":
+		return c.Prepare
+	case "Commit":
+		return c.Commit
+	case "Rollback":
+		return c.Rollback
+	case "Ping":
+		return c.Heartbeat
+	default:
+		return RPCPolicy{}
+	}
+}
+
+// backoff returns the backoff before the retry numbered from 0.
+func (p *RPCPolicy) backoff(retry int) time.Duration {
+	d := p.MinBackoff
+	for i := 0; i < retry && (p.MaxBackoff <= 0 || d < p.MaxBackoff); i++ {
+		d *= 2
+	}
+
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+
+	if p.Jitter > 0 {
+		jitter := p.Jitter
+		if jitter > 1 {
+			jitter = 1
+		}
+		d -= time.Duration(float64(d) * jitter * rand.Float64())
+	}
+
+	return d
+}
+
+// retryable returns whether the failed request should be retried, the requests rejected by peer
+// are not.
+func retryable(err error) bool {
+	switch err {
+	case ErrInvalidRequest, ErrInvalidLog, ErrNotLeader, ErrNotLearner, ErrStaleConfig,
+		ErrInvalidConfigSig, ErrShutdown:
+		return false
+	default:
+		return true
+	}
+}
+
+// callPeer sends the request to peer with the timeout and retry policy of method, see RPCConfig.
+func (r *TwoPCRunner) callPeer(ctx context.Context, id proto.NodeID, method string,
+	args interface{}) (res interface{}, err error) {
+	policy := r.config.RPC.policy(method)
+
+	for retry := 0; ; retry++ {
+		if policy.Timeout > 0 {
+			attemptCtx, cancel := utils.WithClockTimeout(ctx, r.config.clock(), policy.Timeout)
+			res, err = r.requestPeer(attemptCtx, id, method, args)
+			cancel()
+		} else {
+			res, err = r.requestPeer(ctx, id, method, args)
+		}
+
+		if err == nil || retry >= policy.MaxRetries || !retryable(err) || ctx.Err() != nil {
+			return
+		}
+
+		r.config.Logger.Debugf("retry %s request to %s: %s", method, id, err.Error())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.shutdownCh:
+			return
+		case <-r.config.clock().After(policy.backoff(retry)):
+		}
+	}
+}
@@ -0,0 +1,236 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kayak
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/thunderdb/ThunderDB/proto"
+)
+
+// flakyTransport fails the first requests of methods, the request is either delayed until
+// timeout before sent, or sent with its response lost.
+type flakyTransport struct {
+	*MockTransport
+
+	lock     sync.Mutex
+	delays   map[string]int
+	losses   map[string]int
+	attempts map[string]int
+}
+
+func (t *flakyTransport) Request(ctx context.Context, nodeID proto.NodeID,
+	method string, args interface{}) (interface{}, error) {
+	t.lock.Lock()
+	t.attempts[method]++
+	delay := t.delays[method] > 0
+	if delay {
+		t.delays[method]--
+	}
+	loss := !delay && t.losses[method] > 0
+	if loss {
+		t.losses[method]--
+	}
+	t.lock.Unlock()
+
+	if delay {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	res, err := t.MockTransport.Request(ctx, nodeID, method, args)
+	if loss {
+		return nil, errors.New("connection reset")
+	}
+	return res, err
+}
+
+func (t *flakyTransport) getAttempts(method string) int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.attempts[method]
+}
+
+func TestRPCPolicy(t *testing.T) {
+	Convey("backoff is doubled on each retry", t, func() {
+		policy := &RPCPolicy{
+			MinBackoff: time.Millisecond * 10,
+			MaxBackoff: time.Millisecond * 50,
+		}
+		So(policy.backoff(0), ShouldEqual, time.Millisecond*10)
+		So(policy.backoff(1), ShouldEqual, time.Millisecond*20)
+		So(policy.backoff(2), ShouldEqual, time.Millisecond*40)
+		So(policy.backoff(3), ShouldEqual, time.Millisecond*50)
+		So(policy.backoff(100), ShouldEqual, time.Millisecond*50)
+
+		policy.Jitter = 0.5
+		for i := 0; i < 100; i++ {
+			So(policy.backoff(0), ShouldBeBetweenOrEqual, time.Millisecond*5, time.Millisecond*10)
+		}
+	})
+
+	Convey("policies by method", t, func() {
+		config := &RPCConfig{
+			Prepare:   RPCPolicy{MaxRetries: 1},
+			Commit:    RPCPolicy{MaxRetries: 2},
+			Rollback:  RPCPolicy{MaxRetries: 3},
+			Heartbeat: RPCPolicy{MaxRetries: 4},
+		}
+		So(config.policy("Prepare").MaxRetries, ShouldEqual, 1)
+		So(config.policy("Commit").MaxRetries, ShouldEqual, 2)
+		So(config.policy("Rollback").MaxRetries, ShouldEqual, 3)
+		So(config.policy("Ping").MaxRetries, ShouldEqual, 4)
+		So(config.policy("Learn"), ShouldResemble, RPCPolicy{})
+	})
+}
+
+func TestTwoPCRunner_Retry(t *testing.T) {
+	mockLogCodec := &MockLogCodec{}
+	mockRouter := &MockTransportRouter{
+		transports: make(map[proto.NodeID]*MockTransport),
+	}
+
+	type createMockRes struct {
+		runner *TwoPCRunner
+		config *TwoPCConfig
+		fsm    *recordFSM
+		store  *MockInmemStore
+	}
+
+	createMock := func(nodeID proto.NodeID) (res *createMockRes) {
+		logger := log.New()
+		logger.SetLevel(log.FatalLevel)
+		res = &createMockRes{
+			runner: NewTwoPCRunner(),
+			fsm:    &recordFSM{},
+			store:  NewMockInmemStore(),
+		}
+		res.config = &TwoPCConfig{
+			RuntimeConfig: RuntimeConfig{
+				RootDir:        "test_dir",
+				LocalID:        nodeID,
+				Runner:         res.runner,
+				Transport:      mockRouter.getTransport(nodeID),
+				ProcessTimeout: time.Millisecond * 800,
+				Logger:         logger,
+			},
+			LogCodec:        mockLogCodec,
+			FSM:             res.fsm,
+			PrepareTimeout:  time.Millisecond * 200,
+			CommitTimeout:   time.Millisecond * 200,
+			RollbackTimeout: time.Millisecond * 200,
+		}
+		return
+	}
+	peers := testPeersFixture(1, []*Server{
+		{
+			Role: Leader,
+			ID:   "leader",
+		},
+		{
+			Role: Follower,
+			ID:   "follower",
+		},
+	})
+
+	Convey("failed requests to follower are retried", t, func() {
+		mockRouter.ResetAll()
+
+		lMock := createMock("leader")
+		fMock := createMock("follower")
+		mocks := []*createMockRes{lMock, fMock}
+
+		transport := &flakyTransport{
+			MockTransport: mockRouter.getTransport("leader"),
+			delays:        map[string]int{"Prepare": 1},
+			losses:        map[string]int{"Commit": 2},
+			attempts:      make(map[string]int),
+		}
+		lMock.config.Transport = transport
+		lMock.config.RPC = RPCConfig{
+			Prepare: RPCPolicy{
+				Timeout:    time.Millisecond * 50,
+				MaxRetries: 1,
+				MinBackoff: time.Millisecond,
+			},
+			Commit: RPCPolicy{
+				MaxRetries: 2,
+				MinBackoff: time.Millisecond,
+				Jitter:     0.5,
+			},
+		}
+
+		for _, r := range mocks {
+			err := r.runner.Init(r.config, peers, r.store, r.store, r.config.Transport)
+			So(err, ShouldBeNil)
+		}
+
+		defer func() {
+			for _, r := range mocks {
+				r.runner.Shutdown(true)
+			}
+		}()
+
+		testData, _ := mockLogCodec.Encode("test data 1")
+		So(lMock.runner.Apply(testData), ShouldBeNil)
+
+		// slow prepare is retried after timeout, and lost commit responses are retried
+		So(transport.getAttempts("Prepare"), ShouldEqual, 2)
+		So(transport.getAttempts("Commit"), ShouldEqual, 3)
+		So(fMock.runner.lastLogIndex, ShouldEqual, uint64(1))
+		So(fMock.fsm.getApplied(), ShouldResemble, []uint64{1})
+
+		Convey("rejected requests are not retried", func() {
+			_, err := lMock.runner.callPeer(context.Background(), "follower", "Commit", uint64(3))
+			So(err, ShouldEqual, ErrInvalidRequest)
+			So(transport.getAttempts("Commit"), ShouldEqual, 4)
+		})
+
+		Convey("follower prepared with the response lost is rolled back", func() {
+			transport.lock.Lock()
+			transport.losses["Prepare"] = 2
+			transport.lock.Unlock()
+
+			testData, _ := mockLogCodec.Encode(fmt.Sprintf("test data %d", 2))
+			So(lMock.runner.Apply(testData), ShouldNotBeNil)
+			So(transport.getAttempts("Prepare"), ShouldEqual, 4)
+			So(fMock.runner.getState(), ShouldEqual, Idle)
+
+			// follower accepts the next log
+			So(lMock.runner.Apply(testData), ShouldBeNil)
+			So(fMock.runner.lastLogIndex, ShouldEqual, uint64(2))
+		})
+
+		Convey("retries are bounded by policy", func() {
+			transport.lock.Lock()
+			transport.losses["Commit"] = 3
+			transport.lock.Unlock()
+
+			// the log is committed on leader anyway
+			testData, _ := mockLogCodec.Encode(fmt.Sprintf("test data %d", 2))
+			So(lMock.runner.Apply(testData), ShouldBeNil)
+			So(transport.getAttempts("Commit"), ShouldEqual, 6)
+		})
+	})
+}
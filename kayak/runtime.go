@@ -17,9 +17,12 @@
 package kayak
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"path/filepath"
+
+	"github.com/thunderdb/ThunderDB/proto"
 )
 
 const (
@@ -34,6 +37,10 @@ var (
 	ErrInvalidLog = errors.New("invalid log")
 	// ErrNotLeader defines not leader on log processing
 	ErrNotLeader = errors.New("not leader")
+	// ErrTransferNotSupported defines runner not supporting leadership transfer error
+	ErrTransferNotSupported = errors.New("leadership transfer not supported")
+	// ErrReadNotSupported defines runner not supporting consistent read error
+	ErrReadNotSupported = errors.New("consistent read not supported")
 )
 
 // Runtime defines common init/shutdown logic for different consensus protocol runner
@@ -166,3 +173,38 @@ func (r *Runtime) UpdatePeers(peers *Peers) error {
 
 	return nil
 }
+
+// TransferLeadership hands over the leadership to target gracefully for maintenance, new writes
+// are blocked until the transfer is done or ctx is done, the runner must implement
+// TransferableRunner.
+func (r *Runtime) TransferLeadership(ctx context.Context, target proto.NodeID) error {
+	if !r.isLeader {
+		return ErrNotLeader
+	}
+
+	runner, ok := r.config.Runner.(TransferableRunner)
+	if !ok {
+		return ErrTransferNotSupported
+	}
+
+	if err := runner.TransferLeadershipContext(ctx, target); err != nil {
+		return err
+	}
+
+	r.isLeader = false
+
+	return nil
+}
+
+// Read is the barrier of consistent reads on any server, it returns once all the writes completed
+// before the call are applied to the local state, so the following reads of local state observe
+// them. It can be plugged in query serving as the hook before executing read queries. The runner
+// must implement ReadBarrierRunner.
+func (r *Runtime) Read(ctx context.Context) (index uint64, err error) {
+	runner, ok := r.config.Runner.(ReadBarrierRunner)
+	if !ok {
+		return 0, ErrReadNotSupported
+	}
+
+	return runner.ReadBarrier(ctx)
+}
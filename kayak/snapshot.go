@@ -0,0 +1,321 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kayak
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/thunderdb/ThunderDB/proto"
+)
+
+var (
+	// snapshot of fsm stored in local meta
+	keySnapshot = []byte("Snapshot")
+
+	// index of the last log covered by snapshot stored in local meta
+	keySnapshotIndex = []byte("SnapshotIndex")
+
+	// ErrSnapshotNotSupported defines snapshot operations with FSM not implementing Snapshotter
+	ErrSnapshotNotSupported = errors.New("snapshot not supported")
+	// ErrInvalidSnapshot defines invalid snapshot error
+	ErrInvalidSnapshot = errors.New("invalid snapshot")
+	// ErrShutdown defines operating on shutdown runner error
+	ErrShutdown = errors.New("runner is shutdown")
+)
+
+// Snapshotter is an FSM which can save and restore its state, which enables log compaction.
+type Snapshotter interface {
+	FSM
+
+	// Snapshot returns the serialized state of all the applied logs.
+	Snapshot() ([]byte, error)
+
+	// Restore replaces the state with the serialized state returned by Snapshot.
+	Restore(data []byte) error
+}
+
+// Snapshot is the persisted state of FSM as of a log.
+type Snapshot struct {
+	// Log is the last log covered by snapshot, it's kept to verify the hash of the next log
+	Log *Log
+
+	// Data is the serialized state of FSM
+	Data []byte
+}
+
+func (tpc *TwoPCConfig) snapshotDue(logs, bytes uint64) bool {
+	return (tpc.SnapshotThreshold > 0 && logs >= tpc.SnapshotThreshold) ||
+		(tpc.SnapshotThresholdBytes > 0 && bytes >= tpc.SnapshotThresholdBytes)
+}
+
+// Snapshot takes a snapshot of FSM as of the last applied log, then truncates the logs before it,
+// FSM must implement Snapshotter.
+//
+// The log at the snapshot index is kept, so the hash chain of logs can still be verified. Peers
+// lagging behind the truncated logs are caught up by the snapshot instead, see InstallSnapshot.
+// Snapshots are also taken automatically once the logs applied since the last snapshot reach
+// SnapshotThreshold or SnapshotThresholdBytes. Note that the underlying Storage is not covered by
+// snapshots, so log compaction should only be used if the state is handled by FSM.
+func (r *TwoPCRunner) Snapshot() error {
+	res := make(chan error, 1)
+
+	select {
+	case <-r.shutdownCh:
+		return ErrShutdown
+	case r.snapshotReq <- res:
+	}
+
+	select {
+	case <-r.shutdownCh:
+		return ErrShutdown
+	case err := <-res:
+		return err
+	}
+}
+
+// takeSnapshot persists the snapshot of FSM and compacts logs, it must be called in run routine.
+func (r *TwoPCRunner) takeSnapshot() (err error) {
+	s, ok := r.config.FSM.(Snapshotter)
+	if !ok {
+		return ErrSnapshotNotSupported
+	}
+
+	if r.lastApplied <= r.snapshotIndex {
+		// nothing new to snapshot
+		return
+	}
+
+	var l Log
+	if err = r.logStore.GetLog(r.lastApplied, &l); err != nil {
+		return
+	}
+
+	var data []byte
+	if data, err = s.Snapshot(); err != nil {
+		return
+	}
+
+	if err = r.saveSnapshot(&Snapshot{Log: &l, Data: data}); err != nil {
+		return
+	}
+
+	r.appliedSinceSnapshot, r.appliedBytesSinceSnapshot = 0, 0
+	r.compactLogs(l.Index)
+
+	return
+}
+
+// trySnapshot takes a snapshot if the thresholds are reached, failure is only logged since the
+// logs are kept.
+func (r *TwoPCRunner) trySnapshot() {
+	if !r.config.snapshotDue(r.appliedSinceSnapshot, r.appliedBytesSinceSnapshot) {
+		return
+	}
+
+	if err := r.takeSnapshot(); err != nil && err != ErrSnapshotNotSupported {
+		r.config.Logger.Warningf("take snapshot at %d failed: %s", r.lastApplied, err.Error())
+	}
+}
+
+// compactLogs deletes the logs before index.
+func (r *TwoPCRunner) compactLogs(index uint64) {
+	first, err := r.logStore.FirstIndex()
+
+	if err == nil && first > 0 && first < index {
+		err = r.logStore.DeleteRange(first, index-1)
+	}
+
+	if err != nil {
+		// truncated on next snapshot
+		r.config.Logger.Warningf("compact logs before %d failed: %s", index, err.Error())
+	}
+}
+
+func (r *TwoPCRunner) saveSnapshot(s *Snapshot) (err error) {
+	var data []byte
+	if data, err = r.config.logCodec().Encode(s); err != nil {
+		return
+	}
+
+	// the snapshot and its index are persisted together, see needsSnapshot
+	if err = r.stableStore.SetBatch(
+		map[string][]byte{string(keySnapshot): data},
+		map[string]uint64{string(keySnapshotIndex): s.Log.Index},
+	); err != nil {
+		return
+	}
+
+	r.snapshotIndex = s.Log.Index
+
+	return
+}
+
+// loadSnapshot returns the persisted snapshot, nil is returned if there is no snapshot.
+func (r *TwoPCRunner) loadSnapshot() (*Snapshot, error) {
+	data, err := r.stableStore.Get(keySnapshot)
+
+	if err == ErrKeyNotFound || (err == nil && len(data) == 0) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return r.decodeSnapshot(data)
+}
+
+func (r *TwoPCRunner) decodeSnapshot(data interface{}) (s *Snapshot, err error) {
+	var b []byte
+
+	switch v := data.(type) {
+	case []byte:
+		b = v
+	default:
+		// payload converted by transport, e.g. bytes to base64 string by jsonrpc
+		var j []byte
+		if j, err = json.Marshal(data); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(j, &b); err != nil {
+			return nil, ErrInvalidSnapshot
+		}
+	}
+
+	if err = r.config.logCodec().Decode(b, &s); err != nil || s == nil || s.Log == nil {
+		return nil, ErrInvalidSnapshot
+	}
+
+	return s, nil
+}
+
+// restoreSnapshot restores FSM from the persisted snapshot on restart, the committed logs after
+// the snapshot are replayed then.
+func (r *TwoPCRunner) restoreSnapshot() (err error) {
+	s, ok := r.config.FSM.(Snapshotter)
+	if !ok {
+		return
+	}
+
+	var snapshot *Snapshot
+	if snapshot, err = r.loadSnapshot(); err != nil || snapshot == nil {
+		return
+	}
+
+	if snapshot.Log.Index > r.lastLogIndex {
+		// installing snapshot is interrupted before committed, the previous state is kept
+		r.config.Logger.Warningf("ignore snapshot at %d beyond committed log %d",
+			snapshot.Log.Index, r.lastLogIndex)
+		return
+	}
+
+	if err = s.Restore(snapshot.Data); err != nil {
+		return
+	}
+
+	r.snapshotIndex = snapshot.Log.Index
+	r.lastApplied = snapshot.Log.Index
+
+	return
+}
+
+// needsSnapshot checks if the logs after matchIndex are truncated, so the peer must be caught up
+// by snapshot.
+func (r *TwoPCRunner) needsSnapshot(matchIndex uint64) bool {
+	index, err := r.stableStore.GetUint64(keySnapshotIndex)
+	return err == nil && matchIndex+1 < index
+}
+
+// sendSnapshot sends the persisted snapshot to peer, the last index committed on peer is acked
+// even on failure.
+func (r *TwoPCRunner) sendSnapshot(ctx context.Context, id proto.NodeID) (
+	learned uint64, acked bool, err error) {
+	var data []byte
+	if data, err = r.stableStore.Get(keySnapshot); err != nil {
+		return
+	}
+
+	res, err := r.requestPeer(ctx, id, "InstallSnapshot", data)
+	if index, derr := r.decodeLogIndex(res); derr == nil {
+		learned, acked = index, true
+		r.updateProgress(id, learned)
+	}
+
+	return
+}
+
+// processInstallSnapshot replaces the state of FSM and the local logs with the snapshot sent by
+// leader, it responds the last committed log index. FSM is restored first, so the local logs and
+// the committed index are kept if the snapshot can not be restored.
+func (r *TwoPCRunner) processInstallSnapshot(req Request) {
+	err := func() (err error) {
+		if r.role == Leader || r.getState() != Idle {
+			return ErrInvalidRequest
+		}
+
+		s, ok := r.config.FSM.(Snapshotter)
+		if !ok {
+			return ErrSnapshotNotSupported
+		}
+
+		var snapshot *Snapshot
+		if snapshot, err = r.decodeSnapshot(req.GetRequest()); err != nil {
+			return
+		}
+
+		if !snapshot.Log.VerifyHash() {
+			return ErrInvalidSnapshot
+		}
+
+		l := snapshot.Log
+
+		if l.Index <= r.lastLogIndex {
+			// already committed
+			return nil
+		}
+
+		if err = s.Restore(snapshot.Data); err != nil {
+			return
+		}
+
+		if err = r.saveSnapshot(snapshot); err != nil {
+			return
+		}
+
+		// the last log of snapshot becomes the committed head of local logs
+		if err = r.logStore.StoreLog(l); err != nil {
+			return
+		}
+
+		if err = r.stableStore.SetUint64(keyCommittedIndex, l.Index); err != nil {
+			return
+		}
+
+		r.lastLogHash = &l.Hash
+		r.lastLogIndex = l.Index
+		r.lastLogTerm = l.Term
+		r.compactLogs(l.Index)
+
+		r.lastApplied = l.Index
+		r.appliedSinceSnapshot, r.appliedBytesSinceSnapshot = 0, 0
+		r.publishApplied()
+
+		return r.stableStore.SetUint64(keyLastApplied, l.Index)
+	}()
+
+	req.SendResponse(r.lastLogIndex, err)
+}
@@ -0,0 +1,259 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kayak
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/thunderdb/ThunderDB/proto"
+)
+
+// snapshotFSM keeps the data of applied logs in memory, and supports snapshot.
+type snapshotFSM struct {
+	lock       sync.Mutex
+	data       []string
+	restored   int
+	restoreErr error
+}
+
+func (f *snapshotFSM) Apply(l *Log) (interface{}, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.data = append(f.data, string(l.Data))
+	return nil, nil
+}
+
+func (f *snapshotFSM) Snapshot() ([]byte, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return json.Marshal(f.data)
+}
+
+func (f *snapshotFSM) Restore(data []byte) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.restoreErr != nil {
+		return f.restoreErr
+	}
+
+	f.restored++
+	f.data = nil
+	return json.Unmarshal(data, &f.data)
+}
+
+func (f *snapshotFSM) getData() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]string(nil), f.data...)
+}
+
+func TestTwoPCRunner_Snapshot(t *testing.T) {
+	mockLogCodec := &MockLogCodec{}
+	mockRouter := &MockTransportRouter{
+		transports: make(map[proto.NodeID]*MockTransport),
+	}
+
+	type createMockRes struct {
+		runner *TwoPCRunner
+		config *TwoPCConfig
+		fsm    FSM
+		store  *MockInmemStore
+	}
+
+	createConfig := func(res *createMockRes, nodeID proto.NodeID) {
+		logger := log.New()
+		logger.SetLevel(log.FatalLevel)
+		res.runner = NewTwoPCRunner()
+		res.config = &TwoPCConfig{
+			RuntimeConfig: RuntimeConfig{
+				RootDir:        "test_dir",
+				LocalID:        nodeID,
+				Runner:         res.runner,
+				Transport:      mockRouter.getTransport(nodeID),
+				ProcessTimeout: time.Millisecond * 800,
+				Logger:         logger,
+			},
+			LogCodec:          mockLogCodec,
+			FSM:               res.fsm,
+			PrepareTimeout:    time.Millisecond * 200,
+			CommitTimeout:     time.Millisecond * 200,
+			RollbackTimeout:   time.Millisecond * 200,
+			SnapshotThreshold: 3,
+		}
+	}
+	createMock := func(nodeID proto.NodeID) (res *createMockRes) {
+		res = &createMockRes{
+			fsm:   &snapshotFSM{},
+			store: NewMockInmemStore(),
+		}
+		createConfig(res, nodeID)
+		return
+	}
+	servers := []*Server{
+		{
+			Role: Leader,
+			ID:   "leader",
+		},
+		{
+			Role: Follower,
+			ID:   "follower",
+		},
+	}
+	peers := testPeersFixture(1, servers)
+
+	Convey("snapshot and log compaction", t, func() {
+		mockRouter.ResetAll()
+
+		lMock := createMock("leader")
+		fMock := createMock("follower")
+		mocks := []*createMockRes{lMock, fMock}
+
+		for _, r := range mocks {
+			err := r.runner.Init(r.config, peers, r.store, r.store, r.config.Transport)
+			So(err, ShouldBeNil)
+		}
+
+		defer func() {
+			for _, r := range mocks {
+				r.runner.Shutdown(true)
+			}
+		}()
+
+		apply := func(from, to int) {
+			for i := from; i <= to; i++ {
+				testData, _ := mockLogCodec.Encode(fmt.Sprintf("test data %d", i))
+				So(lMock.runner.Apply(testData), ShouldBeNil)
+			}
+		}
+
+		apply(1, 7)
+
+		// snapshot is taken every 3 logs, the log at snapshot index is kept
+		for _, r := range mocks {
+			So(r.runner.Stats().SnapshotIndex, ShouldEqual, uint64(6))
+			So(r.store.kvInt[string(keySnapshotIndex)], ShouldEqual, uint64(6))
+
+			first, _ := r.store.FirstIndex()
+			last, _ := r.store.LastIndex()
+			So(first, ShouldEqual, uint64(6))
+			So(last, ShouldEqual, uint64(7))
+		}
+
+		Convey("manual snapshot", func() {
+			So(lMock.runner.Snapshot(), ShouldBeNil)
+			So(lMock.runner.Stats().SnapshotIndex, ShouldEqual, uint64(7))
+
+			first, _ := lMock.store.FirstIndex()
+			So(first, ShouldEqual, uint64(7))
+
+			// nothing new to snapshot
+			So(lMock.runner.Snapshot(), ShouldBeNil)
+			So(lMock.runner.Stats().SnapshotIndex, ShouldEqual, uint64(7))
+
+			// logs are still committed after compaction
+			apply(8, 8)
+			So(fMock.runner.lastLogIndex, ShouldEqual, uint64(8))
+		})
+
+		Convey("state is restored from snapshot on restart", func() {
+			expected := fMock.fsm.(*snapshotFSM).getData()
+			So(expected, ShouldHaveLength, 7)
+			So(fMock.runner.Shutdown(true), ShouldBeNil)
+
+			// restart with the same stores and an empty fsm
+			fsm := &snapshotFSM{}
+			fMock.fsm = fsm
+			createConfig(fMock, "follower")
+			So(fMock.runner.Init(fMock.config, peers, fMock.store, fMock.store,
+				fMock.config.Transport), ShouldBeNil)
+			So(fsm.restored, ShouldEqual, 1)
+			So(fsm.getData(), ShouldResemble, expected)
+
+			apply(8, 8)
+			So(fsm.getData(), ShouldResemble, lMock.fsm.(*snapshotFSM).getData())
+		})
+
+		Convey("lagging learner is caught up by snapshot", func() {
+			lnMock := createMock("learner")
+			newPeers := testPeersFixture(2, append(servers, &Server{
+				Role: Learner,
+				ID:   "learner",
+			}))
+			So(lnMock.runner.Init(lnMock.config, newPeers, lnMock.store, lnMock.store,
+				lnMock.config.Transport), ShouldBeNil)
+			mocks = append(mocks, lnMock)
+			So(lMock.runner.UpdatePeers(newPeers), ShouldBeNil)
+
+			apply(8, 8)
+			So(waitLearned(lMock.runner, "learner", 8), ShouldBeTrue)
+
+			fsm := lnMock.fsm.(*snapshotFSM)
+			So(fsm.restored, ShouldEqual, 1)
+			So(fsm.getData(), ShouldResemble, lMock.fsm.(*snapshotFSM).getData())
+			So(lnMock.runner.lastLogHash.IsEqual(lMock.runner.lastLogHash), ShouldBeTrue)
+			So(lnMock.store.kvInt[string(keySnapshotIndex)], ShouldEqual, uint64(6))
+
+			// truncated logs are not sent
+			_, ok := lnMock.store.logs[5]
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("snapshot is not installed if restore fails", func() {
+			lnMock := createMock("learner")
+			restoreErr := errors.New("restore failed")
+			lnMock.fsm.(*snapshotFSM).restoreErr = restoreErr
+			So(lnMock.runner.Init(lnMock.config, testPeersFixture(2, append(servers, &Server{
+				Role: Learner,
+				ID:   "learner",
+			})), lnMock.store, lnMock.store, lnMock.config.Transport), ShouldBeNil)
+			mocks = append(mocks, lnMock)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			learned, acked, err := lMock.runner.sendSnapshot(ctx, "learner")
+			So(err, ShouldEqual, restoreErr)
+			So(acked, ShouldBeTrue)
+			So(learned, ShouldEqual, uint64(0))
+
+			// local logs and meta are kept
+			So(lnMock.runner.lastLogIndex, ShouldEqual, uint64(0))
+			So(lnMock.store.kvInt[string(keyCommittedIndex)], ShouldEqual, uint64(0))
+			So(lnMock.store.kvInt[string(keySnapshotIndex)], ShouldEqual, uint64(0))
+			So(lnMock.store.kv[string(keySnapshot)], ShouldBeEmpty)
+			_, ok := lnMock.store.logs[6]
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("snapshot is not supported without snapshotter", func() {
+			fMock.runner.config.FSM = &recordFSM{}
+			So(fMock.runner.Snapshot(), ShouldEqual, ErrSnapshotNotSupported)
+			fMock.runner.Shutdown(true)
+			So(fMock.runner.Snapshot(), ShouldEqual, ErrShutdown)
+		})
+	})
+}
@@ -0,0 +1,185 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the “License”);
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an “AS IS” BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kayak
+
+import (
+	"context"
+	"time"
+
+	"github.com/thunderdb/ThunderDB/proto"
+)
+
+// PeerStats defines the replication progress of a peer tracked by leader.
+type PeerStats struct {
+	// Role is the role of peer in current configuration
+	Role ServerRole
+	// MatchIndex is the last log index known to be committed on peer
+	MatchIndex uint64
+	// NextIndex is the next log index to send to peer
+	NextIndex uint64
+	// LastContact is the time of last successful request to peer, zero if never contacted
+	LastContact time.Time
+	// SinceLastContact is the duration since LastContact, zero if never contacted
+	SinceLastContact time.Duration
+	// Inflight is the count of committed logs queued to learner but not acked
+	Inflight int
+	// InflightBytes is the data size of committed logs queued to learner but not acked
+	InflightBytes int
+	// Latency is the round trip time of the last successful replication request to peer
+	Latency time.Duration
+}
+
+// RunnerStats defines the replication state snapshot of a runner.
+type RunnerStats struct {
+	// Term is the current term
+	Term uint64
+	// Leader is the leader of current term
+	Leader proto.NodeID
+	// CommitIndex is the last committed log index
+	CommitIndex uint64
+	// LastApplied is the last log index applied to storage, or to FSM if it's set
+	LastApplied uint64
+	// ApplyLag is the count of committed logs not applied to FSM yet
+	ApplyLag uint64
+	// SnapshotIndex is the last log index covered by snapshot, zero if no snapshot is taken
+	SnapshotIndex uint64
+	// ReadOnly indicates leader rejects writes since quorum is lost, see SetReadOnlyOnQuorumLoss
+	ReadOnly bool
+	// LeaderChanges is the count of leader changes by new peers configurations since start
+	LeaderChanges uint64
+	// Proposals is the count of logs committed by Apply on this server as leader
+	Proposals uint64
+	// ProposalFailures is the count of logs failed to commit by Apply on this server as leader
+	ProposalFailures uint64
+	// ProposalRate is the count of logs committed by Apply per second in the last 10 seconds
+	ProposalRate float64
+	// Peers is the replication progress of other peers, only available on leader
+	Peers map[proto.NodeID]*PeerStats
+}
+
+// peerProgress is the replication progress of a peer updated by leader.
+type peerProgress struct {
+	matchIndex  uint64
+	lastContact time.Time
+	latency     time.Duration
+}
+
+// Stats returns the replication state of runner, nil is returned if runner is shutdown.
+func (r *TwoPCRunner) Stats() *RunnerStats {
+	stats, _ := r.statsContext(context.Background())
+	return stats
+}
+
+// statsContext is Stats which can be canceled while the run routine is busy.
+func (r *TwoPCRunner) statsContext(ctx context.Context) (*RunnerStats, error) {
+	res := make(chan *RunnerStats, 1)
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-r.shutdownCh:
+		return nil, ErrShutdown
+	case r.statsReq <- res:
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-r.shutdownCh:
+		return nil, ErrShutdown
+	case stats := <-res:
+		return stats, nil
+	}
+}
+
+// processStats collects stats snapshot, it must be called in run routine.
+func (r *TwoPCRunner) processStats(res chan *RunnerStats) {
+	stats := &RunnerStats{
+		Term: r.currentTerm,
+		// logs are applied to storage on commit
+		CommitIndex:      r.lastLogIndex,
+		LastApplied:      r.lastLogIndex - r.applyLag(),
+		ApplyLag:         r.applyLag(),
+		SnapshotIndex:    r.snapshotIndex,
+		ReadOnly:         r.isReadOnly(),
+		LeaderChanges:    r.leaderChanges,
+		Proposals:        r.proposals,
+		ProposalFailures: r.proposalFailures,
+	}
+
+	if r.leader != nil {
+		stats.Leader = r.leader.ID
+	}
+
+	now := r.config.clock().Now()
+	stats.ProposalRate = r.proposalRate.rate(now)
+
+	if r.role == Leader {
+		stats.Peers = make(map[proto.NodeID]*PeerStats)
+
+		r.progressLock.Lock()
+		for _, s := range r.peers.Servers {
+			if s.ID == r.config.LocalID {
+				continue
+			}
+
+			ps := &PeerStats{
+				Role: s.Role,
+			}
+
+			if p, ok := r.progress[s.ID]; ok {
+				ps.MatchIndex = p.matchIndex
+				ps.LastContact = p.lastContact
+				ps.SinceLastContact = now.Sub(p.lastContact)
+				ps.Latency = p.latency
+			}
+
+			if lr, ok := r.learners[s.ID]; ok {
+				ps.Inflight, ps.InflightBytes = lr.getInflight()
+			}
+
+			ps.NextIndex = ps.MatchIndex + 1
+			stats.Peers[s.ID] = ps
+		}
+		r.progressLock.Unlock()
+	}
+
+	res <- stats
+}
+
+// updateProgress records successful contact with peer, and the log index committed on peer if
+// matchIndex is not zero.
+func (r *TwoPCRunner) updateProgress(id proto.NodeID, matchIndex uint64) {
+	r.progressLock.Lock()
+	defer r.progressLock.Unlock()
+
+	p := r.getProgress(id)
+	p.lastContact = r.config.clock().Now()
+	if matchIndex > p.matchIndex {
+		p.matchIndex = matchIndex
+	}
+}
+
+// getProgress returns the progress of peer, it must be called with progressLock held.
+func (r *TwoPCRunner) getProgress(id proto.NodeID) *peerProgress {
+	p, ok := r.progress[id]
+	if !ok {
+		p = &peerProgress{}
+		r.progress[id] = p
+	}
+	return p
+}
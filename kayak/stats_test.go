@@ -0,0 +1,144 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the “License”);
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an “AS IS” BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kayak
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/stretchr/testify/mock"
+	"github.com/thunderdb/ThunderDB/proto"
+)
+
+func TestTwoPCRunner_Stats(t *testing.T) {
+	mockLogCodec := &MockLogCodec{}
+	mockRouter := &MockTransportRouter{
+		transports: make(map[proto.NodeID]*MockTransport),
+	}
+
+	type createMockRes struct {
+		runner *TwoPCRunner
+		config *TwoPCConfig
+		worker *MockWorker
+		store  *MockInmemStore
+	}
+
+	createMock := func(nodeID proto.NodeID) (res *createMockRes) {
+		res = &createMockRes{}
+		logger := log.New()
+		logger.SetLevel(log.FatalLevel)
+		res.runner = NewTwoPCRunner()
+		res.worker = &MockWorker{}
+		res.store = NewMockInmemStore()
+		res.config = &TwoPCConfig{
+			RuntimeConfig: RuntimeConfig{
+				RootDir:        "test_dir",
+				LocalID:        nodeID,
+				Runner:         res.runner,
+				Transport:      mockRouter.getTransport(nodeID),
+				ProcessTimeout: time.Millisecond * 800,
+				Logger:         logger,
+			},
+			LogCodec:        mockLogCodec,
+			Storage:         res.worker,
+			PrepareTimeout:  time.Millisecond * 200,
+			CommitTimeout:   time.Millisecond * 200,
+			RollbackTimeout: time.Millisecond * 200,
+		}
+		return
+	}
+	peers := testPeersFixture(1, []*Server{
+		{
+			Role: Leader,
+			ID:   "leader",
+		},
+		{
+			Role: Follower,
+			ID:   "healthy",
+		},
+		{
+			Role: Follower,
+			ID:   "lagging",
+		},
+	})
+
+	Convey("replication stats", t, func() {
+		mockRouter.ResetAll()
+
+		lMock := createMock("leader")
+		hMock := createMock("healthy")
+		fMock := createMock("lagging")
+		mocks := []*createMockRes{lMock, hMock, fMock}
+
+		for _, r := range mocks {
+			err := r.runner.Init(r.config, peers, r.store, r.store, r.config.Transport)
+			So(err, ShouldBeNil)
+			r.worker.On("Prepare", mock.Anything, "test data").Return(nil)
+		}
+
+		defer func() {
+			for _, r := range mocks {
+				r.runner.Shutdown(true)
+			}
+		}()
+
+		lMock.worker.On("Commit", mock.Anything, "test data").Return(nil)
+		hMock.worker.On("Commit", mock.Anything, "test data").Return(nil)
+		fMock.worker.On("Commit", mock.Anything, "test data").Return(nil).Once()
+		fMock.worker.On("Commit", mock.Anything, "test data").Return(errors.New("commit failed"))
+
+		stats := lMock.runner.Stats()
+		So(stats.Term, ShouldEqual, uint64(1))
+		So(stats.CommitIndex, ShouldEqual, uint64(0))
+		So(stats.Peers, ShouldHaveLength, 2)
+		So(stats.Peers[proto.NodeID("lagging")].NextIndex, ShouldEqual, uint64(1))
+		So(stats.Peers[proto.NodeID("lagging")].LastContact.IsZero(), ShouldBeTrue)
+
+		testData, _ := mockLogCodec.Encode("test data")
+		So(lMock.runner.Apply(testData), ShouldBeNil)
+		So(lMock.runner.Apply(testData), ShouldBeNil)
+
+		stats = lMock.runner.Stats()
+		So(stats.Term, ShouldEqual, uint64(1))
+		So(stats.CommitIndex, ShouldEqual, uint64(2))
+		So(stats.LastApplied, ShouldEqual, uint64(2))
+
+		healthy := stats.Peers[proto.NodeID("healthy")]
+		So(healthy.Role, ShouldEqual, Follower)
+		So(healthy.MatchIndex, ShouldEqual, stats.CommitIndex)
+		So(healthy.NextIndex, ShouldEqual, uint64(3))
+		So(healthy.LastContact.IsZero(), ShouldBeFalse)
+		So(healthy.SinceLastContact, ShouldBeLessThan, lMock.config.ProcessTimeout)
+
+		lagging := stats.Peers[proto.NodeID("lagging")]
+		So(lagging.MatchIndex, ShouldEqual, uint64(1))
+		So(lagging.MatchIndex, ShouldBeLessThan, stats.CommitIndex)
+		So(lagging.NextIndex, ShouldEqual, uint64(2))
+
+		// followers report no peer progress
+		stats = hMock.runner.Stats()
+		So(stats.CommitIndex, ShouldEqual, uint64(2))
+		So(stats.Peers, ShouldBeNil)
+
+		// shutdown runner reports nothing
+		fMock.runner.Shutdown(true)
+		So(fMock.runner.Stats(), ShouldBeNil)
+	})
+}
@@ -0,0 +1,138 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the “License”);
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an “AS IS” BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package transport
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/thunderdb/ThunderDB/proto"
+)
+
+// DefaultDedupTTL is the default duration to keep the response of a request with token.
+const DefaultDedupTTL = time.Minute
+
+type tokenKey struct{}
+
+// WithRequestToken returns a context carrying the idempotency token of a request. If a request is
+// sent with a token by Transport.Request, a retried request with the same token from the same
+// node returns the response of the original one instead of being processed again, as long as
+// the original response is cached, see Config.DedupTTL. Only successful responses are cached, a
+// retry of the failed request is processed again, while the duplicated requests in flight along
+// with the failed one share its error.
+func WithRequestToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, tokenKey{}, token)
+}
+
+// RequestTokenFromContext returns the idempotency token carried by ctx.
+func RequestTokenFromContext(ctx context.Context) (token string, ok bool) {
+	token, ok = ctx.Value(tokenKey{}).(string)
+	return
+}
+
+type dedupKey struct {
+	nodeID proto.NodeID
+	token  string
+}
+
+// dedupEntry is the result of an in-flight or processed request.
+type dedupEntry struct {
+	key      dedupKey
+	done     chan struct{}
+	response interface{}
+	err      error
+	expire   time.Time
+}
+
+// dedupCache caches the results of requests by their tokens.
+type dedupCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[dedupKey]*dedupEntry
+}
+
+func newDedupCache(ttl time.Duration) *dedupCache {
+	if ttl <= 0 {
+		ttl = DefaultDedupTTL
+	}
+
+	return &dedupCache{
+		ttl:     ttl,
+		entries: make(map[dedupKey]*dedupEntry),
+	}
+}
+
+// acquire returns the entry of the request, and whether the caller owns it and must process the
+// request and call release with the result.
+func (c *dedupCache) acquire(nodeID proto.NodeID, token string) (e *dedupEntry, owner bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.purge(now)
+
+	key := dedupKey{nodeID: nodeID, token: token}
+
+	if e = c.entries[key]; e != nil {
+		return e, false
+	}
+
+	e = &dedupEntry{
+		key:  key,
+		done: make(chan struct{}),
+	}
+	c.entries[key] = e
+
+	return e, true
+}
+
+// release saves the result of the request processed by the entry owner, the entry is removed on
+// error so that the retry is processed again.
+func (c *dedupCache) release(e *dedupEntry, response interface{}, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e.response = response
+	e.err = err
+	e.expire = time.Now().Add(c.ttl)
+	close(e.done)
+
+	if err != nil {
+		delete(c.entries, e.key)
+	}
+}
+
+// purge removes the expired entries, it must be called with lock held.
+func (c *dedupCache) purge(now time.Time) {
+	for key, e := range c.entries {
+		select {
+		case <-e.done:
+			if now.After(e.expire) {
+				delete(c.entries, key)
+			}
+		default:
+		}
+	}
+}
+
+func (c *dedupCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
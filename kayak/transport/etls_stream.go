@@ -0,0 +1,309 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the “License”);
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an “AS IS” BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package transport
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/thunderdb/ThunderDB/crypto/asymmetric"
+	"github.com/thunderdb/ThunderDB/crypto/etls"
+	"github.com/thunderdb/ThunderDB/crypto/kms"
+	"github.com/thunderdb/ThunderDB/proto"
+)
+
+const (
+	// DefaultHandshakeTimeout is the default timeout of handshake on accepted connections
+	DefaultHandshakeTimeout = 5 * time.Second
+	// maxNodeIDLength is the max length of node id in handshake header
+	maxNodeIDLength = 255
+	// handshakeNonceLength is the length of the random nonces exchanged in handshake
+	handshakeNonceLength = 32
+	// acceptRetryDelay is the delay before accepting again on temporary listener error
+	acceptRetryDelay = 10 * time.Millisecond
+)
+
+var (
+	// ErrInvalidHandshake defines invalid handshake header error
+	ErrInvalidHandshake = errors.New("invalid handshake")
+	// ErrNoNodeAddr defines node address not found in kms error
+	ErrNoNodeAddr = errors.New("node address not found")
+
+	// handshakeInfo is the HKDF context of session keys
+	handshakeInfo = []byte("kayak etls stream")
+)
+
+// ETLSStream is a StreamLayer built on etls encrypted connections. The address and public key of
+// remote peers are resolved from kms public key store.
+//
+// The dialer sends its node id and a random nonce in plain text as handshake header, and the
+// accepting side replies with its own random nonce. Both sides encrypt the stream with the key
+// derived from the ECDH shared secret of the local private key and the peer public key, salted
+// with both nonces. So a peer claiming another node id can not talk to the remote side, and a
+// recorded stream can not be replayed into a new connection.
+//
+// Handshakes of accepted connections run concurrently, so a silent client does not block the
+// others.
+type ETLSStream struct {
+	nodeID     proto.NodeID
+	privateKey *asymmetric.PrivateKey
+	listener   net.Listener
+
+	serveOnce sync.Once
+	conns     chan *ETLSConn
+	closeOnce sync.Once
+	closeCh   chan struct{}
+
+	// HandshakeTimeout is the timeout of handshake on accepted connections, it should be set
+	// before the first Accept
+	HandshakeTimeout time.Duration
+}
+
+// ETLSConn is an etls connection with the remote peer node id.
+type ETLSConn struct {
+	*etls.CryptoConn
+	peerNodeID proto.NodeID
+}
+
+// NewETLSStream returns a new etls stream layer of node listening on addr, kms.GetLocalPrivateKey
+// is used if privateKey is nil.
+func NewETLSStream(nodeID proto.NodeID, privateKey *asymmetric.PrivateKey, addr string) (
+	s *ETLSStream, err error) {
+	if privateKey == nil {
+		if privateKey, err = kms.GetLocalPrivateKey(); err != nil {
+			return
+		}
+	}
+
+	s = &ETLSStream{
+		nodeID:           nodeID,
+		privateKey:       privateKey,
+		conns:            make(chan *ETLSConn),
+		closeCh:          make(chan struct{}),
+		HandshakeTimeout: DefaultHandshakeTimeout,
+	}
+
+	if s.listener, err = net.Listen("tcp", addr); err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+// Addr returns the listening address of stream.
+func (s *ETLSStream) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Close stops listening, blocked Accept will be unblocked and return ErrStreamClosed.
+func (s *ETLSStream) Close() (err error) {
+	s.closeOnce.Do(func() {
+		close(s.closeCh)
+		err = s.listener.Close()
+	})
+	return
+}
+
+// Accept implements StreamLayer.Accept.
+func (s *ETLSStream) Accept() (conn ConnWithPeerNodeID, err error) {
+	s.serveOnce.Do(func() {
+		go s.serve()
+	})
+
+	select {
+	case <-s.closeCh:
+		return nil, ErrStreamClosed
+	case c := <-s.conns:
+		return c, nil
+	}
+}
+
+// serve accepts connections and runs their handshakes concurrently until stream is closed.
+func (s *ETLSStream) serve() {
+	for {
+		c, err := s.listener.Accept()
+		if err != nil {
+			select {
+			case <-s.closeCh:
+				return
+			default:
+			}
+
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(acceptRetryDelay)
+				continue
+			}
+
+			// listener is broken
+			s.Close()
+			return
+		}
+
+		go s.accept(c)
+	}
+}
+
+// accept runs handshake on the accepted connection and hands it off to Accept.
+func (s *ETLSStream) accept(c net.Conn) {
+	conn, err := s.handshake(c)
+	if err != nil {
+		c.Close()
+		return
+	}
+
+	select {
+	case <-s.closeCh:
+		c.Close()
+	case s.conns <- conn:
+	}
+}
+
+// Dial implements StreamLayer.Dial.
+func (s *ETLSStream) Dial(ctx context.Context, nodeID proto.NodeID) (conn ConnWithPeerNodeID, err error) {
+	if len(s.nodeID) > maxNodeIDLength {
+		return nil, ErrInvalidHandshake
+	}
+
+	var node *proto.Node
+	if node, err = kms.GetNodeInfo(nodeID); err != nil {
+		return
+	}
+
+	if node.Addr == "" {
+		return nil, ErrNoNodeAddr
+	}
+
+	var dialer net.Dialer
+	var c net.Conn
+	if c, err = dialer.DialContext(ctx, "tcp", node.Addr); err != nil {
+		return
+	}
+
+	if conn, err = s.dialHandshake(ctx, c, nodeID, node.PublicKey); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return
+}
+
+func (s *ETLSStream) dialHandshake(ctx context.Context, c net.Conn, nodeID proto.NodeID,
+	publicKey *asymmetric.PublicKey) (conn *ETLSConn, err error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+
+	// send local node id and nonce
+	localNonce := make([]byte, handshakeNonceLength)
+	if _, err = rand.Read(localNonce); err != nil {
+		return
+	}
+
+	header := append([]byte{byte(len(s.nodeID))}, s.nodeID...)
+	header = append(header, localNonce...)
+	if _, err = c.Write(header); err != nil {
+		return
+	}
+
+	// read remote nonce
+	remoteNonce := make([]byte, handshakeNonceLength)
+	if _, err = io.ReadFull(c, remoteNonce); err != nil {
+		return
+	}
+
+	c.SetDeadline(time.Time{})
+
+	return s.newConn(c, nodeID, publicKey, localNonce, remoteNonce)
+}
+
+func (s *ETLSStream) handshake(c net.Conn) (conn *ETLSConn, err error) {
+	c.SetDeadline(time.Now().Add(s.HandshakeTimeout))
+
+	// read remote node id and nonce
+	var length [1]byte
+	if _, err = io.ReadFull(c, length[:]); err != nil {
+		return
+	}
+	if length[0] == 0 {
+		return nil, ErrInvalidHandshake
+	}
+
+	rawNodeID := make([]byte, length[0])
+	if _, err = io.ReadFull(c, rawNodeID); err != nil {
+		return
+	}
+
+	remoteNonce := make([]byte, handshakeNonceLength)
+	if _, err = io.ReadFull(c, remoteNonce); err != nil {
+		return
+	}
+
+	nodeID := proto.NodeID(rawNodeID)
+
+	var publicKey *asymmetric.PublicKey
+	if publicKey, err = kms.GetPublicKey(nodeID); err != nil {
+		return
+	}
+
+	// reply local nonce
+	localNonce := make([]byte, handshakeNonceLength)
+	if _, err = rand.Read(localNonce); err != nil {
+		return
+	}
+	if _, err = c.Write(localNonce); err != nil {
+		return
+	}
+
+	c.SetDeadline(time.Time{})
+
+	return s.newConn(c, nodeID, publicKey, remoteNonce, localNonce)
+}
+
+// newConn returns the etls connection keyed by the shared secret with peer, salted with the
+// nonces of dialer and accepting side.
+func (s *ETLSStream) newConn(c net.Conn, peerNodeID proto.NodeID, peerPublicKey *asymmetric.PublicKey,
+	dialNonce []byte, acceptNonce []byte) (conn *ETLSConn, err error) {
+	var cipher *etls.Cipher
+	if cipher, err = etls.NewCipherWithOptions(asymmetric.GenECDHSharedSecret(s.privateKey, peerPublicKey),
+		&etls.CipherOptions{
+			KDF:  etls.KDFHKDF,
+			Salt: append(append([]byte(nil), dialNonce...), acceptNonce...),
+			Info: handshakeInfo,
+		}); err != nil {
+		return
+	}
+
+	return &ETLSConn{
+		CryptoConn: etls.NewConn(c, cipher, nil),
+		peerNodeID: peerNodeID,
+	}, nil
+}
+
+// GetPeerNodeID implements ConnWithPeerNodeID.GetPeerNodeID.
+func (c *ETLSConn) GetPeerNodeID() proto.NodeID {
+	return c.peerNodeID
+}
+
+var (
+	_ StreamLayer        = &ETLSStream{}
+	_ ConnWithPeerNodeID = &ETLSConn{}
+)
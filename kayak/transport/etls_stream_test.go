@@ -0,0 +1,361 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the “License”);
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an “AS IS” BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package transport
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/stretchr/testify/mock"
+	"github.com/thunderdb/ThunderDB/crypto/asymmetric"
+	"github.com/thunderdb/ThunderDB/crypto/kms"
+	"github.com/thunderdb/ThunderDB/kayak"
+	"github.com/thunderdb/ThunderDB/proto"
+)
+
+func TestETLSStream(t *testing.T) {
+	type createMockRes struct {
+		stream    *ETLSStream
+		runner    *kayak.TwoPCRunner
+		transport *Transport
+		worker    *MockWorker
+		config    *kayak.TwoPCConfig
+		runtime   *kayak.Runtime
+	}
+
+	mockLogCodec := &MockLogCodec{}
+
+	peers := testPeersFixture(1, []*kayak.Server{
+		{
+			Role: kayak.Leader,
+			ID:   "leader",
+		},
+		{
+			Role: kayak.Follower,
+			ID:   "follower1",
+		},
+		{
+			Role: kayak.Follower,
+			ID:   "follower2",
+		},
+	})
+
+	Convey("kayak over etls stream", t, func() {
+		d, err := ioutil.TempDir("", "kayak_etls_test")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(d)
+
+		kms.Unittest = true
+		err = kms.InitPublicKeyStore(filepath.Join(d, "public.keystore"), nil)
+		So(err, ShouldBeNil)
+		kms.ResetBucket()
+
+		// createMock starts a node listening on loopback and registers it in kms
+		createMock := func(nodeID proto.NodeID) (res *createMockRes) {
+			res = &createMockRes{}
+			logger := log.New()
+			logger.SetLevel(log.FatalLevel)
+
+			privateKey, publicKey, err := asymmetric.GenSecp256k1KeyPair()
+			So(err, ShouldBeNil)
+			res.stream, err = NewETLSStream(nodeID, privateKey, "127.0.0.1:0")
+			So(err, ShouldBeNil)
+			err = kms.SetNode(&proto.Node{
+				ID:        nodeID,
+				Addr:      res.stream.Addr().String(),
+				PublicKey: publicKey,
+			})
+			So(err, ShouldBeNil)
+
+			res.runner = kayak.NewTwoPCRunner()
+			res.transport = NewTransport(NewConfig(nodeID, res.stream))
+			res.worker = &MockWorker{}
+			res.config = &kayak.TwoPCConfig{
+				RuntimeConfig: kayak.RuntimeConfig{
+					RootDir:        filepath.Join(d, string(nodeID)),
+					LocalID:        nodeID,
+					Runner:         res.runner,
+					Transport:      res.transport,
+					ProcessTimeout: time.Second * 5,
+					Logger:         logger,
+				},
+				LogCodec:        mockLogCodec,
+				Storage:         res.worker,
+				PrepareTimeout:  time.Second,
+				CommitTimeout:   time.Second,
+				RollbackTimeout: time.Second,
+			}
+			os.MkdirAll(res.config.RootDir, 0755)
+			res.runtime, err = kayak.NewRuntime(res.config, peers)
+			So(err, ShouldBeNil)
+			return
+		}
+
+		lMock := createMock("leader")
+		f1Mock := createMock("follower1")
+		f2Mock := createMock("follower2")
+		mocks := []*createMockRes{lMock, f1Mock, f2Mock}
+
+		for _, r := range mocks {
+			So(r.runtime.Init(), ShouldBeNil)
+		}
+
+		defer func() {
+			for _, r := range mocks {
+				r.runtime.Shutdown()
+				r.transport.Close()
+				r.stream.Close()
+			}
+		}()
+
+		Convey("replicate logs", func() {
+			testPayload := "test data"
+			testData, _ := mockLogCodec.Encode(testPayload)
+
+			callOrder := &CallCollector{}
+			for _, r := range []*createMockRes{f1Mock, f2Mock} {
+				r.worker.On("Prepare", mock.Anything, testPayload).
+					Return(nil).Run(func(args mock.Arguments) {
+					callOrder.Append("f_prepare")
+				})
+				r.worker.On("Commit", mock.Anything, testPayload).
+					Return(nil).Run(func(args mock.Arguments) {
+					callOrder.Append("f_commit")
+				})
+			}
+			lMock.worker.On("Prepare", mock.Anything, testPayload).
+				Return(nil).Run(func(args mock.Arguments) {
+				callOrder.Append("l_prepare")
+			})
+			lMock.worker.On("Commit", mock.Anything, testPayload).
+				Return(nil).Run(func(args mock.Arguments) {
+				callOrder.Append("l_commit")
+			})
+
+			for i := 0; i < 2; i++ {
+				callOrder.Reset()
+				So(lMock.runtime.Apply(testData), ShouldBeNil)
+				So(callOrder.Get(), ShouldResemble, []string{
+					"f_prepare",
+					"f_prepare",
+					"l_prepare",
+					"f_commit",
+					"f_commit",
+					"l_commit",
+				})
+			}
+
+			for _, r := range mocks {
+				So(r.runner.Stats().CommitIndex, ShouldEqual, uint64(2))
+			}
+		})
+
+		Convey("reject unknown or impersonating peer", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			// unknown node
+			_, err := lMock.transport.Request(ctx, "unknown", "Commit", 1)
+			So(err, ShouldNotBeNil)
+
+			// node claiming to be follower1 without its private key
+			privateKey, _, err := asymmetric.GenSecp256k1KeyPair()
+			So(err, ShouldBeNil)
+			stream, err := NewETLSStream("follower1", privateKey, "127.0.0.1:0")
+			So(err, ShouldBeNil)
+			defer stream.Close()
+			impostor := NewTransport(NewConfig("follower1", stream))
+			defer impostor.Close()
+
+			_, err = impostor.Request(ctx, "follower2", "Commit", 1)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+// recordProxy forwards connections to target, and records the data sent by clients.
+type recordProxy struct {
+	listener net.Listener
+	target   string
+
+	lock     sync.Mutex
+	recorded []byte
+}
+
+func newRecordProxy(target string) (p *recordProxy, err error) {
+	p = &recordProxy{target: target}
+	if p.listener, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for {
+			c, err := p.listener.Accept()
+			if err != nil {
+				return
+			}
+			go p.forward(c)
+		}
+	}()
+
+	return
+}
+
+func (p *recordProxy) forward(c net.Conn) {
+	defer c.Close()
+	t, err := net.Dial("tcp", p.target)
+	if err != nil {
+		return
+	}
+	defer t.Close()
+
+	go io.Copy(c, t)
+
+	buf := make([]byte, 4096)
+	for {
+		n, err := c.Read(buf)
+		if n > 0 {
+			p.lock.Lock()
+			p.recorded = append(p.recorded, buf[:n]...)
+			p.lock.Unlock()
+			t.Write(buf[:n])
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (p *recordProxy) getRecorded() []byte {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return append([]byte(nil), p.recorded...)
+}
+
+func TestETLSStream_Handshake(t *testing.T) {
+	// key store is shared by the handshakes still running from the previous cases
+	d, err := ioutil.TempDir("", "kayak_etls_test")
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+	defer os.RemoveAll(d)
+
+	kms.Unittest = true
+	if err = kms.InitPublicKeyStore(filepath.Join(d, "public.keystore"), nil); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+	kms.ResetBucket()
+
+	Convey("etls stream handshake", t, func() {
+		createStream := func(nodeID proto.NodeID) *ETLSStream {
+			privateKey, publicKey, err := asymmetric.GenSecp256k1KeyPair()
+			So(err, ShouldBeNil)
+			stream, err := NewETLSStream(nodeID, privateKey, "127.0.0.1:0")
+			So(err, ShouldBeNil)
+			err = kms.SetNode(&proto.Node{
+				ID:        nodeID,
+				Addr:      stream.Addr().String(),
+				PublicKey: publicKey,
+			})
+			So(err, ShouldBeNil)
+			return stream
+		}
+
+		serverStream := createStream("server")
+		clientStream := createStream("client")
+		server := NewTransport(NewConfig("server", serverStream))
+		client := NewTransport(NewConfig("client", clientStream))
+
+		var (
+			lock     sync.Mutex
+			requests int
+		)
+		go func() {
+			for req := range server.Process() {
+				lock.Lock()
+				requests++
+				lock.Unlock()
+				req.SendResponse(nil, nil)
+			}
+		}()
+		getRequests := func() int {
+			lock.Lock()
+			defer lock.Unlock()
+			return requests
+		}
+
+		defer func() {
+			client.Close()
+			server.Close()
+			clientStream.Close()
+			serverStream.Close()
+		}()
+
+		Convey("silent client does not block other connections", func() {
+			silent, err := net.Dial("tcp", serverStream.Addr().String())
+			So(err, ShouldBeNil)
+			defer silent.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			_, err = client.Request(ctx, "server", "Ping", nil)
+			So(err, ShouldBeNil)
+			So(getRequests(), ShouldEqual, 1)
+		})
+
+		Convey("recorded stream can not be replayed", func() {
+			proxy, err := newRecordProxy(serverStream.Addr().String())
+			So(err, ShouldBeNil)
+			defer proxy.listener.Close()
+
+			node, err := kms.GetNodeInfo("server")
+			So(err, ShouldBeNil)
+			node.Addr = proxy.listener.Addr().String()
+			So(kms.SetNode(node), ShouldBeNil)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			_, err = client.Request(ctx, "server", "Ping", nil)
+			So(err, ShouldBeNil)
+			So(getRequests(), ShouldEqual, 1)
+
+			replay, err := net.Dial("tcp", serverStream.Addr().String())
+			So(err, ShouldBeNil)
+			defer replay.Close()
+			_, err = replay.Write(proxy.getRecorded())
+			So(err, ShouldBeNil)
+
+			time.Sleep(time.Millisecond * 200)
+			So(getRequests(), ShouldEqual, 1)
+		})
+
+		Convey("accept returns on close", func() {
+			So(serverStream.Close(), ShouldBeNil)
+			_, err := serverStream.Accept()
+			So(err, ShouldEqual, ErrStreamClosed)
+		})
+	})
+}
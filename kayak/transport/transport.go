@@ -18,16 +18,39 @@ package transport
 
 import (
 	"context"
+	"errors"
 	"io"
 	"net"
 	"net/rpc"
 	"net/rpc/jsonrpc"
 	"sync"
+	"time"
 
 	"github.com/thunderdb/ThunderDB/kayak"
 	"github.com/thunderdb/ThunderDB/proto"
 )
 
+var (
+	// ErrTransportClosed defines requesting on closed transport error
+	ErrTransportClosed = errors.New("transport is closed")
+	// ErrStreamClosed defines accepting on closed stream layer error
+	ErrStreamClosed = errors.New("stream layer is closed")
+
+	// kayakErrors are restored from the error messages of rpc, so they can be compared by runner
+	kayakErrors = []error{
+		kayak.ErrInvalidRequest,
+		kayak.ErrInvalidLog,
+		kayak.ErrNotLeader,
+		kayak.ErrNotLearner,
+		kayak.ErrStaleConfig,
+		kayak.ErrInvalidConfigSig,
+		kayak.ErrInvalidTransferTarget,
+		kayak.ErrSnapshotNotSupported,
+		kayak.ErrInvalidSnapshot,
+		kayak.ErrShutdown,
+	}
+)
+
 // ConnWithPeerNodeID defines interface support getting remote peer ID
 type ConnWithPeerNodeID interface {
 	net.Conn
@@ -35,7 +58,8 @@ type ConnWithPeerNodeID interface {
 	GetPeerNodeID() proto.NodeID
 }
 
-// StreamLayer is the underlying network connection layer
+// StreamLayer is the underlying network connection layer, Accept returns ErrStreamClosed once the
+// stream layer is closed.
 type StreamLayer interface {
 	Accept() (ConnWithPeerNodeID, error)
 	Dial(context.Context, proto.NodeID) (ConnWithPeerNodeID, error)
@@ -43,9 +67,11 @@ type StreamLayer interface {
 
 // Request is the request object hand off inter node request
 type Request struct {
-	NodeID        proto.NodeID
-	Method        string
-	Payload       interface{}
+	NodeID  proto.NodeID
+	Method  string
+	Payload interface{}
+	// Token is the optional idempotency token of the request, see WithRequestToken
+	Token         string
 	Response      interface{}
 	Error         error
 	respAvailable chan struct{}
@@ -63,11 +89,18 @@ type Response struct {
 	Response interface{}
 }
 
-// Transport support customized stream layer integration with kayak transport
+// Transport support customized stream layer integration with kayak transport.
+//
+// Requests to a node are multiplexed on a pooled rpc connection, which is dialed on the first
+// request and redialed on the next request once it's broken.
 type Transport struct {
 	config     *Config
 	shutdownCh chan struct{}
 	queue      chan kayak.Request
+	dedup      *dedupCache
+
+	clients     map[proto.NodeID]*rpc.Client
+	clientsLock sync.Mutex
 }
 
 // Config defines Transport config object
@@ -77,6 +110,10 @@ type Config struct {
 
 	ClientCodec ClientCodecBuilder
 	ServerCodec ServerCodecBuilder
+
+	// DedupTTL is the duration to keep the response of a request with token after it's processed,
+	// DefaultDedupTTL is used if it's not set
+	DedupTTL time.Duration
 }
 
 // RequestProxy defines a rpc proxy method exported to golang net/rpc
@@ -122,6 +159,8 @@ func NewTransport(config *Config) (t *Transport) {
 		config:     config,
 		shutdownCh: make(chan struct{}),
 		queue:      make(chan kayak.Request, 100),
+		dedup:      newDedupCache(config.DedupTTL),
+		clients:    make(map[proto.NodeID]*rpc.Client),
 	}
 
 	go t.run()
@@ -196,25 +235,109 @@ func (r *Response) get() interface{} {
 // Request implements Transport.Request method
 func (t *Transport) Request(ctx context.Context, nodeID proto.NodeID,
 	method string, args interface{}) (response interface{}, err error) {
-	conn, err := t.config.StreamLayer.Dial(ctx, nodeID)
+	req := NewRequest(t.config.NodeID, method, args)
+	req.Token, _ = RequestTokenFromContext(ctx)
+
+	for retried := false; ; retried = true {
+		var client *rpc.Client
+		if client, err = t.getClient(ctx, nodeID); err != nil {
+			return
+		}
+
+		res := NewResponse()
+		// TODO(xq262144), too tricky
+		call := client.Go("Service.Call", req, res, make(chan *rpc.Call, 1))
+
+		select {
+		case <-ctx.Done():
+			// response of the call is dropped
+			return nil, ctx.Err()
+		case <-call.Done:
+		}
+
+		if err = call.Error; err == nil {
+			return res.get(), nil
+		}
+
+		if _, ok := err.(rpc.ServerError); ok {
+			return res.get(), decodeError(err)
+		}
+
+		// broken connection is redialed on next request
+		t.removeClient(nodeID, client)
+
+		if err == rpc.ErrShutdown && !retried {
+			// the pooled connection was broken before the call is sent
+			continue
+		}
 
-	if err != nil {
+		return
+	}
+}
+
+// getClient returns the pooled client of node, a new connection is dialed if there is none.
+func (t *Transport) getClient(ctx context.Context, nodeID proto.NodeID) (client *rpc.Client, err error) {
+	t.clientsLock.Lock()
+	client, ok := t.clients[nodeID]
+	t.clientsLock.Unlock()
+
+	if ok {
+		return
+	}
+
+	select {
+	case <-t.shutdownCh:
+		return nil, ErrTransportClosed
+	default:
+	}
+
+	var conn ConnWithPeerNodeID
+	if conn, err = t.config.StreamLayer.Dial(ctx, nodeID); err != nil {
 		return
 	}
 
 	// check node id
 	if conn.GetPeerNodeID() != nodeID {
 		// err creating connection
+		conn.Close()
 		return nil, kayak.ErrInvalidRequest
 	}
 
-	client := rpc.NewClientWithCodec(t.config.ClientCodec(conn))
-	req := NewRequest(t.config.NodeID, method, args)
-	res := NewResponse()
-	// TODO(xq262144), too tricky
-	err = client.Call("Service.Call", req, res)
+	client = rpc.NewClientWithCodec(t.config.ClientCodec(conn))
+
+	t.clientsLock.Lock()
+	defer t.clientsLock.Unlock()
+
+	if c, ok := t.clients[nodeID]; ok {
+		// dialed by concurrent request
+		client.Close()
+		return c, nil
+	}
+
+	t.clients[nodeID] = client
+
+	return
+}
+
+// removeClient closes the client and removes it from pool if it's still pooled.
+func (t *Transport) removeClient(nodeID proto.NodeID, client *rpc.Client) {
+	t.clientsLock.Lock()
+	if t.clients[nodeID] == client {
+		delete(t.clients, nodeID)
+	}
+	t.clientsLock.Unlock()
+
+	client.Close()
+}
 
-	return res.get(), err
+func decodeError(err error) error {
+	for _, e := range kayakErrors {
+		if err.Error() == e.Error() {
+			return e
+		}
+	}
+
+	return err
 }
 
 // Process implements Transport.Process method
@@ -234,23 +357,50 @@ func (p *RequestProxy) Call(req *Request, res *Response) error {
 		return kayak.ErrInvalidRequest
 	}
 
+	if req.Token == "" {
+		obj, err := p.process(req)
+		res.set(obj)
+		return err
+	}
+
+	// duplicated requests wait for the result of the original one
+	e, owner := p.transport.dedup.acquire(req.NodeID, req.Token)
+
+	if owner {
+		obj, err := p.process(req)
+		p.transport.dedup.release(e, obj, err)
+	} else {
+		<-e.done
+	}
+
+	res.set(e.response)
+	return e.err
+}
+
+func (p *RequestProxy) process(req *Request) (interface{}, error) {
 	p.transport.enqueue(req)
-	obj, err := req.getResponse()
-	res.set(obj)
-	return err
+	return req.getResponse()
 }
 
 func (p *RequestProxy) serve() {
 	p.server.ServeCodec(p.transport.config.ServerCodec(p.conn))
 }
 
-// Close shutdown transport hand-off
+// Close shutdown transport hand-off, and closes the pooled connections.
 func (t *Transport) Close() {
 	select {
 	case <-t.shutdownCh:
 	default:
 		close(t.shutdownCh)
 	}
+
+	t.clientsLock.Lock()
+	defer t.clientsLock.Unlock()
+
+	for nodeID, client := range t.clients {
+		client.Close()
+		delete(t.clients, nodeID)
+	}
 }
 
 func (t *Transport) run() {
@@ -260,8 +410,15 @@ func (t *Transport) run() {
 			return
 		default:
 			conn, err := t.config.StreamLayer.Accept()
-			if err != nil {
+			if err == ErrStreamClosed {
+				return
+			} else if err != nil {
 				// TODO, log
+				select {
+				case <-t.shutdownCh:
+					return
+				case <-time.After(acceptRetryDelay):
+				}
 				continue
 			}
 
@@ -19,9 +19,11 @@ package transport
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -302,6 +304,170 @@ func TestTransport(t *testing.T) {
 	})
 }
 
+func TestTransport_Dedup(t *testing.T) {
+	Convey("test request dedup", t, FailureContinues, func(c C) {
+		router := NewTestStreamRouter()
+		stream1 := router.Get("id1")
+		stream2 := router.Get("id2")
+		config2 := NewConfig("id2", stream2)
+		config2.DedupTTL = 200 * time.Millisecond
+		t1 := NewTransport(NewConfig("id1", stream1))
+		t2 := NewTransport(config2)
+		defer t1.Close()
+		defer t2.Close()
+
+		var processed int32
+
+		go func() {
+			for req := range t2.Process() {
+				n := atomic.AddInt32(&processed, 1)
+				go func(req kayak.Request, n int32) {
+					// keep the original request in flight while retrying
+					time.Sleep(50 * time.Millisecond)
+					if req.GetMethod() == "fail method" && n%2 == 0 {
+						req.SendResponse(nil, fmt.Errorf("failure %d", n))
+						return
+					}
+					req.SendResponse(fmt.Sprintf("response %d", n), nil)
+				}(req, n)
+			}
+		}()
+
+		request := func(ctx context.Context) (res interface{}, err error) {
+			return t1.Request(ctx, "id2", "test method", "test request")
+		}
+
+		// concurrent requests with the same token
+		ctx := WithRequestToken(context.Background(), "token1")
+		var wg sync.WaitGroup
+		responses := make([]interface{}, 3)
+
+		for i := range responses {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				var err error
+				responses[i], err = request(ctx)
+				c.So(err, ShouldBeNil)
+			}(i)
+		}
+
+		wg.Wait()
+		So(atomic.LoadInt32(&processed), ShouldEqual, 1)
+		So(responses, ShouldResemble, []interface{}{"response 1", "response 1", "response 1"})
+
+		// retry returns the cached response
+		res, err := request(ctx)
+		So(err, ShouldBeNil)
+		So(res, ShouldEqual, "response 1")
+		So(atomic.LoadInt32(&processed), ShouldEqual, 1)
+
+		// other token and requests without token are processed
+		res, err = request(WithRequestToken(context.Background(), "token2"))
+		So(err, ShouldBeNil)
+		So(res, ShouldEqual, "response 2")
+		res, err = request(context.Background())
+		So(err, ShouldBeNil)
+		So(res, ShouldEqual, "response 3")
+		res, err = request(context.Background())
+		So(err, ShouldBeNil)
+		So(res, ShouldEqual, "response 4")
+
+		// cached response expires
+		time.Sleep(2 * config2.DedupTTL)
+		res, err = request(ctx)
+		So(err, ShouldBeNil)
+		So(res, ShouldEqual, "response 5")
+		So(t2.dedup.len(), ShouldEqual, 1)
+
+		// failed response is not cached
+		ctx = WithRequestToken(context.Background(), "token3")
+		_, err = t1.Request(ctx, "id2", "fail method", "test request")
+		So(err, ShouldNotBeNil)
+		So(t2.dedup.len(), ShouldEqual, 1)
+		res, err = t1.Request(ctx, "id2", "fail method", "test request")
+		So(err, ShouldBeNil)
+		So(res, ShouldEqual, "response 7")
+		So(atomic.LoadInt32(&processed), ShouldEqual, 7)
+	})
+}
+
+// dialCountStream counts the connections dialed by stream.
+type dialCountStream struct {
+	*TestStream
+	dials int32
+}
+
+func (s *dialCountStream) Dial(ctx context.Context, nodeID proto.NodeID) (ConnWithPeerNodeID, error) {
+	atomic.AddInt32(&s.dials, 1)
+	return s.TestStream.Dial(ctx, nodeID)
+}
+
+func TestTransport_ConnPool(t *testing.T) {
+	Convey("test pooled connections", t, FailureContinues, func(c C) {
+		router := NewTestStreamRouter()
+		stream1 := &dialCountStream{TestStream: router.Get("id1")}
+		t1 := NewTransport(NewConfig("id1", stream1))
+		t2 := NewTransport(NewConfig("id2", router.Get("id2")))
+		defer t1.Close()
+		defer t2.Close()
+
+		go func() {
+			for req := range t2.Process() {
+				switch req.GetMethod() {
+				case "ping":
+					req.SendResponse("pong", nil)
+				case "fail":
+					req.SendResponse(nil, kayak.ErrNotLeader)
+				}
+				// other requests never respond
+			}
+		}()
+
+		res, err := t1.Request(context.Background(), "id2", "ping", nil)
+		So(err, ShouldBeNil)
+		So(res, ShouldEqual, "pong")
+
+		// concurrent requests are multiplexed on the pooled connection
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				res, err := t1.Request(context.Background(), "id2", "ping", nil)
+				c.So(err, ShouldBeNil)
+				c.So(res, ShouldEqual, "pong")
+			}()
+		}
+		wg.Wait()
+		So(atomic.LoadInt32(&stream1.dials), ShouldEqual, 1)
+
+		// kayak errors are restored, and the connection is kept
+		_, err = t1.Request(context.Background(), "id2", "fail", nil)
+		So(err, ShouldEqual, kayak.ErrNotLeader)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err = t1.Request(ctx, "id2", "hang", nil)
+		So(err == context.DeadlineExceeded, ShouldBeTrue)
+		So(atomic.LoadInt32(&stream1.dials), ShouldEqual, 1)
+
+		// broken connection is redialed
+		t1.clientsLock.Lock()
+		t1.clients["id2"].Close()
+		t1.clientsLock.Unlock()
+
+		res, err = t1.Request(context.Background(), "id2", "ping", nil)
+		So(err, ShouldBeNil)
+		So(res, ShouldEqual, "pong")
+		So(atomic.LoadInt32(&stream1.dials), ShouldEqual, 2)
+
+		t1.Close()
+		_, err = t1.Request(context.Background(), "id2", "ping", nil)
+		So(err, ShouldEqual, ErrTransportClosed)
+	})
+}
+
 func TestIntegration(t *testing.T) {
 	type createMockRes struct {
 		runner    *kayak.TwoPCRunner
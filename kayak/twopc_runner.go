@@ -27,6 +27,7 @@ import (
 	"github.com/thunderdb/ThunderDB/crypto/hash"
 	"github.com/thunderdb/ThunderDB/proto"
 	"github.com/thunderdb/ThunderDB/twopc"
+	"github.com/thunderdb/ThunderDB/utils"
 )
 
 var (
@@ -36,20 +37,34 @@ var (
 	// committed index store in local meta
 	keyCommittedIndex = []byte("CommittedIndex")
 
+	// index of last log applied to fsm store in local meta
+	keyLastApplied = []byte("LastApplied")
+
 	// ErrInvalidRequest indicate inconsistent state
 	ErrInvalidRequest = errors.New("invalid request")
 )
 
+const (
+	// DefaultMaxInflightLogs defines the default max count of logs queued to a learner but not acked
+	DefaultMaxInflightLogs = 64
+)
+
 // TwoPCConfig is a RuntimeConfig implementation organizing two phase commit mutation
 type TwoPCConfig struct {
 	RuntimeConfig
 
-	// LogCodec is the underlying storage log codec
-	LogCodec TwoPCLogCodec
+	// LogCodec is the codec of log data and log payloads between nodes,
+	// MsgPackLogCodec is used if it's not set
+	LogCodec LogCodec
 
-	// Storage is the underlying twopc Storage
+	// Storage is the underlying twopc Storage, it can be nil if the committed logs are handed
+	// off to FSM only
 	Storage twopc.Worker
 
+	// FSM is the optional state machine which the committed logs are applied to in log order,
+	// see FSM
+	FSM FSM
+
 	// PrepareTimeout
 	PrepareTimeout time.Duration
 
@@ -58,6 +73,44 @@ type TwoPCConfig struct {
 
 	// RollbackTimeout
 	RollbackTimeout time.Duration
+
+	// MaxInflightLogs is the max count of committed logs queued to a learner but not acked,
+	// shipping to the learner pauses once it's reached and resumes on ack,
+	// DefaultMaxInflightLogs is used if it's not set
+	MaxInflightLogs int
+
+	// MaxInflightBytes is the max data size of committed logs queued to a learner but not acked,
+	// no limit if it's not set
+	MaxInflightBytes int
+
+	// QuorumProbeInterval is the interval of probing voters in read-only mode,
+	// DefaultQuorumProbeInterval is used if it's not set, see SetReadOnlyOnQuorumLoss
+	QuorumProbeInterval time.Duration
+
+	// SnapshotThreshold is the count of logs applied since the last snapshot to take a new one,
+	// it only works with FSM implementing Snapshotter, see TwoPCRunner.Snapshot
+	SnapshotThreshold uint64
+
+	// SnapshotThresholdBytes is the data size of logs applied since the last snapshot to take a
+	// new one, it only works with FSM implementing Snapshotter, see TwoPCRunner.Snapshot
+	SnapshotThresholdBytes uint64
+
+	// MaxBatchLogs is the max count of committed logs shipped to a learner or a lagging follower
+	// in one round trip, logs are shipped one by one if it's not set
+	MaxBatchLogs int
+
+	// MaxBatchLatency is the max time to wait for more committed logs to fill a batch before
+	// shipping to a learner, it only works with MaxBatchLogs
+	MaxBatchLatency time.Duration
+
+	// Observer is the optional receiver of runner events for instrumentation, see Observer
+	Observer Observer
+
+	// PipelineDepth is the max count of requests shipping logs to a learner in flight without
+	// waiting for acks, one request is sent at a time if it's not set. The logs in flight are
+	// still bounded by MaxInflightLogs and MaxInflightBytes. Followers are not pipelined, since a
+	// log is only committed after all the voters are prepared.
+	PipelineDepth int
 }
 
 // TwoPCRunner is a Runner implementation organizing two phase commit mutation
@@ -74,10 +127,46 @@ type TwoPCRunner struct {
 	lastLogTerm  uint64
 	lastLogHash  *hash.Hash
 
+	// Index of the last log applied to FSM
+	lastApplied uint64
+
+	// Snapshot state, the applied counters are reset on snapshot
+	snapshotIndex             uint64
+	appliedSinceSnapshot      uint64
+	appliedBytesSinceSnapshot uint64
+	snapshotReq               chan chan error
+
+	// Applied index published to readers, see ReadBarrier
+	applied       uint64
+	appliedNotify chan struct{}
+	appliedLock   sync.Mutex
+
 	// Server role
 	leader *Server
 	role   ServerRole
 
+	// Highest term of the peers configurations signed by leader, protected by processLock
+	signedTerm uint64
+
+	// Background replicators of learners, maintained by leader, protected by progressLock
+	learners map[proto.NodeID]*learnerReplicator
+
+	// Replication progress of peers, maintained by leader
+	progress     map[proto.NodeID]*peerProgress
+	progressLock sync.Mutex
+	statsReq     chan chan *RunnerStats
+
+	// Metrics maintained in run routine, see RunnerStats
+	leaderChanges    uint64
+	proposals        uint64
+	proposalFailures uint64
+	proposalRate     rateCounter
+
+	// Read-only mode on quorum loss, see SetReadOnlyOnQuorumLoss
+	readOnlyOnQuorumLoss bool
+	quorumLost           bool
+	quorumLock           sync.Mutex
+
 	// Shutdown channel to exit, protected to prevent concurrent exits
 	shutdown     bool
 	shutdownCh   chan struct{}
@@ -104,15 +193,6 @@ type TwoPCWorkerWrapper struct {
 	nodeID proto.NodeID
 }
 
-// TwoPCLogCodec is the log data encode/decoder
-type TwoPCLogCodec interface {
-	// Encode log to bytes
-	Encode(interface{}) ([]byte, error)
-
-	// Decode logs to bytes
-	Decode([]byte, interface{}) error
-}
-
 // NewTwoPCRunner create a two pc runner
 func NewTwoPCRunner() *TwoPCRunner {
 	return &TwoPCRunner{
@@ -121,6 +201,10 @@ func NewTwoPCRunner() *TwoPCRunner {
 		processRes:     make(chan error),
 		updatePeersReq: make(chan *Peers),
 		updatePeersRes: make(chan error),
+		learners:       make(map[proto.NodeID]*learnerReplicator),
+		progress:       make(map[proto.NodeID]*peerProgress),
+		statsReq:       make(chan chan *RunnerStats),
+		snapshotReq:    make(chan chan error),
 	}
 }
 
@@ -129,6 +213,34 @@ func (tpc *TwoPCConfig) GetRuntimeConfig() *RuntimeConfig {
 	return &tpc.RuntimeConfig
 }
 
+func (tpc *TwoPCConfig) maxInflightLogs() int {
+	if tpc.MaxInflightLogs <= 0 {
+		return DefaultMaxInflightLogs
+	}
+	return tpc.MaxInflightLogs
+}
+
+func (tpc *TwoPCConfig) logCodec() LogCodec {
+	if tpc.LogCodec == nil {
+		return &MsgPackLogCodec{}
+	}
+	return tpc.LogCodec
+}
+
+func (tpc *TwoPCConfig) storage() twopc.Worker {
+	if tpc.Storage == nil {
+		return nopWorker{}
+	}
+	return tpc.Storage
+}
+
+// nopWorker is the twopc.Worker used if no Storage is configured.
+type nopWorker struct{}
+
+func (nopWorker) Prepare(ctx context.Context, wb twopc.WriteBatch) error  { return nil }
+func (nopWorker) Commit(ctx context.Context, wb twopc.WriteBatch) error   { return nil }
+func (nopWorker) Rollback(ctx context.Context, wb twopc.WriteBatch) error { return nil }
+
 // Init implements Runner.Init.
 func (r *TwoPCRunner) Init(config Config, peers *Peers, logs LogStore, stable StableStore, transport Transport) error {
 	if _, ok := config.(*TwoPCConfig); !ok {
@@ -156,6 +268,8 @@ func (r *TwoPCRunner) Init(config Config, peers *Peers, logs LogStore, stable St
 		return err
 	}
 
+	r.publishApplied()
+
 	r.goFunc(r.run)
 
 	return nil
@@ -223,10 +337,6 @@ func (r *TwoPCRunner) tryRestore() error {
 		return err
 	}
 
-	if err = r.restoreUnderlying(); err != nil {
-		return err
-	}
-
 	r.currentTerm = r.peers.Term
 	r.lastLogTerm = lastCommittedLog.Term
 	r.lastLogIndex = lastCommitted
@@ -236,7 +346,7 @@ func (r *TwoPCRunner) tryRestore() error {
 		r.lastLogHash = nil
 	}
 
-	return nil
+	return r.restoreUnderlying()
 }
 
 func (r *TwoPCRunner) initState() error {
@@ -244,8 +354,9 @@ func (r *TwoPCRunner) initState() error {
 		return ErrInvalidConfig
 	}
 
-	// set leader and node role
+	// set leader and node role, a server not in peers waits as learner for joining, see AddServer
 	r.leader = r.peers.Leader
+	r.role = Learner
 
 	for _, s := range r.peers.Servers {
 		if s.ID == r.config.LocalID {
@@ -264,8 +375,29 @@ func (r *TwoPCRunner) reValidateLocalLogs() error {
 }
 
 func (r *TwoPCRunner) restoreUnderlying() error {
-	// TODO(xq262144), restore underlying from snapshot and replaying local logs
-	return nil
+	if r.config.FSM == nil {
+		return nil
+	}
+
+	// the committed logs are replayed from the last applied one, or from the snapshot if FSM
+	// implements Snapshotter
+	lastApplied, err := r.stableStore.GetUint64(keyLastApplied)
+	if err != nil && err != ErrKeyNotFound {
+		return fmt.Errorf("get last applied index failed: %s", err.Error())
+	}
+
+	if lastApplied > r.lastLogIndex {
+		return fmt.Errorf("invalid last applied index, applied: %d, committed: %d",
+			lastApplied, r.lastLogIndex)
+	}
+
+	r.lastApplied = lastApplied
+
+	if err = r.restoreSnapshot(); err != nil {
+		return fmt.Errorf("restore snapshot failed: %s", err.Error())
+	}
+
+	return r.applyCommitted()
 }
 
 // UpdatePeers implements Runner.UpdatePeers.
@@ -305,6 +437,11 @@ func (r *TwoPCRunner) Apply(data []byte) error {
 		return ErrNotLeader
 	}
 
+	// fail fast in read-only mode
+	if r.isReadOnly() {
+		return ErrReadOnly
+	}
+
 	r.processReq <- data
 	return <-r.processRes
 }
@@ -333,12 +470,16 @@ func (r *TwoPCRunner) run() {
 			// TODO(xq262144), cleanup logic
 			return
 		case data := <-r.processReq:
-			r.processRes <- r.processNewLog(data)
+			r.processRes <- r.propose(data)
 		case request := <-r.transport.Process():
 			r.processRequest(request)
 			// TODO(xq262144), support timeout logic for auto rollback prepared transaction on leader change
 		case peersUpdate := <-r.safeForPeersUpdate():
 			r.processPeersUpdate(peersUpdate)
+		case res := <-r.statsReq:
+			r.processStats(res)
+		case res := <-r.snapshotReq:
+			res <- r.takeSnapshot()
 		}
 	}
 }
@@ -373,9 +514,9 @@ func (r *TwoPCRunner) processNewLog(data []byte) error {
 	hasRollback := false
 
 	localPrepare := func(ctx context.Context) error {
-		return nestedTimeoutCtx(ctx, r.config.PrepareTimeout, func(prepareCtx context.Context) error {
+		return r.nestedTimeoutCtx(ctx, r.config.PrepareTimeout, func(prepareCtx context.Context) error {
 			// prepare local prepare node
-			if err := r.config.Storage.Prepare(prepareCtx, decodedLog); err != nil {
+			if err := r.config.storage().Prepare(prepareCtx, decodedLog); err != nil {
 				return err
 			}
 
@@ -387,45 +528,48 @@ func (r *TwoPCRunner) processNewLog(data []byte) error {
 	localRollback := func(ctx context.Context) error {
 		hasRollback = true
 
-		return nestedTimeoutCtx(ctx, r.config.RollbackTimeout, func(rollbackCtx context.Context) error {
+		return r.nestedTimeoutCtx(ctx, r.config.RollbackTimeout, func(rollbackCtx context.Context) error {
 			// prepare local rollback node
 			// TODO(xq262144), check log position
 			r.logStore.DeleteRange(r.lastLogIndex+1, l.Index)
-			return r.config.Storage.Rollback(rollbackCtx, decodedLog)
+			return r.config.storage().Rollback(rollbackCtx, decodedLog)
 		})
 	}
 
 	localCommit := func(ctx context.Context) error {
-		return nestedTimeoutCtx(ctx, r.config.CommitTimeout, func(commitCtx context.Context) error {
-			return r.config.Storage.Commit(commitCtx, decodedLog)
+		return r.nestedTimeoutCtx(ctx, r.config.CommitTimeout, func(commitCtx context.Context) error {
+			return r.config.storage().Commit(commitCtx, decodedLog)
 		})
 	}
 
 	// init context
-	ctx, cancel := context.WithTimeout(context.Background(), r.config.ProcessTimeout)
+	ctx, cancel := utils.WithClockTimeout(context.Background(), r.config.clock(), r.config.ProcessTimeout)
 	defer cancel()
 
-	// build 2PC workers
-	if len(r.peers.Servers) > 1 {
-		nodes := make([]twopc.Worker, 0, len(r.peers.Servers)-1)
+	// build 2PC workers, learners are not involved in commit
+	if voters := r.peers.Voters(); len(voters) > 1 {
+		nodes := make([]twopc.Worker, 0, len(voters)-1)
 
-		for _, s := range r.peers.Servers {
+		for _, s := range voters {
 			if s.ID != r.config.LocalID {
 				nodes = append(nodes, NewTwoPCWorkerWrapper(r, s.ID))
 			}
 		}
 
 		// start coordination
-		c := twopc.NewCoordinator(twopc.NewOptionsWithCallback(
+		opt := twopc.NewOptionsWithCallback(
 			r.config.ProcessTimeout,
 			nil,
 			localPrepare,
 			localRollback,
-		))
+		)
+		opt.Clock = r.config.Clock
+		c := twopc.NewCoordinator(opt)
 
 		// TODO(xq262144), commit error management considering failure node count
 		// only return error on transaction has been rollback
 		if err := c.Put(nodes, l); err != nil && hasRollback {
+			r.checkQuorum(err)
 			return err
 		}
 	} else {
@@ -445,6 +589,11 @@ func (r *TwoPCRunner) processNewLog(data []byte) error {
 	r.lastLogIndex = l.Index
 	r.lastLogTerm = l.Term
 
+	r.tryApplyCommitted()
+
+	// replicate committed log to learners
+	r.replicateToLearners(l)
+
 	return nil
 }
 
@@ -461,6 +610,12 @@ func (r *TwoPCRunner) getState() ServerState {
 }
 
 func (r *TwoPCRunner) processRequest(req Request) {
+	// read index is requested by followers
+	if req.GetMethod() == "ReadIndex" {
+		r.processReadIndex(req)
+		return
+	}
+
 	// verify call from leader
 	if err := r.verifyLeader(req); err != nil {
 		req.SendResponse(nil, err)
@@ -474,20 +629,39 @@ func (r *TwoPCRunner) processRequest(req Request) {
 		r.processCommit(req)
 	case "Rollback":
 		r.processRollback(req)
+	case "TimeoutNow":
+		r.processTimeoutNow(req)
+	case "UpdatePeers":
+		r.processUpdatePeers(req)
+	case "Learn":
+		r.processLearn(req)
+	case "LearnBatch":
+		r.processLearnBatch(req)
+	case "Ping":
+		r.processPing(req)
+	case "InstallSnapshot":
+		r.processInstallSnapshot(req)
 	default:
 		req.SendResponse(nil, ErrInvalidRequest)
 	}
 }
 
 func (r *TwoPCRunner) processPeersUpdate(peersUpdate *Peers) {
+	r.updatePeersRes <- r.applyPeers(peersUpdate)
+}
+
+func (r *TwoPCRunner) applyPeers(peersUpdate *Peers) (err error) {
 	// update peers
 	// TODO(xq262144), handle step down, promote up
-	var err error
 	if err = r.stableStore.SetUint64(keyCurrentTerm, peersUpdate.Term); err == nil {
 		r.peers = peersUpdate
 		r.currentTerm = peersUpdate.Term
 
 		// change role
+		if r.peers.Leader != nil && (r.leader == nil || r.leader.ID != r.peers.Leader.ID) {
+			r.leaderChanges++
+			r.config.observer().OnLeaderChange(r.currentTerm, r.peers.Leader.ID)
+		}
 		r.leader = r.peers.Leader
 
 		notFound := true
@@ -506,7 +680,7 @@ func (r *TwoPCRunner) processPeersUpdate(peersUpdate *Peers) {
 		}
 	}
 
-	r.updatePeersRes <- err
+	return
 }
 
 func (r *TwoPCRunner) verifyLeader(req Request) error {
@@ -538,29 +712,48 @@ func (r *TwoPCRunner) decodeLogIndex(data interface{}) (uint64, error) {
 	return 0, ErrInvalidLog
 }
 
-func (r *TwoPCRunner) decodeLog(data interface{}) (*Log, error) {
-	// TODO(xq262144), very very hack, need rewrite later
+func (r *TwoPCRunner) encodeLog(l *Log) ([]byte, error) {
+	return r.config.logCodec().Encode(l)
+}
+
+func (r *TwoPCRunner) decodeLog(data interface{}) (l *Log, err error) {
 	if data == nil {
 		return nil, ErrInvalidLog
 	}
 
-	b, err := json.Marshal(data)
-	if err != nil {
-		return nil, err
-	}
+	var b []byte
 
-	var l *Log
+	switch v := data.(type) {
+	case *Log:
+		return v, nil
+	case []byte:
+		b = v
+	default:
+		// TODO(xq262144), very very hack, need rewrite later
+		// payload converted by transport, e.g. bytes to base64 string by jsonrpc
+		var j []byte
+		if j, err = json.Marshal(data); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(j, &b); err != nil {
+			// legacy payload of the plain log object
+			if err = json.Unmarshal(j, &l); err == nil && l != nil {
+				return l, nil
+			}
+			return nil, ErrInvalidLog
+		}
+	}
 
-	if err = json.Unmarshal(b, &l); err == nil {
-		return l, nil
+	if err = r.config.logCodec().Decode(b, &l); err != nil || l == nil {
+		return nil, ErrInvalidLog
 	}
 
-	return nil, ErrInvalidLog
+	return l, nil
 }
 
 func (r *TwoPCRunner) decodeLogData(data []byte) (interface{}, error) {
 	var decoded interface{}
-	if err := r.config.LogCodec.Decode(data, &decoded); err != nil {
+	if err := r.config.logCodec().Decode(data, &decoded); err != nil {
 		return nil, err
 	}
 
@@ -568,7 +761,7 @@ func (r *TwoPCRunner) decodeLogData(data []byte) (interface{}, error) {
 }
 
 func (r *TwoPCRunner) processPrepare(req Request) {
-	req.SendResponse(nil, nestedTimeoutCtx(context.Background(), r.config.PrepareTimeout, func(ctx context.Context) (err error) {
+	req.SendResponse(nil, r.nestedTimeoutCtx(context.Background(), r.config.PrepareTimeout, func(ctx context.Context) (err error) {
 		// already in transaction, try abort previous
 		if r.getState() != Idle {
 			// TODO(xq262144), has running transaction
@@ -617,7 +810,7 @@ func (r *TwoPCRunner) processPrepare(req Request) {
 		}
 
 		// prepare on storage
-		if err = r.config.Storage.Prepare(ctx, decodedLog); err != nil {
+		if err = r.config.storage().Prepare(ctx, decodedLog); err != nil {
 			return err
 		}
 
@@ -635,9 +828,15 @@ func (r *TwoPCRunner) processPrepare(req Request) {
 
 func (r *TwoPCRunner) processCommit(req Request) {
 	// commit log
-	req.SendResponse(nil, nestedTimeoutCtx(context.Background(), r.config.CommitTimeout, func(ctx context.Context) (err error) {
+	req.SendResponse(nil, r.nestedTimeoutCtx(context.Background(), r.config.CommitTimeout, func(ctx context.Context) (err error) {
 		// TODO(xq262144), check current running transaction index
 		if r.getState() != Prepared {
+			if index, err := r.decodeLogIndex(req.GetRequest()); err == nil && index > 0 &&
+				index <= r.lastLogIndex {
+				// already committed, the request is retried
+				return nil
+			}
+
 			// not prepared, failed directly
 			return ErrInvalidRequest
 		}
@@ -674,7 +873,7 @@ func (r *TwoPCRunner) processCommit(req Request) {
 		}
 
 		// commit on storage
-		if err = r.config.Storage.Commit(ctx, decodedLog); err != nil {
+		if err = r.config.storage().Commit(ctx, decodedLog); err != nil {
 			return err
 		}
 
@@ -684,6 +883,8 @@ func (r *TwoPCRunner) processCommit(req Request) {
 		r.lastLogIndex = lastLog.Index
 		r.lastLogTerm = lastLog.Term
 
+		r.tryApplyCommitted()
+
 		// set state to idle
 		r.setState(Idle)
 
@@ -693,9 +894,16 @@ func (r *TwoPCRunner) processCommit(req Request) {
 
 func (r *TwoPCRunner) processRollback(req Request) {
 	// rollback log
-	req.SendResponse(nil, nestedTimeoutCtx(context.Background(), r.config.RollbackTimeout, func(ctx context.Context) (err error) {
+	req.SendResponse(nil, r.nestedTimeoutCtx(context.Background(), r.config.RollbackTimeout, func(ctx context.Context) (err error) {
 		// TODO(xq262144), check current running transaction index
 		if r.getState() != Prepared {
+			if index, err := r.decodeLogIndex(req.GetRequest()); err == nil && index > r.lastLogIndex {
+				if lastIndex, err := r.logStore.LastIndex(); err == nil && lastIndex < index {
+					// already rolled back, the request is retried
+					return nil
+				}
+			}
+
 			// not prepared, failed directly
 			return ErrInvalidRequest
 		}
@@ -732,7 +940,7 @@ func (r *TwoPCRunner) processRollback(req Request) {
 		}
 
 		// rollback on storage
-		if err = r.config.Storage.Rollback(ctx, decodedLog); err != nil {
+		if err = r.config.storage().Rollback(ctx, decodedLog); err != nil {
 			return err
 		}
 
@@ -766,7 +974,26 @@ func NewTwoPCWorkerWrapper(runner *TwoPCRunner, nodeID proto.NodeID) *TwoPCWorke
 
 // Prepare implements twopc.Worker.Prepare
 func (tpww *TwoPCWorkerWrapper) Prepare(ctx context.Context, wb twopc.WriteBatch) error {
-	return tpww.callRemote(ctx, "Prepare", wb)
+	l, ok := wb.(*Log)
+	if !ok {
+		return ErrInvalidLog
+	}
+
+	data, err := tpww.runner.encodeLog(l)
+	if err != nil {
+		return err
+	}
+
+	if err = tpww.callRemote(ctx, "Prepare", data); err != nil && retryable(err) {
+		// the remote may have prepared with the response lost or timed out, while the coordinator
+		// only rolls back the prepared workers, roll it back here in best effort
+		r := tpww.runner
+		r.nestedTimeoutCtx(context.Background(), r.config.RollbackTimeout, func(ctx context.Context) error {
+			return tpww.callRemote(ctx, "Rollback", l.Index)
+		})
+	}
+
+	return err
 }
 
 // Commit implements twopc.Worker.Commit
@@ -777,7 +1004,13 @@ func (tpww *TwoPCWorkerWrapper) Commit(ctx context.Context, wb twopc.WriteBatch)
 		return ErrInvalidLog
 	}
 
-	return tpww.callRemote(ctx, "Commit", l.Index)
+	if err := tpww.callRemote(ctx, "Commit", l.Index); err != nil {
+		return err
+	}
+
+	tpww.runner.updateProgress(tpww.nodeID, l.Index)
+
+	return nil
 }
 
 // Rollback implements twopc.Worker.Rollback
@@ -792,19 +1025,22 @@ func (tpww *TwoPCWorkerWrapper) Rollback(ctx context.Context, wb twopc.WriteBatc
 }
 
 func (tpww *TwoPCWorkerWrapper) callRemote(ctx context.Context, method string, args interface{}) (err error) {
-	// TODO(xq262144), handle retry
-	_, err = tpww.runner.transport.Request(ctx, tpww.nodeID, method, args)
+	if _, err = tpww.runner.callPeer(ctx, tpww.nodeID, method, args); err == nil {
+		tpww.runner.updateProgress(tpww.nodeID, 0)
+	}
 	return
 }
 
-func nestedTimeoutCtx(ctx context.Context, timeout time.Duration, process func(context.Context) error) error {
-	nestedCtx, cancel := context.WithTimeout(ctx, timeout)
+func (r *TwoPCRunner) nestedTimeoutCtx(ctx context.Context, timeout time.Duration, process func(context.Context) error) error {
+	nestedCtx, cancel := utils.WithClockTimeout(ctx, r.config.clock(), timeout)
 	defer cancel()
 	return process(nestedCtx)
 }
 
 var (
-	_ Config       = &TwoPCConfig{}
-	_ Runner       = &TwoPCRunner{}
-	_ twopc.Worker = &TwoPCWorkerWrapper{}
+	_ Config             = &TwoPCConfig{}
+	_ Runner             = &TwoPCRunner{}
+	_ TransferableRunner = &TwoPCRunner{}
+	_ ReadBarrierRunner  = &TwoPCRunner{}
+	_ twopc.Worker       = &TwoPCWorkerWrapper{}
 )
@@ -615,7 +615,7 @@ func TestTwoPCRunner_Apply(t *testing.T) {
 			err := lMock.runner.Apply(testData)
 
 			So(err, ShouldNotBeNil)
-			So(err, ShouldEqual, unknownErr)
+			So(errors.Is(err, unknownErr), ShouldBeTrue)
 
 			// test call orders
 			// prepare failed, so no l_prepare is called
@@ -1013,3 +1013,133 @@ func TestTwoPCRunner_UpdatePeers(t *testing.T) {
 		})
 	})
 }
+
+func TestTwoPCRunner_Partition(t *testing.T) {
+	mockLogCodec := &MockLogCodec{}
+	mockRouter := &MockTransportRouter{
+		transports: make(map[proto.NodeID]*MockTransport),
+	}
+
+	type createMockRes struct {
+		runner    *TwoPCRunner
+		transport *MockTransport
+		worker    *MockWorker
+		config    *TwoPCConfig
+		store     *MockInmemStore
+	}
+
+	createMock := func(nodeID proto.NodeID) (res *createMockRes) {
+		res = &createMockRes{}
+		logger := log.New()
+		logger.SetLevel(log.FatalLevel)
+		res.runner = NewTwoPCRunner()
+		res.transport = mockRouter.getTransport(nodeID)
+		res.worker = &MockWorker{}
+		res.store = NewMockInmemStore()
+		res.config = &TwoPCConfig{
+			RuntimeConfig: RuntimeConfig{
+				RootDir:        "test_dir",
+				LocalID:        nodeID,
+				Runner:         res.runner,
+				Transport:      res.transport,
+				ProcessTimeout: time.Millisecond * 800,
+				Logger:         logger,
+			},
+			LogCodec:        mockLogCodec,
+			Storage:         res.worker,
+			PrepareTimeout:  time.Millisecond * 200,
+			CommitTimeout:   time.Millisecond * 200,
+			RollbackTimeout: time.Millisecond * 200,
+		}
+		res.worker.On("Prepare", mock.Anything, "test data").Return(nil)
+		res.worker.On("Commit", mock.Anything, "test data").Return(nil)
+		res.worker.On("Rollback", mock.Anything, "test data").Return(nil)
+		return
+	}
+	peers := testPeersFixture(1, []*Server{
+		{
+			Role: Leader,
+			ID:   "leader",
+		},
+		{
+			Role: Follower,
+			ID:   "follower1",
+		},
+		{
+			Role: Follower,
+			ID:   "follower2",
+		},
+	})
+
+	Convey("isolated follower does not disrupt leader", t, func() {
+		mockRouter.ResetAll()
+
+		lMock := createMock("leader")
+		f1Mock := createMock("follower1")
+		f2Mock := createMock("follower2")
+		mocks := []*createMockRes{lMock, f1Mock, f2Mock}
+
+		for _, r := range mocks {
+			err := r.runner.Init(r.config, peers, r.store, r.store, r.transport)
+			So(err, ShouldBeNil)
+		}
+
+		defer func() {
+			for _, r := range mocks {
+				r.runner.Shutdown(true)
+			}
+		}()
+
+		testData, _ := mockLogCodec.Encode("test data")
+		So(lMock.runner.Apply(testData), ShouldBeNil)
+
+		// isolate follower2, requests to it are dropped
+		mockRouter.ResetTransport("follower2")
+		So(lMock.runner.Apply(testData), ShouldNotBeNil)
+
+		// isolated follower spins, terms only advance with configurations signed by leader
+		for i := 0; i < 3; i++ {
+			So(f2Mock.runner.Apply(testData), ShouldEqual, ErrNotLeader)
+			So(f2Mock.runner.TransferLeadership("follower2"), ShouldEqual, ErrNotLeader)
+			time.Sleep(lMock.config.PrepareTimeout)
+		}
+		So(f2Mock.runner.currentTerm, ShouldEqual, uint64(1))
+
+		// reconnect
+		mockRouter.transportLock.Lock()
+		mockRouter.transports["follower2"] = f2Mock.transport
+		mockRouter.transportLock.Unlock()
+
+		// self-promoting configuration from rejoined follower is rejected
+		bogusPeers := testPeersFixture(5, []*Server{
+			{
+				Role: Follower,
+				ID:   "leader",
+			},
+			{
+				Role: Follower,
+				ID:   "follower1",
+			},
+			{
+				Role: Leader,
+				ID:   "follower2",
+			},
+		})
+		ctx, cancel := context.WithTimeout(context.Background(), lMock.config.ProcessTimeout)
+		defer cancel()
+		_, err := f2Mock.transport.Request(ctx, "leader", "UpdatePeers", bogusPeers)
+		So(err, ShouldEqual, ErrInvalidRequest)
+
+		for _, r := range mocks {
+			So(r.runner.currentTerm, ShouldEqual, uint64(1))
+			So(r.runner.leader.ID, ShouldEqual, proto.NodeID("leader"))
+		}
+		So(lMock.runner.role, ShouldEqual, Leader)
+
+		// existing leader keeps committing
+		So(lMock.runner.Apply(testData), ShouldBeNil)
+		for _, r := range mocks {
+			So(r.runner.lastLogIndex, ShouldEqual, uint64(2))
+		}
+	})
+}
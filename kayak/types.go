@@ -22,12 +22,14 @@ import (
 	"encoding/base64"
 	"encoding/binary"
 	"fmt"
+	"sort"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/thunderdb/ThunderDB/crypto/asymmetric"
 	"github.com/thunderdb/ThunderDB/crypto/hash"
 	"github.com/thunderdb/ThunderDB/proto"
+	"github.com/thunderdb/ThunderDB/utils"
 )
 
 // Log entries are replicated to all members of the Raft cluster
@@ -107,6 +109,10 @@ type StableStore interface {
 
 	// GetUint64 returns the uint64 value for key, or 0 if key was not found.
 	GetUint64(key []byte) (uint64, error)
+
+	// SetBatch sets the values and the uint64 values in a single transaction, so either all of
+	// them are persisted or none of them.
+	SetBatch(vals map[string][]byte, uint64Vals map[string]uint64) error
 }
 
 // ServerRole define the role of node to be leader/coordinator in peer set.
@@ -121,15 +127,21 @@ const (
 	Leader ServerRole = iota
 	// Follower a server that follow the leader log commits.
 	Follower
+	// Learner a non-voting server that receives committed logs from leader but is not counted in
+	// commit quorum, it can be promoted to Follower once caught up.
+	Learner
+)
 
+// Note: Don't renumber these, since the numbers are written into the log.
+const (
 	// Idle indicates no running transaction.
-	Idle ServerState = iota
+	Idle ServerState = 2
 
 	// Prepared indicates in-flight transaction prepared.
-	Prepared
+	Prepared ServerState = 3
 
 	// Shutdown state
-	Shutdown
+	Shutdown ServerState = 4
 )
 
 func (s ServerRole) String() string {
@@ -138,6 +150,8 @@ func (s ServerRole) String() string {
 		return "Leader"
 	case Follower:
 		return "Follower"
+	case Learner:
+		return "Learner"
 	}
 	return "Unknown"
 }
@@ -222,6 +236,66 @@ func (c *Peers) Sign(signer *asymmetric.PrivateKey) error {
 	return nil
 }
 
+// Voters returns the servers counted in commit quorum, learners are excluded.
+func (c *Peers) Voters() (voters []*Server) {
+	for _, s := range c.Servers {
+		if s.Role != Learner {
+			voters = append(voters, s)
+		}
+	}
+	return
+}
+
+// Learners returns the non-voting servers.
+func (c *Peers) Learners() (learners []*Server) {
+	for _, s := range c.Servers {
+		if s.Role == Learner {
+			learners = append(learners, s)
+		}
+	}
+	return
+}
+
+// Quorum returns the number of servers required to commit a log, two phase commit requires all
+// the voters to be prepared.
+func (c *Peers) Quorum() int {
+	return len(c.Voters())
+}
+
+// Digest returns the hash of the canonical form of configuration, which consists of Term,
+// Leader.ID, and the servers sorted by ID with their roles. Nodes holding the same configuration
+// get the same digest regardless of the servers order, so they can compare digests instead of
+// the whole configuration.
+func (c *Peers) Digest() hash.Hash {
+	servers := make([]*Server, len(c.Servers))
+	copy(servers, c.Servers)
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i].ID < servers[j].ID
+	})
+
+	var leaderID proto.NodeID
+	if c.Leader != nil {
+		leaderID = c.Leader.ID
+	}
+
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.LittleEndian, c.Term)
+	writeNodeID(buffer, leaderID)
+	binary.Write(buffer, binary.LittleEndian, uint32(len(servers)))
+	for _, s := range servers {
+		writeNodeID(buffer, s.ID)
+		binary.Write(buffer, binary.LittleEndian, int32(s.Role))
+	}
+
+	return hash.DoubleHashH(buffer.Bytes())
+}
+
+// writeNodeID writes the length prefixed node id to buffer.
+func writeNodeID(buffer *bytes.Buffer, id proto.NodeID) {
+	binary.Write(buffer, binary.LittleEndian, uint32(len(id)))
+	buffer.WriteString(string(id))
+}
+
 // Verify verify signature
 func (c *Peers) Verify() bool {
 	return c.Signature.Verify(c.getBytes(), c.PubKey)
@@ -255,6 +329,19 @@ type RuntimeConfig struct {
 
 	// Logger is the logger
 	Logger *log.Logger
+
+	// Clock measures the timeouts and intervals of runner, utils.RealClock is used if it's nil
+	Clock utils.Clock
+
+	// RPC is the timeout and retry policies of the requests to peers by method, see RPCConfig
+	RPC RPCConfig
+}
+
+func (c *RuntimeConfig) clock() utils.Clock {
+	if c.Clock == nil {
+		return utils.RealClock{}
+	}
+	return c.Clock
 }
 
 // Config interface for abstraction.
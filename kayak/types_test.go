@@ -198,6 +198,57 @@ func TestPeers_Sign(t *testing.T) {
 	})
 }
 
+func TestPeers_Digest(t *testing.T) {
+	newPeers := func() *Peers {
+		return testPeersFixture(1, []*Server{
+			{Role: Leader, ID: "leader"},
+			{Role: Follower, ID: "follower1"},
+			{Role: Follower, ID: "follower2"},
+			{Role: Learner, ID: "learner"},
+		})
+	}
+
+	Convey("identical configs", t, func() {
+		p1, p2 := newPeers(), newPeers()
+		So(p1.Digest(), ShouldResemble, p2.Digest())
+
+		// keys and signature are not counted
+		p2.Signature = nil
+		p2.Servers[1].PubKey = nil
+		So(p1.Digest(), ShouldResemble, p2.Digest())
+	})
+	Convey("servers order does not matter", t, func() {
+		p1, p2 := newPeers(), newPeers()
+		p2.Servers[0], p2.Servers[3] = p2.Servers[3], p2.Servers[0]
+		p2.Servers[1], p2.Servers[2] = p2.Servers[2], p2.Servers[1]
+		So(p1.Digest(), ShouldResemble, p2.Digest())
+		So(p2.Servers[0].ID, ShouldEqual, "learner")
+	})
+	Convey("changed config", t, func() {
+		p := newPeers()
+		digest := p.Digest()
+
+		p.Servers[3].Role = Follower
+		So(p.Digest(), ShouldNotResemble, digest)
+
+		p = newPeers()
+		p.Term = 2
+		So(p.Digest(), ShouldNotResemble, digest)
+
+		p = newPeers()
+		p.Leader = p.Servers[1]
+		So(p.Digest(), ShouldNotResemble, digest)
+
+		p = newPeers()
+		p.Servers = p.Servers[:3]
+		So(p.Digest(), ShouldNotResemble, digest)
+
+		p = newPeers()
+		p.Servers[1].ID = "follower"
+		So(p.Digest(), ShouldNotResemble, digest)
+	})
+}
+
 func TestToString(t *testing.T) {
 	Convey("ServerRole", t, func() {
 		So(fmt.Sprint(Leader), ShouldEqual, "Leader")
@@ -209,6 +260,14 @@ func TestToString(t *testing.T) {
 		So(fmt.Sprint(Prepared), ShouldEqual, "Prepared")
 		So(fmt.Sprint(ServerState(100)), ShouldEqual, "Unknown")
 	})
+	Convey("persisted numbers", t, func() {
+		So(Leader, ShouldEqual, ServerRole(0))
+		So(Follower, ShouldEqual, ServerRole(1))
+		So(Learner, ShouldEqual, ServerRole(2))
+		So(Idle, ShouldEqual, ServerState(2))
+		So(Prepared, ShouldEqual, ServerState(3))
+		So(Shutdown, ShouldEqual, ServerState(4))
+	})
 	Convey("Server", t, func() {
 		s := &Server{
 			Role: Leader,
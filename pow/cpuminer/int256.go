@@ -45,6 +45,28 @@ func (i *Uint256) Inc() (ret *Uint256) {
 	return i
 }
 
+// Cmp compares i and other and returns:
+//
+//	-1 if i <  other
+//	 0 if i == other
+//	+1 if i >  other
+func (i *Uint256) Cmp(other Uint256) int {
+	for _, w := range [...][2]uint64{
+		{i.D, other.D},
+		{i.C, other.C},
+		{i.B, other.B},
+		{i.A, other.A},
+	} {
+		switch {
+		case w[0] < w[1]:
+			return -1
+		case w[0] > w[1]:
+			return 1
+		}
+	}
+	return 0
+}
+
 // Bytes converts Uint256 to []byte
 func (i *Uint256) Bytes() []byte {
 	var binBuf bytes.Buffer
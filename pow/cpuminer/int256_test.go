@@ -93,3 +93,37 @@ func TestUint256_Inc(t *testing.T) {
 		So(i.D, ShouldEqual, 0)
 	})
 }
+
+func TestUint256_Cmp(t *testing.T) {
+	Convey("uint256 cmp equal", t, func() {
+		i := Uint256{1, 2, 3, 4}
+		So(i.Cmp(Uint256{1, 2, 3, 4}), ShouldEqual, 0)
+		z := Uint256{}
+		So(z.Cmp(Uint256{}), ShouldEqual, 0)
+	})
+	Convey("uint256 cmp higher word wins", t, func() {
+		i := Uint256{math.MaxUint64, math.MaxUint64, math.MaxUint64, 0}
+		j := Uint256{0, 0, 0, 1}
+		So(i.Cmp(j), ShouldEqual, -1)
+		So(j.Cmp(i), ShouldEqual, 1)
+
+		i = Uint256{math.MaxUint64, 0, 0, 0}
+		j = Uint256{0, 1, 0, 0}
+		So(i.Cmp(j), ShouldEqual, -1)
+		So(j.Cmp(i), ShouldEqual, 1)
+	})
+	Convey("uint256 cmp after inc carry", t, func() {
+		i := Uint256{math.MaxUint64, math.MaxUint64, 0, 0}
+		j := i
+		j.Inc()
+		So(j, ShouldResemble, Uint256{0, 0, 1, 0})
+		So(i.Cmp(j), ShouldEqual, -1)
+		So(j.Cmp(i), ShouldEqual, 1)
+	})
+	Convey("uint256 cmp survives bytes round trip", t, func() {
+		i := Uint256{math.MaxUint64, 3, 444, 1230}
+		j, err := FromBytes(i.Bytes())
+		So(err, ShouldBeNil)
+		So(i.Cmp(*j), ShouldEqual, 0)
+	})
+}
@@ -18,7 +18,10 @@
 package cpuminer
 
 import (
+	"context"
 	"errors"
+	"runtime"
+	"sync"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/thunderdb/ThunderDB/crypto/hash"
@@ -100,3 +103,70 @@ func (miner *CPUMiner) ComputeBlockNonce(
 		}
 	}
 }
+
+// MineParallel searches for a nonce making HashBlock(data, nonce) reach difficulty
+// with workers goroutines, workers <= 0 means runtime.NumCPU().
+// The nonce space is split by the highest 64 bits (Uint256.D), so each worker
+// iterates its own disjoint range. The first qualifying nonce wins and the
+// other workers are canceled. If ctx is done before that, ctx.Err() is returned.
+func MineParallel(ctx context.Context, data []byte, difficulty int, workers int) (Uint256, error) {
+	return mineParallel(ctx, data, workers, func(h hash.Hash) bool {
+		return h.Difficulty() >= difficulty
+	})
+}
+
+// MineParallelTarget searches for a nonce making HashBlock(data, nonce) meet
+// target like MineParallel, see Target.MeetsTarget.
+func MineParallelTarget(ctx context.Context, data []byte, target Target, workers int) (
+	Uint256, error) {
+	return mineParallel(ctx, data, workers, target.MeetsTarget)
+}
+
+// mineParallel searches for a nonce whose HashBlock(data, nonce) meets with
+// workers goroutines, see MineParallel.
+func mineParallel(ctx context.Context, data []byte, workers int, meets func(hash.Hash) bool) (
+	Uint256, error) {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg     sync.WaitGroup
+		result = make(chan Uint256, workers)
+	)
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(start Uint256) {
+			defer wg.Done()
+			// private copy, HashBlock appends the nonce to data
+			blockData := make([]byte, len(data))
+			copy(blockData, data)
+
+			for i := start; ; i.Inc() {
+				select {
+				case <-ctx.Done():
+					return
+				default:
+					if meets(HashBlock(blockData, i)) {
+						result <- i
+						cancel()
+						return
+					}
+				}
+			}
+		}(Uint256{D: uint64(w)})
+	}
+
+	wg.Wait()
+
+	select {
+	case nonce := <-result:
+		return nonce, nil
+	default:
+		return Uint256{}, ctx.Err()
+	}
+}
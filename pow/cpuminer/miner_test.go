@@ -17,6 +17,7 @@
 package cpuminer
 
 import (
+	"context"
 	"testing"
 
 	"time"
@@ -131,3 +132,38 @@ func TestCPUMiner_HashBlock_quit(t *testing.T) {
 	}
 	t.Logf("Difficulty: %d, Hash: %s", nonceFromCh.Difficulty, hasha.String())
 }
+
+func TestMineParallel(t *testing.T) {
+	diffWanted := 16
+	data := []byte{
+		0x79, 0xa6, 0x1a, 0xdb, 0xc6, 0xe5, 0xa2, 0xe1,
+		0x39, 0xd2, 0x71, 0x3a, 0x54, 0x6e, 0xc7, 0xc8,
+	}
+	nonce, err := MineParallel(context.Background(), data, diffWanted, 4)
+	if err != nil {
+		t.Fatalf("MineParallel failed: %v", err)
+	}
+	hash := HashBlock(data, nonce)
+	if hash.Difficulty() < diffWanted {
+		t.Errorf("MineParallel got nonce %v, difficulty %d, want >= %d",
+			nonce, hash.Difficulty(), diffWanted)
+	}
+	t.Logf("Difficulty: %d, Hash: %s", hash.Difficulty(), hash.String())
+}
+
+func TestMineParallel_cancel(t *testing.T) {
+	data := []byte{
+		0x79, 0xa6,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	begin := time.Now()
+	_, err := MineParallel(ctx, data, 256, 0)
+	if err != context.DeadlineExceeded {
+		t.Errorf("MineParallel should return %v, got %v", context.DeadlineExceeded, err)
+	}
+	if elapsed := time.Since(begin); elapsed > 5*time.Second {
+		t.Errorf("MineParallel took %v to abort", elapsed)
+	}
+}
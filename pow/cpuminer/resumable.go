@@ -0,0 +1,103 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cpuminer
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+)
+
+// resumeBatchSize is the count of nonces tried between context checks in Resume.
+const resumeBatchSize = 1024
+
+// Miner searches for a nonce making HashBlock(data, nonce) meet the target
+// sequentially from a cursor, so the search can be interrupted and resumed
+// later, or persisted with Save and Load. It's not concurrency-safe.
+type Miner struct {
+	data   []byte
+	target Target
+	cursor Uint256
+}
+
+// NewMiner returns a Miner of data and target searching from start.
+func NewMiner(data []byte, target Target, start Uint256) *Miner {
+	// private copy, HashBlock appends the nonce to data
+	blockData := make([]byte, len(data))
+	copy(blockData, data)
+	return &Miner{
+		data:   blockData,
+		target: target,
+		cursor: start,
+	}
+}
+
+// Cursor returns the next nonce to try.
+func (m *Miner) Cursor() Uint256 {
+	return m.cursor
+}
+
+// Target returns the target of m.
+func (m *Miner) Target() Target {
+	return m.target
+}
+
+// TryN tries at most n nonces from the cursor, and returns the nonce and true
+// if it meets the target. The cursor is moved to the nonce after the last one
+// tried, so that a found nonce is not returned again.
+func (m *Miner) TryN(n int) (nonce Uint256, ok bool) {
+	for i := 0; i < n; i++ {
+		nonce = m.cursor
+		m.cursor.Inc()
+		if m.target.MeetsTarget(HashBlock(m.data, nonce)) {
+			return nonce, true
+		}
+	}
+	return Uint256{}, false
+}
+
+// Resume continues searching from the cursor until a nonce meeting the target
+// is found, or ctx is done, in which case ctx.Err() is returned and the search
+// can be resumed again.
+func (m *Miner) Resume(ctx context.Context) (Uint256, error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return Uint256{}, ctx.Err()
+		default:
+			if nonce, ok := m.TryN(resumeBatchSize); ok {
+				return nonce, nil
+			}
+		}
+	}
+}
+
+// Save writes the target and cursor of m to w, the mining data is not saved.
+func (m *Miner) Save(w io.Writer) error {
+	return binary.Write(w, binary.BigEndian, []Uint256{Uint256(m.target), m.cursor})
+}
+
+// Load reads the target and cursor written by Save from r, the mining data
+// of m is kept.
+func (m *Miner) Load(r io.Reader) (err error) {
+	state := make([]Uint256, 2)
+	if err = binary.Read(r, binary.BigEndian, state); err != nil {
+		return
+	}
+	m.target, m.cursor = Target(state[0]), state[1]
+	return
+}
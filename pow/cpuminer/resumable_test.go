@@ -0,0 +1,79 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cpuminer
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMiner(t *testing.T) {
+	data := []byte{
+		0x79, 0xa6, 0x1a, 0xdb, 0xc6, 0xe5, 0xa2, 0xe1,
+	}
+	target := DifficultyToTarget(12)
+
+	Convey("resume mining from saved cursor", t, func() {
+		// the first solution from 0
+		m := NewMiner(data, target, Uint256{})
+		solution, err := m.Resume(context.Background())
+		So(err, ShouldBeNil)
+		So(target.MeetsTarget(HashBlock(data, solution)), ShouldBeTrue)
+		So(solution.A, ShouldBeGreaterThan, 1)
+
+		// mine partway
+		m = NewMiner(data, target, Uint256{})
+		_, ok := m.TryN(int(solution.A / 2))
+		So(ok, ShouldBeFalse)
+		So(m.Cursor(), ShouldResemble, Uint256{A: solution.A / 2})
+
+		buf := new(bytes.Buffer)
+		So(m.Save(buf), ShouldBeNil)
+
+		// reload and continue
+		loaded := NewMiner(data, Target{}, Uint256{})
+		So(loaded.Load(buf), ShouldBeNil)
+		So(loaded.Target(), ShouldResemble, target)
+		So(loaded.Cursor(), ShouldResemble, Uint256{A: solution.A / 2})
+
+		nonce, ok := loaded.TryN(int(solution.A - solution.A/2 + 1))
+		So(ok, ShouldBeTrue)
+		So(nonce, ShouldResemble, solution)
+		So(loaded.Cursor(), ShouldResemble, Uint256{A: solution.A + 1})
+
+		// the found nonce is not returned again
+		nonce, err = loaded.Resume(context.Background())
+		So(err, ShouldBeNil)
+		So(nonce.Cmp(solution), ShouldEqual, 1)
+
+		So(loaded.Load(bytes.NewReader([]byte{0x01})), ShouldEqual, io.ErrUnexpectedEOF)
+	})
+
+	Convey("interrupt and resume", t, func() {
+		m := NewMiner(data, DifficultyToTarget(256), Uint256{})
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		_, err := m.Resume(ctx)
+		So(err, ShouldResemble, context.DeadlineExceeded)
+		So(m.Cursor().A, ShouldBeGreaterThan, 0)
+	})
+}
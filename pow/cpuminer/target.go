@@ -0,0 +1,133 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cpuminer
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/big"
+
+	"github.com/thunderdb/ThunderDB/crypto/hash"
+)
+
+var (
+	// ErrNegativeTarget is returned when compact bits have the sign bit set.
+	ErrNegativeTarget = errors.New("compact target is negative")
+	// ErrTargetOverflow is returned when compact bits exceed 256 bits.
+	ErrTargetOverflow = errors.New("compact target overflows 256 bits")
+)
+
+// Target is a 256 bit threshold of PoW, a hash meets the target if it is not
+// greater than the target. The hash is read as a little-endian integer, so the
+// leading zero bits counted by Hash.Difficulty are its most significant bits.
+type Target Uint256
+
+// DifficultyToTarget returns the max target met by the hashes of at least
+// difficulty leading zero bits.
+func DifficultyToTarget(difficulty int) (t Target) {
+	if difficulty < 0 {
+		difficulty = 0
+	}
+	words := []*uint64{&t.A, &t.B, &t.C, &t.D}
+	for i, w := range words {
+		// bits of this word which are not leading zero bits
+		switch bits := 256 - difficulty - 64*i; {
+		case bits >= 64:
+			*w = math.MaxUint64
+		case bits > 0:
+			*w = 1<<uint(bits) - 1
+		}
+	}
+	return
+}
+
+// MeetsTarget checks if h as a little-endian integer is not greater than t.
+func (t Target) MeetsTarget(h hash.Hash) bool {
+	v := Uint256{
+		A: binary.LittleEndian.Uint64(h[0:8]),
+		B: binary.LittleEndian.Uint64(h[8:16]),
+		C: binary.LittleEndian.Uint64(h[16:24]),
+		D: binary.LittleEndian.Uint64(h[24:32]),
+	}
+	return v.Cmp(Uint256(t)) <= 0
+}
+
+// Big converts t to a big.Int.
+func (t Target) Big() *big.Int {
+	v := new(big.Int)
+	for _, w := range []uint64{t.D, t.C, t.B, t.A} {
+		v.Lsh(v, 64)
+		v.Or(v, new(big.Int).SetUint64(w))
+	}
+	return v
+}
+
+// TargetFromBig converts a non-negative v of at most 256 bits to Target.
+func TargetFromBig(v *big.Int) (t Target, err error) {
+	if v.Sign() < 0 {
+		return t, ErrNegativeTarget
+	}
+	if v.BitLen() > 256 {
+		return t, ErrTargetOverflow
+	}
+	buf := make([]byte, 32)
+	b := v.Bytes()
+	copy(buf[32-len(b):], b)
+	t.D = binary.BigEndian.Uint64(buf[0:8])
+	t.C = binary.BigEndian.Uint64(buf[8:16])
+	t.B = binary.BigEndian.Uint64(buf[16:24])
+	t.A = binary.BigEndian.Uint64(buf[24:32])
+	return
+}
+
+// Compact returns the compact representation of t like the "bits" field of
+// Bitcoin: the highest byte is the byte length of t and the lower 3 bytes are
+// the most significant bytes of t. The sign bit 0x00800000 is never set, so
+// the lower bytes of t may be truncated.
+func (t Target) Compact() uint32 {
+	v := t.Big()
+	exponent := uint((v.BitLen() + 7) / 8)
+	var mantissa uint32
+	if exponent <= 3 {
+		mantissa = uint32(v.Uint64() << (8 * (3 - exponent)))
+	} else {
+		mantissa = uint32(new(big.Int).Rsh(v, 8*(exponent-3)).Uint64())
+	}
+	// keep the sign bit clear
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		exponent++
+	}
+	return uint32(exponent<<24) | mantissa
+}
+
+// TargetFromCompact converts the compact representation of Target.Compact back
+// to Target.
+func TargetFromCompact(bits uint32) (t Target, err error) {
+	if bits&0x00800000 != 0 && bits&0x007fffff != 0 {
+		return t, ErrNegativeTarget
+	}
+	exponent := uint(bits >> 24)
+	mantissa := big.NewInt(int64(bits & 0x007fffff))
+	if exponent <= 3 {
+		mantissa.Rsh(mantissa, 8*(3-exponent))
+	} else {
+		mantissa.Lsh(mantissa, 8*(exponent-3))
+	}
+	return TargetFromBig(mantissa)
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cpuminer
+
+import (
+	"context"
+	"encoding/binary"
+	"math/big"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/thunderdb/ThunderDB/crypto/hash"
+)
+
+// uint256ToHash returns the hash whose little-endian integer is i.
+func uint256ToHash(i Uint256) (h hash.Hash) {
+	binary.LittleEndian.PutUint64(h[0:8], i.A)
+	binary.LittleEndian.PutUint64(h[8:16], i.B)
+	binary.LittleEndian.PutUint64(h[16:24], i.C)
+	binary.LittleEndian.PutUint64(h[24:32], i.D)
+	return
+}
+
+func TestTarget_MeetsTarget(t *testing.T) {
+	Convey("hash around target", t, func() {
+		target := Target{A: 0, B: 0x1234, C: 0, D: 0x00ff}
+		below := Uint256{A: 0xffffffffffffffff, B: 0x1233, C: 0, D: 0x00ff}
+		above := Uint256{A: 1, B: 0x1234, C: 0, D: 0x00ff}
+
+		So(target.MeetsTarget(uint256ToHash(below)), ShouldBeTrue)
+		So(target.MeetsTarget(uint256ToHash(Uint256(target))), ShouldBeTrue)
+		So(target.MeetsTarget(uint256ToHash(above)), ShouldBeFalse)
+	})
+	Convey("difficulty target", t, func() {
+		for _, difficulty := range []int{0, 1, 8, 20, 63, 64, 65, 200, 255, 256} {
+			target := DifficultyToTarget(difficulty)
+			So(target.Big().BitLen(), ShouldEqual, 256-difficulty)
+
+			// the max hash of difficulty and the min hash of difficulty-1
+			h := uint256ToHash(Uint256(target))
+			So(h.Difficulty(), ShouldEqual, difficulty)
+			So(target.MeetsTarget(h), ShouldBeTrue)
+			if difficulty > 0 {
+				next := Uint256(target)
+				next.Inc()
+				h = uint256ToHash(next)
+				So(h.Difficulty(), ShouldEqual, difficulty-1)
+				So(target.MeetsTarget(h), ShouldBeFalse)
+			}
+		}
+	})
+}
+
+func TestTarget_Compact(t *testing.T) {
+	Convey("compact round trip", t, func() {
+		for _, bits := range []uint32{
+			0x1d00ffff, 0x1b0404cb, 0x207fffff, 0x03123456, 0x04123456, 0x2100ffff,
+		} {
+			target, err := TargetFromCompact(bits)
+			So(err, ShouldBeNil)
+			So(target.Compact(), ShouldEqual, bits)
+		}
+	})
+	Convey("compact value", t, func() {
+		target, err := TargetFromCompact(0x1d00ffff)
+		So(err, ShouldBeNil)
+		expected := new(big.Int).Lsh(big.NewInt(0xffff), 8*(0x1d-3))
+		So(target.Big().Cmp(expected), ShouldEqual, 0)
+
+		// the lower bytes are truncated
+		target = DifficultyToTarget(32)
+		truncated, err := TargetFromCompact(target.Compact())
+		So(err, ShouldBeNil)
+		So(target.Compact(), ShouldEqual, 0x1d00ffff)
+		So(truncated.Big().Cmp(target.Big()), ShouldBeLessThanOrEqualTo, 0)
+		So(truncated.Compact(), ShouldEqual, target.Compact())
+
+		// the sign bit is kept clear
+		target, err = TargetFromBig(big.NewInt(0x80))
+		So(err, ShouldBeNil)
+		So(target.Compact(), ShouldEqual, 0x02008000)
+	})
+	Convey("compact error", t, func() {
+		_, err := TargetFromCompact(0x1d800001)
+		So(err, ShouldEqual, ErrNegativeTarget)
+		_, err = TargetFromCompact(0x22010000)
+		So(err, ShouldEqual, ErrTargetOverflow)
+		_, err = TargetFromBig(big.NewInt(-1))
+		So(err, ShouldEqual, ErrNegativeTarget)
+	})
+}
+
+func TestMineParallelTarget(t *testing.T) {
+	Convey("mine with target", t, func() {
+		data := []byte{
+			0x79, 0xa6, 0x1a, 0xdb, 0xc6, 0xe5, 0xa2, 0xe1,
+		}
+		target, err := TargetFromCompact(0x1f00ffff)
+		So(err, ShouldBeNil)
+		nonce, err := MineParallelTarget(context.Background(), data, target, 4)
+		So(err, ShouldBeNil)
+		So(target.MeetsTarget(HashBlock(data, nonce)), ShouldBeTrue)
+	})
+}
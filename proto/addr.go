@@ -0,0 +1,105 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proto
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidAddr indicates a node address is not in the form of host:port.
+var ErrInvalidAddr = errors.New("invalid node address")
+
+const (
+	maxHostnameLength = 253
+	maxLabelLength    = 63
+)
+
+// NormalizeAddr validates a node address in the form of host:port and returns its canonical form,
+// so that equivalent addresses are compared equal: the port is decimal without leading zeros, an
+// IP host is formatted by net.IP.String, e.g., IPv4-mapped IPv6 addresses are formatted as IPv4,
+// and a hostname is lower-cased without the trailing dot. Names are not resolved, so a hostname
+// and its IP are still different addresses. The host can be empty, e.g., ":8080".
+func NormalizeAddr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", ErrInvalidAddr
+	}
+
+	// named ports are not accepted, since resolving them depends on the local services database
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return "", ErrInvalidAddr
+	}
+
+	if host, err = normalizeHost(host); err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, strconv.FormatUint(p, 10)), nil
+}
+
+func normalizeHost(host string) (string, error) {
+	if host == "" {
+		return host, nil
+	}
+
+	ip, zone := host, ""
+	if i := strings.LastIndexByte(host, '%'); i >= 0 {
+		ip, zone = host[:i], host[i:]
+	}
+
+	if parsed := net.ParseIP(ip); parsed != nil {
+		if zone != "" && (parsed.To4() != nil || len(zone) == 1) {
+			return "", ErrInvalidAddr
+		}
+		return parsed.String() + zone, nil
+	}
+
+	if zone != "" {
+		return "", ErrInvalidAddr
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "" || len(host) > maxHostnameLength {
+		return "", ErrInvalidAddr
+	}
+
+	labels := strings.Split(host, ".")
+
+	// a numeric top-level label is a malformed IP, e.g., 127.0.0.01
+	if strings.Trim(labels[len(labels)-1], "0123456789") == "" {
+		return "", ErrInvalidAddr
+	}
+
+	for _, label := range labels {
+		if label == "" || len(label) > maxLabelLength ||
+			label[0] == '-' || label[len(label)-1] == '-' {
+			return "", ErrInvalidAddr
+		}
+
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return "", ErrInvalidAddr
+			}
+		}
+	}
+
+	return host, nil
+}
@@ -0,0 +1,84 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proto
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestNormalizeAddr(t *testing.T) {
+	Convey("equivalent addresses are normalized identically", t, func() {
+		for normalized, addrs := range map[string][]string{
+			"127.0.0.1:80": {
+				"127.0.0.1:80",
+				"127.0.0.1:0080",
+				"[::ffff:127.0.0.1]:80",
+				"[::FFFF:7f00:1]:080",
+			},
+			"[::1]:2120": {
+				"[::1]:2120",
+				"[0:0:0:0:0:0:0:1]:2120",
+				"[0000::0001]:02120",
+			},
+			"[fe80::1%eth0]:2120": {
+				"[fe80::1%eth0]:2120",
+				"[FE80:0::1%eth0]:2120",
+			},
+			"node-1.example.com:2120": {
+				"node-1.example.com:2120",
+				"Node-1.Example.COM:2120",
+				"node-1.example.com.:2120",
+			},
+			":8080": {
+				":8080",
+				":08080",
+			},
+		} {
+			for _, addr := range addrs {
+				n, err := NormalizeAddr(addr)
+				So(err, ShouldBeNil)
+				So(n, ShouldEqual, normalized)
+			}
+		}
+	})
+
+	Convey("malformed addresses are rejected", t, func() {
+		for _, addr := range []string{
+			"",
+			"garbage",
+			"127.0.0.1",
+			"127.0.0.1:",
+			"127.0.0.1:http",
+			"127.0.0.1:65536",
+			"127.0.0.1:-1",
+			"127.0.0.01:80",
+			"999.0.0.1:80",
+			"::1:80",
+			"[127.0.0.1%eth0]:80",
+			"[fe80::1%]:80",
+			"bad host:80",
+			"-node.example.com:80",
+			"node..example.com:80",
+			".:80",
+		} {
+			_, err := NormalizeAddr(addr)
+			So(err, ShouldEqual, ErrInvalidAddr)
+		}
+	})
+}
@@ -17,6 +17,10 @@
 package proto
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -32,6 +36,10 @@ var (
 	NewNodeIDDifficultyTimeout = 60 * time.Second
 )
 
+// ErrNodeBufferLength indicates that the buffer to unmarshal a Node is truncated or has trailing
+// bytes.
+var ErrNodeBufferLength = errors.New("unexpected node buffer length")
+
 // RawNodeID is node name, will be generated from Hash(nodePublicKey)
 // RawNodeID length should be 32 bytes normally
 type RawNodeID struct {
@@ -89,3 +97,78 @@ func (node *Node) InitNodeCryptoInfo() (err error) {
 	log.Debugf("Node: %v", node)
 	return
 }
+
+// MarshalBinary implements encoding.BinaryMarshaler. It encodes the fields in the fixed order
+// ID, Addr, PublicKey and Nonce, so equal nodes are always encoded to the same bytes, which is
+// suitable for hashing.
+//
+// The layout is the same as utils.WriteElements with binary.BigEndian, which is not imported to
+// avoid import cycle: strings and the serialized public key are prefixed by their uint32 lengths,
+// a nil public key is encoded as an empty byte slice, and the nonce is encoded as 32 bytes.
+func (node *Node) MarshalBinary() ([]byte, error) {
+	buffer := bytes.NewBuffer(nil)
+	var pub []byte
+
+	if node.PublicKey != nil {
+		pub = node.PublicKey.Serialize()
+	}
+
+	for _, b := range [][]byte{[]byte(node.ID), []byte(node.Addr), pub} {
+		if err := binary.Write(buffer, binary.BigEndian, uint32(len(b))); err != nil {
+			return nil, err
+		}
+
+		buffer.Write(b)
+	}
+
+	buffer.Write(node.Nonce.Bytes())
+	return buffer.Bytes(), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler, see MarshalBinary for the layout.
+func (node *Node) UnmarshalBinary(data []byte) (err error) {
+	reader := bytes.NewReader(data)
+	fields := make([][]byte, 3)
+
+	for i := range fields {
+		var length uint32
+
+		if err = binary.Read(reader, binary.BigEndian, &length); err != nil {
+			return ErrNodeBufferLength
+		}
+
+		if uint64(length) > uint64(reader.Len()) {
+			return ErrNodeBufferLength
+		}
+
+		fields[i] = make([]byte, length)
+
+		if _, err = io.ReadFull(reader, fields[i]); err != nil {
+			return ErrNodeBufferLength
+		}
+	}
+
+	if reader.Len() != binary.Size(node.Nonce) {
+		return ErrNodeBufferLength
+	}
+
+	var nonce mine.Uint256
+
+	if err = binary.Read(reader, binary.BigEndian, &nonce); err != nil {
+		return
+	}
+
+	var pub *asymmetric.PublicKey
+
+	if len(fields[2]) > 0 {
+		if pub, err = asymmetric.ParsePubKey(fields[2]); err != nil {
+			return
+		}
+	}
+
+	node.ID = NodeID(fields[0])
+	node.Addr = string(fields[1])
+	node.PublicKey = pub
+	node.Nonce = nonce
+	return nil
+}
@@ -17,12 +17,15 @@
 package proto
 
 import (
+	"bytes"
 	"testing"
 
 	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
+	"github.com/thunderdb/ThunderDB/crypto/asymmetric"
 	"github.com/thunderdb/ThunderDB/crypto/hash"
+	mine "github.com/thunderdb/ThunderDB/pow/cpuminer"
 )
 
 func TestNode_InitNodeCryptoInfo(t *testing.T) {
@@ -52,3 +55,65 @@ func TestNode_InitNodeCryptoInfo(t *testing.T) {
 		So((*NodeID)(nil).Difficulty(), ShouldEqual, -1)
 	})
 }
+
+func TestNode_MarshalBinary(t *testing.T) {
+	Convey("round trip with nil public key", t, func() {
+		node := &Node{
+			ID:   "abc",
+			Addr: "addr",
+			Nonce: mine.Uint256{
+				A: 1,
+				B: 2,
+				C: 3,
+				D: 4,
+			},
+		}
+		buf, err := node.MarshalBinary()
+		So(err, ShouldBeNil)
+
+		dec := NewNode()
+		err = dec.UnmarshalBinary(buf)
+		So(err, ShouldBeNil)
+		So(dec, ShouldResemble, node)
+	})
+	Convey("round trip with public key", t, func() {
+		_, pub, err := asymmetric.GenSecp256k1KeyPair()
+		So(err, ShouldBeNil)
+		node := &Node{
+			ID:        "def",
+			Addr:      "127.0.0.1:2120",
+			PublicKey: pub,
+			Nonce:     mine.Uint256{D: 1 << 63},
+		}
+		buf, err := node.MarshalBinary()
+		So(err, ShouldBeNil)
+
+		dec := NewNode()
+		err = dec.UnmarshalBinary(buf)
+		So(err, ShouldBeNil)
+		So(dec.ID, ShouldEqual, node.ID)
+		So(dec.Addr, ShouldEqual, node.Addr)
+		So(dec.Nonce, ShouldResemble, node.Nonce)
+		So(dec.PublicKey.IsEqual(pub), ShouldBeTrue)
+
+		// equal nodes are encoded to identical bytes
+		buf2, err := dec.MarshalBinary()
+		So(err, ShouldBeNil)
+		So(bytes.Equal(buf, buf2), ShouldBeTrue)
+		copied := *node
+		buf3, err := copied.MarshalBinary()
+		So(err, ShouldBeNil)
+		So(bytes.Equal(buf, buf3), ShouldBeTrue)
+	})
+	Convey("unmarshal malformed buffers", t, func() {
+		node := &Node{ID: "abc", Addr: "addr"}
+		buf, err := node.MarshalBinary()
+		So(err, ShouldBeNil)
+
+		dec := NewNode()
+		So(dec.UnmarshalBinary(buf[:len(buf)-1]), ShouldEqual, ErrNodeBufferLength)
+		So(dec.UnmarshalBinary(append(buf, 0)), ShouldEqual, ErrNodeBufferLength)
+		So(dec.UnmarshalBinary([]byte{0, 0, 0xff, 0xff}), ShouldEqual, ErrNodeBufferLength)
+		So(dec.UnmarshalBinary(nil), ShouldEqual, ErrNodeBufferLength)
+	})
+}
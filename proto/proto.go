@@ -27,11 +27,15 @@ type EnvelopeAPI interface {
 	GetTTL() time.Duration
 	GetExpire() time.Duration
 	GetNodeID() *RawNodeID
+	GetRequestID() string
+	GetTraceID() string
 
 	SetVersion(string)
 	SetTTL(time.Duration)
 	SetExpire(time.Duration)
 	SetNodeID(*RawNodeID)
+	SetRequestID(string)
+	SetTraceID(string)
 }
 
 // Envelope is the protocol header
@@ -40,6 +44,10 @@ type Envelope struct {
 	TTL     time.Duration
 	Expire  time.Duration
 	NodeID  *RawNodeID
+	// RequestID identifies a single rpc call
+	RequestID string
+	// TraceID is shared by all the rpc calls originated from the same request
+	TraceID string
 }
 
 // PingReq is Ping RPC request
@@ -90,6 +98,16 @@ func (e *Envelope) GetNodeID() *RawNodeID {
 	return e.NodeID
 }
 
+// GetRequestID implements EnvelopeAPI.GetRequestID
+func (e *Envelope) GetRequestID() string {
+	return e.RequestID
+}
+
+// GetTraceID implements EnvelopeAPI.GetTraceID
+func (e *Envelope) GetTraceID() string {
+	return e.TraceID
+}
+
 // SetVersion implements EnvelopeAPI.SetVersion
 func (e *Envelope) SetVersion(ver string) {
 	e.Version = ver
@@ -109,3 +127,13 @@ func (e *Envelope) SetExpire(exp time.Duration) {
 func (e *Envelope) SetNodeID(nodeID *RawNodeID) {
 	e.NodeID = nodeID
 }
+
+// SetRequestID implements EnvelopeAPI.SetRequestID
+func (e *Envelope) SetRequestID(id string) {
+	e.RequestID = id
+}
+
+// SetTraceID implements EnvelopeAPI.SetTraceID
+func (e *Envelope) SetTraceID(id string) {
+	e.TraceID = id
+}
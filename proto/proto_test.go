@@ -42,5 +42,11 @@ func TestEnvelope_GetSet(t *testing.T) {
 
 		env.SetVersion("0.0.1")
 		So(env.GetVersion(), ShouldEqual, "0.0.1")
+
+		env.SetRequestID("req")
+		So(env.GetRequestID(), ShouldEqual, "req")
+
+		env.SetTraceID("trace")
+		So(env.GetTraceID(), ShouldEqual, "trace")
 	})
 }
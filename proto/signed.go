@@ -0,0 +1,104 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+
+	"github.com/thunderdb/ThunderDB/crypto/asymmetric"
+	"github.com/thunderdb/ThunderDB/crypto/hash"
+)
+
+var (
+	// ErrNilSignature indicates that a SignedEnvelope is not signed.
+	ErrNilSignature = errors.New("nil signature")
+
+	// ErrSignatureNotMatch indicates that the signature of a SignedEnvelope doesn't match its
+	// payload and signer.
+	ErrSignatureNotMatch = errors.New("signature not match")
+)
+
+// PublicKeyResolver resolves the public key of a node, e.g., kms.GetPublicKey.
+type PublicKeyResolver func(id NodeID) (*asymmetric.PublicKey, error)
+
+// SignedEnvelope carries a payload signed by the node Signer. The signature covers both Signer and
+// Payload, so neither of them can be altered without invalidating the envelope.
+//
+// The signer's public key is not carried by the envelope, it's resolved on verification instead,
+// see kms.VerifyEnvelope.
+type SignedEnvelope struct {
+	Payload   []byte
+	Signer    NodeID
+	Signature *asymmetric.Signature
+}
+
+// NewSignedEnvelope returns a new SignedEnvelope of payload signed by the node signer with its
+// private key.
+func NewSignedEnvelope(payload []byte, signer NodeID, priv *asymmetric.PrivateKey) (
+	e *SignedEnvelope, err error) {
+	e = &SignedEnvelope{
+		Payload: payload,
+		Signer:  signer,
+	}
+
+	if err = e.Sign(priv); err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+// digest returns the hash to be signed, it's computed from the uint32 length prefixed Signer
+// followed by Payload.
+func (e *SignedEnvelope) digest() hash.Hash {
+	buffer := bytes.NewBuffer(make([]byte, 0, 4+len(e.Signer)+len(e.Payload)))
+	binary.Write(buffer, binary.BigEndian, uint32(len(e.Signer)))
+	buffer.WriteString(string(e.Signer))
+	buffer.Write(e.Payload)
+	return hash.THashH(buffer.Bytes())
+}
+
+// Sign signs the envelope with the private key of Signer.
+func (e *SignedEnvelope) Sign(priv *asymmetric.PrivateKey) (err error) {
+	h := e.digest()
+	e.Signature, err = priv.Sign(h[:])
+	return
+}
+
+// Verify verifies the envelope signature with the public key of Signer, which is resolved by
+// resolve.
+func (e *SignedEnvelope) Verify(resolve PublicKeyResolver) (err error) {
+	if e.Signature == nil {
+		return ErrNilSignature
+	}
+
+	pub, err := resolve(e.Signer)
+
+	if err != nil {
+		return
+	}
+
+	h := e.digest()
+
+	if pub == nil || !e.Signature.Verify(h[:], pub) {
+		return ErrSignatureNotMatch
+	}
+
+	return nil
+}
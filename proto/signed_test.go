@@ -0,0 +1,80 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proto
+
+import (
+	"errors"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/thunderdb/ThunderDB/crypto/asymmetric"
+)
+
+func TestSignedEnvelope(t *testing.T) {
+	priv, pub, err := asymmetric.GenSecp256k1KeyPair()
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	errUnknownNode := errors.New("unknown node")
+	keys := map[NodeID]*asymmetric.PublicKey{
+		"node1": pub,
+	}
+	resolve := func(id NodeID) (*asymmetric.PublicKey, error) {
+		if pub, ok := keys[id]; ok {
+			return pub, nil
+		}
+
+		return nil, errUnknownNode
+	}
+
+	Convey("sign and verify envelope", t, func() {
+		e, err := NewSignedEnvelope([]byte("payload"), "node1", priv)
+		So(err, ShouldBeNil)
+		So(e.Verify(resolve), ShouldBeNil)
+	})
+	Convey("detect tampering", t, func() {
+		e, err := NewSignedEnvelope([]byte("payload"), "node1", priv)
+		So(err, ShouldBeNil)
+		e.Payload[0] ^= 0xff
+		So(e.Verify(resolve), ShouldEqual, ErrSignatureNotMatch)
+
+		// signer is covered by the signature too
+		keys["node2"] = pub
+		e, err = NewSignedEnvelope([]byte("payload"), "node1", priv)
+		So(err, ShouldBeNil)
+		e.Signer = "node2"
+		So(e.Verify(resolve), ShouldEqual, ErrSignatureNotMatch)
+	})
+	Convey("reject wrong signer key", t, func() {
+		_, otherPub, err := asymmetric.GenSecp256k1KeyPair()
+		So(err, ShouldBeNil)
+		keys["node3"] = otherPub
+		e, err := NewSignedEnvelope([]byte("payload"), "node3", priv)
+		So(err, ShouldBeNil)
+		So(e.Verify(resolve), ShouldEqual, ErrSignatureNotMatch)
+	})
+	Convey("reject unknown node and unsigned envelope", t, func() {
+		e, err := NewSignedEnvelope([]byte("payload"), "unknown", priv)
+		So(err, ShouldBeNil)
+		So(e.Verify(resolve), ShouldEqual, errUnknownNode)
+
+		e = &SignedEnvelope{Payload: []byte("payload"), Signer: "node1"}
+		So(e.Verify(resolve), ShouldEqual, ErrNilSignature)
+	})
+}
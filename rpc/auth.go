@@ -0,0 +1,148 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpc
+
+import (
+	"errors"
+	"net/rpc"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/thunderdb/ThunderDB/proto"
+)
+
+// ErrUnauthorized indicates the request is rejected since the caller is not allowed to call the
+// method by ServerOptions.AccessPolicy.
+var ErrUnauthorized = errors.New("rpc: unauthorized")
+
+// RoleResolver returns the role of the node, e.g. the role in kayak.Peers, ok is false if the
+// node is unknown.
+type RoleResolver func(nodeID proto.NodeID) (role string, ok bool)
+
+// AccessPolicy decides which roles are allowed to call each method. The caller is identified by
+// the node id authenticated on the etls connection, and its role is resolved by RoleResolver.
+// Methods without rule are open to all the callers, including the unauthenticated ones.
+type AccessPolicy struct {
+	resolve RoleResolver
+
+	mu    sync.RWMutex // Protects following fields
+	rules map[string]map[string]bool
+}
+
+// NewAccessPolicy returns a new AccessPolicy resolving roles with resolve.
+func NewAccessPolicy(resolve RoleResolver) *AccessPolicy {
+	return &AccessPolicy{
+		resolve: resolve,
+		rules:   make(map[string]map[string]bool),
+	}
+}
+
+// Allow restricts the method, in the form of "Service.Method", to the callers of roles, it can
+// be called multiple times to allow more roles.
+func (p *AccessPolicy) Allow(serviceMethod string, roles ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	allowed, ok := p.rules[serviceMethod]
+	if !ok {
+		allowed = make(map[string]bool)
+		p.rules[serviceMethod] = allowed
+	}
+	for _, role := range roles {
+		allowed[role] = true
+	}
+}
+
+// Authorize returns ErrUnauthorized if the node is not allowed to call the method, nodeID is nil
+// if the caller is not authenticated.
+func (p *AccessPolicy) Authorize(nodeID *proto.RawNodeID, serviceMethod string) error {
+	p.mu.RLock()
+	allowed, ok := p.rules[serviceMethod]
+	p.mu.RUnlock()
+
+	if !ok {
+		return nil
+	}
+	if nodeID == nil {
+		return ErrUnauthorized
+	}
+
+	role, ok := p.resolve(proto.NodeID(nodeID.String()))
+	if !ok {
+		return ErrUnauthorized
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if !allowed[role] {
+		return ErrUnauthorized
+	}
+	return nil
+}
+
+// AuthServerCodec wraps normal rpc.ServerCodec and rejects the requests denied by AccessPolicy
+// with ErrUnauthorized before the method is called.
+type AuthServerCodec struct {
+	rpc.ServerCodec
+	policy *AccessPolicy
+	nodeID *proto.RawNodeID
+
+	mu     sync.Mutex // Protects following fields
+	method string
+}
+
+// NewAuthServerCodec returns new AuthServerCodec with normal rpc.ServerCodec, the policy and the
+// authenticated node id of connection.
+func NewAuthServerCodec(codec rpc.ServerCodec, policy *AccessPolicy, nodeID *proto.RawNodeID) *AuthServerCodec {
+	return &AuthServerCodec{
+		ServerCodec: codec,
+		policy:      policy,
+		nodeID:      nodeID,
+	}
+}
+
+// ReadRequestHeader override default rpc.ServerCodec behaviour and record the method of request
+func (ac *AuthServerCodec) ReadRequestHeader(r *rpc.Request) (err error) {
+	if err = ac.ServerCodec.ReadRequestHeader(r); err != nil {
+		return
+	}
+
+	// net/rpc reads header and body of a request in turn
+	ac.mu.Lock()
+	ac.method = r.ServiceMethod
+	ac.mu.Unlock()
+
+	return
+}
+
+// ReadRequestBody override default rpc.ServerCodec behaviour and reject unauthorized request
+func (ac *AuthServerCodec) ReadRequestBody(body interface{}) (err error) {
+	if err = ac.ServerCodec.ReadRequestBody(body); err != nil {
+		return
+	}
+
+	ac.mu.Lock()
+	method := ac.method
+	ac.mu.Unlock()
+
+	if err = ac.policy.Authorize(ac.nodeID, method); err != nil {
+		log.Warnf("unauthorized call of %s from %v", method, ac.nodeID)
+	}
+
+	return
+}
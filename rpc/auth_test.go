@@ -0,0 +1,137 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpc
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/thunderdb/ThunderDB/crypto/etls"
+	"github.com/thunderdb/ThunderDB/crypto/hash"
+	"github.com/thunderdb/ThunderDB/proto"
+)
+
+var authCipherKey = []byte("auth test key")
+
+// authCipherHandler reads the node id sent by dialAuthClient, which identifies the caller.
+func authCipherHandler(conn net.Conn) (cryptoConn *etls.CryptoConn, err error) {
+	var h hash.Hash
+	if _, err = io.ReadFull(conn, h[:]); err != nil {
+		return
+	}
+	cryptoConn = etls.NewConn(conn, etls.NewCipher(authCipherKey), &proto.RawNodeID{Hash: h})
+	return
+}
+
+func dialAuthClient(addr string, nodeID *proto.RawNodeID) (client *Client, err error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return
+	}
+	if _, err = conn.Write(nodeID.Hash[:]); err != nil {
+		return
+	}
+	return InitClientConn(etls.NewConn(conn, etls.NewCipher(authCipherKey), nil))
+}
+
+func TestServer_AccessPolicy(t *testing.T) {
+	leader := &proto.RawNodeID{Hash: hash.HashH([]byte("leader"))}
+	follower := &proto.RawNodeID{Hash: hash.HashH([]byte("follower"))}
+	stranger := &proto.RawNodeID{Hash: hash.HashH([]byte("stranger"))}
+	roles := map[proto.NodeID]string{
+		proto.NodeID(leader.String()):   "Leader",
+		proto.NodeID(follower.String()): "Follower",
+	}
+
+	policy := NewAccessPolicy(func(nodeID proto.NodeID) (role string, ok bool) {
+		role, ok = roles[nodeID]
+		return
+	})
+	policy.Allow("Test.IncCounter", "Leader")
+
+	Convey("leader only method", t, func() {
+		l, err := etls.NewCryptoListener("tcp", "127.0.0.1:0", authCipherHandler)
+		So(err, ShouldBeNil)
+
+		service := NewTestService()
+		server := NewServerWithOptions(ServerOptions{
+			AccessPolicy: policy,
+			// unauthorized requests are not served from cache
+			CacheTTL: time.Hour,
+		})
+		So(server.RegisterCacheableService("Test", service, "IncCounter"), ShouldBeNil)
+		server.SetListener(l)
+		go server.Serve()
+		defer server.Stop()
+
+		leaderClient, err := dialAuthClient(l.Addr().String(), leader)
+		So(err, ShouldBeNil)
+		defer leaderClient.Close()
+		followerClient, err := dialAuthClient(l.Addr().String(), follower)
+		So(err, ShouldBeNil)
+		defer followerClient.Close()
+		strangerClient, err := dialAuthClient(l.Addr().String(), stranger)
+		So(err, ShouldBeNil)
+		defer strangerClient.Close()
+
+		rep := new(TestRep)
+		So(leaderClient.Call("Test.IncCounter", &TestReq{Step: 10}, rep), ShouldBeNil)
+		So(rep.Ret, ShouldEqual, 10)
+
+		rep = new(TestRep)
+		So(followerClient.Call("Test.IncCounter", &TestReq{Step: 10}, rep), ShouldEqual,
+			ErrUnauthorized)
+		So(strangerClient.Call("Test.IncCounter", &TestReq{Step: 10}, rep), ShouldEqual,
+			ErrUnauthorized)
+		So(rep.Ret, ShouldEqual, 0)
+		So(service.counter, ShouldEqual, 10)
+
+		// method without rule is open
+		var ret int
+		So(followerClient.Call("Test.IncCounterSimpleArgs", 1, &ret), ShouldBeNil)
+		So(ret, ShouldEqual, 11)
+
+		// more roles allowed
+		policy.Allow("Test.IncCounter", "Follower")
+		So(followerClient.Call("Test.IncCounter", &TestReq{Step: 1}, rep), ShouldBeNil)
+		So(rep.Ret, ShouldEqual, 12)
+	})
+
+	Convey("unauthenticated caller", t, func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+
+		server := NewServerWithOptions(ServerOptions{AccessPolicy: policy})
+		So(server.RegisterService("Test", NewTestService()), ShouldBeNil)
+		server.SetListener(l)
+		go server.Serve()
+		defer server.Stop()
+
+		client, err := InitClient(l.Addr().String())
+		So(err, ShouldBeNil)
+		defer client.Close()
+
+		So(client.Call("Test.IncCounter", &TestReq{Step: 1}, new(TestRep)), ShouldEqual,
+			ErrUnauthorized)
+		var ret int
+		So(client.Call("Test.IncCounterSimpleArgs", 1, &ret), ShouldBeNil)
+		So(ret, ShouldEqual, 1)
+	})
+}
@@ -0,0 +1,268 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	log "github.com/sirupsen/logrus"
+	"github.com/thunderdb/ThunderDB/proto"
+)
+
+// ErrNoBackend indicates all backends of a BalancedClient failed to connect.
+var ErrNoBackend = errors.New("rpc: no available backend")
+
+// DefaultBackendRetryInterval is the default duration a backend is skipped after a connection
+// error.
+const DefaultBackendRetryInterval = 5 * time.Second
+
+// BalanceStrategy defines how BalancedClient picks a backend for a call.
+type BalanceStrategy int
+
+const (
+	// RoundRobin picks the backends in turn.
+	RoundRobin BalanceStrategy = iota
+	// LeastOutstanding picks the backend with the fewest calls in progress, ties are broken in
+	// turn.
+	LeastOutstanding
+)
+
+// BalancedClientOptions defines options of a BalancedClient.
+type BalancedClientOptions struct {
+	// Strategy is the backend picking strategy, RoundRobin by default.
+	Strategy BalanceStrategy
+
+	// RetryInterval is the duration a backend is skipped after a connection error,
+	// DefaultBackendRetryInterval is used if it's not set. Skipped backends are still tried if
+	// all the other backends fail.
+	RetryInterval time.Duration
+
+	// Dial connects to the backend node, the node is resolved via kms and route by default.
+	Dial func(nodeID proto.NodeID) (*Client, error)
+}
+
+// backend is a node of BalancedClient and its connection.
+type backend struct {
+	nodeID      proto.NodeID
+	client      *Client
+	outstanding int
+	downUntil   time.Time
+}
+
+// BalancedClient spreads calls across the nodes serving the same service, and fails over to
+// another node on connection error. A connection to each node is kept and shared by the calls.
+type BalancedClient struct {
+	strategy      BalanceStrategy
+	retryInterval time.Duration
+	dial          func(nodeID proto.NodeID) (*Client, error)
+
+	mu       sync.Mutex // Protects following fields
+	backends []*backend
+	next     int
+}
+
+// NewBalancedClient returns a BalancedClient of the nodes, options can be nil.
+func NewBalancedClient(nodeIDs []proto.NodeID, options *BalancedClientOptions) *BalancedClient {
+	c := &BalancedClient{
+		retryInterval: DefaultBackendRetryInterval,
+		dial:          dialNodeClient,
+	}
+	if options != nil {
+		c.strategy = options.Strategy
+		if options.RetryInterval > 0 {
+			c.retryInterval = options.RetryInterval
+		}
+		if options.Dial != nil {
+			c.dial = options.Dial
+		}
+	}
+	for _, id := range nodeIDs {
+		c.backends = append(c.backends, &backend{nodeID: id})
+	}
+	return c
+}
+
+// dialNodeClient connects to the node with nodeID and initializes a client.
+func dialNodeClient(nodeID proto.NodeID) (*Client, error) {
+	conn, err := DailToNode(nodeID)
+	if err != nil {
+		return nil, err
+	}
+	return InitClientConn(conn)
+}
+
+// Call is like Client.Call on a picked backend.
+func (c *BalancedClient) Call(serviceMethod string, args interface{}, reply interface{}) error {
+	return c.CallContext(context.Background(), serviceMethod, args, reply)
+}
+
+// CallContext is like Client.CallContext on a picked backend. The call is retried on the other
+// backends on connection error, ErrNoBackend is returned if all of them fail.
+func (c *BalancedClient) CallContext(
+	ctx context.Context, serviceMethod string, args interface{}, reply interface{}) error {
+	tried := make(map[*backend]bool)
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		b, client := c.pick(tried)
+		if b == nil {
+			return ErrNoBackend
+		}
+		tried[b] = true
+
+		var err error
+		if client == nil {
+			if client, err = c.connect(b); err != nil {
+				log.Warningf("connect to backend %s failed: %s", b.nodeID, err)
+				c.done(b, nil)
+				continue
+			}
+		}
+
+		err = client.CallContext(ctx, serviceMethod, args, reply)
+		if isConnError(err) {
+			log.Warningf("call %s on backend %s failed: %s", serviceMethod, b.nodeID, err)
+			c.done(b, client)
+			continue
+		}
+
+		c.done(b, nil)
+		return err
+	}
+}
+
+// pick chooses an untried backend by strategy, the backends marked down are chosen only if there
+// is no other one. The returned client is nil if the backend is not connected.
+func (c *BalancedClient) pick(tried map[*backend]bool) (*backend, *Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	var picked, pickedDown *backend
+
+	for i := range c.backends {
+		b := c.backends[(c.next+i)%len(c.backends)]
+		if tried[b] {
+			continue
+		}
+		if now.Before(b.downUntil) {
+			if pickedDown == nil {
+				pickedDown = b
+			}
+			continue
+		}
+		if picked == nil ||
+			(c.strategy == LeastOutstanding && b.outstanding < picked.outstanding) {
+			picked = b
+		}
+		if c.strategy == RoundRobin {
+			break
+		}
+	}
+
+	if picked == nil {
+		picked = pickedDown
+	}
+	if picked == nil {
+		return nil, nil
+	}
+
+	// next round starts after the picked backend
+	for i, b := range c.backends {
+		if b == picked {
+			c.next = i + 1
+			break
+		}
+	}
+
+	picked.outstanding++
+	return picked, picked.client
+}
+
+// connect dials the backend and keeps the connection for later calls.
+func (c *BalancedClient) connect(b *backend) (client *Client, err error) {
+	if client, err = c.dial(b.nodeID); err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if b.client != nil {
+		// connected by a concurrent call
+		client.Close()
+		return b.client, nil
+	}
+	b.client = client
+	return
+}
+
+// done finishes a call on the backend, the backend is marked down if failed is not nil or the
+// backend failed to connect.
+func (c *BalancedClient) done(b *backend, failed *Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b.outstanding--
+	if failed == nil && b.client != nil {
+		b.downUntil = time.Time{}
+		return
+	}
+
+	b.downUntil = time.Now().Add(c.retryInterval)
+	if failed != nil && b.client == failed {
+		b.client = nil
+		failed.Close()
+	}
+}
+
+// Close closes the connections to all backends.
+func (c *BalancedClient) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, b := range c.backends {
+		if b.client != nil {
+			b.client.Close()
+			b.client = nil
+		}
+	}
+}
+
+// isConnError checks if err is caused by a broken connection rather than the remote service.
+func isConnError(err error) bool {
+	switch err {
+	case nil, context.Canceled, context.DeadlineExceeded:
+		// context.DeadlineExceeded implements net.Error
+		return false
+	case rpc.ErrShutdown, io.EOF, io.ErrUnexpectedEOF,
+		yamux.ErrSessionShutdown, yamux.ErrStreamClosed, yamux.ErrConnectionReset:
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
@@ -0,0 +1,159 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpc
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/thunderdb/ThunderDB/proto"
+)
+
+// startTestServices starts a TestService server for each node, and returns the dial function of
+// the nodes. The nodes in down are not served.
+func startTestServices(nodeIDs []proto.NodeID, down map[proto.NodeID]bool) (
+	services map[proto.NodeID]*TestService, dial func(proto.NodeID) (*Client, error), stop func()) {
+	services = make(map[proto.NodeID]*TestService)
+	addrs := make(map[proto.NodeID]string)
+	var servers []*Server
+
+	for _, id := range nodeIDs {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		addrs[id] = l.Addr().String()
+
+		if down[id] {
+			// nobody listens on the address
+			l.Close()
+			continue
+		}
+
+		services[id] = NewTestService()
+		server, err := NewServerWithService(ServiceMap{"Test": services[id]})
+		So(err, ShouldBeNil)
+		server.SetListener(l)
+		go server.Serve()
+		servers = append(servers, server)
+	}
+
+	dial = func(id proto.NodeID) (*Client, error) {
+		addr, ok := addrs[id]
+		if !ok {
+			return nil, errors.New("unknown node")
+		}
+		return InitClient(addr)
+	}
+	stop = func() {
+		for _, s := range servers {
+			s.Stop()
+		}
+	}
+	return
+}
+
+func TestBalancedClient(t *testing.T) {
+	nodeIDs := []proto.NodeID{"node1", "node2", "node3"}
+
+	Convey("round robin across backends", t, func() {
+		services, dial, stop := startTestServices(nodeIDs, nil)
+		defer stop()
+
+		client := NewBalancedClient(nodeIDs, &BalancedClientOptions{Dial: dial})
+		defer client.Close()
+
+		for i := 0; i < 30; i++ {
+			var ret int
+			So(client.Call("Test.IncCounterSimpleArgs", 1, &ret), ShouldBeNil)
+		}
+		for _, id := range nodeIDs {
+			So(services[id].counter, ShouldEqual, 10)
+		}
+
+		// service error is returned without failover
+		So(client.Call("Test.Unknown", 1, new(int)), ShouldNotBeNil)
+	})
+
+	Convey("least outstanding backend", t, func() {
+		services, dial, stop := startTestServices(nodeIDs, nil)
+		defer stop()
+
+		client := NewBalancedClient(nodeIDs, &BalancedClientOptions{
+			Strategy: LeastOutstanding,
+			Dial:     dial,
+		})
+		defer client.Close()
+
+		// ties are broken in turn
+		for i := 0; i < 6; i++ {
+			var ret int
+			So(client.Call("Test.IncCounterSimpleArgs", 1, &ret), ShouldBeNil)
+		}
+		for _, id := range nodeIDs {
+			So(services[id].counter, ShouldEqual, 2)
+		}
+
+		// busy backends are avoided
+		client.backends[0].outstanding = 2
+		client.backends[2].outstanding = 1
+		for i := 0; i < 3; i++ {
+			var ret int
+			So(client.Call("Test.IncCounterSimpleArgs", 1, &ret), ShouldBeNil)
+		}
+		So(services["node1"].counter, ShouldEqual, 2)
+		So(services["node2"].counter, ShouldEqual, 5)
+		So(services["node3"].counter, ShouldEqual, 2)
+	})
+
+	Convey("skip downed backend", t, func() {
+		services, dial, stop := startTestServices(nodeIDs, map[proto.NodeID]bool{"node2": true})
+		defer stop()
+
+		client := NewBalancedClient(nodeIDs, &BalancedClientOptions{
+			Dial:          dial,
+			RetryInterval: time.Hour,
+		})
+		defer client.Close()
+
+		for i := 0; i < 10; i++ {
+			var ret int
+			So(client.Call("Test.IncCounterSimpleArgs", 1, &ret), ShouldBeNil)
+		}
+		So(services["node1"].counter+services["node3"].counter, ShouldEqual, 10)
+		So(services["node1"].counter, ShouldEqual, 5)
+		So(client.backends[1].downUntil.After(time.Now()), ShouldBeTrue)
+		So(client.backends[1].client, ShouldBeNil)
+	})
+
+	Convey("all backends down", t, func() {
+		down := map[proto.NodeID]bool{"node1": true, "node2": true, "node3": true}
+		_, dial, stop := startTestServices(nodeIDs, down)
+		defer stop()
+
+		client := NewBalancedClient(nodeIDs, &BalancedClientOptions{Dial: dial})
+		defer client.Close()
+
+		So(client.Call("Test.IncCounterSimpleArgs", 1, new(int)), ShouldEqual, ErrNoBackend)
+		So(NewBalancedClient(nil, nil).Call("Test.IncCounterSimpleArgs", 1, new(int)),
+			ShouldEqual, ErrNoBackend)
+		for _, b := range client.backends {
+			So(b.outstanding, ShouldEqual, 0)
+		}
+	})
+}
@@ -0,0 +1,286 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpc
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"net/rpc"
+	"sync"
+	"time"
+
+	"github.com/thunderdb/ThunderDB/proto"
+	"github.com/ugorji/go/codec"
+)
+
+// DefaultCacheMaxEntries is the default max number of responses kept by ResponseCache.
+const DefaultCacheMaxEntries = 1024
+
+// errCacheHit makes net/rpc skip calling the method, the cached response is written instead.
+var errCacheHit = errors.New("rpc: cache hit")
+
+// cacheEntry is a cached response.
+type cacheEntry struct {
+	key    string
+	reply  interface{}
+	expire time.Time
+}
+
+// ResponseCache caches the responses of the methods declared cacheable, keyed by method and
+// serialized arguments. The least recently used entry is evicted once it's full, and all the
+// entries are invalidated once the commit index of node advances.
+type ResponseCache struct {
+	ttl        time.Duration
+	maxEntries int
+
+	mu          sync.Mutex // Protects following fields
+	methods     map[string]bool
+	entries     map[string]*list.Element
+	lru         *list.List
+	commitIndex uint64
+}
+
+// NewResponseCache returns a new ResponseCache, DefaultCacheMaxEntries is used if maxEntries is
+// not positive.
+func NewResponseCache(ttl time.Duration, maxEntries int) *ResponseCache {
+	if maxEntries <= 0 {
+		maxEntries = DefaultCacheMaxEntries
+	}
+	return &ResponseCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		methods:    make(map[string]bool),
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// SetCacheable declares the method, in the form of "Service.Method", cacheable.
+func (c *ResponseCache) SetCacheable(serviceMethod string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.methods[serviceMethod] = true
+}
+
+// IsCacheable checks if the method is declared cacheable.
+func (c *ResponseCache) IsCacheable(serviceMethod string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.methods[serviceMethod]
+}
+
+// Get returns the unexpired response of key.
+func (c *ResponseCache) Get(key string) (reply interface{}, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	entry := e.Value.(*cacheEntry)
+	if time.Now().After(entry.expire) {
+		c.remove(e)
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return entry.reply, true
+}
+
+// Put caches the response of key, the response is dropped if the commit index has advanced
+// since commitIndex, which is read by CommitIndex before the method is called.
+func (c *ResponseCache) Put(key string, reply interface{}, commitIndex uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if commitIndex != c.commitIndex {
+		return
+	}
+
+	entry := &cacheEntry{
+		key:    key,
+		reply:  reply,
+		expire: time.Now().Add(c.ttl),
+	}
+	if e, ok := c.entries[key]; ok {
+		e.Value = entry
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Len returns the number of cached responses.
+func (c *ResponseCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// CommitIndex returns the commit index of node known by cache.
+func (c *ResponseCache) CommitIndex() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.commitIndex
+}
+
+// Advance invalidates all the cached responses if commitIndex is greater than the known one.
+func (c *ResponseCache) Advance(commitIndex uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if commitIndex <= c.commitIndex {
+		return
+	}
+	c.commitIndex = commitIndex
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+}
+
+func (c *ResponseCache) remove(e *list.Element) {
+	c.lru.Remove(e)
+	delete(c.entries, e.Value.(*cacheEntry).key)
+}
+
+// cacheKey returns the cache key of method and args, the request specific envelope fields are
+// not counted.
+func cacheKey(serviceMethod string, args interface{}) (key string, err error) {
+	if e, ok := args.(proto.EnvelopeAPI); ok {
+		nodeID, requestID, traceID := e.GetNodeID(), e.GetRequestID(), e.GetTraceID()
+		e.SetNodeID(nil)
+		e.SetRequestID("")
+		e.SetTraceID("")
+		defer func() {
+			e.SetNodeID(nodeID)
+			e.SetRequestID(requestID)
+			e.SetTraceID(traceID)
+		}()
+	}
+
+	buf := bytes.NewBufferString(serviceMethod)
+	buf.WriteByte(0)
+	if err = codec.NewEncoder(buf, &codec.MsgpackHandle{}).Encode(args); err != nil {
+		return
+	}
+	return buf.String(), nil
+}
+
+// pendingCache is a cacheable request being processed.
+type pendingCache struct {
+	key         string
+	commitIndex uint64
+}
+
+// CachedServerCodec wraps normal rpc.ServerCodec and serves the requests of cacheable methods
+// from ResponseCache. A cache hit is reported to net/rpc as a request error to skip calling the
+// method, and the error response is replaced by the cached one.
+type CachedServerCodec struct {
+	rpc.ServerCodec
+	cache *ResponseCache
+
+	mu      sync.Mutex // Protects following fields
+	method  string
+	seq     uint64
+	pending map[uint64]*pendingCache
+	hits    map[uint64]interface{}
+}
+
+// NewCachedServerCodec returns new CachedServerCodec with normal rpc.ServerCodec and the cache.
+func NewCachedServerCodec(codec rpc.ServerCodec, cache *ResponseCache) *CachedServerCodec {
+	return &CachedServerCodec{
+		ServerCodec: codec,
+		cache:       cache,
+		pending:     make(map[uint64]*pendingCache),
+		hits:        make(map[uint64]interface{}),
+	}
+}
+
+// ReadRequestHeader override default rpc.ServerCodec behaviour and record the method of request
+func (cc *CachedServerCodec) ReadRequestHeader(r *rpc.Request) (err error) {
+	if err = cc.ServerCodec.ReadRequestHeader(r); err != nil {
+		return
+	}
+
+	// net/rpc reads header and body of a request in turn
+	cc.mu.Lock()
+	cc.method, cc.seq = r.ServiceMethod, r.Seq
+	cc.mu.Unlock()
+
+	return
+}
+
+// ReadRequestBody override default rpc.ServerCodec behaviour and look up the cache for request
+// of cacheable method
+func (cc *CachedServerCodec) ReadRequestBody(body interface{}) (err error) {
+	if err = cc.ServerCodec.ReadRequestBody(body); err != nil || body == nil {
+		return
+	}
+
+	cc.mu.Lock()
+	method, seq := cc.method, cc.seq
+	cc.mu.Unlock()
+
+	if !cc.cache.IsCacheable(method) {
+		return
+	}
+
+	// read commit index before calling the method
+	commitIndex := cc.cache.CommitIndex()
+	key, err := cacheKey(method, body)
+	if err != nil {
+		// not cacheable args
+		return nil
+	}
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if reply, ok := cc.cache.Get(key); ok {
+		cc.hits[seq] = reply
+		return errCacheHit
+	}
+
+	cc.pending[seq] = &pendingCache{
+		key:         key,
+		commitIndex: commitIndex,
+	}
+	return
+}
+
+// WriteResponse override default rpc.ServerCodec behaviour, write the cached response on cache
+// hit, or cache the successful response of cacheable method
+func (cc *CachedServerCodec) WriteResponse(r *rpc.Response, body interface{}) (err error) {
+	cc.mu.Lock()
+	reply, hit := cc.hits[r.Seq]
+	delete(cc.hits, r.Seq)
+	p := cc.pending[r.Seq]
+	delete(cc.pending, r.Seq)
+	cc.mu.Unlock()
+
+	if hit && r.Error == errCacheHit.Error() {
+		r.Error = ""
+		body = reply
+	} else if p != nil && r.Error == "" {
+		cc.cache.Put(p.key, body, p.commitIndex)
+	}
+
+	return cc.ServerCodec.WriteResponse(r, body)
+}
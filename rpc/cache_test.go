@@ -0,0 +1,167 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpc
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/thunderdb/ThunderDB/proto"
+)
+
+func startCachedServer(options ServerOptions) (server *Server, service *TestService, client *Client) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	So(err, ShouldBeNil)
+
+	service = NewTestService()
+	server = NewServerWithOptions(options)
+	So(server.RegisterCacheableService("Test", service, "IncCounterSimpleArgs"), ShouldBeNil)
+	server.SetListener(l)
+	go server.Serve()
+
+	client, err = InitClient(l.Addr().String())
+	So(err, ShouldBeNil)
+	return
+}
+
+func TestServer_ResponseCache(t *testing.T) {
+	Convey("cacheable method returns memoized result", t, func() {
+		server, service, client := startCachedServer(ServerOptions{CacheTTL: time.Hour})
+		defer server.Stop()
+		defer client.Close()
+
+		for i := 0; i < 3; i++ {
+			var ret int
+			So(client.Call("Test.IncCounterSimpleArgs", 10, &ret), ShouldBeNil)
+			So(ret, ShouldEqual, 10)
+		}
+		So(service.counter, ShouldEqual, 10)
+
+		// different args
+		var ret int
+		So(client.Call("Test.IncCounterSimpleArgs", 5, &ret), ShouldBeNil)
+		So(ret, ShouldEqual, 15)
+		So(server.cache.Len(), ShouldEqual, 2)
+
+		// commit index advancing invalidates the cache
+		server.AdvanceCommitIndex(1)
+		So(server.cache.Len(), ShouldEqual, 0)
+		So(client.Call("Test.IncCounterSimpleArgs", 10, &ret), ShouldBeNil)
+		So(ret, ShouldEqual, 25)
+		server.AdvanceCommitIndex(1)
+		So(client.Call("Test.IncCounterSimpleArgs", 10, &ret), ShouldBeNil)
+		So(ret, ShouldEqual, 25)
+	})
+
+	Convey("non-cacheable method always re-executes", t, func() {
+		server, service, client := startCachedServer(ServerOptions{CacheTTL: time.Hour})
+		defer server.Stop()
+		defer client.Close()
+
+		for i := 1; i <= 3; i++ {
+			rep := new(TestRep)
+			So(client.Call("Test.IncCounter", &TestReq{Step: 10}, rep), ShouldBeNil)
+			So(rep.Ret, ShouldEqual, 10*i)
+		}
+		So(service.counter, ShouldEqual, 30)
+		So(server.cache.Len(), ShouldEqual, 0)
+
+		// errors are not cached
+		So(client.Call("Test.IncCounterSimpleArgs", "bad", new(int)), ShouldNotBeNil)
+		So(server.cache.Len(), ShouldEqual, 0)
+	})
+
+	Convey("cached result expires after ttl", t, func() {
+		server, service, client := startCachedServer(ServerOptions{CacheTTL: 50 * time.Millisecond})
+		defer server.Stop()
+		defer client.Close()
+
+		var ret int
+		So(client.Call("Test.IncCounterSimpleArgs", 10, &ret), ShouldBeNil)
+		So(client.Call("Test.IncCounterSimpleArgs", 10, &ret), ShouldBeNil)
+		So(ret, ShouldEqual, 10)
+
+		time.Sleep(100 * time.Millisecond)
+		So(client.Call("Test.IncCounterSimpleArgs", 10, &ret), ShouldBeNil)
+		So(ret, ShouldEqual, 20)
+		So(service.counter, ShouldEqual, 20)
+	})
+
+	Convey("cache disabled", t, func() {
+		server, service, client := startCachedServer(ServerOptions{})
+		defer server.Stop()
+		defer client.Close()
+
+		var ret int
+		So(client.Call("Test.IncCounterSimpleArgs", 10, &ret), ShouldBeNil)
+		So(client.Call("Test.IncCounterSimpleArgs", 10, &ret), ShouldBeNil)
+		So(ret, ShouldEqual, 20)
+		So(service.counter, ShouldEqual, 20)
+		So(server.cache, ShouldBeNil)
+	})
+}
+
+func TestResponseCache(t *testing.T) {
+	Convey("evict least recently used entry", t, func() {
+		cache := NewResponseCache(time.Hour, 2)
+		cache.Put("a", 1, 0)
+		cache.Put("b", 2, 0)
+		_, ok := cache.Get("a")
+		So(ok, ShouldBeTrue)
+		cache.Put("c", 3, 0)
+		So(cache.Len(), ShouldEqual, 2)
+		_, ok = cache.Get("b")
+		So(ok, ShouldBeFalse)
+		reply, ok := cache.Get("c")
+		So(ok, ShouldBeTrue)
+		So(reply, ShouldEqual, 3)
+	})
+
+	Convey("drop stale response", t, func() {
+		cache := NewResponseCache(time.Hour, 0)
+		commitIndex := cache.CommitIndex()
+		cache.Advance(1)
+		cache.Put("a", 1, commitIndex)
+		So(cache.Len(), ShouldEqual, 0)
+		cache.Put("a", 1, cache.CommitIndex())
+		So(cache.Len(), ShouldEqual, 1)
+		cache.Advance(0)
+		So(cache.Len(), ShouldEqual, 1)
+	})
+
+	Convey("request specific envelope fields are not in key", t, func() {
+		req1 := &proto.PingReq{}
+		req1.SetRequestID("1")
+		req1.SetTraceID("1")
+		req2 := &proto.PingReq{}
+		req2.SetRequestID("2")
+
+		key1, err := cacheKey("DHT.Ping", req1)
+		So(err, ShouldBeNil)
+		key2, err := cacheKey("DHT.Ping", req2)
+		So(err, ShouldBeNil)
+		So(key1, ShouldEqual, key2)
+		So(req1.GetRequestID(), ShouldEqual, "1")
+		So(req1.GetTraceID(), ShouldEqual, "1")
+
+		key3, err := cacheKey("DHT.FindNode", req2)
+		So(err, ShouldBeNil)
+		So(key3, ShouldNotEqual, key2)
+	})
+}
@@ -18,6 +18,7 @@
 package rpc
 
 import (
+	"context"
 	"net"
 	"net/rpc"
 
@@ -150,6 +151,46 @@ func (c *Client) start(conn net.Conn) {
 	c.Client = rpc.NewClientWithCodec(msgpackCodec)
 }
 
+// Call invokes the named function, waits for it to complete, and returns its error status. If
+// args implements proto.EnvelopeAPI, a request id is generated for it. ErrServerBusy is returned
+// if the request is rejected by a busy server, ErrUnauthorized is returned if the caller is not
+// allowed to call the method, and ErrMessageTooLarge is returned if the request is too large.
+func (c *Client) Call(serviceMethod string, args interface{}, reply interface{}) error {
+	return c.CallContext(context.Background(), serviceMethod, args, reply)
+}
+
+// CallContext is like Call, and the trace id carried by ctx, see WithTraceID and
+// EnvelopeContext, is propagated to args. If ctx is done before the call completes, ctx.Err() is
+// returned without waiting for the response, which may still be decoded into reply later, so
+// reply should not be reused in that case.
+func (c *Client) CallContext(
+	ctx context.Context, serviceMethod string, args interface{}, reply interface{}) error {
+	if e, ok := args.(proto.EnvelopeAPI); ok {
+		injectTraceInfo(ctx, e)
+		log.Debugf("calling %s, request id: %s, trace id: %s",
+			serviceMethod, e.GetRequestID(), e.GetTraceID())
+	}
+
+	var err error
+	call := c.Client.Go(serviceMethod, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		err = call.Error
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	switch err {
+	case rpc.ServerError(ErrServerBusy.Error()):
+		return ErrServerBusy
+	case rpc.ServerError(ErrUnauthorized.Error()):
+		return ErrUnauthorized
+	case rpc.ServerError(ErrMessageTooLarge.Error()):
+		return ErrMessageTooLarge
+	}
+	return err
+}
+
 // Close the client RPC connection
 func (c *Client) Close() {
 	c.Client.Close()
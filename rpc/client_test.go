@@ -17,8 +17,10 @@
 package rpc
 
 import (
+	"context"
 	"encoding/hex"
 	"testing"
+	"time"
 
 	"net"
 
@@ -106,3 +108,57 @@ func TestDailToNode(t *testing.T) {
 		So(err, ShouldBeNil)
 	})
 }
+
+type SleepService struct{}
+
+func (s *SleepService) Sleep(ms int, ret *int) error {
+	time.Sleep(time.Duration(ms) * time.Millisecond)
+	*ret = ms
+	return nil
+}
+
+func TestClient_CallContext(t *testing.T) {
+	Convey("call returns on ctx deadline", t, func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+
+		server, err := NewServerWithService(ServiceMap{"Sleep": &SleepService{}})
+		So(err, ShouldBeNil)
+		server.SetListener(l)
+		go server.Serve()
+		defer server.Stop()
+
+		client, err := InitClient(l.Addr().String())
+		So(err, ShouldBeNil)
+		defer client.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		err = client.CallContext(ctx, "Sleep.Sleep", 1000, new(int))
+		So(err == context.DeadlineExceeded, ShouldBeTrue)
+		So(time.Since(start), ShouldBeLessThan, 500*time.Millisecond)
+
+		// the client is still usable
+		var ret int
+		So(client.Call("Sleep.Sleep", 1, &ret), ShouldBeNil)
+		So(ret, ShouldEqual, 1)
+
+		// balanced client returns without failover
+		balanced := NewBalancedClient([]proto.NodeID{"node1"}, &BalancedClientOptions{
+			Dial: func(proto.NodeID) (*Client, error) {
+				return InitClient(l.Addr().String())
+			},
+		})
+		defer balanced.Close()
+
+		ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		start = time.Now()
+		err = balanced.CallContext(ctx, "Sleep.Sleep", 1000, new(int))
+		So(err == context.DeadlineExceeded, ShouldBeTrue)
+		So(time.Since(start), ShouldBeLessThan, 500*time.Millisecond)
+		So(balanced.backends[0].outstanding, ShouldEqual, 0)
+		So(balanced.backends[0].client, ShouldNotBeNil)
+	})
+}
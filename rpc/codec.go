@@ -17,6 +17,7 @@
 package rpc
 
 import (
+	"context"
 	"net/rpc"
 
 	"github.com/thunderdb/ThunderDB/proto"
@@ -56,5 +57,10 @@ func (nc *NodeAwareServerCodec) ReadRequestBody(body interface{}) (err error) {
 	r := body.(proto.EnvelopeAPI)
 	r.SetNodeID(nc.NodeID)
 
+	// callers not using Client.Call may leave the request id empty
+	if r.GetRequestID() == "" {
+		injectTraceInfo(context.Background(), r)
+	}
+
 	return
 }
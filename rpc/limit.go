@@ -0,0 +1,137 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the “License”);
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an “AS IS” BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpc
+
+import (
+	"errors"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// ErrServerBusy indicates the request is rejected since the server is running
+// ServerOptions.MaxConcurrentRequests handlers.
+var ErrServerBusy = errors.New("rpc: server busy")
+
+// ServerOptions defines options of a Server.
+type ServerOptions struct {
+	// MaxConcurrentRequests bounds the number of simultaneously executing handlers of the server,
+	// 0 means unlimited.
+	MaxConcurrentRequests int
+
+	// RejectWhenBusy makes the server reply ErrServerBusy to the excess requests, otherwise they
+	// are queued until a running handler returns.
+	RejectWhenBusy bool
+
+	// CacheTTL enables the response cache of the methods registered by RegisterCacheableService,
+	// a cached response is served for the same method and arguments within CacheTTL.
+	CacheTTL time.Duration
+
+	// CacheMaxEntries bounds the number of cached responses, DefaultCacheMaxEntries is used if
+	// it's not set.
+	CacheMaxEntries int
+
+	// AccessPolicy restricts the methods to the callers of some roles if it's set, the denied
+	// requests are replied with ErrUnauthorized.
+	AccessPolicy *AccessPolicy
+
+	// MaxMessageSize bounds the encoded size of a request, 0 means unlimited. An over-limit
+	// request is replied with ErrMessageTooLarge if possible, and the connection is closed.
+	MaxMessageSize int
+}
+
+// LimitedServerCodec wraps normal rpc.ServerCodec and limits concurrent requests by a semaphore
+// shared among connections. A slot is taken once a request header is read and released after the
+// response is written.
+type LimitedServerCodec struct {
+	rpc.ServerCodec
+	sem    chan struct{}
+	reject bool
+
+	mu       sync.Mutex // Protects following fields
+	rejected map[uint64]bool
+	busy     bool
+}
+
+// NewLimitedServerCodec returns new LimitedServerCodec with normal rpc.ServerCodec and the
+// semaphore.
+func NewLimitedServerCodec(codec rpc.ServerCodec, sem chan struct{}, reject bool) *LimitedServerCodec {
+	return &LimitedServerCodec{
+		ServerCodec: codec,
+		sem:         sem,
+		reject:      reject,
+		rejected:    make(map[uint64]bool),
+	}
+}
+
+// ReadRequestHeader override default rpc.ServerCodec behaviour and acquire a slot for request
+func (lc *LimitedServerCodec) ReadRequestHeader(r *rpc.Request) (err error) {
+	if err = lc.ServerCodec.ReadRequestHeader(r); err != nil {
+		return
+	}
+
+	if !lc.reject {
+		lc.sem <- struct{}{}
+		return
+	}
+
+	select {
+	case lc.sem <- struct{}{}:
+	default:
+		lc.mu.Lock()
+		lc.rejected[r.Seq] = true
+		lc.busy = true
+		lc.mu.Unlock()
+	}
+
+	return
+}
+
+// ReadRequestBody override default rpc.ServerCodec behaviour and reject request if no slot is
+// acquired
+func (lc *LimitedServerCodec) ReadRequestBody(body interface{}) (err error) {
+	if err = lc.ServerCodec.ReadRequestBody(body); err != nil {
+		return
+	}
+
+	// net/rpc reads header and body of a request in turn, so busy belongs to this request
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	if lc.busy {
+		lc.busy = false
+		return ErrServerBusy
+	}
+
+	return
+}
+
+// WriteResponse override default rpc.ServerCodec behaviour and release the slot of request
+func (lc *LimitedServerCodec) WriteResponse(r *rpc.Response, body interface{}) (err error) {
+	err = lc.ServerCodec.WriteResponse(r, body)
+
+	lc.mu.Lock()
+	rejected := lc.rejected[r.Seq]
+	delete(lc.rejected, r.Seq)
+	lc.mu.Unlock()
+
+	if !rejected {
+		<-lc.sem
+	}
+
+	return
+}
@@ -0,0 +1,154 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the “License”);
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an “AS IS” BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpc
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type BlockingService struct {
+	mu      sync.Mutex
+	running int
+	max     int
+	release chan struct{}
+	started chan struct{}
+}
+
+func (s *BlockingService) Block(req int, resp *int) error {
+	s.mu.Lock()
+	s.running++
+	if s.running > s.max {
+		s.max = s.running
+	}
+	s.mu.Unlock()
+
+	s.started <- struct{}{}
+	<-s.release
+
+	s.mu.Lock()
+	s.running--
+	s.mu.Unlock()
+
+	*resp = req
+	return nil
+}
+
+func startLimitedServer(options ServerOptions, service *BlockingService) (server *Server, addr string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	So(err, ShouldBeNil)
+
+	server = NewServerWithOptions(options)
+	So(server.RegisterService("Block", service), ShouldBeNil)
+	server.SetListener(l)
+	go server.Serve()
+
+	return server, l.Addr().String()
+}
+
+func TestServer_MaxConcurrentRequests(t *testing.T) {
+	Convey("queue excess requests", t, func() {
+		service := &BlockingService{
+			release: make(chan struct{}),
+			started: make(chan struct{}, 10),
+		}
+		server, addr := startLimitedServer(ServerOptions{MaxConcurrentRequests: 2}, service)
+		defer server.Stop()
+
+		var wg sync.WaitGroup
+		errs := make([]error, 10)
+		for i := range errs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				client, err := InitClient(addr)
+				if err != nil {
+					errs[i] = err
+					return
+				}
+				defer client.Close()
+				var resp int
+				errs[i] = client.Call("Block.Block", i, &resp)
+			}(i)
+		}
+
+		// only 2 handlers can be started
+		<-service.started
+		<-service.started
+		select {
+		case <-service.started:
+			t.Fatal("handler started beyond the limit")
+		case <-time.After(200 * time.Millisecond):
+		}
+
+		for i := 0; i < 10; i++ {
+			service.release <- struct{}{}
+			if i < 8 {
+				<-service.started
+			}
+		}
+		wg.Wait()
+
+		for _, err := range errs {
+			So(err, ShouldBeNil)
+		}
+		service.mu.Lock()
+		So(service.max, ShouldEqual, 2)
+		service.mu.Unlock()
+	})
+	Convey("reject excess requests", t, func() {
+		service := &BlockingService{
+			release: make(chan struct{}),
+			started: make(chan struct{}, 10),
+		}
+		server, addr := startLimitedServer(
+			ServerOptions{MaxConcurrentRequests: 1, RejectWhenBusy: true}, service)
+		defer server.Stop()
+
+		client, err := InitClient(addr)
+		So(err, ShouldBeNil)
+		defer client.Close()
+
+		blocked := make(chan error, 1)
+		go func() {
+			var resp int
+			blocked <- client.Call("Block.Block", 1, &resp)
+		}()
+		<-service.started
+
+		// rejected request returns immediately
+		var resp int
+		err = client.Call("Block.Block", 2, &resp)
+		So(err, ShouldEqual, ErrServerBusy)
+
+		service.release <- struct{}{}
+		So(<-blocked, ShouldBeNil)
+
+		// slot is released after response
+		go func() {
+			<-service.started
+			service.release <- struct{}{}
+		}()
+		err = client.Call("Block.Block", 3, &resp)
+		So(err, ShouldBeNil)
+		So(resp, ShouldEqual, 3)
+	})
+}
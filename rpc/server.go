@@ -45,15 +45,31 @@ type Server struct {
 	stopCh         chan interface{}
 	serviceMap     ServiceMap
 	Listener       net.Listener
+	options        ServerOptions
+	sem            chan struct{}
+	cache          *ResponseCache
 }
 
 // NewServer return a new Server
 func NewServer() *Server {
-	return &Server{
+	return NewServerWithOptions(ServerOptions{})
+}
+
+// NewServerWithOptions return a new Server with options
+func NewServerWithOptions(options ServerOptions) *Server {
+	s := &Server{
 		rpcServer:  rpc.NewServer(),
 		stopCh:     make(chan interface{}),
 		serviceMap: make(ServiceMap),
+		options:    options,
+	}
+	if options.MaxConcurrentRequests > 0 {
+		s.sem = make(chan struct{}, options.MaxConcurrentRequests)
+	}
+	if options.CacheTTL > 0 {
+		s.cache = NewResponseCache(options.CacheTTL, options.CacheMaxEntries)
 	}
+	return s
 }
 
 // InitRPCServer load the private key, init the crypto transfer layer and register RPC
@@ -151,7 +167,22 @@ func (s *Server) serveRPC(sess *yamux.Session, remoteNodeID *proto.RawNodeID) {
 		log.Error(err)
 		return
 	}
-	msgpackCodec := codec.MsgpackSpecRpc.ServerCodec(conn, &codec.MsgpackHandle{})
+	var msgpackCodec rpc.ServerCodec
+	if s.options.MaxMessageSize > 0 {
+		msgpackCodec = NewSizeLimitedServerCodec(conn, s.options.MaxMessageSize)
+	} else {
+		msgpackCodec = codec.MsgpackSpecRpc.ServerCodec(conn, &codec.MsgpackHandle{})
+	}
+	if s.sem != nil {
+		msgpackCodec = NewLimitedServerCodec(msgpackCodec, s.sem, s.options.RejectWhenBusy)
+	}
+	if s.options.AccessPolicy != nil {
+		// authorize before looking up the cache
+		msgpackCodec = NewAuthServerCodec(msgpackCodec, s.options.AccessPolicy, remoteNodeID)
+	}
+	if s.cache != nil {
+		msgpackCodec = NewCachedServerCodec(msgpackCodec, s.cache)
+	}
 	nodeAwareCodec := NewNodeAwareServerCodec(msgpackCodec, remoteNodeID)
 	s.rpcServer.ServeCodec(nodeAwareCodec)
 }
@@ -161,6 +192,28 @@ func (s *Server) RegisterService(name string, service interface{}) error {
 	return s.rpcServer.RegisterName(name, service)
 }
 
+// RegisterCacheableService is like RegisterService, and the responses of the idempotent methods
+// are cached if ServerOptions.CacheTTL is set.
+func (s *Server) RegisterCacheableService(name string, service interface{}, methods ...string) error {
+	if err := s.RegisterService(name, service); err != nil {
+		return err
+	}
+	if s.cache != nil {
+		for _, m := range methods {
+			s.cache.SetCacheable(name + "." + m)
+		}
+	}
+	return nil
+}
+
+// AdvanceCommitIndex invalidates the cached responses once the commit index of node advances,
+// e.g. a block is pushed to sqlchain, see sqlchain.Config.OnPushBlock.
+func (s *Server) AdvanceCommitIndex(index uint64) {
+	if s.cache != nil {
+		s.cache.Advance(index)
+	}
+}
+
 // Stop Server main loop
 func (s *Server) Stop() {
 	close(s.stopCh)
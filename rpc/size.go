@@ -0,0 +1,156 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpc
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net/rpc"
+
+	"github.com/ugorji/go/codec"
+)
+
+// ErrMessageTooLarge indicates the request is larger than ServerOptions.MaxMessageSize, the
+// connection is closed after the error is replied.
+var ErrMessageTooLarge = errors.New("rpc: message too large")
+
+// sizeLimitedConn counts the bytes of current request read from conn, and fails the reads once
+// the request exceeds limit. Reads are buffered here instead of in the codec, so that the bytes
+// of next request are not counted in advance.
+type sizeLimitedConn struct {
+	io.ReadWriteCloser
+	br *bufio.Reader
+	bw *bufio.Writer
+
+	limit    int64
+	read     int64
+	exceeded bool
+}
+
+// reset starts counting a new request, a connection exceeded the limit stays failed.
+func (c *sizeLimitedConn) reset() {
+	c.read = 0
+}
+
+func (c *sizeLimitedConn) count(n int) error {
+	if c.read += int64(n); c.read > c.limit {
+		c.exceeded = true
+	}
+
+	if c.exceeded {
+		return ErrMessageTooLarge
+	}
+
+	return nil
+}
+
+func (c *sizeLimitedConn) Read(b []byte) (n int, err error) {
+	if c.exceeded {
+		return 0, ErrMessageTooLarge
+	}
+
+	if remaining := c.limit - c.read + 1; int64(len(b)) > remaining {
+		b = b[:remaining]
+	}
+
+	n, err = c.br.Read(b)
+
+	if cerr := c.count(n); cerr != nil {
+		return 0, cerr
+	}
+
+	return
+}
+
+// ReadByte implements io.ByteReader, so that the decoder reads from the buffer directly.
+func (c *sizeLimitedConn) ReadByte() (b byte, err error) {
+	if c.exceeded {
+		return 0, ErrMessageTooLarge
+	}
+
+	if b, err = c.br.ReadByte(); err != nil {
+		return
+	}
+
+	err = c.count(1)
+	return
+}
+
+// UnreadByte implements io.ByteScanner.
+func (c *sizeLimitedConn) UnreadByte() (err error) {
+	if err = c.br.UnreadByte(); err == nil {
+		c.read--
+	}
+
+	return
+}
+
+func (c *sizeLimitedConn) Write(b []byte) (n int, err error) {
+	return c.bw.Write(b)
+}
+
+// Flush flushes the buffered writes, the codec flushes after each response.
+func (c *sizeLimitedConn) Flush() error {
+	return c.bw.Flush()
+}
+
+// SizeLimitedServerCodec is a msgpack rpc.ServerCodec rejecting the requests larger than the
+// limit with ErrMessageTooLarge. The reading of an over-limit request stops once the limit is
+// reached, so that a huge length prefix in the request does not make the server allocate.
+type SizeLimitedServerCodec struct {
+	rpc.ServerCodec
+	conn *sizeLimitedConn
+}
+
+// NewSizeLimitedServerCodec returns new SizeLimitedServerCodec on conn with max request size.
+func NewSizeLimitedServerCodec(conn io.ReadWriteCloser, maxMessageSize int) *SizeLimitedServerCodec {
+	lc := &sizeLimitedConn{
+		ReadWriteCloser: conn,
+		br:              bufio.NewReader(conn),
+		bw:              bufio.NewWriter(conn),
+		limit:           int64(maxMessageSize),
+	}
+	mh := &codec.MsgpackHandle{}
+	// buffering is done by sizeLimitedConn
+	mh.RPCNoBuffer = true
+
+	return &SizeLimitedServerCodec{
+		ServerCodec: codec.MsgpackSpecRpc.ServerCodec(lc, mh),
+		conn:        lc,
+	}
+}
+
+// ReadRequestHeader override default rpc.ServerCodec behaviour and start counting a new request
+func (sc *SizeLimitedServerCodec) ReadRequestHeader(r *rpc.Request) (err error) {
+	sc.conn.reset()
+
+	if err = sc.ServerCodec.ReadRequestHeader(r); err != nil && sc.conn.exceeded {
+		err = ErrMessageTooLarge
+	}
+
+	return
+}
+
+// ReadRequestBody override default rpc.ServerCodec behaviour and reject over-limit request
+func (sc *SizeLimitedServerCodec) ReadRequestBody(body interface{}) (err error) {
+	if err = sc.ServerCodec.ReadRequestBody(body); err != nil && sc.conn.exceeded {
+		err = ErrMessageTooLarge
+	}
+
+	return
+}
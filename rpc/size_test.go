@@ -0,0 +1,96 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpc
+
+import (
+	"net"
+	"net/rpc"
+	"runtime"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type EchoService struct{}
+
+func (s *EchoService) Echo(req string, resp *string) error {
+	*resp = req
+	return nil
+}
+
+func TestServer_MaxMessageSize(t *testing.T) {
+	Convey("reject over-limit request", t, func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+
+		server := NewServerWithOptions(ServerOptions{MaxMessageSize: 1024})
+		So(server.RegisterService("Echo", &EchoService{}), ShouldBeNil)
+		server.SetListener(l)
+		go server.Serve()
+		defer server.Stop()
+
+		client, err := InitClient(l.Addr().String())
+		So(err, ShouldBeNil)
+		defer client.Close()
+
+		// requests within the limit are served
+		var resp string
+		for i := 0; i < 3; i++ {
+			req := strings.Repeat("a", 900)
+			So(client.Call("Echo.Echo", req, &resp), ShouldBeNil)
+			So(resp, ShouldEqual, req)
+		}
+
+		err = client.Call("Echo.Echo", strings.Repeat("a", 4096), &resp)
+		So(err, ShouldEqual, ErrMessageTooLarge)
+
+		// connection is closed
+		err = client.Call("Echo.Echo", "a", &resp)
+		So(err, ShouldNotBeNil)
+	})
+	Convey("huge length prefix is not allocated", t, func() {
+		serverConn, clientConn := net.Pipe()
+		defer clientConn.Close()
+		sc := NewSizeLimitedServerCodec(serverConn, 1024)
+		defer sc.Close()
+
+		go func() {
+			// [0, 1, "Echo.Echo", [str32 of 4GB ...
+			clientConn.Write([]byte{0x94, 0x00, 0x01, 0xa9})
+			clientConn.Write([]byte("Echo.Echo"))
+			clientConn.Write([]byte{0x91, 0xdb, 0xff, 0xff, 0xff, 0xff})
+			clientConn.Write(make([]byte, 4096))
+		}()
+
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		allocated := stats.TotalAlloc
+
+		var req rpc.Request
+		So(sc.ReadRequestHeader(&req), ShouldBeNil)
+		So(req.ServiceMethod, ShouldEqual, "Echo.Echo")
+		var body string
+		So(sc.ReadRequestBody(&body), ShouldEqual, ErrMessageTooLarge)
+
+		runtime.ReadMemStats(&stats)
+		So(stats.TotalAlloc-allocated, ShouldBeLessThan, 16<<20)
+
+		// subsequent reads fail
+		So(sc.ReadRequestHeader(&req), ShouldEqual, ErrMessageTooLarge)
+	})
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the “License”);
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an “AS IS” BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/thunderdb/ThunderDB/proto"
+)
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	traceIDKey
+)
+
+// NewRequestID generates a random request id.
+func NewRequestID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// WithTraceID returns a copy of ctx carrying traceID, which is propagated by Client.CallContext.
+func WithTraceID(ctx context.Context, traceID string) context.Context {
+	return context.WithValue(ctx, traceIDKey, traceID)
+}
+
+// TraceIDFromContext returns the trace id in ctx.
+func TraceIDFromContext(ctx context.Context) (traceID string, ok bool) {
+	traceID, ok = ctx.Value(traceIDKey).(string)
+	return
+}
+
+// RequestIDFromContext returns the request id in ctx.
+func RequestIDFromContext(ctx context.Context) (requestID string, ok bool) {
+	requestID, ok = ctx.Value(requestIDKey).(string)
+	return
+}
+
+// EnvelopeContext returns a context carrying the request id and trace id of a request received by
+// server, the handler should use it for nested calls to propagate the trace id:
+//
+//	func (s *Service) Method(req *Req, resp *Resp) error {
+//		ctx := rpc.EnvelopeContext(req)
+//		return client.CallContext(ctx, "Other.Method", &otherReq, &otherResp)
+//	}
+func EnvelopeContext(e proto.EnvelopeAPI) context.Context {
+	ctx := context.Background()
+
+	if requestID := e.GetRequestID(); requestID != "" {
+		ctx = context.WithValue(ctx, requestIDKey, requestID)
+	}
+
+	if traceID := e.GetTraceID(); traceID != "" {
+		ctx = WithTraceID(ctx, traceID)
+	}
+
+	return ctx
+}
+
+// injectTraceInfo sets request id and trace id of an outgoing request, a new trace is started
+// with the request id if ctx doesn't carry one.
+func injectTraceInfo(ctx context.Context, e proto.EnvelopeAPI) {
+	if e.GetRequestID() == "" {
+		e.SetRequestID(NewRequestID())
+	}
+
+	if traceID, ok := TraceIDFromContext(ctx); ok {
+		e.SetTraceID(traceID)
+	} else if e.GetTraceID() == "" {
+		e.SetTraceID(e.GetRequestID())
+	}
+}
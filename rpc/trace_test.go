@@ -0,0 +1,109 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the “License”);
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an “AS IS” BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpc
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/thunderdb/ThunderDB/proto"
+)
+
+type TraceReq struct {
+	proto.Envelope
+	Nested bool
+}
+
+type TraceResp struct {
+	RequestID       string
+	TraceID         string
+	NestedRequestID string
+	NestedTraceID   string
+}
+
+type TraceService struct {
+	client *Client
+}
+
+func (s *TraceService) Echo(req *TraceReq, resp *TraceResp) (err error) {
+	ctx := EnvelopeContext(req)
+	resp.RequestID, _ = RequestIDFromContext(ctx)
+	resp.TraceID, _ = TraceIDFromContext(ctx)
+
+	if req.Nested {
+		nestedReq := &TraceReq{}
+		nestedResp := new(TraceResp)
+		if err = s.client.CallContext(ctx, "Trace.Echo", nestedReq, nestedResp); err != nil {
+			return
+		}
+		resp.NestedRequestID = nestedResp.RequestID
+		resp.NestedTraceID = nestedResp.TraceID
+	}
+
+	return
+}
+
+func TestRequestIDPropagation(t *testing.T) {
+	Convey("request id and trace id", t, func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+
+		service := &TraceService{}
+		server, err := NewServerWithService(ServiceMap{"Trace": service})
+		So(err, ShouldBeNil)
+		server.SetListener(l)
+		go server.Serve()
+		defer server.Stop()
+
+		service.client, err = InitClient(l.Addr().String())
+		So(err, ShouldBeNil)
+		defer service.client.Close()
+
+		client, err := InitClient(l.Addr().String())
+		So(err, ShouldBeNil)
+		defer client.Close()
+
+		// server sees the generated request id, which also starts a new trace
+		req := &TraceReq{}
+		resp := new(TraceResp)
+		err = client.Call("Trace.Echo", req, resp)
+		So(err, ShouldBeNil)
+		So(req.RequestID, ShouldNotBeEmpty)
+		So(resp.RequestID, ShouldEqual, req.RequestID)
+		So(resp.TraceID, ShouldEqual, req.RequestID)
+
+		// each call gets its own request id
+		req2 := &TraceReq{}
+		err = client.Call("Trace.Echo", req2, resp)
+		So(err, ShouldBeNil)
+		So(req2.RequestID, ShouldNotEqual, req.RequestID)
+
+		// nested calls inherit the caller supplied trace id
+		ctx := WithTraceID(context.Background(), "trace-for-test")
+		req = &TraceReq{Nested: true}
+		resp = new(TraceResp)
+		err = client.CallContext(ctx, "Trace.Echo", req, resp)
+		So(err, ShouldBeNil)
+		So(resp.RequestID, ShouldEqual, req.RequestID)
+		So(resp.TraceID, ShouldEqual, "trace-for-test")
+		So(resp.NestedRequestID, ShouldNotBeEmpty)
+		So(resp.NestedRequestID, ShouldNotEqual, resp.RequestID)
+		So(resp.NestedTraceID, ShouldEqual, "trace-for-test")
+	})
+}
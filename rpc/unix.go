@@ -0,0 +1,85 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the “License”);
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an “AS IS” BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpc
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// UnixSocketPerm is the file mode of the socket file created by NewUnixServer.
+const UnixSocketPerm os.FileMode = 0600
+
+// NewUnixServer returns a new Server listening on a Unix domain socket at path, it's designed
+// for co-located components so no crypto handshake is done. A stale socket file left by a
+// crashed server is removed, but an in-use one is not.
+func NewUnixServer(path string) (server *Server, err error) {
+	if err = removeStaleSocket(path); err != nil {
+		return
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		log.Errorf("listen on unix socket %s failed: %s", path, err)
+		return
+	}
+
+	if err = os.Chmod(path, UnixSocketPerm); err != nil {
+		log.Errorf("set unix socket %s permission failed: %s", path, err)
+		l.Close()
+		return
+	}
+
+	server = NewServer()
+	server.SetListener(l)
+	return
+}
+
+// DialUnix connects to a Server listening on a Unix domain socket at path.
+func DialUnix(path string) (client *Client, err error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		log.Errorf("connect to unix socket %s failed: %s", path, err)
+		return
+	}
+	return InitClientConn(conn)
+}
+
+func removeStaleSocket(path string) (err error) {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return
+	}
+
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a unix socket", path)
+	}
+
+	// check if some server is still listening on it
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("unix socket %s is in use", path)
+	}
+
+	log.Infof("remove stale unix socket %s", path)
+	return os.Remove(path)
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the “License”);
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an “AS IS” BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpc
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestUnixServer(t *testing.T) {
+	Convey("call service over unix socket", t, func() {
+		dir, err := ioutil.TempDir("", "rpc-unix")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "rpc.sock")
+
+		server, err := NewUnixServer(path)
+		So(err, ShouldBeNil)
+		So(server.RegisterService("Test", NewTestService()), ShouldBeNil)
+		go server.Serve()
+		defer server.Stop()
+
+		fi, err := os.Stat(path)
+		So(err, ShouldBeNil)
+		So(fi.Mode().Perm(), ShouldEqual, UnixSocketPerm)
+
+		client, err := DialUnix(path)
+		So(err, ShouldBeNil)
+		defer client.Close()
+
+		rep := new(TestRep)
+		err = client.Call("Test.IncCounter", &TestReq{Step: 10}, rep)
+		So(err, ShouldBeNil)
+		So(rep.Ret, ShouldEqual, 10)
+
+		// in-use socket should not be taken over
+		_, err = NewUnixServer(path)
+		So(err, ShouldNotBeNil)
+	})
+	Convey("stale socket cleanup on restart", t, func() {
+		dir, err := ioutil.TempDir("", "rpc-unix")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "rpc.sock")
+
+		// simulate a crashed server leaving its socket file behind
+		l, err := net.Listen("unix", path)
+		So(err, ShouldBeNil)
+		l.(*net.UnixListener).SetUnlinkOnClose(false)
+		l.Close()
+		_, err = os.Stat(path)
+		So(err, ShouldBeNil)
+
+		server, err := NewUnixServer(path)
+		So(err, ShouldBeNil)
+		So(server.RegisterService("Test", NewTestService()), ShouldBeNil)
+		go server.Serve()
+		defer server.Stop()
+
+		client, err := DialUnix(path)
+		So(err, ShouldBeNil)
+		defer client.Close()
+
+		rep := new(TestRep)
+		err = client.Call("Test.IncCounter", &TestReq{Step: 1}, rep)
+		So(err, ShouldBeNil)
+		So(rep.Ret, ShouldEqual, 1)
+	})
+	Convey("refuse to remove regular file", t, func() {
+		f, err := ioutil.TempFile("", "rpc-unix")
+		So(err, ShouldBeNil)
+		f.Close()
+		defer os.Remove(f.Name())
+
+		_, err = NewUnixServer(f.Name())
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -141,6 +141,64 @@ type Block struct {
 	Queries      []*Query
 }
 
+func (b *Block) marshal() ([]byte, error) {
+	header, err := b.SignedHeader.marshal()
+
+	if err != nil {
+		return nil, err
+	}
+
+	buffer := bytes.NewBuffer(nil)
+
+	if err = utils.WriteElements(buffer, binary.BigEndian,
+		header,
+		uint32(len(b.Queries)),
+	); err != nil {
+		return nil, err
+	}
+
+	for _, q := range b.Queries {
+		if err = utils.WriteElements(buffer, binary.BigEndian, &q.TxnID); err != nil {
+			return nil, err
+		}
+	}
+
+	return buffer.Bytes(), nil
+}
+
+func (b *Block) unmarshal(buf []byte) (err error) {
+	reader := bytes.NewReader(buf)
+	var header []byte
+	var count uint32
+
+	if err = utils.ReadElements(reader, binary.BigEndian, &header, &count); err != nil {
+		return
+	}
+
+	b.SignedHeader = &SignedHeader{}
+
+	if err = b.SignedHeader.unmarshal(header); err != nil {
+		return
+	}
+
+	// Each query takes at least one byte, so count is bounded by the remaining bytes
+	if int(count) > reader.Len() {
+		return ErrFieldLength
+	}
+
+	b.Queries = make([]*Query, count)
+
+	for i := range b.Queries {
+		b.Queries[i] = &Query{}
+
+		if err = utils.ReadElements(reader, binary.BigEndian, &b.Queries[i].TxnID); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
 // SignHeader generates the signature for the Block from the given PrivateKey.
 func (b *Block) SignHeader(signer *asymmetric.PrivateKey) (err error) {
 	buffer, err := b.SignedHeader.Header.marshal()
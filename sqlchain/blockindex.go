@@ -19,21 +19,24 @@ package sqlchain
 import (
 	"encoding/binary"
 	"sync"
+	"time"
 
 	"github.com/thunderdb/ThunderDB/crypto/hash"
 )
 
 type blockNode struct {
-	parent *blockNode
-	hash   hash.Hash
-	height int32
+	parent    *blockNode
+	hash      hash.Hash
+	height    int32
+	timestamp time.Time
 }
 
 func newBlockNode(header *SignedHeader, parent *blockNode) (node *blockNode) {
 	node = &blockNode{
-		hash:   header.BlockHash,
-		parent: nil,
-		height: 0,
+		hash:      header.BlockHash,
+		parent:    nil,
+		height:    0,
+		timestamp: header.Timestamp,
 	}
 
 	if parent != nil {
@@ -48,6 +51,7 @@ func (bn *blockNode) initBlockNode(head *SignedHeader, parent *blockNode) {
 	bn.hash = head.BlockHash
 	bn.parent = nil
 	bn.height = 0
+	bn.timestamp = head.Timestamp
 
 	if parent != nil {
 		bn.parent = parent
@@ -76,26 +80,140 @@ func (bn *blockNode) indexKey() []byte {
 	return indexKey
 }
 
+// ChainEventType is the type of ChainEvent.
+type ChainEventType int
+
+const (
+	// ChainEventConnect indicates the block is connected to the best chain.
+	ChainEventConnect ChainEventType = iota
+
+	// ChainEventDisconnect indicates the block is disconnected from the best chain.
+	ChainEventDisconnect
+)
+
+// ChainEvent notifies a change of the best chain.
+type ChainEvent struct {
+	Type ChainEventType
+	Node *blockNode
+}
+
+// chainSubscriber queues the events for a subscriber, so that the writer never waits for a slow
+// subscriber.
+type chainSubscriber struct {
+	mu     sync.Mutex // Protects following fields
+	queue  []ChainEvent
+	signal chan struct{}
+	quit   chan struct{}
+	out    chan ChainEvent
+}
+
+func newChainSubscriber() (sub *chainSubscriber) {
+	sub = &chainSubscriber{
+		signal: make(chan struct{}, 1),
+		quit:   make(chan struct{}),
+		out:    make(chan ChainEvent),
+	}
+
+	go sub.run()
+	return
+}
+
+func (s *chainSubscriber) push(events []ChainEvent) {
+	s.mu.Lock()
+	s.queue = append(s.queue, events...)
+	s.mu.Unlock()
+
+	select {
+	case s.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (s *chainSubscriber) run() {
+	defer close(s.out)
+
+	for {
+		s.mu.Lock()
+
+		if len(s.queue) == 0 {
+			s.mu.Unlock()
+
+			select {
+			case <-s.signal:
+				continue
+			case <-s.quit:
+				return
+			}
+		}
+
+		event := s.queue[0]
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+
+		select {
+		case s.out <- event:
+		case <-s.quit:
+			return
+		}
+	}
+}
+
 type blockIndex struct {
 	cfg *Config
 
-	mu    sync.RWMutex
-	index map[hash.Hash]*blockNode
+	mu      sync.RWMutex
+	index   map[hash.Hash]*blockNode
+	orphans *orphanPool
+
+	subMu sync.Mutex // Protects following fields
+	subs  map[*chainSubscriber]struct{}
 }
 
 func newBlockIndex(cfg *Config) (index *blockIndex) {
 	index = &blockIndex{
-		cfg:   cfg,
-		index: make(map[hash.Hash]*blockNode),
+		cfg:     cfg,
+		index:   make(map[hash.Hash]*blockNode),
+		orphans: newOrphanPool(cfg.maxOrphans()),
+		subs:    make(map[*chainSubscriber]struct{}),
 	}
 
 	return index
 }
 
-func (bi *blockIndex) AddBlock(newBlock *blockNode) {
+// AddBlock adds newBlock to the index. A block at height 0 must be the configured genesis block
+// if any, and other blocks must extend a block in the index, so that the ancestry of every
+// indexed block terminates at genesis. The timestamp of a block must be later than its parent's,
+// and not later than local time plus the clock skew window, see Config.MaxClockSkew.
+func (bi *blockIndex) AddBlock(newBlock *blockNode) (err error) {
 	bi.mu.Lock()
 	defer bi.mu.Unlock()
+	return bi.addBlock(newBlock)
+}
+
+func (bi *blockIndex) addBlock(newBlock *blockNode) (err error) {
+	if newBlock.parent == nil {
+		if newBlock.height != 0 {
+			return ErrBlockNotConnected
+		}
+
+		if bi.cfg.Genesis != nil && (bi.cfg.Genesis.SignedHeader == nil ||
+			!newBlock.hash.IsEqual(&bi.cfg.Genesis.SignedHeader.BlockHash)) {
+			return ErrGenesisMismatch
+		}
+	} else if parent, ok := bi.index[newBlock.parent.hash]; !ok || parent != newBlock.parent {
+		return ErrBlockNotConnected
+	}
+
+	if newBlock.timestamp.After(time.Now().Add(bi.cfg.maxClockSkew())) {
+		return ErrTimestampInFuture
+	}
+
+	if newBlock.parent != nil && !newBlock.timestamp.After(newBlock.parent.timestamp) {
+		return ErrTimestampTooEarly
+	}
+
 	bi.index[newBlock.hash] = newBlock
+	return
 }
 
 func (bi *blockIndex) HasBlock(hash *hash.Hash) (hasBlock bool) {
@@ -111,3 +229,80 @@ func (bi *blockIndex) LookupNode(hash *hash.Hash) (b *blockNode) {
 	b = bi.index[*hash]
 	return b
 }
+
+// AddOrphan buffers the block whose parent is not in the index yet, see Chain.AddBlock.
+func (bi *blockIndex) AddOrphan(block *Block) {
+	bi.mu.Lock()
+	defer bi.mu.Unlock()
+	bi.orphans.add(block)
+}
+
+// TakeOrphans removes and returns the buffered blocks extending the block of parentHash.
+func (bi *blockIndex) TakeOrphans(parentHash *hash.Hash) []*Block {
+	bi.mu.Lock()
+	defer bi.mu.Unlock()
+	return bi.orphans.takeChildren(parentHash)
+}
+
+// Subscribe returns a channel receiving the ChainEvents of the best chain in order, and a function
+// to cancel the subscription, which closes the channel. The events are queued for the subscriber
+// without blocking the chain.
+func (bi *blockIndex) Subscribe() (<-chan ChainEvent, func()) {
+	sub := newChainSubscriber()
+
+	bi.subMu.Lock()
+	bi.subs[sub] = struct{}{}
+	bi.subMu.Unlock()
+
+	var once sync.Once
+
+	return sub.out, func() {
+		once.Do(func() {
+			bi.subMu.Lock()
+			delete(bi.subs, sub)
+			bi.subMu.Unlock()
+			close(sub.quit)
+		})
+	}
+}
+
+// notifyHead sends the events of moving the best chain from oldHead to newHead to the
+// subscribers: the blocks of the old branch are disconnected from oldHead down to the fork point,
+// then the blocks of the new branch are connected up to newHead.
+func (bi *blockIndex) notifyHead(oldHead, newHead *blockNode) {
+	bi.subMu.Lock()
+	defer bi.subMu.Unlock()
+
+	if len(bi.subs) == 0 {
+		return
+	}
+
+	var connected []*blockNode
+	fork := newHead
+
+	for fork != nil && (oldHead == nil || oldHead.ancestor(fork.height) != fork) {
+		connected = append(connected, fork)
+		fork = fork.parent
+	}
+
+	events := make([]ChainEvent, 0, len(connected))
+
+	for node := oldHead; node != nil && node != fork; node = node.parent {
+		events = append(events, ChainEvent{Type: ChainEventDisconnect, Node: node})
+	}
+
+	for i := len(connected) - 1; i >= 0; i-- {
+		events = append(events, ChainEvent{Type: ChainEventConnect, Node: connected[i]})
+	}
+
+	for sub := range bi.subs {
+		sub.push(events)
+	}
+}
+
+// HasOrphan returns whether the block is buffered in the orphan pool.
+func (bi *blockIndex) HasOrphan(hash *hash.Hash) bool {
+	bi.mu.RLock()
+	defer bi.mu.RUnlock()
+	return bi.orphans.has(hash)
+}
@@ -18,8 +18,11 @@ package sqlchain
 
 import (
 	"testing"
+	"time"
 
+	"github.com/thunderdb/ThunderDB/crypto/asymmetric"
 	"github.com/thunderdb/ThunderDB/crypto/hash"
+	"github.com/thunderdb/ThunderDB/proto"
 )
 
 var (
@@ -114,7 +117,11 @@ func TestAncestor(t *testing.T) {
 
 	for _, b := range testBlocks {
 		bn := newBlockNode(b.SignedHeader, parent)
-		index.AddBlock(bn)
+
+		if err := index.AddBlock(bn); err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+
 		parent = bn
 	}
 
@@ -148,7 +155,11 @@ func TestIndex(t *testing.T) {
 
 	for _, b := range testBlocks {
 		bn := newBlockNode(b.SignedHeader, parent)
-		index.AddBlock(bn)
+
+		if err := index.AddBlock(bn); err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+
 		parent = bn
 	}
 
@@ -166,3 +177,102 @@ func TestIndex(t *testing.T) {
 		}
 	}
 }
+
+func TestIndexGenesis(t *testing.T) {
+	priv, _, err := asymmetric.GenSecp256k1KeyPair()
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	genesis, err := NewGenesis(proto.NodeID("producer"), rootHash,
+		testBlocks[0].SignedHeader.Timestamp, priv)
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if err = genesis.Verify(); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	foreign, err := NewGenesis(proto.NodeID("foreign"), rootHash, time.Now(), priv)
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	index := newBlockIndex(&Config{Genesis: genesis})
+
+	// Reject a foreign genesis
+	if err = index.AddBlock(newBlockNode(foreign.SignedHeader, nil)); err != ErrGenesisMismatch {
+		t.Fatalf("Unexpected result: %v", err)
+	}
+
+	// Accept the configured genesis and its descendants
+	parent := newBlockNode(genesis.SignedHeader, nil)
+
+	if err = index.AddBlock(parent); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	for _, b := range testBlocks[1:] {
+		bn := newBlockNode(b.SignedHeader, parent)
+
+		if err = index.AddBlock(bn); err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+
+		parent = bn
+	}
+
+	// Reject an orphan chain which never reaches genesis
+	orphan := newBlockNode(testBlocks[1].SignedHeader, newBlockNode(foreign.SignedHeader, nil))
+
+	if err = index.AddBlock(orphan); err != ErrBlockNotConnected {
+		t.Fatalf("Unexpected result: %v", err)
+	}
+
+	if err = index.AddBlock(&blockNode{hash: hash.Hash{}, height: 1}); err != ErrBlockNotConnected {
+		t.Fatalf("Unexpected result: %v", err)
+	}
+
+	if index.HasBlock(&foreign.SignedHeader.BlockHash) {
+		t.Fatal("Unexpected result: foreign genesis is indexed")
+	}
+}
+
+func TestIndexTimestamp(t *testing.T) {
+	cfg := &Config{MaxClockSkew: time.Minute}
+	index := newBlockIndex(cfg)
+	parent := newBlockNode(testBlocks[0].SignedHeader, nil)
+
+	if err := index.AddBlock(parent); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	newChild := func(ts time.Time) *blockNode {
+		bn := newBlockNode(testBlocks[1].SignedHeader, parent)
+		bn.timestamp = ts
+		return bn
+	}
+
+	// Backwards timestamp
+	if err := index.AddBlock(newChild(parent.timestamp.Add(-time.Second))); err != ErrTimestampTooEarly {
+		t.Fatalf("Unexpected result: %v", err)
+	}
+
+	if err := index.AddBlock(newChild(parent.timestamp)); err != ErrTimestampTooEarly {
+		t.Fatalf("Unexpected result: %v", err)
+	}
+
+	// Far-future timestamp
+	if err := index.AddBlock(newChild(time.Now().Add(time.Hour))); err != ErrTimestampInFuture {
+		t.Fatalf("Unexpected result: %v", err)
+	}
+
+	// In-window timestamp
+	if err := index.AddBlock(newChild(time.Now().Add(cfg.MaxClockSkew / 2))); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+}
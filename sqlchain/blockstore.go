@@ -0,0 +1,93 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	bolt "github.com/coreos/bbolt"
+	"github.com/thunderdb/ThunderDB/crypto/hash"
+)
+
+var (
+	blockBodyBucket = []byte("thunderdb-block-body-bucket")
+)
+
+// BlockStore stores the full blocks, while the block index only tracks headers.
+type BlockStore interface {
+	// PutBlock stores the block keyed by its block hash.
+	PutBlock(block *Block) error
+
+	// GetBlock loads the block with the block hash, ErrBlockNotFound is returned if it's not
+	// stored.
+	GetBlock(h hash.Hash) (*Block, error)
+}
+
+// BoltBlockStore is a BlockStore implementation on a bolt database.
+type BoltBlockStore struct {
+	db *bolt.DB
+}
+
+// NewBoltBlockStore returns a new BoltBlockStore on the database, it can share the database with
+// chain.
+func NewBoltBlockStore(db *bolt.DB) (store *BoltBlockStore, err error) {
+	err = db.Update(func(tx *bolt.Tx) (err error) {
+		_, err = tx.CreateBucketIfNotExists(blockBodyBucket)
+		return
+	})
+
+	if err != nil {
+		return
+	}
+
+	return &BoltBlockStore{db: db}, nil
+}
+
+// PutBlock implements BlockStore.PutBlock.
+func (s *BoltBlockStore) PutBlock(block *Block) (err error) {
+	if block.SignedHeader == nil {
+		return ErrNilValue
+	}
+
+	buffer, err := block.marshal()
+
+	if err != nil {
+		return
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(blockBodyBucket).Put(block.SignedHeader.BlockHash[:], buffer)
+	})
+}
+
+// GetBlock implements BlockStore.GetBlock.
+func (s *BoltBlockStore) GetBlock(h hash.Hash) (block *Block, err error) {
+	err = s.db.View(func(tx *bolt.Tx) (err error) {
+		buffer := tx.Bucket(blockBodyBucket).Get(h[:])
+
+		if buffer == nil {
+			return ErrBlockNotFound
+		}
+
+		block = &Block{}
+		return block.unmarshal(buffer)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return
+}
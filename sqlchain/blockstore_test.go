@@ -0,0 +1,237 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/thunderdb/ThunderDB/crypto/hash"
+)
+
+func checkSameBlock(t *testing.T, expected, actual *Block) {
+	eb, err := expected.marshal()
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	ab, err := actual.marshal()
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if !bytes.Equal(eb, ab) {
+		t.Fatalf("Block mismatch: expected %s, got %s",
+			expected.SignedHeader.BlockHash.String(), actual.SignedHeader.BlockHash.String())
+	}
+
+	if len(actual.Queries) != len(expected.Queries) {
+		t.Fatalf("Unexpected query count: %d, expected %d",
+			len(actual.Queries), len(expected.Queries))
+	}
+
+	if err = actual.Verify(); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+}
+
+func TestBoltBlockStore(t *testing.T) {
+	fl, err := ioutil.TempFile("", "blockstore")
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	fl.Close()
+	defer os.Remove(fl.Name())
+
+	db, err := bolt.Open(fl.Name(), 0600, nil)
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	defer db.Close()
+
+	store, err := NewBoltBlockStore(db)
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	blocks := make([]*Block, 0, 10)
+
+	for parent := rootHash; len(blocks) < cap(blocks); {
+		block, err := createRandomBlock(parent, false)
+
+		if err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+
+		if err = store.PutBlock(block); err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+
+		blocks = append(blocks, block)
+		parent = block.SignedHeader.BlockHash
+	}
+
+	for _, block := range blocks {
+		stored, err := store.GetBlock(block.SignedHeader.BlockHash)
+
+		if err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+
+		checkSameBlock(t, block, stored)
+	}
+
+	// Missing body
+	if _, err = store.GetBlock(hash.Hash{}); err != ErrBlockNotFound {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if err = store.PutBlock(&Block{}); err != ErrNilValue {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestChainBlockBody(t *testing.T) {
+	fl, err := ioutil.TempFile("", "chain")
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	fl.Close()
+	defer os.Remove(fl.Name())
+
+	genesis, err := createRandomBlock(rootHash, true)
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	chain, err := NewChain(&Config{
+		DataDir: fl.Name(),
+		Genesis: genesis,
+	})
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	blocks := []*Block{genesis}
+
+	for i := 0; i < 5; i++ {
+		block, err := createRandomBlock(blocks[len(blocks)-1].SignedHeader.BlockHash, false)
+
+		if err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+
+		if err = chain.AddBlock(block); err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+
+		blocks = append(blocks, block)
+	}
+
+	// Block not connected to the chain is buffered but not stored
+	unknown, err := createRandomBlock(rootHash, false)
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if err = chain.AddBlock(unknown); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if !chain.index.HasOrphan(&unknown.SignedHeader.BlockHash) {
+		t.Fatal("Unexpected result: orphan block is not buffered")
+	}
+
+	if _, err = chain.GetBlock(unknown.SignedHeader.BlockHash); err != ErrBlockNotFound {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Block on side branch is stored
+	fork, err := createRandomBlock(genesis.SignedHeader.BlockHash, false)
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if err = chain.AddBlock(fork); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	blocks = append(blocks, fork)
+
+	// Header pushed without body
+	headerOnly, err := createRandomBlock(chain.state.Head, false)
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if err = chain.PushBlock(headerOnly.SignedHeader); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	// Reload chain and load bodies lazily
+	chain.db.Close()
+	chain, err = LoadChain(&Config{DataDir: fl.Name()})
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	defer chain.db.Close()
+
+	for _, block := range blocks {
+		if !chain.index.HasBlock(&block.SignedHeader.BlockHash) {
+			t.Fatalf("Block not indexed: %s", block.SignedHeader.BlockHash.String())
+		}
+
+		stored, err := chain.GetBlock(block.SignedHeader.BlockHash)
+
+		if err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+
+		checkSameBlock(t, block, stored)
+	}
+
+	if _, err = chain.GetBlock(unknown.SignedHeader.BlockHash); err != ErrBlockNotFound {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if !chain.index.HasBlock(&headerOnly.SignedHeader.BlockHash) {
+		t.Fatalf("Block not indexed: %s", headerOnly.SignedHeader.BlockHash.String())
+	}
+
+	if _, err = chain.GetBlock(headerOnly.SignedHeader.BlockHash); err != ErrBlockNotFound {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"encoding/binary"
 
 	bolt "github.com/coreos/bbolt"
+	log "github.com/sirupsen/logrus"
 	"github.com/thunderdb/ThunderDB/crypto/hash"
 	"github.com/thunderdb/ThunderDB/utils"
 )
@@ -64,6 +65,7 @@ type Chain struct {
 	cfg          *Config
 	db           *bolt.DB
 	index        *blockIndex
+	blocks       BlockStore
 	pendingBlock *Block
 	state        *State
 }
@@ -99,11 +101,18 @@ func NewChain(cfg *Config) (chain *Chain, err error) {
 		return
 	}
 
+	blocks, err := openBlockStore(cfg, db)
+
+	if err != nil {
+		return
+	}
+
 	// Create chain state
 	chain = &Chain{
 		cfg:          cfg,
 		db:           db,
 		index:        newBlockIndex(cfg),
+		blocks:       blocks,
 		pendingBlock: &Block{},
 		state: &State{
 			node:   nil,
@@ -112,7 +121,7 @@ func NewChain(cfg *Config) (chain *Chain, err error) {
 		},
 	}
 
-	err = chain.PushBlock(cfg.Genesis.SignedHeader)
+	err = chain.AddBlock(cfg.Genesis)
 
 	if err != nil {
 		return nil, err
@@ -137,11 +146,18 @@ func LoadChain(cfg *Config) (chain *Chain, err error) {
 		return
 	}
 
+	blocks, err := openBlockStore(cfg, db)
+
+	if err != nil {
+		return
+	}
+
 	// Create chain state
 	chain = &Chain{
 		cfg:          cfg,
 		db:           db,
 		index:        newBlockIndex(cfg),
+		blocks:       blocks,
 		pendingBlock: &Block{},
 		state:        &State{},
 	}
@@ -198,6 +214,11 @@ func LoadChain(cfg *Config) (chain *Chain, err error) {
 			}
 
 			nodes[index].initBlockNode(header, parent)
+
+			if err = chain.index.AddBlock(&nodes[index]); err != nil {
+				return
+			}
+
 			lastNode = &nodes[index]
 			index++
 		}
@@ -209,9 +230,151 @@ func LoadChain(cfg *Config) (chain *Chain, err error) {
 		return nil, err
 	}
 
+	chain.state.node = chain.index.LookupNode(&chain.state.Head)
+
 	return
 }
 
+// openBlockStore returns the configured block store, or a BoltBlockStore on the chain database.
+func openBlockStore(cfg *Config, db *bolt.DB) (BlockStore, error) {
+	if cfg.BlockStore != nil {
+		return cfg.BlockStore, nil
+	}
+
+	return NewBoltBlockStore(db)
+}
+
+// AddBlock stores the full block and adds its header to the chain. A block extending the best
+// chain is pushed directly, and a block extending another indexed block is added as a side
+// branch, the chain reorganizes to the branch once it's higher than the best chain. The blocks
+// which can never be reverted are configured by Config.CheckpointDepth and Config.Checkpoints.
+//
+// A block whose parent is unknown yet is buffered in the orphan pool, see Config.MaxOrphans.
+// Once a block is added, the buffered blocks extending it, and their buffered descendants, are
+// added in the same way.
+func (c *Chain) AddBlock(block *Block) (err error) {
+	if block.SignedHeader == nil {
+		return ErrNilValue
+	}
+
+	if err = c.addBlock(block); err == ErrParentNotFound {
+		c.index.AddOrphan(block)
+		return nil
+	} else if err != nil {
+		return
+	}
+
+	// Add the orphans which are unblocked by the new blocks
+	for added := []*Block{block}; len(added) > 0; added = added[1:] {
+		for _, orphan := range c.index.TakeOrphans(&added[0].SignedHeader.BlockHash) {
+			if err := c.addBlock(orphan); err != nil {
+				log.Debugf("drop orphan block %s: %v", orphan.SignedHeader.BlockHash.String(), err)
+				continue
+			}
+
+			added = append(added, orphan)
+		}
+	}
+
+	return
+}
+
+func (c *Chain) addBlock(block *Block) (err error) {
+
+	header := block.SignedHeader
+
+	if header.ParentHash == hash.Hash(c.state.Head) {
+		if err = c.checkCheckpoint(header, c.state.Height+1); err != nil {
+			return
+		}
+
+		if err = c.blocks.PutBlock(block); err != nil {
+			return
+		}
+
+		return c.PushBlock(header)
+	}
+
+	if c.index.HasBlock(&header.BlockHash) {
+		return
+	}
+
+	parent := c.index.LookupNode(&header.ParentHash)
+
+	if parent == nil {
+		return ErrParentNotFound
+	}
+
+	if err = c.checkCheckpoint(header, parent.height+1); err != nil {
+		return
+	}
+
+	if err = c.checkFork(parent); err != nil {
+		return
+	}
+
+	node := newBlockNode(header, parent)
+
+	if err = c.index.AddBlock(node); err != nil {
+		return
+	}
+
+	if err = c.blocks.PutBlock(block); err != nil {
+		return
+	}
+
+	if node.height <= c.state.Height {
+		// Side branch
+		return c.writeBlock(node, header, false)
+	}
+
+	return c.setHead(node, header)
+}
+
+// checkCheckpoint checks the block header at height against the pinned checkpoints.
+func (c *Chain) checkCheckpoint(header *SignedHeader, height int32) error {
+	if h, ok := c.cfg.Checkpoints[height]; ok && !h.IsEqual(&header.BlockHash) {
+		return ErrCheckpointMismatch
+	}
+
+	return nil
+}
+
+// checkFork checks that a side branch extending parent doesn't revert any final block of the
+// best chain.
+func (c *Chain) checkFork(parent *blockNode) error {
+	// Find the fork point on the best chain
+	fork := parent
+
+	for fork != nil && c.state.node.ancestor(fork.height) != fork {
+		fork = fork.parent
+	}
+
+	if fork == nil {
+		return ErrBlockNotConnected
+	}
+
+	// The deepest reverted block is the one right above the fork point
+	if depth := c.state.Height - fork.height - 1; c.cfg.CheckpointDepth > 0 &&
+		depth > c.cfg.CheckpointDepth {
+		return ErrReorgBelowCheckpoint
+	}
+
+	for height := range c.cfg.Checkpoints {
+		if height > fork.height && height <= c.state.Height {
+			return ErrReorgBelowCheckpoint
+		}
+	}
+
+	return nil
+}
+
+// GetBlock loads the full block with the block hash from the block store, ErrBlockNotFound is
+// returned if only its header is known.
+func (c *Chain) GetBlock(h hash.Hash) (*Block, error) {
+	return c.blocks.GetBlock(h)
+}
+
 // PushBlock pushes the signed block header to extend the current main chain.
 func (c *Chain) PushBlock(block *SignedHeader) (err error) {
 	// Pushed block must extend the best chain
@@ -219,26 +382,55 @@ func (c *Chain) PushBlock(block *SignedHeader) (err error) {
 		return ErrInvalidBlock
 	}
 
-	// Update best state
-	c.state.node = newBlockNode(block, c.state.node)
-	c.state.Head = [32]byte(block.BlockHash)
-	c.state.Height++
+	if err = c.checkCheckpoint(block, c.state.Height+1); err != nil {
+		return
+	}
 
 	// Update index
-	c.index.AddBlock(c.state.node)
+	node := newBlockNode(block, c.state.node)
+
+	if err = c.index.AddBlock(node); err != nil {
+		return
+	}
 
-	// Write to db
+	return c.setHead(node, block)
+}
+
+// setHead updates the best state to node, which extends the best chain or reorganizes it to a
+// higher side branch. The subscribers of the index are notified once the state is written.
+func (c *Chain) setHead(node *blockNode, header *SignedHeader) (err error) {
+	oldHead := c.state.node
+	c.state.node = node
+	c.state.Head = node.hash
+	c.state.Height = node.height
+
+	if err = c.writeBlock(node, header, true); err != nil {
+		return
+	}
+
+	c.index.notifyHead(oldHead, node)
+
+	if c.cfg.OnPushBlock != nil {
+		c.cfg.OnPushBlock(c.state.Height)
+	}
+
+	return
+}
+
+// writeBlock writes the block header of node to db, along with the best state if withState is
+// set.
+func (c *Chain) writeBlock(node *blockNode, header *SignedHeader, withState bool) error {
 	return c.db.Update(func(tx *bolt.Tx) (err error) {
-		buffer, err := block.marshal()
+		buffer, err := header.marshal()
 
 		if err != nil {
 			return err
 		}
 
-		key := c.state.node.indexKey()
+		key := node.indexKey()
 		err = tx.Bucket(metaBucket[:]).Bucket(metaBlockIndexBucket).Put(key, buffer)
 
-		if err != nil {
+		if err != nil || !withState {
 			return err
 		}
 
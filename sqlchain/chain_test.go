@@ -23,6 +23,7 @@ import (
 	"math/rand"
 	"reflect"
 	"testing"
+	"time"
 
 	pb "github.com/golang/protobuf/proto"
 	"github.com/thunderdb/ThunderDB/crypto/hash"
@@ -130,15 +131,23 @@ func TestChain(t *testing.T) {
 		t.Fatalf("Error occurred: %v", err)
 	}
 
+	pushedHeight := int32(-1)
 	chain, err := NewChain(&Config{
 		DataDir: fl.Name(),
 		Genesis: genesis,
+		OnPushBlock: func(height int32) {
+			pushedHeight = height
+		},
 	})
 
 	if err != nil {
 		t.Fatalf("Error occurred: %v", err)
 	}
 
+	if pushedHeight != 0 {
+		t.Fatalf("Unexpected pushed height: %d", pushedHeight)
+	}
+
 	t.Logf("Create new chain: genesis hash = %s", genesis.SignedHeader.BlockHash.String())
 
 	// Push blocks
@@ -151,6 +160,10 @@ func TestChain(t *testing.T) {
 			t.Fatalf("Error occurred: %v", err)
 		}
 
+		if pushedHeight != chain.state.Height {
+			t.Fatalf("Unexpected pushed height: %d, expected %d", pushedHeight, chain.state.Height)
+		}
+
 		t.Logf("Pushed new block: height = %d,  %s <- %s",
 			chain.state.Height,
 			block.SignedHeader.ParentHash.String(),
@@ -173,3 +186,233 @@ func TestChain(t *testing.T) {
 		t.Fatalf("Error occurred: %v", err)
 	}
 }
+
+func extendBranch(t *testing.T, chain *Chain, parent hash.Hash, n int) (blocks []*Block) {
+	for i := 0; i < n; i++ {
+		block, err := createRandomBlock(parent, false)
+
+		if err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+
+		if err = chain.AddBlock(block); err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+
+		blocks = append(blocks, block)
+		parent = block.SignedHeader.BlockHash
+	}
+
+	return
+}
+
+func TestChainCheckpoint(t *testing.T) {
+	fl, err := ioutil.TempFile("", "chain")
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	fl.Close()
+
+	genesis, err := createRandomBlock(rootHash, true)
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	chain, err := NewChain(&Config{
+		DataDir:         fl.Name(),
+		Genesis:         genesis,
+		CheckpointDepth: 2,
+	})
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	best := extendBranch(t, chain, genesis.SignedHeader.BlockHash, 5)
+
+	// Shallow fork is kept as side branch until it's higher than the best chain
+	side := extendBranch(t, chain, best[2].SignedHeader.BlockHash, 2)
+
+	if !chain.state.Head.IsEqual(&best[4].SignedHeader.BlockHash) {
+		t.Fatalf("Unexpected head: %s", chain.state.Head.String())
+	}
+
+	side = append(side, extendBranch(t, chain, side[1].SignedHeader.BlockHash, 1)...)
+
+	if !chain.state.Head.IsEqual(&side[2].SignedHeader.BlockHash) || chain.state.Height != 6 {
+		t.Fatalf("Unexpected head: height = %d, %s", chain.state.Height, chain.state.Head.String())
+	}
+
+	// Deep fork is rejected
+	deep, err := createRandomBlock(best[0].SignedHeader.BlockHash, false)
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if err = chain.AddBlock(deep); err != ErrReorgBelowCheckpoint {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Reorganized state survives reloading
+	chain.db.Close()
+	chain, err = LoadChain(&Config{DataDir: fl.Name()})
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if !chain.state.Head.IsEqual(&side[2].SignedHeader.BlockHash) || chain.state.Height != 6 {
+		t.Fatalf("Unexpected head: height = %d, %s", chain.state.Height, chain.state.Head.String())
+	}
+
+	chain.db.Close()
+}
+
+func TestChainPinnedCheckpoint(t *testing.T) {
+	fl, err := ioutil.TempFile("", "chain")
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	fl.Close()
+
+	blocks := make([]*Block, 0, 5)
+
+	for parent := rootHash; len(blocks) < cap(blocks); {
+		block, err := createRandomBlock(parent, len(blocks) == 0)
+
+		if err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+
+		blocks = append(blocks, block)
+		parent = block.SignedHeader.BlockHash
+	}
+
+	chain, err := NewChain(&Config{
+		DataDir:     fl.Name(),
+		Genesis:     blocks[0],
+		Checkpoints: map[int32]hash.Hash{2: blocks[2].SignedHeader.BlockHash},
+	})
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	defer chain.db.Close()
+
+	if err = chain.AddBlock(blocks[1]); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	// Block conflicting with checkpoint is rejected
+	conflict, err := createRandomBlock(blocks[1].SignedHeader.BlockHash, false)
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if err = chain.AddBlock(conflict); err != ErrCheckpointMismatch {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if err = chain.PushBlock(conflict.SignedHeader); err != ErrCheckpointMismatch {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for _, block := range blocks[2:] {
+		if err = chain.AddBlock(block); err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+	}
+
+	// Fork above checkpoint is allowed
+	extendBranch(t, chain, blocks[2].SignedHeader.BlockHash, 1)
+
+	// Fork below checkpoint is rejected
+	fork, err := createRandomBlock(blocks[0].SignedHeader.BlockHash, false)
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if err = chain.AddBlock(fork); err != ErrReorgBelowCheckpoint {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestChainEvents(t *testing.T) {
+	fl, err := ioutil.TempFile("", "chain")
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	fl.Close()
+
+	genesis, err := createRandomBlock(rootHash, true)
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	chain, err := NewChain(&Config{
+		DataDir: fl.Name(),
+		Genesis: genesis,
+	})
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	defer chain.db.Close()
+
+	events, cancel := chain.index.Subscribe()
+	best := extendBranch(t, chain, genesis.SignedHeader.BlockHash, 3)
+
+	// Side branch reorganizes the chain once it's higher than the best chain
+	side := extendBranch(t, chain, best[0].SignedHeader.BlockHash, 3)
+
+	expected := []struct {
+		typ   ChainEventType
+		block *Block
+	}{
+		{ChainEventConnect, best[0]},
+		{ChainEventConnect, best[1]},
+		{ChainEventConnect, best[2]},
+		{ChainEventDisconnect, best[2]},
+		{ChainEventDisconnect, best[1]},
+		{ChainEventConnect, side[0]},
+		{ChainEventConnect, side[1]},
+		{ChainEventConnect, side[2]},
+	}
+
+	for i, e := range expected {
+		select {
+		case event := <-events:
+			if event.Type != e.typ || !event.Node.hash.IsEqual(&e.block.SignedHeader.BlockHash) {
+				t.Fatalf("Unexpected event #%d: type = %d, %s", i, event.Type, event.Node.hash.String())
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Event #%d not received", i)
+		}
+	}
+
+	// Channel is closed after cancelling
+	cancel()
+	extendBranch(t, chain, side[2].SignedHeader.BlockHash, 1)
+
+	select {
+	case event, ok := <-events:
+		if ok {
+			t.Fatalf("Unexpected event: type = %d, %s", event.Type, event.Node.hash.String())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Channel not closed")
+	}
+}
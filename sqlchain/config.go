@@ -16,8 +16,82 @@
 
 package sqlchain
 
+import (
+	"time"
+
+	"github.com/thunderdb/ThunderDB/crypto/hash"
+)
+
+const (
+	// DefaultMaxClockSkew is the default clock skew window of block timestamps.
+	DefaultMaxClockSkew = 2 * time.Minute
+
+	// DefaultMaxOrphans is the default max number of orphan blocks buffered by the block index.
+	DefaultMaxOrphans = 128
+
+	// DefaultBlockInterval is the default expected interval between blocks.
+	DefaultBlockInterval = time.Minute
+)
+
 // Config represents a sql-chain config.
 type Config struct {
 	DataDir string
+
+	// Genesis is the genesis block of the chain, see NewGenesis. If it's set, the block index only
+	// accepts it at height 0.
 	Genesis *Block
+
+	// MaxClockSkew is the max duration that a block timestamp can be ahead of local time,
+	// DefaultMaxClockSkew is used if it's not set.
+	MaxClockSkew time.Duration
+
+	// MaxOrphans is the max number of blocks buffered while waiting for their parents,
+	// DefaultMaxOrphans is used if it's not set.
+	MaxOrphans int
+
+	// BlockInterval is the expected interval between blocks, which the difficulty is retargeted
+	// to, see Config.CalcNextDifficulty. DefaultBlockInterval is used if it's not set.
+	BlockInterval time.Duration
+
+	// CheckpointDepth makes the blocks more than CheckpointDepth below the best tip final, a block
+	// forking the best chain below them is rejected with ErrReorgBelowCheckpoint. No limit if it's
+	// not set.
+	CheckpointDepth int32
+
+	// Checkpoints pins the block hashes at heights, a block conflicting with the pinned hash at
+	// its height is rejected with ErrCheckpointMismatch, and the pinned blocks are final once
+	// they are in the best chain.
+	Checkpoints map[int32]hash.Hash
+
+	// BlockStore stores the full blocks of the chain, a BoltBlockStore on the chain database is
+	// used if it's not set.
+	BlockStore BlockStore
+
+	// OnPushBlock is called with the new height once a block is pushed to the main chain, e.g.
+	// to invalidate the responses cached by rpc.Server.AdvanceCommitIndex.
+	OnPushBlock func(height int32)
+}
+
+func (c *Config) maxClockSkew() time.Duration {
+	if c.MaxClockSkew <= 0 {
+		return DefaultMaxClockSkew
+	}
+
+	return c.MaxClockSkew
+}
+
+func (c *Config) maxOrphans() int {
+	if c.MaxOrphans <= 0 {
+		return DefaultMaxOrphans
+	}
+
+	return c.MaxOrphans
+}
+
+func (c *Config) blockInterval() time.Duration {
+	if c.BlockInterval <= 0 {
+		return DefaultBlockInterval
+	}
+
+	return c.BlockInterval
 }
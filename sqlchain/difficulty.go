@@ -0,0 +1,69 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"math/big"
+	"time"
+
+	"github.com/thunderdb/ThunderDB/pow/cpuminer"
+)
+
+const (
+	// MaxRetargetFactor is the max factor that the target can be scaled by in a single retarget,
+	// which limits the effect of manipulated block timestamps.
+	MaxRetargetFactor = 4
+)
+
+// CalcNextDifficulty returns the target of the next retarget period: lastTarget is scaled by the
+// ratio of actualTimespan, the time taken by the last period, to expectedTimespan. So faster
+// blocks get a lower target, i.e., a higher difficulty, and vice versa. The ratio is clamped to
+// [1/MaxRetargetFactor, MaxRetargetFactor], and the result never exceeds the max target.
+// lastTarget is returned as is if expectedTimespan is not positive.
+func CalcNextDifficulty(
+	lastTarget cpuminer.Target, actualTimespan, expectedTimespan time.Duration) cpuminer.Target {
+	if expectedTimespan <= 0 {
+		return lastTarget
+	}
+
+	if min := expectedTimespan / MaxRetargetFactor; actualTimespan < min {
+		actualTimespan = min
+	} else if max := expectedTimespan * MaxRetargetFactor; actualTimespan > max {
+		actualTimespan = max
+	}
+
+	next := lastTarget.Big()
+	next.Mul(next, big.NewInt(int64(actualTimespan)))
+	next.Quo(next, big.NewInt(int64(expectedTimespan)))
+
+	target, err := cpuminer.TargetFromBig(next)
+
+	if err != nil {
+		// overflow
+		return cpuminer.DifficultyToTarget(0)
+	}
+
+	return target
+}
+
+// CalcNextDifficulty returns the target after blocks blocks are produced in actualTimespan with
+// lastTarget, the expected timespan is blocks times Config.BlockInterval. See the package-level
+// CalcNextDifficulty.
+func (c *Config) CalcNextDifficulty(
+	lastTarget cpuminer.Target, actualTimespan time.Duration, blocks int) cpuminer.Target {
+	return CalcNextDifficulty(lastTarget, actualTimespan, time.Duration(blocks)*c.blockInterval())
+}
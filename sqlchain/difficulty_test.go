@@ -0,0 +1,85 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/thunderdb/ThunderDB/pow/cpuminer"
+)
+
+func TestCalcNextDifficulty(t *testing.T) {
+	last := cpuminer.DifficultyToTarget(20)
+	expected := 10 * time.Minute
+	scaled := func(num, den int64) *big.Int {
+		v := last.Big()
+		v.Mul(v, big.NewInt(num))
+		return v.Quo(v, big.NewInt(den))
+	}
+
+	cases := []struct {
+		actual time.Duration
+		target *big.Int
+	}{
+		// on time
+		{expected, last.Big()},
+		// faster blocks raise difficulty
+		{expected / 2, scaled(1, 2)},
+		// slower blocks lower difficulty
+		{expected * 3, scaled(3, 1)},
+		// clamped
+		{expected / 10, scaled(1, MaxRetargetFactor)},
+		{0, scaled(1, MaxRetargetFactor)},
+		{expected * 10, scaled(MaxRetargetFactor, 1)},
+	}
+
+	for _, c := range cases {
+		next := CalcNextDifficulty(last, c.actual, expected)
+
+		if next.Big().Cmp(c.target) != 0 {
+			t.Fatalf("Unexpected target for timespan %v: %x, expected %x",
+				c.actual, next.Big(), c.target)
+		}
+	}
+
+	// never exceeds the max target
+	max := cpuminer.DifficultyToTarget(0)
+
+	if next := CalcNextDifficulty(cpuminer.DifficultyToTarget(1), expected*4, expected); next != max {
+		t.Fatalf("Unexpected target: %x", next.Big())
+	}
+
+	// invalid expected timespan
+	if next := CalcNextDifficulty(last, expected, 0); next != last {
+		t.Fatalf("Unexpected target: %x", next.Big())
+	}
+
+	// config block interval
+	cfg := &Config{BlockInterval: time.Minute}
+
+	if next := cfg.CalcNextDifficulty(last, 5*time.Minute, 10); next.Big().Cmp(scaled(1, 2)) != 0 {
+		t.Fatalf("Unexpected target: %x", next.Big())
+	}
+
+	cfg = &Config{}
+
+	if next := cfg.CalcNextDifficulty(last, 10*DefaultBlockInterval, 10); next != last {
+		t.Fatalf("Unexpected target: %x", next.Big())
+	}
+}
@@ -50,4 +50,29 @@ var (
 	// ErrInvalidBlock indicates an invalid block which does not extend the best chain while
 	// pushing new blocks.
 	ErrInvalidBlock = errors.New("invalid block")
+
+	// ErrGenesisMismatch indicates that a block at height 0 doesn't match the configured genesis
+	// block.
+	ErrGenesisMismatch = errors.New("genesis block mismatch")
+
+	// ErrBlockNotConnected indicates a block whose ancestry doesn't terminate at the genesis block
+	// of the index.
+	ErrBlockNotConnected = errors.New("block is not connected to genesis")
+
+	// ErrTimestampTooEarly indicates a block whose timestamp is not later than its parent's.
+	ErrTimestampTooEarly = errors.New("block timestamp is too early")
+
+	// ErrTimestampInFuture indicates a block whose timestamp is too far ahead of local time.
+	ErrTimestampInFuture = errors.New("block timestamp is in the future")
+
+	// ErrBlockNotFound indicates that the block body is not found in the block store.
+	ErrBlockNotFound = errors.New("block not found")
+
+	// ErrReorgBelowCheckpoint indicates a block forking the best chain below a checkpoint, which
+	// would revert a final block.
+	ErrReorgBelowCheckpoint = errors.New("reorg below checkpoint")
+
+	// ErrCheckpointMismatch indicates a block conflicting with the pinned checkpoint at its
+	// height.
+	ErrCheckpointMismatch = errors.New("block conflicts with checkpoint")
 )
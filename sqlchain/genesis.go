@@ -0,0 +1,53 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the “License”);
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an “AS IS” BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"time"
+
+	"github.com/thunderdb/ThunderDB/crypto/asymmetric"
+	"github.com/thunderdb/ThunderDB/crypto/hash"
+	"github.com/thunderdb/ThunderDB/proto"
+)
+
+// GenesisVersion is the header version of the genesis block created by NewGenesis.
+const GenesisVersion int32 = 0x01000000
+
+// NewGenesis creates a genesis block produced by producer with the given root hash, and signs its
+// header with signer. The parent hash of a genesis block is its root hash, which is also the head
+// of an empty chain.
+func NewGenesis(producer proto.NodeID, root hash.Hash, timestamp time.Time,
+	signer *asymmetric.PrivateKey) (genesis *Block, err error) {
+	genesis = &Block{
+		SignedHeader: &SignedHeader{
+			Header: Header{
+				Version:    GenesisVersion,
+				Producer:   producer,
+				RootHash:   root,
+				ParentHash: root,
+				Timestamp:  timestamp.UTC(),
+			},
+			Signee: signer.PubKey(),
+		},
+	}
+
+	if err = genesis.SignHeader(signer); err != nil {
+		return nil, err
+	}
+
+	return
+}
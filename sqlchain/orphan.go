@@ -0,0 +1,102 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the “License”);
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an “AS IS” BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"container/list"
+
+	"github.com/thunderdb/ThunderDB/crypto/hash"
+)
+
+// orphanPool buffers the blocks whose parents are not in the block index yet. Orphans are
+// indexed by their parent hashes, and the oldest one is evicted if the pool is full.
+type orphanPool struct {
+	maxSize  int
+	order    *list.List // of *Block, oldest first
+	byHash   map[hash.Hash]*list.Element
+	byParent map[hash.Hash][]*Block
+}
+
+func newOrphanPool(maxSize int) *orphanPool {
+	return &orphanPool{
+		maxSize:  maxSize,
+		order:    list.New(),
+		byHash:   make(map[hash.Hash]*list.Element),
+		byParent: make(map[hash.Hash][]*Block),
+	}
+}
+
+func (p *orphanPool) len() int {
+	return p.order.Len()
+}
+
+func (p *orphanPool) has(h *hash.Hash) (ok bool) {
+	_, ok = p.byHash[*h]
+	return
+}
+
+func (p *orphanPool) add(block *Block) {
+	header := block.SignedHeader
+
+	if p.has(&header.BlockHash) {
+		return
+	}
+
+	for p.order.Len() >= p.maxSize && p.order.Len() > 0 {
+		p.remove(p.order.Front().Value.(*Block))
+	}
+
+	p.byHash[header.BlockHash] = p.order.PushBack(block)
+	p.byParent[header.ParentHash] = append(p.byParent[header.ParentHash], block)
+}
+
+func (p *orphanPool) remove(block *Block) {
+	header := block.SignedHeader
+	e, ok := p.byHash[header.BlockHash]
+
+	if !ok {
+		return
+	}
+
+	p.order.Remove(e)
+	delete(p.byHash, header.BlockHash)
+	siblings := p.byParent[header.ParentHash]
+
+	for i, s := range siblings {
+		if s == block {
+			siblings = append(siblings[:i], siblings[i+1:]...)
+			break
+		}
+	}
+
+	if len(siblings) == 0 {
+		delete(p.byParent, header.ParentHash)
+	} else {
+		p.byParent[header.ParentHash] = siblings
+	}
+}
+
+// takeChildren removes and returns the orphans whose parent is parentHash.
+func (p *orphanPool) takeChildren(parentHash *hash.Hash) (children []*Block) {
+	children = append(children, p.byParent[*parentHash]...)
+
+	for _, c := range children {
+		p.remove(c)
+	}
+
+	return
+}
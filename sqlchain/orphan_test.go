@@ -0,0 +1,208 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the “License”);
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an “AS IS” BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/thunderdb/ThunderDB/crypto/hash"
+)
+
+func createTestChain(t *testing.T, length int) (genesis *Block, blocks []*Block) {
+	genesis, err := createRandomBlock(rootHash, true)
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	for prev := genesis; len(blocks) < length; prev = blocks[len(blocks)-1] {
+		b, err := createRandomBlock(prev.SignedHeader.BlockHash, false)
+
+		if err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+
+		blocks = append(blocks, b)
+	}
+
+	return
+}
+
+func newOrphanTestChain(t *testing.T, cfg *Config) *Chain {
+	fl, err := ioutil.TempFile("", "chain")
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	fl.Close()
+	cfg.DataDir = fl.Name()
+	chain, err := NewChain(cfg)
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	return chain
+}
+
+func TestOrphanPool(t *testing.T) {
+	genesis, blocks := createTestChain(t, 5)
+	pushedHeight := int32(-1)
+	chain := newOrphanTestChain(t, &Config{
+		Genesis: genesis,
+		OnPushBlock: func(height int32) {
+			pushedHeight = height
+		},
+	})
+
+	// Deliver blocks in reverse order
+	for i := len(blocks) - 1; i > 0; i-- {
+		if err := chain.AddBlock(blocks[i]); err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+
+		if chain.index.HasBlock(&blocks[i].SignedHeader.BlockHash) {
+			t.Fatal("Unexpected result: orphan block is attached")
+		}
+
+		if !chain.index.HasOrphan(&blocks[i].SignedHeader.BlockHash) {
+			t.Fatal("Unexpected result: orphan block is not buffered")
+		}
+
+		if _, err := chain.GetBlock(blocks[i].SignedHeader.BlockHash); err != ErrBlockNotFound {
+			t.Fatalf("Unexpected result: %v, expected %v", err, ErrBlockNotFound)
+		}
+	}
+
+	// All blocks are attached once their ancestors arrive
+	if err := chain.AddBlock(blocks[0]); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if chain.state.Height != 5 || chain.state.Head != blocks[4].SignedHeader.BlockHash ||
+		pushedHeight != 5 {
+		t.Fatalf("Unexpected chain state: %d, %s", chain.state.Height, chain.state.Head.String())
+	}
+
+	for i, b := range blocks {
+		bn := chain.index.LookupNode(&b.SignedHeader.BlockHash)
+
+		if bn == nil || bn.height != int32(i+1) {
+			t.Fatalf("Unexpected result: block %d is not indexed at its height: %v", i, bn)
+		}
+
+		if _, err := chain.GetBlock(b.SignedHeader.BlockHash); err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+	}
+
+	if chain.index.orphans.len() != 0 {
+		t.Fatalf("Unexpected orphan pool size: %d", chain.index.orphans.len())
+	}
+
+	// Duplicated block is ignored
+	if err := chain.AddBlock(blocks[0]); err != nil || chain.state.Height != 5 {
+		t.Fatalf("Unexpected result: height = %d, err = %v", chain.state.Height, err)
+	}
+
+	// The attached blocks are written
+	chain.db.Close()
+	chain, err := LoadChain(&Config{DataDir: chain.cfg.DataDir})
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if chain.state.Height != 5 || chain.index.LookupNode(&blocks[4].SignedHeader.BlockHash) == nil {
+		t.Fatalf("Unexpected chain state: %d, %s", chain.state.Height, chain.state.Head.String())
+	}
+}
+
+func TestOrphanPoolCheckpoint(t *testing.T) {
+	genesis, blocks := createTestChain(t, 5)
+	chain := newOrphanTestChain(t, &Config{
+		Genesis:     genesis,
+		Checkpoints: map[int32]hash.Hash{4: blocks[0].SignedHeader.BlockHash},
+	})
+
+	for i := len(blocks) - 1; i >= 0; i-- {
+		if err := chain.AddBlock(blocks[i]); err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+	}
+
+	// The orphan mismatching the checkpoint is dropped, and its descendants are never attached
+	if chain.state.Height != 3 || chain.state.Head != blocks[2].SignedHeader.BlockHash {
+		t.Fatalf("Unexpected chain state: %d, %s", chain.state.Height, chain.state.Head.String())
+	}
+
+	for _, b := range blocks[3:] {
+		if chain.index.HasBlock(&b.SignedHeader.BlockHash) {
+			t.Fatal("Unexpected result: block mismatching checkpoint is attached")
+		}
+
+		if _, err := chain.GetBlock(b.SignedHeader.BlockHash); err != ErrBlockNotFound {
+			t.Fatalf("Unexpected result: %v, expected %v", err, ErrBlockNotFound)
+		}
+	}
+
+	if chain.index.HasOrphan(&blocks[3].SignedHeader.BlockHash) ||
+		!chain.index.HasOrphan(&blocks[4].SignedHeader.BlockHash) {
+		t.Fatal("Unexpected result: orphan pool mismatched")
+	}
+}
+
+func TestOrphanPoolEviction(t *testing.T) {
+	genesis, blocks := createTestChain(t, 5)
+	chain := newOrphanTestChain(t, &Config{Genesis: genesis, MaxOrphans: 3})
+
+	for _, b := range blocks[1:] {
+		if err := chain.AddBlock(b); err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+	}
+
+	if chain.index.orphans.len() != 3 {
+		t.Fatalf("Unexpected orphan pool size: %d", chain.index.orphans.len())
+	}
+
+	// The oldest orphan is evicted
+	if chain.index.HasOrphan(&blocks[1].SignedHeader.BlockHash) {
+		t.Fatal("Unexpected result: oldest orphan is not evicted")
+	}
+
+	for _, b := range blocks[2:] {
+		if !chain.index.HasOrphan(&b.SignedHeader.BlockHash) {
+			t.Fatal("Unexpected result: orphan block is not buffered")
+		}
+	}
+
+	// Only the blocks connected to genesis are attached
+	if err := chain.AddBlock(blocks[0]); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if chain.state.Height != 1 {
+		t.Fatalf("Unexpected chain height: %d", chain.state.Height)
+	}
+
+	if chain.index.orphans.len() != 3 {
+		t.Fatalf("Unexpected orphan pool size: %d", chain.index.orphans.len())
+	}
+}
@@ -0,0 +1,156 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/ugorji/go/codec"
+)
+
+var (
+	// ErrAuditDisabled indicates the audit log is not enabled, see EnableAudit.
+	ErrAuditDisabled = errors.New("storage: audit log is not enabled")
+
+	// ErrInvalidAuditRecord indicates a corrupted record in the audit log.
+	ErrInvalidAuditRecord = errors.New("storage: invalid audit record")
+)
+
+// AuditRecord is the record of a committed transaction in the audit log.
+type AuditRecord struct {
+	TxID    TxID
+	Queries []string
+}
+
+// EnableAudit enables the append-only audit log at path, the file is created if it doesn't exist.
+// Each transaction committed by Commit is recorded with its statements, and the record is
+// flushed to disk before the transaction is committed, so that no committed transaction is
+// missing from the audit log. An empty path disables the audit log.
+func (s *Storage) EnableAudit(path string) (err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.audit != nil {
+		if err = s.audit.Close(); err != nil {
+			return
+		}
+
+		s.audit = nil
+	}
+
+	if path == "" {
+		return
+	}
+
+	if s.audit, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600); err != nil {
+		s.audit = nil
+	}
+
+	return
+}
+
+// AuditReader returns a reader to replay the audit log from the beginning.
+func (s *Storage) AuditReader() (*AuditReader, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.audit == nil {
+		return nil, ErrAuditDisabled
+	}
+
+	f, err := os.Open(s.audit.Name())
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &AuditReader{
+		f: f,
+		r: bufio.NewReader(f),
+	}, nil
+}
+
+// writeAudit appends the record of current tx to the audit log and syncs it, the lock must be
+// held by caller.
+//
+// Layout: record length (uint32, big endian) | record in msgpack.
+func (s *Storage) writeAudit() (err error) {
+	if s.audit == nil {
+		return
+	}
+
+	buffer := bytes.NewBuffer(make([]byte, 4))
+
+	if err = codec.NewEncoder(buffer, &codec.MsgpackHandle{}).Encode(&AuditRecord{
+		TxID:    s.id,
+		Queries: s.queries,
+	}); err != nil {
+		return
+	}
+
+	data := buffer.Bytes()
+	binary.BigEndian.PutUint32(data, uint32(len(data)-4))
+
+	if _, err = s.audit.Write(data); err != nil {
+		return
+	}
+
+	return s.audit.Sync()
+}
+
+// AuditReader replays the records of audit log in commit order.
+type AuditReader struct {
+	f *os.File
+	r *bufio.Reader
+}
+
+// Next returns the next record, io.EOF is returned if there is no more record.
+func (ar *AuditReader) Next() (record *AuditRecord, err error) {
+	var length uint32
+
+	if err = binary.Read(ar.r, binary.BigEndian, &length); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = ErrInvalidAuditRecord
+		}
+
+		return nil, err
+	}
+
+	data := make([]byte, length)
+
+	if _, err = io.ReadFull(ar.r, data); err != nil {
+		return nil, ErrInvalidAuditRecord
+	}
+
+	record = &AuditRecord{}
+
+	if err = codec.NewDecoderBytes(data, &codec.MsgpackHandle{}).Decode(record); err != nil {
+		return nil, ErrInvalidAuditRecord
+	}
+
+	return
+}
+
+// Close closes the reader.
+func (ar *AuditReader) Close() error {
+	return ar.f.Close()
+}
@@ -0,0 +1,184 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestAudit(t *testing.T) {
+	fl, err := ioutil.TempFile("", "sqlite3-")
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	st, err := New(fmt.Sprintf("file:%s", fl.Name()))
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if _, err = st.AuditReader(); err != ErrAuditDisabled {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	auditFile := fl.Name() + "-audit"
+	defer os.Remove(auditFile)
+
+	if err = st.EnableAudit(auditFile); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	logs := []*ExecLog{
+		{
+			ConnectionID: 1,
+			SeqNo:        1,
+			Queries: []string{
+				"CREATE TABLE IF NOT EXISTS `kv` (`key` TEXT PRIMARY KEY, `value` BLOB); " +
+					"INSERT INTO `kv` VALUES ('k1', 'v1')",
+			},
+		},
+		{
+			ConnectionID: 1,
+			SeqNo:        2,
+			Queries: []string{
+				"INSERT INTO `kv` VALUES ('k2', 'v2')",
+				"UPDATE `kv` SET `value` = 'v1-2' WHERE `key` = 'k1'",
+			},
+		},
+		{
+			// Failed commit is not recorded
+			ConnectionID: 1,
+			SeqNo:        3,
+			Queries:      []string{"DELETE FROM `kv`"},
+			TxOptions:    &sql.TxOptions{ReadOnly: true},
+		},
+		{
+			ConnectionID: 2,
+			SeqNo:        1,
+			Queries:      []string{"DELETE FROM `kv` WHERE `key` = 'k2'"},
+		},
+	}
+
+	expected := []*AuditRecord{
+		{
+			TxID: TxID{ConnectionID: 1, SeqNo: 1},
+			Queries: []string{
+				"CREATE TABLE IF NOT EXISTS `kv` (`key` TEXT PRIMARY KEY, `value` BLOB)",
+				"INSERT INTO `kv` VALUES ('k1', 'v1')",
+			},
+		},
+		{
+			TxID:    TxID{ConnectionID: 1, SeqNo: 2},
+			Queries: logs[1].Queries,
+		},
+		{
+			TxID:    TxID{ConnectionID: 2, SeqNo: 1},
+			Queries: logs[3].Queries,
+		},
+	}
+
+	for i, el := range logs {
+		if err = st.Prepare(context.Background(), el); err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+
+		if err = st.Commit(context.Background(), el); i == 2 {
+			if err != ErrReadOnlyTx {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		} else if err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+
+		// Audit log is reopened in append mode
+		if i == 1 {
+			if err = st.EnableAudit(auditFile); err != nil {
+				t.Fatalf("Error occurred: %v", err)
+			}
+		}
+	}
+
+	reader, err := st.AuditReader()
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	defer reader.Close()
+
+	for _, e := range expected {
+		record, err := reader.Next()
+
+		if err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+
+		if !reflect.DeepEqual(record, e) {
+			t.Fatalf("Unexpected record: %v, expected %v", record, e)
+		}
+	}
+
+	if _, err = reader.Next(); err != io.EOF {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Truncated record
+	data, err := ioutil.ReadFile(auditFile)
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if err = ioutil.WriteFile(auditFile, data[:len(data)-1], 0600); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	truncated, err := st.AuditReader()
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	defer truncated.Close()
+
+	for range expected[1:] {
+		if _, err = truncated.Next(); err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+	}
+
+	if _, err = truncated.Next(); err != ErrInvalidAuditRecord {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if err = st.EnableAudit(""); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if _, err = st.AuditReader(); err != ErrAuditDisabled {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,155 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the “License”);
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an “AS IS” BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+const (
+	// backupStepPages is the number of pages copied in each backup step.
+	backupStepPages = 256
+
+	// backupRetryInterval is the interval to retry a backup step if the database is locked.
+	backupRetryInterval = 10 * time.Millisecond
+)
+
+var (
+	// ErrNotSQLiteConn indicates the underlying driver connection is not a sqlite3 connection.
+	ErrNotSQLiteConn = errors.New("storage: not a sqlite3 connection")
+)
+
+// BackupProgress is called after each backup step with the number of pages remaining to be
+// copied and the total number of pages of the source database.
+type BackupProgress func(remaining, total int)
+
+// Backup copies the live database to the database of destDSN consistently with the sqlite online
+// backup API, see BackupWithProgress.
+func (s *Storage) Backup(ctx context.Context, destDSN string) error {
+	return s.BackupWithProgress(ctx, destDSN, nil)
+}
+
+// BackupWithProgress copies the live database to the database of destDSN consistently with the
+// sqlite online backup API, progress is called after each step if it's not nil. The destination
+// database is overwritten.
+//
+// The source is copied in steps of backupStepPages pages, and the source database is only locked
+// for reading during each step, so the ongoing reads and writes are not blocked. The backup
+// restarts automatically if the source is modified by another connection between steps.
+func (s *Storage) BackupWithProgress(ctx context.Context, destDSN string, progress BackupProgress) (err error) {
+	d, err := NewDSN(destDSN)
+
+	if err != nil {
+		return
+	}
+
+	if err = setupCrypto(d); err != nil {
+		return
+	}
+
+	destDB, err := sql.Open(driverName, d.Format())
+
+	if err != nil {
+		return
+	}
+
+	defer destDB.Close()
+
+	destConn, err := destDB.Conn(ctx)
+
+	if err != nil {
+		return
+	}
+
+	defer destConn.Close()
+
+	srcConn, err := s.db.Conn(ctx)
+
+	if err != nil {
+		return
+	}
+
+	defer srcConn.Close()
+
+	return destConn.Raw(func(destDriverConn interface{}) error {
+		return srcConn.Raw(func(srcDriverConn interface{}) error {
+			dest, ok := destDriverConn.(*sqlite3.SQLiteConn)
+
+			if !ok {
+				return ErrNotSQLiteConn
+			}
+
+			src, ok := srcDriverConn.(*sqlite3.SQLiteConn)
+
+			if !ok {
+				return ErrNotSQLiteConn
+			}
+
+			return backup(ctx, dest, src, progress)
+		})
+	})
+}
+
+func backup(ctx context.Context, dest, src *sqlite3.SQLiteConn, progress BackupProgress) (err error) {
+	b, err := dest.Backup("main", src, "main")
+
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if ferr := b.Finish(); err == nil {
+			err = ferr
+		}
+	}()
+
+	lastRemaining := -1
+
+	for {
+		var done bool
+
+		if done, err = b.Step(backupStepPages); err != nil {
+			return
+		}
+
+		if progress != nil {
+			progress(b.Remaining(), b.PageCount())
+		}
+
+		if done {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		if b.Remaining() == lastRemaining {
+			// source is locked, nothing is copied in this step
+			time.Sleep(backupRetryInterval)
+		}
+
+		lastRemaining = b.Remaining()
+	}
+}
@@ -0,0 +1,151 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the “License”);
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an “AS IS” BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlite3-backup-")
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	st, err := New(fmt.Sprintf("file:%s/src.db", dir))
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	seq := uint64(0)
+	exec := func(queries ...string) error {
+		seq++
+		el := &ExecLog{
+			ConnectionID: 1,
+			SeqNo:        seq,
+			Timestamp:    uint64(time.Now().UnixNano()),
+			Queries:      queries,
+		}
+
+		if err := st.Prepare(context.Background(), el); err != nil {
+			return err
+		}
+
+		return st.Commit(context.Background(), el)
+	}
+
+	// ~4MB of pre-backup data, copied in multiple steps
+	const rows = 4000
+
+	if err = exec(
+		"CREATE TABLE t (k INTEGER PRIMARY KEY, v BLOB)",
+		fmt.Sprintf("WITH RECURSIVE c(x) AS (SELECT 1 UNION ALL SELECT x + 1 FROM c WHERE x < %d) "+
+			"INSERT INTO t (k, v) SELECT x, randomblob(1024) FROM c", rows),
+	); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	// write concurrently during backup
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		for i := 0; i < 20; i++ {
+			if err := exec(fmt.Sprintf("INSERT INTO t (k, v) VALUES (%d, randomblob(1024))",
+				rows+1+i)); err != nil {
+				t.Errorf("Error occurred: %v", err)
+				return
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	dest := fmt.Sprintf("file:%s/dest.db", dir)
+	steps := 0
+	lastRemaining, lastTotal := -1, -1
+
+	err = st.BackupWithProgress(ctx, dest, func(remaining, total int) {
+		steps++
+		lastRemaining, lastTotal = remaining, total
+	})
+	wg.Wait()
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if steps < 2 || lastRemaining != 0 || lastTotal <= 0 {
+		t.Fatalf("Unexpected progress: steps = %d, remaining = %d, total = %d",
+			steps, lastRemaining, lastTotal)
+	}
+
+	db, err := sql.Open("sqlite3", dest)
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	defer db.Close()
+
+	var result string
+
+	if err = db.QueryRow("PRAGMA integrity_check").Scan(&result); err != nil || result != "ok" {
+		t.Fatalf("Unexpected integrity check result: %s, %v", result, err)
+	}
+
+	var count int
+
+	if err = db.QueryRow("SELECT COUNT(*) FROM t WHERE k <= ?", rows).Scan(&count); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if count != rows {
+		t.Fatalf("Unexpected row count in backup: %d", count)
+	}
+
+	// backup is independent from source
+	if err = exec("DROP TABLE t"); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if err = db.QueryRow("SELECT COUNT(*) FROM t").Scan(&count); err != nil || count < rows {
+		t.Fatalf("Unexpected row count in backup: %d, %v", count, err)
+	}
+
+	// canceled backup
+	canceled, cancelNow := context.WithCancel(context.Background())
+	cancelNow()
+
+	if err = st.Backup(canceled, fmt.Sprintf("file:%s/canceled.db", dir)); err == nil {
+		t.Fatal("Unexpected result: returned nil while expecting an error")
+	}
+}
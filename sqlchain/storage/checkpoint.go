@@ -0,0 +1,144 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrCheckpointBusy indicates the WAL checkpoint is not completed since it's blocked by the
+// concurrent readers or writers, the WAL file is left as is and the checkpoint is retried later.
+var ErrCheckpointBusy = errors.New("storage: checkpoint blocked by concurrent transactions")
+
+// SetCheckpointPolicy sets the policy to checkpoint and truncate the WAL file: a checkpoint is
+// run after every everyNCommits successful commits if everyNCommits is positive, and when the
+// storage is closed if onClose is true. A checkpoint blocked by the concurrent readers doesn't
+// fail the commit, it's retried on the next commit instead.
+func (s *Storage) SetCheckpointPolicy(everyNCommits int, onClose bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	if everyNCommits < 0 {
+		everyNCommits = 0
+	}
+
+	s.checkpointEvery = everyNCommits
+	s.checkpointOnClose = onClose
+	s.uncheckpointed = 0
+}
+
+// Checkpoint checkpoints the WAL file to the database and truncates it, ErrCheckpointBusy is
+// returned if it's blocked by the concurrent transactions.
+func (s *Storage) Checkpoint(ctx context.Context) error {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.checkpoint(ctx)
+}
+
+// checkpoint runs a truncating WAL checkpoint without waiting for the concurrent transactions,
+// the lock must be held by caller.
+func (s *Storage) checkpoint(ctx context.Context) (err error) {
+	conn, err := s.db.Conn(ctx)
+
+	if err != nil {
+		return
+	}
+
+	defer conn.Close()
+
+	// The busy handler would block the commits until the readers are done, fail fast instead
+	var timeout int
+
+	if err = conn.QueryRowContext(ctx, "PRAGMA busy_timeout").Scan(&timeout); err != nil {
+		return
+	}
+
+	if _, err = conn.ExecContext(ctx, "PRAGMA busy_timeout = 0"); err != nil {
+		return
+	}
+
+	defer func() {
+		if _, rerr := conn.ExecContext(context.Background(),
+			fmt.Sprintf("PRAGMA busy_timeout = %d", timeout)); err == nil {
+			err = rerr
+		}
+	}()
+
+	var busy, logFrames, checkpointed int
+
+	err = conn.QueryRowContext(ctx, "PRAGMA wal_checkpoint(TRUNCATE)").Scan(
+		&busy, &logFrames, &checkpointed)
+
+	if err != nil {
+		return
+	}
+
+	if busy != 0 {
+		return ErrCheckpointBusy
+	}
+
+	s.uncheckpointed = 0
+	return
+}
+
+// recordCheckpoint counts a successful commit and checkpoints the WAL file if the count reaches
+// the policy, the lock must be held by caller.
+func (s *Storage) recordCheckpoint(ctx context.Context) {
+	if s.checkpointEvery <= 0 {
+		return
+	}
+
+	if s.uncheckpointed++; s.uncheckpointed < s.checkpointEvery {
+		return
+	}
+
+	if err := s.checkpoint(ctx); err != nil {
+		log.Warningf("storage: failed to checkpoint: %v", err)
+	}
+}
+
+// Close rolls back the prepared transaction if there is one, checkpoints the WAL file if it's
+// required by the checkpoint policy, and closes the audit log. The database itself is shared by
+// the storages on the same file and is kept open.
+func (s *Storage) Close() (err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.tx != nil {
+		s.tx.Rollback()
+		s.resetTx()
+	}
+
+	if s.checkpointOnClose {
+		err = s.checkpoint(context.Background())
+	}
+
+	if s.audit != nil {
+		if cerr := s.audit.Close(); err == nil {
+			err = cerr
+		}
+
+		s.audit = nil
+	}
+
+	return
+}
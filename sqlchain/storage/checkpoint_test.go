@@ -0,0 +1,170 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func walSize(t *testing.T, name string) int64 {
+	fi, err := os.Stat(name + "-wal")
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	return fi.Size()
+}
+
+func commitQueries(t *testing.T, st *Storage, seq uint64, queries ...string) {
+	el := &ExecLog{
+		ConnectionID: 1,
+		SeqNo:        seq,
+		Timestamp:    uint64(time.Now().Unix()),
+		Queries:      queries,
+	}
+
+	if err := st.Prepare(context.Background(), el); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if err := st.Commit(context.Background(), el); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+}
+
+func TestCheckpointPolicy(t *testing.T) {
+	fl, err := ioutil.TempFile("", "sqlite3-")
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	fl.Close()
+	defer os.Remove(fl.Name())
+	defer os.Remove(fl.Name() + "-wal")
+	defer os.Remove(fl.Name() + "-shm")
+
+	st, err := New(fmt.Sprintf("file:%s", fl.Name()))
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	st.SetCheckpointPolicy(3, false)
+	commitQueries(t, st, 1, "CREATE TABLE IF NOT EXISTS `kv` (`key` TEXT PRIMARY KEY, `value` BLOB)")
+	commitQueries(t, st, 2, "INSERT INTO `kv` VALUES ('k1', 'v1')")
+
+	// Below the threshold, the WAL file keeps growing
+	if size := walSize(t, fl.Name()); size == 0 {
+		t.Fatal("Unexpected result: WAL file truncated before threshold")
+	}
+
+	// Checkpoint blocked by an open reader doesn't fail the commit
+	rows, err := st.db.Query("SELECT * FROM `kv`")
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if !rows.Next() {
+		t.Fatal("Unexpected result: no rows")
+	}
+
+	commitQueries(t, st, 3, "INSERT INTO `kv` VALUES ('k2', 'v2')")
+
+	if size := walSize(t, fl.Name()); size == 0 {
+		t.Fatal("Unexpected result: WAL file truncated with open reader")
+	}
+
+	// Reaching the threshold truncates the WAL file once the reader is done
+	rows.Close()
+	commitQueries(t, st, 4, "INSERT INTO `kv` VALUES ('k3', 'v3')")
+
+	if size := walSize(t, fl.Name()); size != 0 {
+		t.Fatalf("Unexpected WAL size: %d, expected 0", size)
+	}
+
+	var count int
+
+	if err = st.db.QueryRow("SELECT COUNT(*) FROM `kv`").Scan(&count); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if count != 3 {
+		t.Fatalf("Unexpected row count: %d, expected 3", count)
+	}
+
+	// Counter restarts after checkpoint
+	commitQueries(t, st, 5, "INSERT INTO `kv` VALUES ('k4', 'v4')")
+
+	if size := walSize(t, fl.Name()); size == 0 {
+		t.Fatal("Unexpected result: WAL file truncated before threshold")
+	}
+
+	// Closing without onClose keeps the WAL file
+	if err = st.Close(); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if size := walSize(t, fl.Name()); size == 0 {
+		t.Fatal("Unexpected result: WAL file truncated on close")
+	}
+}
+
+func TestCheckpointOnClose(t *testing.T) {
+	fl, err := ioutil.TempFile("", "sqlite3-")
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	fl.Close()
+	defer os.Remove(fl.Name())
+	defer os.Remove(fl.Name() + "-wal")
+	defer os.Remove(fl.Name() + "-shm")
+
+	st, err := New(fmt.Sprintf("file:%s", fl.Name()))
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	st.SetCheckpointPolicy(0, true)
+	commitQueries(t, st, 1, "CREATE TABLE IF NOT EXISTS `kv` (`key` TEXT PRIMARY KEY, `value` BLOB)")
+
+	for i := 0; i < 10; i++ {
+		commitQueries(t, st, uint64(i+2), fmt.Sprintf("INSERT INTO `kv` VALUES ('k%d', 'v')", i))
+	}
+
+	if size := walSize(t, fl.Name()); size == 0 {
+		t.Fatal("Unexpected result: WAL file truncated without checkpoint")
+	}
+
+	if err = st.Close(); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if size := walSize(t, fl.Name()); size != 0 {
+		t.Fatalf("Unexpected WAL size: %d, expected 0", size)
+	}
+}
@@ -0,0 +1,354 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the “License”);
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an “AS IS” BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+/*
+#cgo CFLAGS: -I${SRCDIR}/../../vendor/github.com/mattn/go-sqlite3
+#include <stdlib.h>
+#include "crypto_vfs.h"
+*/
+import "C"
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/thunderdb/ThunderDB/crypto/asymmetric"
+	"github.com/thunderdb/ThunderDB/crypto/hash"
+)
+
+const (
+	// CryptoKeyParam is the DSN parameter of the hex encoded AES key, the database, its rollback
+	// journal and wal files are encrypted with the key if it's set, see SetCryptoKey.
+	//
+	// The pages of the files are encrypted by a sqlite vfs shim in AES-GCM mode with a random
+	// nonce on each write, the nonce and tag are stored in the bytes reserved at the end of each
+	// page, and the offset of the page is authenticated, a page failing authentication is reported
+	// as a corrupted database. So an encrypted database must be created with the key, and it can
+	// only be restored from a backup of an encrypted database. The page size and format bytes of
+	// the database header, the page numbers and checksums of the journal and wal files are not
+	// encrypted, neither are temporary files.
+	CryptoKeyParam = "_crypto_key"
+
+	cryptoVFSName = "thunderdb_crypto"
+	cryptoIDParam = "crypto_id"
+)
+
+var (
+	// ErrInvalidCryptoKey indicates that the crypto key is not a valid AES key.
+	ErrInvalidCryptoKey = errors.New("storage: invalid crypto key")
+
+	errCryptoPage    = errors.New("storage: invalid encrypted page")
+	errCryptoReserve = errors.New("storage: no bytes reserved for encryption in database")
+
+	cryptoVFSOnce sync.Once
+	cryptoVFSErr  error
+
+	cryptoKeys = struct {
+		sync.RWMutex
+		ids   map[string]int // key -> id
+		aeads []cipher.AEAD  // id -> cipher
+		files map[string]int // database path -> id
+	}{
+		ids:   make(map[string]int),
+		files: make(map[string]int),
+	}
+)
+
+// DeriveCryptoKey derives the database encryption key from the private key of node, the key is
+// derived from the ECDH shared secret of the key pair itself, with a domain separation prefix.
+func DeriveCryptoKey(private *asymmetric.PrivateKey) (key []byte, err error) {
+	if private == nil {
+		return nil, ErrInvalidCryptoKey
+	}
+
+	secret, err := private.SharedSecret(private.PubKey())
+
+	if err != nil {
+		return
+	}
+
+	return hash.DoubleHashB(append([]byte("thunderdb storage key"), secret...)), nil
+}
+
+// SetCryptoKey sets the encryption key of the database, key should be a 16, 24 or 32 bytes AES
+// key.
+func (dsn *DSN) SetCryptoKey(key []byte) {
+	dsn.AddParam(CryptoKeyParam, hex.EncodeToString(key))
+}
+
+// setupCrypto replaces the crypto key parameter of dsn with the parameters of the crypto vfs.
+func setupCrypto(dsn *DSN) (err error) {
+	v, ok := dsn.GetParam(CryptoKeyParam)
+
+	if !ok {
+		return
+	}
+
+	key, err := hex.DecodeString(v)
+
+	if err != nil {
+		return ErrInvalidCryptoKey
+	}
+
+	id, err := registerCryptoKey(key)
+
+	if err != nil {
+		return
+	}
+
+	cryptoVFSOnce.Do(func() {
+		// the name is referenced by sqlite and never freed
+		if rc := C.registerCryptoVFS(C.CString(cryptoVFSName)); rc != C.SQLITE_OK {
+			cryptoVFSErr = errors.New("storage: failed to register crypto vfs")
+		}
+	})
+
+	if cryptoVFSErr != nil {
+		return cryptoVFSErr
+	}
+
+	dsn.RemoveParam(CryptoKeyParam)
+	dsn.AddParam("vfs", cryptoVFSName)
+	dsn.AddParam(cryptoIDParam, strconv.Itoa(id))
+
+	return
+}
+
+// registerCryptoKey returns the id of key used by the crypto vfs.
+func registerCryptoKey(key []byte) (id int, err error) {
+	cryptoKeys.Lock()
+	defer cryptoKeys.Unlock()
+
+	if id, ok := cryptoKeys.ids[string(key)]; ok {
+		return id, nil
+	}
+
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return 0, ErrInvalidCryptoKey
+	}
+
+	aead, err := cipher.NewGCM(block)
+
+	if err != nil {
+		return
+	}
+
+	id = len(cryptoKeys.aeads)
+	cryptoKeys.aeads = append(cryptoKeys.aeads, aead)
+	cryptoKeys.ids[string(key)] = id
+
+	return
+}
+
+// isHeaderPage reports whether the page at offset of a file of kind is the first page of the main
+// database, the page size and format bytes of which are kept in plaintext, so that the page size
+// can be read before the page is decrypted.
+func isHeaderPage(kind int, offset int64) bool {
+	return kind == C.CRYPTO_FILE_MAIN_DB && offset == 0
+}
+
+// splitPage splits page into the body encrypted, and the nonce and tag stored in the reserved
+// bytes.
+func splitPage(page []byte) (body, nonce, tag []byte, err error) {
+	if len(page) < 512 {
+		return nil, nil, nil, errCryptoPage
+	}
+
+	body = page[:len(page)-C.CRYPTO_RESERVE]
+	nonce = page[len(body) : len(body)+12]
+	tag = page[len(body)+12 : len(body)+28]
+	return
+}
+
+// pageText returns a copy of the encrypted part of body with extra capacity, and the additional
+// data authenticated, which binds the page to its offset in the file of kind.
+func pageText(kind int, body []byte, offset int64, extra int) (text, aad []byte) {
+	aad = make([]byte, 16, 24)
+	binary.BigEndian.PutUint64(aad[:8], uint64(kind))
+	binary.BigEndian.PutUint64(aad[8:], uint64(offset))
+	text = make([]byte, 0, len(body)+extra)
+
+	if isHeaderPage(kind, offset) {
+		aad = append(aad, body[16:24]...)
+		text = append(append(text, body[:16]...), body[24:]...)
+	} else {
+		text = append(text, body...)
+	}
+
+	return
+}
+
+// setPageText copies the encrypted part of body from text, it's the reverse of pageText.
+func setPageText(kind int, body []byte, offset int64, text []byte) {
+	if isHeaderPage(kind, offset) {
+		copy(body[:16], text)
+		copy(body[24:], text[16:])
+	} else {
+		copy(body, text)
+	}
+}
+
+// sealPage encrypts page at offset of a file of kind in place with a random nonce.
+func sealPage(aead cipher.AEAD, kind int, page []byte, offset int64) (err error) {
+	body, nonce, tag, err := splitPage(page)
+
+	if err != nil {
+		return
+	}
+
+	// sqlite may use the bytes not reserved, e.g. in a database restored from a plaintext backup
+	if isHeaderPage(kind, offset) && body[20] < C.CRYPTO_RESERVE {
+		return errCryptoReserve
+	}
+
+	if _, err = rand.Read(nonce); err != nil {
+		return
+	}
+
+	text, aad := pageText(kind, body, offset, aead.Overhead())
+	sealed := aead.Seal(text[:0], nonce, text, aad)
+	setPageText(kind, body, offset, sealed)
+	copy(tag, sealed[len(text):])
+
+	return
+}
+
+// openPage authenticates and decrypts page at offset of a file of kind in place, the reserved
+// bytes are zeroed, as the checksums of journal and wal pages are computed by sqlite with the
+// reserved bytes it never writes.
+func openPage(aead cipher.AEAD, kind int, page []byte, offset int64) (err error) {
+	body, nonce, tag, err := splitPage(page)
+
+	if err != nil {
+		return
+	}
+
+	text, aad := pageText(kind, body, offset, len(tag))
+
+	if text, err = aead.Open(text[:0], nonce, append(text, tag...), aad); err != nil {
+		return errCryptoPage
+	}
+
+	setPageText(kind, body, offset, text)
+
+	for i := len(body); i < len(page); i++ {
+		page[i] = 0
+	}
+
+	return
+}
+
+// newDatabasePage returns the first page of an empty database with bytes reserved for encryption,
+// sqlite only reserves bytes in the pages of a new database in codec builds, so the page is
+// written to a new encrypted database before sqlite initializes it.
+func newDatabasePage() (page []byte) {
+	page = make([]byte, C.CRYPTO_PAGE_SIZE)
+	copy(page, "SQLite format 3\x00")
+	binary.BigEndian.PutUint16(page[16:], C.CRYPTO_PAGE_SIZE)
+	page[18], page[19] = 1, 1 // file format versions
+	page[20] = C.CRYPTO_RESERVE
+	page[21], page[22], page[23] = 64, 32, 32 // payload fractions
+
+	// an empty sqlite_master table
+	page[100] = 0x0d
+	binary.BigEndian.PutUint16(page[105:], C.CRYPTO_PAGE_SIZE-C.CRYPTO_RESERVE)
+
+	return
+}
+
+// cryptoAEAD returns the cipher of key id, the caller should hold the read lock of cryptoKeys.
+func cryptoAEAD(id C.int) cipher.AEAD {
+	if id < 0 || int(id) >= len(cryptoKeys.aeads) {
+		return nil
+	}
+
+	return cryptoKeys.aeads[id]
+}
+
+// cBytes returns the n bytes of the C buffer buf as a slice.
+func cBytes(buf unsafe.Pointer, n C.int) []byte {
+	return (*[1 << 30]byte)(buf)[:n:n]
+}
+
+//export goCryptoSealPage
+func goCryptoSealPage(id C.int, kind C.int, buf unsafe.Pointer, n C.int, offset C.sqlite3_int64) C.int {
+	cryptoKeys.RLock()
+	defer cryptoKeys.RUnlock()
+
+	if aead := cryptoAEAD(id); aead == nil || sealPage(aead, int(kind), cBytes(buf, n), int64(offset)) != nil {
+		return 1
+	}
+
+	return 0
+}
+
+//export goCryptoOpenPage
+func goCryptoOpenPage(id C.int, kind C.int, buf unsafe.Pointer, n C.int, offset C.sqlite3_int64) C.int {
+	cryptoKeys.RLock()
+	defer cryptoKeys.RUnlock()
+
+	if aead := cryptoAEAD(id); aead == nil || openPage(aead, int(kind), cBytes(buf, n), int64(offset)) != nil {
+		return 1
+	}
+
+	return 0
+}
+
+//export goCryptoNewDatabase
+func goCryptoNewDatabase(id C.int, buf unsafe.Pointer) C.int {
+	page := newDatabasePage()
+	copy(cBytes(buf, C.CRYPTO_PAGE_SIZE), page)
+	return goCryptoSealPage(id, C.CRYPTO_FILE_MAIN_DB, buf, C.CRYPTO_PAGE_SIZE, 0)
+}
+
+//export goCryptoBindFile
+func goCryptoBindFile(name *C.char, id C.int) {
+	cryptoKeys.Lock()
+	defer cryptoKeys.Unlock()
+
+	if id < 0 {
+		delete(cryptoKeys.files, C.GoString(name))
+	} else {
+		cryptoKeys.files[C.GoString(name)] = int(id)
+	}
+}
+
+//export goCryptoLookupFile
+func goCryptoLookupFile(name *C.char) C.int {
+	fn := C.GoString(name)
+	fn = strings.TrimSuffix(strings.TrimSuffix(fn, "-journal"), "-wal")
+
+	cryptoKeys.RLock()
+	defer cryptoKeys.RUnlock()
+
+	if id, ok := cryptoKeys.files[fn]; ok {
+		return C.int(id)
+	}
+
+	return -1
+}
@@ -0,0 +1,327 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the “License”);
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an “AS IS” BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/thunderdb/ThunderDB/crypto/asymmetric"
+)
+
+// closeCachedDB closes and removes the cached database of filename, so that it can be reopened
+// with another key.
+func closeCachedDB(t *testing.T, filename string) {
+	index.Lock()
+	defer index.Unlock()
+
+	if db, ok := index.db[filename]; ok {
+		if err := db.Close(); err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+
+		delete(index.db, filename)
+	}
+}
+
+func openWithKey(t *testing.T, filename string, key []byte) *Storage {
+	d, err := NewDSN(fmt.Sprintf("file:%s", filename))
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if key != nil {
+		d.SetCryptoKey(key)
+	}
+
+	st, err := New(d.Format())
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	return st
+}
+
+func TestDeriveCryptoKey(t *testing.T) {
+	priv, _, err := asymmetric.GenSecp256k1KeyPair()
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	key1, err := DeriveCryptoKey(priv)
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	key2, err := DeriveCryptoKey(priv)
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if len(key1) != 32 || !bytes.Equal(key1, key2) {
+		t.Fatalf("Unexpected result: %x, %x", key1, key2)
+	}
+
+	other, _, err := asymmetric.GenSecp256k1KeyPair()
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if key3, _ := DeriveCryptoKey(other); bytes.Equal(key1, key3) {
+		t.Fatal("Unexpected result: same key derived from different private keys")
+	}
+
+	if _, err = DeriveCryptoKey(nil); err != ErrInvalidCryptoKey {
+		t.Fatalf("Unexpected result: %v, expected %v", err, ErrInvalidCryptoKey)
+	}
+}
+
+func TestCryptoPage(t *testing.T) {
+	id, err := registerCryptoKey(bytes.Repeat([]byte{1}, 32))
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	aead := cryptoKeys.aeads[id]
+	plain := newDatabasePage()
+	copy(plain[200:], "top-secret-value")
+
+	seal := func(offset int64) []byte {
+		page := append([]byte(nil), plain...)
+
+		if err := sealPage(aead, 0, page, offset); err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+
+		return page
+	}
+
+	// rewrites of the same page never reuse the keystream
+	page1, page2 := seal(0), seal(0)
+
+	if bytes.Equal(page1, page2) || bytes.Contains(page1, []byte("top-secret-value")) {
+		t.Fatal("Unexpected result: same ciphertext of rewrites")
+	}
+
+	// the page size of the database header is kept in plaintext
+	if !bytes.Equal(page1[16:24], plain[16:24]) || bytes.Equal(page1[:16], plain[:16]) {
+		t.Fatalf("Unexpected result: %x", page1[:24])
+	}
+
+	if err = openPage(aead, 0, page1, 0); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if !bytes.Equal(page1, plain) {
+		t.Fatal("Unexpected result: decrypted page mismatched")
+	}
+
+	// tampered or moved pages fail authentication
+	for _, i := range []int{0, 16, 200, len(plain) - 30} {
+		page := seal(0)
+		page[i] ^= 1
+
+		if err = openPage(aead, 0, page, 0); err != errCryptoPage {
+			t.Fatalf("Unexpected result: %v, expected %v", err, errCryptoPage)
+		}
+	}
+
+	if err = openPage(aead, 0, seal(4096), 8192); err != errCryptoPage {
+		t.Fatalf("Unexpected result: %v, expected %v", err, errCryptoPage)
+	}
+
+	if err = openPage(aead, 2, seal(4096), 4096); err != errCryptoPage {
+		t.Fatalf("Unexpected result: %v, expected %v", err, errCryptoPage)
+	}
+
+	// pages of databases without reserved bytes are not encrypted
+	plain[20] = 0
+
+	if err = sealPage(aead, 0, plain, 0); err != errCryptoReserve {
+		t.Fatalf("Unexpected result: %v, expected %v", err, errCryptoReserve)
+	}
+}
+
+func TestCryptoStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlite3-crypto-")
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	priv, _, err := asymmetric.GenSecp256k1KeyPair()
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	key, err := DeriveCryptoKey(priv)
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	fn := dir + "/crypto.db"
+	secret := "top-secret-value"
+	st := openWithKey(t, fn, key)
+
+	el := &ExecLog{
+		ConnectionID: 1,
+		SeqNo:        1,
+		Timestamp:    uint64(time.Now().Unix()),
+		Queries: []string{
+			"CREATE TABLE `kv` (`key` TEXT PRIMARY KEY, `value` TEXT)",
+			fmt.Sprintf("INSERT INTO `kv` VALUES ('k1', '%s')", secret),
+		},
+	}
+
+	if err = st.Prepare(context.Background(), el); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if err = st.Commit(context.Background(), el); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	// no plaintext in database or wal files
+	for _, f := range []string{fn, fn + "-wal"} {
+		data, err := ioutil.ReadFile(f)
+
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatalf("Error occurred: %v", err)
+		}
+
+		if bytes.Contains(data, []byte(secret)) || bytes.Contains(data, []byte("SQLite format 3")) {
+			t.Fatalf("Unexpected result: plaintext found in %s", f)
+		}
+	}
+
+	// wal of a crashed database is recovered
+	copyFn := dir + "/crypto-copy.db"
+
+	for _, suffix := range []string{"", "-wal"} {
+		data, err := ioutil.ReadFile(fn + suffix)
+
+		if err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+
+		if err = ioutil.WriteFile(copyFn+suffix, data, 0600); err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+	}
+
+	var value string
+
+	if err = openWithKey(t, copyFn, key).db.QueryRow(
+		"SELECT `value` FROM `kv` WHERE `key` = 'k1'").Scan(&value); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if value != secret {
+		t.Fatalf("Unexpected result: %s, expected %s", value, secret)
+	}
+
+	closeCachedDB(t, copyFn)
+	closeCachedDB(t, fn)
+
+	// can not be opened without key or with a wrong key
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s", fn))
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if err = db.QueryRow("SELECT `value` FROM `kv`").Scan(&value); err == nil {
+		t.Fatal("Unexpected result: returned nil while expecting an error")
+	} else {
+		t.Logf("Error occurred as expected: %v", err)
+	}
+
+	db.Close()
+
+	wrongKey := append([]byte(nil), key...)
+	wrongKey[0] ^= 0xff
+	st = openWithKey(t, fn, wrongKey)
+
+	if err = st.db.QueryRow("SELECT `value` FROM `kv`").Scan(&value); err == nil {
+		t.Fatal("Unexpected result: returned nil while expecting an error")
+	} else {
+		t.Logf("Error occurred as expected: %v", err)
+	}
+
+	closeCachedDB(t, fn)
+
+	// round trip with the right key
+	st = openWithKey(t, fn, key)
+
+	if err = st.db.QueryRow("SELECT `value` FROM `kv` WHERE `key` = 'k1'").Scan(&value); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if value != secret {
+		t.Fatalf("Unexpected result: %s, expected %s", value, secret)
+	}
+
+	closeCachedDB(t, fn)
+
+	// tampered database is detected
+	data, err := ioutil.ReadFile(fn)
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	data[len(data)-100] ^= 1
+
+	if err = ioutil.WriteFile(fn, data, 0600); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	st = openWithKey(t, fn, key)
+
+	if err = st.db.QueryRow("SELECT `value` FROM `kv` WHERE `key` = 'k1'").Scan(&value); err == nil {
+		t.Fatal("Unexpected result: returned nil while expecting an error")
+	} else {
+		t.Logf("Error occurred as expected: %v", err)
+	}
+
+	closeCachedDB(t, fn)
+
+	if _, err = New(fmt.Sprintf("file:%s?%s=xyz", fn, CryptoKeyParam)); err != ErrInvalidCryptoKey {
+		t.Fatalf("Unexpected result: %v, expected %v", err, ErrInvalidCryptoKey)
+	}
+
+	if _, err = New(fmt.Sprintf("file:%s?%s=0102", fn, CryptoKeyParam)); err != ErrInvalidCryptoKey {
+		t.Fatalf("Unexpected result: %v, expected %v", err, ErrInvalidCryptoKey)
+	}
+}
@@ -0,0 +1,372 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the “License”);
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an “AS IS” BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// crypto vfs is a shim of the default sqlite vfs, which encrypts the pages of the main database,
+// rollback journal and wal files with goCryptoSealPage, and authenticates and decrypts them with
+// goCryptoOpenPage. The key of a main database is specified by the crypto_id uri parameter, and is
+// bound to the path of the database, so that its journal and wal files use the same key. Other
+// files are not encrypted.
+//
+// The nonce and tag of a page are stored in the CRYPTO_RESERVE bytes reserved at the end of the
+// page, which are reserved by the first page written to a new database by cryptoInitDatabase.
+// Pages are always written as a whole, other writes of the journal and wal files, i.e. headers,
+// page numbers and checksums, are not encrypted, and other writes of the main database are
+// rejected.
+
+#include <stdlib.h>
+#include <string.h>
+#include "crypto_vfs.h"
+#include "_cgo_export.h"
+
+typedef struct CryptoFile {
+	sqlite3_file base;
+	sqlite3_file *pReal;
+	int keyID; // -1 if not encrypted
+	int kind;
+} CryptoFile;
+
+static sqlite3_vfs cryptoVFS;
+static sqlite3_vfs *pRootVFS;
+
+static int cryptoClose(sqlite3_file *pFile) {
+	CryptoFile *p = (CryptoFile *)pFile;
+	return p->pReal->pMethods->xClose(p->pReal);
+}
+
+// isPageSize reports whether n is a valid sqlite page size.
+static int isPageSize(sqlite3_int64 n) {
+	return n >= 512 && n <= 65536 && (n & (n - 1)) == 0;
+}
+
+// cryptoReadPage reads the page after the nHdr bytes of header at iOfst, rcAuth is returned if the
+// page fails authentication. A page not read completely or failing authentication is filled with
+// zeros, so that a torn journal record or wal frame fails the checksum of sqlite.
+static int cryptoReadPage(CryptoFile *p, char *zBuf, int iAmt, sqlite3_int64 iOfst, int nHdr, int rcAuth) {
+	int rc = p->pReal->pMethods->xRead(p->pReal, zBuf, iAmt, iOfst);
+
+	if (rc == SQLITE_IOERR_SHORT_READ) {
+		memset(zBuf + nHdr, 0, iAmt - nHdr);
+		return rc;
+	}
+
+	if (rc != SQLITE_OK) {
+		return rc;
+	}
+
+	if (goCryptoOpenPage(p->keyID, p->kind, zBuf + nHdr, iAmt - nHdr, iOfst + nHdr) != 0) {
+		memset(zBuf + nHdr, 0, iAmt - nHdr);
+		return rcAuth;
+	}
+
+	return SQLITE_OK;
+}
+
+// cryptoReadHeader reads a part of the first page of the main database, the page size is read from
+// the plaintext bytes of the database header. The part is read as zeros if the page fails
+// authentication, which could be torn before the hot journal is rolled back, the page is
+// authenticated again when it's read as a whole.
+static int cryptoReadHeader(CryptoFile *p, void *zBuf, int iAmt, sqlite3_int64 iOfst) {
+	unsigned char aSize[2];
+	char *zPage;
+	int pgsz;
+	int rc;
+
+	memset(zBuf, 0, iAmt);
+
+	if ((rc = p->pReal->pMethods->xRead(p->pReal, aSize, 2, 16)) != SQLITE_OK) {
+		return rc;
+	}
+
+	pgsz = (aSize[0] << 8) | (aSize[1] << 16);
+
+	if (!isPageSize(pgsz) || iOfst + iAmt > pgsz) {
+		return SQLITE_OK;
+	}
+
+	if ((zPage = sqlite3_malloc(pgsz)) == 0) {
+		return SQLITE_NOMEM;
+	}
+
+	if ((rc = cryptoReadPage(p, zPage, pgsz, 0, 0, SQLITE_OK)) == SQLITE_OK) {
+		memcpy(zBuf, zPage + iOfst, iAmt);
+	}
+
+	sqlite3_free(zPage);
+	return rc;
+}
+
+static int cryptoRead(sqlite3_file *pFile, void *zBuf, int iAmt, sqlite3_int64 iOfst) {
+	CryptoFile *p = (CryptoFile *)pFile;
+
+	if (p->keyID >= 0) {
+		switch (p->kind) {
+		case CRYPTO_FILE_MAIN_DB:
+			if (isPageSize(iAmt) && iOfst % iAmt == 0) {
+				return cryptoReadPage(p, zBuf, iAmt, iOfst, 0, SQLITE_CORRUPT);
+			}
+			return cryptoReadHeader(p, zBuf, iAmt, iOfst);
+		case CRYPTO_FILE_MAIN_JOURNAL:
+			// the page of a journal record follows the 4 bytes page number, and the records
+			// start at sector boundaries after the journal header
+			if (isPageSize(iAmt) && iOfst % 8 == 4) {
+				return cryptoReadPage(p, zBuf, iAmt, iOfst, 0, SQLITE_OK);
+			}
+			break;
+		case CRYPTO_FILE_WAL:
+			if (isPageSize(iAmt)) {
+				return cryptoReadPage(p, zBuf, iAmt, iOfst, 0, SQLITE_CORRUPT);
+			}
+			// wal frames are read with the 24 bytes frame header on recovery
+			if (iAmt > 24 && isPageSize(iAmt - 24)) {
+				return cryptoReadPage(p, zBuf, iAmt, iOfst, 24, SQLITE_OK);
+			}
+			break;
+		}
+	}
+
+	return p->pReal->pMethods->xRead(p->pReal, zBuf, iAmt, iOfst);
+}
+
+static int cryptoWritePage(CryptoFile *p, const void *zBuf, int iAmt, sqlite3_int64 iOfst) {
+	void *zEnc;
+	int rc;
+
+	if ((zEnc = sqlite3_malloc(iAmt)) == 0) {
+		return SQLITE_NOMEM;
+	}
+
+	memcpy(zEnc, zBuf, iAmt);
+
+	if (goCryptoSealPage(p->keyID, p->kind, zEnc, iAmt, iOfst) != 0) {
+		sqlite3_free(zEnc);
+		return SQLITE_IOERR_WRITE;
+	}
+
+	rc = p->pReal->pMethods->xWrite(p->pReal, zEnc, iAmt, iOfst);
+	sqlite3_free(zEnc);
+	return rc;
+}
+
+static int cryptoWrite(sqlite3_file *pFile, const void *zBuf, int iAmt, sqlite3_int64 iOfst) {
+	CryptoFile *p = (CryptoFile *)pFile;
+
+	if (p->keyID >= 0) {
+		switch (p->kind) {
+		case CRYPTO_FILE_MAIN_DB:
+			if (isPageSize(iAmt) && iOfst % iAmt == 0) {
+				return cryptoWritePage(p, zBuf, iAmt, iOfst);
+			}
+			return SQLITE_IOERR_WRITE;
+		case CRYPTO_FILE_MAIN_JOURNAL:
+			if (isPageSize(iAmt) && iOfst % 8 == 4) {
+				return cryptoWritePage(p, zBuf, iAmt, iOfst);
+			}
+			break;
+		case CRYPTO_FILE_WAL:
+			if (isPageSize(iAmt)) {
+				return cryptoWritePage(p, zBuf, iAmt, iOfst);
+			}
+			// only the wal header and frame headers are written in plaintext, a page split on
+			// the sync point without powersafe overwrite is rejected
+			if (iAmt != 32 && iAmt != 24) {
+				return SQLITE_IOERR_WRITE;
+			}
+			break;
+		}
+	}
+
+	return p->pReal->pMethods->xWrite(p->pReal, zBuf, iAmt, iOfst);
+}
+
+static int cryptoTruncate(sqlite3_file *pFile, sqlite3_int64 size) {
+	CryptoFile *p = (CryptoFile *)pFile;
+	return p->pReal->pMethods->xTruncate(p->pReal, size);
+}
+
+static int cryptoSync(sqlite3_file *pFile, int flags) {
+	CryptoFile *p = (CryptoFile *)pFile;
+	return p->pReal->pMethods->xSync(p->pReal, flags);
+}
+
+static int cryptoFileSize(sqlite3_file *pFile, sqlite3_int64 *pSize) {
+	CryptoFile *p = (CryptoFile *)pFile;
+	return p->pReal->pMethods->xFileSize(p->pReal, pSize);
+}
+
+static int cryptoLock(sqlite3_file *pFile, int eLock) {
+	CryptoFile *p = (CryptoFile *)pFile;
+	return p->pReal->pMethods->xLock(p->pReal, eLock);
+}
+
+static int cryptoUnlock(sqlite3_file *pFile, int eLock) {
+	CryptoFile *p = (CryptoFile *)pFile;
+	return p->pReal->pMethods->xUnlock(p->pReal, eLock);
+}
+
+static int cryptoCheckReservedLock(sqlite3_file *pFile, int *pResOut) {
+	CryptoFile *p = (CryptoFile *)pFile;
+	return p->pReal->pMethods->xCheckReservedLock(p->pReal, pResOut);
+}
+
+static int cryptoFileControl(sqlite3_file *pFile, int op, void *pArg) {
+	CryptoFile *p = (CryptoFile *)pFile;
+	return p->pReal->pMethods->xFileControl(p->pReal, op, pArg);
+}
+
+static int cryptoSectorSize(sqlite3_file *pFile) {
+	CryptoFile *p = (CryptoFile *)pFile;
+	return p->pReal->pMethods->xSectorSize(p->pReal);
+}
+
+static int cryptoDeviceCharacteristics(sqlite3_file *pFile) {
+	CryptoFile *p = (CryptoFile *)pFile;
+	return p->pReal->pMethods->xDeviceCharacteristics(p->pReal);
+}
+
+static int cryptoShmMap(sqlite3_file *pFile, int iPg, int pgsz, int bExtend, void volatile **pp) {
+	CryptoFile *p = (CryptoFile *)pFile;
+	return p->pReal->pMethods->xShmMap(p->pReal, iPg, pgsz, bExtend, pp);
+}
+
+static int cryptoShmLock(sqlite3_file *pFile, int offset, int n, int flags) {
+	CryptoFile *p = (CryptoFile *)pFile;
+	return p->pReal->pMethods->xShmLock(p->pReal, offset, n, flags);
+}
+
+static void cryptoShmBarrier(sqlite3_file *pFile) {
+	CryptoFile *p = (CryptoFile *)pFile;
+	p->pReal->pMethods->xShmBarrier(p->pReal);
+}
+
+static int cryptoShmUnmap(sqlite3_file *pFile, int deleteFlag) {
+	CryptoFile *p = (CryptoFile *)pFile;
+	return p->pReal->pMethods->xShmUnmap(p->pReal, deleteFlag);
+}
+
+static int cryptoFetch(sqlite3_file *pFile, sqlite3_int64 iOfst, int iAmt, void **pp) {
+	// memory mapped pages are encrypted, always fallback to xRead
+	*pp = 0;
+	return SQLITE_OK;
+}
+
+static int cryptoUnfetch(sqlite3_file *pFile, sqlite3_int64 iOfst, void *pPage) {
+	return SQLITE_OK;
+}
+
+static const sqlite3_io_methods cryptoIOMethods = {
+	3,
+	cryptoClose,
+	cryptoRead,
+	cryptoWrite,
+	cryptoTruncate,
+	cryptoSync,
+	cryptoFileSize,
+	cryptoLock,
+	cryptoUnlock,
+	cryptoCheckReservedLock,
+	cryptoFileControl,
+	cryptoSectorSize,
+	cryptoDeviceCharacteristics,
+	cryptoShmMap,
+	cryptoShmLock,
+	cryptoShmBarrier,
+	cryptoShmUnmap,
+	cryptoFetch,
+	cryptoUnfetch,
+};
+
+// cryptoInitDatabase writes the first page of an empty database to reserve bytes in each page, the
+// file is locked exclusively, so that a database initialized by another connection is never
+// overwritten.
+static int cryptoInitDatabase(CryptoFile *p) {
+	sqlite3_file *pReal = p->pReal;
+	sqlite3_int64 size;
+	void *zPage;
+	int rc;
+
+	if ((rc = pReal->pMethods->xLock(pReal, SQLITE_LOCK_SHARED)) == SQLITE_OK &&
+	    (rc = pReal->pMethods->xLock(pReal, SQLITE_LOCK_RESERVED)) == SQLITE_OK &&
+	    (rc = pReal->pMethods->xLock(pReal, SQLITE_LOCK_EXCLUSIVE)) == SQLITE_OK &&
+	    (rc = pReal->pMethods->xFileSize(pReal, &size)) == SQLITE_OK && size == 0) {
+		if ((zPage = sqlite3_malloc(CRYPTO_PAGE_SIZE)) == 0) {
+			rc = SQLITE_NOMEM;
+		} else if (goCryptoNewDatabase(p->keyID, zPage) != 0) {
+			rc = SQLITE_IOERR_WRITE;
+		} else if ((rc = pReal->pMethods->xWrite(pReal, zPage, CRYPTO_PAGE_SIZE, 0)) == SQLITE_OK) {
+			rc = pReal->pMethods->xSync(pReal, SQLITE_SYNC_NORMAL);
+		}
+
+		sqlite3_free(zPage);
+	}
+
+	pReal->pMethods->xUnlock(pReal, SQLITE_LOCK_NONE);
+
+	// the database is opened by another connection, which has initialized it
+	return rc == SQLITE_BUSY ? SQLITE_OK : rc;
+}
+
+static int cryptoOpen(sqlite3_vfs *pVfs, const char *zName, sqlite3_file *pFile, int flags, int *pOutFlags) {
+	CryptoFile *p = (CryptoFile *)pFile;
+	const char *zID;
+	int rc;
+
+	memset(p, 0, sizeof(CryptoFile));
+	p->pReal = (sqlite3_file *)&p[1];
+	p->keyID = -1;
+
+	if (zName != 0) {
+		if (flags & SQLITE_OPEN_MAIN_DB) {
+			p->kind = CRYPTO_FILE_MAIN_DB;
+			zID = sqlite3_uri_parameter(zName, "crypto_id");
+			p->keyID = zID != 0 ? atoi(zID) : -1;
+			goCryptoBindFile((char *)zName, p->keyID);
+		} else if (flags & SQLITE_OPEN_MAIN_JOURNAL) {
+			p->kind = CRYPTO_FILE_MAIN_JOURNAL;
+			p->keyID = goCryptoLookupFile((char *)zName);
+		} else if (flags & SQLITE_OPEN_WAL) {
+			p->kind = CRYPTO_FILE_WAL;
+			p->keyID = goCryptoLookupFile((char *)zName);
+		}
+	}
+
+	rc = pRootVFS->xOpen(pRootVFS, zName, p->pReal, flags, pOutFlags);
+
+	if (rc == SQLITE_OK && p->kind == CRYPTO_FILE_MAIN_DB && p->keyID >= 0 && (flags & SQLITE_OPEN_READWRITE)) {
+		if ((rc = cryptoInitDatabase(p)) != SQLITE_OK) {
+			p->pReal->pMethods->xClose(p->pReal);
+		}
+	}
+
+	if (rc == SQLITE_OK) {
+		p->base.pMethods = &cryptoIOMethods;
+	}
+
+	return rc;
+}
+
+int registerCryptoVFS(const char *zName) {
+	if ((pRootVFS = sqlite3_vfs_find(0)) == 0) {
+		return SQLITE_ERROR;
+	}
+
+	cryptoVFS = *pRootVFS;
+	cryptoVFS.pNext = 0;
+	cryptoVFS.zName = zName;
+	cryptoVFS.szOsFile = sizeof(CryptoFile) + pRootVFS->szOsFile;
+	cryptoVFS.xOpen = cryptoOpen;
+
+	return sqlite3_vfs_register(&cryptoVFS, 0);
+}
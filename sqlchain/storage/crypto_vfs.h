@@ -0,0 +1,34 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the “License”);
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an “AS IS” BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+#ifndef THUNDERDB_CRYPTO_VFS_H
+#define THUNDERDB_CRYPTO_VFS_H
+
+#include "sqlite3-binding.h"
+
+// kinds of files encrypted by the crypto vfs
+#define CRYPTO_FILE_MAIN_DB 0
+#define CRYPTO_FILE_MAIN_JOURNAL 1
+#define CRYPTO_FILE_WAL 2
+
+// page size of new encrypted databases, and the bytes reserved at the end of each page for the
+// nonce and tag of the page
+#define CRYPTO_PAGE_SIZE 4096
+#define CRYPTO_RESERVE 32
+
+int registerCryptoVFS(const char *zName);
+
+#endif
@@ -27,7 +27,8 @@ type DSN struct {
 	params   map[string]string
 }
 
-// NewDSN parses the given string and returns a DSN.
+// NewDSN parses the given string and returns a DSN, the pragma parameters are checked against
+// AllowedPragmas, see SetPragma.
 func NewDSN(s string) (*DSN, error) {
 	parts := strings.SplitN(s, "?", 2)
 
@@ -50,6 +51,10 @@ func NewDSN(s string) (*DSN, error) {
 		dsn.params[param[0]] = param[1]
 	}
 
+	if err := dsn.checkConnParams(); err != nil {
+		return nil, err
+	}
+
 	return dsn, nil
 }
 
@@ -90,3 +95,8 @@ func (dsn *DSN) GetParam(key string) (value string, ok bool) {
 	value, ok = dsn.params[key]
 	return
 }
+
+// RemoveParam removes the parameter of key.
+func (dsn *DSN) RemoveParam(key string) {
+	delete(dsn.params, key)
+}
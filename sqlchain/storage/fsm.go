@@ -0,0 +1,55 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"context"
+
+	"github.com/thunderdb/ThunderDB/kayak"
+)
+
+// FSM is a kayak.FSM which commits the ExecLog of each committed kayak log to the storage. The
+// log data must be encoded by ExecLog.MarshalBinary.
+type FSM struct {
+	st *Storage
+}
+
+// NewFSM returns a new FSM applying logs to st.
+func NewFSM(st *Storage) *FSM {
+	return &FSM{st: st}
+}
+
+// Apply implements kayak.FSM.Apply, the committed ExecLog is returned along with its undo log.
+func (f *FSM) Apply(l *kayak.Log) (interface{}, error) {
+	el := &ExecLog{}
+
+	if err := el.UnmarshalBinary(l.Data); err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+
+	if err := f.st.Prepare(ctx, el); err != nil {
+		return nil, err
+	}
+
+	if err := f.st.Commit(ctx, el); err != nil {
+		return nil, err
+	}
+
+	return el, nil
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/thunderdb/ThunderDB/kayak"
+)
+
+func TestFSM(t *testing.T) {
+	fl, err := ioutil.TempFile("", "sqlite3-")
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	st, err := New(fmt.Sprintf("file:%s", fl.Name()))
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	fsm := NewFSM(st)
+	queries := []string{
+		"CREATE TABLE IF NOT EXISTS `kv` (`key` TEXT PRIMARY KEY, `value` BLOB)",
+		"INSERT INTO `kv` VALUES ('k1', 'v1')",
+		"UPDATE `kv` SET `value` = 'v1-2' WHERE `key` = 'k1'",
+		"INSERT INTO `kv` VALUES ('k2', 'v2')",
+	}
+
+	for i, q := range queries {
+		data, err := (&ExecLog{
+			ConnectionID: 1,
+			SeqNo:        uint64(i + 1),
+			Queries:      []string{q},
+		}).MarshalBinary()
+
+		if err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+
+		res, err := fsm.Apply(&kayak.Log{Index: uint64(i + 1), Data: data})
+
+		if err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+
+		if el, ok := res.(*ExecLog); !ok || el.SeqNo != uint64(i+1) {
+			t.Fatalf("Unexpected result: %v", res)
+		}
+	}
+
+	if kvs := dumpKV(t, st); !reflect.DeepEqual(kvs, map[string]string{
+		"k1": "v1-2",
+		"k2": "v2",
+	}) {
+		t.Fatalf("Unexpected result: %v", kvs)
+	}
+
+	history := st.CommittedHistory(len(queries))
+
+	for i, id := range history {
+		if id.SeqNo != uint64(i+1) {
+			t.Fatalf("Unexpected commit order: %v", history)
+		}
+	}
+
+	// Corrupted log is not applied
+	if _, err = fsm.Apply(&kayak.Log{Index: 5, Data: []byte{0xc1}}); err == nil {
+		t.Fatal("Unexpected result: returned nil while expecting an error")
+	}
+
+	if id := st.LastCommittedTxID(); id.SeqNo != uint64(len(queries)) {
+		t.Fatalf("Unexpected last committed tx: %v", id)
+	}
+}
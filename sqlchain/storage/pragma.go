@@ -0,0 +1,230 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+const (
+	// PragmaParamPrefix is the prefix of the DSN parameters of the additional pragmas, e.g.
+	// "_pragma_foreign_keys=1", which are executed on each new connection, see SetPragma. Only the
+	// pragmas in AllowedPragmas are accepted.
+	PragmaParamPrefix = "_pragma_"
+
+	// ExtensionsParam is the DSN parameter of the comma separated names of the extension loaders
+	// called on each new connection, see RegisterExtension and AddExtension.
+	ExtensionsParam = "_extensions"
+
+	// driverName is the sql driver which applies the pragmas and extensions of DSN.
+	driverName = "thunderdb_sqlite3"
+)
+
+var (
+	// AllowedPragmas is the set of pragmas which can be set by DSN.
+	AllowedPragmas = map[string]bool{
+		"foreign_keys":       true,
+		"cache_size":         true,
+		"temp_store":         true,
+		"mmap_size":          true,
+		"recursive_triggers": true,
+		"secure_delete":      true,
+	}
+
+	// ErrUnsupportedPragma indicates the pragma is not in AllowedPragmas.
+	ErrUnsupportedPragma = errors.New("storage: unsupported pragma")
+
+	// ErrInvalidPragmaValue indicates the pragma value is not a plain word or number.
+	ErrInvalidPragmaValue = errors.New("storage: invalid pragma value")
+
+	// ErrUnknownExtension indicates the extension loader is not registered.
+	ErrUnknownExtension = errors.New("storage: unknown extension")
+
+	extensions = struct {
+		sync.RWMutex
+		loaders map[string]ExtensionLoader
+	}{
+		loaders: make(map[string]ExtensionLoader),
+	}
+)
+
+// ExtensionLoader loads extensions or registers functions on a new connection, e.g. by
+// conn.LoadExtension.
+type ExtensionLoader func(conn *sqlite3.SQLiteConn) error
+
+func init() {
+	sql.Register(driverName, &pragmaDriver{})
+}
+
+// RegisterExtension registers the extension loader under name, so that it can be referenced by
+// DSN, see AddExtension. The loader registered under the same name is replaced.
+func RegisterExtension(name string, loader ExtensionLoader) {
+	extensions.Lock()
+	defer extensions.Unlock()
+
+	extensions.loaders[name] = loader
+}
+
+// SetPragma sets the pragma executed on each new connection, only the pragmas in AllowedPragmas
+// are accepted.
+func (dsn *DSN) SetPragma(name, value string) (err error) {
+	if err = checkPragma(name, value); err != nil {
+		return
+	}
+
+	dsn.AddParam(PragmaParamPrefix+name, value)
+	return
+}
+
+// AddExtension adds the extension loader registered under name to be called on each new
+// connection.
+func (dsn *DSN) AddExtension(name string) {
+	if v, ok := dsn.GetParam(ExtensionsParam); ok && v != "" {
+		name = v + "," + name
+	}
+
+	dsn.AddParam(ExtensionsParam, name)
+}
+
+// checkPragma checks the pragma is allowed and its value can't inject statements.
+func checkPragma(name, value string) error {
+	if !AllowedPragmas[name] {
+		return ErrUnsupportedPragma
+	}
+
+	if value == "" {
+		return ErrInvalidPragmaValue
+	}
+
+	for i, c := range value {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '_':
+		case c == '-' && i == 0:
+		default:
+			return ErrInvalidPragmaValue
+		}
+	}
+
+	return nil
+}
+
+// checkConnParams checks the pragma parameters of dsn.
+func (dsn *DSN) checkConnParams() error {
+	for k, v := range dsn.params {
+		if strings.HasPrefix(k, PragmaParamPrefix) {
+			if err := checkPragma(strings.TrimPrefix(k, PragmaParamPrefix), v); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// takeConnParams removes and returns the pragma statements in name order and the extension names
+// of dsn, which are unknown to the sqlite driver.
+func (dsn *DSN) takeConnParams() (pragmas []string, exts []string) {
+	for k, v := range dsn.params {
+		if strings.HasPrefix(k, PragmaParamPrefix) {
+			pragmas = append(pragmas,
+				fmt.Sprintf("PRAGMA %s = %s", strings.TrimPrefix(k, PragmaParamPrefix), v))
+			delete(dsn.params, k)
+		}
+	}
+
+	sort.Strings(pragmas)
+
+	if v, ok := dsn.GetParam(ExtensionsParam); ok {
+		if v != "" {
+			exts = strings.Split(v, ",")
+		}
+
+		dsn.RemoveParam(ExtensionsParam)
+	}
+
+	return
+}
+
+// pragmaDriver is the sqlite driver which executes the pragmas and calls the extension loaders
+// of DSN on each new connection.
+type pragmaDriver struct {
+	sqlite3.SQLiteDriver
+}
+
+// Open implements driver.Driver.Open.
+func (d *pragmaDriver) Open(dsn string) (conn driver.Conn, err error) {
+	pd, err := NewDSN(dsn)
+
+	if err != nil {
+		return
+	}
+
+	pragmas, exts := pd.takeConnParams()
+
+	if len(pragmas) == 0 && len(exts) == 0 {
+		return d.SQLiteDriver.Open(dsn)
+	}
+
+	loaders := make([]ExtensionLoader, len(exts))
+
+	extensions.RLock()
+	for i, name := range exts {
+		loaders[i] = extensions.loaders[name]
+	}
+	extensions.RUnlock()
+
+	for _, loader := range loaders {
+		if loader == nil {
+			return nil, ErrUnknownExtension
+		}
+	}
+
+	if conn, err = d.SQLiteDriver.Open(pd.Format()); err != nil {
+		return
+	}
+
+	sc := conn.(*sqlite3.SQLiteConn)
+
+	defer func() {
+		if err != nil {
+			sc.Close()
+			conn = nil
+		}
+	}()
+
+	for _, pragma := range pragmas {
+		if _, err = sc.Exec(pragma, nil); err != nil {
+			return
+		}
+	}
+
+	for _, loader := range loaders {
+		if err = loader(sc); err != nil {
+			return
+		}
+	}
+
+	return
+}
@@ -0,0 +1,243 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+func newPragmaStorage(t *testing.T, setup func(dsn *DSN)) (st *Storage, cleanup func()) {
+	fl, err := ioutil.TempFile("", "sqlite3-")
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	fl.Close()
+
+	dsn, err := NewDSN("file:" + fl.Name())
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	setup(dsn)
+
+	if st, err = New(dsn.Format()); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	return st, func() {
+		os.Remove(fl.Name())
+		os.Remove(fl.Name() + "-wal")
+		os.Remove(fl.Name() + "-shm")
+	}
+}
+
+func TestDSNPragmas(t *testing.T) {
+	dsn, err := NewDSN("file:test.db?cache=shared")
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if err = dsn.SetPragma("foreign_keys", "1"); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if err = dsn.SetPragma("cache_size", "-4000"); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	dsn.AddExtension("ext1")
+	dsn.AddExtension("ext2")
+
+	// Format round-trips the extra params
+	parsed, err := NewDSN(dsn.Format())
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if !reflect.DeepEqual(dsn, parsed) {
+		t.Fatalf("Result mismatch:\n\tExpected = %+v\n\tActual = %+v\n", dsn, parsed)
+	}
+
+	if v, _ := parsed.GetParam(ExtensionsParam); v != "ext1,ext2" {
+		t.Fatalf("Unexpected extensions: %s", v)
+	}
+
+	// Pragmas out of the allowlist or with unsafe values are rejected
+	if err = dsn.SetPragma("journal_mode", "DELETE"); err != ErrUnsupportedPragma {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if err = dsn.SetPragma("cache_size", "1; DROP TABLE t"); err != ErrInvalidPragmaValue {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if _, err = NewDSN("file:test.db?_pragma_writable_schema=1"); err != ErrUnsupportedPragma {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestForeignKeysPragma(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		st, cleanup := newPragmaStorage(t, func(dsn *DSN) {
+			if enabled {
+				if err := dsn.SetPragma("foreign_keys", "ON"); err != nil {
+					t.Fatalf("Error occurred: %v", err)
+				}
+			}
+		})
+		defer cleanup()
+
+		if _, err := st.db.Exec("CREATE TABLE `parent` (`id` INTEGER PRIMARY KEY); " +
+			"CREATE TABLE `child` (`pid` INTEGER REFERENCES `parent`(`id`))"); err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+
+		// Pragma is applied on all the connections in pool
+		conns := make([]*sql.Conn, 0, 3)
+
+		for i := 0; i < cap(conns); i++ {
+			conn, err := st.db.Conn(context.Background())
+
+			if err != nil {
+				t.Fatalf("Error occurred: %v", err)
+			}
+
+			var fk int
+			row := conn.QueryRowContext(context.Background(), "PRAGMA foreign_keys")
+
+			if err = row.Scan(&fk); err != nil {
+				t.Fatalf("Error occurred: %v", err)
+			}
+
+			if (fk != 0) != enabled {
+				t.Fatalf("Unexpected foreign_keys: %d", fk)
+			}
+
+			conns = append(conns, conn)
+		}
+
+		for _, conn := range conns {
+			conn.Close()
+		}
+
+		_, err := st.db.Exec("INSERT INTO `child` VALUES (1)")
+
+		if enabled && (err == nil || !strings.Contains(err.Error(), "FOREIGN KEY")) {
+			t.Fatalf("Unexpected error: %v", err)
+		} else if !enabled && err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+	}
+}
+
+func TestDefaultPragmas(t *testing.T) {
+	st, cleanup := newPragmaStorage(t, func(dsn *DSN) {
+		if err := dsn.SetPragma("cache_size", "-4000"); err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+	})
+	defer cleanup()
+
+	var (
+		journalMode string
+		synchronous int
+		cacheSize   int
+	)
+
+	if err := st.db.QueryRow("PRAGMA journal_mode").Scan(&journalMode); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if err := st.db.QueryRow("PRAGMA synchronous").Scan(&synchronous); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if err := st.db.QueryRow("PRAGMA cache_size").Scan(&cacheSize); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	// FULL synchronous is 2
+	if journalMode != "wal" || synchronous != 2 || cacheSize != -4000 {
+		t.Fatalf("Unexpected pragmas: journal_mode = %s, synchronous = %d, cache_size = %d",
+			journalMode, synchronous, cacheSize)
+	}
+
+	// Defaults can be overridden
+	overridden, cleanup := newPragmaStorage(t, func(dsn *DSN) {
+		dsn.AddParam("_synchronous", "NORMAL")
+	})
+	defer cleanup()
+
+	if err := overridden.db.QueryRow("PRAGMA synchronous").Scan(&synchronous); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	// NORMAL synchronous is 1
+	if synchronous != 1 {
+		t.Fatalf("Unexpected synchronous: %d", synchronous)
+	}
+}
+
+func TestExtensionLoader(t *testing.T) {
+	RegisterExtension("test_reverse", func(conn *sqlite3.SQLiteConn) error {
+		return conn.RegisterFunc("reverse", func(s string) string {
+			r := []rune(s)
+			for i, j := 0, len(r)-1; i < j; i, j = i+1, j-1 {
+				r[i], r[j] = r[j], r[i]
+			}
+			return string(r)
+		}, true)
+	})
+
+	st, cleanup := newPragmaStorage(t, func(dsn *DSN) {
+		dsn.AddExtension("test_reverse")
+	})
+	defer cleanup()
+
+	var reversed string
+
+	if err := st.db.QueryRow("SELECT reverse('abc')").Scan(&reversed); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if reversed != "cba" {
+		t.Fatalf("Unexpected result: %s", reversed)
+	}
+
+	// Unknown extension fails the connection
+	unknown, cleanup := newPragmaStorage(t, func(dsn *DSN) {
+		dsn.AddExtension("test_unknown")
+	})
+	defer cleanup()
+
+	if err := unknown.db.Ping(); err != ErrUnknownExtension {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,249 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the “License”);
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an “AS IS” BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+)
+
+var (
+	// ErrUnterminatedStatement indicates a quoted string, identifier or block comment is not
+	// terminated in a query.
+	ErrUnterminatedStatement = errors.New("storage: unterminated statement")
+
+	// ErrStatementDenied indicates a statement type is not allowed by the StatementPolicy.
+	ErrStatementDenied = errors.New("storage: statement denied")
+)
+
+// StatementPolicy defines the statement types allowed to be executed by Storage, the type of a
+// statement is its first keyword, e.g., SELECT, INSERT, PRAGMA.
+type StatementPolicy struct {
+	// Allow is the list of allowed statement types, all types are allowed if it's empty.
+	Allow []string
+	// Deny is the list of denied statement types, it takes precedence over Allow.
+	Deny []string
+}
+
+// Check returns ErrStatementDenied if the statement type of stmt is not allowed.
+func (p *StatementPolicy) Check(stmt string) error {
+	t := StatementType(stmt)
+
+	for _, d := range p.Deny {
+		if strings.EqualFold(d, t) {
+			return ErrStatementDenied
+		}
+	}
+
+	if len(p.Allow) == 0 {
+		return nil
+	}
+
+	for _, a := range p.Allow {
+		if strings.EqualFold(a, t) {
+			return nil
+		}
+	}
+
+	return ErrStatementDenied
+}
+
+// StatementType returns the upper-cased first keyword of a statement, leading comments are
+// skipped.
+func StatementType(stmt string) string {
+	s := &scanner{src: stmt}
+
+	for s.pos < len(s.src) {
+		if s.skipSpaceAndComments() {
+			continue
+		}
+
+		return strings.ToUpper(s.word())
+	}
+
+	return ""
+}
+
+// SplitStatements splits a query into statements separated by semicolons. Semicolons in quoted
+// strings, quoted identifiers, comments and trigger bodies are not separators. The statements
+// are trimmed, and empty statements are dropped.
+func SplitStatements(query string) (stmts []string, err error) {
+	var (
+		s     = &scanner{src: query}
+		start int
+		first string // first keyword of current statement
+		words int    // keywords count of current statement
+		// trigger body state
+		isTrigger bool
+		inBody    bool
+		caseDepth int
+		lastWord  string
+	)
+
+	flush := func(end int) {
+		if stmt := strings.TrimSpace(query[start:end]); stmt != "" && words > 0 {
+			stmts = append(stmts, stmt)
+		}
+		start = s.pos
+		first, words, isTrigger, inBody, caseDepth, lastWord = "", 0, false, false, 0, ""
+	}
+
+	for s.pos < len(s.src) {
+		if s.skipSpaceAndComments() {
+			continue
+		}
+
+		if s.err != nil {
+			return nil, s.err
+		}
+
+		c := s.src[s.pos]
+
+		switch {
+		case c == '\'' || c == '"' || c == '`' || c == '[':
+			if err = s.skipQuoted(); err != nil {
+				return nil, err
+			}
+			words++
+			lastWord = ""
+		case c == ';':
+			s.pos++
+			if inBody && lastWord != "END" {
+				// statement separator inside trigger body
+				lastWord = ""
+				continue
+			}
+			flush(s.pos - 1)
+		case isWordChar(rune(c)):
+			w := strings.ToUpper(s.word())
+			words++
+
+			if words == 1 {
+				first = w
+			} else if first == "CREATE" && w == "TRIGGER" && words <= 3 {
+				// CREATE [TEMP|TEMPORARY] TRIGGER
+				isTrigger = true
+			}
+
+			if isTrigger {
+				switch w {
+				case "BEGIN":
+					inBody = true
+				case "CASE":
+					caseDepth++
+				case "END":
+					if caseDepth > 0 {
+						caseDepth--
+						w = ""
+					}
+				}
+			}
+
+			lastWord = w
+		default:
+			s.pos++
+			words++
+			lastWord = ""
+		}
+	}
+
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	flush(len(query))
+
+	return
+}
+
+// scanner is a minimal sqlite lexer used to split statements.
+type scanner struct {
+	src string
+	pos int
+	err error
+}
+
+// skipSpaceAndComments skips white spaces or a comment at current position, it returns false if
+// nothing is skipped.
+func (s *scanner) skipSpaceAndComments() bool {
+	switch {
+	case unicode.IsSpace(rune(s.src[s.pos])):
+		s.pos++
+	case strings.HasPrefix(s.src[s.pos:], "--"):
+		if end := strings.IndexByte(s.src[s.pos:], '\n'); end >= 0 {
+			s.pos += end + 1
+		} else {
+			s.pos = len(s.src)
+		}
+	case strings.HasPrefix(s.src[s.pos:], "/*"):
+		if end := strings.Index(s.src[s.pos+2:], "*/"); end >= 0 {
+			s.pos += end + 4
+		} else {
+			s.pos = len(s.src)
+			s.err = ErrUnterminatedStatement
+		}
+	default:
+		return false
+	}
+
+	return true
+}
+
+// skipQuoted skips a quoted string or identifier at current position, quotes are escaped by
+// doubling them.
+func (s *scanner) skipQuoted() error {
+	open := s.src[s.pos]
+	closing := open
+
+	if open == '[' {
+		closing = ']'
+	}
+
+	for i := s.pos + 1; i < len(s.src); i++ {
+		if s.src[i] != closing {
+			continue
+		}
+
+		if closing != ']' && i+1 < len(s.src) && s.src[i+1] == closing {
+			// escaped quote
+			i++
+			continue
+		}
+
+		s.pos = i + 1
+		return nil
+	}
+
+	s.pos = len(s.src)
+	return ErrUnterminatedStatement
+}
+
+// word reads a keyword or unquoted identifier at current position.
+func (s *scanner) word() string {
+	start := s.pos
+
+	for s.pos < len(s.src) && isWordChar(rune(s.src[s.pos])) {
+		s.pos++
+	}
+
+	return s.src[start:s.pos]
+}
+
+func isWordChar(r rune) bool {
+	return r == '_' || r == '$' || r >= 0x80 || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
@@ -0,0 +1,188 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the “License”);
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an “AS IS” BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSplitStatements(t *testing.T) {
+	cases := []struct {
+		query string
+		stmts []string
+	}{
+		{
+			"SELECT 1",
+			[]string{"SELECT 1"},
+		},
+		{
+			"INSERT INTO t VALUES (1); INSERT INTO t VALUES (2);;\n",
+			[]string{"INSERT INTO t VALUES (1)", "INSERT INTO t VALUES (2)"},
+		},
+		{
+			"INSERT INTO t VALUES ('a;b', 'it''s; fine'); SELECT \"c;d\", `e;f`, [g;h] FROM t",
+			[]string{
+				"INSERT INTO t VALUES ('a;b', 'it''s; fine')",
+				"SELECT \"c;d\", `e;f`, [g;h] FROM t",
+			},
+		},
+		{
+			"-- comment; here\nSELECT 1; /* block; comment */ SELECT 2; -- trailing;",
+			[]string{"-- comment; here\nSELECT 1", "/* block; comment */ SELECT 2"},
+		},
+		{
+			"CREATE TEMP TRIGGER tr AFTER INSERT ON t BEGIN " +
+				"UPDATE t SET v = CASE WHEN v > 0 THEN 1 ELSE 0 END; DELETE FROM t WHERE v < 0; END; SELECT 1",
+			[]string{
+				"CREATE TEMP TRIGGER tr AFTER INSERT ON t BEGIN " +
+					"UPDATE t SET v = CASE WHEN v > 0 THEN 1 ELSE 0 END; DELETE FROM t WHERE v < 0; END",
+				"SELECT 1",
+			},
+		},
+		{
+			"  ; -- nothing\n",
+			nil,
+		},
+	}
+
+	for _, c := range cases {
+		stmts, err := SplitStatements(c.query)
+
+		if err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+
+		if !reflect.DeepEqual(stmts, c.stmts) {
+			t.Fatalf("Unexpected result: %q, expected %q", stmts, c.stmts)
+		}
+	}
+
+	for _, q := range []string{"SELECT 'abc", "SELECT \"abc", "SELECT 1 /* abc", "SELECT [abc"} {
+		if _, err := SplitStatements(q); err != ErrUnterminatedStatement {
+			t.Fatalf("Unexpected result: %v, expected %v", err, ErrUnterminatedStatement)
+		}
+	}
+}
+
+func TestStatementPolicy(t *testing.T) {
+	p := &StatementPolicy{Deny: []string{"pragma", "ATTACH"}}
+
+	for _, stmt := range []string{"SELECT 1", "insert into t values (1)", "/* c */ DELETE FROM t"} {
+		if err := p.Check(stmt); err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+	}
+
+	for _, stmt := range []string{"PRAGMA journal_mode", "-- c\n attach 'x' AS y"} {
+		if err := p.Check(stmt); err != ErrStatementDenied {
+			t.Fatalf("Unexpected result: %v, expected %v", err, ErrStatementDenied)
+		}
+	}
+
+	p = &StatementPolicy{Allow: []string{"SELECT", "INSERT"}, Deny: []string{"INSERT"}}
+
+	if err := p.Check("SELECT 1"); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	for _, stmt := range []string{"INSERT INTO t VALUES (1)", "DROP TABLE t"} {
+		if err := p.Check(stmt); err != ErrStatementDenied {
+			t.Fatalf("Unexpected result: %v, expected %v", err, ErrStatementDenied)
+		}
+	}
+}
+
+func TestStorageMultiStatements(t *testing.T) {
+	fl, err := ioutil.TempFile("", "sqlite3-")
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	st, err := New(fmt.Sprintf("file:%s", fl.Name()))
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	st.SetStatementPolicy(&StatementPolicy{Deny: []string{"PRAGMA", "ATTACH", "DETACH"}})
+
+	el := &ExecLog{
+		ConnectionID: 1,
+		SeqNo:        1,
+		Timestamp:    uint64(time.Now().Unix()),
+		Queries: []string{
+			"CREATE TABLE `kv` (`key` TEXT PRIMARY KEY, `value` TEXT); " +
+				"INSERT INTO `kv` VALUES ('k1', 'v1;v1'); INSERT INTO `kv` VALUES ('k2', 'v2')",
+		},
+	}
+
+	if err = st.Prepare(context.Background(), el); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if err = st.Commit(context.Background(), el); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	var count int
+
+	if err = st.db.QueryRow("SELECT COUNT(*) FROM `kv` WHERE `value` IN ('v1;v1', 'v2')").
+		Scan(&count); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if count != 2 {
+		t.Fatalf("Unexpected result: %d rows, expected 2", count)
+	}
+
+	// the denied statement is rejected before the statements before it are executed
+	denied := &ExecLog{
+		ConnectionID: 1,
+		SeqNo:        2,
+		Timestamp:    uint64(time.Now().Unix()),
+		Queries: []string{
+			"INSERT INTO `kv` VALUES ('k3', 'v3')",
+			"DELETE FROM `kv`; ATTACH DATABASE ':memory:' AS `other`",
+		},
+	}
+
+	if err = st.Prepare(context.Background(), denied); err != ErrStatementDenied {
+		t.Fatalf("Unexpected result: %v, expected %v", err, ErrStatementDenied)
+	}
+
+	if err = st.Commit(context.Background(), denied); err == nil {
+		t.Fatal("Unexpected result: returned nil while expecting an error")
+	}
+
+	if err = st.ApplyReorg(nil, []*ExecLog{denied}); err != ErrStatementDenied {
+		t.Fatalf("Unexpected result: %v, expected %v", err, ErrStatementDenied)
+	}
+
+	if err = st.db.QueryRow("SELECT COUNT(*) FROM `kv`").Scan(&count); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if count != 2 {
+		t.Fatalf("Unexpected result: %d rows, expected 2", count)
+	}
+}
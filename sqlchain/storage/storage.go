@@ -17,19 +17,40 @@
 package storage
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
 	"errors"
 	"fmt"
+	"os"
 	"sync"
+	"time"
 
-	// Register go-sqlite3 engine.
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 
+	log "github.com/sirupsen/logrus"
 	"github.com/thunderdb/ThunderDB/twopc"
+	"github.com/ugorji/go/codec"
+)
+
+const (
+	// CommittedHistorySize is the max number of committed transaction IDs kept by Storage.
+	CommittedHistorySize = 1024
+
+	// stagedSavepoint is the savepoint before the staged queries executed by QueryInTx.
+	stagedSavepoint = "`staged`"
 )
 
 var (
+	// ErrReadOnlyTx indicates that an ExecLog with read-only TxOptions attempts to write.
+	ErrReadOnlyTx = errors.New("storage: write in read-only transaction")
+
+	// ErrUnsupportedIsolation indicates that the isolation level in TxOptions is not supported.
+	ErrUnsupportedIsolation = errors.New("storage: unsupported isolation level")
+
+	// ErrNotSelect indicates that the query of QueryInTx is not a single SELECT statement.
+	ErrNotSelect = errors.New("storage: query is not a single select statement")
+
 	index = struct {
 		sync.Mutex
 		db map[string]*sql.DB
@@ -39,11 +60,45 @@ var (
 )
 
 // ExecLog represents the execution log of sqlite.
+//
+// Undo is filled when the ExecLog is committed, or applied by ApplyReorg, so that the ExecLog can
+// be reverted during a chain reorganization. It's nil if the changes can not be undone, see
+// undoRecorder for the limitations.
 type ExecLog struct {
 	ConnectionID uint64
 	SeqNo        uint64
 	Timestamp    uint64
 	Queries      []string
+	Undo         *UndoLog
+
+	// TxOptions is the optional options of the transaction opened by Prepare, the default options
+	// are used if it's nil. SQLite transactions are always serializable, so isolation levels
+	// stronger than sql.LevelSerializable are rejected. Writes in a read-only transaction are
+	// rejected with ErrReadOnlyTx on commit.
+	TxOptions *sql.TxOptions
+}
+
+func init() {
+	twopc.RegisterWriteBatch("storage.ExecLog", &ExecLog{})
+}
+
+// execLog has no methods, so that the codec encodes ExecLog as a plain struct.
+type execLog ExecLog
+
+// MarshalBinary implements encoding.BinaryMarshaler, the ExecLog is encoded in msgpack.
+func (el *ExecLog) MarshalBinary() ([]byte, error) {
+	buffer := bytes.NewBuffer(nil)
+
+	if err := codec.NewEncoder(buffer, &codec.MsgpackHandle{}).Encode((*execLog)(el)); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (el *ExecLog) UnmarshalBinary(data []byte) error {
+	return codec.NewDecoderBytes(data, &codec.MsgpackHandle{}).Decode((*execLog)(el))
 }
 
 func openDB(dsn string) (db *sql.DB, err error) {
@@ -54,8 +109,19 @@ func openDB(dsn string) (db *sql.DB, err error) {
 		return nil, err
 	}
 
-	d.AddParam("_journal_mode", "WAL")
-	d.AddParam("_synchronous", "FULL")
+	if err = setupCrypto(d); err != nil {
+		return nil, err
+	}
+
+	// WAL and full synchronous mode by default
+	if _, ok := d.GetParam("_journal_mode"); !ok {
+		d.AddParam("_journal_mode", "WAL")
+	}
+
+	if _, ok := d.GetParam("_synchronous"); !ok {
+		d.AddParam("_synchronous", "FULL")
+	}
+
 	fdsn := d.Format()
 
 	fn := d.GetFileName()
@@ -64,7 +130,7 @@ func openDB(dsn string) (db *sql.DB, err error) {
 
 	if (fn == ":memory:" || mode == "memory") && cache != "shared" {
 		// Return a new DB instance if it's in memory and private.
-		db, err = sql.Open("sqlite3", fdsn)
+		db, err = sql.Open(driverName, fdsn)
 		return
 	}
 
@@ -73,7 +139,7 @@ func openDB(dsn string) (db *sql.DB, err error) {
 	index.Unlock()
 
 	if !ok {
-		db, err = sql.Open("sqlite3", fdsn)
+		db, err = sql.Open(driverName, fdsn)
 
 		if err != nil {
 			return nil, err
@@ -87,6 +153,16 @@ func openDB(dsn string) (db *sql.DB, err error) {
 	return
 }
 
+// StmtStat represents the execution statistics of a statement.
+type StmtStat struct {
+	Query    string
+	Duration time.Duration
+
+	// RowsAffected is reported by the sqlite driver, which is the count of the most recent INSERT,
+	// UPDATE or DELETE in the connection, so it's meaningless for the other statements.
+	RowsAffected int64
+}
+
 // TxID represents a transaction ID.
 type TxID struct {
 	ConnectionID uint64
@@ -101,11 +177,36 @@ func equalTxID(x, y *TxID) bool {
 // Storage represents a underlying storage implementation based on sqlite3.
 type Storage struct {
 	sync.Mutex
-	dsn     string
-	db      *sql.DB
-	tx      *sql.Tx // Current tx
-	id      TxID
-	queries []string
+	dsn      string
+	db       *sql.DB
+	tx       *sql.Tx // Current tx
+	id       TxID
+	queries  []string
+	readOnly bool // Current tx is read-only
+
+	// Result of the staged queries if they have been executed in current tx, see QueryInTx
+	applied      bool
+	appliedUndo  *UndoLog
+	appliedStats []StmtStat
+
+	// Optional statement policy checked on prepare, see SetStatementPolicy
+	policy *StatementPolicy
+
+	// Statement statistics of the last commit if enabled, see SetCollectStats
+	collectStats bool
+	lastStats    []StmtStat
+
+	// Ring buffer of the recently committed transaction IDs, see CommittedHistory
+	history      []TxID
+	historyStart int
+
+	// Optional append-only audit log of the committed transactions, see EnableAudit
+	audit *os.File
+
+	// WAL checkpoint policy and the commits since the last checkpoint, see SetCheckpointPolicy
+	checkpointEvery   int
+	checkpointOnClose bool
+	uncheckpointed    int
 }
 
 // New returns a new storage connected by dsn.
@@ -122,6 +223,63 @@ func New(dsn string) (st *Storage, err error) {
 	}, nil
 }
 
+// SetStatementPolicy sets the policy checked against each statement of the ExecLogs, the ExecLog
+// is rejected by Prepare or ApplyReorg if any of its statement is denied. A nil policy allows all
+// statements.
+func (s *Storage) SetStatementPolicy(p *StatementPolicy) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.policy = p
+}
+
+// SetCollectStats enables or disables collecting the statement statistics of Commit, see
+// LastCommitStats.
+func (s *Storage) SetCollectStats(enabled bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.collectStats = enabled
+
+	if !enabled {
+		s.lastStats = nil
+	}
+}
+
+// LastCommitStats returns the statistics of each statement executed by the last successful
+// Commit in order, or nil if statistics collection is disabled, see SetCollectStats.
+func (s *Storage) LastCommitStats() (stats []StmtStat) {
+	s.Lock()
+	defer s.Unlock()
+
+	return append(stats, s.lastStats...)
+}
+
+// splitQueries splits queries into single statements and checks them with the statement policy.
+func (s *Storage) splitQueries(queries []string) (stmts []string, err error) {
+	for _, q := range queries {
+		var qs []string
+
+		if qs, err = SplitStatements(q); err != nil {
+			return nil, err
+		}
+
+		stmts = append(stmts, qs...)
+	}
+
+	if s.policy == nil {
+		return
+	}
+
+	for _, stmt := range stmts {
+		if err = s.policy.Check(stmt); err != nil {
+			return nil, err
+		}
+	}
+
+	return
+}
+
 // Prepare implements prepare method of two-phase commit worker.
 func (s *Storage) Prepare(ctx context.Context, wb twopc.WriteBatch) (err error) {
 	el, ok := wb.(*ExecLog)
@@ -133,9 +291,47 @@ func (s *Storage) Prepare(ctx context.Context, wb twopc.WriteBatch) (err error)
 	s.Lock()
 	defer s.Unlock()
 
+	return s.prepare(ctx, el)
+}
+
+// TryPrepare is like Prepare, but returns false without error if the storage is already busy
+// with a different transaction, so that the caller can wait or route the transaction elsewhere
+// instead of treating it as a failure.
+func (s *Storage) TryPrepare(ctx context.Context, el *ExecLog) (ok bool, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.tx != nil && !equalTxID(&s.id, &TxID{el.ConnectionID, el.SeqNo, el.Timestamp}) {
+		return false, nil
+	}
+
+	if err = s.prepare(ctx, el); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// prepare opens the transaction of el, or replaces the queries if it's already opened, the lock
+// must be held by caller.
+func (s *Storage) prepare(ctx context.Context, el *ExecLog) (err error) {
+	if err = checkTxOptions(el.TxOptions); err != nil {
+		return
+	}
+
+	queries, err := s.splitQueries(el.Queries)
+
+	if err != nil {
+		return
+	}
+
 	if s.tx != nil {
 		if equalTxID(&s.id, &TxID{el.ConnectionID, el.SeqNo, el.Timestamp}) {
-			s.queries = el.Queries
+			if err = s.revertStaged(ctx); err != nil {
+				return
+			}
+
+			s.queries = queries
 			return nil
 		}
 
@@ -143,14 +339,15 @@ func (s *Storage) Prepare(ctx context.Context, wb twopc.WriteBatch) (err error)
 			"conn = %d, seq = %d, time = %d", s.id.ConnectionID, s.id.SeqNo, s.id.Timestamp)
 	}
 
-	s.tx, err = s.db.BeginTx(ctx, nil)
+	s.tx, err = s.db.BeginTx(ctx, el.TxOptions)
 
 	if err != nil {
 		return
 	}
 
 	s.id = TxID{el.ConnectionID, el.SeqNo, el.Timestamp}
-	s.queries = el.Queries
+	s.queries = queries
+	s.readOnly = el.TxOptions != nil && el.TxOptions.ReadOnly
 
 	return nil
 }
@@ -168,18 +365,46 @@ func (s *Storage) Commit(ctx context.Context, wb twopc.WriteBatch) (err error) {
 
 	if s.tx != nil {
 		if equalTxID(&s.id, &TxID{el.ConnectionID, el.SeqNo, el.Timestamp}) {
-			for _, q := range s.queries {
-				_, err = s.tx.ExecContext(ctx, q)
+			var stats *[]StmtStat
+
+			if s.collectStats {
+				stats = &[]StmtStat{}
+			}
+
+			defer func() {
+				if err == nil {
+					err = s.writeAudit()
+				}
 
 				if err != nil {
 					s.tx.Rollback()
-					s.tx = nil
-					s.queries = nil
-					return
+				} else if err = s.tx.Commit(); err == nil {
+					s.recordCommitted(s.id)
+
+					if stats != nil {
+						s.lastStats = *stats
+					}
+				}
+
+				s.resetTx()
+
+				if err == nil {
+					s.recordCheckpoint(ctx)
+				}
+			}()
+
+			if s.applied {
+				el.Undo = s.appliedUndo
+
+				if stats != nil {
+					*stats = s.appliedStats
 				}
+
+				return
 			}
 
-			return nil
+			el.Undo, err = execTx(ctx, s.tx, s.queries, s.readOnly, stats)
+			return
 		}
 
 		return fmt.Errorf("twopc: inconsistent state, currently in tx: "+
@@ -189,6 +414,54 @@ func (s *Storage) Commit(ctx context.Context, wb twopc.WriteBatch) (err error) {
 	return errors.New("twopc: tx not prepared")
 }
 
+// recordCommitted appends id to the committed history, the oldest one is dropped if the history
+// is full.
+func (s *Storage) recordCommitted(id TxID) {
+	if len(s.history) < CommittedHistorySize {
+		s.history = append(s.history, id)
+		return
+	}
+
+	s.history[s.historyStart] = id
+	s.historyStart = (s.historyStart + 1) % CommittedHistorySize
+}
+
+// LastCommittedTxID returns the ID of the last transaction committed by Commit, or a zero TxID
+// if none is committed since the storage is created.
+func (s *Storage) LastCommittedTxID() (id TxID) {
+	s.Lock()
+	defer s.Unlock()
+
+	if len(s.history) == 0 {
+		return
+	}
+
+	return s.history[(s.historyStart+len(s.history)-1)%len(s.history)]
+}
+
+// CommittedHistory returns the IDs of at most n recently committed transactions in commit order,
+// the last one is the most recent. Only the last CommittedHistorySize transactions committed
+// since the storage is created are kept.
+func (s *Storage) CommittedHistory(n int) (ids []TxID) {
+	s.Lock()
+	defer s.Unlock()
+
+	if n > len(s.history) {
+		n = len(s.history)
+	}
+
+	if n <= 0 {
+		return
+	}
+
+	ids = make([]TxID, n)
+	for i := range ids {
+		ids[i] = s.history[(s.historyStart+len(s.history)-n+i)%len(s.history)]
+	}
+
+	return
+}
+
 // Rollback implements rollback method of two-phase commit worker.
 func (s *Storage) Rollback(ctx context.Context, wb twopc.WriteBatch) (err error) {
 	el, ok := wb.(*ExecLog)
@@ -207,9 +480,286 @@ func (s *Storage) Rollback(ctx context.Context, wb twopc.WriteBatch) (err error)
 
 	if s.tx != nil {
 		s.tx.Rollback()
-		s.tx = nil
-		s.queries = nil
+		s.resetTx()
 	}
 
 	return nil
 }
+
+// resetTx clears the state of current tx after it's committed or rolled back.
+func (s *Storage) resetTx() {
+	s.tx = nil
+	s.queries = nil
+	s.readOnly = false
+	s.applied = false
+	s.appliedUndo = nil
+	s.appliedStats = nil
+}
+
+// QueryInTx executes a single SELECT statement in the prepared tx if there is one, so that it
+// observes the changes of the queries staged by Prepare, which are invisible to the other readers
+// until Commit. The query is executed on the database if no tx is prepared, e.g., the tx has been
+// committed or rolled back. The returned rows should be closed before the tx is committed or
+// rolled back, which waits for the rows to be closed.
+func (s *Storage) QueryInTx(ctx context.Context, query string, args ...interface{}) (
+	rows *sql.Rows, err error) {
+	stmts, err := SplitStatements(query)
+
+	if err != nil {
+		return
+	}
+
+	if len(stmts) != 1 || StatementType(stmts[0]) != "SELECT" {
+		return nil, ErrNotSelect
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.tx == nil {
+		return s.db.QueryContext(ctx, query, args...)
+	}
+
+	if err = s.applyStaged(ctx); err != nil {
+		return
+	}
+
+	return s.tx.QueryContext(ctx, query, args...)
+}
+
+// applyStaged executes the staged queries in current tx after a savepoint, so that the tx can
+// revert to the savepoint if it's prepared again with new queries. Commit reuses the result
+// instead of executing the queries again.
+func (s *Storage) applyStaged(ctx context.Context) (err error) {
+	if s.applied {
+		return
+	}
+
+	if _, err = s.tx.ExecContext(ctx, "SAVEPOINT "+stagedSavepoint); err != nil {
+		return
+	}
+
+	var stats *[]StmtStat
+
+	if s.collectStats {
+		stats = &[]StmtStat{}
+	}
+
+	undo, err := execTx(ctx, s.tx, s.queries, s.readOnly, stats)
+
+	if err != nil {
+		s.rollbackToStaged(ctx)
+		return
+	}
+
+	s.applied = true
+	s.appliedUndo = undo
+
+	if stats != nil {
+		s.appliedStats = *stats
+	}
+
+	return
+}
+
+// revertStaged reverts the staged queries executed by applyStaged.
+func (s *Storage) revertStaged(ctx context.Context) (err error) {
+	if !s.applied {
+		return
+	}
+
+	if err = s.rollbackToStaged(ctx); err != nil {
+		return
+	}
+
+	s.applied = false
+	s.appliedUndo = nil
+	s.appliedStats = nil
+	return
+}
+
+func (s *Storage) rollbackToStaged(ctx context.Context) (err error) {
+	if _, err = s.tx.ExecContext(ctx, "ROLLBACK TO "+stagedSavepoint); err != nil {
+		return
+	}
+
+	_, err = s.tx.ExecContext(ctx, "RELEASE "+stagedSavepoint)
+	return
+}
+
+// checkTxOptions checks if opts is supported by sqlite.
+func checkTxOptions(opts *sql.TxOptions) error {
+	if opts != nil && opts.Isolation > sql.LevelSerializable {
+		return ErrUnsupportedIsolation
+	}
+
+	return nil
+}
+
+// execTx executes queries in tx, the queries are executed in query-only mode if readOnly is set,
+// and the returned UndoLog is empty in this case. The statistics of the statements are appended
+// to stats if it's not nil.
+func execTx(ctx context.Context, tx *sql.Tx, queries []string, readOnly bool,
+	stats *[]StmtStat) (undo *UndoLog, err error) {
+	if !readOnly {
+		return execWithUndo(ctx, tx, queries, stats)
+	}
+
+	if _, err = tx.ExecContext(ctx, "PRAGMA query_only = 1"); err != nil {
+		return
+	}
+
+	// query_only is a connection flag, it should be reset before the connection is released
+	defer func() {
+		if _, rerr := tx.ExecContext(ctx, "PRAGMA query_only = 0"); rerr != nil && err == nil {
+			err = rerr
+		}
+	}()
+
+	for _, q := range queries {
+		if err = execStmt(ctx, tx, q, stats); err != nil {
+			if e, ok := err.(sqlite3.Error); ok && e.Code == sqlite3.ErrReadonly {
+				err = ErrReadOnlyTx
+			}
+
+			return nil, err
+		}
+	}
+
+	return &UndoLog{}, nil
+}
+
+// execWithUndo executes queries in tx and returns the UndoLog of them, the UndoLog is nil if the
+// changes can not be undone.
+func execWithUndo(ctx context.Context, tx *sql.Tx, queries []string, stats *[]StmtStat) (
+	undo *UndoLog, err error) {
+	r, err := newUndoRecorder(ctx, tx)
+
+	if err != nil {
+		log.Warningf("storage: failed to record undo log: %v", err)
+		r = nil
+	} else {
+		// recursive_triggers is a connection flag, it should be restored before the connection is
+		// released, whether the queries succeed or not
+		defer func() {
+			if rerr := r.restore(ctx); rerr != nil && err == nil {
+				err = rerr
+			}
+		}()
+	}
+
+	for _, q := range queries {
+		if err = execStmt(ctx, tx, q, stats); err != nil {
+			return nil, err
+		}
+	}
+
+	if r == nil {
+		return nil, nil
+	}
+
+	if undo, err = r.finish(ctx); err != nil {
+		log.Warningf("storage: failed to build undo log: %v", err)
+		return nil, nil
+	}
+
+	return undo, nil
+}
+
+// execStmt executes a single statement in tx, its statistics are appended to stats if it's not
+// nil.
+func execStmt(ctx context.Context, tx *sql.Tx, query string, stats *[]StmtStat) (err error) {
+	if stats == nil {
+		_, err = tx.ExecContext(ctx, query)
+		return
+	}
+
+	start := time.Now()
+	res, err := tx.ExecContext(ctx, query)
+
+	if err != nil {
+		return
+	}
+
+	stat := StmtStat{Query: query, Duration: time.Since(start)}
+
+	if stat.RowsAffected, err = res.RowsAffected(); err != nil {
+		return
+	}
+
+	*stats = append(*stats, stat)
+	return
+}
+
+// ApplyReorg switches the storage to a new branch during a chain reorganization: the ExecLogs in
+// revert, which are committed in order on the old branch, are undone in reverse order, then the
+// ExecLogs in apply are executed in order. All the changes are made in a single transaction, and
+// none of them are made if any step fails, e.g., an ExecLog in revert has no UndoLog. The Undo
+// fields of the ExecLogs in apply are filled on success.
+func (s *Storage) ApplyReorg(revert []*ExecLog, apply []*ExecLog) (err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.tx != nil {
+		return fmt.Errorf("storage: reorg during tx: conn = %d, seq = %d, time = %d",
+			s.id.ConnectionID, s.id.SeqNo, s.id.Timestamp)
+	}
+
+	for _, el := range revert {
+		if el.Undo == nil {
+			return ErrNoUndoLog
+		}
+	}
+
+	applyQueries := make([][]string, len(apply))
+
+	for index, el := range apply {
+		if err = checkTxOptions(el.TxOptions); err != nil {
+			return
+		}
+
+		if applyQueries[index], err = s.splitQueries(el.Queries); err != nil {
+			return
+		}
+	}
+
+	ctx := context.Background()
+	tx, err := s.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return
+	}
+
+	undos := make([]*UndoLog, len(apply))
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+
+		if err = tx.Commit(); err == nil {
+			for index, el := range apply {
+				el.Undo = undos[index]
+			}
+		}
+	}()
+
+	for i := len(revert) - 1; i >= 0; i-- {
+		for _, q := range revert[i].Undo.Queries {
+			if _, err = tx.ExecContext(ctx, q); err != nil {
+				return
+			}
+		}
+	}
+
+	for index, el := range apply {
+		readOnly := el.TxOptions != nil && el.TxOptions.ReadOnly
+
+		if undos[index], err = execTx(ctx, tx, applyQueries[index], readOnly, nil); err != nil {
+			return
+		}
+	}
+
+	return
+}
@@ -18,10 +18,14 @@ package storage
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 	"io/ioutil"
+	"reflect"
 	"testing"
 	"time"
+
+	"github.com/thunderdb/ThunderDB/twopc"
 )
 
 func TestBadType(t *testing.T) {
@@ -122,3 +126,861 @@ func TestStorage(t *testing.T) {
 		t.Fatalf("Error occurred: %v", err)
 	}
 }
+
+func TestTryPrepare(t *testing.T) {
+	fl, err := ioutil.TempFile("", "sqlite3-")
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	st, err := New(fmt.Sprintf("file:%s", fl.Name()))
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	el1 := &ExecLog{
+		ConnectionID: 1,
+		SeqNo:        1,
+		Timestamp:    uint64(time.Now().Unix()),
+		Queries: []string{
+			"CREATE TABLE IF NOT EXISTS `kv` (`key` TEXT PRIMARY KEY, `value` BLOB)",
+			"INSERT INTO `kv` VALUES ('k1', 'v1')",
+		},
+	}
+
+	el2 := &ExecLog{
+		ConnectionID: 2,
+		SeqNo:        1,
+		Timestamp:    uint64(time.Now().Unix()),
+		Queries: []string{
+			"INSERT INTO `kv` VALUES ('k2', 'v2')",
+		},
+	}
+
+	if ok, err := st.TryPrepare(context.Background(), el1); err != nil || !ok {
+		t.Fatalf("Unexpected result: ok = %v, err = %v", ok, err)
+	}
+
+	// Competing tx gets busy signal, and the current tx is not affected
+	if ok, err := st.TryPrepare(context.Background(), el2); err != nil || ok {
+		t.Fatalf("Unexpected result: ok = %v, err = %v", ok, err)
+	}
+
+	// Re-preparing the same tx is allowed
+	if ok, err := st.TryPrepare(context.Background(), el1); err != nil || !ok {
+		t.Fatalf("Unexpected result: ok = %v, err = %v", ok, err)
+	}
+
+	// Prepare still treats competing tx as failure
+	if err = st.Prepare(context.Background(), el2); err == nil {
+		t.Fatal("Unexpected result: returned nil while expecting an error")
+	}
+
+	if err = st.Commit(context.Background(), el1); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	// Storage is free after commit
+	if ok, err := st.TryPrepare(context.Background(), el2); err != nil || !ok {
+		t.Fatalf("Unexpected result: ok = %v, err = %v", ok, err)
+	}
+
+	if err = st.Commit(context.Background(), el2); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if kvs := dumpKV(t, st); !reflect.DeepEqual(kvs, map[string]string{
+		"k1": "v1",
+		"k2": "v2",
+	}) {
+		t.Fatalf("Unexpected result: %v", kvs)
+	}
+
+	// Invalid tx is still an error
+	if ok, err := st.TryPrepare(context.Background(), &ExecLog{
+		ConnectionID: 3,
+		Queries:      []string{"SELECT 1; SELECT 2"},
+		TxOptions:    &sql.TxOptions{Isolation: sql.LevelLinearizable},
+	}); err == nil || ok {
+		t.Fatalf("Unexpected result: ok = %v, err = %v", ok, err)
+	}
+}
+
+func dumpKV(t *testing.T, st *Storage) map[string]string {
+	rows, err := st.db.Query("SELECT `key`, `value` FROM `kv`")
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	defer rows.Close()
+	kvs := make(map[string]string)
+
+	for rows.Next() {
+		var k, v string
+
+		if err = rows.Scan(&k, &v); err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+
+		kvs[k] = v
+	}
+
+	return kvs
+}
+
+func hasTable(t *testing.T, st *Storage, table string) bool {
+	var count int
+
+	if err := st.db.QueryRow("SELECT COUNT(*) FROM `sqlite_master` WHERE `type` = 'table' "+
+		"AND `name` = ?", table).Scan(&count); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	return count > 0
+}
+
+func TestApplyReorg(t *testing.T) {
+	fl, err := ioutil.TempFile("", "sqlite3-")
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	st, err := New(fmt.Sprintf("file:%s", fl.Name()))
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	ctx := context.Background()
+	genesis := &ExecLog{
+		ConnectionID: 1,
+		SeqNo:        1,
+		Queries: []string{
+			"CREATE TABLE `kv` (`key` TEXT PRIMARY KEY, `value` BLOB)",
+			"INSERT INTO `kv` VALUES ('k1', 'v1')",
+			"INSERT INTO `kv` VALUES ('k2', 'v2')",
+		},
+	}
+	branchA := []*ExecLog{
+		{
+			ConnectionID: 1,
+			SeqNo:        2,
+			Queries: []string{
+				"UPDATE `kv` SET `value` = 'a' WHERE `key` = 'k1'",
+				"INSERT INTO `kv` VALUES ('k3', 'a')",
+				"DELETE FROM `kv` WHERE `key` = 'k2'",
+			},
+		},
+		{
+			ConnectionID: 1,
+			SeqNo:        3,
+			Queries: []string{
+				"INSERT OR REPLACE INTO `kv` VALUES ('k3', 'it''s a2')",
+				"CREATE TABLE `extra` (`id` INTEGER PRIMARY KEY)",
+				"INSERT INTO `extra` VALUES (1)",
+			},
+		},
+	}
+	branchB := []*ExecLog{
+		{
+			ConnectionID: 2,
+			SeqNo:        2,
+			Queries: []string{
+				"INSERT INTO `kv` VALUES ('k4', 'b')",
+				"UPDATE `kv` SET `value` = 'b' WHERE `key` = 'k2'",
+			},
+		},
+	}
+	stateA := map[string]string{"k1": "a", "k3": "it's a2"}
+	stateB := map[string]string{"k1": "v1", "k2": "b", "k4": "b"}
+
+	// Commit genesis and branch A
+	for _, el := range append([]*ExecLog{genesis}, branchA...) {
+		if err = st.Prepare(ctx, el); err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+
+		if err = st.Commit(ctx, el); err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+
+		if el.Undo == nil {
+			t.Fatal("Unexpected result: undo log is not recorded")
+		}
+	}
+
+	if kvs := dumpKV(t, st); !reflect.DeepEqual(kvs, stateA) {
+		t.Fatalf("Unexpected result: %v", kvs)
+	}
+
+	// Switch to branch B
+	if err = st.ApplyReorg(branchA, branchB); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if kvs := dumpKV(t, st); !reflect.DeepEqual(kvs, stateB) {
+		t.Fatalf("Unexpected result: %v", kvs)
+	}
+
+	if hasTable(t, st, "extra") {
+		t.Fatal("Unexpected result: table created by reverted exec log still exists")
+	}
+
+	// Failed reorg leaves storage untouched
+	bad := []*ExecLog{
+		{
+			ConnectionID: 3,
+			SeqNo:        2,
+			Queries: []string{
+				"INSERT INTO `kv` VALUES ('k5', 'c')",
+				"INSERT INTO `no_such_table` VALUES (1)",
+			},
+		},
+	}
+
+	if err = st.ApplyReorg(branchB, bad); err == nil {
+		t.Fatal("Unexpected result: returned nil while expecting an error")
+	} else {
+		t.Logf("Error occurred as expected: %v", err)
+	}
+
+	if bad[0].Undo != nil {
+		t.Fatal("Unexpected result: undo log is set by failed reorg")
+	}
+
+	if kvs := dumpKV(t, st); !reflect.DeepEqual(kvs, stateB) {
+		t.Fatalf("Unexpected result: %v", kvs)
+	}
+
+	if err = st.ApplyReorg([]*ExecLog{{}}, nil); err != ErrNoUndoLog {
+		t.Fatalf("Unexpected result: %v", err)
+	}
+
+	// Switch back to branch A
+	if err = st.ApplyReorg(branchB, branchA); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if kvs := dumpKV(t, st); !reflect.DeepEqual(kvs, stateA) {
+		t.Fatalf("Unexpected result: %v", kvs)
+	}
+
+	if !hasTable(t, st, "extra") {
+		t.Fatal("Unexpected result: table is not created")
+	}
+}
+
+func TestUndoRecursiveTriggers(t *testing.T) {
+	db, err := sql.Open(driverName, "file::memory:")
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	defer db.Close()
+
+	// the flag is checked on the same connection
+	db.SetMaxOpenConns(1)
+
+	if _, err = db.Exec("CREATE TABLE `kv` (`key` TEXT PRIMARY KEY, `value` TEXT)"); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	for _, c := range []struct {
+		flag    int
+		queries []string
+		fail    bool
+	}{
+		{0, []string{"INSERT INTO `kv` VALUES ('k1', 'v1')"}, false},
+		{0, []string{"INSERT INTO `kv` VALUES ('k1', 'v1')", "INSERT INTO `none` VALUES (1)"}, true},
+		{1, []string{"INSERT INTO `kv` VALUES ('k1', 'v1')", "INSERT INTO `none` VALUES (1)"}, true},
+	} {
+		if _, err = db.Exec(fmt.Sprintf("PRAGMA recursive_triggers = %d", c.flag)); err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+
+		tx, err := db.Begin()
+
+		if err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+
+		if _, err = execWithUndo(context.Background(), tx, c.queries, nil); (err != nil) != c.fail {
+			t.Fatalf("Unexpected result: %v", err)
+		}
+
+		if err = tx.Rollback(); err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+
+		var flag int
+
+		if err = db.QueryRow("PRAGMA recursive_triggers").Scan(&flag); err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+
+		if flag != c.flag {
+			t.Fatalf("Unexpected recursive_triggers: %d, expected %d", flag, c.flag)
+		}
+	}
+}
+
+func TestCommittedHistory(t *testing.T) {
+	fl, err := ioutil.TempFile("", "sqlite3-")
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	st, err := New(fmt.Sprintf("file:%s", fl.Name()))
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if id := st.LastCommittedTxID(); id != (TxID{}) {
+		t.Fatalf("Unexpected last committed tx: %v", id)
+	}
+
+	if ids := st.CommittedHistory(10); len(ids) != 0 {
+		t.Fatalf("Unexpected history: %v", ids)
+	}
+
+	var expected []TxID
+
+	for i := 0; i < 5; i++ {
+		el := &ExecLog{
+			ConnectionID: 1,
+			SeqNo:        uint64(i),
+			Timestamp:    uint64(time.Now().UnixNano()),
+			Queries:      []string{fmt.Sprintf("CREATE TABLE IF NOT EXISTS t%d (k TEXT)", i)},
+		}
+
+		if err = st.Prepare(context.Background(), el); err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+
+		if err = st.Commit(context.Background(), el); err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+
+		id := TxID{el.ConnectionID, el.SeqNo, el.Timestamp}
+		expected = append(expected, id)
+
+		if last := st.LastCommittedTxID(); last != id {
+			t.Fatalf("Unexpected last committed tx: %v, expected %v", last, id)
+		}
+	}
+
+	// rolled back transaction is not recorded
+	el := &ExecLog{ConnectionID: 2, SeqNo: 1, Timestamp: uint64(time.Now().UnixNano())}
+
+	if err = st.Prepare(context.Background(), el); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if err = st.Rollback(context.Background(), el); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if last := st.LastCommittedTxID(); last != expected[4] {
+		t.Fatalf("Unexpected last committed tx: %v", last)
+	}
+
+	if ids := st.CommittedHistory(3); !reflect.DeepEqual(ids, expected[2:]) {
+		t.Fatalf("Unexpected history: %v, expected %v", ids, expected[2:])
+	}
+
+	if ids := st.CommittedHistory(100); !reflect.DeepEqual(ids, expected) {
+		t.Fatalf("Unexpected history: %v, expected %v", ids, expected)
+	}
+
+	// history is bounded
+	for i := 0; i < CommittedHistorySize; i++ {
+		st.recordCommitted(TxID{ConnectionID: 3, SeqNo: uint64(i)})
+	}
+
+	ids := st.CommittedHistory(CommittedHistorySize + 1)
+
+	if len(ids) != CommittedHistorySize {
+		t.Fatalf("Unexpected history length: %d", len(ids))
+	}
+
+	for i, id := range ids {
+		if id != (TxID{ConnectionID: 3, SeqNo: uint64(i)}) {
+			t.Fatalf("Unexpected history entry %d: %v", i, id)
+		}
+	}
+
+	if last := st.LastCommittedTxID(); last != (TxID{ConnectionID: 3, SeqNo: CommittedHistorySize - 1}) {
+		t.Fatalf("Unexpected last committed tx: %v", last)
+	}
+}
+
+func TestCommitStats(t *testing.T) {
+	fl, err := ioutil.TempFile("", "sqlite3-")
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	st, err := New(fmt.Sprintf("file:%s", fl.Name()))
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	var queries []string
+	commit := func(seq uint64) {
+		queries = []string{
+			fmt.Sprintf("CREATE TABLE stats%d (k TEXT, v TEXT)", seq),
+			fmt.Sprintf("INSERT INTO stats%d VALUES ('k0', 'v0'), ('k1', 'v1'), ('k2', 'v2')", seq),
+			fmt.Sprintf("UPDATE stats%d SET v = 'v' WHERE k IN ('k0', 'k1')", seq),
+			fmt.Sprintf("DELETE FROM stats%d WHERE k = 'k2'", seq),
+		}
+		el := &ExecLog{
+			ConnectionID: 1,
+			SeqNo:        seq,
+			Timestamp:    uint64(time.Now().UnixNano()),
+			Queries:      queries,
+		}
+
+		if err = st.Prepare(context.Background(), el); err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+
+		if err = st.Commit(context.Background(), el); err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+	}
+
+	// disabled by default
+	commit(1)
+
+	if stats := st.LastCommitStats(); stats != nil {
+		t.Fatalf("Unexpected stats: %v", stats)
+	}
+
+	st.SetCollectStats(true)
+	commit(2)
+	stats := st.LastCommitStats()
+
+	if len(stats) != len(queries) {
+		t.Fatalf("Unexpected stats: %v", stats)
+	}
+
+	for i, stat := range stats {
+		if stat.Query != queries[i] || stat.Duration <= 0 {
+			t.Fatalf("Unexpected stat %d: %v", i, stat)
+		}
+	}
+
+	if stats[1].RowsAffected != 3 || stats[2].RowsAffected != 2 || stats[3].RowsAffected != 1 {
+		t.Fatalf("Unexpected rows affected: %v", stats)
+	}
+
+	// the stats are kept if commit fails
+	el := &ExecLog{
+		ConnectionID: 1,
+		SeqNo:        3,
+		Timestamp:    uint64(time.Now().UnixNano()),
+		Queries:      []string{"INSERT INTO stats2 VALUES ('k3', 'v3')", "INSERT INTO nonexist VALUES (1)"},
+	}
+
+	if err = st.Prepare(context.Background(), el); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if err = st.Commit(context.Background(), el); err == nil {
+		t.Fatal("Unexpected result: returned nil while expecting an error")
+	}
+
+	if s := st.LastCommitStats(); !reflect.DeepEqual(s, stats) {
+		t.Fatalf("Unexpected stats: %v", s)
+	}
+
+	st.SetCollectStats(false)
+
+	if stats = st.LastCommitStats(); stats != nil {
+		t.Fatalf("Unexpected stats: %v", stats)
+	}
+}
+
+func TestTxOptions(t *testing.T) {
+	fl, err := ioutil.TempFile("", "sqlite3-")
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	st, err := New(fmt.Sprintf("file:%s", fl.Name()))
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	ctx := context.Background()
+	ts := uint64(time.Now().Unix())
+	els := []*ExecLog{
+		{
+			ConnectionID: 1,
+			SeqNo:        1,
+			Timestamp:    ts,
+			Queries: []string{
+				"CREATE TABLE `kv` (`key` TEXT PRIMARY KEY, `value` TEXT)",
+				"INSERT INTO `kv` VALUES ('k1', 'v1')",
+			},
+			TxOptions: &sql.TxOptions{Isolation: sql.LevelSerializable},
+		},
+		{
+			ConnectionID: 1,
+			SeqNo:        2,
+			Timestamp:    ts,
+			Queries:      []string{"SELECT * FROM `kv`"},
+			TxOptions:    &sql.TxOptions{ReadOnly: true},
+		},
+	}
+
+	for _, el := range els {
+		if err = st.Prepare(ctx, el); err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+
+		if err = st.Commit(ctx, el); err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+	}
+
+	if !reflect.DeepEqual(els[1].Undo, &UndoLog{}) {
+		t.Fatalf("Unexpected result: %v, expected empty undo log", els[1].Undo)
+	}
+
+	// write in read-only tx is refused
+	ro := &ExecLog{
+		ConnectionID: 1,
+		SeqNo:        3,
+		Timestamp:    ts,
+		Queries:      []string{"INSERT INTO `kv` VALUES ('k2', 'v2')"},
+		TxOptions:    &sql.TxOptions{ReadOnly: true},
+	}
+
+	if err = st.Prepare(ctx, ro); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if err = st.Commit(ctx, ro); err != ErrReadOnlyTx {
+		t.Fatalf("Unexpected result: %v, expected %v", err, ErrReadOnlyTx)
+	}
+
+	if err = st.ApplyReorg(nil, []*ExecLog{ro}); err != ErrReadOnlyTx {
+		t.Fatalf("Unexpected result: %v, expected %v", err, ErrReadOnlyTx)
+	}
+
+	unsupported := &ExecLog{
+		ConnectionID: 1,
+		SeqNo:        4,
+		Timestamp:    ts,
+		Queries:      []string{"SELECT 1"},
+		TxOptions:    &sql.TxOptions{Isolation: sql.LevelLinearizable},
+	}
+
+	if err = st.Prepare(ctx, unsupported); err != ErrUnsupportedIsolation {
+		t.Fatalf("Unexpected result: %v, expected %v", err, ErrUnsupportedIsolation)
+	}
+
+	// the connection is writable again after the read-only tx
+	rw := &ExecLog{
+		ConnectionID: 1,
+		SeqNo:        5,
+		Timestamp:    ts,
+		Queries:      []string{"INSERT INTO `kv` VALUES ('k3', 'v3')"},
+	}
+
+	if err = st.Prepare(ctx, rw); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if err = st.Commit(ctx, rw); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	var keys []string
+	rows, err := st.db.Query("SELECT `key` FROM `kv` ORDER BY `key`")
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var k string
+
+		if err = rows.Scan(&k); err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+
+		keys = append(keys, k)
+	}
+
+	if !reflect.DeepEqual(keys, []string{"k1", "k3"}) {
+		t.Fatalf("Unexpected result: %v, expected [k1 k3]", keys)
+	}
+}
+
+func queryKeys(t *testing.T, st *Storage) (keys []string) {
+	rows, err := st.QueryInTx(context.Background(), "SELECT `key` FROM `kv` ORDER BY `key`")
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var k string
+
+		if err = rows.Scan(&k); err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+
+		keys = append(keys, k)
+	}
+
+	return
+}
+
+func TestQueryInTx(t *testing.T) {
+	fl, err := ioutil.TempFile("", "sqlite3-")
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	st, err := New(fmt.Sprintf("file:%s", fl.Name()))
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	newExecLog := func(seq uint64, queries ...string) *ExecLog {
+		return &ExecLog{
+			ConnectionID: 1,
+			SeqNo:        seq,
+			Timestamp:    uint64(time.Now().UnixNano()),
+			Queries:      queries,
+		}
+	}
+
+	el := newExecLog(1, "CREATE TABLE `kv` (`key` TEXT PRIMARY KEY, `value` TEXT)",
+		"INSERT INTO `kv` VALUES ('k0', 'v0')")
+
+	if err = st.Prepare(context.Background(), el); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if err = st.Commit(context.Background(), el); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	// no tx prepared
+	if keys := queryKeys(t, st); !reflect.DeepEqual(keys, []string{"k0"}) {
+		t.Fatalf("Unexpected keys: %v", keys)
+	}
+
+	// staged inserts are visible in tx only
+	el = newExecLog(2, "INSERT INTO `kv` VALUES ('k1', 'v1')", "DELETE FROM `kv` WHERE `key` = 'k0'")
+
+	if err = st.Prepare(context.Background(), el); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if keys := queryKeys(t, st); !reflect.DeepEqual(keys, []string{"k1"}) {
+			t.Fatalf("Unexpected keys: %v", keys)
+		}
+	}
+
+	if kvs := dumpKV(t, st); !reflect.DeepEqual(kvs, map[string]string{"k0": "v0"}) {
+		t.Fatalf("Unexpected kvs: %v", kvs)
+	}
+
+	if _, err = st.QueryInTx(context.Background(), "DELETE FROM `kv`"); err != ErrNotSelect {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if _, err = st.QueryInTx(context.Background(), "SELECT 1; SELECT 2"); err != ErrNotSelect {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// prepared again with new queries
+	el.Queries = []string{"INSERT INTO `kv` VALUES ('k2', 'v2')"}
+
+	if err = st.Prepare(context.Background(), el); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if keys := queryKeys(t, st); !reflect.DeepEqual(keys, []string{"k0", "k2"}) {
+		t.Fatalf("Unexpected keys: %v", keys)
+	}
+
+	if err = st.Commit(context.Background(), el); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if kvs := dumpKV(t, st); !reflect.DeepEqual(kvs, map[string]string{"k0": "v0", "k2": "v2"}) {
+		t.Fatalf("Unexpected kvs: %v", kvs)
+	}
+
+	if el.Undo == nil || !reflect.DeepEqual(st.LastCommittedTxID(), TxID{1, 2, el.Timestamp}) {
+		t.Fatalf("Unexpected commit result: undo = %v", el.Undo)
+	}
+
+	// rolled back
+	el = newExecLog(3, "INSERT INTO `kv` VALUES ('k3', 'v3')")
+
+	if err = st.Prepare(context.Background(), el); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if keys := queryKeys(t, st); !reflect.DeepEqual(keys, []string{"k0", "k2", "k3"}) {
+		t.Fatalf("Unexpected keys: %v", keys)
+	}
+
+	if err = st.Rollback(context.Background(), el); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if keys := queryKeys(t, st); !reflect.DeepEqual(keys, []string{"k0", "k2"}) {
+		t.Fatalf("Unexpected keys: %v", keys)
+	}
+
+	// staged queries failed
+	el = newExecLog(4, "INSERT INTO `kv` VALUES ('k0', 'v0')")
+
+	if err = st.Prepare(context.Background(), el); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if _, err = st.QueryInTx(context.Background(), "SELECT * FROM `kv`"); err == nil {
+		t.Fatal("Unexpected result: returned nil while expecting an error")
+	} else {
+		t.Logf("Error occurred as expected: %v", err)
+	}
+
+	if err = st.Commit(context.Background(), el); err == nil {
+		t.Fatal("Unexpected result: returned nil while expecting an error")
+	}
+
+	if keys := queryKeys(t, st); !reflect.DeepEqual(keys, []string{"k0", "k2"}) {
+		t.Fatalf("Unexpected keys: %v", keys)
+	}
+}
+
+// netStorage simulates a remote storage, the ExecLog is encoded before sending and decoded on
+// the remote side.
+type netStorage struct {
+	*Storage
+}
+
+func (s *netStorage) send(wb twopc.WriteBatch) (remote twopc.WriteBatch, err error) {
+	data, err := twopc.MarshalWriteBatch(wb)
+
+	if err != nil {
+		return
+	}
+
+	return twopc.UnmarshalWriteBatch(data)
+}
+
+func (s *netStorage) Prepare(ctx context.Context, wb twopc.WriteBatch) (err error) {
+	if wb, err = s.send(wb); err != nil {
+		return
+	}
+
+	return s.Storage.Prepare(ctx, wb)
+}
+
+func (s *netStorage) Commit(ctx context.Context, wb twopc.WriteBatch) (err error) {
+	if wb, err = s.send(wb); err != nil {
+		return
+	}
+
+	return s.Storage.Commit(ctx, wb)
+}
+
+func (s *netStorage) Rollback(ctx context.Context, wb twopc.WriteBatch) (err error) {
+	if wb, err = s.send(wb); err != nil {
+		return
+	}
+
+	return s.Storage.Rollback(ctx, wb)
+}
+
+func TestExecLogSerialization(t *testing.T) {
+	el := &ExecLog{
+		ConnectionID: 1,
+		SeqNo:        2,
+		Timestamp:    uint64(time.Now().UnixNano()),
+		Queries:      []string{"INSERT INTO `kv` VALUES ('k1', 'v1')"},
+		Undo:         &UndoLog{Queries: []string{"DELETE FROM `kv` WHERE `key` = 'k1'"}},
+		TxOptions:    &sql.TxOptions{Isolation: sql.LevelSerializable, ReadOnly: true},
+	}
+
+	data, err := twopc.MarshalWriteBatch(el)
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	wb, err := twopc.UnmarshalWriteBatch(data)
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if !reflect.DeepEqual(wb, el) {
+		t.Fatalf("Unexpected exec log: %v", wb)
+	}
+
+	if err = wb.UnmarshalBinary([]byte{0xc1}); err == nil {
+		t.Fatal("Unexpected result: returned nil while expecting an error")
+	}
+
+	// networked commit
+	fl, err := ioutil.TempFile("", "sqlite3-")
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	st, err := New(fmt.Sprintf("file:%s", fl.Name()))
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	el.Queries = []string{
+		"CREATE TABLE `kv` (`key` TEXT PRIMARY KEY, `value` TEXT)",
+		"INSERT INTO `kv` VALUES ('k1', 'v1')",
+	}
+	el.Undo = nil
+	el.TxOptions = nil
+	c := twopc.NewCoordinator(twopc.NewOptions(5 * time.Second))
+
+	if err = c.Put([]twopc.Worker{&netStorage{st}}, el); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if kvs := dumpKV(t, st); !reflect.DeepEqual(kvs, map[string]string{"k1": "v1"}) {
+		t.Fatalf("Unexpected kvs: %v", kvs)
+	}
+
+	if id := st.LastCommittedTxID(); !reflect.DeepEqual(id, TxID{1, 2, el.Timestamp}) {
+		t.Fatalf("Unexpected committed tx: %v", id)
+	}
+}
@@ -0,0 +1,285 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the “License”);
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an “AS IS” BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const undoLogTable = "__thunderdb_undo_log"
+
+var (
+	// ErrNoUndoLog indicates that an ExecLog to be reverted doesn't carry undo information.
+	ErrNoUndoLog = errors.New("storage: exec log has no undo log")
+
+	// ErrUndoUnsupported indicates that the changes made by an ExecLog can not be reverted, e.g.,
+	// a table existing before the ExecLog is dropped.
+	ErrUndoUnsupported = errors.New("storage: changes can not be undone")
+)
+
+// UndoLog represents the inverse queries of an ExecLog, which revert the database to the state
+// before the ExecLog was executed. Queries should be executed in order.
+type UndoLog struct {
+	Queries []string
+}
+
+// undoRecorder records the row changes within a sql.Tx and builds an UndoLog from them.
+//
+// Row changes of the tables existing when the recorder starts are captured by temporary
+// triggers, which write the inverse queries of the changes to a temporary table, and tables
+// created during recording are dropped by the UndoLog. Schema changes on existing tables and
+// WITHOUT ROWID tables are not supported.
+type undoRecorder struct {
+	tx                *sql.Tx
+	tables            []string
+	recursiveTriggers int
+}
+
+func quoteIdent(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+func quoteLiteral(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+func listTables(ctx context.Context, tx *sql.Tx) (tables []string, err error) {
+	rows, err := tx.QueryContext(ctx, "SELECT `name` FROM `main`.`sqlite_master` "+
+		"WHERE `type` = 'table' AND `name` NOT LIKE 'sqlite_%'")
+
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+
+		if err = rows.Scan(&name); err != nil {
+			return
+		}
+
+		tables = append(tables, name)
+	}
+
+	return tables, rows.Err()
+}
+
+func listColumns(ctx context.Context, tx *sql.Tx, table string) (columns []string, err error) {
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf("PRAGMA `main`.table_info(%s)",
+		quoteIdent(table)))
+
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid     int
+			name    string
+			ctype   string
+			notNull bool
+			dflt    interface{}
+			pk      int
+		)
+
+		if err = rows.Scan(&cid, &name, &ctype, &notNull, &dflt, &pk); err != nil {
+			return
+		}
+
+		columns = append(columns, name)
+	}
+
+	return columns, rows.Err()
+}
+
+func triggerName(op string, index int) string {
+	return quoteIdent(fmt.Sprintf("__thunderdb_undo_%s_%d", op, index))
+}
+
+// newUndoRecorder starts to record the row changes within tx.
+func newUndoRecorder(ctx context.Context, tx *sql.Tx) (r *undoRecorder, err error) {
+	r = &undoRecorder{tx: tx}
+
+	// REPLACE conflict resolution only fires delete triggers with recursive triggers enabled
+	if err = tx.QueryRowContext(ctx, "PRAGMA recursive_triggers").Scan(
+		&r.recursiveTriggers); err != nil {
+		return nil, err
+	}
+
+	defer func(r *undoRecorder) {
+		if err != nil {
+			r.restore(ctx)
+		}
+	}(r)
+
+	if r.tables, err = listTables(ctx, tx); err != nil {
+		return nil, err
+	}
+
+	stmts := []string{
+		"PRAGMA recursive_triggers = ON",
+		fmt.Sprintf("CREATE TEMP TABLE IF NOT EXISTS %s "+
+			"(`seq` INTEGER PRIMARY KEY AUTOINCREMENT, `query` TEXT)", quoteIdent(undoLogTable)),
+		fmt.Sprintf("DELETE FROM `temp`.%s", quoteIdent(undoLogTable)),
+	}
+
+	for index, table := range r.tables {
+		var columns []string
+
+		if columns, err = listColumns(ctx, tx, table); err != nil {
+			return nil, err
+		}
+
+		stmts = append(stmts, r.triggers(index, table, columns)...)
+	}
+
+	for _, stmt := range stmts {
+		if _, err = tx.ExecContext(ctx, stmt); err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+// triggers returns the statements creating the triggers on table, which write the inverse
+// query of a row change to the undo log table.
+func (r *undoRecorder) triggers(index int, table string, columns []string) []string {
+	var (
+		qt     = quoteIdent(table)
+		names  = make([]string, len(columns))
+		values = make([]string, len(columns))
+		sets   = make([]string, len(columns))
+	)
+
+	for i, column := range columns {
+		qc := quoteIdent(column)
+		names[i] = quoteLiteral(", " + qc)
+		values[i] = fmt.Sprintf("', ' || quote(OLD.%s)", qc)
+		sets[i] = fmt.Sprintf("%s || ' = ' || quote(OLD.%s)", quoteLiteral(", "+qc), qc)
+	}
+
+	insertLog := func(query string) string {
+		return fmt.Sprintf("INSERT INTO %s (`query`) VALUES (%s);",
+			quoteIdent(undoLogTable), query)
+	}
+
+	return []string{
+		fmt.Sprintf("CREATE TEMP TRIGGER %s AFTER INSERT ON `main`.%s BEGIN %s END",
+			triggerName("insert", index), qt, insertLog(fmt.Sprintf(
+				"%s || NEW.rowid", quoteLiteral("DELETE FROM "+qt+" WHERE rowid = ")))),
+		fmt.Sprintf("CREATE TEMP TRIGGER %s AFTER DELETE ON `main`.%s BEGIN %s END",
+			triggerName("delete", index), qt, insertLog(fmt.Sprintf(
+				"%s || %s || ') VALUES (' || OLD.rowid || %s || ')'",
+				quoteLiteral("INSERT INTO "+qt+" (rowid"), strings.Join(append(names, "''"), " || "),
+				strings.Join(append(values, "''"), " || ")))),
+		fmt.Sprintf("CREATE TEMP TRIGGER %s AFTER UPDATE ON `main`.%s BEGIN %s END",
+			triggerName("update", index), qt, insertLog(fmt.Sprintf(
+				"%s || OLD.rowid || %s || ' WHERE rowid = ' || NEW.rowid",
+				quoteLiteral("UPDATE "+qt+" SET rowid = "), strings.Join(append(sets, "''"), " || ")))),
+	}
+}
+
+// restore restores the recursive_triggers flag of the connection changed by the recorder.
+func (r *undoRecorder) restore(ctx context.Context) (err error) {
+	_, err = r.tx.ExecContext(ctx, fmt.Sprintf("PRAGMA recursive_triggers = %d",
+		r.recursiveTriggers))
+	return
+}
+
+// finish stops recording and returns the UndoLog of the recorded changes.
+func (r *undoRecorder) finish(ctx context.Context) (undo *UndoLog, err error) {
+	var (
+		tx     = r.tx
+		tables []string
+	)
+
+	for index := range r.tables {
+		for _, op := range []string{"insert", "delete", "update"} {
+			if _, err = tx.ExecContext(ctx, fmt.Sprintf("DROP TRIGGER IF EXISTS `temp`.%s",
+				triggerName(op, index))); err != nil {
+				return
+			}
+		}
+	}
+
+	if tables, err = listTables(ctx, tx); err != nil {
+		return
+	}
+
+	existing := make(map[string]bool, len(r.tables))
+
+	for _, table := range r.tables {
+		existing[table] = true
+	}
+
+	created := make([]string, 0)
+
+	for _, table := range tables {
+		if existing[table] {
+			delete(existing, table)
+		} else {
+			created = append(created, table)
+		}
+	}
+
+	if len(existing) > 0 {
+		return nil, ErrUndoUnsupported
+	}
+
+	// Revert row changes in reverse order
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf(
+		"SELECT `query` FROM `temp`.%s ORDER BY `seq` DESC", quoteIdent(undoLogTable)))
+
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	undo = &UndoLog{}
+
+	for rows.Next() {
+		var q string
+
+		if err = rows.Scan(&q); err != nil {
+			return nil, err
+		}
+
+		undo.Queries = append(undo.Queries, q)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, table := range created {
+		undo.Queries = append(undo.Queries, "DROP TABLE "+quoteIdent(table))
+	}
+
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM `temp`.%s", quoteIdent(undoLogTable)))
+
+	return
+}
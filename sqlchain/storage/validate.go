@@ -0,0 +1,98 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"context"
+	"fmt"
+)
+
+// InvalidStatementError indicates a statement of an ExecLog is rejected by Validate. Index is the
+// index of the statement after the queries are split into single statements, and Err is the
+// error reported by sqlite.
+type InvalidStatementError struct {
+	Index     int
+	Statement string
+	Err       error
+}
+
+func (e *InvalidStatementError) Error() string {
+	return fmt.Sprintf("storage: invalid statement %d (%s): %v", e.Index, e.Statement, e.Err)
+}
+
+// Unwrap returns the error reported by sqlite.
+func (e *InvalidStatementError) Unwrap() error {
+	return e.Err
+}
+
+// isSchemaStatement reports whether stmt changes the schema, so that it must be executed for the
+// following statements to be compiled.
+func isSchemaStatement(stmt string) bool {
+	switch StatementType(stmt) {
+	case "CREATE", "DROP", "ALTER":
+		return true
+	default:
+		return false
+	}
+}
+
+// Validate checks the statements of el without changing anything, the first invalid statement is
+// returned as an InvalidStatementError, e.g., a syntax error or a reference to a missing table.
+// The TxOptions and the statement policy are checked like Prepare.
+//
+// The statements are compiled by sqlite in a transaction which is always rolled back, without
+// touching the transaction opened by Prepare. Schema statements are executed in the transaction,
+// so that the following statements can refer to the tables they create, other statements are
+// only compiled, so the errors raised on execution, e.g., constraint violations, are not
+// detected.
+func (s *Storage) Validate(ctx context.Context, el *ExecLog) (err error) {
+	if err = checkTxOptions(el.TxOptions); err != nil {
+		return
+	}
+
+	s.Lock()
+	queries, err := s.splitQueries(el.Queries)
+	s.Unlock()
+
+	if err != nil {
+		return
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return
+	}
+
+	defer tx.Rollback()
+
+	for i, q := range queries {
+		if isSchemaStatement(q) {
+			_, err = tx.ExecContext(ctx, q)
+		} else if stmt, perr := tx.PrepareContext(ctx, q); perr != nil {
+			err = perr
+		} else {
+			err = stmt.Close()
+		}
+
+		if err != nil {
+			return &InvalidStatementError{Index: i, Statement: q, Err: err}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	fl, err := ioutil.TempFile("", "sqlite3-")
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	st, err := New(fmt.Sprintf("file:%s", fl.Name()))
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	el := &ExecLog{
+		ConnectionID: 1,
+		SeqNo:        1,
+		Timestamp:    uint64(time.Now().Unix()),
+		Queries: []string{
+			"CREATE TABLE IF NOT EXISTS `kv` (`key` TEXT PRIMARY KEY, `value` BLOB)",
+			"INSERT INTO `kv` VALUES ('k1', 'v1'); UPDATE `kv` SET `value` = 'v2' WHERE `key` = 'k1'",
+		},
+	}
+
+	// Valid batch passes, and the table created by it is not kept
+	if err = st.Validate(context.Background(), el); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if hasTable(t, st, "kv") {
+		t.Fatal("Unexpected result: table created by validation")
+	}
+
+	// Invalid statements are pinpointed
+	for index, invalid := range []string{
+		"INSERT INTO `nonexistent` VALUES ('k2', 'v2')",
+		"INSERT INTO `kv` VALUES ('k2', 'v2', 'extra')",
+		"INSERTT INTO `kv` VALUES ('k2', 'v2')",
+	} {
+		bad := &ExecLog{
+			ConnectionID: 2,
+			SeqNo:        uint64(index),
+			Queries:      append(append([]string{}, el.Queries...), invalid, "DELETE FROM `kv`"),
+		}
+		err = st.Validate(context.Background(), bad)
+		ise := (*InvalidStatementError)(nil)
+
+		if !errors.As(err, &ise) || ise.Index != 3 || ise.Statement != invalid {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		t.Logf("Error occurred as expected: %v", err)
+	}
+
+	// Validation does not interfere with the prepared tx
+	if err = st.Prepare(context.Background(), el); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if err = st.Validate(context.Background(), el); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if err = st.Commit(context.Background(), el); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if kvs := dumpKV(t, st); !reflect.DeepEqual(kvs, map[string]string{"k1": "v2"}) {
+		t.Fatalf("Unexpected result: %v", kvs)
+	}
+
+	// Statement policy is checked
+	st.SetStatementPolicy(&StatementPolicy{Deny: []string{"DELETE"}})
+
+	if err = st.Validate(context.Background(), &ExecLog{
+		Queries: []string{"DELETE FROM `kv`"},
+	}); err != ErrStatementDenied {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
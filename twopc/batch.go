@@ -0,0 +1,138 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package twopc
+
+import (
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+var (
+	// ErrNotSerializable indicates the WriteBatch does not implement SerializableWriteBatch.
+	ErrNotSerializable = errors.New("twopc: write batch is not serializable")
+
+	// ErrUnregisteredWriteBatch indicates the type of WriteBatch is not registered by
+	// RegisterWriteBatch.
+	ErrUnregisteredWriteBatch = errors.New("twopc: write batch type is not registered")
+
+	// ErrInvalidWriteBatch indicates a corrupted encoded WriteBatch.
+	ErrInvalidWriteBatch = errors.New("twopc: invalid write batch")
+
+	batchTypes = struct {
+		sync.RWMutex
+		byName map[string]reflect.Type
+		byType map[reflect.Type]string
+	}{
+		byName: make(map[string]reflect.Type),
+		byType: make(map[reflect.Type]string),
+	}
+)
+
+// SerializableWriteBatch is a WriteBatch which can be encoded to cross the network, its type
+// should be registered by RegisterWriteBatch, see MarshalWriteBatch and UnmarshalWriteBatch.
+type SerializableWriteBatch interface {
+	WriteBatch
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+}
+
+// RegisterWriteBatch registers the type of wb, which must be a pointer, under name, so that the
+// batches of this type can be decoded by UnmarshalWriteBatch. It panics if the name or the type
+// is already registered, like gob.RegisterName.
+func RegisterWriteBatch(name string, wb SerializableWriteBatch) {
+	t := reflect.TypeOf(wb)
+
+	if t.Kind() != reflect.Ptr {
+		panic(fmt.Sprintf("twopc: write batch type %v is not a pointer", t))
+	}
+
+	batchTypes.Lock()
+	defer batchTypes.Unlock()
+
+	if _, ok := batchTypes.byName[name]; ok {
+		panic(fmt.Sprintf("twopc: write batch name %s registered twice", name))
+	}
+
+	if _, ok := batchTypes.byType[t]; ok {
+		panic(fmt.Sprintf("twopc: write batch type %v registered twice", t))
+	}
+
+	batchTypes.byName[name] = t.Elem()
+	batchTypes.byType[t] = name
+}
+
+// MarshalWriteBatch encodes wb along with its registered type name.
+//
+// Layout: name length (uvarint) | name | wb.MarshalBinary().
+func MarshalWriteBatch(wb WriteBatch) (data []byte, err error) {
+	swb, ok := wb.(SerializableWriteBatch)
+
+	if !ok {
+		return nil, ErrNotSerializable
+	}
+
+	batchTypes.RLock()
+	name, ok := batchTypes.byType[reflect.TypeOf(swb)]
+	batchTypes.RUnlock()
+
+	if !ok {
+		return nil, ErrUnregisteredWriteBatch
+	}
+
+	payload, err := swb.MarshalBinary()
+
+	if err != nil {
+		return
+	}
+
+	data = make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(name)+len(payload))
+	data = data[:binary.PutUvarint(data, uint64(len(name)))]
+	data = append(data, name...)
+	return append(data, payload...), nil
+}
+
+// UnmarshalWriteBatch decodes the WriteBatch encoded by MarshalWriteBatch to a new instance of
+// the registered type.
+func UnmarshalWriteBatch(data []byte) (wb SerializableWriteBatch, err error) {
+	length, n := binary.Uvarint(data)
+
+	if n <= 0 || length > uint64(len(data)-n) {
+		return nil, ErrInvalidWriteBatch
+	}
+
+	name := string(data[n : n+int(length)])
+
+	batchTypes.RLock()
+	t, ok := batchTypes.byName[name]
+	batchTypes.RUnlock()
+
+	if !ok {
+		return nil, ErrUnregisteredWriteBatch
+	}
+
+	wb = reflect.New(t).Interface().(SerializableWriteBatch)
+
+	if err = wb.UnmarshalBinary(data[n+int(length):]); err != nil {
+		return nil, err
+	}
+
+	return
+}
@@ -0,0 +1,204 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package twopc
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testBatch struct {
+	TxID uint64
+	Cmds []string
+}
+
+func (b *testBatch) MarshalBinary() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{"TxID": b.TxID, "Cmds": b.Cmds})
+}
+
+func (b *testBatch) UnmarshalBinary(data []byte) error {
+	v := struct {
+		TxID uint64
+		Cmds []string
+	}{}
+
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	b.TxID, b.Cmds = v.TxID, v.Cmds
+	return nil
+}
+
+// unregisteredBatch is serializable but not registered.
+type unregisteredBatch struct {
+	testBatch
+}
+
+func init() {
+	RegisterWriteBatch("twopc.testBatch", &testBatch{})
+}
+
+// netWorker simulates a remote worker, the WriteBatch is encoded before sending and decoded on
+// the remote side.
+type netWorker struct {
+	*localWorker
+
+	mu       sync.Mutex
+	received []WriteBatch
+}
+
+func (w *netWorker) send(wb WriteBatch) (remote WriteBatch, err error) {
+	data, err := MarshalWriteBatch(wb)
+
+	if err != nil {
+		return
+	}
+
+	if remote, err = UnmarshalWriteBatch(data); err != nil {
+		return
+	}
+
+	w.mu.Lock()
+	w.received = append(w.received, remote)
+	w.mu.Unlock()
+
+	return
+}
+
+func (w *netWorker) Prepare(ctx context.Context, wb WriteBatch) (err error) {
+	if wb, err = w.send(wb); err != nil {
+		return
+	}
+
+	return w.localWorker.Prepare(ctx, wb)
+}
+
+func (w *netWorker) Commit(ctx context.Context, wb WriteBatch) (err error) {
+	if wb, err = w.send(wb); err != nil {
+		return
+	}
+
+	return w.localWorker.Commit(ctx, wb)
+}
+
+func (w *netWorker) Rollback(ctx context.Context, wb WriteBatch) (err error) {
+	if wb, err = w.send(wb); err != nil {
+		return
+	}
+
+	return w.localWorker.Rollback(ctx, wb)
+}
+
+func TestWriteBatchSerialization(t *testing.T) {
+	wb := &testBatch{TxID: 1, Cmds: []string{"+1", "-3", "+10"}}
+	data, err := MarshalWriteBatch(wb)
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	decoded, err := UnmarshalWriteBatch(data)
+
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if !reflect.DeepEqual(decoded, wb) {
+		t.Fatalf("Unexpected write batch: %v", decoded)
+	}
+
+	if _, err = MarshalWriteBatch(&RaftWriteBatchReq{}); err != ErrNotSerializable {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if _, err = MarshalWriteBatch(&unregisteredBatch{}); err != ErrUnregisteredWriteBatch {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// corrupted data
+	for _, d := range [][]byte{nil, {0xff}, data[:5]} {
+		if _, err = UnmarshalWriteBatch(d); err != ErrInvalidWriteBatch {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	if _, err = UnmarshalWriteBatch(append([]byte{3}, "foo"...)); err != ErrUnregisteredWriteBatch {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if _, err = UnmarshalWriteBatch(data[:len(data)-1]); err == nil {
+		t.Fatal("Unexpected result: returned nil while expecting an error")
+	}
+
+	// duplicate registration
+	for _, f := range []func(){
+		func() { RegisterWriteBatch("twopc.testBatch", &unregisteredBatch{}) },
+		func() { RegisterWriteBatch("twopc.testBatch2", &testBatch{}) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatal("Duplicate registration should panic")
+				}
+			}()
+
+			f()
+		}()
+	}
+}
+
+func TestCoordinator_SerializedWriteBatch(t *testing.T) {
+	c := NewCoordinator(NewOptions(5 * time.Second))
+	workers := []*netWorker{
+		{localWorker: newLocalWorker(time.Second)},
+		{localWorker: newLocalWorker(time.Second)},
+	}
+	wb := &testBatch{TxID: 1, Cmds: []string{"+1", "-3", "+10"}}
+
+	if err := c.Put([]Worker{workers[0], workers[1]}, wb); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	for _, w := range workers {
+		if state := w.getState(); state != Committed {
+			t.Fatalf("Unexpected worker state: %v", state)
+		}
+
+		// prepare and commit
+		if len(w.received) != 2 {
+			t.Fatalf("Unexpected received batches: %v", w.received)
+		}
+
+		for _, received := range w.received {
+			if received == WriteBatch(wb) || !reflect.DeepEqual(received, wb) {
+				t.Fatalf("Unexpected received batch: %v", received)
+			}
+		}
+	}
+
+	// not serializable batch fails on prepare
+	if err := c.Put([]Worker{workers[0]}, &RaftWriteBatchReq{}); err == nil {
+		t.Fatal("Unexpected result: returned nil while expecting an error")
+	} else {
+		t.Logf("Error occurred as expected: %v", err)
+	}
+}
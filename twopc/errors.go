@@ -0,0 +1,190 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package twopc
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// PrepareError indicates a worker failed to prepare the transaction. Index is the index of the
+// worker in the workers passed to Coordinator.Put, ID is its stable identifier, see
+// IdentifiedWorker, and Err is the error returned by the worker, which can be matched by
+// errors.Is and errors.As.
+type PrepareError struct {
+	Index  int
+	ID     string
+	Worker Worker
+	Err    error
+}
+
+func (e *PrepareError) Error() string {
+	return fmt.Sprintf("twopc: prepare failed on worker %d (%s): %v", e.Index, e.ID, e.Err)
+}
+
+// Unwrap returns the error returned by the worker.
+func (e *PrepareError) Unwrap() error {
+	return e.Err
+}
+
+// PreCommitError indicates a worker failed to pre-commit the transaction in ThreePhaseCommit.
+type PreCommitError struct {
+	Index  int
+	ID     string
+	Worker Worker
+	Err    error
+}
+
+func (e *PreCommitError) Error() string {
+	return fmt.Sprintf("twopc: pre-commit failed on worker %d (%s): %v", e.Index, e.ID, e.Err)
+}
+
+// Unwrap returns the error returned by the worker.
+func (e *PreCommitError) Unwrap() error {
+	return e.Err
+}
+
+// CommitError indicates a worker failed to commit the transaction after the commit decision is
+// made, the other workers are committed anyway.
+type CommitError struct {
+	Index  int
+	ID     string
+	Worker Worker
+	Err    error
+}
+
+func (e *CommitError) Error() string {
+	return fmt.Sprintf("twopc: commit failed on worker %d (%s): %v", e.Index, e.ID, e.Err)
+}
+
+// Unwrap returns the error returned by the worker.
+func (e *CommitError) Unwrap() error {
+	return e.Err
+}
+
+// RollbackError indicates a worker failed to roll back the transaction.
+type RollbackError struct {
+	Index  int
+	ID     string
+	Worker Worker
+	Err    error
+}
+
+func (e *RollbackError) Error() string {
+	return fmt.Sprintf("twopc: rollback failed on worker %d (%s): %v", e.Index, e.ID, e.Err)
+}
+
+// Unwrap returns the error returned by the worker.
+func (e *RollbackError) Unwrap() error {
+	return e.Err
+}
+
+// HookError indicates a hook failed, Phase is the phase which the hook is called before.
+type HookError struct {
+	Phase string
+	Err   error
+}
+
+func (e *HookError) Error() string {
+	return fmt.Sprintf("twopc: before %s hook failed: %v", e.Phase, e.Err)
+}
+
+// Unwrap returns the error returned by the hook.
+func (e *HookError) Unwrap() error {
+	return e.Err
+}
+
+// MultiError aggregates the errors of the workers failed in the same phase, each of them is
+// matched by errors.Is and errors.As.
+type MultiError []error
+
+func (e MultiError) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+
+	return fmt.Sprintf("twopc: %d workers failed: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// Unwrap returns the aggregated errors.
+func (e MultiError) Unwrap() []error {
+	return []error(e)
+}
+
+// Is reports whether any of the aggregated errors matches target, errors.Is only unwraps a slice
+// of errors since Go 1.20.
+func (e MultiError) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// As finds the first of the aggregated errors that matches target, errors.As only unwraps a slice
+// of errors since Go 1.20.
+func (e MultiError) As(target interface{}) bool {
+	for _, err := range e {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// workerError returns the typed errors of the failed workers in phase, a MultiError is returned
+// if more than one worker fails, or nil if all the workers succeed. The errors are ordered by the
+// stable worker order, regardless of the order in which the workers returned.
+func workerError(phase string, workers []Worker, errs []error) error {
+	var failed MultiError
+
+	for _, index := range stableOrder(workers) {
+		err := errs[index]
+		if err == nil {
+			continue
+		}
+
+		id := workerID(index, workers[index])
+
+		switch phase {
+		case PhasePrepare:
+			err = &PrepareError{Index: index, ID: id, Worker: workers[index], Err: err}
+		case PhasePreCommit:
+			err = &PreCommitError{Index: index, ID: id, Worker: workers[index], Err: err}
+		case PhaseCommit:
+			err = &CommitError{Index: index, ID: id, Worker: workers[index], Err: err}
+		default:
+			err = &RollbackError{Index: index, ID: id, Worker: workers[index], Err: err}
+		}
+
+		failed = append(failed, err)
+	}
+
+	switch len(failed) {
+	case 0:
+		return nil
+	case 1:
+		return failed[0]
+	default:
+		return failed
+	}
+}
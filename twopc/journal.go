@@ -0,0 +1,271 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package twopc
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/thunderdb/ThunderDB/utils"
+)
+
+// PhaseDone is recorded in Journal after a transaction is settled on all workers.
+const PhaseDone = "done"
+
+var (
+	// ErrNoTxCodec indicates Options.Journal is set without Options.Codec.
+	ErrNoTxCodec = errors.New("twopc: journal requires tx codec")
+
+	// ErrInvalidJournal indicates a corrupted journal record.
+	ErrInvalidJournal = errors.New("twopc: invalid journal record")
+)
+
+// PendingTx is a transaction recorded in Journal but not settled.
+type PendingTx struct {
+	TxID TxID
+	// Phase is the last recorded phase.
+	Phase string
+	// Payload is the payload recorded with PhasePrepare.
+	Payload []byte
+}
+
+// Journal is the coordinator-side write-ahead log, the coordinator records each phase transition
+// of a transaction before issuing it to workers, so that transactions interrupted by a crash can
+// be resolved by Coordinator.Recover. Record must be durable when it returns.
+//
+// A transaction starts with a PhasePrepare record carrying the encoded payload and ends with a
+// PhaseDone record. A transaction id may be reused after it's done, a new PhasePrepare record
+// starts a new transaction.
+type Journal interface {
+	Record(txID TxID, phase string, payload []byte) error
+	Replay() ([]PendingTx, error)
+}
+
+// TxCodec encodes the workers and the WriteBatch of a transaction to the journal payload, and
+// decodes them on recovery.
+type TxCodec interface {
+	Encode(workers []Worker, wb WriteBatch) ([]byte, error)
+	Decode(payload []byte) ([]Worker, WriteBatch, error)
+}
+
+// FileJournal is a Journal appending records to a file, each record is synced to disk.
+//
+// Record format:
+//
+// 0      8       9               9+plen  13+plen        13+plen+len
+// +------+-------+---------------+-------+--------------+
+// | txID | plen  |     phase     |  len  |   payload    |
+// +------+-------+---------------+-------+--------------+
+//
+// A truncated record at the end of file is ignored on replay, since it is never acknowledged.
+type FileJournal struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewFileJournal opens or creates a file journal at path.
+func NewFileJournal(path string) (j *FileJournal, err error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return
+	}
+
+	return &FileJournal{file: f}, nil
+}
+
+// Record implements Journal.Record.
+func (j *FileJournal) Record(txID TxID, phase string, payload []byte) (err error) {
+	if len(phase) > 0xff {
+		return ErrInvalidJournal
+	}
+
+	buf := make([]byte, 8+1+len(phase)+4+len(payload))
+	binary.BigEndian.PutUint64(buf, uint64(txID))
+	buf[8] = uint8(len(phase))
+	copy(buf[9:], phase)
+	binary.BigEndian.PutUint32(buf[9+len(phase):], uint32(len(payload)))
+	copy(buf[13+len(phase):], payload)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, err = j.file.Write(buf); err != nil {
+		return
+	}
+
+	return j.file.Sync()
+}
+
+// Replay implements Journal.Replay, pending transactions are returned in the order they started.
+func (j *FileJournal) Replay() (pending []PendingTx, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, err = j.file.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+
+	var (
+		r     = bufio.NewReader(j.file)
+		txs   = make(map[TxID]*PendingTx)
+		order []*PendingTx
+	)
+
+	for {
+		var txID TxID
+		var phase string
+		var payload []byte
+
+		if txID, phase, payload, err = readJournalRecord(r); err != nil {
+			break
+		}
+
+		tx, ok := txs[txID]
+		if phase == PhasePrepare || !ok {
+			tx = &PendingTx{TxID: txID, Payload: payload}
+			txs[txID] = tx
+			order = append(order, tx)
+		}
+		tx.Phase = phase
+	}
+
+	if err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	err = nil
+
+	for _, tx := range order {
+		// skip transactions replaced by a later one with the same id
+		if txs[tx.TxID] == tx && tx.Phase != PhaseDone {
+			pending = append(pending, *tx)
+		}
+	}
+
+	return
+}
+
+// Close closes the journal file.
+func (j *FileJournal) Close() error {
+	return j.file.Close()
+}
+
+func readJournalRecord(r io.Reader) (txID TxID, phase string, payload []byte, err error) {
+	var header [9]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return
+	}
+	txID = TxID(binary.BigEndian.Uint64(header[:8]))
+
+	buf := make([]byte, int(header[8])+4)
+	if _, err = io.ReadFull(r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	phase = string(buf[:header[8]])
+
+	payload = make([]byte, binary.BigEndian.Uint32(buf[header[8]:]))
+	if _, err = io.ReadFull(r, payload); err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+// record writes the phase transition to Options.Journal if it's set.
+func (c *Coordinator) record(txID TxID, phase string, payload []byte) error {
+	if c.option.Journal == nil {
+		return nil
+	}
+
+	return c.option.Journal.Record(txID, phase, payload)
+}
+
+// Recover resolves the transactions left pending in Options.Journal by a previous coordinator,
+// it should be called before any Put. A transaction is committed if the commit decision has been
+// recorded, which implies that all the workers were prepared, otherwise it's rolled back. The
+// first resolution error is returned after trying all the pending transactions, failed
+// transactions stay pending and will be retried by next Recover.
+func (c *Coordinator) Recover() (err error) {
+	if c.option.Journal == nil {
+		return nil
+	}
+
+	if c.option.Codec == nil {
+		return ErrNoTxCodec
+	}
+
+	pending, err := c.option.Journal.Replay()
+	if err != nil {
+		return
+	}
+
+	for _, p := range pending {
+		c.txLock.Lock()
+		if uint64(p.TxID) > c.txSeq {
+			// keep new transaction ids away from pending ones
+			c.txSeq = uint64(p.TxID)
+		}
+		c.txLock.Unlock()
+
+		if rerr := c.resolve(p); rerr != nil && err == nil {
+			err = rerr
+		}
+	}
+
+	return
+}
+
+func (c *Coordinator) resolve(p PendingTx) (err error) {
+	workers, wb, err := c.option.Codec.Decode(p.Payload)
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := utils.WithClockTimeout(context.Background(), c.option.Clock, c.option.timeout)
+	defer cancel()
+
+	tx := newTxState(workers, cancel)
+
+	switch p.Phase {
+	case PhasePreCommit, PhaseCommit:
+		// all the workers have been prepared
+		tx.enterPhase(PhaseCommit)
+		if err = c.record(p.TxID, PhaseCommit, nil); err != nil {
+			return
+		}
+		err = c.commit(ctx, tx, workers, wb)
+	default:
+		tx.enterPhase(PhaseRollback)
+		if err = c.record(p.TxID, PhaseRollback, nil); err != nil {
+			return
+		}
+		// the prepare results are lost, roll back all the workers
+		err = c.rollback(ctx, tx, workers, nil, wb)
+	}
+
+	if err != nil {
+		return
+	}
+
+	return c.record(p.TxID, PhaseDone, nil)
+}
@@ -0,0 +1,313 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package twopc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testTxCodec encodes workers by their names in a registry.
+type testTxCodec struct {
+	workers map[string]*localWorker
+}
+
+type testTxPayload struct {
+	Workers []string
+	Data    string
+}
+
+func (c *testTxCodec) Encode(workers []Worker, wb WriteBatch) ([]byte, error) {
+	p := testTxPayload{Data: wb.(string)}
+
+	for _, worker := range workers {
+		for name, w := range c.workers {
+			if w == worker {
+				p.Workers = append(p.Workers, name)
+			}
+		}
+	}
+
+	return json.Marshal(p)
+}
+
+func (c *testTxCodec) Decode(payload []byte) (workers []Worker, wb WriteBatch, err error) {
+	var p testTxPayload
+	if err = json.Unmarshal(payload, &p); err != nil {
+		return
+	}
+
+	for _, name := range p.Workers {
+		workers = append(workers, c.workers[name])
+	}
+
+	return workers, p.Data, nil
+}
+
+// crashJournal panics after the record of crashPhase is written, to simulate a coordinator crash.
+type crashJournal struct {
+	*FileJournal
+	crashPhase string
+}
+
+var errCrash = errors.New("coordinator crashed")
+
+// failJournal fails the records of failPhase.
+type failJournal struct {
+	*FileJournal
+	failPhase string
+}
+
+var errRecord = errors.New("record failed")
+
+func (j *failJournal) Record(txID TxID, phase string, payload []byte) error {
+	if phase == j.failPhase {
+		return errRecord
+	}
+	return j.FileJournal.Record(txID, phase, payload)
+}
+
+func (j *crashJournal) Record(txID TxID, phase string, payload []byte) (err error) {
+	if err = j.FileJournal.Record(txID, phase, payload); err == nil && phase == j.crashPhase {
+		panic(errCrash)
+	}
+	return
+}
+
+func newTestJournal(t *testing.T) (path string, cleanup func()) {
+	d, err := ioutil.TempDir("", "twopc_journal")
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	return filepath.Join(d, "journal"), func() { os.RemoveAll(d) }
+}
+
+func TestFileJournal(t *testing.T) {
+	path, cleanup := newTestJournal(t)
+	defer cleanup()
+
+	j, err := NewFileJournal(path)
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	records := []struct {
+		txID    TxID
+		phase   string
+		payload string
+	}{
+		{1, PhasePrepare, "tx1"},
+		{2, PhasePrepare, "tx2"},
+		{1, PhaseCommit, ""},
+		{3, PhasePrepare, "tx3"},
+		{2, PhaseRollback, ""},
+		{2, PhaseDone, ""},
+		{3, PhaseDone, ""},
+		// reused id starts a new transaction
+		{3, PhasePrepare, "tx3 again"},
+	}
+
+	for _, r := range records {
+		if err = j.Record(r.txID, r.phase, []byte(r.payload)); err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+	}
+
+	j.Close()
+
+	// append a torn record
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	f.Write([]byte{0, 0, 0, 0, 0, 0, 0, 4, 7, 'p'})
+	f.Close()
+
+	if j, err = NewFileJournal(path); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+	defer j.Close()
+
+	pending, err := j.Replay()
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if len(pending) != 2 {
+		t.Fatalf("Unexpected pending transactions: %v", pending)
+	}
+	if p := pending[0]; p.TxID != 1 || p.Phase != PhaseCommit || string(p.Payload) != "tx1" {
+		t.Fatalf("Unexpected pending transaction: %v", p)
+	}
+	if p := pending[1]; p.TxID != 3 || p.Phase != PhasePrepare || string(p.Payload) != "tx3 again" {
+		t.Fatalf("Unexpected pending transaction: %v", p)
+	}
+}
+
+func TestCoordinator_Recover(t *testing.T) {
+	// testCrash runs a transaction which crashes the coordinator by crash, then recovers it with
+	// a new coordinator and returns the worker states before and after recovery
+	testCrash := func(crash func(opt *Options)) (crashed, recovered []RaftTxState) {
+		path, cleanup := newTestJournal(t)
+		defer cleanup()
+
+		codec := &testTxCodec{workers: map[string]*localWorker{
+			"w1": newLocalWorker(time.Second),
+			"w2": newLocalWorker(time.Second),
+			"w3": newLocalWorker(time.Second),
+		}}
+		workers := []Worker{codec.workers["w1"], codec.workers["w2"], codec.workers["w3"]}
+
+		j, err := NewFileJournal(path)
+		if err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+
+		opt := NewOptions(5 * time.Second)
+		opt.Journal = j
+		opt.Codec = codec
+		crash(opt)
+
+		func() {
+			defer func() {
+				if r := recover(); r != errCrash {
+					t.Fatalf("Unexpected crash: %v", r)
+				}
+			}()
+			NewCoordinator(opt).Put(workers, "test data")
+		}()
+
+		j.Close()
+
+		for _, worker := range workers {
+			crashed = append(crashed, worker.(*localWorker).getState())
+		}
+
+		// restart
+		if j, err = NewFileJournal(path); err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+		defer j.Close()
+
+		opt = NewOptions(5 * time.Second)
+		opt.Journal = j
+		opt.Codec = codec
+		c := NewCoordinator(opt)
+
+		if err = c.Recover(); err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+
+		for _, worker := range workers {
+			recovered = append(recovered, worker.(*localWorker).getState())
+		}
+
+		if pending, err := j.Replay(); err != nil || len(pending) != 0 {
+			t.Fatalf("Unexpected pending transactions after recovery: %v, %v", pending, err)
+		}
+
+		// new transactions don't reuse recovered ids
+		if c.txSeq < 1 {
+			t.Fatalf("Unexpected tx sequence after recovery: %v", c.txSeq)
+		}
+		if err = c.Put(workers, "test data"); err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+
+		return
+	}
+
+	// crash after the commit decision is recorded
+	crashed, recovered := testCrash(func(opt *Options) {
+		opt.Journal = &crashJournal{FileJournal: opt.Journal.(*FileJournal), crashPhase: PhaseCommit}
+	})
+
+	for i := range crashed {
+		if crashed[i] != Prepared {
+			t.Fatalf("Unexpected worker state after crash: %v", crashed[i])
+		}
+		if recovered[i] != Committed {
+			t.Fatalf("Unexpected worker state after recovery: %v", recovered[i])
+		}
+	}
+
+	// crash after prepare, before the commit decision
+	crashed, recovered = testCrash(func(opt *Options) {
+		opt.beforeCommit = func(ctx context.Context) error {
+			panic(errCrash)
+		}
+	})
+
+	for i := range crashed {
+		if crashed[i] != Prepared {
+			t.Fatalf("Unexpected worker state after crash: %v", crashed[i])
+		}
+		if recovered[i] != RolledBack {
+			t.Fatalf("Unexpected worker state after recovery: %v", recovered[i])
+		}
+	}
+
+	// journal without codec
+	c := NewCoordinator(&Options{Journal: &FileJournal{}, timeout: time.Second})
+	if err := c.Recover(); err != ErrNoTxCodec {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := c.Put(nil, nil); err != ErrNoTxCodec {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestCoordinator_RecordDoneFailure(t *testing.T) {
+	path, cleanup := newTestJournal(t)
+	defer cleanup()
+
+	fj, err := NewFileJournal(path)
+	if err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+	defer fj.Close()
+
+	codec := &testTxCodec{workers: map[string]*localWorker{
+		"w1": newLocalWorker(time.Second),
+		"w2": newLocalWorker(time.Second),
+	}}
+	workers := []Worker{codec.workers["w1"], codec.workers["w2"]}
+
+	opt := NewOptions(5 * time.Second)
+	opt.Journal = &failJournal{FileJournal: fj, failPhase: PhaseDone}
+	opt.Codec = codec
+	c := NewCoordinator(opt)
+
+	// the transaction is committed, even though it's left pending in journal
+	if err = c.Put(workers, "test data"); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	for _, worker := range workers {
+		if state := worker.(*localWorker).getState(); state != Committed {
+			t.Fatalf("Unexpected worker state: %v", state)
+		}
+	}
+
+	if pending, err := fj.Replay(); err != nil || len(pending) != 1 || pending[0].Phase != PhaseCommit {
+		t.Fatalf("Unexpected pending transactions: %v, %v", pending, err)
+	}
+}
@@ -19,42 +19,126 @@ package twopc
 import (
 	"context"
 	"fmt"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/thunderdb/ThunderDB/utils"
 )
 
 // Hook are called during 2PC running
 type Hook func(ctx context.Context) error
 
+// ContextHook is a Hook which may return a context derived from ctx, the values of the returned
+// context are visible to the subsequent hooks and worker calls of the transaction, while the
+// deadline and cancellation are still controlled by the coordinator. ctx is kept if nil is
+// returned.
+type ContextHook func(ctx context.Context) (context.Context, error)
+
+// Protocol selects the atomic commit protocol run by a coordinator.
+type Protocol int
+
+const (
+	// TwoPhaseCommit runs Prepare and Commit on workers, it's the default protocol.
+	TwoPhaseCommit Protocol = iota
+
+	// ThreePhaseCommit runs Prepare (CanCommit), PreCommit and Commit (DoCommit) on workers,
+	// which must implement ThreePCWorker. Once a worker has been pre-committed, it knows that all
+	// the workers have voted yes, so it can safely commit on its own if the coordinator stalls.
+	// The commit decision is made once all the workers are pre-committed, so the commit hook runs
+	// before PreCommit, and the transaction can not be canceled or rolled back after it.
+	ThreePhaseCommit
+)
+
 // Options represents options of a 2PC coordinator.
 type Options struct {
+	// Protocol is the commit protocol used by the coordinator, TwoPhaseCommit by default.
+	Protocol Protocol
+
+	// Journal records phase transitions for crash recovery if it's set, see Coordinator.Recover.
+	Journal Journal
+
+	// Codec encodes transactions to Journal payloads, it's required if Journal is set.
+	Codec TxCodec
+
+	// PreflightCheck makes the coordinator ping all the workers implementing HealthyWorker
+	// concurrently before the prepare phase, the transaction is aborted without preparing any
+	// worker if any of them fails, since all the workers are required to commit.
+	PreflightCheck bool
+
+	// Clock measures the transaction timeout, utils.RealClock is used if it's nil.
+	Clock utils.Clock
+
 	timeout        time.Duration
 	beforePrepare  Hook
 	beforeCommit   Hook
 	beforeRollback Hook
+
+	prepareHook  ContextHook
+	commitHook   ContextHook
+	rollbackHook ContextHook
 }
 
-// Worker represents a 2PC worker who implements Prepare, Commit, and Rollback.
+// Worker represents a 2PC worker who implements Prepare, Commit, and Rollback. Rollback is only
+// issued to the workers prepared successfully, so a worker failing to prepare, including being
+// canceled by the context, should leave nothing prepared.
 type Worker interface {
 	Prepare(ctx context.Context, wb WriteBatch) error
 	Commit(ctx context.Context, wb WriteBatch) error
 	Rollback(ctx context.Context, wb WriteBatch) error
 }
 
+// ThreePCWorker represents a 3PC worker, Worker.Prepare and Worker.Commit are used as the
+// CanCommit and DoCommit phases respectively. A worker should commit the WriteBatch by itself if
+// it doesn't receive the DoCommit call in time after PreCommit.
+type ThreePCWorker interface {
+	Worker
+	PreCommit(ctx context.Context, wb WriteBatch) error
+}
+
+// HealthyWorker represents a worker supporting health probe, see Options.PreflightCheck.
+type HealthyWorker interface {
+	Worker
+	Ping(ctx context.Context) error
+}
+
+// OrderedWorker represents a worker with commit priority. If any worker of a transaction
+// implements OrderedWorker, the commit and rollback phases are run on the workers one by one in
+// descending priority order instead of concurrently, workers without priority are treated as
+// priority 0 and ties keep the stable worker order. The prepare phase is always concurrent.
+type OrderedWorker interface {
+	Worker
+	CommitPriority() int
+}
+
+// IdentifiedWorker represents a worker with a stable identifier, which should be unique among the
+// workers of a transaction. The workers are reported in the stable worker order: workers without
+// identifier come first in input order, followed by the identified workers sorted by identifier,
+// so that the errors of concurrent phases are reproducible regardless of completion timing.
+type IdentifiedWorker interface {
+	Worker
+	WorkerID() string
+}
+
 // WriteBatch is an empty interface which will be passed to Worker methods.
 type WriteBatch interface{}
 
 // Coordinator is a 2PC coordinator.
 type Coordinator struct {
 	option *Options
+
+	txLock sync.Mutex // Protects following fields
+	txSeq  uint64
+	txs    map[TxID]*txState
 }
 
 // NewCoordinator creates a new 2PC Coordinator.
 func NewCoordinator(opt *Options) *Coordinator {
 	return &Coordinator{
 		option: opt,
+		txs:    make(map[TxID]*txState),
 	}
 }
 
@@ -75,104 +159,460 @@ func NewOptionsWithCallback(timeout time.Duration, beforePrepare Hook, beforeCom
 	}
 }
 
-func (c *Coordinator) rollback(ctx context.Context, workers []Worker, wb WriteBatch) (err error) {
+// NewOptionsWithContextCallback returns a new coordinator option with before
+// prepare/commit/rollback callback, which may pass values to the subsequent phases through the
+// returned context, see ContextHook.
+func NewOptionsWithContextCallback(timeout time.Duration, beforePrepare ContextHook,
+	beforeCommit ContextHook, beforeRollback ContextHook) *Options {
+	return &Options{
+		timeout:      timeout,
+		prepareHook:  beforePrepare,
+		commitHook:   beforeCommit,
+		rollbackHook: beforeRollback,
+	}
+}
+
+// callHook calls the hooks before phase, values is the context returned by the context hook, or
+// ctx if there is none.
+func (o *Options) callHook(ctx context.Context, phase string) (values context.Context, err error) {
+	var hook Hook
+	var ctxHook ContextHook
+
+	switch phase {
+	case PhasePrepare:
+		hook, ctxHook = o.beforePrepare, o.prepareHook
+	case PhaseCommit:
+		hook, ctxHook = o.beforeCommit, o.commitHook
+	default:
+		hook, ctxHook = o.beforeRollback, o.rollbackHook
+	}
+
+	if hook != nil {
+		if err = hook(ctx); err != nil {
+			return ctx, err
+		}
+	}
+
+	if ctxHook != nil {
+		if values, err = ctxHook(ctx); err != nil || values == nil {
+			return ctx, err
+		}
+
+		return values, nil
+	}
+
+	return ctx, nil
+}
+
+// valuesContext is ctx with the values of another context, so that the values added by hooks do
+// not change the deadline and cancellation of phases.
+type valuesContext struct {
+	context.Context
+	values context.Context
+}
+
+func (c *valuesContext) Value(key interface{}) interface{} {
+	return c.values.Value(key)
+}
+
+func withValues(ctx context.Context, values context.Context) context.Context {
+	if values == ctx {
+		return ctx
+	}
+
+	return &valuesContext{Context: ctx, values: values}
+}
+
+func (c *Coordinator) preflight(ctx context.Context, workers []Worker) (err error) {
 	errs := make([]error, len(workers))
 	wg := sync.WaitGroup{}
 
 	for index, worker := range workers {
+		hw, ok := worker.(HealthyWorker)
+		if !ok {
+			continue
+		}
+
 		wg.Add(1)
-		go func(n Worker, e *error) {
-			*e = n.Rollback(ctx, wb)
+		go func(n HealthyWorker, e *error) {
+			*e = n.Ping(ctx)
 			wg.Done()
-		}(worker, &errs[index])
+		}(hw, &errs[index])
 	}
 
 	wg.Wait()
 
-	for _, err = range errs {
-		if err != nil {
-			return err
+	for _, index := range stableOrder(workers) {
+		if err := errs[index]; err != nil {
+			id := workerID(index, workers[index])
+			log.Debugf("preflight check failed on worker %s: err = %v", id, err)
+			return fmt.Errorf("twopc: preflight check failed on worker %s: %v", id, err)
+		}
+	}
+
+	return nil
+}
+
+// workerID returns the stable identifier of the worker, or its index if it does not implement
+// IdentifiedWorker.
+func workerID(index int, worker Worker) string {
+	if iw, ok := worker.(IdentifiedWorker); ok {
+		return iw.WorkerID()
+	}
+
+	return strconv.Itoa(index)
+}
+
+// stableOrder returns the worker indices in the stable worker order, see IdentifiedWorker.
+func stableOrder(workers []Worker) (order []int) {
+	ids := make([]string, len(workers))
+	identified := make([]bool, len(workers))
+	order = make([]int, len(workers))
+
+	for index, worker := range workers {
+		order[index] = index
+		if iw, ok := worker.(IdentifiedWorker); ok {
+			ids[index] = iw.WorkerID()
+			identified[index] = true
+		}
+	}
+
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := order[i], order[j]
+		if identified[a] != identified[b] {
+			return !identified[a]
+		}
+		return ids[a] < ids[b]
+	})
+
+	return
+}
+
+// commitOrder returns the worker indices in commit order, or nil if no worker implements
+// OrderedWorker.
+func commitOrder(workers []Worker) (order []int) {
+	priorities := make([]int, len(workers))
+	ordered := false
+
+	for index, worker := range workers {
+		if ow, ok := worker.(OrderedWorker); ok {
+			priorities[index] = ow.CommitPriority()
+			ordered = true
 		}
 	}
 
-	return fmt.Errorf("twopc: rollback")
+	if !ordered {
+		return nil
+	}
+
+	order = stableOrder(workers)
+	sort.SliceStable(order, func(i, j int) bool {
+		return priorities[order[i]] > priorities[order[j]]
+	})
+
+	return
 }
 
-func (c *Coordinator) commit(ctx context.Context, workers []Worker, wb WriteBatch) (err error) {
+// rollback rolls back the workers, the workers failed to prepare are skipped if prepareErrs is
+// not nil.
+func (c *Coordinator) rollback(ctx context.Context,
+	tx *txState, workers []Worker, prepareErrs []error, wb WriteBatch) (err error) {
 	errs := make([]error, len(workers))
+	skip := func(index int) bool {
+		return prepareErrs != nil && prepareErrs[index] != nil
+	}
+
+	if order := commitOrder(workers); order != nil {
+		for _, index := range order {
+			if skip(index) {
+				continue
+			}
+
+			tx.workerStart(index, PhaseRollback)
+			errs[index] = workers[index].Rollback(ctx, wb)
+			tx.workerDone(index, errs[index])
+		}
+
+		return workerError(PhaseRollback, workers, errs)
+	}
+
 	wg := sync.WaitGroup{}
 
 	for index, worker := range workers {
+		if skip(index) {
+			continue
+		}
+
 		wg.Add(1)
-		go func(n Worker, e *error) {
-			*e = n.Commit(ctx, wb)
+		tx.workerStart(index, PhaseRollback)
+		go func(index int, n Worker, e *error) {
+			*e = n.Rollback(ctx, wb)
+			tx.workerDone(index, *e)
 			wg.Done()
-		}(worker, &errs[index])
+		}(index, worker, &errs[index])
 	}
 
 	wg.Wait()
 
-	for _, err = range errs {
-		if err != nil {
-			return err
+	return workerError(PhaseRollback, workers, errs)
+}
+
+func (c *Coordinator) commit(
+	ctx context.Context, tx *txState, workers []Worker, wb WriteBatch) (err error) {
+	errs := make([]error, len(workers))
+
+	if order := commitOrder(workers); order != nil {
+		// the commit decision is made, so all the workers are committed even if some fail
+		for _, index := range order {
+			tx.workerStart(index, PhaseCommit)
+			errs[index] = workers[index].Commit(ctx, wb)
+			tx.workerDone(index, errs[index])
 		}
+
+		return workerError(PhaseCommit, workers, errs)
 	}
 
-	return nil
+	wg := sync.WaitGroup{}
+
+	for index, worker := range workers {
+		wg.Add(1)
+		tx.workerStart(index, PhaseCommit)
+		go func(index int, n Worker, e *error) {
+			*e = n.Commit(ctx, wb)
+			tx.workerDone(index, *e)
+			wg.Done()
+		}(index, worker, &errs[index])
+	}
+
+	wg.Wait()
+
+	return workerError(PhaseCommit, workers, errs)
+}
+
+func (c *Coordinator) preCommit(
+	ctx context.Context, tx *txState, workers []Worker, wb WriteBatch) (err error) {
+	errs := make([]error, len(workers))
+	wg := sync.WaitGroup{}
+
+	for index, worker := range workers {
+		wg.Add(1)
+		tx.workerStart(index, PhasePreCommit)
+		go func(index int, n ThreePCWorker, e *error) {
+			*e = n.PreCommit(ctx, wb)
+			tx.workerDone(index, *e)
+			wg.Done()
+		}(index, worker.(ThreePCWorker), &errs[index])
+	}
+
+	wg.Wait()
+
+	if err = workerError(PhasePreCommit, workers, errs); err != nil {
+		log.Debugf("pre-commit failed: err = %v", err)
+	}
+
+	return
 }
 
-// Put initiates a 2PC process to apply given WriteBatch on all workers.
+// Put initiates a 2PC process to apply given WriteBatch on all workers, or a 3PC process if
+// Options.Protocol is ThreePhaseCommit. The transaction is registered during the process, see
+// InFlight, Status and Cancel. If several workers fail in the same phase, their errors are
+// returned as a MultiError.
 func (c *Coordinator) Put(workers []Worker, wb WriteBatch) (err error) {
+	return c.PutContext(context.Background(), workers, wb)
+}
+
+// PutContext initiates a transaction like Put, the contexts of prepare and commit are derived
+// from parent. If parent is done before the commit decision, the transaction is aborted and rolled
+// back promptly on a new timeout, and the parent context error is returned. Once the commit
+// decision is made, the commit errors are returned as is.
+func (c *Coordinator) PutContext(parent context.Context, workers []Worker, wb WriteBatch) (
+	err error) {
+	_, err = c.put(parent, workers, wb)
+	return
+}
+
+// PutDetailed initiates a transaction like PutContext, and returns the outcome of each worker
+// along with the error, so that the workers failed to commit after the commit decision can be
+// repaired. The workers have no outcome if the transaction is rejected before prepare, e.g., by
+// Options.PreflightCheck.
+func (c *Coordinator) PutDetailed(parent context.Context, workers []Worker, wb WriteBatch) (
+	result *PutResult, err error) {
+	tx, err := c.put(parent, workers, wb)
+
+	if tx == nil {
+		tx = newTxState(workers, nil)
+	}
+
+	return tx.result(), err
+}
+
+func (c *Coordinator) put(parent context.Context, workers []Worker, wb WriteBatch) (
+	tx *txState, err error) {
+	// the outcome of workers is returned as is once the commit decision is made
+	decided := false
+	defer func() {
+		if err != nil && !decided && parent.Err() != nil {
+			err = parent.Err()
+		}
+	}()
+
 	// Initiate phase one: ask nodes to prepare for progress
-	ctx, cancel := context.WithTimeout(context.Background(), c.option.timeout)
+	ctx, cancel := utils.WithClockTimeout(parent, c.option.Clock, c.option.timeout)
 	defer cancel()
 
-	if c.option.beforePrepare != nil {
-		if err := c.option.beforePrepare(ctx); err != nil {
-			return err
+	if c.option.Protocol == ThreePhaseCommit {
+		for _, worker := range workers {
+			if _, ok := worker.(ThreePCWorker); !ok {
+				return nil, fmt.Errorf("twopc: worker %v does not implement ThreePCWorker", worker)
+			}
+		}
+	}
+
+	// txCtx is canceled by Coordinator.Cancel, while ctx is kept for commit or rollback
+	txCtx, txCancel := context.WithCancel(ctx)
+	defer txCancel()
+
+	var payload []byte
+	if c.option.Journal != nil {
+		if c.option.Codec == nil {
+			return nil, ErrNoTxCodec
+		}
+		if payload, err = c.option.Codec.Encode(workers, wb); err != nil {
+			return
+		}
+	}
+
+	tx = newTxState(workers, txCancel)
+	txID := c.register(tx)
+	defer c.unregister(txID)
+
+	if c.option.PreflightCheck {
+		if err = c.preflight(txCtx, workers); err != nil {
+			return
 		}
 	}
 
+	values, err := c.option.callHook(txCtx, PhasePrepare)
+	if err != nil {
+		return tx, &HookError{Phase: PhasePrepare, Err: err}
+	}
+	txCtx, ctx = withValues(txCtx, values), withValues(ctx, values)
+
+	if err = c.record(txID, PhasePrepare, payload); err != nil {
+		return
+	}
+
 	errs := make([]error, len(workers))
 	wg := sync.WaitGroup{}
 
 	for index, worker := range workers {
 		wg.Add(1)
-		go func(n Worker, e *error) {
-			*e = n.Prepare(ctx, wb)
+		tx.workerStart(index, PhasePrepare)
+		go func(index int, n Worker, e *error) {
+			// never prepare once the transaction is aborted
+			if *e = txCtx.Err(); *e == nil {
+				*e = n.Prepare(txCtx, wb)
+			}
+			tx.workerDone(index, *e)
 			wg.Done()
-		}(worker, &errs[index])
+		}(index, worker, &errs[index])
 	}
 
+	// wait for all the workers to settle, so that no rollback races with prepare
 	wg.Wait()
 
 	// Check prepare results and initiate phase two
 	var returnErr error
-	for index, err := range errs {
-		if err != nil {
+	if returnErr = workerError(PhasePrepare, workers, errs); returnErr != nil {
+		log.Debugf("prepare failed: err = %v", returnErr)
+		goto ROLLBACK
+	}
+
+	if values, err := c.option.callHook(txCtx, PhaseCommit); err != nil {
+		returnErr = &HookError{Phase: PhaseCommit, Err: err}
+		log.Debug("before commit failed: err = %v", err)
+		goto ROLLBACK
+	} else {
+		txCtx, ctx = withValues(txCtx, values), withValues(ctx, values)
+	}
+
+	// abort if canceled or the parent context is done before the commit decision
+	if err := txCtx.Err(); err != nil {
+		returnErr = err
+		goto ROLLBACK
+	}
+
+	if c.option.Protocol == ThreePhaseCommit {
+		if err := tx.enterPhase(PhasePreCommit); err != nil {
+			returnErr = err
+			goto ROLLBACK
+		}
+
+		if err := c.record(txID, PhasePreCommit, nil); err != nil {
+			returnErr = err
+			goto ROLLBACK
+		}
+
+		if err := c.preCommit(txCtx, tx, workers, wb); err != nil {
 			returnErr = err
-			log.Debugf("prepare failed on %v: err = %v", workers[index], err)
 			goto ROLLBACK
 		}
+
+		// pre-committed workers commit on their own after timeout, and Recover commits the
+		// pre-committed transaction, so it's never rolled back from here on
+		decided = true
 	}
 
-	if c.option.beforeCommit != nil {
-		if err := c.option.beforeCommit(ctx); err != nil {
+	if err := tx.enterPhase(PhaseCommit); err != nil {
+		returnErr = err
+		goto ROLLBACK
+	}
+
+	// the commit decision must be durable before any worker commits
+	if err := c.record(txID, PhaseCommit, nil); err != nil {
+		if !decided {
 			returnErr = err
-			log.Debug("before commit failed: err = %v", err)
 			goto ROLLBACK
 		}
+
+		log.Warningf("record commit of pre-committed transaction %d failed: err = %v", txID, err)
 	}
 
-	return c.commit(ctx, workers, wb)
+	decided = true
+
+	if err = c.commit(ctx, tx, workers, wb); err != nil {
+		return
+	}
+
+	// all the workers have committed, the transaction is only left pending in journal, and a
+	// later Recover commits it again
+	if rerr := c.record(txID, PhaseDone, nil); rerr != nil {
+		log.Warningf("record done of committed transaction %d failed: err = %v", txID, rerr)
+	}
+
+	return
 
 ROLLBACK:
-	if c.option.beforeRollback != nil {
-		// ignore rollback fail options
-		c.option.beforeRollback(ctx)
+	tx.enterPhase(PhaseRollback)
+	c.record(txID, PhaseRollback, nil)
+
+	if tx.isCanceled() {
+		returnErr = ErrTxCanceled
 	}
 
-	c.rollback(ctx, workers, wb)
+	// roll back on a new timeout, since ctx may be done along with parent, the values are kept
+	rbCtx, rbCancel := utils.WithClockTimeout(context.Background(), c.option.Clock, c.option.timeout)
+	defer rbCancel()
+	rbCtx = withValues(rbCtx, ctx)
+
+	// ignore rollback fail options
+	if values, err := c.option.callHook(rbCtx, PhaseRollback); err == nil {
+		rbCtx = withValues(rbCtx, values)
+	}
+
+	if err := c.rollback(rbCtx, tx, workers, errs, wb); err == nil {
+		c.record(txID, PhaseDone, nil)
+	}
 
-	return returnErr
+	return tx, returnErr
 }
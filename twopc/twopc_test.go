@@ -19,8 +19,12 @@ package twopc
 import (
 	"context"
 	"fmt"
+	"math/rand"
 	"os"
+	"reflect"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -31,6 +35,7 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/thunderdb/ThunderDB/crypto/etls"
 	"github.com/thunderdb/ThunderDB/rpc"
+	"github.com/thunderdb/ThunderDB/utils"
 )
 
 type RaftTxState int
@@ -41,6 +46,7 @@ const (
 	Prepared
 	Committed
 	RolledBack
+	PreCommitted
 )
 
 const (
@@ -480,8 +486,10 @@ func TestTwoPhaseCommit_WithHooks(t *testing.T) {
 	err = c.Put(nodes, &RaftWriteBatchReq{TxID: 1, Cmds: []string{"+1", "-3", "+10"}})
 	if err == nil {
 		t.Fatal("Unexpected result: returned nil while expecting an error")
-	} else if err != beforePrepareError {
+	} else if !errors.Is(err, beforePrepareError) {
 		t.Fatal("Unexpected result: beforePrepare error is expected")
+	} else if he := (*HookError)(nil); !errors.As(err, &he) || he.Phase != PhasePrepare {
+		t.Fatalf("Unexpected hook error: %v", err)
 	} else {
 		t.Logf("Error occurred as expected: %s", err.Error())
 	}
@@ -496,7 +504,7 @@ func TestTwoPhaseCommit_WithHooks(t *testing.T) {
 	err = c.Put(nodes, &RaftWriteBatchReq{TxID: 2, Cmds: []string{"+1", "-3", "+10"}})
 	if err == nil {
 		t.Fatal("Unexpected result: returned nil while expecting an error")
-	} else if err != beforeCommitError {
+	} else if !errors.Is(err, beforeCommitError) {
 		t.Fatal("Unexpected result: beforeCommit error is expected")
 	} else {
 		t.Logf("Error occurred as expected: %s", err.Error())
@@ -512,9 +520,1230 @@ func TestTwoPhaseCommit_WithHooks(t *testing.T) {
 	err = c.Put(nodes, &RaftWriteBatchReq{TxID: 3, Cmds: []string{"+1", "-3", "+10"}})
 	if err == nil {
 		t.Fatal("Unexpected result: returned nil while expecting an error")
-	} else if err != beforeCommitError {
+	} else if !errors.Is(err, beforeCommitError) {
 		t.Fatal("Unexpected result: beforeCommit error is expected")
 	} else {
 		t.Logf("Error occurred as expected: %s", err.Error())
 	}
 }
+
+// localWorker is an in-memory ThreePCWorker, it commits by itself if DoCommit doesn't arrive in
+// commitTimeout after PreCommit.
+type localWorker struct {
+	mu            sync.Mutex
+	state         RaftTxState
+	commitTimeout time.Duration
+	timer         *time.Timer
+	blockPrepare  bool
+}
+
+func newLocalWorker(commitTimeout time.Duration) *localWorker {
+	return &localWorker{
+		state:         Initailized,
+		commitTimeout: commitTimeout,
+	}
+}
+
+func (w *localWorker) getState() RaftTxState {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.state
+}
+
+func (w *localWorker) Prepare(ctx context.Context, wb WriteBatch) error {
+	if w.blockPrepare {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.state = Prepared
+	return nil
+}
+
+func (w *localWorker) PreCommit(ctx context.Context, wb WriteBatch) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.state != Prepared {
+		return errors.New("pre-commit on unprepared worker")
+	}
+
+	w.state = PreCommitted
+	w.timer = time.AfterFunc(w.commitTimeout, func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+
+		if w.state == PreCommitted {
+			log.Debug("coordinator stalled, commit by worker itself")
+			w.state = Committed
+		}
+	})
+
+	return nil
+}
+
+func (w *localWorker) Commit(ctx context.Context, wb WriteBatch) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+
+	switch w.state {
+	case Prepared, PreCommitted, Committed:
+		w.state = Committed
+		return nil
+	default:
+		return errors.New("commit on unprepared worker")
+	}
+}
+
+func (w *localWorker) Rollback(ctx context.Context, wb WriteBatch) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+
+	w.state = RolledBack
+	return nil
+}
+
+// stallJournal stalls the coordinator on recording the commit decision until released.
+type stallJournal struct {
+	stalled chan struct{}
+	release chan struct{}
+}
+
+func (j *stallJournal) Record(txID TxID, phase string, payload []byte) error {
+	if phase == PhaseCommit {
+		close(j.stalled)
+		<-j.release
+	}
+	return nil
+}
+
+func (j *stallJournal) Replay() ([]PendingTx, error) {
+	return nil, nil
+}
+
+// nopTxCodec encodes nothing, it's used with the journals never replayed.
+type nopTxCodec struct{}
+
+func (nopTxCodec) Encode(workers []Worker, wb WriteBatch) ([]byte, error) {
+	return nil, nil
+}
+
+func (nopTxCodec) Decode(payload []byte) ([]Worker, WriteBatch, error) {
+	return nil, nil, nil
+}
+
+func testCoordinatorStall(t *testing.T, protocol Protocol) (states []RaftTxState) {
+	stalled := make(chan struct{})
+	release := make(chan struct{})
+	opt := NewOptions(5 * time.Second)
+	opt.Journal = &stallJournal{stalled: stalled, release: release}
+	opt.Codec = nopTxCodec{}
+	opt.Protocol = protocol
+	c := NewCoordinator(opt)
+
+	workers := make([]Worker, 3)
+
+	for i := range workers {
+		workers[i] = newLocalWorker(100 * time.Millisecond)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.Put(workers, nil)
+	}()
+
+	<-stalled
+	time.Sleep(500 * time.Millisecond)
+
+	for _, worker := range workers {
+		states = append(states, worker.(*localWorker).getState())
+	}
+
+	close(release)
+
+	if err := <-errCh; err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	for _, worker := range workers {
+		if state := worker.(*localWorker).getState(); state != Committed {
+			t.Fatalf("Unexpected worker state after put: %v", state)
+		}
+	}
+
+	return
+}
+
+func TestThreePhaseCommit(t *testing.T) {
+	// 2PC workers stay blocked in prepared state while coordinator stalls
+	for _, state := range testCoordinatorStall(t, TwoPhaseCommit) {
+		if state != Prepared {
+			t.Fatalf("Unexpected 2PC worker state during stall: %v", state)
+		}
+	}
+
+	// 3PC workers commit by themselves
+	for _, state := range testCoordinatorStall(t, ThreePhaseCommit) {
+		if state != Committed {
+			t.Fatalf("Unexpected 3PC worker state during stall: %v", state)
+		}
+	}
+
+	// 3PC requires ThreePCWorker
+	c := NewCoordinator(&Options{Protocol: ThreePhaseCommit, timeout: 5 * time.Second})
+	testNodeReset()
+	policy = AllGood
+
+	if err := c.Put(nodes, &RaftWriteBatchReq{TxID: 0}); err == nil {
+		t.Fatal("Unexpected result: returned nil while expecting an error")
+	} else {
+		t.Logf("Error occurred as expected: %s", err.Error())
+	}
+}
+
+// blockPreCommitWorker is a localWorker blocked in pre-commit until released.
+type blockPreCommitWorker struct {
+	*localWorker
+	preCommitting chan struct{}
+	release       chan struct{}
+}
+
+func (w *blockPreCommitWorker) PreCommit(ctx context.Context, wb WriteBatch) error {
+	close(w.preCommitting)
+	<-w.release
+	return w.localWorker.PreCommit(ctx, wb)
+}
+
+func TestThreePhaseCommit_Decision(t *testing.T) {
+	checkCommitted := func(workers []Worker) {
+		for _, worker := range workers {
+			var state RaftTxState
+			switch w := worker.(type) {
+			case *localWorker:
+				state = w.getState()
+			case *blockPreCommitWorker:
+				state = w.getState()
+			}
+			if state != Committed {
+				t.Fatalf("Unexpected worker state: %v", state)
+			}
+		}
+	}
+
+	// commit hook runs before pre-commit, a failure rolls back the workers never pre-committed
+	opt := NewOptionsWithCallback(5*time.Second, nil, func(ctx context.Context) error {
+		return errors.New("hook failed")
+	}, nil)
+	opt.Protocol = ThreePhaseCommit
+	workers := []Worker{newLocalWorker(time.Second), newLocalWorker(time.Second)}
+
+	result, err := NewCoordinator(opt).PutDetailed(context.Background(), workers, nil)
+	if he := (*HookError)(nil); !errors.As(err, &he) || he.Phase != PhaseCommit {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, r := range result.Workers {
+		if r.PreCommitted || !r.RolledBack {
+			t.Fatalf("Unexpected worker result: %+v", r)
+		}
+	}
+
+	// pre-committing transaction can not be canceled
+	opt = NewOptions(5 * time.Second)
+	opt.Protocol = ThreePhaseCommit
+	c := NewCoordinator(opt)
+	blocked := &blockPreCommitWorker{
+		localWorker:   newLocalWorker(time.Second),
+		preCommitting: make(chan struct{}),
+		release:       make(chan struct{}),
+	}
+	workers = []Worker{newLocalWorker(time.Second), blocked}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.Put(workers, nil)
+	}()
+
+	<-blocked.preCommitting
+	if err := c.Cancel(c.InFlight()[0]); err != ErrTxCommitting {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	close(blocked.release)
+
+	if err := <-errCh; err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+	checkCommitted(workers)
+
+	// parent context done after pre-commit does not roll back
+	journal := &stallJournal{stalled: make(chan struct{}), release: make(chan struct{})}
+	opt = NewOptions(5 * time.Second)
+	opt.Protocol = ThreePhaseCommit
+	opt.Journal = journal
+	opt.Codec = nopTxCodec{}
+	c = NewCoordinator(opt)
+	workers = []Worker{newLocalWorker(time.Second), newLocalWorker(time.Second)}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		errCh <- c.PutContext(ctx, workers, nil)
+	}()
+
+	<-journal.stalled
+	cancel()
+	close(journal.release)
+
+	if err := <-errCh; err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+	checkCommitted(workers)
+}
+
+func TestCoordinator_Cancel(t *testing.T) {
+	c := NewCoordinator(NewOptions(5 * time.Second))
+
+	if err := c.Cancel(TxID(1)); err != ErrTxNotFound {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	slow := newLocalWorker(time.Second)
+	slow.blockPrepare = true
+	workers := []Worker{newLocalWorker(time.Second), slow}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.Put(workers, nil)
+	}()
+
+	var txIDs []TxID
+
+	for len(txIDs) == 0 {
+		time.Sleep(10 * time.Millisecond)
+		txIDs = c.InFlight()
+	}
+
+	// wait until the fast worker finishes prepare
+	for {
+		phase, status, ok := c.Status(txIDs[0])
+
+		if !ok || phase != PhasePrepare || len(status) != 2 {
+			t.Fatalf("Unexpected status: %v, %+v, %v", phase, status, ok)
+		}
+
+		if status[0].Done {
+			if status[0].Phase != PhasePrepare || status[0].Err != nil ||
+				status[1].Phase != PhasePrepare || status[1].Done {
+				t.Fatalf("Unexpected worker status: %+v", status)
+			}
+
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := c.Cancel(txIDs[0]); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if err := <-errCh; err != ErrTxCanceled {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// the slow worker is canceled before prepared, so it's not rolled back
+	for i, expected := range []RaftTxState{RolledBack, Initailized} {
+		if state := workers[i].(*localWorker).getState(); state != expected {
+			t.Fatalf("Unexpected worker state after cancel: %v", state)
+		}
+	}
+
+	if _, _, ok := c.Status(txIDs[0]); ok || len(c.InFlight()) != 0 {
+		t.Fatal("Settled transaction should be removed from registry")
+	}
+
+	if err := c.Cancel(txIDs[0]); err != ErrTxNotFound {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+// cancelWorker is a localWorker blocked in prepare, it records the prepare error.
+type cancelWorker struct {
+	*localWorker
+	prepareErr chan error
+}
+
+func (w *cancelWorker) Prepare(ctx context.Context, wb WriteBatch) error {
+	err := w.localWorker.Prepare(ctx, wb)
+	w.prepareErr <- err
+	return err
+}
+
+func TestCoordinator_PutContext(t *testing.T) {
+	c := NewCoordinator(NewOptions(5 * time.Second))
+	workers := make([]Worker, 3)
+
+	for i := range workers {
+		w := &cancelWorker{localWorker: newLocalWorker(time.Second), prepareErr: make(chan error, 1)}
+		w.blockPrepare = true
+		workers[i] = w
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.PutContext(ctx, workers, nil)
+	}()
+
+	for len(c.InFlight()) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	start := time.Now()
+	cancel()
+
+	select {
+	case err := <-errCh:
+		if err != context.Canceled {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("PutContext should return promptly after cancellation")
+	}
+
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("PutContext returned too slowly after cancellation: %v", elapsed)
+	}
+
+	for _, worker := range workers {
+		w := worker.(*cancelWorker)
+
+		if err := <-w.prepareErr; err != context.Canceled {
+			t.Fatalf("Unexpected prepare error: %v", err)
+		}
+
+		// never prepared, nothing to roll back
+		if state := w.getState(); state != Initailized {
+			t.Fatalf("Unexpected worker state after cancel: %v", state)
+		}
+	}
+
+	if len(c.InFlight()) != 0 {
+		t.Fatal("Settled transaction should be removed from registry")
+	}
+
+	// canceled before put
+	if err := c.PutContext(ctx, []Worker{newLocalWorker(time.Second)}, nil); err != context.Canceled {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// not canceled
+	if err := c.PutContext(context.Background(), []Worker{newLocalWorker(time.Second)}, nil); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	// prepared worker is rolled back on a live context after cancellation
+	ctx, cancel = context.WithCancel(context.Background())
+	prepared := &rollbackCtxWorker{localWorker: newLocalWorker(time.Second), rollbackErr: make(chan error, 1)}
+	blocked := newLocalWorker(time.Second)
+	blocked.blockPrepare = true
+
+	go func() {
+		errCh <- c.PutContext(ctx, []Worker{prepared, blocked}, nil)
+	}()
+
+	for prepared.getState() != Prepared {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+
+	if err := <-errCh; err != context.Canceled {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := <-prepared.rollbackErr; err != nil {
+		t.Fatalf("Rollback context should not be done: %v", err)
+	}
+	if state := prepared.getState(); state != RolledBack {
+		t.Fatalf("Unexpected worker state after cancel: %v", state)
+	}
+
+	// commit errors are kept after the commit decision
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	failed := &cancelCommitWorker{localWorker: newLocalWorker(time.Second), cancel: cancel}
+
+	err := c.PutContext(ctx, []Worker{newLocalWorker(time.Second), failed}, nil)
+	if ce := (*CommitError)(nil); !errors.As(err, &ce) || ce.Err != errCommitCanceled {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+// cancelCommitWorker is a localWorker which cancels the parent context of transaction and fails
+// on commit.
+type cancelCommitWorker struct {
+	*localWorker
+	cancel context.CancelFunc
+}
+
+var errCommitCanceled = errors.New("commit canceled")
+
+func (w *cancelCommitWorker) Commit(ctx context.Context, wb WriteBatch) error {
+	w.cancel()
+	return errCommitCanceled
+}
+
+// rollbackCtxWorker is a localWorker which records the context error on rollback.
+type rollbackCtxWorker struct {
+	*localWorker
+	rollbackErr chan error
+}
+
+func (w *rollbackCtxWorker) Rollback(ctx context.Context, wb WriteBatch) error {
+	w.rollbackErr <- ctx.Err()
+	return w.localWorker.Rollback(ctx, wb)
+}
+
+type CallCollector struct {
+	l         sync.Mutex
+	callOrder []string
+}
+
+func (c *CallCollector) Append(call string) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	c.callOrder = append(c.callOrder, call)
+}
+
+func (c *CallCollector) Get() []string {
+	c.l.Lock()
+	defer c.l.Unlock()
+	return c.callOrder[:]
+}
+
+func (c *CallCollector) Reset() {
+	c.l.Lock()
+	defer c.l.Unlock()
+	c.callOrder = c.callOrder[:0]
+}
+
+// priorityWorker is a localWorker with commit priority, it collects the commit and rollback
+// calls, and waits in prepare until all the workers are preparing.
+type priorityWorker struct {
+	*localWorker
+	name      string
+	priority  int
+	calls     *CallCollector
+	preparing *sync.WaitGroup
+	failed    bool
+}
+
+func (w *priorityWorker) CommitPriority() int {
+	return w.priority
+}
+
+func (w *priorityWorker) Prepare(ctx context.Context, wb WriteBatch) error {
+	w.preparing.Done()
+	w.preparing.Wait()
+
+	if w.failed {
+		return errors.New("prepare failed")
+	}
+
+	return w.localWorker.Prepare(ctx, wb)
+}
+
+func (w *priorityWorker) Commit(ctx context.Context, wb WriteBatch) error {
+	w.calls.Append("commit " + w.name)
+	return w.localWorker.Commit(ctx, wb)
+}
+
+func (w *priorityWorker) Rollback(ctx context.Context, wb WriteBatch) error {
+	w.calls.Append("rollback " + w.name)
+	return w.localWorker.Rollback(ctx, wb)
+}
+
+func TestCoordinator_OrderedWorker(t *testing.T) {
+	c := NewCoordinator(NewOptions(5 * time.Second))
+	calls := &CallCollector{}
+	newWorkers := func() []*priorityWorker {
+		preparing := &sync.WaitGroup{}
+		workers := []*priorityWorker{
+			{name: "low", priority: -1},
+			{name: "default0"},
+			{name: "high", priority: 10},
+			{name: "mid", priority: 5},
+			{name: "default1"},
+		}
+		for _, w := range workers {
+			w.localWorker = newLocalWorker(time.Second)
+			w.calls = calls
+			w.preparing = preparing
+		}
+		preparing.Add(len(workers))
+		return workers
+	}
+	toWorkers := func(pws []*priorityWorker) (workers []Worker) {
+		for i, w := range pws {
+			// default priority workers do not implement OrderedWorker
+			if w.priority == 0 {
+				workers = append(workers, &struct{ Worker }{pws[i]})
+			} else {
+				workers = append(workers, pws[i])
+			}
+		}
+		return
+	}
+
+	// prepare is concurrent, otherwise the workers wait for each other forever
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.Put(toWorkers(newWorkers()), nil)
+	}()
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Prepare should be concurrent")
+	}
+
+	expected := []string{
+		"commit high", "commit mid", "commit default0", "commit default1", "commit low",
+	}
+
+	if !reflect.DeepEqual(calls.Get(), expected) {
+		t.Fatalf("Unexpected commit order: %v", calls.Get())
+	}
+
+	// rollback is ordered too
+	calls.Reset()
+	workers := newWorkers()
+	workers[1].failed = true
+
+	if err := c.Put(toWorkers(workers), nil); err == nil {
+		t.Fatal("Unexpected result: returned nil while expecting an error")
+	}
+
+	// the failed worker is not rolled back
+	expected = []string{
+		"rollback high", "rollback mid", "rollback default1", "rollback low",
+	}
+
+	if !reflect.DeepEqual(calls.Get(), expected) {
+		t.Fatalf("Unexpected rollback order: %v", calls.Get())
+	}
+}
+
+// pingWorker is a localWorker supporting health probe, it counts the prepare calls.
+type pingWorker struct {
+	*localWorker
+	dead     bool
+	pings    int32
+	prepares int32
+}
+
+func (w *pingWorker) Ping(ctx context.Context) error {
+	atomic.AddInt32(&w.pings, 1)
+
+	if w.dead {
+		return errors.New("worker is down")
+	}
+
+	return nil
+}
+
+func (w *pingWorker) Prepare(ctx context.Context, wb WriteBatch) error {
+	atomic.AddInt32(&w.prepares, 1)
+	return w.localWorker.Prepare(ctx, wb)
+}
+
+func TestCoordinator_PreflightCheck(t *testing.T) {
+	opt := NewOptions(5 * time.Second)
+	opt.PreflightCheck = true
+	c := NewCoordinator(opt)
+
+	healthy := []*pingWorker{
+		{localWorker: newLocalWorker(time.Second)},
+		{localWorker: newLocalWorker(time.Second)},
+	}
+	dead := &pingWorker{localWorker: newLocalWorker(time.Second), dead: true}
+	// workers without Ping are assumed healthy
+	workers := []Worker{healthy[0], healthy[1], dead, newLocalWorker(time.Second)}
+
+	if err := c.Put(workers, nil); err == nil {
+		t.Fatal("Unexpected result: returned nil while expecting an error")
+	} else {
+		t.Logf("Error occurred as expected: %s", err.Error())
+	}
+
+	for _, w := range append(healthy, dead) {
+		if atomic.LoadInt32(&w.pings) != 1 {
+			t.Fatalf("Unexpected ping count: %d", w.pings)
+		}
+		if atomic.LoadInt32(&w.prepares) != 0 {
+			t.Fatalf("Unexpected prepare count: %d", w.prepares)
+		}
+		if state := w.getState(); state != Initailized {
+			t.Fatalf("Unexpected worker state after preflight abort: %v", state)
+		}
+	}
+
+	// all healthy
+	dead.dead = false
+
+	if err := c.Put(workers, nil); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	for _, w := range append(healthy, dead) {
+		if state := w.getState(); state != Committed {
+			t.Fatalf("Unexpected worker state after put: %v", state)
+		}
+	}
+}
+
+// failWorker is a localWorker failing in phase.
+type failWorker struct {
+	*localWorker
+	phase string
+	err   error
+}
+
+func (w *failWorker) Prepare(ctx context.Context, wb WriteBatch) error {
+	if w.phase == PhasePrepare {
+		return w.err
+	}
+
+	return w.localWorker.Prepare(ctx, wb)
+}
+
+func (w *failWorker) PreCommit(ctx context.Context, wb WriteBatch) error {
+	if w.phase == PhasePreCommit {
+		return w.err
+	}
+
+	return w.localWorker.PreCommit(ctx, wb)
+}
+
+func (w *failWorker) Commit(ctx context.Context, wb WriteBatch) error {
+	if w.phase == PhaseCommit {
+		return w.err
+	}
+
+	return w.localWorker.Commit(ctx, wb)
+}
+
+func (w *failWorker) Rollback(ctx context.Context, wb WriteBatch) error {
+	if w.phase == PhaseRollback {
+		return w.err
+	}
+
+	return w.localWorker.Rollback(ctx, wb)
+}
+
+func TestCoordinator_TypedErrors(t *testing.T) {
+	workerErr := errors.New("worker error")
+	newWorkers := func(phase string) (workers []Worker, failed Worker) {
+		failed = &failWorker{localWorker: newLocalWorker(time.Second), phase: phase, err: workerErr}
+		workers = []Worker{newLocalWorker(time.Second), failed, newLocalWorker(time.Second)}
+		return
+	}
+	checkWorker := func(err error, index int, worker Worker, errIndex int, errWorker Worker) {
+		if !errors.Is(err, workerErr) {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		if errIndex != index || errWorker != worker {
+			t.Fatalf("Unexpected failed worker: %d (%v)", errIndex, errWorker)
+		}
+
+		t.Logf("Error occurred as expected: %s", err.Error())
+	}
+
+	c := NewCoordinator(NewOptions(5 * time.Second))
+
+	// prepare
+	workers, failed := newWorkers(PhasePrepare)
+	err := c.Put(workers, nil)
+	pe := (*PrepareError)(nil)
+
+	if !errors.As(err, &pe) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	checkWorker(err, 1, failed, pe.Index, pe.Worker)
+
+	// commit
+	workers, failed = newWorkers(PhaseCommit)
+	err = c.Put(workers, nil)
+	ce := (*CommitError)(nil)
+
+	if !errors.As(err, &ce) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	checkWorker(err, 1, failed, ce.Index, ce.Worker)
+
+	// rollback
+	workers, failed = newWorkers(PhaseRollback)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err = c.rollback(ctx, newTxState(workers, cancel), workers, nil, nil)
+	re := (*RollbackError)(nil)
+
+	if !errors.As(err, &re) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	checkWorker(err, 1, failed, re.Index, re.Worker)
+
+	// pre-commit
+	opt := NewOptions(5 * time.Second)
+	opt.Protocol = ThreePhaseCommit
+	c = NewCoordinator(opt)
+	workers, failed = newWorkers(PhasePreCommit)
+	err = c.Put(workers, nil)
+	pce := (*PreCommitError)(nil)
+
+	if !errors.As(err, &pce) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	checkWorker(err, 1, failed, pce.Index, pce.Worker)
+
+	// errors of other phases are not matched
+	if errors.As(err, &pe) || errors.As(err, &ce) || errors.As(err, &re) {
+		t.Fatalf("Unexpected error type: %T", err)
+	}
+}
+
+func TestCoordinator_MultiError(t *testing.T) {
+	c := NewCoordinator(NewOptions(5 * time.Second))
+	errs := []error{errors.New("disk full"), errors.New("timeout")}
+	workers := []Worker{
+		&failWorker{localWorker: newLocalWorker(time.Second), phase: PhasePrepare, err: errs[0]},
+		newLocalWorker(time.Second),
+		&failWorker{localWorker: newLocalWorker(time.Second), phase: PhasePrepare, err: errs[1]},
+	}
+
+	err := c.Put(workers, nil)
+	me := MultiError(nil)
+
+	if !errors.As(err, &me) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	t.Logf("Error occurred as expected: %s", err.Error())
+
+	if len(me) != 2 {
+		t.Fatalf("Unexpected error count: %d", len(me))
+	}
+
+	for i, index := range []int{0, 2} {
+		pe := (*PrepareError)(nil)
+
+		if !errors.As(me[i], &pe) || pe.Index != index || pe.Worker != workers[index] {
+			t.Fatalf("Unexpected worker error: %v", me[i])
+		}
+
+		if !errors.Is(err, errs[i]) || !errors.Is(me[i], errs[i]) {
+			t.Fatalf("Worker error is not matched: %v", errs[i])
+		}
+	}
+
+	// matched by the methods of MultiError without unwrapping a slice of errors
+	if pe := (*PrepareError)(nil); !me.As(&pe) || pe.Index != 0 {
+		t.Fatalf("Unexpected worker error: %v", pe)
+	}
+
+	if !me.Is(errs[1]) || me.Is(errors.New("disk full")) {
+		t.Fatalf("Unexpected match of worker errors: %v", err)
+	}
+
+	// only the prepared worker is rolled back
+	for i, expected := range []RaftTxState{Initailized, RolledBack, Initailized} {
+		if state := workers[i].(interface{ getState() RaftTxState }).getState(); state != expected {
+			t.Fatalf("Unexpected worker state: %v", state)
+		}
+	}
+
+	// single failure is not aggregated
+	workers[2] = newLocalWorker(time.Second)
+	err = c.Put(workers, nil)
+
+	if errors.As(err, &me) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if pe := (*PrepareError)(nil); !errors.As(err, &pe) || pe.Index != 0 {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+// idWorker is a failWorker with stable identifier, it sleeps randomly before returning to shuffle
+// the completion order of the workers.
+type idWorker struct {
+	*failWorker
+	id string
+}
+
+func (w *idWorker) WorkerID() string {
+	return w.id
+}
+
+func (w *idWorker) sleep() {
+	time.Sleep(time.Duration(rand.Intn(5)) * time.Millisecond)
+}
+
+func (w *idWorker) Prepare(ctx context.Context, wb WriteBatch) error {
+	w.sleep()
+	return w.failWorker.Prepare(ctx, wb)
+}
+
+func (w *idWorker) Rollback(ctx context.Context, wb WriteBatch) error {
+	w.sleep()
+	return w.failWorker.Rollback(ctx, wb)
+}
+
+func TestCoordinator_StableOrder(t *testing.T) {
+	c := NewCoordinator(NewOptions(5 * time.Second))
+	newWorkers := func(phase string) []Worker {
+		newFailWorker := func(id string) Worker {
+			return &idWorker{
+				failWorker: &failWorker{
+					localWorker: newLocalWorker(time.Second),
+					phase:       phase,
+					err:         errors.New(id + " failed"),
+				},
+				id: id,
+			}
+		}
+
+		return []Worker{
+			newFailWorker("c"),
+			&failWorker{
+				localWorker: newLocalWorker(time.Second),
+				phase:       phase,
+				err:         errors.New("anonymous failed"),
+			},
+			newFailWorker("a"),
+			newFailWorker("b"),
+		}
+	}
+
+	expected := "twopc: 4 workers failed: " +
+		"twopc: prepare failed on worker 1 (1): anonymous failed; " +
+		"twopc: prepare failed on worker 2 (a): a failed; " +
+		"twopc: prepare failed on worker 3 (b): b failed; " +
+		"twopc: prepare failed on worker 0 (c): c failed"
+
+	for i := 0; i < 20; i++ {
+		if err := c.Put(newWorkers(PhasePrepare), nil); err == nil || err.Error() != expected {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	expected = "twopc: 4 workers failed: " +
+		"twopc: rollback failed on worker 1 (1): anonymous failed; " +
+		"twopc: rollback failed on worker 2 (a): a failed; " +
+		"twopc: rollback failed on worker 3 (b): b failed; " +
+		"twopc: rollback failed on worker 0 (c): c failed"
+
+	for i := 0; i < 20; i++ {
+		workers := newWorkers(PhaseRollback)
+		ctx, cancel := context.WithCancel(context.Background())
+		err := c.rollback(ctx, newTxState(workers, cancel), workers, nil, nil)
+		cancel()
+
+		if err == nil || err.Error() != expected {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+}
+
+type ctxKey string
+
+// ctxWorker is a localWorker collecting the context values observed in each phase.
+type ctxWorker struct {
+	*localWorker
+	calls *CallCollector
+	fail  bool
+}
+
+func (w *ctxWorker) observe(ctx context.Context, phase string) {
+	w.calls.Append(fmt.Sprintf("%s %v %v", phase, ctx.Value(ctxKey("tenant")), ctx.Value(ctxKey("span"))))
+}
+
+func (w *ctxWorker) Prepare(ctx context.Context, wb WriteBatch) error {
+	w.observe(ctx, PhasePrepare)
+
+	if w.fail {
+		return errors.New("prepare failed")
+	}
+
+	return w.localWorker.Prepare(ctx, wb)
+}
+
+func (w *ctxWorker) Commit(ctx context.Context, wb WriteBatch) error {
+	w.observe(ctx, PhaseCommit)
+	return w.localWorker.Commit(ctx, wb)
+}
+
+func (w *ctxWorker) Rollback(ctx context.Context, wb WriteBatch) error {
+	w.observe(ctx, PhaseRollback)
+	return w.localWorker.Rollback(ctx, wb)
+}
+
+func TestCoordinator_ContextValues(t *testing.T) {
+	calls := &CallCollector{}
+	hook := func(phase string) ContextHook {
+		return func(ctx context.Context) (context.Context, error) {
+			calls.Append(fmt.Sprintf("before %s %v %v", phase, ctx.Value(ctxKey("tenant")), ctx.Value(ctxKey("span"))))
+
+			if phase == PhasePrepare {
+				return context.WithValue(ctx, ctxKey("span"), "span-1"), nil
+			}
+
+			// keep the context
+			return nil, nil
+		}
+	}
+	c := NewCoordinator(NewOptionsWithContextCallback(
+		5*time.Second, hook(PhasePrepare), hook(PhaseCommit), hook(PhaseRollback)))
+	parent := context.WithValue(context.Background(), ctxKey("tenant"), "tenant-1")
+
+	// commit
+	workers := []Worker{&ctxWorker{localWorker: newLocalWorker(time.Second), calls: calls}}
+
+	if err := c.PutContext(parent, workers, nil); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	expected := []string{
+		"before prepare tenant-1 <nil>",
+		"prepare tenant-1 span-1",
+		"before commit tenant-1 span-1",
+		"commit tenant-1 span-1",
+	}
+
+	if !reflect.DeepEqual(calls.Get(), expected) {
+		t.Fatalf("Unexpected calls: %v", calls.Get())
+	}
+
+	// rollback
+	calls.Reset()
+	workers = []Worker{
+		&ctxWorker{localWorker: newLocalWorker(time.Second), calls: calls},
+		&ctxWorker{localWorker: newLocalWorker(time.Second), calls: calls, fail: true},
+	}
+
+	if err := c.PutContext(parent, workers, nil); err == nil {
+		t.Fatal("Unexpected result: returned nil while expecting an error")
+	}
+
+	expected = []string{
+		"before prepare tenant-1 <nil>",
+		"prepare tenant-1 span-1",
+		"prepare tenant-1 span-1",
+		"before rollback tenant-1 span-1",
+		"rollback tenant-1 span-1",
+	}
+
+	if !reflect.DeepEqual(calls.Get(), expected) {
+		t.Fatalf("Unexpected calls: %v", calls.Get())
+	}
+
+	// hook error
+	c = NewCoordinator(NewOptionsWithContextCallback(5*time.Second,
+		func(ctx context.Context) (context.Context, error) {
+			return nil, errors.New("hook failed")
+		}, nil, nil))
+	err := c.PutContext(parent, []Worker{newLocalWorker(time.Second)}, nil)
+
+	if he := (*HookError)(nil); !errors.As(err, &he) || he.Phase != PhasePrepare {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestCoordinator_PutDetailed(t *testing.T) {
+	c := NewCoordinator(NewOptions(5 * time.Second))
+	workerErr := errors.New("worker error")
+	newFailWorker := func(phase string) Worker {
+		return &failWorker{localWorker: newLocalWorker(time.Second), phase: phase, err: workerErr}
+	}
+	check := func(actual WorkerResult, expected WorkerResult) {
+		actual.Worker, expected.Worker = nil, nil
+
+		if !reflect.DeepEqual(actual, expected) {
+			t.Fatalf("Unexpected worker result: %+v, expected %+v", actual, expected)
+		}
+	}
+
+	// commit decision is made, worker 1 lags behind
+	workers := []Worker{newLocalWorker(time.Second), newFailWorker(PhaseCommit), newLocalWorker(time.Second)}
+	res, err := c.PutDetailed(context.Background(), workers, nil)
+
+	if ce := (*CommitError)(nil); !errors.As(err, &ce) || ce.Index != 1 {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if !res.Committed || len(res.Workers) != len(workers) {
+		t.Fatalf("Unexpected result: %+v", res)
+	}
+
+	check(res.Workers[0], WorkerResult{Index: 0, ID: "0", Prepared: true, Committed: true})
+	check(res.Workers[1], WorkerResult{Index: 1, ID: "1", Prepared: true,
+		Errs: map[string]error{PhaseCommit: workerErr}})
+	check(res.Workers[2], WorkerResult{Index: 2, ID: "2", Prepared: true, Committed: true})
+
+	if res.Workers[1].Worker != workers[1] {
+		t.Fatalf("Unexpected worker: %v", res.Workers[1].Worker)
+	}
+
+	// rolled back, worker 2 fails to roll back
+	workers = []Worker{newLocalWorker(time.Second), newFailWorker(PhasePrepare), newFailWorker(PhaseRollback)}
+	res, err = c.PutDetailed(context.Background(), workers, nil)
+
+	if pe := (*PrepareError)(nil); !errors.As(err, &pe) || pe.Index != 1 {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if res.Committed {
+		t.Fatalf("Unexpected result: %+v", res)
+	}
+
+	check(res.Workers[0], WorkerResult{Index: 0, ID: "0", Prepared: true, RolledBack: true})
+	check(res.Workers[1], WorkerResult{Index: 1, ID: "1",
+		Errs: map[string]error{PhasePrepare: workerErr}})
+	check(res.Workers[2], WorkerResult{Index: 2, ID: "2", Prepared: true,
+		Errs: map[string]error{PhaseRollback: workerErr}})
+
+	// rejected before prepare
+	opt := NewOptions(5 * time.Second)
+	opt.Protocol = ThreePhaseCommit
+	c = NewCoordinator(opt)
+	res, err = c.PutDetailed(context.Background(), []Worker{&struct{ Worker }{newLocalWorker(time.Second)}}, nil)
+
+	if err == nil {
+		t.Fatal("Unexpected result: returned nil while expecting an error")
+	}
+
+	check(res.Workers[0], WorkerResult{Index: 0, ID: "0"})
+}
+
+func TestCoordinator_Clock(t *testing.T) {
+	clock := utils.NewFakeClock(time.Now())
+	opt := NewOptions(time.Hour)
+	opt.Clock = clock
+	c := NewCoordinator(opt)
+	blocked := newLocalWorker(time.Second)
+	blocked.blockPrepare = true
+	workers := []Worker{newLocalWorker(time.Second), blocked}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.Put(workers, nil)
+	}()
+
+	// wait for the transaction timer
+	for clock.Waiters() == 0 {
+		runtime.Gosched()
+	}
+
+	select {
+	case err := <-errCh:
+		t.Fatalf("Unexpected result: %v", err)
+	default:
+	}
+
+	clock.Advance(time.Hour)
+
+	if err := <-errCh; !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for i, expected := range []RaftTxState{RolledBack, Initailized} {
+		if state := workers[i].(*localWorker).getState(); state != expected {
+			t.Fatalf("Unexpected worker state: %v", state)
+		}
+	}
+}
+
+// strictWorker is a localWorker preparing after latency unless canceled, it fails to roll back
+// if it's not prepared.
+type strictWorker struct {
+	*localWorker
+	latency time.Duration
+}
+
+func (w *strictWorker) Prepare(ctx context.Context, wb WriteBatch) error {
+	select {
+	case <-time.After(w.latency):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	return w.localWorker.Prepare(ctx, wb)
+}
+
+func (w *strictWorker) Rollback(ctx context.Context, wb WriteBatch) error {
+	if state := w.getState(); state != Prepared {
+		return fmt.Errorf("invalid state: %v", state)
+	}
+
+	return w.localWorker.Rollback(ctx, wb)
+}
+
+func TestCoordinator_CancelStaggeredPrepare(t *testing.T) {
+	c := NewCoordinator(NewOptions(5 * time.Second))
+	workers := make([]Worker, 6)
+
+	for i := range workers {
+		workers[i] = &strictWorker{
+			localWorker: newLocalWorker(time.Second),
+			latency:     time.Duration(i) * 40 * time.Millisecond,
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	res, err := c.PutDetailed(ctx, workers, nil)
+
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	prepared := 0
+
+	for i, w := range res.Workers {
+		if w.Errs[PhaseRollback] != nil {
+			t.Fatalf("Unexpected rollback error of worker %d: %v", i, w.Errs[PhaseRollback])
+		}
+
+		state := workers[i].(*strictWorker).getState()
+
+		switch {
+		case w.Prepared && state == RolledBack && w.RolledBack:
+			prepared++
+		case !w.Prepared && state == Initailized && !w.RolledBack:
+		default:
+			t.Fatalf("Inconsistent worker %d: state = %v, result = %+v", i, state, w)
+		}
+	}
+
+	if prepared == 0 || prepared == len(workers) {
+		t.Fatalf("Unexpected prepared worker count: %d", prepared)
+	}
+}
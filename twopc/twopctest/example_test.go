@@ -0,0 +1,68 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package twopctest_test
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/thunderdb/ThunderDB/twopc"
+	"github.com/thunderdb/ThunderDB/twopc/twopctest"
+)
+
+func ExampleMockWorker_prepareFailure() {
+	w1 := twopctest.NewMockWorker("w1", nil)
+	w2 := twopctest.NewMockWorker("w2", nil)
+	c := twopc.NewCoordinator(twopc.NewOptions(time.Second))
+
+	// w2 refuses to prepare, so the transaction is rolled back
+	w2.FailOn(twopc.PhasePrepare, errors.New("disk full"))
+	err := c.Put([]twopc.Worker{w1, w2}, "wb")
+
+	var prepareErr *twopc.PrepareError
+	if errors.As(err, &prepareErr) {
+		fmt.Println("prepare failed on", prepareErr.Worker.(*twopctest.MockWorker).Name())
+	}
+
+	fmt.Println("w1:", w1.Phases())
+	// Output:
+	// prepare failed on w2
+	// w1: [prepare rollback]
+}
+
+func ExampleMockWorker_commitFailure() {
+	w1 := twopctest.NewMockWorker("w1", nil)
+	w2 := twopctest.NewMockWorker("w2", nil)
+	c := twopc.NewCoordinator(twopc.NewOptions(time.Second))
+
+	// w2 fails after the commit decision is made, the other workers are committed anyway
+	w2.FailOn(twopc.PhaseCommit, errors.New("connection lost"))
+	err := c.Put([]twopc.Worker{w1, w2}, "wb")
+
+	var commitErr *twopc.CommitError
+	if errors.As(err, &commitErr) {
+		fmt.Println("commit failed on", commitErr.Worker.(*twopctest.MockWorker).Name())
+	}
+
+	fmt.Println("w1:", w1.Phases())
+	fmt.Println("w2:", w2.Phases())
+	// Output:
+	// commit failed on w2
+	// w1: [prepare commit]
+	// w2: [prepare commit]
+}
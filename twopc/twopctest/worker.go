@@ -0,0 +1,191 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package twopctest
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/thunderdb/ThunderDB/twopc"
+)
+
+// PhasePing is the phase of the health probe, see MockWorker.Ping.
+const PhasePing = "ping"
+
+// Call is a recorded call of a MockWorker.
+type Call struct {
+	Worker     string
+	Phase      string
+	WriteBatch twopc.WriteBatch
+}
+
+// CallRecorder records the calls in order, it can be shared by the workers of a transaction to
+// check the order of the calls across workers.
+type CallRecorder struct {
+	mu    sync.Mutex // Protects following fields
+	calls []Call
+}
+
+// Record appends the call.
+func (r *CallRecorder) Record(call Call) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.calls = append(r.calls, call)
+}
+
+// Calls returns a copy of the recorded calls in order.
+func (r *CallRecorder) Calls() []Call {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]Call(nil), r.calls...)
+}
+
+// Phases returns the phases of the recorded calls in order.
+func (r *CallRecorder) Phases() (phases []string) {
+	for _, call := range r.Calls() {
+		phases = append(phases, call.Phase)
+	}
+
+	return
+}
+
+// Reset clears the recorded calls.
+func (r *CallRecorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.calls = nil
+}
+
+// MockWorker is a twopc.ThreePCWorker and twopc.HealthyWorker which records its calls and returns
+// the injected errors after the injected latency. The latency is cut short if the context is
+// done, and the context error is returned instead.
+type MockWorker struct {
+	name     string
+	calls    CallRecorder
+	recorder *CallRecorder
+
+	mu      sync.Mutex // Protects following fields
+	errs    map[string]error
+	latency map[string]time.Duration
+}
+
+// NewMockWorker returns a new MockWorker named name, the calls are also recorded by recorder if
+// it's not nil.
+func NewMockWorker(name string, recorder *CallRecorder) *MockWorker {
+	return &MockWorker{
+		name:     name,
+		recorder: recorder,
+		errs:     make(map[string]error),
+		latency:  make(map[string]time.Duration),
+	}
+}
+
+// Name returns the name of the worker.
+func (w *MockWorker) Name() string {
+	return w.name
+}
+
+// FailOn makes the calls of phase return err, a nil err clears the failure.
+func (w *MockWorker) FailOn(phase string, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err == nil {
+		delete(w.errs, phase)
+		return
+	}
+
+	w.errs[phase] = err
+}
+
+// SetLatency delays the calls of phase by d.
+func (w *MockWorker) SetLatency(phase string, d time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.latency[phase] = d
+}
+
+// Calls returns the calls of the worker in order.
+func (w *MockWorker) Calls() []Call {
+	return w.calls.Calls()
+}
+
+// Phases returns the phases of the calls of the worker in order.
+func (w *MockWorker) Phases() []string {
+	return w.calls.Phases()
+}
+
+// Reset clears the recorded calls of the worker, the failures and latencies are kept.
+func (w *MockWorker) Reset() {
+	w.calls.Reset()
+}
+
+// Prepare implements twopc.Worker.Prepare.
+func (w *MockWorker) Prepare(ctx context.Context, wb twopc.WriteBatch) error {
+	return w.call(ctx, twopc.PhasePrepare, wb)
+}
+
+// PreCommit implements twopc.ThreePCWorker.PreCommit.
+func (w *MockWorker) PreCommit(ctx context.Context, wb twopc.WriteBatch) error {
+	return w.call(ctx, twopc.PhasePreCommit, wb)
+}
+
+// Commit implements twopc.Worker.Commit.
+func (w *MockWorker) Commit(ctx context.Context, wb twopc.WriteBatch) error {
+	return w.call(ctx, twopc.PhaseCommit, wb)
+}
+
+// Rollback implements twopc.Worker.Rollback.
+func (w *MockWorker) Rollback(ctx context.Context, wb twopc.WriteBatch) error {
+	return w.call(ctx, twopc.PhaseRollback, wb)
+}
+
+// Ping implements twopc.HealthyWorker.Ping.
+func (w *MockWorker) Ping(ctx context.Context) error {
+	return w.call(ctx, PhasePing, nil)
+}
+
+func (w *MockWorker) call(ctx context.Context, phase string, wb twopc.WriteBatch) error {
+	call := Call{Worker: w.name, Phase: phase, WriteBatch: wb}
+	w.calls.Record(call)
+
+	if w.recorder != nil {
+		w.recorder.Record(call)
+	}
+
+	w.mu.Lock()
+	err, latency := w.errs[phase], w.latency[phase]
+	w.mu.Unlock()
+
+	if latency > 0 {
+		timer := time.NewTimer(latency)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,169 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package twopctest
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/thunderdb/ThunderDB/twopc"
+)
+
+var (
+	_ twopc.ThreePCWorker = &MockWorker{}
+	_ twopc.HealthyWorker = &MockWorker{}
+)
+
+func TestMockWorker(t *testing.T) {
+	recorder := &CallRecorder{}
+	w := NewMockWorker("w1", recorder)
+	ctx := context.Background()
+	errPrepare := errors.New("prepare failed")
+
+	// failure injection
+	w.FailOn(twopc.PhasePrepare, errPrepare)
+
+	if err := w.Prepare(ctx, "wb"); err != errPrepare {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if err := w.Rollback(ctx, "wb"); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	w.FailOn(twopc.PhasePrepare, nil)
+
+	if err := w.Prepare(ctx, "wb"); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	// call recording
+	expected := []Call{
+		{Worker: "w1", Phase: twopc.PhasePrepare, WriteBatch: "wb"},
+		{Worker: "w1", Phase: twopc.PhaseRollback, WriteBatch: "wb"},
+		{Worker: "w1", Phase: twopc.PhasePrepare, WriteBatch: "wb"},
+	}
+
+	if calls := w.Calls(); !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("Unexpected calls: %v", calls)
+	}
+
+	if calls := recorder.Calls(); !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("Unexpected recorded calls: %v", calls)
+	}
+
+	w.Reset()
+
+	if calls := w.Calls(); len(calls) != 0 {
+		t.Fatalf("Unexpected calls after reset: %v", calls)
+	}
+
+	if calls := recorder.Calls(); len(calls) != len(expected) {
+		t.Fatalf("Shared recorder should not be reset: %v", calls)
+	}
+
+	// artificial latency
+	w.SetLatency(twopc.PhaseCommit, 50*time.Millisecond)
+	start := time.Now()
+
+	if err := w.Commit(ctx, "wb"); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("Commit returned too early: %v", elapsed)
+	}
+
+	// latency is cut short by context
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+
+	if err := w.Commit(timeoutCtx, "wb"); err != context.DeadlineExceeded {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestMockWorker_Coordinator(t *testing.T) {
+	recorder := &CallRecorder{}
+	w1, w2 := NewMockWorker("w1", recorder), NewMockWorker("w2", recorder)
+	workers := []twopc.Worker{w1, w2}
+	c := twopc.NewCoordinator(twopc.NewOptions(time.Second))
+
+	// success
+	if err := c.Put(workers, "wb"); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	for _, w := range []*MockWorker{w1, w2} {
+		if phases := w.Phases(); !reflect.DeepEqual(phases,
+			[]string{twopc.PhasePrepare, twopc.PhaseCommit}) {
+			t.Fatalf("Unexpected phases of %s: %v", w.Name(), phases)
+		}
+
+		w.Reset()
+	}
+
+	// prepare failure rolls back the workers
+	errPrepare := errors.New("prepare failed")
+	w2.FailOn(twopc.PhasePrepare, errPrepare)
+
+	err := c.Put(workers, "wb")
+	var prepareErr *twopc.PrepareError
+
+	if !errors.As(err, &prepareErr) || prepareErr.Worker != w2 || !errors.Is(err, errPrepare) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if phases := w1.Phases(); !reflect.DeepEqual(phases,
+		[]string{twopc.PhasePrepare, twopc.PhaseRollback}) {
+		t.Fatalf("Unexpected phases of w1: %v", phases)
+	}
+
+	w2.FailOn(twopc.PhasePrepare, nil)
+
+	// prepare timeout
+	w1.Reset()
+	w2.Reset()
+	recorder.Reset()
+	w1.SetLatency(twopc.PhasePrepare, time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err = c.PutContext(ctx, workers, "wb"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for _, call := range recorder.Calls() {
+		if call.Phase == twopc.PhaseCommit {
+			t.Fatalf("Unexpected commit after timeout: %v", call)
+		}
+	}
+
+	// w1 is canceled before prepared, so only w2 is rolled back
+	if phases := w1.Phases(); !reflect.DeepEqual(phases, []string{twopc.PhasePrepare}) {
+		t.Fatalf("Unexpected phases of w1: %v", phases)
+	}
+
+	if phases := w2.Phases(); !reflect.DeepEqual(phases,
+		[]string{twopc.PhasePrepare, twopc.PhaseRollback}) {
+		t.Fatalf("Unexpected phases of w2: %v", phases)
+	}
+}
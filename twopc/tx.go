@@ -0,0 +1,269 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package twopc
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// TxID identifies a transaction initiated by Coordinator.Put.
+type TxID uint64
+
+// Phases of a transaction.
+const (
+	PhasePrepare   = "prepare"
+	PhasePreCommit = "precommit"
+	PhaseCommit    = "commit"
+	PhaseRollback  = "rollback"
+)
+
+var (
+	// ErrTxNotFound indicates the transaction is not in flight.
+	ErrTxNotFound = errors.New("twopc: transaction not found")
+
+	// ErrTxCanceled indicates the transaction is canceled by Coordinator.Cancel.
+	ErrTxCanceled = errors.New("twopc: transaction canceled")
+
+	// ErrTxCommitting indicates the transaction can not be canceled since it has entered the
+	// pre-commit or commit phase.
+	ErrTxCommitting = errors.New("twopc: transaction is committing")
+)
+
+// WorkerStatus represents the progress of a worker in a transaction.
+type WorkerStatus struct {
+	Worker Worker
+	// Phase is the last phase issued to the worker, empty if none is issued yet.
+	Phase string
+	// Done indicates whether the worker has returned from Phase.
+	Done bool
+	// Err is the result of Phase.
+	Err error
+}
+
+// WorkerResult represents the outcome of a worker in a finished transaction, see
+// Coordinator.PutDetailed.
+type WorkerResult struct {
+	// Index is the index of the worker in the workers passed to Coordinator.PutDetailed.
+	Index int
+	// ID is the stable identifier of the worker, see IdentifiedWorker.
+	ID     string
+	Worker Worker
+	// Prepared, PreCommitted, Committed and RolledBack indicate the phases the worker succeeded in.
+	Prepared     bool
+	PreCommitted bool
+	Committed    bool
+	RolledBack   bool
+	// Errs is the errors returned by the worker keyed by phase, nil if the worker never fails.
+	Errs map[string]error
+}
+
+// PutResult represents the outcome of a transaction, see Coordinator.PutDetailed.
+type PutResult struct {
+	// Committed indicates whether the commit decision is made, the workers not committed should be
+	// repaired in this case.
+	Committed bool
+	// Workers is the outcome of each worker in input order.
+	Workers []WorkerResult
+}
+
+type txState struct {
+	mu       sync.Mutex
+	phase    string
+	workers  []WorkerStatus
+	results  []WorkerResult
+	cancel   context.CancelFunc
+	canceled bool
+}
+
+func newTxState(workers []Worker, cancel context.CancelFunc) *txState {
+	tx := &txState{
+		phase:   PhasePrepare,
+		workers: make([]WorkerStatus, len(workers)),
+		results: make([]WorkerResult, len(workers)),
+		cancel:  cancel,
+	}
+
+	for i, worker := range workers {
+		tx.workers[i].Worker = worker
+		tx.results[i] = WorkerResult{Index: i, ID: workerID(i, worker), Worker: worker}
+	}
+
+	return tx
+}
+
+// enterPhase moves the transaction to phase, it fails if the transaction is canceled before
+// entering the commit phase.
+func (tx *txState) enterPhase(phase string) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.canceled && phase != PhaseRollback {
+		return ErrTxCanceled
+	}
+
+	tx.phase = phase
+	return nil
+}
+
+func (tx *txState) isCanceled() bool {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	return tx.canceled
+}
+
+func (tx *txState) workerStart(index int, phase string) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	tx.workers[index] = WorkerStatus{Worker: tx.workers[index].Worker, Phase: phase}
+}
+
+func (tx *txState) workerDone(index int, err error) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	tx.workers[index].Done = true
+	tx.workers[index].Err = err
+
+	r := &tx.results[index]
+	phase := tx.workers[index].Phase
+
+	if err != nil {
+		if r.Errs == nil {
+			r.Errs = make(map[string]error)
+		}
+		r.Errs[phase] = err
+		return
+	}
+
+	switch phase {
+	case PhasePrepare:
+		r.Prepared = true
+	case PhasePreCommit:
+		r.PreCommitted = true
+	case PhaseCommit:
+		r.Committed = true
+	case PhaseRollback:
+		r.RolledBack = true
+	}
+}
+
+func (tx *txState) result() *PutResult {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	res := &PutResult{
+		Committed: tx.phase == PhaseCommit,
+		Workers:   make([]WorkerResult, len(tx.results)),
+	}
+	copy(res.Workers, tx.results)
+	return res
+}
+
+func (tx *txState) status() (phase string, workers []WorkerStatus) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	workers = make([]WorkerStatus, len(tx.workers))
+	copy(workers, tx.workers)
+	return tx.phase, workers
+}
+
+func (tx *txState) doCancel() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	switch tx.phase {
+	case PhasePreCommit, PhaseCommit:
+		return ErrTxCommitting
+	case PhaseRollback:
+		return nil
+	}
+
+	tx.canceled = true
+	tx.cancel()
+	return nil
+}
+
+func (c *Coordinator) register(tx *txState) TxID {
+	c.txLock.Lock()
+	defer c.txLock.Unlock()
+
+	c.txSeq++
+
+	if c.txs == nil {
+		c.txs = make(map[TxID]*txState)
+	}
+
+	c.txs[TxID(c.txSeq)] = tx
+	return TxID(c.txSeq)
+}
+
+func (c *Coordinator) unregister(txID TxID) {
+	c.txLock.Lock()
+	defer c.txLock.Unlock()
+
+	delete(c.txs, txID)
+}
+
+func (c *Coordinator) lookup(txID TxID) (tx *txState, ok bool) {
+	c.txLock.Lock()
+	defer c.txLock.Unlock()
+
+	tx, ok = c.txs[txID]
+	return
+}
+
+// InFlight returns the IDs of the transactions not settled yet.
+func (c *Coordinator) InFlight() (txIDs []TxID) {
+	c.txLock.Lock()
+	defer c.txLock.Unlock()
+
+	for txID := range c.txs {
+		txIDs = append(txIDs, txID)
+	}
+
+	return
+}
+
+// Status returns the current phase and the worker progress of an in-flight transaction.
+func (c *Coordinator) Status(txID TxID) (phase string, workers []WorkerStatus, ok bool) {
+	tx, ok := c.lookup(txID)
+
+	if !ok {
+		return
+	}
+
+	phase, workers = tx.status()
+	return
+}
+
+// Cancel aborts an in-flight transaction, the pending prepare phase is interrupted by context
+// cancellation and all the workers are rolled back. A transaction which has entered the
+// pre-commit or commit phase can not be canceled.
+func (c *Coordinator) Cancel(txID TxID) error {
+	tx, ok := c.lookup(txID)
+
+	if !ok {
+		return ErrTxNotFound
+	}
+
+	return tx.doCancel()
+}
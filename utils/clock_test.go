@@ -0,0 +1,132 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utils
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	c := NewFakeClock(start)
+
+	t1 := c.NewTimer(time.Second)
+	t2 := c.NewTimer(2 * time.Second)
+	after := c.After(3 * time.Second)
+
+	if n := c.Waiters(); n != 3 {
+		t.Fatalf("Unexpected waiters: %d", n)
+	}
+
+	c.Advance(time.Second)
+
+	select {
+	case now := <-t1.C():
+		if !now.Equal(start.Add(time.Second)) {
+			t.Fatalf("Unexpected time: %v", now)
+		}
+	default:
+		t.Fatal("Timer should be fired")
+	}
+
+	select {
+	case <-t2.C():
+		t.Fatal("Timer should not be fired")
+	default:
+	}
+
+	if !t2.Stop() || t1.Stop() {
+		t.Fatal("Unexpected stop result")
+	}
+
+	c.Advance(2 * time.Second)
+
+	select {
+	case <-t2.C():
+		t.Fatal("Stopped timer should not be fired")
+	case <-after:
+	}
+
+	if now := c.Now(); !now.Equal(start.Add(3 * time.Second)) {
+		t.Fatalf("Unexpected time: %v", now)
+	}
+
+	// Timer without duration fires immediately
+	select {
+	case <-c.After(0):
+	default:
+		t.Fatal("Timer should be fired")
+	}
+}
+
+func TestWithClockTimeout(t *testing.T) {
+	c := NewFakeClock(time.Now())
+	ctx, cancel := WithClockTimeout(context.Background(), c, time.Hour)
+	defer cancel()
+
+	if deadline, ok := ctx.Deadline(); !ok || !deadline.Equal(c.Now().Add(time.Hour)) {
+		t.Fatalf("Unexpected deadline: %v", deadline)
+	}
+
+	c.Advance(time.Minute)
+
+	select {
+	case <-ctx.Done():
+		t.Fatal("Context should not be done")
+	default:
+	}
+
+	c.Advance(time.Hour)
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Context should be done")
+	}
+
+	if ctx.Err() != context.DeadlineExceeded {
+		t.Fatalf("Unexpected error: %v", ctx.Err())
+	}
+
+	// Derived context inherits the error
+	child, childCancel := context.WithCancel(ctx)
+	defer childCancel()
+
+	if child.Err() != context.DeadlineExceeded {
+		t.Fatalf("Unexpected error: %v", child.Err())
+	}
+
+	// Canceled before timeout
+	ctx, cancel = WithClockTimeout(context.Background(), c, time.Hour)
+	cancel()
+	c.Advance(time.Hour)
+
+	if ctx.Err() != context.Canceled {
+		t.Fatalf("Unexpected error: %v", ctx.Err())
+	}
+
+	// Real clock
+	ctx, cancel = WithClockTimeout(context.Background(), RealClock{}, time.Millisecond)
+	defer cancel()
+	<-ctx.Done()
+
+	if ctx.Err() != context.DeadlineExceeded {
+		t.Fatalf("Unexpected error: %v", ctx.Err())
+	}
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+)
+
+// WriteEnvelope writes the element list in a self-describing envelope with the following
+// format:
+//
+// 0         1       5       9                 9+len0
+// +---------+-------+-------+-----------------+-------+----------------+-----
+// | version | count | len0  |    element0     | len1  |    element1    | ...
+// +---------+-------+-------+-----------------+-------+----------------+-----
+//
+// Each element is encoded as WriteElements does and framed by its own length, so that a reader
+// of another version can skip or zero-fill the elements it doesn't know, see ReadEnvelope.
+func (s *Serializer) WriteEnvelope(
+	w io.Writer, order binary.ByteOrder, version uint8, elements ...interface{}) (err error) {
+	ctx := context.Background()
+
+	if err = s.writeUint8(ctx, w, version); err != nil {
+		return
+	}
+
+	if err = s.writeUint32(ctx, w, order, uint32(len(elements))); err != nil {
+		return
+	}
+
+	buffer := bytes.NewBuffer(nil)
+
+	for _, element := range elements {
+		buffer.Reset()
+
+		if err = s.writeElement(ctx, buffer, order, fixedLengthPrefix, element); err != nil {
+			return
+		}
+
+		if err = s.writeBytes(ctx, w, order, fixedLengthPrefix, buffer.Bytes()); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// ReadEnvelope reads an envelope written by WriteEnvelope and returns its version. The elements
+// are decoded in order. Trailing elements in the envelope but not in the element list, which are
+// usually written by a newer version, are skipped. Elements in the list but not in the envelope,
+// which are usually missing in an older version, are set to their zero values.
+func (s *Serializer) ReadEnvelope(
+	r io.Reader, order binary.ByteOrder, version *uint8, elements ...interface{}) (err error) {
+	if *version, err = s.readUint8(r); err != nil {
+		return
+	}
+
+	var count uint32
+
+	if count, err = s.readUint32(r, order); err != nil {
+		return
+	}
+
+	var buffer []byte
+
+	for i := uint32(0); i < count; i++ {
+		if err = s.readBytes(r, order, fixedLengthPrefix, &buffer); err != nil {
+			return
+		}
+
+		if i >= uint32(len(elements)) {
+			continue
+		}
+
+		reader := bytes.NewReader(buffer)
+
+		if err = s.readElement(reader, order, fixedLengthPrefix, elements[i]); err != nil {
+			return
+		}
+
+		if reader.Len() != 0 {
+			return ErrUnexpectedBufferLength
+		}
+	}
+
+	if int(count) < len(elements) {
+		zeroElements(elements[count:])
+	}
+
+	return
+}
+
+// WriteEnvelope writes the element list in a self-describing envelope with the default
+// Serializer.
+func WriteEnvelope(
+	w io.Writer, order binary.ByteOrder, version uint8, elements ...interface{}) (err error) {
+	return serializer.WriteEnvelope(w, order, version, elements...)
+}
+
+// ReadEnvelope reads an envelope written by WriteEnvelope with the default Serializer.
+func ReadEnvelope(
+	r io.Reader, order binary.ByteOrder, version *uint8, elements ...interface{}) (err error) {
+	return serializer.ReadEnvelope(r, order, version, elements...)
+}
@@ -0,0 +1,108 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/thunderdb/ThunderDB/crypto/hash"
+	"github.com/thunderdb/ThunderDB/proto"
+)
+
+type envelopeV1 struct {
+	NodeID proto.NodeID
+	Addr   string
+	Hash   hash.Hash
+}
+
+type envelopeV2 struct {
+	envelopeV1
+	Port  uint16
+	Extra []byte
+}
+
+func TestEnvelope(t *testing.T) {
+	v1 := &envelopeV1{
+		NodeID: proto.NodeID("00000bef611d346c0cbe1beaa76e7f0ed705a194fdf9ac3a248ec70e9c198bf9"),
+		Addr:   "127.0.0.1",
+	}
+	v1.Hash = hash.THashH([]byte(v1.Addr))
+	v2 := &envelopeV2{
+		envelopeV1: *v1,
+		Port:       4661,
+		Extra:      []byte("extra"),
+	}
+
+	// v2 writer, v1 reader
+	buffer := bytes.NewBuffer(nil)
+
+	if err := WriteEnvelope(buffer, binary.BigEndian, 2,
+		v2.NodeID, v2.Addr, v2.Hash, v2.Port, v2.Extra); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	var (
+		version uint8
+		r1      envelopeV1
+	)
+
+	if err := ReadEnvelope(buffer, binary.BigEndian, &version,
+		&r1.NodeID, &r1.Addr, &r1.Hash); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if version != 2 || r1 != *v1 {
+		t.Fatalf("Result not match: version=%d, r1=%+v", version, r1)
+	}
+
+	if buffer.Len() != 0 {
+		t.Fatalf("Unread trailing elements: %d bytes", buffer.Len())
+	}
+
+	// v1 writer, v2 reader
+	buffer.Reset()
+
+	if err := WriteEnvelope(buffer, binary.BigEndian, 1, v1.NodeID, v1.Addr, v1.Hash); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	r2 := envelopeV2{Port: 1, Extra: []byte("stale")}
+
+	if err := ReadEnvelope(buffer, binary.BigEndian, &version,
+		&r2.NodeID, &r2.Addr, &r2.Hash, &r2.Port, &r2.Extra); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if version != 1 || r2.envelopeV1 != *v1 || r2.Port != 0 || r2.Extra != nil {
+		t.Fatalf("Result not match: version=%d, r2=%+v", version, r2)
+	}
+
+	// mismatched element type
+	buffer.Reset()
+
+	if err := WriteEnvelope(buffer, binary.BigEndian, 1, uint64(1)); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	var port uint16
+
+	if err := ReadEnvelope(buffer, binary.BigEndian, &version, &port); err != ErrUnexpectedBufferLength {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
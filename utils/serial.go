@@ -17,9 +17,12 @@
 package utils
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"io"
+	"reflect"
+	"sync/atomic"
 	"time"
 
 	"github.com/thunderdb/ThunderDB/crypto/asymmetric"
@@ -33,12 +36,73 @@ const (
 	maxBufferLength       = 1 << 20
 )
 
-// simpleSerializer is just a simple serializer with its own []byte pool, which is done by a
-// buffered []byte channel.
-type simpleSerializer chan []byte
+// lengthPrefix defines how the length of variable-length elements, such as string and []byte,
+// is encoded.
+type lengthPrefix int
+
+const (
+	// fixedLengthPrefix encodes length as a 4 bytes uint32 in the given byte order.
+	fixedLengthPrefix lengthPrefix = iota
+
+	// varLengthPrefix encodes length as an unsigned varint, see binary.PutUvarint.
+	varLengthPrefix
+)
+
+// maxLen returns the max length in bytes of the prefix.
+func (lp lengthPrefix) maxLen() int {
+	if lp == varLengthPrefix {
+		return binary.MaxVarintLen32
+	}
+
+	return 4
+}
+
+// SerializerOptions defines the buffer pool of a Serializer.
+type SerializerOptions struct {
+	// MaxPooledBuffers is the capacity of the buffer pool.
+	MaxPooledBuffers int
+
+	// BufferLength is the length of each pooled buffer, borrowing a larger buffer always
+	// allocates a new one.
+	BufferLength int
+
+	// BlockWhenExhausted bounds the pooled buffers in use to MaxPooledBuffers: once they are all
+	// borrowed, writing blocks until one is returned or the context is done, instead of
+	// allocating a new buffer. Oversized buffers are still allocated.
+	BlockWhenExhausted bool
+}
+
+// SerializerStats contains the buffer pool statistics of a Serializer.
+type SerializerStats struct {
+	// Hits is the count of buffers borrowed from the pool.
+	Hits uint64
+
+	// Misses is the count of buffers allocated because the pool is empty or the requested length
+	// exceeds SerializerOptions.BufferLength.
+	Misses uint64
+
+	// Waits is the count of borrowings blocked on an exhausted pool, only with
+	// SerializerOptions.BlockWhenExhausted.
+	Waits uint64
+}
+
+// Serializer is just a simple serializer with its own []byte pool, which is done by a buffered
+// []byte channel.
+type Serializer struct {
+	pool         chan []byte
+	bufferLength int
+	block        bool
+	allocated    int64
+	hits         uint64
+	misses       uint64
+	waits        uint64
+}
 
 var (
-	serializer simpleSerializer = make(chan []byte, maxPooledBufferNumber)
+	serializer = NewSerializer(SerializerOptions{
+		MaxPooledBuffers: maxPooledBufferNumber,
+		BufferLength:     pooledBufferLength,
+	})
 
 	// ErrBufferLengthExceedLimit indicates that a string length exceeds limit during
 	// deserialization.
@@ -50,35 +114,90 @@ var (
 
 	// ErrUnexpectedBufferLength indicates that the given buffer doesn't have length as specified.
 	ErrUnexpectedBufferLength = errors.New("unexpected buffer length")
+
+	// ErrOverlongVarint indicates that a varint length prefix is longer than its canonical
+	// encoding or overflows uint32 during deserialization.
+	ErrOverlongVarint = errors.New("overlong varint")
 )
 
-func (s simpleSerializer) borrowBuffer(len int) []byte {
-	if len > pooledBufferLength {
-		return make([]byte, len)
+// NewSerializer returns a new Serializer with the given pool options, non-positive values fall
+// back to the default ones used by the package-level functions.
+func NewSerializer(opts SerializerOptions) *Serializer {
+	if opts.MaxPooledBuffers <= 0 {
+		opts.MaxPooledBuffers = maxPooledBufferNumber
+	}
+
+	if opts.BufferLength <= 0 {
+		opts.BufferLength = pooledBufferLength
+	}
+
+	return &Serializer{
+		pool:         make(chan []byte, opts.MaxPooledBuffers),
+		bufferLength: opts.BufferLength,
+		block:        opts.BlockWhenExhausted,
+	}
+}
+
+// Stats returns the buffer pool statistics.
+func (s *Serializer) Stats() SerializerStats {
+	return SerializerStats{
+		Hits:   atomic.LoadUint64(&s.hits),
+		Misses: atomic.LoadUint64(&s.misses),
+		Waits:  atomic.LoadUint64(&s.waits),
+	}
+}
+
+func (s *Serializer) borrowBuffer(len int) []byte {
+	// Never fails without a deadline.
+	buffer, _ := s.borrowBufferContext(context.Background(), len)
+	return buffer
+}
+
+// borrowBufferContext borrows a buffer of length len, it waits for a returned buffer if the pool
+// is exhausted in blocking mode.
+func (s *Serializer) borrowBufferContext(ctx context.Context, len int) ([]byte, error) {
+	if len > s.bufferLength {
+		atomic.AddUint64(&s.misses, 1)
+		return make([]byte, len), nil
 	}
 
 	select {
-	case buffer := <-s:
-		return buffer[:len]
+	case buffer := <-s.pool:
+		atomic.AddUint64(&s.hits, 1)
+		return buffer[:len], nil
 	default:
 	}
 
-	return make([]byte, len, pooledBufferLength)
+	if s.block && atomic.AddInt64(&s.allocated, 1) > int64(cap(s.pool)) {
+		atomic.AddInt64(&s.allocated, -1)
+		atomic.AddUint64(&s.waits, 1)
+
+		select {
+		case buffer := <-s.pool:
+			atomic.AddUint64(&s.hits, 1)
+			return buffer[:len], nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	atomic.AddUint64(&s.misses, 1)
+	return make([]byte, len, s.bufferLength), nil
 }
 
-func (s simpleSerializer) returnBuffer(buffer []byte) {
-	// This guarantees all the buffers in free list are of the same size pooledBufferLength.
-	if cap(buffer) != pooledBufferLength {
+func (s *Serializer) returnBuffer(buffer []byte) {
+	// This guarantees all the buffers in free list are of the same size bufferLength.
+	if cap(buffer) != s.bufferLength {
 		return
 	}
 
 	select {
-	case s <- buffer:
+	case s.pool <- buffer:
 	default:
 	}
 }
 
-func (s simpleSerializer) readUint8(r io.Reader) (ret uint8, err error) {
+func (s *Serializer) readUint8(r io.Reader) (ret uint8, err error) {
 	buffer := s.borrowBuffer(1)
 	defer s.returnBuffer(buffer)
 
@@ -89,7 +208,7 @@ func (s simpleSerializer) readUint8(r io.Reader) (ret uint8, err error) {
 	return
 }
 
-func (s simpleSerializer) readUint16(r io.Reader, order binary.ByteOrder) (ret uint16, err error) {
+func (s *Serializer) readUint16(r io.Reader, order binary.ByteOrder) (ret uint16, err error) {
 	buffer := s.borrowBuffer(2)
 	defer s.returnBuffer(buffer)
 
@@ -100,7 +219,7 @@ func (s simpleSerializer) readUint16(r io.Reader, order binary.ByteOrder) (ret u
 	return
 }
 
-func (s simpleSerializer) readUint32(r io.Reader, order binary.ByteOrder) (ret uint32, err error) {
+func (s *Serializer) readUint32(r io.Reader, order binary.ByteOrder) (ret uint32, err error) {
 	buffer := s.borrowBuffer(4)
 	defer s.returnBuffer(buffer)
 
@@ -111,7 +230,7 @@ func (s simpleSerializer) readUint32(r io.Reader, order binary.ByteOrder) (ret u
 	return
 }
 
-func (s simpleSerializer) readUint64(r io.Reader, order binary.ByteOrder) (ret uint64, err error) {
+func (s *Serializer) readUint64(r io.Reader, order binary.ByteOrder) (ret uint64, err error) {
 	buffer := s.borrowBuffer(8)
 	defer s.returnBuffer(buffer)
 
@@ -122,6 +241,52 @@ func (s simpleSerializer) readUint64(r io.Reader, order binary.ByteOrder) (ret u
 	return
 }
 
+// readLength reads the length prefix of a variable-length element.
+func (s *Serializer) readLength(
+	r io.Reader, order binary.ByteOrder, lp lengthPrefix) (ret uint32, err error) {
+	if lp != varLengthPrefix {
+		return s.readUint32(r, order)
+	}
+
+	buffer := s.borrowBuffer(1)
+	defer s.returnBuffer(buffer)
+
+	var x uint64
+
+	for i, shift := 0, uint(0); i < binary.MaxVarintLen32; i, shift = i+1, shift+7 {
+		if _, err = io.ReadFull(r, buffer); err != nil {
+			if i > 0 && err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+
+			return
+		}
+
+		b := buffer[0]
+
+		if b < 0x80 {
+			// Zero last byte is a non-canonical encoding, except for zero itself
+			if i > 0 && b == 0 {
+				err = ErrOverlongVarint
+				return
+			}
+
+			if x |= uint64(b) << shift; x > 1<<32-1 {
+				err = ErrOverlongVarint
+				return
+			}
+
+			ret = uint32(x)
+			return
+		}
+
+		x |= uint64(b&0x7f) << shift
+	}
+
+	err = ErrOverlongVarint
+	return
+}
+
 // readString reads string from reader with the following format:
 //
 // 0     4                                 4+len
@@ -129,16 +294,16 @@ func (s simpleSerializer) readUint64(r io.Reader, order binary.ByteOrder) (ret u
 // | len |             string              |
 // +-----+---------------------------------+
 //
-func (s simpleSerializer) readString(r io.Reader, order binary.ByteOrder, ret *string) (err error) {
-	lenBuffer := s.borrowBuffer(4)
-	defer s.returnBuffer(lenBuffer)
+// The len field is a varint instead if lp is varLengthPrefix, so is the other variable-length
+// elements.
+func (s *Serializer) readString(
+	r io.Reader, order binary.ByteOrder, lp lengthPrefix, ret *string) (err error) {
+	var retLen uint32
 
-	if _, err = io.ReadFull(r, lenBuffer); err != nil {
+	if retLen, err = s.readLength(r, order, lp); err != nil {
 		return
 	}
 
-	retLen := order.Uint32(lenBuffer)
-
 	if retLen > maxBufferLength {
 		err = ErrBufferLengthExceedLimit
 		return
@@ -161,16 +326,14 @@ func (s simpleSerializer) readString(r io.Reader, order binary.ByteOrder, ret *s
 // | len |             bytes               |
 // +-----+---------------------------------+
 //
-func (s simpleSerializer) readBytes(r io.Reader, order binary.ByteOrder, ret *[]byte) (err error) {
-	lenBuffer := s.borrowBuffer(4)
-	defer s.returnBuffer(lenBuffer)
+func (s *Serializer) readBytes(
+	r io.Reader, order binary.ByteOrder, lp lengthPrefix, ret *[]byte) (err error) {
+	var retLen uint32
 
-	if _, err = io.ReadFull(r, lenBuffer); err != nil {
+	if retLen, err = s.readLength(r, order, lp); err != nil {
 		return
 	}
 
-	retLen := order.Uint32(lenBuffer)
-
 	if retLen > maxBufferLength {
 		err = ErrBufferLengthExceedLimit
 		return
@@ -197,7 +360,7 @@ func (s simpleSerializer) readBytes(r io.Reader, order binary.ByteOrder, ret *[]
 
 // readFixedSizeBytes reads fixed-size bytes from reader. It's used to read fixed-size array such
 // as Hash, which is a [32]byte array.
-func (s simpleSerializer) readFixedSizeBytes(r io.Reader, lenToRead int, ret []byte) (err error) {
+func (s *Serializer) readFixedSizeBytes(r io.Reader, lenToRead int, ret []byte) (err error) {
 	if len(ret) != lenToRead {
 		return ErrInsufficientBuffer
 	}
@@ -206,8 +369,14 @@ func (s simpleSerializer) readFixedSizeBytes(r io.Reader, lenToRead int, ret []b
 	return
 }
 
-func (s simpleSerializer) writeUint8(w io.Writer, val uint8) (err error) {
-	buffer := s.borrowBuffer(1)
+func (s *Serializer) writeUint8(
+	ctx context.Context, w io.Writer, val uint8) (err error) {
+	var buffer []byte
+
+	if buffer, err = s.borrowBufferContext(ctx, 1); err != nil {
+		return
+	}
+
 	defer s.returnBuffer(buffer)
 
 	buffer[0] = val
@@ -215,8 +384,14 @@ func (s simpleSerializer) writeUint8(w io.Writer, val uint8) (err error) {
 	return
 }
 
-func (s simpleSerializer) writeUint16(w io.Writer, order binary.ByteOrder, val uint16) (err error) {
-	buffer := s.borrowBuffer(2)
+func (s *Serializer) writeUint16(
+	ctx context.Context, w io.Writer, order binary.ByteOrder, val uint16) (err error) {
+	var buffer []byte
+
+	if buffer, err = s.borrowBufferContext(ctx, 2); err != nil {
+		return
+	}
+
 	defer s.returnBuffer(buffer)
 
 	order.PutUint16(buffer, val)
@@ -224,8 +399,14 @@ func (s simpleSerializer) writeUint16(w io.Writer, order binary.ByteOrder, val u
 	return
 }
 
-func (s simpleSerializer) writeUint32(w io.Writer, order binary.ByteOrder, val uint32) (err error) {
-	buffer := s.borrowBuffer(4)
+func (s *Serializer) writeUint32(
+	ctx context.Context, w io.Writer, order binary.ByteOrder, val uint32) (err error) {
+	var buffer []byte
+
+	if buffer, err = s.borrowBufferContext(ctx, 4); err != nil {
+		return
+	}
+
 	defer s.returnBuffer(buffer)
 
 	order.PutUint32(buffer, val)
@@ -233,8 +414,14 @@ func (s simpleSerializer) writeUint32(w io.Writer, order binary.ByteOrder, val u
 	return
 }
 
-func (s simpleSerializer) writeUint64(w io.Writer, order binary.ByteOrder, val uint64) (err error) {
-	buffer := s.borrowBuffer(8)
+func (s *Serializer) writeUint64(
+	ctx context.Context, w io.Writer, order binary.ByteOrder, val uint64) (err error) {
+	var buffer []byte
+
+	if buffer, err = s.borrowBufferContext(ctx, 8); err != nil {
+		return
+	}
+
 	defer s.returnBuffer(buffer)
 
 	order.PutUint64(buffer, val)
@@ -242,6 +429,18 @@ func (s simpleSerializer) writeUint64(w io.Writer, order binary.ByteOrder, val u
 	return
 }
 
+// putLength puts the length prefix of a variable-length element into buffer and returns the
+// number of bytes written.
+func (s *Serializer) putLength(
+	buffer []byte, order binary.ByteOrder, lp lengthPrefix, val uint32) int {
+	if lp == varLengthPrefix {
+		return binary.PutUvarint(buffer, uint64(val))
+	}
+
+	order.PutUint32(buffer, val)
+	return 4
+}
+
 // writeString writes string to writer with the following format:
 //
 //  0     4                                 4+len
@@ -249,14 +448,19 @@ func (s simpleSerializer) writeUint64(w io.Writer, order binary.ByteOrder, val u
 // | len |             string              |
 // +-----+---------------------------------+
 //
-func (s simpleSerializer) writeString(w io.Writer, order binary.ByteOrder, val *string) (err error) {
-	buffer := s.borrowBuffer(4 + len(*val))
+func (s *Serializer) writeString(ctx context.Context,
+	w io.Writer, order binary.ByteOrder, lp lengthPrefix, val *string) (err error) {
+	var buffer []byte
+
+	if buffer, err = s.borrowBufferContext(ctx, lp.maxLen()+len(*val)); err != nil {
+		return
+	}
+
 	defer s.returnBuffer(buffer)
 
-	valLen := uint32(len(*val))
-	order.PutUint32(buffer, valLen)
-	copy(buffer[4:], []byte(*val))
-	_, err = w.Write(buffer)
+	n := s.putLength(buffer, order, lp, uint32(len(*val)))
+	n += copy(buffer[n:], *val)
+	_, err = w.Write(buffer[:n])
 	return
 }
 
@@ -267,20 +471,25 @@ func (s simpleSerializer) writeString(w io.Writer, order binary.ByteOrder, val *
 // | len |             bytes               |
 // +-----+---------------------------------+
 //
-func (s simpleSerializer) writeBytes(w io.Writer, order binary.ByteOrder, val []byte) (err error) {
-	buffer := s.borrowBuffer(4 + len(val))
+func (s *Serializer) writeBytes(ctx context.Context,
+	w io.Writer, order binary.ByteOrder, lp lengthPrefix, val []byte) (err error) {
+	var buffer []byte
+
+	if buffer, err = s.borrowBufferContext(ctx, lp.maxLen()+len(val)); err != nil {
+		return
+	}
+
 	defer s.returnBuffer(buffer)
 
-	valLen := uint32(len(val))
-	order.PutUint32(buffer, valLen)
-	copy(buffer[4:], []byte(val))
-	_, err = w.Write(buffer)
+	n := s.putLength(buffer, order, lp, uint32(len(val)))
+	n += copy(buffer[n:], val)
+	_, err = w.Write(buffer[:n])
 	return
 }
 
 // writeFixedSizeBytes writes fixed-size bytes to wirter. It's used to write fixed-size array such
 // as Hash, which is a [32]byte array.
-func (s simpleSerializer) writeFixedSizeBytes(w io.Writer, lenToPut int, val []byte) (err error) {
+func (s *Serializer) writeFixedSizeBytes(w io.Writer, lenToPut int, val []byte) (err error) {
 	if len(val) != lenToPut {
 		return ErrUnexpectedBufferLength
 	}
@@ -289,78 +498,79 @@ func (s simpleSerializer) writeFixedSizeBytes(w io.Writer, lenToPut int, val []b
 	return
 }
 
-func readElement(r io.Reader, order binary.ByteOrder, element interface{}) (err error) {
+func (s *Serializer) readElement(
+	r io.Reader, order binary.ByteOrder, lp lengthPrefix, element interface{}) (err error) {
 	switch e := element.(type) {
 	case *bool:
 		var ret uint8
 
-		if ret, err = serializer.readUint8(r); err == nil {
+		if ret, err = s.readUint8(r); err == nil {
 			*e = (ret != 0x00)
 		}
 
 	case *int8:
 		var ret uint8
 
-		if ret, err = serializer.readUint8(r); err == nil {
+		if ret, err = s.readUint8(r); err == nil {
 			*e = int8(ret)
 		}
 
 	case *uint8:
-		*e, err = serializer.readUint8(r)
+		*e, err = s.readUint8(r)
 
 	case *int16:
 		var ret uint16
 
-		if ret, err = serializer.readUint16(r, order); err == nil {
+		if ret, err = s.readUint16(r, order); err == nil {
 			*e = int16(ret)
 		}
 
 	case *uint16:
-		*e, err = serializer.readUint16(r, order)
+		*e, err = s.readUint16(r, order)
 
 	case *int32:
 		var ret uint32
 
-		if ret, err = serializer.readUint32(r, order); err == nil {
+		if ret, err = s.readUint32(r, order); err == nil {
 			*e = int32(ret)
 		}
 
 	case *uint32:
-		*e, err = serializer.readUint32(r, order)
+		*e, err = s.readUint32(r, order)
 
 	case *int64:
 		var ret uint64
 
-		if ret, err = serializer.readUint64(r, order); err == nil {
+		if ret, err = s.readUint64(r, order); err == nil {
 			*e = int64(ret)
 		}
 
 	case *uint64:
-		*e, err = serializer.readUint64(r, order)
+		*e, err = s.readUint64(r, order)
 
 	case *time.Time:
 		var ret uint64
 
-		if ret, err = serializer.readUint64(r, order); err == nil {
+		if ret, err = s.readUint64(r, order); err == nil {
 			*e = time.Unix(0, int64(ret)).UTC()
 		}
 
 	case *string:
-		err = serializer.readString(r, order, e)
+		err = s.readString(r, order, lp, e)
 
 	case *[]byte:
-		err = serializer.readBytes(r, order, e)
+		err = s.readBytes(r, order, lp, e)
 
 	case *proto.NodeID:
-		err = serializer.readString(r, order, (*string)(e))
+		err = s.readString(r, order, lp, (*string)(e))
 
 	case *hash.Hash:
-		err = serializer.readFixedSizeBytes(r, hash.HashSize, (*e)[:])
+		err = s.readFixedSizeBytes(r, hash.HashSize, (*e)[:])
 
 	case **asymmetric.PublicKey:
 		var buffer []byte
 
-		if err = serializer.readBytes(r, order, &buffer); err == nil && len(buffer) > 0 {
+		if err = s.readBytes(r, order, lp, &buffer); err == nil && len(buffer) > 0 {
 			*e, err = asymmetric.ParsePubKey(buffer)
 		} else {
 			*e = nil
@@ -369,7 +579,7 @@ func readElement(r io.Reader, order binary.ByteOrder, element interface{}) (err
 	case **asymmetric.Signature:
 		var buffer []byte
 
-		if err = serializer.readBytes(r, order, &buffer); err == nil && len(buffer) > 0 {
+		if err = s.readBytes(r, order, lp, &buffer); err == nil && len(buffer) > 0 {
 			*e, err = asymmetric.ParseSignature(buffer)
 		} else {
 			*e = nil
@@ -383,20 +593,336 @@ func readElement(r io.Reader, order binary.ByteOrder, element interface{}) (err
 }
 
 // ReadElements reads the element list in order from the given reader.
+func (s *Serializer) ReadElements(
+	r io.Reader, order binary.ByteOrder, elements ...interface{}) (err error) {
+	return s.readElements(r, order, fixedLengthPrefix, elements)
+}
+
+// ReadElements reads the element list in order from the given reader with the default
+// Serializer.
 func ReadElements(r io.Reader, order binary.ByteOrder, elements ...interface{}) (err error) {
+	return serializer.ReadElements(r, order, elements...)
+}
+
+// countingReader counts the bytes read from the underlying reader.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (r *countingReader) Read(p []byte) (n int, err error) {
+	n, err = r.r.Read(p)
+	r.n += n
+	return
+}
+
+// ReadElementsPartial reads the element list in order like ReadElements, but stops without error
+// if the reader reaches EOF between elements, which usually happens when the trailing elements
+// are absent in an older version. It returns the count of elements read, the remaining elements
+// are set to their zero values. An EOF in the middle of an element is still reported as
+// io.ErrUnexpectedEOF.
+func (s *Serializer) ReadElementsPartial(
+	r io.Reader, order binary.ByteOrder, elements ...interface{}) (n int, err error) {
+	cr := &countingReader{r: r}
+
+	for ; n < len(elements); n++ {
+		cr.n = 0
+
+		if err = s.readElement(cr, order, fixedLengthPrefix, elements[n]); err != nil {
+			if err != io.EOF {
+				return
+			}
+
+			if cr.n != 0 {
+				err = io.ErrUnexpectedEOF
+				return
+			}
+
+			err = nil
+			break
+		}
+	}
+
+	zeroElements(elements[n:])
+	return
+}
+
+// ReadElementsPartial reads the element list in order like ReadElements with the default
+// Serializer, see Serializer.ReadElementsPartial.
+func ReadElementsPartial(
+	r io.Reader, order binary.ByteOrder, elements ...interface{}) (n int, err error) {
+	return serializer.ReadElementsPartial(r, order, elements...)
+}
+
+// zeroElements sets the elements, which are pointers, to their zero values.
+func zeroElements(elements []interface{}) {
 	for _, element := range elements {
-		if err = readElement(r, order, element); err != nil {
+		if v := reflect.ValueOf(element); v.Kind() == reflect.Ptr && !v.IsNil() {
+			v.Elem().Set(reflect.Zero(v.Elem().Type()))
+		}
+	}
+}
+
+// scalarSize returns the encoded size of element if it's a fixed-size scalar, or 0 otherwise.
+// Only the pointers are accepted if pointerOnly is set, since the others can't be read into.
+func scalarSize(element interface{}, pointerOnly bool) int {
+	switch element.(type) {
+	case *bool, *int8, *uint8:
+		return 1
+	case *int16, *uint16:
+		return 2
+	case *int32, *uint32:
+		return 4
+	case *int64, *uint64, *time.Time:
+		return 8
+	}
+
+	if pointerOnly {
+		return 0
+	}
+
+	switch element.(type) {
+	case bool, int8, uint8:
+		return 1
+	case int16, uint16:
+		return 2
+	case int32, uint32:
+		return 4
+	case int64, uint64, time.Time:
+		return 8
+	}
+
+	return 0
+}
+
+// scalarRun returns the count and the total encoded size of the leading fixed-size scalars in
+// elements.
+func scalarRun(elements []interface{}, pointerOnly bool) (n int, size int) {
+	for ; n < len(elements); n++ {
+		elementSize := scalarSize(elements[n], pointerOnly)
+
+		if elementSize == 0 {
 			break
 		}
+
+		size += elementSize
 	}
 
 	return
 }
 
-func writeElement(w io.Writer, order binary.ByteOrder, element interface{}) (err error) {
+// putScalar puts the fixed-size scalar element into buffer like writeElement and returns the
+// number of bytes written.
+func putScalar(buffer []byte, order binary.ByteOrder, element interface{}) int {
 	switch e := element.(type) {
 	case bool:
-		err = serializer.writeUint8(w, func() uint8 {
+		buffer[0] = 0x00
+
+		if e {
+			buffer[0] = 0x01
+		}
+
+		return 1
+	case *bool:
+		return putScalar(buffer, order, *e)
+	case int8:
+		buffer[0] = uint8(e)
+		return 1
+	case *int8:
+		buffer[0] = uint8(*e)
+		return 1
+	case uint8:
+		buffer[0] = e
+		return 1
+	case *uint8:
+		buffer[0] = *e
+		return 1
+	case int16:
+		order.PutUint16(buffer, uint16(e))
+		return 2
+	case *int16:
+		order.PutUint16(buffer, uint16(*e))
+		return 2
+	case uint16:
+		order.PutUint16(buffer, e)
+		return 2
+	case *uint16:
+		order.PutUint16(buffer, *e)
+		return 2
+	case int32:
+		order.PutUint32(buffer, uint32(e))
+		return 4
+	case *int32:
+		order.PutUint32(buffer, uint32(*e))
+		return 4
+	case uint32:
+		order.PutUint32(buffer, e)
+		return 4
+	case *uint32:
+		order.PutUint32(buffer, *e)
+		return 4
+	case int64:
+		order.PutUint64(buffer, uint64(e))
+		return 8
+	case *int64:
+		order.PutUint64(buffer, uint64(*e))
+		return 8
+	case uint64:
+		order.PutUint64(buffer, e)
+		return 8
+	case *uint64:
+		order.PutUint64(buffer, *e)
+		return 8
+	case time.Time:
+		order.PutUint64(buffer, uint64(e.UnixNano()))
+		return 8
+	case *time.Time:
+		order.PutUint64(buffer, uint64(e.UnixNano()))
+		return 8
+	}
+
+	return 0
+}
+
+// getScalar gets the fixed-size scalar element from buffer like readElement and returns the
+// number of bytes read.
+func getScalar(buffer []byte, order binary.ByteOrder, element interface{}) int {
+	switch e := element.(type) {
+	case *bool:
+		*e = (buffer[0] != 0x00)
+		return 1
+	case *int8:
+		*e = int8(buffer[0])
+		return 1
+	case *uint8:
+		*e = buffer[0]
+		return 1
+	case *int16:
+		*e = int16(order.Uint16(buffer))
+		return 2
+	case *uint16:
+		*e = order.Uint16(buffer)
+		return 2
+	case *int32:
+		*e = int32(order.Uint32(buffer))
+		return 4
+	case *uint32:
+		*e = order.Uint32(buffer)
+		return 4
+	case *int64:
+		*e = int64(order.Uint64(buffer))
+		return 8
+	case *uint64:
+		*e = order.Uint64(buffer)
+		return 8
+	case *time.Time:
+		*e = time.Unix(0, int64(order.Uint64(buffer))).UTC()
+		return 8
+	}
+
+	return 0
+}
+
+// readScalars reads the fixed-size scalar elements of total encoded size in a single read. The
+// result is the same as reading them one by one: the elements read completely are set, and
+// io.EOF is returned if the reader ends between elements.
+func (s *Serializer) readScalars(
+	r io.Reader, order binary.ByteOrder, elements []interface{}, size int) (err error) {
+	buffer := s.borrowBuffer(size)
+	defer s.returnBuffer(buffer)
+
+	read, err := io.ReadFull(r, buffer)
+
+	for _, element := range elements {
+		elementSize := scalarSize(element, true)
+
+		if read < elementSize {
+			if err == io.ErrUnexpectedEOF && read == 0 {
+				err = io.EOF
+			}
+
+			return
+		}
+
+		getScalar(buffer, order, element)
+		buffer, read = buffer[elementSize:], read-elementSize
+	}
+
+	return
+}
+
+// writeScalars writes the fixed-size scalar elements of total encoded size in a single write.
+func (s *Serializer) writeScalars(ctx context.Context,
+	w io.Writer, order binary.ByteOrder, elements []interface{}, size int) (err error) {
+	var buffer []byte
+
+	if buffer, err = s.borrowBufferContext(ctx, size); err != nil {
+		return
+	}
+
+	defer s.returnBuffer(buffer)
+
+	for offset, i := 0, 0; i < len(elements); i++ {
+		offset += putScalar(buffer[offset:], order, elements[i])
+	}
+
+	_, err = w.Write(buffer)
+	return
+}
+
+// readElements reads the element list in order, the consecutive fixed-size scalars are read in
+// a single read.
+func (s *Serializer) readElements(
+	r io.Reader, order binary.ByteOrder, lp lengthPrefix, elements []interface{}) (err error) {
+	for i := 0; i < len(elements); {
+		if n, size := scalarRun(elements[i:], true); n > 1 {
+			if err = s.readScalars(r, order, elements[i:i+n], size); err != nil {
+				return
+			}
+
+			i += n
+			continue
+		}
+
+		if err = s.readElement(r, order, lp, elements[i]); err != nil {
+			return
+		}
+
+		i++
+	}
+
+	return
+}
+
+// writeElements writes the element list in order, the consecutive fixed-size scalars are written
+// in a single write with the same layout as writing them one by one.
+func (s *Serializer) writeElements(ctx context.Context,
+	w io.Writer, order binary.ByteOrder, lp lengthPrefix, elements []interface{}) (err error) {
+	for i := 0; i < len(elements); {
+		if n, size := scalarRun(elements[i:], false); n > 1 {
+			if err = s.writeScalars(ctx, w, order, elements[i:i+n], size); err != nil {
+				return
+			}
+
+			i += n
+			continue
+		}
+
+		if err = s.writeElement(ctx, w, order, lp, elements[i]); err != nil {
+			return
+		}
+
+		i++
+	}
+
+	return
+}
+
+func (s *Serializer) writeElement(ctx context.Context,
+	w io.Writer, order binary.ByteOrder, lp lengthPrefix, element interface{}) (err error) {
+	switch e := element.(type) {
+	case bool:
+		err = s.writeUint8(ctx, w, func() uint8 {
 			if e {
 				return uint8(0x01)
 			}
@@ -405,7 +931,7 @@ func writeElement(w io.Writer, order binary.ByteOrder, element interface{}) (err
 		}())
 
 	case *bool:
-		err = serializer.writeUint8(w, func() uint8 {
+		err = s.writeUint8(ctx, w, func() uint8 {
 			if *e {
 				return uint8(0x01)
 			}
@@ -414,109 +940,109 @@ func writeElement(w io.Writer, order binary.ByteOrder, element interface{}) (err
 		}())
 
 	case int8:
-		err = serializer.writeUint8(w, uint8(e))
+		err = s.writeUint8(ctx, w, uint8(e))
 
 	case *int8:
-		err = serializer.writeUint8(w, uint8(*e))
+		err = s.writeUint8(ctx, w, uint8(*e))
 
 	case uint8:
-		err = serializer.writeUint8(w, e)
+		err = s.writeUint8(ctx, w, e)
 
 	case *uint8:
-		err = serializer.writeUint8(w, *e)
+		err = s.writeUint8(ctx, w, *e)
 
 	case int16:
-		err = serializer.writeUint16(w, order, uint16(e))
+		err = s.writeUint16(ctx, w, order, uint16(e))
 
 	case *int16:
-		err = serializer.writeUint16(w, order, uint16(*e))
+		err = s.writeUint16(ctx, w, order, uint16(*e))
 
 	case uint16:
-		err = serializer.writeUint16(w, order, e)
+		err = s.writeUint16(ctx, w, order, e)
 
 	case *uint16:
-		err = serializer.writeUint16(w, order, *e)
+		err = s.writeUint16(ctx, w, order, *e)
 
 	case int32:
-		err = serializer.writeUint32(w, order, uint32(e))
+		err = s.writeUint32(ctx, w, order, uint32(e))
 
 	case *int32:
-		err = serializer.writeUint32(w, order, uint32(*e))
+		err = s.writeUint32(ctx, w, order, uint32(*e))
 
 	case uint32:
-		err = serializer.writeUint32(w, order, e)
+		err = s.writeUint32(ctx, w, order, e)
 
 	case *uint32:
-		err = serializer.writeUint32(w, order, *e)
+		err = s.writeUint32(ctx, w, order, *e)
 
 	case int64:
-		err = serializer.writeUint64(w, order, uint64(e))
+		err = s.writeUint64(ctx, w, order, uint64(e))
 
 	case *int64:
-		err = serializer.writeUint64(w, order, uint64(*e))
+		err = s.writeUint64(ctx, w, order, uint64(*e))
 
 	case uint64:
-		err = serializer.writeUint64(w, order, e)
+		err = s.writeUint64(ctx, w, order, e)
 
 	case *uint64:
-		err = serializer.writeUint64(w, order, *e)
+		err = s.writeUint64(ctx, w, order, *e)
 
 	case string:
-		err = serializer.writeString(w, order, &e)
+		err = s.writeString(ctx, w, order, lp, &e)
 
 	case *string:
-		err = serializer.writeString(w, order, e)
+		err = s.writeString(ctx, w, order, lp, e)
 
 	case []byte:
-		err = serializer.writeBytes(w, order, e)
+		err = s.writeBytes(ctx, w, order, lp, e)
 
 	case *[]byte:
-		err = serializer.writeBytes(w, order, *e)
+		err = s.writeBytes(ctx, w, order, lp, *e)
 
 	case time.Time:
-		err = serializer.writeUint64(w, order, (uint64)(e.UnixNano()))
+		err = s.writeUint64(ctx, w, order, (uint64)(e.UnixNano()))
 
 	case *time.Time:
-		err = serializer.writeUint64(w, order, (uint64)(e.UnixNano()))
+		err = s.writeUint64(ctx, w, order, (uint64)(e.UnixNano()))
 
 	case proto.NodeID:
-		err = serializer.writeString(w, order, (*string)(&e))
+		err = s.writeString(ctx, w, order, lp, (*string)(&e))
 
 	case *proto.NodeID:
-		err = serializer.writeString(w, order, (*string)(e))
+		err = s.writeString(ctx, w, order, lp, (*string)(e))
 
 	case hash.Hash:
-		err = serializer.writeFixedSizeBytes(w, hash.HashSize, e[:])
+		err = s.writeFixedSizeBytes(w, hash.HashSize, e[:])
 
 	case *hash.Hash:
-		err = serializer.writeFixedSizeBytes(w, hash.HashSize, (*e)[:])
+		err = s.writeFixedSizeBytes(w, hash.HashSize, (*e)[:])
 
 	case *asymmetric.PublicKey:
 		if e == nil {
-			err = serializer.writeBytes(w, order, nil)
+			err = s.writeBytes(ctx, w, order, lp, nil)
 		} else {
-			err = serializer.writeBytes(w, order, e.Serialize())
+			err = s.writeBytes(ctx, w, order, lp, e.Serialize())
 		}
 
 	case **asymmetric.PublicKey:
 		if *e == nil {
-			err = serializer.writeBytes(w, order, nil)
+			err = s.writeBytes(ctx, w, order, lp, nil)
 		} else {
-			err = serializer.writeBytes(w, order, (*e).Serialize())
+			err = s.writeBytes(ctx, w, order, lp, (*e).Serialize())
 		}
 
 	case *asymmetric.Signature:
 		if e == nil {
-			err = serializer.writeBytes(w, order, nil)
+			err = s.writeBytes(ctx, w, order, lp, nil)
 		} else {
-			err = serializer.writeBytes(w, order, e.Serialize())
+			err = s.writeBytes(ctx, w, order, lp, e.Serialize())
 		}
 
 	case **asymmetric.Signature:
 		if *e == nil {
-			err = serializer.writeBytes(w, order, nil)
+			err = s.writeBytes(ctx, w, order, lp, nil)
 		} else {
-			err = serializer.writeBytes(w, order, (*e).Serialize())
+			err = s.writeBytes(ctx, w, order, lp, (*e).Serialize())
 		}
 
 	default:
@@ -527,12 +1053,55 @@ func writeElement(w io.Writer, order binary.ByteOrder, element interface{}) (err
 }
 
 // WriteElements writes the element list in order to the given writer.
+func (s *Serializer) WriteElements(
+	w io.Writer, order binary.ByteOrder, elements ...interface{}) (err error) {
+	return s.WriteElementsContext(context.Background(), w, order, elements...)
+}
+
+// WriteElementsContext writes the element list like WriteElements, but returns the context
+// error if it is done while waiting for a pooled buffer, see
+// SerializerOptions.BlockWhenExhausted.
+func (s *Serializer) WriteElementsContext(ctx context.Context,
+	w io.Writer, order binary.ByteOrder, elements ...interface{}) (err error) {
+	return s.writeElements(ctx, w, order, fixedLengthPrefix, elements)
+}
+
+// WriteElements writes the element list in order to the given writer with the default
+// Serializer.
 func WriteElements(w io.Writer, order binary.ByteOrder, elements ...interface{}) (err error) {
-	for _, element := range elements {
-		if err = writeElement(w, order, element); err != nil {
-			break
-		}
-	}
+	return serializer.WriteElements(w, order, elements...)
+}
 
-	return
+// ReadElementsCompact reads the element list written by WriteElementsCompact in order from the
+// given reader.
+func (s *Serializer) ReadElementsCompact(
+	r io.Reader, order binary.ByteOrder, elements ...interface{}) (err error) {
+	return s.readElements(r, order, varLengthPrefix, elements)
+}
+
+// ReadElementsCompact reads the element list written by WriteElementsCompact in order from the
+// given reader with the default Serializer.
+func ReadElementsCompact(r io.Reader, order binary.ByteOrder, elements ...interface{}) (err error) {
+	return serializer.ReadElementsCompact(r, order, elements...)
+}
+
+// WriteElementsCompact writes the element list in order to the given writer like WriteElements,
+// but the length prefixes of variable-length elements are encoded as varints. Scalar elements are
+// encoded identically.
+func (s *Serializer) WriteElementsCompact(
+	w io.Writer, order binary.ByteOrder, elements ...interface{}) (err error) {
+	return s.WriteElementsCompactContext(context.Background(), w, order, elements...)
+}
+
+// WriteElementsCompactContext writes the element list like WriteElementsCompact with the
+// context, see WriteElementsContext.
+func (s *Serializer) WriteElementsCompactContext(ctx context.Context,
+	w io.Writer, order binary.ByteOrder, elements ...interface{}) (err error) {
+	return s.writeElements(ctx, w, order, varLengthPrefix, elements)
+}
+
+// WriteElementsCompact writes the element list in order to the given writer like WriteElements
+// with the default Serializer.
+func WriteElementsCompact(w io.Writer, order binary.ByteOrder, elements ...interface{}) (err error) {
+	return serializer.WriteElementsCompact(w, order, elements...)
 }
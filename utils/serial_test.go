@@ -18,7 +18,9 @@ package utils
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"io"
 	"math/rand"
 	"reflect"
 	"sync"
@@ -188,6 +190,55 @@ func (s *testStruct) UnmarshalBinary(b []byte) error {
 	)
 }
 
+func (s *testStruct) MarshalBinaryCompact() ([]byte, error) {
+	buffer := bytes.NewBuffer(nil)
+
+	if err := WriteElementsCompact(buffer, binary.BigEndian,
+		s.BoolField,
+		s.Int8Field,
+		s.Uint8Field,
+		s.Int16Field,
+		s.Uint16Field,
+		s.Int32Field,
+		s.Uint32Field,
+		s.Int64Field,
+		s.Uint64Field,
+		s.StringField,
+		s.BytesField,
+		s.TimeField,
+		s.NodeIDField,
+		s.HashField,
+		s.PublicKeyField,
+		s.SignatureField,
+	); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+func (s *testStruct) UnmarshalBinaryCompact(b []byte) error {
+	reader := bytes.NewReader(b)
+	return ReadElementsCompact(reader, binary.BigEndian,
+		&s.BoolField,
+		&s.Int8Field,
+		&s.Uint8Field,
+		&s.Int16Field,
+		&s.Uint16Field,
+		&s.Int32Field,
+		&s.Uint32Field,
+		&s.Int64Field,
+		&s.Uint64Field,
+		&s.StringField,
+		&s.BytesField,
+		&s.TimeField,
+		&s.NodeIDField,
+		&s.HashField,
+		&s.PublicKeyField,
+		&s.SignatureField,
+	)
+}
+
 func TestNullValueSerialization(t *testing.T) {
 	ots := &testStruct{}
 	// XXX(leventeliu): beware of the zero value flaw -- time.Time zero value (January 1, year 1,
@@ -281,6 +332,398 @@ func TestSerialization(t *testing.T) {
 	wg.Wait()
 }
 
+func TestCompactSerialization(t *testing.T) {
+	ots := &testStruct{}
+	rts := &testStruct{}
+
+	for i := 0; i < testRounds; i++ {
+		ots.randomize()
+		cenc, err := ots.MarshalBinaryCompact()
+
+		if err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+
+		if err = rts.UnmarshalBinaryCompact(cenc); err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+
+		if !reflect.DeepEqual(ots, rts) {
+			t.Fatalf("Result not match: \n\tt1=%+v\n\tt2=%+v", ots, rts)
+		}
+
+		enc, err := ots.MarshalBinary()
+
+		if err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+
+		// 5 variable-length fields, each saves at least 2 bytes since all the lengths are
+		// less than 1<<14
+		if len(cenc)+10 > len(enc) {
+			t.Fatalf("Compact encoding is not compact: %d v.s. %d", len(cenc), len(enc))
+		}
+	}
+}
+
+func TestCompactLengthPrefix(t *testing.T) {
+	for _, l := range []int{0, 1, 0x7f, 0x80, 0x3fff, 0x4000, maxBufferLength} {
+		buffer := bytes.NewBuffer(nil)
+		val := make([]byte, l)
+		rand.Read(val)
+
+		if err := WriteElementsCompact(buffer, binary.BigEndian, val); err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+
+		var uvarint [binary.MaxVarintLen64]byte
+
+		if expected := binary.PutUvarint(uvarint[:], uint64(l)) + l; buffer.Len() != expected {
+			t.Fatalf("Unexpected encoding length: %d v.s. %d", buffer.Len(), expected)
+		}
+
+		var ret []byte
+
+		if err := ReadElementsCompact(buffer, binary.BigEndian, &ret); err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+
+		if !bytes.Equal(val, ret) {
+			t.Fatalf("Result not match: length = %d", l)
+		}
+	}
+
+	for _, c := range []struct {
+		enc []byte
+		err error
+	}{
+		{[]byte{0x80, 0x00}, ErrOverlongVarint},
+		{[]byte{0x81, 0x80, 0x00}, ErrOverlongVarint},
+		{[]byte{0xff, 0xff, 0xff, 0xff, 0x10}, ErrOverlongVarint},
+		{[]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0x01}, ErrOverlongVarint},
+		{[]byte{0x81, 0x80, 0x80, 0x01}, ErrBufferLengthExceedLimit},
+		{[]byte{0x80}, io.ErrUnexpectedEOF},
+		{[]byte{0x05, 'a', 'b'}, io.ErrUnexpectedEOF},
+	} {
+		var str string
+
+		if err := ReadElementsCompact(bytes.NewReader(c.enc), binary.BigEndian, &str); err != c.err {
+			t.Fatalf("Unexpected error for %x: %v v.s. %v", c.enc, err, c.err)
+		}
+	}
+}
+
+func TestReadElementsPartial(t *testing.T) {
+	var (
+		ouint  = rand.Uint32()
+		ostr   = "test"
+		obytes = []byte{0x01, 0x02, 0x03}
+		ohash  = hash.HashH([]byte(ostr))
+		otime  = time.Unix(0, time.Now().UnixNano()).UTC()
+	)
+
+	buffer := bytes.NewBuffer(nil)
+	boundaries := []int{0}
+
+	for _, element := range []interface{}{ouint, ostr, obytes, ohash, otime} {
+		if err := WriteElements(buffer, binary.BigEndian, element); err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+
+		boundaries = append(boundaries, buffer.Len())
+	}
+
+	enc := buffer.Bytes()
+
+	for i, boundary := range boundaries {
+		ruint, rstr, rbytes, rhash, rtime := uint32(1), "x", []byte{0x01}, hash.Hash{0x01},
+			time.Now()
+		n, err := ReadElementsPartial(bytes.NewReader(enc[:boundary]), binary.BigEndian,
+			&ruint, &rstr, &rbytes, &rhash, &rtime)
+
+		if err != nil {
+			t.Fatalf("Error occurred at boundary %d: %v", i, err)
+		}
+
+		if n != i {
+			t.Fatalf("Unexpected populated count at boundary %d: %d", i, n)
+		}
+
+		expected := []interface{}{ouint, ostr, obytes, ohash, otime}
+		zeros := []interface{}{uint32(0), "", []byte(nil), hash.Hash{}, time.Time{}}
+		copy(expected[n:], zeros[n:])
+
+		if !reflect.DeepEqual(
+			[]interface{}{ruint, rstr, rbytes, rhash, rtime}, expected) {
+			t.Fatalf("Result not match at boundary %d: %v, %v, %v, %v, %v",
+				i, ruint, rstr, rbytes, rhash, rtime)
+		}
+
+		if i == len(boundaries)-1 {
+			break
+		}
+
+		// truncated in the middle of the next element
+		n, err = ReadElementsPartial(bytes.NewReader(enc[:boundary+1]), binary.BigEndian,
+			&ruint, &rstr, &rbytes, &rhash, &rtime)
+
+		if err != io.ErrUnexpectedEOF || n != i {
+			t.Fatalf("Unexpected result at boundary %d: %d, %v", i, n, err)
+		}
+	}
+}
+
+// scalarElements returns the scalar fields of s, as values or pointers.
+func (s *testStruct) scalarElements(pointers bool) []interface{} {
+	if pointers {
+		return []interface{}{
+			&s.BoolField, &s.Int8Field, &s.Uint8Field, &s.Int16Field, &s.Uint16Field,
+			&s.Int32Field, &s.Uint32Field, &s.Int64Field, &s.Uint64Field, &s.TimeField,
+		}
+	}
+
+	return []interface{}{
+		s.BoolField, s.Int8Field, s.Uint8Field, s.Int16Field, s.Uint16Field,
+		s.Int32Field, s.Uint32Field, s.Int64Field, s.Uint64Field, s.TimeField,
+	}
+}
+
+// writeElementsPerField writes the elements one by one without the scalar fast path.
+func writeElementsPerField(w io.Writer, order binary.ByteOrder, elements ...interface{}) error {
+	for _, element := range elements {
+		if err := serializer.writeElement(
+			context.Background(), w, order, fixedLengthPrefix, element); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readElementsPerField reads the elements one by one without the scalar fast path.
+func readElementsPerField(r io.Reader, order binary.ByteOrder, elements ...interface{}) error {
+	for _, element := range elements {
+		if err := serializer.readElement(r, order, fixedLengthPrefix, element); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func TestScalarFastPath(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.BigEndian, binary.LittleEndian} {
+		for i := 0; i < testRounds; i++ {
+			ots := &testStruct{}
+			ots.randomize()
+
+			for _, pointers := range []bool{false, true} {
+				// mix scalar runs with the other elements
+				elements := append([]interface{}{ots.StringField}, ots.scalarElements(pointers)...)
+				elements = append(elements, ots.HashField, ots.Int32Field)
+
+				expected := bytes.NewBuffer(nil)
+
+				if err := writeElementsPerField(expected, order, elements...); err != nil {
+					t.Fatalf("Error occurred: %v", err)
+				}
+
+				actual := bytes.NewBuffer(nil)
+
+				if err := WriteElements(actual, order, elements...); err != nil {
+					t.Fatalf("Error occurred: %v", err)
+				}
+
+				if !bytes.Equal(expected.Bytes(), actual.Bytes()) {
+					t.Fatalf("Encoding mismatch: expected %x, got %x",
+						expected.Bytes(), actual.Bytes())
+				}
+			}
+
+			enc := bytes.NewBuffer(nil)
+
+			if err := WriteElements(enc, order, ots.scalarElements(false)...); err != nil {
+				t.Fatalf("Error occurred: %v", err)
+			}
+
+			// truncated at and between elements
+			for length := 0; length <= enc.Len(); length++ {
+				expected, actual := &testStruct{}, &testStruct{}
+				expectedErr := readElementsPerField(bytes.NewReader(enc.Bytes()[:length]), order,
+					expected.scalarElements(true)...)
+				actualErr := ReadElements(bytes.NewReader(enc.Bytes()[:length]), order,
+					actual.scalarElements(true)...)
+
+				if expectedErr != actualErr {
+					t.Fatalf("Error mismatch at length %d: expected %v, got %v",
+						length, expectedErr, actualErr)
+				}
+
+				if !reflect.DeepEqual(expected, actual) {
+					t.Fatalf("Result mismatch at length %d:\n\tExpected = %+v\n\tActual = %+v\n",
+						length, expected, actual)
+				}
+			}
+		}
+	}
+}
+
+func TestSerializerOptions(t *testing.T) {
+	s := NewSerializer(SerializerOptions{MaxPooledBuffers: 4, BufferLength: 256})
+
+	if stats := s.Stats(); stats.Hits != 0 || stats.Misses != 0 {
+		t.Fatalf("Unexpected initial stats: %+v", stats)
+	}
+
+	// oversized elements are always allocated
+	val := make([]byte, 1024)
+	rand.Read(val)
+	buffer := bytes.NewBuffer(nil)
+
+	if err := s.WriteElements(buffer, binary.BigEndian, val); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	var ret []byte
+
+	if err := s.ReadElements(buffer, binary.BigEndian, &ret); err != nil {
+		t.Fatalf("Error occurred: %v", err)
+	}
+
+	if !bytes.Equal(val, ret) {
+		t.Fatal("Result not match")
+	}
+
+	stats := s.Stats()
+
+	if stats.Misses == 0 {
+		t.Fatalf("Oversized buffer should be counted as a miss: %+v", stats)
+	}
+
+	// the same pooled buffer is reused by the following calls
+	for i := 0; i < testRounds; i++ {
+		if err := s.WriteElements(buffer, binary.BigEndian, val[:128]); err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+
+		if err := s.ReadElements(buffer, binary.BigEndian, &ret); err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+
+		if !bytes.Equal(val[:128], ret) {
+			t.Fatal("Result not match")
+		}
+	}
+
+	if stats = s.Stats(); stats.Hits < uint64(testRounds) {
+		t.Fatalf("Pooled buffers should be reused: %+v", stats)
+	}
+
+	// default options
+	s = NewSerializer(SerializerOptions{})
+
+	if s.bufferLength != pooledBufferLength || cap(s.pool) != maxPooledBufferNumber {
+		t.Fatalf("Unexpected default options: %d, %d", s.bufferLength, cap(s.pool))
+	}
+}
+
+func TestSerializerBlockWhenExhausted(t *testing.T) {
+	for _, block := range []bool{true, false} {
+		s := NewSerializer(SerializerOptions{
+			MaxPooledBuffers:   2,
+			BufferLength:       256,
+			BlockWhenExhausted: block,
+		})
+
+		// exhaust the pool
+		b1, b2 := s.borrowBuffer(1), s.borrowBuffer(1)
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		err := s.WriteElementsContext(ctx, bytes.NewBuffer(nil), binary.BigEndian, uint64(1))
+		cancel()
+
+		if block && err != context.DeadlineExceeded {
+			t.Fatalf("Unexpected error: %v", err)
+		} else if !block && err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+
+		// blocked writing proceeds once a buffer is returned
+		done := make(chan error)
+
+		go func() {
+			done <- s.WriteElementsContext(
+				context.Background(), bytes.NewBuffer(nil), binary.BigEndian, "test")
+		}()
+
+		if block {
+			select {
+			case err = <-done:
+				t.Fatalf("Writing should be blocked: %v", err)
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+
+		s.returnBuffer(b1)
+
+		if err = <-done; err != nil {
+			t.Fatalf("Error occurred: %v", err)
+		}
+
+		s.returnBuffer(b2)
+
+		// concurrent serializers
+		wg := &sync.WaitGroup{}
+
+		for i := 0; i < testGoRoutines; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				buffer := bytes.NewBuffer(nil)
+				val := make([]byte, 128)
+
+				for i := 0; i < testRounds; i++ {
+					rand.Read(val)
+					ostr, obytes, ouint := string(val[:64]), val[64:], rand.Uint64()
+
+					if err := s.WriteElementsContext(context.Background(), buffer,
+						binary.BigEndian, ostr, obytes, ouint); err != nil {
+						t.Errorf("Error occurred: %v", err)
+						return
+					}
+
+					var (
+						rstr   string
+						rbytes []byte
+						ruint  uint64
+					)
+
+					if err := s.ReadElements(buffer, binary.BigEndian,
+						&rstr, &rbytes, &ruint); err != nil {
+						t.Errorf("Error occurred: %v", err)
+						return
+					}
+
+					if rstr != ostr || !bytes.Equal(rbytes, obytes) || ruint != ouint {
+						t.Errorf("Result not match")
+						return
+					}
+				}
+			}()
+		}
+
+		wg.Wait()
+
+		stats := s.Stats()
+
+		if block && (stats.Misses > 2 || stats.Waits == 0) {
+			t.Fatalf("Pooled buffers should be bounded: %+v", stats)
+		} else if !block && stats.Waits != 0 {
+			t.Fatalf("Non-blocking serializer should never wait: %+v", stats)
+		}
+	}
+}
+
 func BenchmarkMarshalBinary(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		b.StopTimer()
@@ -331,3 +774,93 @@ func BenchmarkUnmarshalBinary(b *testing.B) {
 		b.StopTimer()
 	}
 }
+
+func benchmarkEncodedSize(b *testing.B, marshal func(*testStruct) ([]byte, error)) {
+	size := 0
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		st := &testStruct{}
+		st.randomize()
+		b.StartTimer()
+
+		enc, err := marshal(st)
+
+		if err != nil {
+			b.Fatalf("Error occurred: %v", err)
+		}
+
+		b.StopTimer()
+		size += len(enc)
+	}
+
+	b.SetBytes(int64(size / b.N))
+	b.Logf("Average encoded size: %d bytes", size/b.N)
+}
+
+func BenchmarkEncodedSize(b *testing.B) {
+	benchmarkEncodedSize(b, (*testStruct).MarshalBinary)
+}
+
+func BenchmarkEncodedSizeCompact(b *testing.B) {
+	benchmarkEncodedSize(b, (*testStruct).MarshalBinaryCompact)
+}
+
+func benchmarkWriteScalars(b *testing.B,
+	write func(io.Writer, binary.ByteOrder, ...interface{}) error) {
+	st := &testStruct{}
+	st.randomize()
+	elements := st.scalarElements(true)
+	buffer := bytes.NewBuffer(make([]byte, 0, 64))
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		buffer.Reset()
+
+		if err := write(buffer, binary.BigEndian, elements...); err != nil {
+			b.Fatalf("Error occurred: %v", err)
+		}
+	}
+}
+
+func BenchmarkWriteScalars(b *testing.B) {
+	benchmarkWriteScalars(b, WriteElements)
+}
+
+func BenchmarkWriteScalarsPerField(b *testing.B) {
+	benchmarkWriteScalars(b, writeElementsPerField)
+}
+
+func benchmarkReadScalars(b *testing.B,
+	read func(io.Reader, binary.ByteOrder, ...interface{}) error) {
+	st := &testStruct{}
+	st.randomize()
+	buffer := bytes.NewBuffer(nil)
+
+	if err := WriteElements(buffer, binary.BigEndian, st.scalarElements(false)...); err != nil {
+		b.Fatalf("Error occurred: %v", err)
+	}
+
+	enc := buffer.Bytes()
+	elements := st.scalarElements(true)
+	reader := bytes.NewReader(enc)
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		reader.Reset(enc)
+
+		if err := read(reader, binary.BigEndian, elements...); err != nil {
+			b.Fatalf("Error occurred: %v", err)
+		}
+	}
+}
+
+func BenchmarkReadScalars(b *testing.B) {
+	benchmarkReadScalars(b, ReadElements)
+}
+
+func BenchmarkReadScalarsPerField(b *testing.B) {
+	benchmarkReadScalars(b, readElementsPerField)
+}